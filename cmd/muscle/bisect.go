@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nicolagi/muscle/internal/config"
+	"github.com/nicolagi/muscle/internal/storage"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// How many revisions bisect examines looking for the good revision in
+// the bad revision's lineage.
+const bisectLimit = 1000
+
+// bisection is the state of a bisect session, persisted between
+// invocations of the bisect command.
+type bisection struct {
+	tag  string // Whose parents make up the lineage.
+	good storage.Pointer
+	bad  storage.Pointer
+}
+
+func loadBisection(pathname string) (*bisection, error) {
+	const method = "loadBisection"
+	f, err := os.Open(pathname)
+	if os.IsNotExist(err) {
+		return nil, errorf(method, "no bisect session, run bisect start")
+	}
+	if err != nil {
+		return nil, errorf(method, "%v", err)
+	}
+	defer func() { _ = f.Close() }()
+	b := new(bisection)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 {
+			return nil, errorf(method, "malformed line %q", s.Text())
+		}
+		switch fields[0] {
+		case "tag":
+			b.tag = fields[1]
+		case "good", "bad":
+			p, err := storage.NewPointerFromHex(fields[1])
+			if err != nil {
+				return nil, errorf(method, "line %q: %v", s.Text(), err)
+			}
+			if fields[0] == "good" {
+				b.good = p
+			} else {
+				b.bad = p
+			}
+		default:
+			return nil, errorf(method, "malformed line %q", s.Text())
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errorf(method, "%v", err)
+	}
+	return b, nil
+}
+
+func (b *bisection) save(pathname string) error {
+	const method = "bisection.save"
+	var buf bytes.Buffer
+	_, _ = fmt.Fprintf(&buf, "tag %s\n", b.tag)
+	if !b.good.IsNull() {
+		_, _ = fmt.Fprintf(&buf, "good %s\n", b.good.Hex())
+	}
+	if !b.bad.IsNull() {
+		_, _ = fmt.Fprintf(&buf, "bad %s\n", b.bad.Hex())
+	}
+	if err := ioutil.WriteFile(pathname+".new", buf.Bytes(), 0600); err != nil {
+		return errorf(method, "%v", err)
+	}
+	if err := os.Rename(pathname+".new", pathname); err != nil {
+		return errorf(method, "%v", err)
+	}
+	return nil
+}
+
+// bisectMidpoint takes the lineage of the bad revision, i.e., the keys
+// of the bad revision and of its ancestors, most recent first, and
+// returns the revision to test next, halfway between the bad and the
+// good revisions, and how many revisions are left to test. If none
+// are left, the bad revision is the first bad one.
+func bisectMidpoint(lineage []storage.Pointer, good storage.Pointer) (mid storage.Pointer, left int, err error) {
+	const method = "bisectMidpoint"
+	for i, key := range lineage {
+		if key.Equals(good) {
+			if i <= 1 {
+				return storage.Null, 0, nil
+			}
+			// Strictly between the bad and the good revisions.
+			return lineage[1+(i-1)/2], i - 1, nil
+		}
+	}
+	return storage.Null, 0, errorf(method, "good revision %v is not an ancestor of the bad revision %v (within %d revisions)", good, lineage[0], len(lineage))
+}
+
+// doBisect runs a bisect subcommand: start, good, bad, or reset.
+// Revisions to test are in the musclefs mount, at their hex keys.
+func doBisect(w io.Writer, cfg *config.C, treeStore *tree.Store, base string, subcommand string, tagName string, args []string) error {
+	const method = "doBisect"
+	pathname := filepath.Join(base, "bisect")
+	switch subcommand {
+	case "start":
+		tag, err := treeStore.RemoteTag(tagName)
+		if err != nil {
+			return errorf(method, "%v", err)
+		}
+		if tag.Pointer.IsNull() {
+			return errorf(method, "tag %q does not exist", tagName)
+		}
+		b := &bisection{tag: tagName, bad: tag.Pointer}
+		if err := b.save(pathname); err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(w, "bad %v (%s), mark a good revision next\n", b.bad, tagName)
+		return nil
+	case "reset":
+		if err := os.Remove(pathname); err != nil && !os.IsNotExist(err) {
+			return errorf(method, "%v", err)
+		}
+		return nil
+	case "good", "bad":
+	default:
+		return errorf(method, "unknown subcommand %q", subcommand)
+	}
+
+	b, err := loadBisection(pathname)
+	if err != nil {
+		return err
+	}
+	var key storage.Pointer
+	if len(args) > 0 {
+		if key, err = storage.NewPointerFromHex(args[0]); err != nil {
+			return errorf(method, "%v", err)
+		}
+	} else if b.good.IsNull() {
+		return errorf(method, "no revision to mark %s, name one", subcommand)
+	} else if key, err = b.next(treeStore); err != nil {
+		return err
+	} else if key.IsNull() {
+		return errorf(method, "bisect is done, run bisect reset")
+	}
+	if subcommand == "good" {
+		b.good = key
+	} else {
+		b.bad = key
+	}
+	if b.good.IsNull() {
+		if err := b.save(pathname); err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(w, "bad %v, mark a good revision next\n", b.bad)
+		return nil
+	}
+	lineage, err := b.lineage(treeStore)
+	if err != nil {
+		return err
+	}
+	mid, left, err := bisectMidpoint(lineage, b.good)
+	if err != nil {
+		return err
+	}
+	if err := b.save(pathname); err != nil {
+		return err
+	}
+	if mid.IsNull() {
+		r, err := treeStore.LoadRevisionByKey(b.bad)
+		if err != nil {
+			return errorf(method, "%v", err)
+		}
+		_, _ = fmt.Fprintf(w, "first bad revision:\n%v", r)
+		return nil
+	}
+	_, _ = fmt.Fprintf(w, "%d revisions left to test (about %d steps), next: %s\n",
+		left, bits.Len(uint(left)), filepath.Join(cfg.MuscleFSMount, mid.Hex()))
+	return nil
+}
+
+// lineage returns the keys of the bad revision and of its ancestors.
+func (b *bisection) lineage(treeStore *tree.Store) ([]storage.Pointer, error) {
+	const method = "bisection.lineage"
+	head, err := treeStore.LoadRevisionByKey(b.bad)
+	if err != nil {
+		return nil, errorf(method, "%v", err)
+	}
+	rr, err := treeStore.History(bisectLimit, head, b.tag)
+	if err != nil {
+		return nil, errorf(method, "%v", err)
+	}
+	keys := make([]storage.Pointer, len(rr))
+	for i, r := range rr {
+		keys[i] = r.Key()
+	}
+	return keys, nil
+}
+
+// next returns the revision to test next, or storage.Null if done.
+func (b *bisection) next(treeStore *tree.Store) (storage.Pointer, error) {
+	lineage, err := b.lineage(treeStore)
+	if err != nil {
+		return storage.Null, err
+	}
+	mid, _, err := bisectMidpoint(lineage, b.good)
+	return mid, err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestBisectMidpoint(t *testing.T) {
+	var lineage []storage.Pointer
+	for i := 0; i < 10; i++ {
+		lineage = append(lineage, storage.RandomPointer())
+	}
+	testCases := []struct {
+		good     int
+		wantMid  int // -1 if done.
+		wantLeft int
+	}{
+		{good: 1, wantMid: -1},
+		{good: 2, wantMid: 1, wantLeft: 1},
+		{good: 3, wantMid: 2, wantLeft: 2},
+		{good: 9, wantMid: 5, wantLeft: 8},
+	}
+	for _, tc := range testCases {
+		mid, left, err := bisectMidpoint(lineage, lineage[tc.good])
+		if err != nil {
+			t.Errorf("good %d: %v", tc.good, err)
+			continue
+		}
+		if tc.wantMid == -1 {
+			if !mid.IsNull() {
+				t.Errorf("good %d: got %v, want none", tc.good, mid)
+			}
+		} else if !mid.Equals(lineage[tc.wantMid]) || left != tc.wantLeft {
+			t.Errorf("good %d: got %v and %d left, want %v and %d left", tc.good, mid, left, lineage[tc.wantMid], tc.wantLeft)
+		}
+	}
+	if _, _, err := bisectMidpoint(lineage, storage.RandomPointer()); err == nil {
+		t.Error("got nil error for a good revision outside of the lineage")
+	}
+}
+
+func TestBisectionPersistence(t *testing.T) {
+	pathname := filepath.Join(t.TempDir(), "bisect")
+	if _, err := loadBisection(pathname); err == nil {
+		t.Error("got nil error loading a missing session")
+	}
+	b := &bisection{tag: "base", bad: storage.RandomPointer()}
+	if err := b.save(pathname); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadBisection(pathname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.tag != b.tag || !got.good.IsNull() || !got.bad.Equals(b.bad) {
+		t.Errorf("got %+v, want %+v", got, b)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/nicolagi/muscle/internal/storage"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// A bundle holds the stored values, i.e., encrypted blocks, nodes and
+// revisions, needed to go from one revision to a later one, so that a
+// host without access to the remote store can be updated by carrying a
+// file over. It starts with a header:
+//
+//	muscle bundle 1
+//	from REV1
+//	to REV2
+//
+// followed by a record for each value, a line “KEY LENGTH SHA256”
+// followed by the value, and ends with a line “end COUNT”. REV1 is
+// Null for a bundle holding everything needed for REV2.
+const bundleMagic = "muscle bundle 1"
+
+// How many revisions bundleKeys examines looking for the first
+// revision in the lineage of the second.
+const bundleLineageLimit = 1000
+
+// bundleStats summarizes a bundle written or applied.
+type bundleStats struct {
+	revisions int
+	values    int
+	bytes     int64
+}
+
+func (s bundleStats) String() string {
+	return fmt.Sprintf("%d revisions, %d values, %d bytes", s.revisions, s.values, s.bytes)
+}
+
+// parseRevisionRange parses “REV1..REV2”, where REV1 may be empty.
+func parseRevisionRange(s string) (from, to storage.Pointer, err error) {
+	const method = "parseRevisionRange"
+	ends := strings.SplitN(s, "..", 2)
+	if len(ends) != 2 {
+		return nil, nil, errorf(method, "%q: want REV1..REV2", s)
+	}
+	from = storage.Null
+	if ends[0] != "" {
+		if from, err = storage.NewPointerFromHex(ends[0]); err != nil {
+			return nil, nil, errorf(method, "%v", err)
+		}
+	}
+	if to, err = storage.NewPointerFromHex(ends[1]); err != nil {
+		return nil, nil, errorf(method, "%v", err)
+	}
+	return from, to, nil
+}
+
+// bundleKeys returns, sorted, the keys reachable from the revisions in
+// the lineage of to along the tag, down to but excluding from, that are
+// not reachable from from, and how many revisions those are.
+func bundleKeys(treeStore *tree.Store, tagName string, from, to storage.Pointer) (keys []string, revisions int, err error) {
+	const method = "bundleKeys"
+	head, err := treeStore.LoadRevisionByKey(to)
+	if err != nil {
+		return nil, 0, errorf(method, "%v", err)
+	}
+	rr, err := treeStore.History(bundleLineageLimit, head, tagName)
+	if err != nil {
+		return nil, 0, errorf(method, "%v", err)
+	}
+	if !from.IsNull() {
+		found := false
+		for i, r := range rr {
+			if r.Key().Equals(from) {
+				rr, found = rr[:i], true
+				break
+			}
+		}
+		if !found {
+			return nil, 0, errorf(method, "%v is not in the history of %v along %q (within %d revisions)", from, to, tagName, len(rr))
+		}
+	} else if p, ok := rr[len(rr)-1].Parent(tagName); ok && !p.Pointer.IsNull() {
+		return nil, 0, errorf(method, "history of %v along %q is longer than %d revisions", to, tagName, len(rr))
+	}
+	have := make(map[string]struct{})
+	if !from.IsNull() {
+		t, err := tree.NewTree(treeStore, tree.WithRevision(from))
+		if err != nil {
+			return nil, 0, errorf(method, "revision %v: %v", from, err)
+		}
+		if _, err := t.ReachableKeys(have); err != nil {
+			return nil, 0, errorf(method, "revision %v: %v", from, err)
+		}
+	}
+	// The accumulator starts with what the other host has, so that
+	// shared subtrees are not even visited.
+	reachable := make(map[string]struct{}, len(have))
+	for k := range have {
+		reachable[k] = struct{}{}
+	}
+	for _, r := range rr {
+		t, err := tree.NewTree(treeStore, tree.WithRevision(r.Key()))
+		if err != nil {
+			return nil, 0, errorf(method, "revision %v: %v", r.Key(), err)
+		}
+		if _, err := t.ReachableKeys(reachable); err != nil {
+			return nil, 0, errorf(method, "revision %v: %v", r.Key(), err)
+		}
+	}
+	for k := range reachable {
+		if _, ok := have[k]; ok {
+			continue
+		}
+		// Skip null pointers, e.g., of empty nodes.
+		if p, err := storage.NewPointerFromHex(k); err == nil && p.IsNull() {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, len(rr), nil
+}
+
+// writeBundle writes a bundle for going from one revision to another,
+// with the values of the keys, read from the source store.
+func writeBundle(w io.Writer, from, to storage.Pointer, keys []string, source storage.Store) (stats bundleStats, err error) {
+	const method = "writeBundle"
+	bw := bufio.NewWriter(w)
+	_, _ = fmt.Fprintf(bw, "%s\nfrom %v\nto %v\n", bundleMagic, from, to)
+	for _, k := range keys {
+		value, err := source.Get(storage.Key(k))
+		if err != nil {
+			return stats, errorf(method, "%v", err)
+		}
+		sum := sha256.Sum256(value)
+		_, _ = fmt.Fprintf(bw, "%s %d %x\n", k, len(value), sum)
+		_, _ = bw.Write(value)
+		stats.values++
+		stats.bytes += int64(len(value))
+	}
+	_, _ = fmt.Fprintf(bw, "end %d\n", stats.values)
+	if err := bw.Flush(); err != nil {
+		return stats, errorf(method, "%v", err)
+	}
+	return stats, nil
+}
+
+// readBundleHeader reads the header of a bundle, returning the
+// revisions it goes from and to.
+func readBundleHeader(r *bufio.Reader) (from, to storage.Pointer, err error) {
+	const method = "readBundleHeader"
+	line := func() (string, error) {
+		s, err := r.ReadString('\n')
+		if err != nil {
+			return "", errorf(method, "%v", err)
+		}
+		return strings.TrimSuffix(s, "\n"), nil
+	}
+	if magic, err := line(); err != nil {
+		return nil, nil, err
+	} else if magic != bundleMagic {
+		return nil, nil, errorf(method, "not a bundle: %q", magic)
+	}
+	for _, end := range []struct {
+		label string
+		p     *storage.Pointer
+	}{{"from ", &from}, {"to ", &to}} {
+		s, err := line()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !strings.HasPrefix(s, end.label) {
+			return nil, nil, errorf(method, "malformed header line %q", s)
+		}
+		if s = strings.TrimPrefix(s, end.label); s == "Null" {
+			*end.p = storage.Null
+		} else if *end.p, err = storage.NewPointerFromHex(s); err != nil {
+			return nil, nil, errorf(method, "%v", err)
+		}
+	}
+	if to.IsNull() {
+		return nil, nil, errorf(method, "bundle goes to the Null revision")
+	}
+	return from, to, nil
+}
+
+// applyBundle reads the values of a bundle, after the header, and puts
+// them in the destination store. Each value is checked before it is
+// stored, and a truncated bundle is an error, but the values stored
+// before the error are not removed; applying the bundle again is safe.
+func applyBundle(r *bufio.Reader, dst storage.Store) (stats bundleStats, err error) {
+	const method = "applyBundle"
+	for {
+		s, err := r.ReadString('\n')
+		if err != nil {
+			return stats, errorf(method, "after %d values: %v", stats.values, err)
+		}
+		var count int
+		if n, _ := fmt.Sscanf(s, "end %d\n", &count); n == 1 {
+			if count != stats.values {
+				return stats, errorf(method, "read %d values, bundle has %d", stats.values, count)
+			}
+			return stats, nil
+		}
+		var key, sumHex string
+		var length int
+		if _, err := fmt.Sscanf(s, "%s %d %s\n", &key, &length, &sumHex); err != nil {
+			return stats, errorf(method, "malformed record %q: %v", s, err)
+		}
+		if length < 0 {
+			return stats, errorf(method, "malformed record %q", s)
+		}
+		// Only blocks and nodes, not tags or anything outside the
+		// store, e.g., for a disk store, "../" paths.
+		if p, err := storage.NewPointerFromHex(key); err != nil || p.Hex() != key {
+			return stats, errorf(method, "malformed record %q: not a block key", s)
+		}
+		value := make([]byte, length)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return stats, errorf(method, "value of %s: %v", key, err)
+		}
+		sum := sha256.Sum256(value)
+		if hex.EncodeToString(sum[:]) != sumHex {
+			return stats, errorf(method, "value of %s is corrupted", key)
+		}
+		if err := dst.Put(storage.Key(key), value); err != nil {
+			return stats, errorf(method, "%v", err)
+		}
+		stats.values++
+		stats.bytes += int64(length)
+	}
+}
+
+// applyBundleFile applies a bundle, see applyBundle, and points the tag
+// to the revision the bundle goes to, if it pointed to the revision the
+// bundle goes from. Before that, it checks that all the nodes of the
+// new revision can be loaded.
+func applyBundleFile(w io.Writer, r io.Reader, treeStore *tree.Store, dst storage.Store, tagName string) error {
+	const method = "applyBundleFile"
+	br := bufio.NewReader(r)
+	from, to, err := readBundleHeader(br)
+	if err != nil {
+		return errorf(method, "%v", err)
+	}
+	tag, err := treeStore.RemoteTag(tagName)
+	if err != nil {
+		return errorf(method, "%v", err)
+	}
+	if !tag.Pointer.Equals(from) && !tag.Pointer.Equals(to) {
+		return errorf(method, "tag %q points to %v, the bundle goes from %v to %v", tagName, tag.Pointer, from, to)
+	}
+	stats, err := applyBundle(br, dst)
+	if err != nil {
+		return errorf(method, "%v", err)
+	}
+	_, _ = fmt.Fprintf(w, "%d values, %d bytes applied\n", stats.values, stats.bytes)
+	t, err := tree.NewTree(treeStore, tree.WithRevision(to))
+	if err != nil {
+		return errorf(method, "revision %v: %v", to, err)
+	}
+	if _, err := t.ReachableKeys(nil); err != nil {
+		return errorf(method, "revision %v: %v", to, err)
+	}
+	if tag.Pointer.Equals(to) {
+		_, _ = fmt.Fprintf(w, "tag %s already points to %v\n", tagName, to)
+		return nil
+	}
+	if err := treeStore.UpdateRemoteTags([]tree.Tag{tag}, to); err != nil {
+		return errorf(method, "%v", err)
+	}
+	_, _ = fmt.Fprintf(w, "tag %s updated to %v\n", tagName, to)
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestBundle(t *testing.T) {
+	source := &storage.InMemory{}
+	var keys []string
+	for _, value := range []string{"alpha", "beta", ""} {
+		key := storage.PointerTo([]byte(value)).Key()
+		if err := source.Put(key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, string(key))
+	}
+	to := storage.RandomPointer()
+	var buf bytes.Buffer
+	if _, err := writeBundle(&buf, storage.Null, to, keys, source); err != nil {
+		t.Fatal(err)
+	}
+	bundle := buf.Bytes()
+
+	apply := func(bundle []byte) (*storage.InMemory, error) {
+		t.Helper()
+		r := bufio.NewReader(bytes.NewReader(bundle))
+		from, gotTo, err := readBundleHeader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !from.IsNull() || !gotTo.Equals(to) {
+			t.Fatalf("got %v..%v, want Null..%v", from, gotTo, to)
+		}
+		dst := &storage.InMemory{}
+		_, err = applyBundle(r, dst)
+		return dst, err
+	}
+
+	dst, err := apply(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		want, _ := source.Get(storage.Key(k))
+		if got, err := dst.Get(storage.Key(k)); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q, %v, want %q", k, got, err, want)
+		}
+	}
+
+	corrupted := append([]byte(nil), bundle...)
+	i := bytes.Index(corrupted, []byte("alpha"))
+	corrupted[i] = 'A'
+	if _, err := apply(corrupted); err == nil {
+		t.Error("got nil error for a corrupted bundle")
+	}
+	if _, err := apply(bundle[:len(bundle)-len("end 3\n")]); err == nil {
+		t.Error("got nil error for a truncated bundle")
+	}
+	header := bundle[:bytes.Index(bundle, []byte(keys[0]))]
+	for _, key := range []string{"root.base", "../../../../tmp/x", "a", strings.ToUpper(keys[0])} {
+		crafted := fmt.Sprintf("%s%s 0 %x\nend 1\n", header, key, sha256.Sum256(nil))
+		if dst, err := apply([]byte(crafted)); err == nil {
+			t.Errorf("%q: got nil error for a key that's not a block", key)
+		} else if _, err := dst.Get(storage.Key(key)); err == nil {
+			t.Errorf("%q: stored", key)
+		}
+	}
+	if _, _, err := readBundleHeader(bufio.NewReader(bytes.NewReader([]byte("muscle bundle 2\n")))); err == nil {
+		t.Error("got nil error for an unknown format")
+	}
+}
+
+func TestParseRevisionRange(t *testing.T) {
+	a, b := storage.RandomPointer(), storage.RandomPointer()
+	if from, to, err := parseRevisionRange(a.Hex() + ".." + b.Hex()); err != nil || !from.Equals(a) || !to.Equals(b) {
+		t.Errorf("got %v, %v, %v", from, to, err)
+	}
+	if from, to, err := parseRevisionRange(".." + b.Hex()); err != nil || !from.IsNull() || !to.Equals(b) {
+		t.Errorf("got %v, %v, %v", from, to, err)
+	}
+	for _, s := range []string{b.Hex(), a.Hex() + "..", "x.." + b.Hex()} {
+		if _, _, err := parseRevisionRange(s); err == nil {
+			t.Errorf("%q: got nil error", s)
+		}
+	}
+}
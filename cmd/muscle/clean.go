@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/storage"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// How many batches of keys clean deletes concurrently.
+const cleanWorkers = 8
+
+// cleanStats summarizes the outcome of deleteKeys.
+type cleanStats struct {
+	deleted int
+	failed  int
+}
+
+// deleteKeys deletes the keys from the store, in batches of up to
+// batchSize keys if the store is a storage.BatchDeleter, one at a time
+// otherwise, with batches processed by concurrent workers. Each key is
+// also deleted from the cache, on a best effort basis. Failures are
+// logged to progress, along with the progress made, at most every
+// interval.
+func deleteKeys(store, cache storage.Store, keys []storage.Key, batchSize int, progress io.Writer, interval time.Duration) cleanStats {
+	batcher, ok := store.(storage.BatchDeleter)
+	if !ok {
+		batchSize = 1
+	}
+	total := len(keys)
+	batches := make(chan []storage.Key)
+	go func() {
+		for len(keys) > 0 {
+			n := batchSize
+			if n > len(keys) {
+				n = len(keys)
+			}
+			batches <- keys[:n]
+			keys = keys[n:]
+		}
+		close(batches)
+	}()
+
+	var mu sync.Mutex
+	var stats cleanStats
+	var lastReport time.Time
+	report := func(deleted, failed int, errs []error) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, err := range errs {
+			_, _ = fmt.Fprintf(progress, "clean: %v\n", err)
+		}
+		stats.deleted += deleted
+		stats.failed += failed
+		if now := time.Now(); now.Sub(lastReport) >= interval {
+			lastReport = now
+			_, _ = fmt.Fprintf(progress, "clean: %d of %d keys deleted, %d failed\n", stats.deleted, total, stats.failed)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < cleanWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				for _, key := range batch {
+					_ = cache.Delete(key) // Best effort.
+				}
+				if !ok {
+					if err := store.Delete(batch[0]); err != nil {
+						report(0, 1, []error{err})
+					} else {
+						report(1, 0, nil)
+					}
+					continue
+				}
+				failed, err := batcher.DeleteBatch(batch)
+				if err != nil {
+					report(0, len(batch), []error{fmt.Errorf("batch of %d keys: %w", len(batch), err)})
+					continue
+				}
+				var errs []error
+				for _, err := range failed {
+					errs = append(errs, err)
+				}
+				report(len(batch)-len(failed), len(failed), errs)
+			}
+		}()
+	}
+	wg.Wait()
+	return stats
+}
+
+// markGarbage marks the keys as garbage in the tombstone log, unless
+// they are there already, and returns how many it marked.
+func markGarbage(treeStore *tree.Store, keys []storage.Key, now time.Time) (marked int, err error) {
+	err = treeStore.UpdateTombstones(func(m map[string]tree.Tombstone) (bool, error) {
+		marked = 0
+		for _, k := range keys {
+			if _, ok := m[string(k)]; !ok {
+				m[string(k)] = tree.Tombstone{State: tree.TombstoneMarked, Since: now}
+				marked++
+			}
+		}
+		return marked > 0, nil
+	})
+	if err != nil {
+		return 0, errorf("markGarbage", "%v", err)
+	}
+	return marked, nil
+}
+
+// sweepStats summarizes the outcome of sweepGarbage.
+type sweepStats struct {
+	cleanStats
+	revived   int
+	forgotten int
+}
+
+// sweepGarbage deletes the keys marked as garbage more than the grace
+// period ago, except those that turn out to be needed, which it
+// revives. It first records in the tombstone log that the keys are
+// being swept, so that pushes using them wait, and then that they
+// were swept, so that pushes using them upload them again. Keys swept
+// more than the grace period ago are forgotten. Keys whose sweep was
+// interrupted are swept again.
+func sweepGarbage(treeStore *tree.Store, store, cache storage.Store, needed map[string]struct{}, grace time.Duration, progress io.Writer, interval time.Duration) (stats sweepStats, err error) {
+	const method = "sweepGarbage"
+	var keys []storage.Key
+	err = treeStore.UpdateTombstones(func(m map[string]tree.Tombstone) (bool, error) {
+		keys, stats = nil, sweepStats{}
+		now := time.Now()
+		for k, t := range m {
+			if t.State != tree.TombstoneSweeping && now.Sub(t.Since) < grace {
+				continue
+			}
+			switch _, ok := needed[k]; {
+			case t.State == tree.TombstoneSwept:
+				delete(m, k)
+				stats.forgotten++
+			case ok && t.State == tree.TombstoneMarked:
+				delete(m, k)
+				stats.revived++
+			default:
+				// A key being swept is swept again, even if needed:
+				// it may be gone already, and pushes wait for it.
+				m[k] = tree.Tombstone{State: tree.TombstoneSweeping, Since: now}
+				keys = append(keys, storage.Key(k))
+			}
+		}
+		return len(keys) > 0 || stats.revived > 0 || stats.forgotten > 0, nil
+	})
+	if err != nil {
+		return stats, errorf(method, "%v", err)
+	}
+	if len(keys) == 0 {
+		return stats, nil
+	}
+	stats.cleanStats = deleteKeys(store, cache, keys, storage.S3MaxDeleteBatch, progress, interval)
+	// Keys that failed to be deleted are marked swept anyway: at
+	// worst, pushes upload them again needlessly.
+	err = treeStore.UpdateTombstones(func(m map[string]tree.Tombstone) (bool, error) {
+		now := time.Now()
+		for _, k := range keys {
+			m[string(k)] = tree.Tombstone{State: tree.TombstoneSwept, Since: now}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return stats, errorf(method, "%v", err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/storage"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// batchStore deletes in batches, failing to delete one key.
+type batchStore struct {
+	storage.InMemory
+	stubborn storage.Key
+	batches  int32
+}
+
+func (s *batchStore) DeleteBatch(keys []storage.Key) (map[storage.Key]error, error) {
+	atomic.AddInt32(&s.batches, 1)
+	failed := make(map[storage.Key]error)
+	for _, k := range keys {
+		if k == s.stubborn {
+			failed[k] = errors.New("access denied")
+		} else if err := s.Delete(k); err != nil {
+			failed[k] = err
+		}
+	}
+	return failed, nil
+}
+
+func TestDeleteKeys(t *testing.T) {
+	var keys []storage.Key
+	for i := 0; i < 25; i++ {
+		keys = append(keys, storage.Key(fmt.Sprintf("key%d", i)))
+	}
+	populate := func(s storage.Store) {
+		for _, k := range keys {
+			if err := s.Put(k, []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	t.Run("one at a time", func(t *testing.T) {
+		store, cache := &storage.InMemory{}, &storage.InMemory{}
+		populate(store)
+		populate(cache)
+		stats := deleteKeys(store, cache, keys, 10, ioutil.Discard, 0)
+		if stats != (cleanStats{deleted: 25}) {
+			t.Errorf("got %+v, want 25 deleted", stats)
+		}
+		for _, s := range []*storage.InMemory{store, cache} {
+			if ok, _ := s.Contains(keys[0]); ok {
+				t.Error("key not deleted")
+			}
+		}
+	})
+	t.Run("in batches", func(t *testing.T) {
+		store := &batchStore{stubborn: keys[3]}
+		populate(store)
+		stats := deleteKeys(store, &storage.InMemory{}, keys, 10, ioutil.Discard, 0)
+		if stats != (cleanStats{deleted: 24, failed: 1}) {
+			t.Errorf("got %+v, want 24 deleted and 1 failed", stats)
+		}
+		if store.batches != 3 {
+			t.Errorf("got %d batches, want 3", store.batches)
+		}
+	})
+}
+
+func TestMarkAndSweepGarbage(t *testing.T) {
+	store, cache, pointers := &storage.InMemory{}, &storage.InMemory{}, &storage.InMemory{}
+	treeStore, err := tree.NewStore(nil, pointers, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []storage.Key{"garbage", "needed", "revived"}
+	for _, k := range keys {
+		if err := store.Put(k, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	marked, err := markGarbage(treeStore, keys, time.Now().Add(-time.Hour))
+	if err != nil || marked != 3 {
+		t.Fatalf("got %d, %v, want 3 marked", marked, err)
+	}
+	if marked, err := markGarbage(treeStore, keys[:1], time.Now()); err != nil || marked != 0 {
+		t.Fatalf("got %d, %v, want none marked again", marked, err)
+	}
+	// A push revives a key.
+	if _, _, err := treeStore.Revive(map[string]struct{}{"revived": {}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	needed := map[string]struct{}{"needed": {}}
+	stats, err := sweepGarbage(treeStore, store, cache, needed, 2*time.Hour, ioutil.Discard, 0)
+	if err != nil || stats != (sweepStats{}) {
+		t.Fatalf("got %+v, %v, want nothing swept within the grace period", stats, err)
+	}
+	stats, err = sweepGarbage(treeStore, store, cache, needed, time.Minute, ioutil.Discard, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (sweepStats{cleanStats: cleanStats{deleted: 1}, revived: 1}); stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+	for k, want := range map[storage.Key]bool{"garbage": false, "needed": true, "revived": true} {
+		if ok, _ := store.Contains(k); ok != want {
+			t.Errorf("%s: got %v, want %v", k, ok, want)
+		}
+	}
+	m, err := treeStore.Tombstones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m["garbage"].State != tree.TombstoneSwept {
+		t.Errorf("got %v, want only the deleted key, swept", m)
+	}
+	if stats, err = sweepGarbage(treeStore, store, cache, needed, 0, ioutil.Discard, 0); err != nil || stats.forgotten != 1 {
+		t.Errorf("got %+v, %v, want the swept key forgotten", stats, err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// exportOptions say which metadata an export preserves. There is no
+// option for ownership: muscle doesn't record it, so exported files
+// belong to the user running the export.
+type exportOptions struct {
+	// Give directories mode 0755 and files 0644, rather than the
+	// permissions they have in muscle, e.g., when restoring onto a
+	// system whose users need to read them.
+	normalizeModes bool
+
+	// Leave modification times to the time of the export, rather than
+	// those in muscle.
+	normalizeMtimes bool
+}
+
+// exportStats summarizes the outcome of an export.
+type exportStats struct {
+	dirs  int
+	files int
+	bytes int64
+}
+
+func (s exportStats) String() string {
+	return fmt.Sprintf("%d directories, %d files, %d bytes exported", s.dirs, s.files, s.bytes)
+}
+
+// exportTree copies the directories and files of the tree to dst,
+// which must not exist. Modes and modification times are set once a
+// directory's contents are written, so that read-only directories can
+// be exported too.
+func exportTree(t *tree.Tree, dst string, opts exportOptions) (stats exportStats, err error) {
+	const method = "exportTree"
+	if err := exportNode(t, t.Attach(), dst, opts, &stats); err != nil {
+		return stats, errorf(method, "%v", err)
+	}
+	return stats, nil
+}
+
+func exportNode(t *tree.Tree, node *tree.Node, pathname string, opts exportOptions, stats *exportStats) error {
+	info := node.Info()
+	perm := os.FileMode(info.Mode & 0777)
+	if node.IsDir() {
+		if err := os.Mkdir(pathname, 0700); err != nil {
+			return err
+		}
+		if err := t.Grow(node); err != nil {
+			return err
+		}
+		for _, child := range node.Children() {
+			if err := exportNode(t, child, filepath.Join(pathname, child.Info().Name), opts, stats); err != nil {
+				return err
+			}
+		}
+		stats.dirs++
+		if opts.normalizeModes {
+			perm = 0755
+		}
+	} else {
+		f, err := os.OpenFile(pathname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(f, io.NewSectionReader(node, 0, int64(info.Size)))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", pathname, err)
+		}
+		stats.files++
+		stats.bytes += n
+		if opts.normalizeModes {
+			perm = 0644
+		}
+	}
+	if err := os.Chmod(pathname, perm); err != nil {
+		return err
+	}
+	if !opts.normalizeMtimes {
+		mtime := time.Unix(int64(info.Modified), 0)
+		if err := os.Chtimes(pathname, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
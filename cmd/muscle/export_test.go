@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+func TestExportTree(t *testing.T) {
+	lt, _, _, _ := setUpTree(t)
+	_, root := lt.Root()
+	dir, err := lt.Add(root, "docs", 0500|tree.DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := lt.Add(dir, "notes.txt", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1600000000, 0)
+	file.Touch(uint32(mtime.Unix()))
+	dir.Touch(uint32(mtime.Unix()))
+
+	check := func(t *testing.T, pathname string, wantMode os.FileMode, preservedMtime bool) {
+		t.Helper()
+		fi, err := os.Stat(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode().Perm(); got != wantMode {
+			t.Errorf("%s: got mode %v, want %v", pathname, got, wantMode)
+		}
+		if got := fi.ModTime().Equal(mtime); got != preservedMtime {
+			t.Errorf("%s: got mtime %v, preserved is %v", pathname, fi.ModTime(), preservedMtime)
+		}
+	}
+
+	t.Run("preserves modes and mtimes", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "export")
+		stats, err := exportTree(lt, dst, exportOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Let the temporary directory be removed.
+		defer func() { _ = os.Chmod(filepath.Join(dst, "docs"), 0700) }()
+		if stats != (exportStats{dirs: 2, files: 1, bytes: 5}) {
+			t.Errorf("got %+v", stats)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(dst, "docs", "notes.txt")); err != nil || string(b) != "hello" {
+			t.Errorf("got %q, %v, want hello", b, err)
+		}
+		check(t, filepath.Join(dst, "docs"), 0500, true)
+		check(t, filepath.Join(dst, "docs", "notes.txt"), 0600, true)
+	})
+
+	t.Run("normalizes modes and mtimes", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "export")
+		if _, err := exportTree(lt, dst, exportOptions{normalizeModes: true, normalizeMtimes: true}); err != nil {
+			t.Fatal(err)
+		}
+		check(t, filepath.Join(dst, "docs"), 0755, false)
+		check(t, filepath.Join(dst, "docs", "notes.txt"), 0644, false)
+	})
+
+	t.Run("refuses an existing destination", func(t *testing.T) {
+		if _, err := exportTree(lt, t.TempDir(), exportOptions{}); err == nil {
+			t.Error("got no error")
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// garbageStats counts keys and the bytes of their values.
+type garbageStats struct {
+	keys  int
+	bytes int64
+}
+
+func (s *garbageStats) add(size int64) {
+	s.keys++
+	s.bytes += size
+}
+
+// countGarbage lists the store and counts the keys stored and those
+// that are garbage, i.e., not needed. Only keys of blocks, nodes, and
+// revisions are considered, not, e.g., those of tags. Listing stops
+// if the context is done.
+func countGarbage(ctx context.Context, store storage.Lister, needed map[string]struct{}) (stored, garbage garbageStats, err error) {
+	err = storage.ListAll(ctx, store, func(ki storage.KeyInfo) error {
+		if _, err := storage.NewPointerFromHex(string(ki.Key)); err != nil {
+			return nil
+		}
+		stored.add(ki.Size)
+		if _, ok := needed[string(ki.Key)]; !ok {
+			garbage.add(ki.Size)
+		}
+		return nil
+	})
+	if err != nil {
+		err = errorf("countGarbage", "%v", err)
+	}
+	return
+}
+
+func writeGarbageReport(w io.Writer, stored, garbage garbageStats) {
+	percent := func(part, whole float64) float64 {
+		if whole == 0 {
+			return 0
+		}
+		return 100 * part / whole
+	}
+	_, _ = fmt.Fprintf(w, "stored: %d keys, %d bytes\n", stored.keys, stored.bytes)
+	_, _ = fmt.Fprintf(w, "garbage: %d keys (%.1f%%), %d bytes (%.1f%%)\n",
+		garbage.keys, percent(float64(garbage.keys), float64(stored.keys)),
+		garbage.bytes, percent(float64(garbage.bytes), float64(stored.bytes)))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestCountGarbage(t *testing.T) {
+	store := &storage.InMemory{}
+	put := func(key string, size int) {
+		t.Helper()
+		if err := store.Put(storage.Key(key), make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	needed := storage.RandomPointer().Hex()
+	put(needed, 10)
+	put(storage.RandomPointer().Hex(), 20)
+	put(storage.RandomPointer().Hex(), 30)
+	// Not a block, node, or revision.
+	put("remote.root.host", 40)
+
+	stored, garbage, err := countGarbage(context.Background(), store, map[string]struct{}{needed: {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != (garbageStats{keys: 3, bytes: 60}) {
+		t.Errorf("got stored %+v, want 3 keys, 60 bytes", stored)
+	}
+	if garbage != (garbageStats{keys: 2, bytes: 50}) {
+		t.Errorf("got garbage %+v, want 2 keys, 50 bytes", garbage)
+	}
+	var b strings.Builder
+	writeGarbageReport(&b, stored, garbage)
+	if want := "stored: 3 keys, 60 bytes\ngarbage: 2 keys (66.7%), 50 bytes (83.3%)\n"; b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
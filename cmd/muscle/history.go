@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/storage"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// historyEntry is what the template given to history -format is
+// executed on, once per revision.
+type historyEntry struct {
+	Key      storage.Pointer
+	ShortKey string // The first 8 hex digits of the key.
+	Time     time.Time
+	Host     string
+	Root     storage.Pointer
+	Parents  []tree.Tag // With Name and Pointer fields.
+	Tags     []string   // Names of the remote tags pointing to the revision.
+	Keep     bool       // Whether pushed with the retention hint.
+	Message  string     // Given with push -m, if any.
+}
+
+// parseHistoryFormat parses a template for history -format. Besides
+// the fields of historyEntry, the template can use the join function,
+// i.e., strings.Join. A newline is added after each revision.
+func parseHistoryFormat(format string) (*template.Template, error) {
+	return template.New("history").Funcs(template.FuncMap{"join": strings.Join}).Parse(format + "\n")
+}
+
+// historyTags returns the names of the remote tags pointing to each
+// revision, by hex key, considering the given tag and those named as
+// parents by the revisions.
+func historyTags(treeStore *tree.Store, tagName string, rr []*tree.Revision) (map[string][]string, error) {
+	seen := map[string]bool{tagName: true}
+	names := []string{tagName}
+	for _, r := range rr {
+		for _, p := range r.Parents() {
+			if !seen[p.Name] {
+				seen[p.Name] = true
+				names = append(names, p.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	tags, err := treeStore.RemoteTags(names)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string][]string)
+	for _, t := range tags {
+		if !t.Pointer.IsNull() {
+			m[t.Pointer.Hex()] = append(m[t.Pointer.Hex()], t.Name)
+		}
+	}
+	return m, nil
+}
+
+// formatRevision writes the revision according to the template.
+func formatRevision(w io.Writer, tmpl *template.Template, r *tree.Revision, tags map[string][]string) error {
+	key := r.Key()
+	short := key.Hex()
+	if len(short) > 8 {
+		short = short[:8]
+	}
+	return tmpl.Execute(w, historyEntry{
+		Key:      key,
+		ShortKey: short,
+		Time:     r.Time(),
+		Host:     r.Host(),
+		Root:     r.RootKey(),
+		Parents:  r.Parents(),
+		Tags:     tags[key.Hex()],
+		Keep:     r.Keep(),
+		Message:  r.Message(),
+	})
+}
+
+// revisionStat compares the revision with its parent along the tag,
+// or with an empty tree if it has none.
+func revisionStat(treeStore *tree.Store, r *tree.Revision, tagName string) (tree.DiffStat, error) {
+	const method = "revisionStat"
+	this, err := tree.NewTree(treeStore, tree.WithRevision(r.Key()))
+	if err != nil {
+		return tree.DiffStat{}, errorf(method, "%v", err)
+	}
+	var opts []tree.TreeOption
+	if parent, ok := r.Parent(tagName); ok && !parent.Pointer.IsNull() {
+		opts = append(opts, tree.WithRevision(parent.Pointer))
+	}
+	parent, err := tree.NewTree(treeStore, opts...)
+	if err != nil {
+		return tree.DiffStat{}, errorf(method, "%v", err)
+	}
+	stat, err := tree.DiffTreesStat(parent, this)
+	if err != nil {
+		return tree.DiffStat{}, errorf(method, "%v", err)
+	}
+	return stat, nil
+}
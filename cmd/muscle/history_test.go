@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/storage"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+func TestFormatRevision(t *testing.T) {
+	parent := storage.RandomPointer()
+	r := tree.NewRevision(&tree.Node{}, []tree.Tag{{Name: "base", Pointer: parent}, {Name: "laptop", Pointer: storage.Null}})
+	r.SetMessage("fix typo")
+	tmpl, err := parseHistoryFormat(`{{.Host}} {{join .Tags ","}}{{range .Parents}} {{.Name}}={{.Pointer}}{{end}} {{printf "%q" .Message}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := formatRevision(&buf, tmpl, r, map[string][]string{r.Key().Hex(): {"base", "laptop"}}); err != nil {
+		t.Fatal(err)
+	}
+	want := r.Host() + " base,laptop base=" + parent.Hex() + " laptop=Null \"fix typo\"\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := parseHistoryFormat("{{.Missing"); err == nil {
+		t.Error("got nil error for a malformed template")
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/clnt"
+	"github.com/nicolagi/muscle/internal/config"
+)
+
+// importStats summarizes the outcome of an import.
+type importStats struct {
+	dirs    int
+	files   int
+	bytes   int64
+	skipped int // Entries with no counterpart in muscle, e.g., symbolic links.
+}
+
+func (s importStats) String() string {
+	return fmt.Sprintf("%d directories, %d files, %d bytes imported; %d entries skipped", s.dirs, s.files, s.bytes, s.skipped)
+}
+
+// An importTarget is where importTar creates what it reads, given
+// slash-separated paths relative to the destination.
+type importTarget interface {
+	// exists reports whether the path exists.
+	exists(pathname string) (bool, error)
+	mkdir(pathname string, perm uint32) error
+	create(pathname string, perm uint32, r io.Reader) (int64, error)
+	setMtime(pathname string, mtime time.Time) error
+}
+
+// importTar creates the directories and regular files in the tar
+// archive read from r in the target, under dst, which must not have
+// them already. Parent directories are created as needed. Other entries, e.g.,
+// symbolic and hard links, have no counterpart in muscle, and are
+// skipped. Modification times are preserved.
+func importTar(target importTarget, dst string, r io.Reader) (stats importStats, err error) {
+	const method = "importTar"
+	known := make(map[string]bool)
+	mtimes := make(map[string]time.Time)
+	var mkdirAll func(string) error
+	mkdirAll = func(dir string) error {
+		if dir == "" || known[dir] {
+			return nil
+		}
+		if err := mkdirAll(parentOf(dir)); err != nil {
+			return err
+		}
+		if ok, err := target.exists(dir); err != nil {
+			return err
+		} else if !ok {
+			if err := target.mkdir(dir, 0700); err != nil {
+				return err
+			}
+			stats.dirs++
+		}
+		known[dir] = true
+		return nil
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return stats, errorf(method, "%v", err)
+		}
+		// Keep within the destination, whatever the archive says.
+		name := path.Join(dst, path.Clean("/"+hdr.Name))
+		if name == dst {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := mkdirAll(parentOf(name)); err != nil {
+				return stats, errorf(method, "%s: %v", name, err)
+			}
+			if !known[name] {
+				if err := target.mkdir(name, uint32(hdr.Mode)&0777); err != nil {
+					return stats, errorf(method, "%s: %v", name, err)
+				}
+				known[name] = true
+				stats.dirs++
+			}
+			// Set once the directory is complete.
+			mtimes[name] = hdr.ModTime
+		case tar.TypeReg, tar.TypeRegA:
+			if err := mkdirAll(parentOf(name)); err != nil {
+				return stats, errorf(method, "%s: %v", name, err)
+			}
+			n, err := target.create(name, uint32(hdr.Mode)&0777, tr)
+			if err != nil {
+				return stats, errorf(method, "%s: %v", name, err)
+			}
+			if err := target.setMtime(name, hdr.ModTime); err != nil {
+				return stats, errorf(method, "%s: %v", name, err)
+			}
+			stats.files++
+			stats.bytes += n
+		default:
+			stats.skipped++
+		}
+	}
+	// Deepest first, so that setting a directory's time doesn't
+	// change its parent's.
+	var dirs []string
+	for dir := range mtimes {
+		dirs = append(dirs, dir)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		if err := target.setMtime(dir, mtimes[dir]); err != nil {
+			return stats, errorf(method, "%s: %v", dir, err)
+		}
+	}
+	return stats, nil
+}
+
+func parentOf(pathname string) string {
+	if i := strings.LastIndexByte(pathname, '/'); i >= 0 {
+		return pathname[:i]
+	}
+	return ""
+}
+
+// fsTarget is an importTarget for the live tree served by musclefs.
+type fsTarget struct {
+	fs *clnt.Clnt
+}
+
+func (t fsTarget) abs(pathname string) string {
+	return path.Join("live", pathname)
+}
+
+func (t fsTarget) exists(pathname string) (bool, error) {
+	names := strings.Split(t.abs(pathname), "/")
+	fid := t.fs.FidAlloc()
+	// The walk stops short, without error, at the first name missing.
+	// Then the server has no such fid, but Clunk is still what returns
+	// it to the pool; its error is of no interest.
+	qids, err := t.fs.Walk(t.fs.Root, fid, names)
+	if err != nil {
+		_ = t.fs.Clunk(fid)
+		return false, err
+	}
+	if len(qids) != len(names) {
+		_ = t.fs.Clunk(fid)
+		return false, nil
+	}
+	return true, t.fs.Clunk(fid)
+}
+
+func (t fsTarget) mkdir(pathname string, perm uint32) error {
+	f, err := t.fs.FCreate(t.abs(pathname), p.DMDIR|perm, p.OREAD)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (t fsTarget) create(pathname string, perm uint32, r io.Reader) (int64, error) {
+	f, err := t.fs.FCreate(t.abs(pathname), perm, p.OWRITE)
+	if err != nil {
+		return 0, err
+	}
+	// Writes of at most one message each.
+	buf := make([]byte, t.fs.Msize-p.IOHDRSZ)
+	var total int64
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, err := f.Writen(buf[:n], uint64(total)); err != nil {
+				_ = f.Close()
+				return total, err
+			}
+			total += int64(n)
+		}
+		if errors.Is(rerr, io.EOF) || errors.Is(rerr, io.ErrUnexpectedEOF) {
+			break
+		}
+		if rerr != nil {
+			_ = f.Close()
+			return total, rerr
+		}
+	}
+	return total, f.Close()
+}
+
+func (t fsTarget) setMtime(pathname string, mtime time.Time) error {
+	fid, err := t.fs.FWalk(t.abs(pathname))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = t.fs.Clunk(fid) }()
+	dir := p.NewWstatDir()
+	dir.Mtime = uint32(mtime.Unix())
+	return t.fs.Wstat(fid, dir)
+}
+
+// importBackup runs the command, which writes a tar archive of a backup
+// to its standard output, e.g., restic dump, and imports the archive
+// into musclefs, under dst, a path relative to the root of the live
+// tree, which must not exist. The command shares the standard input
+// and error, e.g., to ask for the password of the backup repository.
+func importBackup(c *config.C, name string, args []string, dst string) (importStats, error) {
+	const method = "importBackup"
+	dst = strings.TrimPrefix(path.Clean("/"+dst), "/")
+	if dst == "" {
+		return importStats{}, errorf(method, "refusing to import into the root of the tree")
+	}
+	user := p.OsUsers.Uid2User(os.Getuid())
+	fs, err := clnt.Mount(c.ListenNet, c.ListenAddr, "", 128*1024, user)
+	if err != nil {
+		return importStats{}, errorf(method, "connecting to %s: %v", c.ListenAddr, err)
+	}
+	defer fs.Unmount()
+	target := fsTarget{fs: fs}
+	if ok, err := target.exists(dst); err != nil {
+		return importStats{}, errorf(method, "%v", err)
+	} else if ok {
+		return importStats{}, errorf(method, "%s exists already", dst)
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return importStats{}, errorf(method, "%v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return importStats{}, errorf(method, "%v", err)
+	}
+	stats, ierr := importTar(target, dst, stdout)
+	if ierr != nil {
+		// Don't leave the command blocked writing.
+		_ = cmd.Process.Kill()
+	}
+	if err := cmd.Wait(); err != nil && ierr == nil {
+		return stats, errorf(method, "%s: %v", name, err)
+	}
+	if ierr != nil {
+		return stats, ierr
+	}
+	return stats, nil
+}
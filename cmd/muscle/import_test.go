@@ -0,0 +1,100 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// memTarget is an importTarget recording what is created.
+type memTarget struct {
+	dirs   map[string]uint32
+	files  map[string]string
+	mtimes map[string]time.Time
+}
+
+func (t *memTarget) exists(pathname string) (bool, error) {
+	_, ok := t.dirs[pathname]
+	return ok, nil
+}
+
+func (t *memTarget) mkdir(pathname string, perm uint32) error {
+	t.dirs[pathname] = perm
+	return nil
+}
+
+func (t *memTarget) create(pathname string, perm uint32, r io.Reader) (int64, error) {
+	b, err := ioutil.ReadAll(r)
+	t.files[pathname] = string(b)
+	return int64(len(b)), err
+}
+
+func (t *memTarget) setMtime(pathname string, mtime time.Time) error {
+	t.mtimes[pathname] = mtime
+	return nil
+}
+
+func TestImportTar(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, e := range []struct {
+		hdr      tar.Header
+		contents string
+	}{
+		{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "home/", Mode: 0755, ModTime: mtime}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "home/notes.txt", Mode: 0644, ModTime: mtime}, contents: "hello"},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hosts", Mode: 0600, ModTime: mtime}, contents: "localhost"},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "home/link", Linkname: "notes.txt", ModTime: mtime}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "../escape", Mode: 0600, ModTime: mtime}, contents: "contained"},
+	} {
+		e.hdr.Size = int64(len(e.contents))
+		if err := tw.WriteHeader(&e.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	target := &memTarget{
+		dirs:   map[string]uint32{"restored": 0700},
+		files:  make(map[string]string),
+		mtimes: make(map[string]time.Time),
+	}
+	stats, err := importTar(target, "restored/old", &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (importStats{dirs: 3, files: 3, bytes: 23, skipped: 1}); stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+	wantDirs := map[string]uint32{
+		"restored":          0700,
+		"restored/old":      0700,
+		"restored/old/home": 0755,
+		"restored/old/etc":  0700,
+	}
+	if diff := cmp.Diff(wantDirs, target.dirs); diff != "" {
+		t.Errorf("directories: %s", diff)
+	}
+	wantFiles := map[string]string{
+		"restored/old/home/notes.txt": "hello",
+		"restored/old/etc/hosts":      "localhost",
+		"restored/old/escape":         "contained",
+	}
+	if diff := cmp.Diff(wantFiles, target.files); diff != "" {
+		t.Errorf("files: %s", diff)
+	}
+	if got := target.mtimes["restored/old/home"]; !got.Equal(mtime) {
+		t.Errorf("got %v, want the directory's time preserved", got)
+	}
+}
@@ -2,15 +2,22 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/lionkov/go9p/p"
@@ -30,12 +37,38 @@ var (
 	// the properties are bound to positional arguments. The global context is for flags that are part of all flag sets,
 	// that is, all sub-commands.
 	globalContext struct {
-		base string
+		base    string
+		profile string
+	}
+
+	bisectContext struct {
+		tagName string
+	}
+
+	bundleContext struct {
+		tagName   string
+		output    string
+		revisions string
 	}
 
 	cleanContext struct {
 		storedKeys string
 		neededKeys string
+		sweep      bool
+		grace      time.Duration
+		tagNames   string
+		count      int
+	}
+
+	exportContext struct {
+		tagName  string
+		revision string
+		options  exportOptions
+	}
+
+	garbageContext struct {
+		tagNames string
+		count    int
 	}
 
 	diffContext struct {
@@ -45,10 +78,42 @@ var (
 		verbose bool
 	}
 
+	initContext struct {
+		storage string
+	}
+
+	controlContext struct {
+		socket bool
+		once   string
+	}
+
+	repairContext struct {
+		tagName string
+		splice  bool
+	}
+
+	statusContext struct {
+		all   bool
+		stale time.Duration
+	}
+
+	tagContext struct {
+		keep   bool
+		unkeep bool
+	}
+
+	verifyContext struct {
+		tagName  string
+		revision string
+		force    bool
+	}
+
 	historyContext struct {
 		prefix string
 		count  int
 		diff   bool
+		format string
+		stat   bool
 
 		// These apply only if diff is true.
 		tagName string
@@ -60,6 +125,7 @@ var (
 func newFlagSet(name string) *flag.FlagSet {
 	fs := flag.NewFlagSet(name, flag.ExitOnError)
 	fs.StringVar(&globalContext.base, "base", config.DefaultBaseDirectoryPath, "`directory` for caches, configuration, logs, etc.")
+	fs.StringVar(&globalContext.profile, "profile", "", "`name` of the profile whose base directory to use instead of -base, see "+config.ProfilesFilePath)
 	return fs
 }
 
@@ -67,8 +133,23 @@ func exitUsage(msg string) {
 	_, _ = fmt.Fprintln(os.Stderr, msg)
 	_, _ = fmt.Fprintf(os.Stderr, `Usage: %s COMMAND [ARGS]
 
+All commands take -base to select the base directory, or -profile to
+select one by name from %s, which has lines such as
+“work $HOME/lib/muscle-work”.
+
 Commands:
 
+* bisect
+
+The “bisect” command helps find the revision that introduced a
+change, by binary search over the lineage of a tag. Run “bisect
+start [-b TAG]” to mark the revision the tag points to as bad, then
+“bisect good REVISION” to mark an older one as good. Each time, the
+command prints the path of a revision halfway between, within the
+musclefs mount, to be examined and marked with “bisect good” or
+“bisect bad” (a revision argument is optional from then on), until
+the first bad revision is found. Run “bisect reset” to start over.
+
 	clean: remove unneeded items from the persistent store - use with caution
 
 		At some point you might want to trim your history to reduce your S3 bill. This is a dangerous way to achieve
@@ -76,14 +157,22 @@ Commands:
 		safe. I won't give cut and paste commands so you'll be force to understand the ins and outs and take
 		responsibility. The process is the following.
 
-		- Use the list command to list what's in the remote store at present.
+		- Use the list command to list what's in the remote store at present (or omit -stored, below, to have clean
+		list it).
 		- Use the history command to extract the range of revisions you want to keep. Mind you, I say "range", because
 		if you omit an intermediate revision in the history, the parent chain will be broken and you'll have no access
-		to revisions prior to that one, unless you store the revision key somewhere. Also, no instance of musclefs
-		should be running, potentially changing the store contents and root pointers. Especially considering you want to
-		keep the local root!
+		to revisions prior to that one, unless you store the revision key somewhere. Also, you want to keep the local
+		root!
 		- Feed those revision keys to the reachable command. This will get you all the keys to keep.
-		- Use this command (clean) with the two lists of keys (stored, to keep) to prune the remote storage.
+		Alternatively, with musclefs running, “muscle control reachable [-b TAGS] [-n COUNT]” writes the keys needed by
+		its tree and the latest COUNT revisions of each tag to the reachable file in the base directory, reusing the
+		nodes it has in memory.
+		- Use this command (clean) with the two lists of keys (stored, to keep) to mark the keys to prune as garbage.
+		It also keeps the keys reachable from revisions pinned by a running musclefs, i.e., being browsed.
+		- After the grace period (-grace, 24 hours by default), run “clean -sweep” to delete the marked keys. Running
+		musclefs instances revive marked keys the revisions they push use, so they are not deleted; keys still needed by
+		the latest revisions of the tags (-b, -n), pinned revisions or the local tree are revived as well. Keys deleted
+		meanwhile are uploaded again by the next push that needs them; a push during a sweep fails, to be tried again.
 
 		How do you know all is well?
 
@@ -98,13 +187,40 @@ Commands:
 Reads commands line by line from standard input and sends them to
 musclefs via its contro file /ctl. It prints responses to standard
 output. An example usage is "muco pull | muco" where "muco" is
-defined as "fn muco { muscle control $* ; }".
+defined as "fn muco { muscle control $* ; }". It stops at the first
+command that fails, after printing its response, and exits with
+status 1; it exits with status 2 if it can't talk to musclefs.
+As "muscle control script", it sends all of standard input as one
+script instead, which musclefs runs all or nothing, e.g., "muco pull |
+muco script" applies the merge in one go or not at all.
+With -socket, it talks to musclefs over the unix socket ctl.sock in
+the base directory instead of 9P, e.g., if the 9P server is wedged.
+With -once TOKEN, each command, or the script, is prefixed with "once
+TOKEN" (the command's line number is appended to the token for
+commands from standard input), so that musclefs runs it at most once,
+replaying the response if it's sent again, e.g., by a wrapper retrying
+after a timeout with the same token; a retry sent while the command is
+still running waits for its response.
 
+	apply-bundle [FILE]: stores the values in a bundle made by the bundle command, read from the file or standard input, in the remote store, e.g., a disk store on a host without network access, and points the tag given with -b to the revision the bundle goes to, if it pointed to the one it goes from; musclefs then pulls as usual
+	bundle REV1..REV2: writes to standard output, or the file given with -o, the values needed to go from revision REV1 to the later revision REV2 along the tag given with -b, i.e., those reachable from REV2 and the revisions in between but not from REV1 (omit REV1 for all those reachable from REV2 and its history)
+	debug cat-blocks REF...: decrypts the blocks with the given refs, as in the output of the dump control command, and writes their contents to standard output in order, e.g., to recover a file whose metadata is damaged
 	diff: compare local tree to the remote tree
-	history: shows the history of the tree
-	init: initializes configuration given the base directory
+	export [-b TAG | -r REV] [-normalize-modes] [-normalize-mtimes] DST-DIR: copies the revision the tag points to, or the one given, to the directory, which must not exist; the permissions and modification times in muscle are kept unless normalized, e.g., when restoring onto a system with different users (muscle does not record ownership, so the files belong to whoever runs the command)
+	garbage: report how many keys and bytes in the remote store are not reachable from the history of the tags given with -b (the latest -n revisions of each, if set), the revisions pinned by musclefs, or the local tree; nothing is deleted
+	history: shows the history of the tree; the -format flag takes a text/template for each revision, for scripts; -stat summarizes the changes each revision made to its parent
+	import-borg REPO ARCHIVE DST-PATH: imports the archive of the borg repository into the live tree served by musclefs, at the path given, which must not exist, by means of borg export-tar; only directories and regular files are imported
+	import-restic REPO SNAPSHOT DST-PATH: the same for a snapshot of a restic repository, by means of restic dump
+	init: initializes configuration given the base directory; the -storage flag selects disk (default) or memory storage
 	list: list all keys in remote store
+	prefetch: copies blocks from the remote store to the cache, in the order musclefs first read them as of its last push or exit, e.g., to play media files smoothly after emptying the cache
 	reachable: reads a list of line-separated revision keys from standard input and lists all keys reachable from them to standard output
+	recover-staging: finds the values in the staging area that the local tree doesn't use, e.g., after a crash; those the seal journal records as sealed are deleted, the others moved to the quarantine directory; musclefs does the same at startup, and must not be running
+	remotes: lists the remote tags in the store, e.g., one per host, with the revision each points to, its time and host, and how long ago that was
+	repair-history -splice OLD NEW: if revision OLD is lost, so that the history of the tag given with -b stops there, makes its child a child of revision NEW instead; the later revisions are rewritten and the tag updated
+	stats: show the calls musclefs made to its stores, and those muscle made to the remote store, and estimate the monthly cost of those to the remote store with the request-cost and transfer-cost configuration
+	status [-all] [-stale DURATION]: shows when musclefs on this host, or on all hosts, last pushed, flushed, and was seen running, as recorded by musclefs in the store; exits with status 1 if any host hasn't pushed within the duration, which defaults to the stale-after configuration, or a week
+	tag -keep [REV...]: makes garbage collection (clean, garbage, and the reachable control command) retain the revisions given regardless of age, as if pushed with “push -keep”, or lists those retained this way; “tag -unkeep REV...” undoes it, except for revisions pushed with -keep
 
 * upload
 
@@ -118,15 +234,30 @@ are reported in error messages (but you'll need to front muscle with
 a logging 9P proxy such as https://github.com/nicolagi/pine to see
 error messages in Linux).
 
+	verify [-b TAG | -r REV] [-force]: reads all nodes and blocks of the revision the tag points to, or the one given, from the remote store, bypassing the cache, and checks that they decrypt; only if all do, points the tag “verified” to the revision, which must descend from the one the tag points to unless forced, so that it names a revision known to be restorable, e.g., in disaster recovery notes (musclefs refuses to push to that tag); exits with status 1 and lists what failed otherwise
 	version: show version information
-`, os.Args[0])
+`, os.Args[0], config.ProfilesFilePath)
 	os.Exit(2)
 }
 
 func main() {
+	bisectFlags := newFlagSet("bisect")
+	bisectFlags.StringVar(&bisectContext.tagName, "b", "base", "tag `name` (for bisect start)")
+
+	bundleFlags := newFlagSet("bundle")
+	bundleFlags.StringVar(&bundleContext.tagName, "b", "base", "tag `name` along whose history the revisions are")
+	bundleFlags.StringVar(&bundleContext.output, "o", "", "output `file`, instead of standard output")
+
+	applyBundleFlags := newFlagSet("apply-bundle")
+	applyBundleFlags.StringVar(&bundleContext.tagName, "b", "base", "tag `name` to update")
+
 	cleanFlags := newFlagSet("clean")
-	cleanFlags.StringVar(&cleanContext.storedKeys, "stored", "", "`file` listing stored keys - output from muscle list")
-	cleanFlags.StringVar(&cleanContext.neededKeys, "needed", "", "`file` listing needed keys - output from muscle reachable")
+	cleanFlags.StringVar(&cleanContext.storedKeys, "stored", "", "`file` listing stored keys - output from muscle list; if not given, the store is listed")
+	cleanFlags.StringVar(&cleanContext.neededKeys, "needed", "", "`file` listing needed keys - output from muscle reachable, or the reachable control command")
+	cleanFlags.BoolVar(&cleanContext.sweep, "sweep", false, "delete the keys marked as garbage more than the grace period ago")
+	cleanFlags.DurationVar(&cleanContext.grace, "grace", 24*time.Hour, "grace `period` between marking and deleting keys")
+	cleanFlags.StringVar(&cleanContext.tagNames, "b", "base", "comma-separated tag `names` whose latest revisions are checked for needed keys before deleting")
+	cleanFlags.IntVar(&cleanContext.count, "n", 1, "number of `revisions` checked per tag, all if zero")
 
 	diffFlags := newFlagSet("diff")
 	diffFlags.StringVar(&diffContext.tagName, "b", "base", "tag `name`")
@@ -134,9 +265,22 @@ func main() {
 	diffFlags.BoolVar(&diffContext.names, "N", false, "only output paths that changed, not context diffs")
 	diffFlags.StringVar(&diffContext.prefix, "prefix", "", "omit diffs outside of `path`, e.g., project/name")
 
+	exportFlags := newFlagSet("export")
+	exportFlags.StringVar(&exportContext.tagName, "b", "base", "tag `name` pointing to the revision to export")
+	exportFlags.StringVar(&exportContext.revision, "r", "", "`revision` to export, instead of the one the tag points to")
+	exportFlags.BoolVar(&exportContext.options.normalizeModes, "normalize-modes", false, "give directories mode 0755 and files 0644")
+	exportFlags.BoolVar(&exportContext.options.normalizeMtimes, "normalize-mtimes", false, "leave modification times to the time of the export")
+
+	garbageFlags := newFlagSet("garbage")
+	garbageFlags.StringVar(&garbageContext.tagNames, "b", "base", "comma-separated tag `names` whose history is retained")
+	garbageFlags.IntVar(&garbageContext.count, "n", 0, "number of `revisions` retained per tag, all if zero")
+
 	// For all commands that don't take flags.
 	emptyFlags := newFlagSet("empty")
 
+	initFlags := newFlagSet("init")
+	initFlags.StringVar(&initContext.storage, "storage", "disk", "storage `type`, disk or memory (memory does not persist data, for trying muscle out)")
+
 	// TODO I think instance should be renamed to tree for all these - how to view local vs remote history?
 	// TODO I need a glossary
 
@@ -146,7 +290,30 @@ func main() {
 	historyFlags.StringVar(&historyContext.prefix, "prefix", "", "omit diffs outside of `path`, e.g., project/name")
 	historyFlags.BoolVar(&historyContext.names, "N", false, "Only output paths that changed, not context diffs (requires -d)")
 	historyFlags.IntVar(&historyContext.count, "n", 3, "Number of `revisions` to show")
+	historyFlags.StringVar(&historyContext.format, "format", "", "`template` for each revision, with fields Key, ShortKey, Time, Host, Root, Parents, Tags, Keep, and Message, e.g., '{{.ShortKey}} {{.Time.Unix}} {{join .Tags \",\"}}'")
 	historyFlags.BoolVar(&historyContext.verbose, "v", false, "include metadata changes (requires -d)")
+	controlFlags := newFlagSet("control")
+	controlFlags.BoolVar(&controlContext.socket, "socket", false, "talk to musclefs over its control socket rather than 9P")
+	controlFlags.StringVar(&controlContext.once, "once", "", "run each command at most once, even if sent again, e.g., by a retry with the same `token`")
+
+	repairFlags := newFlagSet("repair-history")
+	repairFlags.StringVar(&repairContext.tagName, "b", "base", "tag `name` whose history to repair")
+	repairFlags.BoolVar(&repairContext.splice, "splice", false, "make the revision whose parent is the first argument, lost, a child of the second")
+
+	statusFlags := newFlagSet("status")
+	statusFlags.BoolVar(&statusContext.all, "all", false, "show all hosts, not only this one")
+	statusFlags.DurationVar(&statusContext.stale, "stale", 0, "flag hosts that haven't pushed for this `duration`, instead of the stale-after configuration")
+
+	tagFlags := newFlagSet("tag")
+	tagFlags.BoolVar(&tagContext.keep, "keep", false, "retain the revisions given regardless of age, or list those retained if none is given")
+	tagFlags.BoolVar(&tagContext.unkeep, "unkeep", false, "stop retaining the revisions given")
+
+	verifyFlags := newFlagSet("verify")
+	verifyFlags.StringVar(&verifyContext.tagName, "b", "base", "tag `name` pointing to the revision to verify")
+	verifyFlags.StringVar(&verifyContext.revision, "r", "", "`revision` to verify, instead of the one the tag points to")
+	verifyFlags.BoolVar(&verifyContext.force, "force", false, "move the verified tag even if the revision doesn't descend from the one it points to")
+
+	historyFlags.BoolVar(&historyContext.stat, "stat", false, "show the number of files added, modified, and deleted, and the bytes churned, by each revision")
 
 	// TODO does update encoding work?
 
@@ -155,34 +322,80 @@ func main() {
 	}
 
 	switch cmd := os.Args[1]; cmd {
+	case "apply-bundle":
+		_ = applyBundleFlags.Parse(os.Args[2:])
+		if narg := applyBundleFlags.NArg(); narg > 1 {
+			exitUsage(fmt.Sprintf("apply-bundle: at most one arg expected, got %d", narg))
+		}
+	case "bisect":
+		if len(os.Args) < 3 {
+			exitUsage("bisect: subcommand required")
+		}
+		_ = bisectFlags.Parse(os.Args[3:])
+		if narg := bisectFlags.NArg(); narg > 1 {
+			exitUsage(fmt.Sprintf("bisect: at most one arg expected, got %d", narg))
+		}
+	case "bundle":
+		// Flags may also follow the revision range.
+		_ = bundleFlags.Parse(os.Args[2:])
+		if bundleFlags.NArg() > 0 {
+			args := bundleFlags.Args()
+			_ = bundleFlags.Parse(args[1:])
+			if narg := bundleFlags.NArg(); narg != 0 {
+				exitUsage(fmt.Sprintf("bundle: one arg expected, got %d", narg+1))
+			}
+			bundleContext.revisions = args[0]
+		}
+		if bundleContext.revisions == "" {
+			exitUsage("bundle: usage: bundle [-b TAG] [-o FILE] REV1..REV2")
+		}
 	case "clean":
 		// Ignoring error - here and in all other cases below - because we configure flag sets to exit on error.
 		_ = cleanFlags.Parse(os.Args[2:])
-		// Arguments to clean could be positional. It's always going to be 2 required positional arguments. But I'm
-		// keeping them as flags so one has to be explicit about what keys need to be preserved and which ones are
-		// stored.
+		// Arguments to clean could be positional. But I'm keeping them as flags so one has to be explicit about what
+		// keys need to be preserved and which ones are stored (unless the store is to be listed).
 		if narg := cleanFlags.NArg(); narg != 0 {
 			exitUsage(fmt.Sprintf("clean: no args expected, got %d", narg))
 		}
-		if cleanContext.neededKeys == "" || cleanContext.storedKeys == "" {
+		if cleanContext.neededKeys == "" && !cleanContext.sweep {
 			cleanFlags.Usage()
 			os.Exit(2)
 		}
 	case "control":
+		_ = controlFlags.Parse(os.Args[2:])
+	case "debug":
 		_ = emptyFlags.Parse(os.Args[2:])
+		if emptyFlags.NArg() < 2 || emptyFlags.Arg(0) != "cat-blocks" {
+			exitUsage("debug: usage: debug cat-blocks REF...")
+		}
 	case "diff":
 		_ = diffFlags.Parse(os.Args[2:])
 		if narg := diffFlags.NArg(); narg != 0 {
 			exitUsage(fmt.Sprintf("diff: no args expected, got %d\n", narg))
 		}
+	case "export":
+		_ = exportFlags.Parse(os.Args[2:])
+		if narg := exportFlags.NArg(); narg != 1 {
+			exitUsage(fmt.Sprintf("export: one arg expected, got %d", narg))
+		}
+	case "garbage":
+		_ = garbageFlags.Parse(os.Args[2:])
+		if narg := garbageFlags.NArg(); narg != 0 {
+			exitUsage(fmt.Sprintf("garbage: no args expected, got %d", narg))
+		}
 	case "history":
 		_ = historyFlags.Parse(os.Args[2:])
 		if narg := historyFlags.NArg(); narg != 0 {
 			exitUsage(fmt.Sprintf("history: no args expected, got %d\n", narg))
 		}
-	case "init":
+	case "import-borg", "import-restic":
 		_ = emptyFlags.Parse(os.Args[2:])
-		if narg := emptyFlags.NArg(); narg != 0 {
+		if emptyFlags.NArg() != 3 {
+			exitUsage(fmt.Sprintf("%s: usage: %s REPO SNAPSHOT DST-PATH", cmd, cmd))
+		}
+	case "init":
+		_ = initFlags.Parse(os.Args[2:])
+		if narg := initFlags.NArg(); narg != 0 {
 			exitUsage(fmt.Sprintf("init: no args expected, got %d", narg))
 		}
 	case "list":
@@ -195,21 +408,61 @@ func main() {
 		if narg := emptyFlags.NArg(); narg != 0 {
 			exitUsage(fmt.Sprintf("mount: no args expected, got %d", narg))
 		}
+	case "prefetch":
+		_ = emptyFlags.Parse(os.Args[2:])
+		if narg := emptyFlags.NArg(); narg != 0 {
+			exitUsage(fmt.Sprintf("prefetch: no args expected, got %d", narg))
+		}
 	case "reachable":
 		_ = emptyFlags.Parse(os.Args[2:])
 		if narg := emptyFlags.NArg(); narg != 0 {
 			exitUsage(fmt.Sprintf("reachable: no args expected, got %d", narg))
 		}
+	case "recover-staging":
+		_ = emptyFlags.Parse(os.Args[2:])
+		if narg := emptyFlags.NArg(); narg != 0 {
+			exitUsage(fmt.Sprintf("recover-staging: no args expected, got %d", narg))
+		}
+	case "remotes":
+		_ = emptyFlags.Parse(os.Args[2:])
+		if narg := emptyFlags.NArg(); narg != 0 {
+			exitUsage(fmt.Sprintf("remotes: no args expected, got %d", narg))
+		}
+	case "repair-history":
+		_ = repairFlags.Parse(os.Args[2:])
+		if !repairContext.splice || repairFlags.NArg() != 2 {
+			exitUsage("repair-history: usage: repair-history [-b TAG] -splice OLD NEW")
+		}
+	case "stats":
+		_ = emptyFlags.Parse(os.Args[2:])
+		if narg := emptyFlags.NArg(); narg != 0 {
+			exitUsage(fmt.Sprintf("stats: no args expected, got %d", narg))
+		}
+	case "status":
+		_ = statusFlags.Parse(os.Args[2:])
+		if narg := statusFlags.NArg(); narg != 0 {
+			exitUsage(fmt.Sprintf("status: no args expected, got %d", narg))
+		}
 	case "umount":
 		_ = emptyFlags.Parse(os.Args[2:])
 		if narg := emptyFlags.NArg(); narg != 0 {
 			exitUsage(fmt.Sprintf("umount: no args expected, got %d", narg))
 		}
+	case "tag":
+		_ = tagFlags.Parse(os.Args[2:])
+		if tagContext.keep == tagContext.unkeep || (tagContext.unkeep && tagFlags.NArg() == 0) {
+			exitUsage("tag: usage: tag -keep [REV...] | tag -unkeep REV...")
+		}
 	case "upload":
 		_ = emptyFlags.Parse(os.Args[2:])
 		if narg := emptyFlags.NArg(); narg != 0 {
 			exitUsage(fmt.Sprintf("upload: no args expected, got %d", narg))
 		}
+	case "verify":
+		_ = verifyFlags.Parse(os.Args[2:])
+		if narg := verifyFlags.NArg(); narg != 0 {
+			exitUsage(fmt.Sprintf("verify: no args expected, got %d", narg))
+		}
 	case "version":
 		_ = emptyFlags.Parse(os.Args[2:])
 		if narg := emptyFlags.NArg(); narg != 0 {
@@ -219,10 +472,21 @@ func main() {
 		exitUsage(fmt.Sprintf("%q: command not recognized", cmd))
 	}
 
+	if globalContext.profile != "" {
+		if globalContext.base != config.DefaultBaseDirectoryPath {
+			exitUsage("-base and -profile are mutually exclusive")
+		}
+		base, err := config.ProfileBase(globalContext.profile)
+		if err != nil {
+			log.Fatalf("Could not resolve profile: %v", err)
+		}
+		globalContext.base = base
+	}
+
 	// The init subcommand is special, because it must create configuration, not use it.
 	// Therefore it is handled outside of the big switch statement below.
 	if os.Args[1] == "init" {
-		if err := config.Initialize(globalContext.base); err != nil {
+		if err := config.Initialize(globalContext.base, initContext.storage); err != nil {
 			log.Fatalf("Could not initialize config in %q: %v", globalContext.base, err)
 		}
 		return
@@ -250,35 +514,101 @@ func main() {
 	}
 
 	if os.Args[1] == "control" {
-		if err := doControl(cfg, os.Args[2:]); err != nil {
+		if err := doControl(cfg, controlFlags.Args(), controlContext.socket, controlContext.once); err != nil {
 			log.Printf("control: %+v", err)
-			os.Exit(1)
+			var cerr *commandError
+			if errors.As(err, &cerr) {
+				os.Exit(1)
+			}
+			os.Exit(2)
 		} else {
 			os.Exit(0)
 		}
 	}
 
+	if os.Args[1] == "import-borg" || os.Args[1] == "import-restic" {
+		repo, snapshot, dst := emptyFlags.Arg(0), emptyFlags.Arg(1), emptyFlags.Arg(2)
+		name, args := "restic", []string{"-r", repo, "dump", "--archive", "tar", snapshot, "/"}
+		if os.Args[1] == "import-borg" {
+			name, args = "borg", []string{"export-tar", repo + "::" + snapshot, "-"}
+		}
+		stats, err := importBackup(cfg, name, args, dst)
+		if err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
+		}
+		fmt.Println(stats)
+		os.Exit(0)
+	}
+
+	if os.Args[1] == "stats" {
+		metrics, err := storage.LoadMetrics(cfg.MetricsFilePath())
+		if err != nil {
+			log.Fatalf("stats: %v", err)
+		}
+		commandMetrics, err := storage.LoadMetrics(cfg.CommandMetricsFilePath())
+		if err != nil {
+			log.Fatalf("stats: %v", err)
+		}
+		metrics.Merge(commandMetrics)
+		since, entries := metrics.Snapshot()
+		model := storage.CostModel{PerThousandCalls: cfg.RequestCosts, PerGiBRead: cfg.TransferCost}
+		writeStatsReport(os.Stdout, since, entries, cfg.Storage, model, time.Now())
+		os.Exit(0)
+	}
+
 	stagingStore := storage.NewDiskStore(cfg.StagingDirectoryPath())
 	cacheStore := storage.NewDiskStore(cfg.CacheDirectoryPath())
 	remoteStore, err := storage.NewStore(cfg)
 	if err != nil {
 		log.Fatalf("Could not create remote store: %v", err)
 	}
-	f, err := ioutil.TempFile("", "")
+	if err := block.CheckSentinel(remoteStore, cfg.EncryptionKeyBytes()); errors.Is(err, block.ErrWrongKey) {
+		log.Fatalf("The encryption key in the configuration is not the one the remote store was written with: %v", err)
+	}
+	metrics, err := storage.LoadMetrics(cfg.CommandMetricsFilePath())
 	if err != nil {
-		log.Fatalf("Could not create temporary file for bugs propagation log: %v", err)
+		log.Fatalf("Could not load metrics: %v", err)
+	}
+	remoteStore = storage.Metered(remoteStore, cfg.Storage, metrics)
+	// The store calls are counted whatever the outcome of the command,
+	// so from here on every way out of main saves the metrics first.
+	saveMetrics := func() {
+		if err := metrics.Save(cfg.CommandMetricsFilePath()); err != nil {
+			log.Printf("Could not save metrics: %v", err)
+		}
 	}
-	paired, err := storage.NewPaired(cacheStore, remoteStore, f.Name())
+	fatalf := func(format string, v ...interface{}) {
+		saveMetrics()
+		log.Fatalf(format, v...)
+	}
+	exit := func(code int) {
+		saveMetrics()
+		os.Exit(code)
+	}
+	logDir, err := ioutil.TempDir("", "")
 	if err != nil {
-		log.Fatalf("Could not start new paired store with log %q: %v", f.Name(), err)
+		fatalf("Could not create temporary directory for bugs propagation log: %v", err)
 	}
-	blockFactory, err := block.NewFactory(stagingStore, paired, cfg.EncryptionKeyBytes())
+	paired, err := storage.NewPaired(cacheStore, remoteStore, logDir)
 	if err != nil {
-		log.Fatalf("Could not build block factory: %v", err)
+		fatalf("Could not start new paired store with log %q: %v", logDir, err)
+	}
+	var factoryOptions []block.FactoryOption
+	if os.Args[1] == "recover-staging" {
+		// To reattach staged values sealed by an interrupted seal.
+		journal, err := block.OpenSealJournal(cfg.SealJournalFilePath())
+		if err != nil {
+			fatalf("Could not open seal journal: %v", err)
+		}
+		factoryOptions = append(factoryOptions, block.WithSealJournal(journal))
+	}
+	blockFactory, err := block.NewFactory(stagingStore, paired, cfg.EncryptionKeyBytes(), factoryOptions...)
+	if err != nil {
+		fatalf("Could not build block factory: %v", err)
 	}
 	treeStore, err := tree.NewStore(blockFactory, remoteStore, globalContext.base)
 	if err != nil {
-		log.Fatalf("Could not load tree: %v", err)
+		fatalf("Could not load tree: %v", err)
 	}
 
 	rootKey, err := treeStore.LocalRootKey()
@@ -287,73 +617,190 @@ func main() {
 		err = nil
 	}
 	if err != nil {
-		log.Fatalf("Could not load tree: %v", err)
+		fatalf("Could not load tree: %v", err)
 	}
 	localTree, err := tree.NewTree(treeStore, tree.WithRoot(rootKey))
 	if err != nil {
-		log.Fatalf("Could not load tree: %v", err)
+		fatalf("Could not load tree: %v", err)
 	}
 
+	// Listing a large store takes a while; an interrupt stops it
+	// between pages.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	switch cmd := os.Args[1]; cmd {
 
+	case "apply-bundle":
+		in := os.Stdin
+		if applyBundleFlags.NArg() == 1 {
+			f, err := os.Open(applyBundleFlags.Arg(0))
+			if err != nil {
+				fatalf("apply-bundle: %v", err)
+			}
+			defer func() { _ = f.Close() }()
+			in = f
+		}
+		// Straight to the remote store, as the propagation from the
+		// cache would not outlive this process.
+		if err := applyBundleFile(os.Stdout, in, treeStore, remoteStore, bundleContext.tagName); err != nil {
+			fatalf("apply-bundle: %v", err)
+		}
+
+	case "bisect":
+		if err := doBisect(os.Stdout, cfg, treeStore, globalContext.base, os.Args[2], bisectContext.tagName, bisectFlags.Args()); err != nil {
+			fatalf("bisect: %v", err)
+		}
+
+	case "bundle":
+		from, to, err := parseRevisionRange(bundleContext.revisions)
+		if err != nil {
+			fatalf("bundle: %v", err)
+		}
+		keys, revisions, err := bundleKeys(treeStore, bundleContext.tagName, from, to)
+		if err != nil {
+			fatalf("bundle: %v", err)
+		}
+		out := os.Stdout
+		if bundleContext.output != "" {
+			if out, err = os.Create(bundleContext.output); err != nil {
+				fatalf("bundle: %v", err)
+			}
+		}
+		stats, err := writeBundle(out, from, to, keys, paired)
+		if err == nil && out != os.Stdout {
+			err = out.Close()
+		}
+		if err != nil {
+			if out != os.Stdout {
+				_ = os.Remove(bundleContext.output)
+			}
+			fatalf("bundle: %v", err)
+		}
+		stats.revisions = revisions
+		log.Printf("bundle: %v", stats)
+
 	case "clean":
+		if cleanContext.sweep {
+			pinned, err := tree.PinnedRevisions(cfg.PinsDirectoryPath())
+			if err != nil {
+				fatalf("clean: %v", err)
+			}
+			needed, err := treeStore.NeededKeys(localTree, strings.Split(cleanContext.tagNames, ","), cleanContext.count, pinned)
+			if err != nil {
+				fatalf("clean: %v", err)
+			}
+			stats, err := sweepGarbage(treeStore, remoteStore, cacheStore, needed, cleanContext.grace, os.Stderr, 5*time.Second)
+			log.Printf("clean: %d keys revived, %d deleted, %d failed, %d forgotten", stats.revived, stats.deleted, stats.failed, stats.forgotten)
+			if err != nil {
+				fatalf("clean: %v", err)
+			}
+			if stats.failed > 0 {
+				exit(1)
+			}
+			break
+		}
 		// TODO enable versioning for bucket containing remote roots
 		m := make(map[string]struct{})
-		f, err := os.Open(cleanContext.storedKeys)
+		if cleanContext.storedKeys == "" {
+			store, ok := remoteStore.(storage.Lister)
+			if !ok {
+				fatalf("clean: the store can't list keys, use -stored")
+			}
+			err := storage.ListAll(ctx, store, func(ki storage.KeyInfo) error {
+				m[string(ki.Key)] = struct{}{}
+				return nil
+			})
+			if err != nil {
+				fatalf("clean: listing stored keys: %v", err)
+			}
+		} else {
+			f, err := os.Open(cleanContext.storedKeys)
+			if err != nil {
+				fatalf("Could not open file containing stored keys %q: %v", cleanContext.storedKeys, err)
+			}
+			s := bufio.NewScanner(f)
+			for s.Scan() {
+				m[s.Text()] = struct{}{}
+			}
+			if err := s.Err(); err != nil {
+				fatalf("Error scanning file %q: %v", f.Name(), err)
+			}
+			_ = f.Close()
+		}
+		log.Printf("clean: found %d stored keys", len(m))
+		f, err := os.Open(cleanContext.neededKeys)
 		if err != nil {
-			log.Fatalf("Could not open file containing stored keys %q: %v", cleanContext.storedKeys, err)
+			fatalf("Could not open file containing still needed keys %q: %v", cleanContext.neededKeys, err)
 		}
 		s := bufio.NewScanner(f)
 		for s.Scan() {
-			m[s.Text()] = struct{}{}
+			delete(m, s.Text())
 		}
 		if err := s.Err(); err != nil {
-			log.Fatalf("Error scanning file %q: %v", f.Name(), err)
+			fatalf("Error scanning file %q: %v", f.Name(), err)
 		}
-		_ = f.Close()
-		log.Printf("clean: found %d stored keys", len(m))
-		f, err = os.Open(cleanContext.neededKeys)
+		log.Printf("clean: %d stored keys that are no longer needed", len(m))
+		// Keep what's needed by revisions in use, e.g., browsed
+		// through musclefs, even if not in the list of needed keys.
+		pinned, err := tree.PinnedRevisions(cfg.PinsDirectoryPath())
 		if err != nil {
-			log.Fatalf("Could not open file containing still needed keys %q: %v", cleanContext.neededKeys, err)
+			fatalf("clean: %v", err)
 		}
-		s = bufio.NewScanner(f)
-		for s.Scan() {
-			delete(m, s.Text())
+		for _, revision := range pinned {
+			t, err := tree.NewTree(treeStore, tree.WithRevision(revision))
+			if err != nil {
+				fatalf("clean: loading pinned revision %v: %v", revision, err)
+			}
+			inUse, err := t.ReachableKeys(nil)
+			if err != nil {
+				fatalf("clean: keys of pinned revision %v: %v", revision, err)
+			}
+			for k := range inUse {
+				delete(m, k)
+			}
 		}
-		if err := s.Err(); err != nil {
-			log.Fatalf("Error scanning file %q: %v", f.Name(), err)
+		if len(pinned) > 0 {
+			log.Printf("clean: %d stored keys that are no longer needed and not in use by %d pinned revisions", len(m), len(pinned))
 		}
-		log.Printf("clean: %d stored keys that are no longer needed", len(m))
-		i := 0
+		var keys []storage.Key
 		for keyHex := range m {
-			if keyHex == "base" || strings.HasPrefix(keyHex, tree.RemoteRootKeyPrefix) {
+			if keyHex == "base" || strings.HasPrefix(keyHex, tree.RemoteRootKeyPrefix) || strings.HasPrefix(keyHex, tree.InstanceKeyPrefix) {
 				continue
 			}
-			key, _ := storage.NewPointerFromHex(keyHex) // TODO handle rror
-			// TODO log a warning
-			// TODO rethink output
-			_ = cacheStore.Delete(key.Key()) // Best effort
-			err := remoteStore.Delete(key.Key())
+			key, err := storage.NewPointerFromHex(keyHex)
 			if err != nil {
-				fmt.Print("O")
-				log.Printf("clean: %v", err)
-			} else {
-				fmt.Print(".")
+				log.Printf("clean: skipping %q: %v", keyHex, err)
+				continue
 			}
-			i++
-			if i%80 == 0 {
-				fmt.Print("\n")
+			keys = append(keys, key.Key())
+		}
+		marked, err := markGarbage(treeStore, keys, time.Now())
+		if err != nil {
+			fatalf("clean: %v", err)
+		}
+		log.Printf("clean: %d keys marked as garbage, %d marked already", marked, len(keys)-marked)
+		log.Printf("clean: run “muscle clean -sweep” in %v to delete them", cleanContext.grace)
+
+	case "debug":
+		refs := make([]block.Ref, emptyFlags.NArg()-1)
+		for i, arg := range emptyFlags.Args()[1:] {
+			if refs[i], err = block.ParseRef(arg); err != nil {
+				fatalf("debug: %v", err)
 			}
 		}
+		if err := blockFactory.Cat(os.Stdout, refs); err != nil {
+			fatalf("debug: %v", err)
+		}
 
 	case "diff":
 		tag, err := treeStore.RemoteTag(diffContext.tagName)
 		if err != nil {
-			log.Fatalf("diff: %v", err)
+			fatalf("diff: %v", err)
 		}
 		remoteTree, err := tree.NewTree(treeStore, tree.WithRevision(tag.Pointer))
 		if err != nil {
-			log.Fatalf("diff: %v", err)
+			fatalf("diff: %v", err)
 		}
 		err = tree.DiffTrees(
 			remoteTree,
@@ -364,27 +811,96 @@ func main() {
 			tree.DiffTreesInitialPath(diffContext.prefix),
 			tree.DiffTreesNamesOnly(diffContext.names),
 			tree.DiffTreesVerbose(diffContext.verbose),
+			tree.DiffTreesMaxSize(uint64(cfg.DiffMaxSize)),
 		)
 		if err != nil {
-			log.Fatalf("diff: %v", err)
+			fatalf("diff: %v", err)
 		}
 
+	case "export":
+		var revision storage.Pointer
+		if exportContext.revision != "" {
+			if revision, err = storage.NewPointerFromHex(exportContext.revision); err != nil {
+				fatalf("export: %v", err)
+			}
+		} else {
+			tag, err := treeStore.RemoteTag(exportContext.tagName)
+			if err != nil {
+				fatalf("export: %v", err)
+			}
+			if tag.Pointer.IsNull() {
+				fatalf("export: tag %q points to no revision", exportContext.tagName)
+			}
+			revision = tag.Pointer
+		}
+		t, err := tree.NewTree(treeStore, tree.WithRevision(revision))
+		if err != nil {
+			fatalf("export: %v", err)
+		}
+		stats, err := exportTree(t, exportFlags.Arg(0), exportContext.options)
+		if err != nil {
+			fatalf("export: %v", err)
+		}
+		log.Printf("export: %v", stats)
+
+	case "garbage":
+		store, ok := remoteStore.(storage.Lister)
+		if !ok {
+			fatalf("garbage: the store can't list keys")
+		}
+		pinned, err := tree.PinnedRevisions(cfg.PinsDirectoryPath())
+		if err != nil {
+			fatalf("garbage: %v", err)
+		}
+		needed, err := treeStore.NeededKeys(localTree, strings.Split(garbageContext.tagNames, ","), garbageContext.count, pinned)
+		if err != nil {
+			fatalf("garbage: %v", err)
+		}
+		stored, garbage, err := countGarbage(ctx, store, needed)
+		if err != nil {
+			fatalf("garbage: %v", err)
+		}
+		writeGarbageReport(os.Stdout, stored, garbage)
+
 	case "history":
 		tag, err := treeStore.RemoteTag(historyContext.tagName)
 		if err != nil {
-			log.Fatalf("could not read base pointer: %+v", err)
+			fatalf("could not read base pointer: %+v", err)
 		}
 		rev, err := treeStore.LoadRevisionByKey(tag.Pointer)
 		if err != nil {
-			log.Fatalf("could not load revision %v: %+v", tag.Pointer, err)
+			fatalf("could not load revision %v: %+v", tag.Pointer, err)
 		}
 		rr, err := treeStore.History(historyContext.count, rev, historyContext.tagName)
 		if err != nil {
 			log.Printf("history may be truncated: %+v", err)
 		}
+		var tmpl *template.Template
+		var tags map[string][]string
+		if historyContext.format != "" {
+			if tmpl, err = parseHistoryFormat(historyContext.format); err != nil {
+				fatalf("history: %v", err)
+			}
+			if tags, err = historyTags(treeStore, historyContext.tagName, rr); err != nil {
+				fatalf("history: %v", err)
+			}
+		}
 		for i := 0; i < len(rr); i++ {
 			this := rr[i]
-			fmt.Println(this)
+			if tmpl != nil {
+				if err := formatRevision(os.Stdout, tmpl, this, tags); err != nil {
+					fatalf("history: %v", err)
+				}
+			} else {
+				fmt.Println(this)
+			}
+			if historyContext.stat {
+				if stat, err := revisionStat(treeStore, this, historyContext.tagName); err != nil {
+					log.Printf("history: %v", err)
+				} else {
+					fmt.Printf(" %v\n", stat)
+				}
+			}
 			if historyContext.diff && i < len(rr)-1 {
 				var a, b *tree.Tree
 				var arootpath, brootpath string
@@ -406,6 +922,7 @@ func main() {
 					tree.DiffTreesInitialPath(historyContext.prefix),
 					tree.DiffTreesNamesOnly(historyContext.names),
 					tree.DiffTreesVerbose(historyContext.verbose),
+					tree.DiffTreesMaxSize(uint64(cfg.DiffMaxSize)),
 				)
 				if err != nil {
 					log.Printf("could not diff against remote tree: %+v", err)
@@ -419,17 +936,28 @@ func main() {
 		// TODO note about encryption and that it's probably bad
 		store, ok := remoteStore.(storage.Lister)
 		if !ok {
-			log.Fatal("Store does not implement github.com/nicolagi/muscle/internal/storage.Lister.")
-		}
-		keys, err := store.List()
-		if err != nil {
-			log.Fatalf("Could not list keys in store: %v", err)
+			fatalf("Store does not implement github.com/nicolagi/muscle/internal/storage.Lister.")
 		}
-		for key := range keys {
+		err := storage.ListAll(ctx, store, func(ki storage.KeyInfo) error {
 			// Do not print keys that are not hash pointers, e.g., "remote.root.myhost", "extraneous-key", ...
-			if _, err := storage.NewPointerFromHex(key); err == nil {
-				fmt.Println(key)
+			if _, err := storage.NewPointerFromHex(string(ki.Key)); err == nil {
+				fmt.Println(ki.Key)
 			}
+			return nil
+		})
+		if err != nil {
+			fatalf("Could not list keys in store: %v", err)
+		}
+
+	case "prefetch":
+		keys, err := block.LoadReadOrder(cfg.ReadOrderFilePath())
+		if err != nil {
+			fatalf("prefetch: %v", err)
+		}
+		stats := prefetch(remoteStore, cacheStore, keys)
+		log.Printf("prefetch: %d keys cached already, %d fetched, %d failed", stats.cached, stats.fetched, stats.failed)
+		if stats.failed > 0 {
+			exit(1)
 		}
 
 	case "reachable":
@@ -438,26 +966,127 @@ func main() {
 		for s.Scan() {
 			key, err := storage.NewPointerFromHex(s.Text())
 			if err != nil {
-				log.Fatalf("reachable: %v", err)
+				fatalf("reachable: %v", err)
 			}
 			log.Printf("reachable: examining revision %q", key)
 			t, err := tree.NewTree(treeStore, tree.WithRevision(key))
 			if err != nil {
-				log.Fatalf("reachable: %v", err)
+				fatalf("reachable: %v", err)
 			}
 			if _, err := t.ReachableKeys(m); err != nil {
-				log.Fatalf("reachable: %v", err)
+				fatalf("reachable: %v", err)
 			}
 		}
 		if err := s.Err(); err != nil {
-			log.Fatalf("reachable: %v", err)
+			fatalf("reachable: %v", err)
 		}
 		for k := range m {
 			fmt.Println(k)
 		}
 
+	case "recover-staging":
+		r, err := localTree.RecoverStaging(ctx, stagingStore, storage.NewDiskStore(cfg.QuarantineDirectoryPath()))
+		if err != nil {
+			fatalf("recover-staging: %v", err)
+		}
+		fmt.Printf("%d staged values not in use: %d reattached, %d quarantined in %s\n", r.Orphaned, r.Reattached, r.Quarantined, cfg.QuarantineDirectoryPath())
+
+	case "remotes":
+		if err := treeStore.WriteRemoteTags(ctx, os.Stdout, time.Now()); err != nil {
+			fatalf("remotes: %v", err)
+		}
+
+	case "status":
+		instances, err := treeStore.Instances(ctx)
+		if err != nil {
+			fatalf("status: %v", err)
+		}
+		if !statusContext.all {
+			host, err := os.Hostname()
+			if err != nil {
+				fatalf("status: %v", err)
+			}
+			var mine []tree.Instance
+			for _, i := range instances {
+				if i.Host == host {
+					mine = append(mine, i)
+				}
+			}
+			if len(mine) == 0 {
+				fatalf("status: no record of musclefs on %s in the store", host)
+			}
+			instances = mine
+		}
+		window := statusContext.stale
+		if window == 0 {
+			window = cfg.StaleAfter
+		}
+		if window == 0 {
+			window = defaultStaleAfter
+		}
+		if writeStatus(os.Stdout, instances, time.Now(), window) > 0 {
+			exit(1)
+		}
+
+	case "repair-history":
+		var keys [2]storage.Pointer
+		for i, arg := range repairFlags.Args() {
+			if keys[i], err = storage.NewPointerFromHex(arg); err != nil {
+				fatalf("repair-history: %v", err)
+			}
+		}
+		if err := repairHistory(os.Stdout, treeStore, repairContext.tagName, keys[0], keys[1]); err != nil {
+			fatalf("repair-history: %v", err)
+		}
+
+	case "tag":
+		var revisions []storage.Pointer
+		for _, arg := range tagFlags.Args() {
+			r, err := storage.NewPointerFromHex(arg)
+			if err != nil {
+				fatalf("tag: %v", err)
+			}
+			revisions = append(revisions, r)
+		}
+		if err := keepRevisions(os.Stdout, treeStore, revisions, tagContext.keep); err != nil {
+			fatalf("tag: %v", err)
+		}
+
 	case "upload":
-		doUpload(cacheStore, remoteStore)
+		if err := doUpload(cacheStore, remoteStore); err != nil {
+			fatalf("upload: error: %v", err)
+		}
+
+	case "verify":
+		var revision storage.Pointer
+		if verifyContext.revision != "" {
+			if revision, err = storage.NewPointerFromHex(verifyContext.revision); err != nil {
+				fatalf("verify: %v", err)
+			}
+		} else {
+			tag, err := treeStore.RemoteTag(verifyContext.tagName)
+			if err != nil {
+				fatalf("verify: %v", err)
+			}
+			if tag.Pointer.IsNull() {
+				fatalf("verify: tag %q points to no revision", verifyContext.tagName)
+			}
+			revision = tag.Pointer
+		}
+		// Bypass the cache, see verifyRevision.
+		remoteFactory, err := block.NewFactory(stagingStore, remoteStore, cfg.EncryptionKeyBytes())
+		if err != nil {
+			fatalf("verify: %v", err)
+		}
+		remoteTreeStore, err := tree.NewStore(remoteFactory, remoteStore, globalContext.base)
+		if err != nil {
+			fatalf("verify: %v", err)
+		}
+		stats, err := verifyRevision(os.Stdout, remoteTreeStore, remoteFactory, revision, verifyContext.force)
+		log.Printf("verify: %v", stats)
+		if err != nil {
+			fatalf("verify: %v", err)
+		}
 
 	case "version":
 		fmt.Println(version)
@@ -465,25 +1094,119 @@ func main() {
 	default:
 		panic("not reached")
 	}
+
+	saveMetrics()
+}
+
+// A commandError reports that musclefs failed to run a command written
+// to its control file, as opposed to a failure communicating with it.
+type commandError struct {
+	command string
+	err     error
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("command %q: %v", e.command, e.err)
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
 }
 
-func doControl(c *config.C, args []string) error {
+func doControl(c *config.C, args []string, socket bool, once string) error {
 	const method = "doControl"
-	user := p.OsUsers.Uid2User(os.Getuid())
-	fs, err := clnt.Mount(c.ListenNet, c.ListenAddr, "", 8192, user)
-	if err != nil {
-		return errorf(method, "connecting to %s: %v", c.ListenAddr, err)
-	}
-	defer fs.Unmount()
-	ctl, err := fs.FOpen("ctl", p.ORDWR)
-	if err != nil {
-		return errorf(method, "opening control file: %v", err)
+	var send func(name string, command []byte) error
+	maxScript := -1
+	if socket {
+		conn, err := net.Dial("unix", c.ControlSocketPath())
+		if err != nil {
+			return errorf(method, "connecting to %s: %v", c.ControlSocketPath(), err)
+		}
+		defer func() { _ = conn.Close() }()
+		r := bufio.NewReader(conn)
+		send = func(name string, command []byte) error {
+			// Copy, the command may be the scanner's buffer.
+			request := append([]byte(nil), command...)
+			if name == "script" {
+				// The script ends at a line holding only a dot.
+				if !bytes.HasSuffix(request, []byte("\n")) {
+					request = append(request, '\n')
+				}
+				request = append(request, ".\n"...)
+			} else {
+				request = append(request, '\n')
+			}
+			if _, err := conn.Write(request); err != nil {
+				return errorf(method, "sending command %q: %v", name, err)
+			}
+			var status string
+			var n int
+			if header, err := r.ReadString('\n'); err != nil {
+				return errorf(method, "reading response for command %q: %v", name, err)
+			} else if _, err := fmt.Sscanf(header, "%s %d\n", &status, &n); err != nil {
+				return errorf(method, "malformed response header %q for command %q: %v", header, name, err)
+			}
+			response := make([]byte, n)
+			if _, err := io.ReadFull(r, response); err != nil {
+				return errorf(method, "reading response for command %q: %v", name, err)
+			}
+			if _, err := os.Stdout.Write(response); err != nil {
+				return errorf(method, "writing response to standard output for command %q: %v", name, err)
+			}
+			if status != "ok" {
+				return &commandError{command: name, err: errors.New("failed")}
+			}
+			return nil
+		}
+	} else {
+		user := p.OsUsers.Uid2User(os.Getuid())
+		fs, err := clnt.Mount(c.ListenNet, c.ListenAddr, "", 8192, user)
+		if err != nil {
+			return errorf(method, "connecting to %s: %v", c.ListenAddr, err)
+		}
+		defer fs.Unmount()
+		ctl, err := fs.FOpen("ctl", p.ORDWR)
+		if err != nil {
+			return errorf(method, "opening control file: %v", err)
+		}
+		defer func() {
+			if err := ctl.Close(); err != nil {
+				log.Printf("warning: closing control file: %v", err)
+			}
+		}()
+		// The whole script must go in a single write, which the
+		// client would silently truncate.
+		maxScript = int(fs.Msize - p.IOHDRSZ)
+		send = func(name string, command []byte) error {
+			// The write fails if the command fails, but the response,
+			// with the details, is there to be read anyway.
+			_, cerr := ctl.Write(command)
+			if _, err := ctl.Seek(0, 0); err != nil {
+				return errorf(method, "seeking to beginning of control file: %v", err)
+			}
+			if response, err := ioutil.ReadAll(ctl); err != nil {
+				return errorf(method, "reading response for command %q: %v", command, err)
+			} else if _, err := os.Stdout.Write(response); err != nil {
+				return errorf(method, "writing response to standard output for command %q: %v", command, err)
+			}
+			if cerr != nil {
+				return &commandError{command: name, err: cerr}
+			}
+			return nil
+		}
 	}
-	defer func() {
-		if err := ctl.Close(); err != nil {
-			log.Printf("warning: closing control file: %v", err)
+
+	if len(args) == 1 && args[0] == "script" {
+		body, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return errorf(method, "reading script: %v", err)
+		}
+		script := append([]byte(oncePrefix(once, 0)+"script\n"), body...)
+		if maxScript >= 0 && len(script) > maxScript {
+			return errorf(method, "script is %d bytes, at most %d fit in a message", len(script), maxScript)
 		}
-	}()
+		return send("script", script)
+	}
 
 	var s *bufio.Scanner
 	if len(args) > 0 {
@@ -491,17 +1214,18 @@ func doControl(c *config.C, args []string) error {
 	} else {
 		s = bufio.NewScanner(os.Stdin)
 	}
-	for s.Scan() {
-		if _, err := ctl.Write(s.Bytes()); err != nil {
-			return errorf(method, "writing command %q: %v", s.Bytes(), err)
-		}
-		if _, err := ctl.Seek(0, 0); err != nil {
-			return errorf(method, "seeking to beginning of control file: %v", err)
+	// Commands from standard input need tokens of their own.
+	n := 0
+	if len(args) == 0 {
+		n = 1
+	}
+	for ; s.Scan(); n++ {
+		command := s.Bytes()
+		if once != "" {
+			command = append([]byte(oncePrefix(once, n)), command...)
 		}
-		if response, err := ioutil.ReadAll(ctl); err != nil {
-			return errorf(method, "reading response for command %q: %v", s.Bytes(), err)
-		} else if _, err := os.Stdout.Write(response); err != nil {
-			return errorf(method, "writing response to standard output for command %q: %v", s.Bytes(), err)
+		if err := send(s.Text(), command); err != nil {
+			return err
 		}
 	}
 	if err := s.Err(); err != nil {
@@ -510,13 +1234,31 @@ func doControl(c *config.C, args []string) error {
 	return nil
 }
 
-func doUpload(fromStore, toStore storage.Store) {
+// oncePrefix returns the prefix making musclefs run a command at most
+// once, for the token, numbered unless n is zero, or nothing without a
+// token.
+func oncePrefix(token string, n int) string {
+	switch {
+	case token == "":
+		return ""
+	case n == 0:
+		return "once " + token + " "
+	default:
+		return fmt.Sprintf("once %s.%d ", token, n)
+	}
+}
+
+func doUpload(fromStore, toStore storage.Store) error {
 	completed := uint32(0)
 	pending := make(chan storage.Key, 4096)
 	uploaders := sync.WaitGroup{}
 	// upload runs in a goroutine and uses the three variables above.
 	upload := func() {
 		for key := range pending {
+			// Skip keys already uploaded, e.g., by a previous interrupted run.
+			if ok, err := toStore.Contains(key); err == nil && ok {
+				continue
+			}
 		get:
 			value, err := fromStore.Get(key)
 			if err != nil {
@@ -545,10 +1287,11 @@ func doUpload(fromStore, toStore storage.Store) {
 	for s.Scan() {
 		pending <- storage.Key(s.Text())
 	}
-	if err := s.Err(); err != nil {
-		log.Fatalf("upload: error: could not scan keys from standard input: %v", err)
-	}
 	close(pending)
 	uploaders.Wait()
 	log.Printf("upload: uploaded %d keys", completed)
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("could not scan keys from standard input: %w", err)
+	}
+	return nil
 }
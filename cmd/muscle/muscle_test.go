@@ -8,7 +8,10 @@ import (
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/nicolagi/muscle/internal/block"
 	"github.com/nicolagi/muscle/internal/config"
+	"github.com/nicolagi/muscle/internal/storage"
+	"github.com/nicolagi/muscle/internal/tree"
 )
 
 /*
@@ -66,7 +69,7 @@ func TestInit(t *testing.T) {
 		if err := ioutil.WriteFile(path, contents, 0600); err != nil {
 			t.Fatalf("could not write random config file at %q: %v", path, err)
 		}
-		if err := config.Initialize(base); err == nil {
+		if err := config.Initialize(base, "disk"); err == nil {
 			t.Error("expected an error, got nil")
 		}
 		got, err := ioutil.ReadFile(path)
@@ -77,6 +80,28 @@ func TestInit(t *testing.T) {
 			t.Errorf("config file has changed (-want +got):\n%s", diff)
 		}
 	})
+	t.Run("memory storage configuration", func(t *testing.T) {
+		base := t.TempDir()
+		if err := config.Initialize(base, "memory"); err != nil {
+			t.Fatal(err)
+		}
+		c, err := config.Load(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := c.Storage, "memory"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if c.DiskStoreDir != "" {
+			t.Errorf("got %q, want no disk store dir", c.DiskStoreDir)
+		}
+	})
+	t.Run("unsupported storage type", func(t *testing.T) {
+		base := t.TempDir()
+		if err := config.Initialize(base, "s3"); err == nil {
+			t.Error("expected an error, got nil")
+		}
+	})
 	t.Run("creates working configuration", func(t *testing.T) {
 		t.Skip("TODO rewrite using push/pull")
 		/*
@@ -86,7 +111,7 @@ func TestInit(t *testing.T) {
 			}
 			defer tryRemoveAll(base)
 			base = filepath.Join(base, "muscle") // Ensures init creates dirs if necessary.
-			if err := config.Initialize(base); err != nil {
+			if err := config.Initialize(base, "disk"); err != nil {
 				t.Fatal(err)
 			}
 			c, err := config.Load(base)
@@ -165,3 +190,26 @@ func TestInit(t *testing.T) {
 		*/
 	})
 }
+
+// setUpTree returns a mutable tree backed by in-memory stores, with
+// the tree store and block factory it uses, and the remote store of
+// blocks, for tests to tamper with.
+func setUpTree(t *testing.T) (lt *tree.Tree, store *tree.Store, factory *block.Factory, repository *storage.InMemory) {
+	t.Helper()
+	key := make([]byte, 16)
+	rand.Read(key)
+	repository = &storage.InMemory{}
+	factory, err := block.NewFactory(&storage.InMemory{}, repository, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err = tree.NewStore(factory, &storage.InMemory{}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt, err = tree.NewTree(store, tree.WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lt, store, factory, repository
+}
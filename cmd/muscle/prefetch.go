@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// How many keys prefetch fetches concurrently.
+const prefetchWorkers = 4
+
+// prefetchStats summarizes the outcome of prefetch.
+type prefetchStats struct {
+	cached  int
+	fetched int
+	failed  int
+}
+
+// prefetch copies the values of the keys from the remote store to the
+// cache, skipping those cached already. Fetches start in the order of
+// the keys, e.g., the order in which musclefs read them, so that the
+// first blocks needed are the first available. Failures are logged.
+func prefetch(remote, cache storage.Store, keys []storage.Key) prefetchStats {
+	var (
+		mu    sync.Mutex
+		stats prefetchStats
+		wg    sync.WaitGroup
+	)
+	count := func(n *int) {
+		mu.Lock()
+		*n++
+		mu.Unlock()
+	}
+	queue := make(chan storage.Key)
+	for i := 0; i < prefetchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range queue {
+				if ok, err := cache.Contains(k); err == nil && ok {
+					count(&stats.cached)
+					continue
+				}
+				v, err := remote.Get(k)
+				if err == nil {
+					err = cache.Put(k, v)
+				}
+				if err != nil {
+					log.Printf("prefetch: %v", err)
+					count(&stats.failed)
+					continue
+				}
+				count(&stats.fetched)
+			}
+		}()
+	}
+	for _, k := range keys {
+		queue <- k
+	}
+	close(queue)
+	wg.Wait()
+	return stats
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestPrefetch(t *testing.T) {
+	remote := &storage.InMemory{}
+	cache := &storage.InMemory{}
+	var keys []storage.Key
+	for i := 0; i < 10; i++ {
+		k := storage.RandomPointer().Key()
+		if err := remote.Put(k, storage.Value("value")); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	if err := cache.Put(keys[0], storage.Value("value")); err != nil {
+		t.Fatal(err)
+	}
+	keys = append(keys, storage.RandomPointer().Key())
+
+	got := prefetch(remote, cache, keys)
+	if want := (prefetchStats{cached: 1, fetched: 9, failed: 1}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	for _, k := range keys[:10] {
+		if ok, err := cache.Contains(k); err != nil || !ok {
+			t.Errorf("%v: got %v, %v, want cached", k, ok, err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/nicolagi/muscle/internal/storage"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// repairHistory splices the history of the tag, so that the revision
+// whose parent along the tag is oldParent, lost, gets newParent as
+// parent instead, see tree.Store.SpliceHistory, and points the tag and,
+// if it was replaced, the local base to the new revisions. The tag is
+// only updated if it did not move in the meantime.
+func repairHistory(w io.Writer, treeStore *tree.Store, tagName string, oldParent, newParent storage.Pointer) error {
+	const method = "repairHistory"
+	tag, err := treeStore.RemoteTag(tagName)
+	if err != nil {
+		return errorf(method, "%v", err)
+	}
+	replaced, err := treeStore.SpliceHistory(tag.Pointer, tagName, oldParent, newParent)
+	if err != nil {
+		return errorf(method, "%v", err)
+	}
+	var keys []string
+	for k := range replaced {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(w, "%s replaced by %v\n", k, replaced[k])
+	}
+	head := replaced[tag.Pointer.Hex()]
+	if err := treeStore.UpdateRemoteTags([]tree.Tag{tag}, head); err != nil {
+		return errorf(method, "%v", err)
+	}
+	_, _ = fmt.Fprintf(w, "tag %s updated to %v\n", tagName, head)
+	localbase, err := treeStore.LocalBasePointer()
+	if err != nil {
+		return errorf(method, "%v", err)
+	}
+	if p, ok := replaced[localbase.Hex()]; ok {
+		if err := treeStore.SetLocalBasePointer(p); err != nil {
+			return errorf(method, "%v", err)
+		}
+		_, _ = fmt.Fprintf(w, "local base updated to %v\n", p)
+	}
+	return nil
+}
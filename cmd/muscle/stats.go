@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// writeStatsReport writes the counts of calls to the stores since the
+// given time, and the monthly cost of the calls to the named remote
+// store according to the cost model, extrapolated from the period up
+// to now.
+func writeStatsReport(w io.Writer, since time.Time, entries []storage.MetricsEntry, remote string, model storage.CostModel, now time.Time) {
+	period := now.Sub(since)
+	_, _ = fmt.Fprintf(w, "since %s (%v)\n", since.Format(time.RFC3339), period.Truncate(time.Second))
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', tabwriter.AlignRight)
+	_, _ = fmt.Fprintln(tw, "store\top\tcalls\tbytes\t")
+	for _, e := range entries {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t\n", e.Store, e.Op, e.Calls, e.Bytes)
+	}
+	_ = tw.Flush()
+	if len(model.PerThousandCalls) == 0 && model.PerGiBRead == 0 {
+		_, _ = fmt.Fprintln(w, "no cost model configured, see request-cost and transfer-cost")
+		return
+	}
+	cost := model.Cost(entries, remote)
+	_, _ = fmt.Fprintf(w, "cost %s %.4f\n", remote, cost)
+	_, _ = fmt.Fprintf(w, "monthly-cost %s %.4f\n", remote, storage.Monthly(cost, period))
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// The window of the status command if not configured.
+const defaultStaleAfter = 7 * 24 * time.Hour
+
+// writeStatus writes a line per instance, with how long ago it last
+// pushed, flushed, and was seen running, and "stale" at the end if it
+// hasn't pushed within the window. It returns how many are stale.
+func writeStatus(w io.Writer, instances []tree.Instance, now time.Time, window time.Duration) (stale int) {
+	ago := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return now.Sub(t).Truncate(time.Second).String() + " ago"
+	}
+	for _, i := range instances {
+		_, _ = fmt.Fprintf(w, "%s pushed %s, flushed %s, seen %s", i.Host, ago(i.Pushed), ago(i.Flushed), ago(i.Seen))
+		if now.Sub(i.Pushed) > window {
+			stale++
+			_, _ = fmt.Fprint(w, ", stale")
+		}
+		_, _ = fmt.Fprintln(w)
+	}
+	return stale
+}
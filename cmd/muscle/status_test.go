@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+func TestWriteStatus(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	instances := []tree.Instance{
+		{Host: "desktop", Seen: now.Add(-time.Minute), Flushed: now.Add(-2 * time.Minute), Pushed: now.Add(-time.Hour)},
+		{Host: "laptop", Seen: now.Add(-9 * 24 * time.Hour), Pushed: now.Add(-10 * 24 * time.Hour)},
+		{Host: "new", Seen: now},
+	}
+	var b strings.Builder
+	if stale := writeStatus(&b, instances, now, 7*24*time.Hour); stale != 2 {
+		t.Errorf("got %d stale, want 2", stale)
+	}
+	want := "desktop pushed 1h0m0s ago, flushed 2m0s ago, seen 1m0s ago\n" +
+		"laptop pushed 240h0m0s ago, flushed never, seen 216h0m0s ago, stale\n" +
+		"new pushed never, flushed never, seen 0s ago, stale\n"
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/nicolagi/muscle/internal/storage"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// keepRevisions adds the revisions to the list of those garbage
+// collection retains regardless of age, or removes them from it if
+// keep is false, see tree.Store.SetKept. Without revisions, it writes
+// the list instead.
+func keepRevisions(w io.Writer, treeStore *tree.Store, revisions []storage.Pointer, keep bool) error {
+	const method = "keepRevisions"
+	if len(revisions) == 0 {
+		kept, err := treeStore.KeptRevisions()
+		if err != nil {
+			return errorf(method, "%v", err)
+		}
+		for _, r := range kept {
+			_, _ = fmt.Fprintln(w, r)
+		}
+		return nil
+	}
+	for _, r := range revisions {
+		if err := treeStore.SetKept(r, keep); err != nil {
+			return errorf(method, "%v", err)
+		}
+		if keep {
+			_, _ = fmt.Fprintf(w, "keeping %v\n", r)
+		} else {
+			_, _ = fmt.Fprintf(w, "no longer keeping %v\n", r)
+		}
+	}
+	return nil
+}
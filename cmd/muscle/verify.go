@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/internal/storage"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// verifyStats summarizes the outcome of a verification.
+type verifyStats struct {
+	nodes  int
+	blocks int
+	bytes  int64
+	failed int
+}
+
+func (s verifyStats) String() string {
+	return fmt.Sprintf("%d nodes, %d blocks, %d bytes verified, %d failed", s.nodes, s.blocks, s.bytes, s.failed)
+}
+
+// verifyRevision loads all nodes of the revision and all blocks of its
+// files, writing those missing or failing to decrypt to w, and points
+// tree.VerifiedTag to the revision if there are none. The tree store and
+// the factory must read from the remote store, not the cache, or a
+// value lost remotely but cached would pass. The tag is only updated if
+// it did not move in the meantime, e.g., by another verification, and
+// only advanced, to a revision descending from the one it points to,
+// unless forced.
+func verifyRevision(w io.Writer, treeStore *tree.Store, factory *block.Factory, revision storage.Pointer, force bool) (stats verifyStats, err error) {
+	const method = "verifyRevision"
+	tag, err := treeStore.RemoteTag(tree.VerifiedTag)
+	if err != nil {
+		return stats, errorf(method, "%v", err)
+	}
+	if !force && !tag.Pointer.IsNull() {
+		ok, err := treeStore.Descends(revision, tag.Pointer)
+		if err != nil {
+			return stats, errorf(method, "%v", err)
+		}
+		if !ok {
+			return stats, errorf(method, "%v does not descend from %v, which tag %s points to (see -force)", revision, tag.Pointer, tree.VerifiedTag)
+		}
+	}
+	t, err := tree.NewTree(treeStore, tree.WithRevision(revision))
+	if err != nil {
+		return stats, errorf(method, "%v", err)
+	}
+	verifyNode(w, t, factory, t.Attach(), make(map[storage.Key]bool), &stats)
+	if stats.failed > 0 {
+		return stats, errorf(method, "%d failed, tag %s not updated", stats.failed, tree.VerifiedTag)
+	}
+	if tag.Pointer.Equals(revision) {
+		_, _ = fmt.Fprintf(w, "tag %s already at %v\n", tree.VerifiedTag, revision)
+		return stats, nil
+	}
+	if err := treeStore.UpdateRemoteTags([]tree.Tag{tag}, revision); err != nil {
+		return stats, errorf(method, "%v", err)
+	}
+	_, _ = fmt.Fprintf(w, "tag %s updated to %v\n", tree.VerifiedTag, revision)
+	return stats, nil
+}
+
+// verifyNode verifies the node and those below it. File blocks are
+// read with new blocks from the factory, rather than through the node,
+// so that their values aren't kept. Blocks shared by files are only
+// read once.
+func verifyNode(w io.Writer, t *tree.Tree, factory *block.Factory, node *tree.Node, seen map[storage.Key]bool, stats *verifyStats) {
+	stats.nodes++
+	if node.IsDir() {
+		if err := t.Grow(node); err != nil {
+			_, _ = fmt.Fprintf(w, "%s: %v\n", node.Path(), err)
+			stats.failed++
+			return
+		}
+		for _, child := range node.Children() {
+			verifyNode(w, t, factory, child, seen, stats)
+		}
+		return
+	}
+	for _, e := range node.BlockMap() {
+		key := e.Ref.Key()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		b, err := factory.New(e.Ref, 0)
+		var value []byte
+		if err == nil {
+			value, err = b.ReadAll()
+		}
+		if err != nil {
+			_, _ = fmt.Fprintf(w, "%s: block at %d: %v\n", node.Path(), e.Offset, err)
+			stats.failed++
+			continue
+		}
+		stats.blocks++
+		stats.bytes += int64(len(value))
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/storage"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+func TestVerifyRevision(t *testing.T) {
+	lt, store, factory, repository := setUpTree(t)
+	_, root := lt.Root()
+	dir, err := lt.Add(root, "docs", 0700|tree.DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := lt.Add(dir, "notes.txt", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := func(content string) storage.Pointer {
+		t.Helper()
+		if err := file.WriteAt([]byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := lt.Seal(); err != nil {
+			t.Fatal(err)
+		}
+		tags, err := store.RemoteTags([]string{"base"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, root := lt.Root()
+		revision := tree.NewRevision(root, tags)
+		if err := store.StoreRevision(revision); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetRemoteTags([]string{"base"}, revision.Key()); err != nil {
+			t.Fatal(err)
+		}
+		return revision.Key()
+	}
+	verified := func() storage.Pointer {
+		t.Helper()
+		tag, err := store.RemoteTag(tree.VerifiedTag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tag.Pointer
+	}
+
+	good := push("hello")
+	stats, err := verifyRevision(ioutil.Discard, store, factory, good, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (verifyStats{nodes: 3, blocks: 1, bytes: 5}) {
+		t.Errorf("got %+v", stats)
+	}
+	if got := verified(); !got.Equals(good) {
+		t.Errorf("got %v, want %v", got, good)
+	}
+
+	// A block lost from the remote store fails the verification.
+	bad := push("world")
+	for _, e := range file.BlockMap() {
+		if err := repository.Delete(e.Ref.Key()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err = verifyRevision(ioutil.Discard, store, factory, bad, false)
+	if err == nil {
+		t.Fatal("got nil error")
+	}
+	if stats.failed != 1 {
+		t.Errorf("got %+v", stats)
+	}
+	if got := verified(); !got.Equals(good) {
+		t.Errorf("got %v, want %v", got, good)
+	}
+
+	// So does one that doesn't decrypt.
+	for _, e := range file.BlockMap() {
+		if err := repository.Put(e.Ref.Key(), []byte("garbage")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := verifyRevision(ioutil.Discard, store, factory, bad, false); err == nil {
+		t.Error("got nil error")
+	}
+	if got := verified(); !got.Equals(good) {
+		t.Errorf("got %v, want %v", got, good)
+	}
+
+	// The tag only moves back if forced.
+	later := push("again")
+	if _, err := verifyRevision(ioutil.Discard, store, factory, later, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyRevision(ioutil.Discard, store, factory, good, false); err == nil {
+		t.Error("got nil error moving the tag back")
+	}
+	if got := verified(); !got.Equals(later) {
+		t.Errorf("got %v, want %v", got, later)
+	}
+	if _, err := verifyRevision(ioutil.Discard, store, factory, good, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := verified(); !got.Equals(good) {
+		t.Errorf("got %v, want %v", got, good)
+	}
+}
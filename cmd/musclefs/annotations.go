@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/nicolagi/muscle/internal/linuxerr"
+	"github.com/nicolagi/muscle/internal/p9util"
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// The name of the file holding notes on a revision, e.g., "before the
+// reinstall", listed in the root directory of every revision browsed.
+// It hides a file of the same name in the revision, if any.
+const notesFileName = "NOTES"
+
+// Notes are kept in memory, so writes and truncations beyond this size
+// fail with EFBIG.
+const maxNotesSize = 1 << 20
+
+// annotations keeps notes on revisions in a directory, one file per
+// revision, since revisions are immutable.
+type annotations struct {
+	dir string
+
+	// The notes files, by revision, shared by all fids.
+	nodes map[string]*fsNode
+}
+
+func newAnnotations(dir string) *annotations {
+	return &annotations{dir: dir, nodes: make(map[string]*fsNode)}
+}
+
+// node returns the notes file for the revision, reading the notes the
+// first time.
+func (a *annotations) node(revision storage.Pointer) (*fsNode, error) {
+	const method = "annotations.node"
+	if node, ok := a.nodes[revision.Hex()]; ok {
+		return node, nil
+	}
+	now := time.Now()
+	node := &fsNode{
+		kind:     notesFile,
+		revision: revision,
+		dir: p.Dir{
+			Name:  notesFileName,
+			Mode:  0644,
+			Uid:   p9util.NodeUID,
+			Gid:   p9util.NodeGID,
+			Atime: uint32(now.Unix()),
+			Mtime: uint32(now.Unix()),
+			Qid:   p.Qid{Path: uint64(now.UnixNano())},
+		},
+	}
+	pathname := filepath.Join(a.dir, revision.Hex())
+	data, err := ioutil.ReadFile(pathname)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errorv(method, err)
+	}
+	if fi, err := os.Stat(pathname); err == nil {
+		node.dir.Mtime = uint32(fi.ModTime().Unix())
+	}
+	node.data = data
+	node.dir.Length = uint64(len(data))
+	a.nodes[revision.Hex()] = node
+	return node, nil
+}
+
+// write writes b at offset off of the notes, and saves them.
+func (a *annotations) write(node *fsNode, b []byte, off uint64) error {
+	if off > maxNotesSize || uint64(len(b)) > maxNotesSize-off {
+		return errorf("annotations.write", "offset %d: %w", off, linuxerr.EFBIG)
+	}
+	if end := int(off) + len(b); end > len(node.data) {
+		node.data = append(node.data, make([]byte, end-len(node.data))...)
+	}
+	copy(node.data[off:], b)
+	return a.save(node)
+}
+
+// truncate changes the length of the notes, and saves them.
+func (a *annotations) truncate(node *fsNode, size uint64) error {
+	if size > maxNotesSize {
+		return errorf("annotations.truncate", "length %d: %w", size, linuxerr.EFBIG)
+	}
+	if length := int(size); length <= len(node.data) {
+		node.data = node.data[:length]
+	} else {
+		node.data = append(node.data, make([]byte, length-len(node.data))...)
+	}
+	return a.save(node)
+}
+
+// save persists the notes, removing the file if they are empty.
+func (a *annotations) save(node *fsNode) error {
+	const method = "annotations.save"
+	node.dir.Length = uint64(len(node.data))
+	node.dir.Mtime = uint32(time.Now().Unix())
+	node.dir.Qid.Version++
+	pathname := filepath.Join(a.dir, node.revision.Hex())
+	if len(node.data) == 0 {
+		if err := os.Remove(pathname); err != nil && !os.IsNotExist(err) {
+			return errorv(method, err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(a.dir, 0700); err != nil {
+		return errorv(method, err)
+	}
+	if err := ioutil.WriteFile(pathname+".new", node.data, 0600); err != nil {
+		return errorv(method, err)
+	}
+	if err := os.Rename(pathname+".new", pathname); err != nil {
+		return errorv(method, err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/linuxerr"
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestAnnotations(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "annotations")
+	revision := storage.RandomPointer()
+	a := newAnnotations(dir)
+	node, err := a.node(revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.dir.Length != 0 {
+		t.Fatalf("got length %d, want empty notes", node.dir.Length)
+	}
+	if err := a.write(node, []byte("before the reinstall"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.write(node, []byte("upgrade"), 11); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.truncate(node, 18); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(node.data), "before the upgrade"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Notes survive a restart.
+	reloaded, err := newAnnotations(dir).node(revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(reloaded.data), "before the upgrade"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if reloaded.dir.Length != 18 {
+		t.Errorf("got length %d, want 18", reloaded.dir.Length)
+	}
+
+	// Emptying the notes removes their file.
+	if err := a.truncate(node, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, revision.Hex())); !os.IsNotExist(err) {
+		t.Errorf("got %v, want the notes file removed", err)
+	}
+
+	// Offsets and lengths are bounded, not to run out of memory.
+	for _, off := range []uint64{1 << 63, maxNotesSize, maxNotesSize - 1} {
+		if err := a.write(node, []byte("xy"), off); !errors.Is(err, linuxerr.EFBIG) {
+			t.Errorf("write at %d: got %v, want %v", off, err, linuxerr.EFBIG)
+		}
+	}
+	if err := a.truncate(node, 1<<62); !errors.Is(err, linuxerr.EFBIG) {
+		t.Errorf("got %v, want %v", err, linuxerr.EFBIG)
+	}
+	if len(node.data) != 0 {
+		t.Errorf("got %d bytes of notes, want none", len(node.data))
+	}
+	if err := a.write(node, []byte("x"), maxNotesSize-1); err != nil {
+		t.Error(err)
+	}
+}
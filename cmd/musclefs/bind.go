@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// refreshBinds points the directories showing remote tags at the root
+// of the file system, see config.C.Binds, to the revisions the tags
+// point to now, adding those missing. Walks into the directories
+// before a refresh keep seeing the previous revision, which stays
+// pinned until they are clunked. Tags that don't exist yet are
+// reported and skipped. The caller must hold the tree lock.
+func (ops *ops) refreshBinds(w io.Writer) {
+	for _, b := range ops.cfg.Binds {
+		tag, err := ops.treeStore.RemoteTag(b.Tag)
+		if err != nil {
+			_, _ = fmt.Fprintf(w, "bind %s: %v\n", b.Name, err)
+			continue
+		}
+		if tag.Pointer.IsNull() {
+			_, _ = fmt.Fprintf(w, "bind %s: no tag %q\n", b.Name, b.Tag)
+			continue
+		}
+		if child := ops.root.child(b.Name); child != nil && child.tree != nil && child.tree.Revision().Equals(tag.Pointer) {
+			continue
+		}
+		child, err := ops.historicRoot(tag.Pointer, b.Name)
+		if err != nil {
+			_, _ = fmt.Fprintf(w, "bind %s: %v\n", b.Name, err)
+			continue
+		}
+		ops.retire(ops.root.setChild(b.Name, child))
+		_, _ = fmt.Fprintf(w, "bind %s: tag %s at %v\n", b.Name, b.Tag, tag.Pointer)
+	}
+}
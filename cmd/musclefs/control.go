@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"flag"
+	"fmt"
 	"io"
 	"path/filepath"
+	"strings"
 
+	"github.com/nicolagi/muscle/internal/linuxerr"
+	"github.com/nicolagi/muscle/internal/storage"
 	"github.com/nicolagi/muscle/internal/tree"
 )
 
-func doDiff(w io.Writer, localTree *tree.Tree, treeStore *tree.Store, muscleFSMount string, args []string) error {
+func doDiff(w io.Writer, localTree *tree.Tree, treeStore *tree.Store, muscleFSMount string, maxSize int64, branch string, args []string) error {
 	const method = "doDiff"
 	var tagName string
 	var diffContext struct {
@@ -17,7 +22,7 @@ func doDiff(w io.Writer, localTree *tree.Tree, treeStore *tree.Store, muscleFSMo
 		verbose bool
 	}
 	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
-	flags.StringVar(&tagName, "b", "base", "tag `name`")
+	flags.StringVar(&tagName, "b", branch, "tag `name`")
 	flags.BoolVar(&diffContext.verbose, "v", false, "include metadata changes")
 	flags.BoolVar(&diffContext.names, "N", false, "only output paths that changed, not context diffs")
 	flags.StringVar(&diffContext.prefix, "prefix", "", "omit diffs outside of `path`, e.g., project/name")
@@ -44,9 +49,287 @@ func doDiff(w io.Writer, localTree *tree.Tree, treeStore *tree.Store, muscleFSMo
 		tree.DiffTreesInitialPath(diffContext.prefix),
 		tree.DiffTreesNamesOnly(diffContext.names),
 		tree.DiffTreesVerbose(diffContext.verbose),
+		tree.DiffTreesMaxSize(uint64(maxSize)),
 	)
 	if err != nil {
 		return errorv(method, err)
 	}
 	return nil
 }
+
+// previewPull writes, for each graft2 and unlink command in the pull
+// worklog, the diff between the local and the remote tree at the path
+// it changes, i.e., what the command would change. The lines are
+// commented out, so the output of a dry run can still be fed to the
+// script command.
+func previewPull(w io.Writer, localTree *tree.Tree, remoteTree *tree.Tree, muscleFSMount string, maxSize int64, commands string) error {
+	const method = "previewPull"
+	remoteRev, _ := remoteTree.Root()
+	var preview bytes.Buffer
+	for _, c := range strings.Split(commands, "\n") {
+		args := strings.Fields(c)
+		var p string
+		switch {
+		case len(args) == 3 && args[0] == "graft2":
+			p = args[2]
+		case len(args) == 2 && args[0] == "unlink":
+			p = args[1]
+		default:
+			continue
+		}
+		err := tree.DiffTrees(
+			localTree,
+			remoteTree,
+			filepath.Join(muscleFSMount, "live"),
+			filepath.Join(muscleFSMount, remoteRev.Hex()),
+			tree.DiffTreesOutput(&preview),
+			tree.DiffTreesInitialPath(p),
+			tree.DiffTreesMaxSize(uint64(maxSize)),
+		)
+		if err != nil {
+			return errorf(method, "%q: %v", c, err)
+		}
+	}
+	_, _ = fmt.Fprintln(w, "# preview of the changes to the local tree:")
+	for _, line := range strings.SplitAfter(preview.String(), "\n") {
+		if line != "" {
+			_, _ = fmt.Fprintf(w, "# %s", line)
+		}
+	}
+	return nil
+}
+
+// expandAlias returns the commands the alias invoked by line expands
+// to, with the arguments given to the alias appended to the last one,
+// or nil if line doesn't invoke an alias.
+func expandAlias(aliases map[string]string, line string) []string {
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return nil
+	}
+	body, ok := aliases[args[0]]
+	if !ok {
+		return nil
+	}
+	var commands []string
+	for _, c := range strings.Split(body, ";") {
+		if c = strings.TrimSpace(c); c != "" {
+			commands = append(commands, c)
+		}
+	}
+	if len(commands) > 0 && len(args) > 1 {
+		last := len(commands) - 1
+		commands[last] = commands[last] + " " + strings.Join(args[1:], " ")
+	}
+	return commands
+}
+
+// runControl runs a command written to the control file. If it invokes
+// an alias, it runs the commands the alias expands to in order, until
+// one fails, and concatenates their outputs. Aliases take precedence
+// over commands with the same name, but aren't expanded recursively,
+// so an alias can wrap the command it shadows. Commands prefixed with
+// "once TOKEN" are run at most once, see runOnce.
+func runControl(ops *ops, controlNode *fsNode, line string) error {
+	if token, command, ok := splitOnce(line); ok {
+		return ops.runOnce(controlNode, token, command)
+	}
+	if first, body := splitScript(line); first == "script" {
+		return runScript(ops, controlNode, body)
+	}
+	commands := expandAlias(ops.cfg.Aliases, line)
+	if commands == nil {
+		return runCommand(ops, controlNode, line)
+	}
+	var output bytes.Buffer
+	defer func() {
+		controlNode.data = output.Bytes()
+		controlNode.dir.Length = uint64(len(controlNode.data))
+	}()
+	for _, c := range commands {
+		_, _ = fmt.Fprintf(&output, "# %s\n", c)
+		err := runCommand(ops, controlNode, c)
+		output.Write(controlNode.data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scriptable lists the commands a script may run: those that only
+// change the local tree, which can be rolled back, or don't change
+// anything.
+var scriptable = map[string]bool{
+	"backlog":     true,
+	"checkpoints": true,
+	"copy-from":   true,
+	"debug":       true,
+	"diff":        true,
+	"dirty":       true,
+	"dump":        true,
+	"filemap":     true,
+	"flush":       true,
+	"fsck-names":  true,
+	"graft":       true,
+	"graft2":      true,
+	"lsof":        true,
+	"remotes":     true,
+	"rename":      true,
+	"retry-load":  true,
+	"stats":       true,
+	"status":      true,
+	"stores":      true,
+	"trim":        true,
+	"unlink":      true,
+}
+
+// splitScript splits what was written to the control file into its
+// first line, trimmed, and the rest.
+func splitScript(text string) (first string, body string) {
+	first = text
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		first, body = text[:i], text[i+1:]
+	}
+	return strings.TrimSpace(first), body
+}
+
+// parseScript returns the commands in the body of a script, one per
+// line, skipping blank lines and comments. A final pull command, as
+// found at the end of the output of pull, is returned separately,
+// because it isn't part of the script proper: it runs only once the
+// script has succeeded, and isn't rolled back.
+func parseScript(body string) (commands []string, pull bool, err error) {
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if pull {
+			return nil, false, fmt.Errorf("pull must be the last command: %w", linuxerr.EINVAL)
+		}
+		name := strings.Fields(line)[0]
+		switch {
+		case name == "pull" && line == name:
+			pull = true
+		case !scriptable[name]:
+			return nil, false, fmt.Errorf("command not allowed in a script: %q: %w", name, linuxerr.EINVAL)
+		default:
+			commands = append(commands, line)
+		}
+	}
+	return commands, pull, nil
+}
+
+// runScript runs the commands in the body of a script, one per line,
+// in order and under the lock held for the write to the control file,
+// so that no other request sees the tree half way through. If one
+// fails, the following ones are not run, and the local tree is rolled
+// back to how it was before the script, which is sealed beforehand for
+// the purpose. Only commands that change nothing but the local tree
+// may be run, see scriptable, so that the rollback is complete, and
+// nothing is run if what they may change is in use, see scriptTargets. The
+// outputs of the commands are concatenated, as for aliases, e.g., for
+// "muscle control script" to apply the output of pull in one go.
+func runScript(ops *ops, controlNode *fsNode, body string) (err error) {
+	var output bytes.Buffer
+	defer func() {
+		if err != nil {
+			_, _ = fmt.Fprintf(&output, "# script failed: %v\n", err)
+		}
+		controlNode.data = output.Bytes()
+		controlNode.dir.Length = uint64(len(controlNode.data))
+	}()
+	commands, pull, err := parseScript(body)
+	if err != nil {
+		return err
+	}
+	// Only what the commands may change is rolled back, which must not
+	// be in use for that.
+	targets, err := scriptTargets(ops.tree, commands)
+	if err != nil {
+		return err
+	}
+	if err := ops.tree.Flush(); err != nil {
+		return err
+	}
+	if err := ops.tree.Seal(); err != nil {
+		return err
+	}
+	saved, err := ops.treeStore.LocalRootKey()
+	if err != nil {
+		return err
+	}
+	for _, c := range commands {
+		_, _ = fmt.Fprintf(&output, "# %s\n", c)
+		err := runCommand(ops, controlNode, c)
+		output.Write(controlNode.data)
+		if err == nil {
+			continue
+		}
+		if rerr := rollBack(ops, saved, targets); rerr != nil {
+			_, _ = fmt.Fprintf(&output, "# rollback to %v failed: %v\n", saved, rerr)
+		} else {
+			_, _ = fmt.Fprintf(&output, "# rolled back to %v\n", saved)
+		}
+		return err
+	}
+	if err := ops.tree.Flush(); err != nil {
+		return err
+	}
+	if pull {
+		_, _ = fmt.Fprintln(&output, "# pull")
+		err := runCommand(ops, controlNode, "pull")
+		output.Write(controlNode.data)
+		return err
+	}
+	return nil
+}
+
+// scriptTargets returns the names of the children of the root of the
+// local tree below which the commands may change anything, see
+// scriptable. It fails with an error wrapping linuxerr.EBUSY if any of
+// them is in use, because it couldn't be rolled back.
+func scriptTargets(t *tree.Tree, commands []string) ([]string, error) {
+	var paths []string
+	for _, c := range commands {
+		args := strings.Fields(c)
+		switch args[0] {
+		case "rename", "unlink":
+			paths = append(paths, args[1:]...)
+		case "graft", "graft2", "copy-from":
+			if _, _, rest := parseGraftFlags(args[1:]); len(rest) > 0 {
+				paths = append(paths, rest[len(rest)-1])
+			}
+		}
+	}
+	_, root := t.Root()
+	var names []string
+	for _, p := range paths {
+		name := strings.Split(strings.TrimPrefix(filepath.Clean(p), "/"), "/")[0]
+		names = append(names, name)
+		nn, err := t.Walk(root, name)
+		if err != nil || len(nn) != 1 {
+			continue
+		}
+		// The name may differ, e.g., in case.
+		names = append(names, nn[0].Info().Name)
+		if nn[0].InUse() {
+			return nil, fmt.Errorf("%q: %w", name, linuxerr.EBUSY)
+		}
+	}
+	return names, nil
+}
+
+// rollBack makes the children of the root of the local tree with the
+// given names match those of the sealed root with the given key.
+func rollBack(ops *ops, key storage.Pointer, names []string) error {
+	saved, err := tree.NewTree(ops.treeStore, tree.WithRoot(key))
+	if err != nil {
+		return err
+	}
+	if err := ops.tree.ReplaceChildren(saved.Attach(), names); err != nil {
+		return err
+	}
+	return ops.tree.Flush()
+}
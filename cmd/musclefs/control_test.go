@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/linuxerr"
+)
+
+func TestExpandAlias(t *testing.T) {
+	aliases := map[string]string{
+		"sync":    "flush; sync -remote",
+		"publish": "flush;push ;",
+	}
+	testCases := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"flush", nil},
+		{"sync", []string{"flush", "sync -remote"}},
+		{"sync 10s\n", []string{"flush", "sync -remote 10s"}},
+		{"publish laptop", []string{"flush", "push laptop"}},
+	}
+	for _, tc := range testCases {
+		if got := expandAlias(aliases, tc.line); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestSplitOnce(t *testing.T) {
+	testCases := []struct {
+		line    string
+		token   string
+		command string
+		ok      bool
+	}{
+		{"push", "", "", false},
+		{"once", "", "", false},
+		{"once t1", "", "", false},
+		{"once  push", "", "", false},
+		{"once t1 push -keep", "t1", "push -keep", true},
+		{" once t1 script\nunlink a\n", "t1", "script\nunlink a\n", true},
+	}
+	for _, tc := range testCases {
+		token, command, ok := splitOnce(tc.line)
+		if token != tc.token || command != tc.command || ok != tc.ok {
+			t.Errorf("%q: got %q, %q, %t, want %q, %q, %t", tc.line, token, command, ok, tc.token, tc.command, tc.ok)
+		}
+	}
+}
+
+// A retry arriving while the command with the same token still runs,
+// having released the ops lock, waits for its outcome rather than
+// running it again.
+func TestRunOnceWaitsForRunInFlight(t *testing.T) {
+	ops := new(ops)
+	run := &onceRun{command: "push", done: make(chan struct{})}
+	ops.once.runs = map[string]*onceRun{"t1": run}
+	ops.once.order = []string{"t1"}
+	retry := new(fsNode)
+	errc := make(chan error)
+	go func() {
+		ops.lock(nil)
+		defer ops.unlock()
+		errc <- ops.runOnce(retry, "t1", "push")
+	}()
+	select {
+	case err := <-errc:
+		t.Fatalf("got %v before the run in flight completed", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	ops.lock(nil)
+	run.output = []byte("pushed\n")
+	run.err = linuxerr.EAGAIN
+	close(run.done)
+	ops.unlock()
+	if err := <-errc; !errors.Is(err, linuxerr.EAGAIN) {
+		t.Errorf("got %v, want %v", err, linuxerr.EAGAIN)
+	}
+	if got, want := string(retry.data), "pushed\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	testCases := []struct {
+		body     string
+		commands []string
+		pull     bool
+		fails    bool
+	}{
+		{"", nil, false, false},
+		{"# comment\n\nflush\n", []string{"flush"}, false, false},
+		{"graft2 a/b b\nunlink c\nflush\npull\n", []string{"graft2 a/b b", "unlink c", "flush"}, true, false},
+		{"pull\nflush\n", nil, false, true},
+		{"flush\npull -x\n", nil, false, true},
+		{"push\n", nil, false, true},
+		{"script\n", nil, false, true},
+	}
+	for _, tc := range testCases {
+		commands, pull, err := parseScript(tc.body)
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%q: no error", tc.body)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.body, err)
+		} else if !reflect.DeepEqual(commands, tc.commands) || pull != tc.pull {
+			t.Errorf("%q: got %q, %v, want %q, %v", tc.body, commands, pull, tc.commands, tc.pull)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/nicolagi/muscle/internal/linuxerr"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// copyFrom copies the file or directory at source, a path relative to
+// the root of the file server such as "tags/base/docs" or "live/docs",
+// to target, a path relative to the root of the live tree. No data is
+// copied: the copy shares the blocks of the source, only its ancestors
+// in the live tree become dirty.
+//
+// The copy is grafted from a tree loaded afresh, so that the nodes
+// served under source are left alone. A source in the live tree is
+// sealed first, as for scripts, so that the copy is of its current
+// contents and shares no staged values with it: the flushes of either
+// would otherwise overwrite the other, reusing the staging keys.
+func (ops *ops) copyFrom(w io.Writer, source string, target string, force bool, preserve bool) error {
+	const method = "ops.copyFrom"
+	var src, srcParent *fsNode
+	src = ops.root
+	for _, name := range strings.Split(source, "/") {
+		if name == "" {
+			continue
+		}
+		child, err := ops.walk1(src, name)
+		if err != nil {
+			return errorf(method, "walk to %q: %w", source, err)
+		}
+		src, srcParent = child, src
+	}
+	if src.kind != muscleNode && src.kind != historicNode {
+		return errorf(method, "%q is not in a tree: %w", source, linuxerr.EINVAL)
+	}
+	if src.tree == ops.tree {
+		if err := ops.tree.Flush(); err != nil {
+			return errorf(method, "flush: %v", err)
+		}
+		if err := ops.tree.Seal(); err != nil {
+			return errorf(method, "seal: %v", err)
+		}
+	}
+	copied, err := tree.NewTree(ops.treeStore, tree.WithRoot(src.Pointer()))
+	if err != nil {
+		return errorf(method, "load %q: %v", source, err)
+	}
+	// The source parent only matters for preserving its modification
+	// time, which a tree root doesn't have.
+	var parentNode *tree.Node
+	if srcParent != nil && srcParent.kind == src.kind && !src.IsRoot() {
+		parentNode = srcParent.Node
+	}
+
+	elems := strings.Split(target, "/")
+	name := elems[len(elems)-1]
+	elems = elems[:len(elems)-1]
+	_, parent := ops.tree.Root()
+	if len(elems) > 0 {
+		walked, err := ops.tree.Walk(parent, elems...)
+		if err != nil {
+			if errors.Is(err, tree.ErrNotExist) {
+				err = linuxerr.ENOENT
+			}
+			return errorf(method, "walk to %q: %w", target, err)
+		}
+		if len(walked) != len(elems) {
+			return errorf(method, "walk to %q: %w", target, linuxerr.ENOENT)
+		}
+		parent = walked[len(walked)-1]
+	}
+	if err := ops.tree.Graft(parent, copied.Attach(), name, ops.graftOptions(force, preserve, parentNode)...); err != nil {
+		return errorf(method, "%v: %w", err, graftErrno(err))
+	}
+	_, _ = fmt.Fprintf(w, "copied %s to %s\n", source, target)
+	return nil
+}
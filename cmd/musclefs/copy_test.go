@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/config"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+func TestCopyFromSurvivesReload(t *testing.T) {
+	live, s, _ := setUpTree(t)
+	_, root := live.Root()
+	dir, err := live.Add(root, "src", 0700|tree.DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := live.Add(dir, "f", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WriteAt([]byte("source"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := live.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// A historic tree loaded under another name, as for tags.
+	if err := live.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := s.LocalRootKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := tree.NewTree(s, tree.WithRoot(sealed), tree.WithRootName("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := &ops{
+		treeStore: s,
+		tree:      live,
+		cfg:       &config.C{},
+		root: &fsNode{kind: syntheticDir, children: []*fsNode{
+			{kind: muscleNode, tree: live, Node: root},
+			{kind: historicNode, tree: old, Node: old.Attach()},
+		}},
+	}
+	if err := ops.copyFrom(ioutil.Discard, "root/src", "live-copy", false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ops.copyFrom(ioutil.Discard, "old/src", "tag-copy", false, false); err != nil {
+		t.Fatal(err)
+	}
+	walked, err := live.Walk(root, "live-copy", "f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := walked[1].WriteAt([]byte("copied"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := live.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := s.LocalRootKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t2, err := tree.NewTree(s, tree.WithRoot(reloaded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		dir  string
+		want string
+	}{
+		{"src", "source"},
+		{"live-copy", "copied"},
+		{"tag-copy", "source"},
+	} {
+		walked, err := t2.Walk(t2.Attach(), tc.dir, "f")
+		if err != nil {
+			t.Errorf("%s: %v", tc.dir, err)
+			continue
+		}
+		p := make([]byte, 6)
+		if _, err := walked[1].ReadAt(p, 0); err != nil {
+			t.Errorf("%s: %v", tc.dir, err)
+		} else if got := string(p); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.dir, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/nicolagi/muscle/internal/netutil"
+)
+
+// The control socket runs the commands of the control file over a
+// unix socket of its own, so that they work even if the 9P server, or
+// the kernel client talking to it, is wedged.
+//
+// A request is a line holding a command, or a line holding "script",
+// possibly prefixed with "once TOKEN", followed by the lines of the
+// script and a line holding only ".". The response is a line holding
+// "ok" or "error", a space, and the number of bytes of output, followed
+// by the output, i.e., what reading the control file would return. A
+// connection can carry many requests.
+
+// serveControlSocket listens on the unix socket at pathname, and runs
+// the commands received until the listener fails.
+func (ops *ops) serveControlSocket(pathname string) error {
+	const method = "ops.serveControlSocket"
+	listener, err := netutil.Listen("unix", pathname)
+	if err != nil {
+		return errorv(method, err)
+	}
+	defer func() { _ = listener.Close() }()
+	// Administrative commands are for the owner only.
+	if err := os.Chmod(pathname, 0600); err != nil {
+		return errorv(method, err)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return errorv(method, err)
+		}
+		go ops.serveControlConn(conn)
+	}
+}
+
+func (ops *ops) serveControlConn(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	r := bufio.NewReader(conn)
+	// Each connection has its own output, so that it doesn't
+	// replace what 9P clients read back from the control file.
+	node := &fsNode{kind: controlFile}
+	for {
+		text, err := readControlRequest(r)
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			log.Printf("Control socket: %v", err)
+			return
+		}
+		node.data = nil
+		ops.lock(nil)
+		err = runControl(ops, node, text)
+		ops.unlock()
+		if err != nil && len(node.data) == 0 {
+			node.data = []byte(err.Error() + "\n")
+		}
+		if err := writeControlResponse(conn, node.data, err); err != nil {
+			log.Printf("Control socket: %v", err)
+			return
+		}
+	}
+}
+
+// readControlRequest reads the next command, or script, including its
+// first line, from the control socket.
+func readControlRequest(r *bufio.Reader) (string, error) {
+	first, err := r.ReadString('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) && first != "" {
+			return "", errorf("readControlRequest", "unterminated request %q", first)
+		}
+		return "", err
+	}
+	command := first
+	if _, c, ok := splitOnce(first); ok {
+		command = c
+	}
+	if strings.TrimSpace(command) != "script" {
+		return strings.TrimSuffix(first, "\n"), nil
+	}
+	var script strings.Builder
+	script.WriteString(first)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", errorf("readControlRequest", "unterminated script: %v", err)
+		}
+		if strings.TrimSpace(line) == "." {
+			return script.String(), nil
+		}
+		script.WriteString(line)
+	}
+}
+
+func writeControlResponse(w io.Writer, output []byte, err error) error {
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	if _, err := fmt.Fprintf(w, "%s %d\n", status, len(output)); err != nil {
+		return err
+	}
+	_, err = w.Write(output)
+	return err
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadControlRequest(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("push\nscript\nrename a b\nunlink c\n.\nonce t1 script\nunlink d\n.\nstatus\npartial"))
+	for _, want := range []string{"push", "script\nrename a b\nunlink c\n", "once t1 script\nunlink d\n", "status"} {
+		if got, err := readControlRequest(r); err != nil || got != want {
+			t.Errorf("got %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := readControlRequest(r); err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("got %v, want an error for the unterminated request", err)
+	}
+	if _, err := readControlRequest(r); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v, want EOF", err)
+	}
+	r = bufio.NewReader(strings.NewReader("script\nrename a b\n"))
+	if _, err := readControlRequest(r); err == nil {
+		t.Error("got no error for an unterminated script")
+	}
+}
+
+func TestWriteControlResponse(t *testing.T) {
+	var b bytes.Buffer
+	if err := writeControlResponse(&b, []byte("pushed\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeControlResponse(&b, []byte("failed\n"), errors.New("failed")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), "ok 7\npushed\nerror 7\nfailed\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -14,8 +14,9 @@ const (
 )
 
 type nodeLock struct {
-	owner   *srv.Fid
+	owner   *srv.Fid // Nil while parked, see parkLocks.
 	node    *tree.Node
+	token   string // Session token of the owner, if any.
 	expires uint32
 }
 
@@ -25,21 +26,34 @@ var nodelocks struct {
 }
 
 // Returns nil if the node is already locked or node locks were exhausted.
-func lockNode(owner *srv.Fid, node *tree.Node) *nodeLock {
+// A lock parked for the given session token, which must not be empty,
+// is handed over to the new owner instead.
+func lockNode(owner *srv.Fid, node *tree.Node, token string) *nodeLock {
 	now := uint32(time.Now().Unix())
 	nodelocks.Lock()
 	defer nodelocks.Unlock()
+	var free *nodeLock
 	for i := range nodelocks.locks {
-		if l := &nodelocks.locks[i]; l.expires <= now { // Is lock expired?
-			l.expires = now + lockDurationSeconds
-			l.owner = owner
-			l.node = node
-			return l
+		l := &nodelocks.locks[i]
+		if l.expires <= now { // Is lock expired?
+			if free == nil {
+				free = l
+			}
 		} else if l.node == node {
-			return nil // Already locked by a non-expired lock.
+			if l.owner != nil || token == "" || l.token != token {
+				return nil // Already locked by a non-expired lock.
+			}
+			free = l
+			break
 		}
 	}
-	return nil
+	if free != nil {
+		free.expires = now + lockDurationSeconds
+		free.owner = owner
+		free.node = node
+		free.token = token
+	}
+	return free
 }
 
 // Marks the lock free.
@@ -49,5 +63,38 @@ func unlockNode(l *nodeLock) {
 	// Prevent loitering:
 	l.owner = nil
 	l.node = nil
+	l.token = ""
 	nodelocks.Unlock()
 }
+
+// parkLocks detaches the locks held by the fids of c, a connection
+// going away, from their fids, and keeps them for the given grace
+// period. During that time, the files stay locked, but a client
+// attaching with the same session token can lock them again, which is
+// how it reclaims them. Locks taken without a session token are left
+// alone, to be released as the fids are destroyed. Returns the number
+// of parked locks. Must be called with the tree lock held, as fid
+// handlers change node.lock under it.
+//
+// Only the locks survive: the fids themselves are lost with the
+// connection, as the 9P library keeps their state private, and the
+// reconnecting client must walk to and open its files anew.
+func parkLocks(c *srv.Conn, grace time.Duration) int {
+	expires := uint32(time.Now().Add(grace).Unix())
+	c.Lock()
+	defer c.Unlock()
+	nodelocks.Lock()
+	defer nodelocks.Unlock()
+	n := 0
+	for _, fid := range c.Fidpool {
+		node, ok := fid.Aux.(*fsNode)
+		if !ok || node.lock == nil || node.lock.token == "" {
+			continue
+		}
+		node.lock.owner = nil
+		node.lock.expires = expires
+		node.lock = nil
+		n++
+	}
+	return n
+}
@@ -10,6 +10,8 @@ import (
 
 	"github.com/lionkov/go9p/p"
 	"github.com/lionkov/go9p/p/clnt"
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/muscle/internal/tree"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -285,3 +287,65 @@ func TestDMEXCL(t *testing.T) {
 func randomName() string {
 	return fmt.Sprintf("testfile.%d", rand.Uint64())
 }
+
+func TestParkLocks(t *testing.T) {
+	node := new(tree.Node)
+	owner := new(srv.Fid)
+	l := lockNode(owner, node, "token")
+	if l == nil {
+		t.Fatal("got no lock")
+	}
+	defer unlockNode(l)
+	if lockNode(new(srv.Fid), node, "token") != nil {
+		t.Error("got a lock held by another fid")
+	}
+
+	owner.Aux = &fsNode{kind: muscleNode, Node: node, lock: l}
+	c := &srv.Conn{Fidpool: map[uint32]*srv.Fid{1: owner}}
+	if n := parkLocks(c, time.Minute); n != 1 {
+		t.Errorf("got %d parked locks, want 1", n)
+	}
+	if owner.Aux.(*fsNode).lock != nil {
+		t.Error("got the parked lock still attached to its fid")
+	}
+	for _, token := range []string{"", "other"} {
+		if lockNode(new(srv.Fid), node, token) != nil {
+			t.Errorf("got the parked lock with token %q", token)
+		}
+	}
+	reclaimer := new(srv.Fid)
+	if got := lockNode(reclaimer, node, "token"); got != l || got.owner != reclaimer {
+		t.Errorf("got %p, want the parked lock %p, owned by the reclaiming fid", got, l)
+	}
+	if lockNode(new(srv.Fid), node, "token") != nil {
+		t.Error("got a reclaimed lock again")
+	}
+
+	// Parked locks not reclaimed within the grace period become free.
+	reclaimer.Aux = &fsNode{kind: muscleNode, Node: node, lock: l}
+	c = &srv.Conn{Fidpool: map[uint32]*srv.Fid{1: reclaimer}}
+	parkLocks(c, -time.Second)
+	if got := lockNode(new(srv.Fid), node, ""); got == nil {
+		t.Error("got no lock after the grace period")
+	} else if got != l {
+		unlockNode(got)
+	}
+}
+
+func TestParkLocksWithoutToken(t *testing.T) {
+	node := new(tree.Node)
+	owner := new(srv.Fid)
+	l := lockNode(owner, node, "")
+	if l == nil {
+		t.Fatal("got no lock")
+	}
+	defer unlockNode(l)
+	owner.Aux = &fsNode{kind: muscleNode, Node: node, lock: l}
+	c := &srv.Conn{Fidpool: map[uint32]*srv.Fid{1: owner}}
+	if n := parkLocks(c, time.Minute); n != 0 {
+		t.Errorf("got %d parked locks, want 0", n)
+	}
+	if owner.Aux.(*fsNode).lock != l {
+		t.Error("got a lock without token detached from its fid")
+	}
+}
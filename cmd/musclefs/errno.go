@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"github.com/nicolagi/muscle/internal/linuxerr"
+	"github.com/nicolagi/muscle/internal/storage"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// Errors from the tree and storage packages, and the operating system,
+// and what to report to clients for them.
+var errnos = []struct {
+	err   error
+	errno linuxerr.E
+}{
+	{tree.ErrNotExist, linuxerr.ENOENT},
+	{tree.ErrExist, linuxerr.EEXIST},
+	{tree.ErrMode, linuxerr.EINVAL},
+	{tree.ErrNotEmpty, linuxerr.ENOTEMPTY},
+	{tree.ErrPermission, linuxerr.EACCES},
+	{tree.ErrReadOnly, linuxerr.EROFS},
+	{tree.ErrInUse, linuxerr.EBUSY},
+	{storage.ErrNotFound, linuxerr.ENOENT},
+	{storage.ErrReadOnly, linuxerr.EROFS},
+	{os.ErrNotExist, linuxerr.ENOENT},
+	{os.ErrExist, linuxerr.EEXIST},
+	{os.ErrPermission, linuxerr.EACCES},
+	{syscall.ENOSPC, linuxerr.ENOSPC},
+	{syscall.EDQUOT, linuxerr.EDQUOT},
+	{syscall.EROFS, linuxerr.EROFS},
+	{syscall.ENAMETOOLONG, linuxerr.ENAMETOOLONG},
+}
+
+// errno maps an error to the linuxerr value that best describes it, so
+// that, e.g., coreutils report a missing file rather than a permission
+// problem. An error wrapping a linuxerr value maps to that value.
+// Errors with no better description map to linuxerr.EIO; the Linux
+// 9P driver would otherwise report an unknown error.
+func errno(err error) linuxerr.E {
+	var e linuxerr.E
+	if errors.As(err, &e) {
+		return e
+	}
+	for _, m := range errnos {
+		if errors.Is(err, m.err) {
+			return m.errno
+		}
+	}
+	return linuxerr.EIO
+}
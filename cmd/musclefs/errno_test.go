@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/muscle/internal/linuxerr"
+	"github.com/nicolagi/muscle/internal/storage"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+func TestErrno(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want linuxerr.E
+	}{
+		{linuxerr.ENOTDIR, linuxerr.ENOTDIR},
+		{fmt.Errorf("walking: %w", linuxerr.ELOOP), linuxerr.ELOOP},
+		{fmt.Errorf("child %q: %w", "a", tree.ErrNotExist), linuxerr.ENOENT},
+		{fmt.Errorf("%q within %q: %w", "a", "/", tree.ErrExist), linuxerr.EEXIST},
+		{fmt.Errorf("sockets are not supported: %w", tree.ErrMode), linuxerr.EINVAL},
+		{tree.ErrReadOnly, linuxerr.EROFS},
+		{fmt.Errorf("seal: %w", tree.ErrInUse), linuxerr.EBUSY},
+		{fmt.Errorf("%q: %w", "key", storage.ErrNotFound), linuxerr.ENOENT},
+		// An explicit mapping wins over the wrapped error.
+		{fmt.Errorf("%v: %w", storage.ErrNotFound, linuxerr.ENODATA), linuxerr.ENODATA},
+		{&os.PathError{Op: "write", Path: "/x", Err: syscall.ENOSPC}, linuxerr.ENOSPC},
+		{&os.PathError{Op: "open", Path: "/x", Err: syscall.ENOENT}, linuxerr.ENOENT},
+		{errors.New("something else"), linuxerr.EIO},
+		{&requestError{op: "read", err: &storage.Error{Op: "get", Key: "k", Backend: "s3", Err: storage.ErrNotFound}}, linuxerr.ENOENT},
+	}
+	for _, tc := range testCases {
+		if got := errno(tc.err); got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestRequestError(t *testing.T) {
+	r := &srv.Req{
+		Tc:  &p.Fcall{Type: p.Tread},
+		Fid: &srv.Fid{Aux: &fsNode{kind: controlFile, dir: p.Dir{Name: "ctl"}}},
+	}
+	err := newRequestError(r, fmt.Errorf("load: %w", &storage.Error{Op: "get", Key: "k", Backend: "s3", Err: errors.New("timeout")}))
+	if got, want := err.Error(), `read path="ctl" store=s3 key=k: load: s3 store: get k: timeout`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	r = &srv.Req{Tc: &p.Fcall{Type: p.Tattach}}
+	if got, want := newRequestError(r, linuxerr.EBUSY).Error(), "attach: "+linuxerr.EBUSY.Error(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
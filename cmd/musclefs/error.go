@@ -1,6 +1,13 @@
 package main
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/muscle/internal/storage"
+)
 
 func errorv(typeMethod string, err error) error {
 	return fmt.Errorf("github.com/nicolagi/muscle/cmd/musclefs."+typeMethod+": %v", err)
@@ -9,3 +16,46 @@ func errorv(typeMethod string, err error) error {
 func errorf(typeMethod, format string, a ...interface{}) error {
 	return fmt.Errorf("github.com/nicolagi/muscle/cmd/musclefs."+typeMethod+": "+format, a...)
 }
+
+// requestError describes an error responded to a 9P request with what
+// is known of where it happened: the request, the path of the node it
+// was made on, if any, and the store and key that failed, if the error
+// came from a store, see storage.Named.
+type requestError struct {
+	op      string
+	path    string
+	backend string
+	key     storage.Key
+	err     error
+}
+
+func newRequestError(r *srv.Req, err error) *requestError {
+	e := &requestError{op: opNames[r.Tc.Type], err: err}
+	if r.Fid != nil {
+		if node, ok := r.Fid.Aux.(*fsNode); ok {
+			e.path = tracePath(node)
+		}
+	}
+	var serr *storage.Error
+	if errors.As(err, &serr) {
+		e.backend, e.key = serr.Backend, serr.Key
+	}
+	return e
+}
+
+func (e *requestError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.op)
+	if e.path != "" {
+		_, _ = fmt.Fprintf(&b, " path=%q", e.path)
+	}
+	if e.backend != "" {
+		_, _ = fmt.Fprintf(&b, " store=%s key=%s", e.backend, e.key)
+	}
+	_, _ = fmt.Fprintf(&b, ": %v", e.err)
+	return b.String()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
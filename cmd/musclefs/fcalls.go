@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// Levels of 9P message logging, see fcallLogger.
+const (
+	fcallsOff int32 = iota
+	fcallsOn
+	fcallsPackets
+)
+
+var fcallLevels = []string{"off", "on", "packets"}
+
+// fcallLogger logs the 9P messages musclefs receives and sends, like
+// go9p does with the -D flag, and also their raw bytes at the packets
+// level. Unlike the go9p debug level, which each connection copies
+// when it starts, the level can be changed at any time, e.g., with the
+// "debug 9p" control command, and applies to all connections. The zero
+// value logs nothing.
+type fcallLogger struct {
+	level int32 // Accessed atomically.
+}
+
+func (l *fcallLogger) set(level string) error {
+	for i, name := range fcallLevels {
+		if name == level {
+			atomic.StoreInt32(&l.level, int32(i))
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown level %q, want one of %v", level, fcallLevels)
+}
+
+func (l *fcallLogger) String() string {
+	return fcallLevels[atomic.LoadInt32(&l.level)]
+}
+
+func (l *fcallLogger) request(r *srv.Req) {
+	switch atomic.LoadInt32(&l.level) {
+	case fcallsPackets:
+		log.Println(">->", r.Conn.Id, fmt.Sprint(r.Tc.Pkt))
+		fallthrough
+	case fcallsOn:
+		log.Println(">>>", r.Conn.Id, r.Tc.String())
+	}
+}
+
+func (l *fcallLogger) response(r *srv.Req) {
+	if r.Rc == nil {
+		return
+	}
+	switch atomic.LoadInt32(&l.level) {
+	case fcallsPackets:
+		log.Println("<-<", r.Conn.Id, fmt.Sprint(r.Rc.Pkt))
+		fallthrough
+	case fcallsOn:
+		log.Println("<<<", r.Conn.Id, r.Rc.String())
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+func TestFcallLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	tc := p.NewFcall(8192)
+	if err := p.PackTclunk(tc, 42); err != nil {
+		t.Fatal(err)
+	}
+	r := &srv.Req{Tc: tc, Conn: &srv.Conn{Id: "conn"}}
+	var l fcallLogger
+	count := func(level string) (fcalls, packets int) {
+		t.Helper()
+		buf.Reset()
+		if err := l.set(level); err != nil {
+			t.Fatal(err)
+		}
+		l.request(r)
+		return strings.Count(buf.String(), ">>> conn"), strings.Count(buf.String(), ">-> conn")
+	}
+	for level, want := range map[string][2]int{"off": {0, 0}, "on": {1, 0}, "packets": {1, 1}} {
+		if fcalls, packets := count(level); fcalls != want[0] || packets != want[1] {
+			t.Errorf("%s: got %d messages and %d packets logged, want %v", level, fcalls, packets, want)
+		}
+		if got := l.String(); got != level {
+			t.Errorf("got level %q, want %q", got, level)
+		}
+	}
+	if err := l.set("verbose"); err == nil {
+		t.Error("got nil error for an unknown level")
+	}
+}
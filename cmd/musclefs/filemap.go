@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/nicolagi/muscle/internal/linuxerr"
+)
+
+// filemap writes a line for each block of the file at pathname,
+// relative to the root of the live tree, with the offset and length of
+// the block within the file, its ref, and where it is: dirty (only in
+// memory), staging, cache, or remote. Blocks are not loaded, so that
+// the map shows what reading the file would involve.
+func (ops *ops) filemap(w io.Writer, pathname string) error {
+	_, node := ops.tree.Root()
+	if elems := strings.Split(strings.Trim(pathname, "/"), "/"); elems[0] != "" {
+		nn, err := ops.tree.Walk(node, elems...)
+		if err != nil {
+			return err
+		}
+		if len(nn) != len(elems) {
+			return fmt.Errorf("%s: %w", pathname, linuxerr.ENOENT)
+		}
+		node = nn[len(nn)-1]
+	}
+	if node.IsDir() {
+		return fmt.Errorf("%s: %w", pathname, linuxerr.EISDIR)
+	}
+	for _, e := range node.BlockMap() {
+		ref, where := "-", e.Location
+		if e.Ref != nil {
+			ref = e.Ref.String()
+		}
+		if where == "repository" {
+			cached, err := ops.pairedStore.Cached(e.Ref.Key())
+			if err != nil {
+				return err
+			}
+			where = "remote"
+			if cached {
+				where = "cache"
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%d %d %s %s\n", e.Offset, e.Length, ref, where); err != nil {
+			return err
+		}
+	}
+	return nil
+}
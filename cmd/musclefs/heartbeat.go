@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// The heartbeat interval if not configured.
+const defaultHeartbeatInterval = 15 * time.Minute
+
+// instance returns the record of this instance for the store of tags,
+// see tree.Store.Heartbeat. The caller must hold the tree lock.
+func (ops *ops) instance() tree.Instance {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "(unknown)"
+	}
+	i := tree.Instance{Host: host, Seen: time.Now(), Pushed: ops.lastPush}
+	if stats := ops.tree.LastFlushStats(); !stats.Started.IsZero() {
+		i.Flushed = stats.Started.Add(stats.Duration)
+	}
+	return i
+}
+
+// heartbeats records this instance in the store of tags at startup and
+// every interval thereafter, so that "muscle status -all" on any host
+// can tell it is alive and when it last pushed.
+func (ops *ops) heartbeats(interval time.Duration) {
+	if interval == 0 {
+		interval = defaultHeartbeatInterval
+	}
+	for {
+		ops.lock(nil)
+		i := ops.instance()
+		ops.unlock()
+		if err := ops.treeStore.Heartbeat(i); err != nil {
+			log.Printf("Could not record heartbeat: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
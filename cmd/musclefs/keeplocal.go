@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/nicolagi/muscle/internal/linuxerr"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// parseKeepLocalRule splits a rule of the form revision/pattern,
+// where the revision can be tree.AnyRevision.
+func parseKeepLocalRule(rule string) (revision, pattern string, err error) {
+	const method = "parseKeepLocalRule"
+	parts := strings.SplitN(rule, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errorf(method, "%q is not of the form REVISION/PATTERN: %w", rule, linuxerr.EINVAL)
+	}
+	if parts[0] != tree.AnyRevision && !revisionExpr.MatchString(parts[0]) {
+		return "", "", errorf(method, "%q is neither a revision nor %q: %w", parts[0], tree.AnyRevision, linuxerr.EINVAL)
+	}
+	return parts[0], parts[1], nil
+}
+
+// loadKeepLocalRules adds the rules persisted at pathname to the tree.
+// A missing file means there are no rules.
+func loadKeepLocalRules(t *tree.Tree, pathname string) error {
+	const method = "loadKeepLocalRules"
+	f, err := os.Open(pathname)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errorv(method, err)
+	}
+	defer func() { _ = f.Close() }()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		revision, pattern, err := parseKeepLocalRule(line)
+		if err != nil {
+			return errorv(method, err)
+		}
+		if err := t.Ignore(revision, pattern); err != nil {
+			return errorv(method, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return errorv(method, err)
+	}
+	return nil
+}
+
+// saveKeepLocalRules atomically replaces the file at pathname with
+// the tree's current rules.
+func saveKeepLocalRules(t *tree.Tree, pathname string) error {
+	const method = "saveKeepLocalRules"
+	var buf bytes.Buffer
+	for _, rule := range t.IgnoreRules() {
+		buf.WriteString(rule)
+		buf.WriteByte('\n')
+	}
+	if err := ioutil.WriteFile(pathname+".new", buf.Bytes(), 0600); err != nil {
+		return errorv(method, err)
+	}
+	if err := os.Rename(pathname+".new", pathname); err != nil {
+		return errorv(method, err)
+	}
+	return nil
+}
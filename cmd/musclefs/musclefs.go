@@ -2,16 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -20,57 +26,23 @@ import (
 	"github.com/lionkov/go9p/p/srv"
 	"github.com/nicolagi/muscle/internal/block"
 	"github.com/nicolagi/muscle/internal/config"
+	"github.com/nicolagi/muscle/internal/debug"
 	"github.com/nicolagi/muscle/internal/linuxerr"
 	"github.com/nicolagi/muscle/internal/netutil"
+	"github.com/nicolagi/muscle/internal/otlp"
 	"github.com/nicolagi/muscle/internal/p9util"
 	"github.com/nicolagi/muscle/internal/storage"
 	"github.com/nicolagi/muscle/internal/tree"
 )
 
-var (
-	unsupportedModes = map[uint32]error{
-		p.DMMOUNT:     fmt.Errorf("mounted channels are not supported"),
-		p.DMAUTH:      fmt.Errorf("authentication files are not supported"),
-		p.DMTMP:       fmt.Errorf("temporary files are not supported"),
-		p.DMSYMLINK:   fmt.Errorf("symbolic links are not supported"),
-		p.DMLINK:      fmt.Errorf("hard links are not supported"),
-		p.DMDEVICE:    fmt.Errorf("device files are not supported"),
-		p.DMNAMEDPIPE: fmt.Errorf("named pipes are not supported"),
-		p.DMSOCKET:    fmt.Errorf("sockets are not supported"),
-		p.DMSETUID:    fmt.Errorf("setuid files are not supported"),
-		p.DMSETGID:    fmt.Errorf("setgid files are not supported"),
-	}
-	knownModes uint32
-
-	revisionExpr = regexp.MustCompile(`^[0-9a-f]{64}$`)
-)
+var revisionExpr = regexp.MustCompile(`^[0-9a-f]{64}$`)
 
-func init() {
-	knownModes = 0777 | p.DMDIR | p.DMAPPEND | p.DMEXCL
-	for mode := range unsupportedModes {
-		knownModes |= mode
-	}
-}
+// How many blocks the read profile records, see block.ReadProfile.
+const readProfileSize = 1 << 16
 
-func checkMode(node *tree.Node, mode uint32) error {
-	if node != nil {
-		if node.IsDir() && mode&p.DMDIR == 0 {
-			return fmt.Errorf("a directory cannot become a regular file")
-		}
-		if !node.IsDir() && mode&p.DMDIR != 0 {
-			return fmt.Errorf("a regular file cannot become a directory")
-		}
-	}
-	for bit, err := range unsupportedModes {
-		if mode&bit != 0 {
-			return err
-		}
-	}
-	if extra := mode &^ knownModes; extra != 0 {
-		return fmt.Errorf("unrecognized mode bits: %b", extra)
-	}
-	return nil
-}
+// How often the health and latency of replicas of the remote store are
+// checked, see storage.Failover.
+const replicaProbeInterval = 30 * time.Second
 
 type nodeKind int
 
@@ -78,22 +50,54 @@ const (
 	controlFile nodeKind = iota
 	historicNode
 	muscleNode
+	notesFile
 	syntheticDir
 )
 
+// A lookupFunc finds a child of a synthetic dir that isn't listed, e.g.,
+// the root of the revision named by a hex key, returning nil if none.
+type lookupFunc func(dir *fsNode, name string) (*fsNode, error)
+
 type fsNode struct {
 	kind       nodeKind
 	tree       *tree.Tree       // For muscle and historic nodes.
 	*tree.Node                  // For muscle nodes.
 	dir        p.Dir            // For the control file and synthetic dirs.
-	data       []byte           // For the control file.
+	data       []byte           // For the control file and notes files.
 	children   []*fsNode        // For the synthetic dirs.
+	lookup     lookupFunc       // For synthetic dirs with children found by name.
 	dirb       p9util.DirBuffer // For muscle nodes and synthetic dirs.
+	dirbver    uint32           // Directory version when dirb was built.
 	lock       *nodeLock        // Only meaningful for DMEXCL muscle file nodes.
+	notes      *fsNode          // For the roots of historic trees, if annotating.
+	revision   storage.Pointer  // For notes files, the revision annotated.
+}
+
+// version returns the qid version of the node.
+func (node *fsNode) version() uint32 {
+	switch node.kind {
+	case controlFile, notesFile, syntheticDir:
+		return node.dir.Qid.Version
+	default:
+		return node.Info().Version
+	}
+}
+
+// readDir serves a directory read from the buffer of directory
+// entries. The buffer is a snapshot, so that a client reading the
+// directory in many requests sees a consistent listing. A read at
+// offset zero starts a new listing, which is when the snapshot is
+// rebuilt if the directory changed since it was taken.
+func (node *fsNode) readDir(b []byte, offset int) (int, error) {
+	if offset == 0 && node.version() != node.dirbver {
+		node.prepareForReads()
+	}
+	return node.dirb.Read(b, offset)
 }
 
 func (node *fsNode) prepareForReads() {
 	node.dirb.Reset()
+	node.dirbver = node.version()
 	switch node.kind {
 	case muscleNode, historicNode:
 		var dir p.Dir
@@ -101,6 +105,9 @@ func (node *fsNode) prepareForReads() {
 			p9util.NodeDirVar(child, &dir)
 			node.dirb.Write(&dir)
 		}
+		if node.notes != nil {
+			node.dirb.Write(&node.notes.dir)
+		}
 	case syntheticDir:
 		for _, child := range node.children {
 			switch child.kind {
@@ -128,44 +135,224 @@ type ops struct {
 	root *fsNode
 
 	cfg *config.C
+
+	// Last requests served, for the trace control command.
+	trace traceRing
+
+	// Logs 9P messages, see the -D flag and the debug 9p command.
+	fcalls fcallLogger
+
+	// Threshold for logging slow operations; zero disables logging.
+	slow time.Duration
+
+	// Nil unless tracing is enabled. The current span is that of the
+	// request holding the tree lock, used as parent by storage calls.
+	tracer  *otlp.Tracer
+	current *otlp.Current
+	spansMu sync.Mutex
+	spans   map[*srv.Req]*otlp.Span
+
+	// Nil unless rate limiting is enabled.
+	limits *rateLimits
+
+	sessions *sessions
+
+	// Where to send a signal to flush and exit, once drained.
+	quit chan<- os.Signal
+
+	// The tag to pull from and push to, see the checkout command.
+	branch string
+
+	// How often to consider flushing, in nanoseconds, for atomic
+	// access by the periodic flush goroutine.
+	snapshotFrequency int64
+
+	// The staging area, for accounting, and whether a seal to bring
+	// it under the soft limit is in progress (accessed atomically).
+	staging *storage.DiskStore
+	sealing int32
+
+	// Revisions browsed through historic roots, so that clean keeps
+	// their blocks. Nil in tests.
+	pins *tree.Pins
+
+	// Historic trees replaced in the synthetic dirs showing them,
+	// whose revisions stay pinned until their last fid is clunked.
+	retired map[*tree.Tree]struct{}
+
+	// Notes on revisions, shown in the roots of historic trees. Nil
+	// in tests.
+	annotations *annotations
+
+	// Counts of calls to the stores, for the stats command and
+	// "muscle stats". Nil in tests.
+	metrics *storage.Metrics
+
+	// The order in which blocks are first read, saved on push as a
+	// hint for prefetching. Nil in tests.
+	profile *block.ReadProfile
+
+	// Nil unless replicas of the remote store are configured.
+	failover *storage.Failover
+
+	// When this instance last pushed, for heartbeats.
+	lastPush time.Time
+
+	// Set while directories are prefetched, see prefetchDirs
+	// (accessed atomically).
+	prefetching int32
+
+	// The outcomes of the latest commands run once, see runOnce.
+	once onceRuns
+}
+
+// saveReadOrder saves the order in which blocks were first read, if
+// profiling, logging failures: the hint is optional.
+func (ops *ops) saveReadOrder() {
+	if ops.profile == nil {
+		return
+	}
+	if err := ops.profile.Save(ops.cfg.ReadOrderFilePath()); err != nil {
+		log.Printf("Could not save the read order: %v", err)
+	}
+}
+
+// lock acquires the lock serializing access to the tree, logging if
+// that took longer than the slow operation threshold. The request, if
+// not nil, becomes the parent of the spans for storage calls made while
+// holding the lock.
+func (ops *ops) lock(r *srv.Req) {
+	if ops.slow <= 0 {
+		ops.mu.Lock()
+	} else {
+		start := time.Now()
+		ops.mu.Lock()
+		if d := time.Since(start); d >= ops.slow {
+			debug.Logf(debug.Info, "Slow lock: waited %v for the tree lock", d)
+		}
+	}
+	if ops.tracer != nil && r != nil {
+		ops.spansMu.Lock()
+		ops.current.Set(ops.spans[r])
+		ops.spansMu.Unlock()
+	}
+}
+
+func (ops *ops) unlock() {
+	ops.current.Set(nil)
+	ops.mu.Unlock()
 }
 
 var (
-	_ srv.ReqOps = (*ops)(nil)
-	_ srv.FidOps = (*ops)(nil)
+	_ srv.ReqOps  = (*ops)(nil)
+	_ srv.FidOps  = (*ops)(nil)
+	_ srv.ConnOps = (*ops)(nil)
 )
 
+// logRespondError logs the error along with the request, path, and
+// store it concerns, see requestError, and responds with the linuxerr
+// value describing it, see errno.
 func logRespondError(r *srv.Req, err error) {
-	log.Printf("Rerror: %s", err)
-	var e linuxerr.E
-	if errors.As(err, &e) {
-		r.RespondError(e)
-	} else {
-		r.RespondError(err)
+	debug.Logf(debug.Info, "Rerror: %v", newRequestError(r, err))
+	r.RespondError(errno(err))
+}
+
+// ConnOpened implements srv.ConnOps.
+func (ops *ops) ConnOpened(c *srv.Conn) {
+	ops.limits.open(c)
+	ops.sessions.open(c)
+}
+
+// ConnClosed implements srv.ConnOps.
+// Locks held by sessions with a token are parked rather than released, see parkLocks.
+// The fids left are destroyed here, under the tree lock, because go9p
+// destroys them after this returns without it, see FidDestroy.
+func (ops *ops) ConnClosed(c *srv.Conn) {
+	ops.limits.close(c)
+	ops.lock(nil)
+	defer ops.unlock()
+	if ops.cfg.SessionGrace > 0 && ops.sessions.token(c) != "" {
+		if n := parkLocks(c, ops.cfg.SessionGrace); n > 0 {
+			debug.Logf(debug.Info, "Parked %d locks of session %s for %v", n, c.Id, ops.cfg.SessionGrace)
+		}
 	}
+	c.Lock()
+	for _, fid := range c.Fidpool {
+		ops.destroyFid(fid)
+	}
+	c.Unlock()
+	ops.sessions.close(c)
 }
 
 // ReqProcess implements srv.ReqProcessOps.
-// It delegates to the default processing right away, but could be used to add instrumentation for debugging when needed.
+// It delays the request if its connection is over the rate limits,
+// records when the request started, if tracing is enabled, then delegates to the default processing.
 func (ops *ops) ReqProcess(r *srv.Req) {
+	ops.limits.wait(r)
+	ops.sessions.begin(r)
+	ops.trace.begin(r)
+	ops.fcalls.request(r)
+	if ops.tracer != nil {
+		span := ops.tracer.Start("9p."+opNames[r.Tc.Type], nil)
+		span.SetAttribute("fid", r.Tc.Fid)
+		ops.spansMu.Lock()
+		ops.spans[r] = span
+		ops.spansMu.Unlock()
+	}
 	r.Process()
 }
 
 // ReqRespond implements srv.ReqProcessOps.
-// It delegates to the default processing right away, but could be used to add instrumentation for debugging when needed.
+// It records the request in the trace, if tracing is enabled, then delegates to the default processing.
 func (ops *ops) ReqRespond(r *srv.Req) {
+	ops.sessions.end(r)
+	ops.trace.end(r)
+	ops.fcalls.response(r)
+	if ops.tracer != nil {
+		ops.spansMu.Lock()
+		span := ops.spans[r]
+		delete(ops.spans, r)
+		ops.spansMu.Unlock()
+		if r.Fid != nil {
+			// Responses are sent while holding the tree lock, so it's
+			// safe to compute the path.
+			node, _ := r.Fid.Aux.(*fsNode)
+			span.SetAttribute("path", tracePath(node))
+		}
+		if r.Rc != nil && r.Rc.Type == p.Rerror {
+			span.SetError(errors.New(r.Rc.Error))
+		}
+		span.End()
+	}
 	r.PostProcess()
 }
 
+// FidDestroy implements srv.FidOps.
+// Fids of closed connections were destroyed by ConnClosed already.
+// Those of open connections are destroyed as they are clunked or
+// removed, while the tree lock is held.
 func (ops *ops) FidDestroy(fid *srv.Fid) {
+	if ops.sessions.isOpen(fid.Fconn) {
+		ops.destroyFid(fid)
+	}
+}
+
+// destroyFid releases what the fid holds. It must be called with the
+// tree lock held.
+func (ops *ops) destroyFid(fid *srv.Fid) {
 	if fid.Aux == nil {
 		return
 	}
 	node := fid.Aux.(*fsNode)
 	switch node.kind {
-	case controlFile:
+	case controlFile, notesFile:
 	case syntheticDir:
 	default:
+		// Also reached for fids the client didn't clunk, when the
+		// connection closes, see ConnClosed.
+		if node.Node != nil && (fid.Omode&3 == p.OWRITE || fid.Omode&3 == p.ORDWR) {
+			node.EndWrites()
+		}
 		refs := node.Unref()
 		if node.lock != nil {
 			unlockNode(node.lock)
@@ -174,20 +361,31 @@ func (ops *ops) FidDestroy(fid *srv.Fid) {
 		if refs == 0 && node.Unlinked() {
 			node.tree.Discard(node.Node)
 		}
+		if node.kind == historicNode {
+			ops.unpinRetired(node.tree)
+		}
 	}
 }
 
 func (ops *ops) Attach(r *srv.Req) {
-	ops.mu.Lock()
-	defer ops.mu.Unlock()
+	ops.lock(r)
+	defer ops.unlock()
+	if ops.sessions.isDraining() {
+		logRespondError(r, fmt.Errorf("draining: %w", linuxerr.EBUSY))
+		return
+	}
+	if token := strings.TrimPrefix(r.Tc.Aname, "session="); token != r.Tc.Aname && token != "" {
+		ops.sessions.setToken(r.Conn, token)
+	}
 	r.Fid.Aux = ops.root
 	r.RespondRattach(&ops.root.dir.Qid)
+	go ops.prefetchDirs(ops.cfg.PrefetchDepth)
 }
 
 func (ops *ops) clone(r *srv.Req) {
 	node := r.Fid.Aux.(*fsNode)
 	switch node.kind {
-	case controlFile:
+	case controlFile, notesFile:
 		r.Newfid.Aux = node
 		r.RespondRwalk(nil)
 	case syntheticDir:
@@ -204,103 +402,236 @@ func (ops *ops) clone(r *srv.Req) {
 	}
 }
 
+// walk1 walks one element from node. The name "." walks to the node
+// itself, and ".." walks to its parent, the parent of the root of a
+// tree being the root of the file server, whose parent is itself.
 func (ops *ops) walk1(node *fsNode, name string) (*fsNode, error) {
 	switch node.kind {
-	case controlFile:
-		return nil, linuxerr.EACCES
+	case controlFile, notesFile:
+		return nil, linuxerr.ENOTDIR
 	case syntheticDir:
-		if name == ".." && node == ops.root {
+		// Synthetic dirs other than the root are children of the root.
+		switch name {
+		case ".":
 			return node, nil
+		case "..":
+			return ops.root, nil
 		}
-		for _, child := range node.children {
-			switch child.kind {
-			case controlFile, syntheticDir:
-				if child.dir.Name == name {
-					return child, nil
-				}
-			default:
-				var dir p.Dir
-				p9util.NodeDirVar(child.Node, &dir)
-				if dir.Name == name {
-					return child, nil
-				}
+		if node.lookup == nil {
+			if child := node.child(name); child != nil {
+				return child, nil
 			}
-		}
-		// The name can't be looked up.
-		// Try to interpret it as a hash pointer pointing to a revision.
-		if !revisionExpr.MatchString(name) {
 			return nil, linuxerr.ENOENT
 		}
-		revpointer, err := storage.NewPointerFromHex(name)
-		if err != nil {
-			return nil, nil
-		}
-		revtree, err := tree.NewTree(ops.treeStore, tree.WithRevision(revpointer), tree.WithRootName(name))
+		child, err := node.lookup(node, name)
 		if err != nil {
-			if errors.Is(err, tree.ErrNotExist) || errors.Is(err, linuxerr.ENOENT) {
-				return nil, linuxerr.ENOENT
-			}
 			return nil, err
 		}
-		_, revroot := revtree.Root()
-		revnode := &fsNode{
-			kind: historicNode,
-			tree: revtree,
-			Node: revroot,
+		if child == nil {
+			return nil, linuxerr.ENOENT
 		}
-		node.children = append(node.children, revnode)
-		node.prepareForReads()
-		return revnode, nil
+		return child, nil
 	default:
 		if node.Unlinked() {
 			return nil, linuxerr.ENOENT
 		}
+		if !node.IsDir() {
+			return nil, linuxerr.ENOTDIR
+		}
+		switch name {
+		case ".":
+			return node, nil
+		case "..":
+			if node.IsRoot() {
+				return ops.root, nil
+			}
+		case notesFileName:
+			if node.notes != nil {
+				return node.notes, nil
+			}
+		}
 		walked, err := node.tree.Walk(node.Node, name)
 		if err != nil {
+			if errors.Is(err, tree.ErrNotExist) {
+				return nil, linuxerr.ENOENT
+			}
 			return nil, err
 		}
-		if len(walked) != 1 {
-			return nil, linuxerr.EPERM // Incorrect, but will do for now.
+		return ops.annotate(&fsNode{kind: node.kind, tree: node.tree, Node: walked[0]}), nil
+	}
+}
+
+// child returns the child of a synthetic dir with the given name, if any.
+func (node *fsNode) child(name string) *fsNode {
+	for _, child := range node.children {
+		switch child.kind {
+		case controlFile, syntheticDir:
+			if child.dir.Name == name {
+				return child
+			}
+		default:
+			var dir p.Dir
+			p9util.NodeDirVar(child.Node, &dir)
+			if dir.Name == name {
+				return child
+			}
+		}
+	}
+	return nil
+}
+
+// setChild adds the child to a synthetic dir, replacing the one with
+// the same name, if any, which it returns.
+func (node *fsNode) setChild(name string, child *fsNode) (replaced *fsNode) {
+	for i, c := range node.children {
+		if c.kind == historicNode && c.Info().Name == name {
+			node.children[i] = child
+			node.dir.Qid.Version++
+			return c
+		}
+	}
+	node.children = append(node.children, child)
+	// Don't rebuild the directory buffer here, a listing may be in progress.
+	node.dir.Qid.Version++
+	return nil
+}
+
+// historicRoot returns a node for the root of the given revision,
+// naming it as given.
+func (ops *ops) historicRoot(key storage.Pointer, name string) (*fsNode, error) {
+	revtree, err := tree.NewTree(ops.treeStore, tree.WithRevision(key), tree.WithRootName(name))
+	if err != nil {
+		if errors.Is(err, tree.ErrNotExist) || errors.Is(err, linuxerr.ENOENT) {
+			return nil, linuxerr.ENOENT
+		}
+		return nil, err
+	}
+	if ops.pins != nil {
+		// Browsing can go on without the pin, at the risk of
+		// running into blocks deleted by clean.
+		if err := ops.pins.Pin(key); err != nil {
+			log.Printf("Could not pin revision %v: %v", key, err)
 		}
-		return &fsNode{kind: node.kind, tree: node.tree, Node: walked[0]}, nil
 	}
+	_, revroot := revtree.Root()
+	return ops.annotate(&fsNode{kind: historicNode, tree: revtree, Node: revroot}), nil
+}
+
+// retire unpins the revision of a historic root replaced in the
+// synthetic dir showing it, once no fid refers to any of its nodes,
+// see unpinRetired.
+func (ops *ops) retire(node *fsNode) {
+	if node == nil || ops.pins == nil {
+		return
+	}
+	if ops.retired == nil {
+		ops.retired = make(map[*tree.Tree]struct{})
+	}
+	ops.retired[node.tree] = struct{}{}
+	ops.unpinRetired(node.tree)
+}
+
+// unpinRetired unpins the revision of the retired historic tree, if
+// no fid refers to any of its nodes.
+func (ops *ops) unpinRetired(t *tree.Tree) {
+	if _, ok := ops.retired[t]; !ok {
+		return
+	}
+	// Refs of nodes count towards their ancestors.
+	if _, root := t.Root(); root.InUse() {
+		return
+	}
+	delete(ops.retired, t)
+	if err := ops.pins.Unpin(t.Revision()); err != nil {
+		log.Printf("Could not unpin revision %v: %v", t.Revision(), err)
+	}
+}
+
+// annotate gives the node its notes file, if it's the root of a
+// historic tree. Failing to read the notes only hides them.
+func (ops *ops) annotate(node *fsNode) *fsNode {
+	if ops.annotations == nil || node.kind != historicNode || !node.IsRoot() {
+		return node
+	}
+	notes, err := ops.annotations.node(node.tree.Revision())
+	if err != nil {
+		log.Printf("Could not read the notes on revision %v: %v", node.tree.Revision(), err)
+		return node
+	}
+	node.notes = notes
+	return node
+}
+
+// lookupRevision interprets names in the root directory as hex keys
+// of revisions, whose roots it adds to the root directory.
+func (ops *ops) lookupRevision(dir *fsNode, name string) (*fsNode, error) {
+	if child := dir.child(name); child != nil {
+		return child, nil
+	}
+	if !revisionExpr.MatchString(name) {
+		return nil, nil
+	}
+	key, err := storage.NewPointerFromHex(name)
+	if err != nil {
+		return nil, nil
+	}
+	child, err := ops.historicRoot(key, name)
+	if err != nil {
+		return nil, err
+	}
+	dir.setChild(name, child)
+	return child, nil
 }
 
+// lookupTag interprets names in the tags directory as names of remote
+// tags, resolving them to the root of the revision they point to. Tags
+// are resolved on every walk, since other hosts may push to them.
+func (ops *ops) lookupTag(dir *fsNode, name string) (*fsNode, error) {
+	tag, err := ops.treeStore.RemoteTag(name)
+	if err != nil {
+		return nil, err
+	}
+	if tag.Pointer.IsNull() {
+		return nil, nil
+	}
+	if child := dir.child(name); child != nil && child.tree.Revision().Equals(tag.Pointer) {
+		return child, nil
+	}
+	child, err := ops.historicRoot(tag.Pointer, name)
+	if err != nil {
+		return nil, err
+	}
+	ops.retire(dir.setChild(name, child))
+	return child, nil
+}
+
+// walk implements Twalk as described in walk(5): if the first element
+// can't be walked, for any reason, the error is returned; otherwise,
+// the qids of the elements successfully walked are returned, and
+// newfid is affected only if all elements were walked.
 func (ops *ops) walk(r *srv.Req) {
 	node := r.Fid.Aux.(*fsNode)
-	var child *fsNode
-	var err error
 	var qids []p.Qid
 	for _, name := range r.Tc.Wname {
-		child, err = ops.walk1(node, name)
+		child, err := ops.walk1(node, name)
 		if err != nil {
+			if len(qids) == 0 {
+				logRespondError(r, err)
+				return
+			}
 			break
 		}
 		node = child
 		switch node.kind {
-		case controlFile:
-			qids = append(qids, node.dir.Qid)
-		case syntheticDir:
+		case controlFile, notesFile, syntheticDir:
 			qids = append(qids, node.dir.Qid)
 		default:
 			qids = append(qids, p9util.NodeQID(node.Node))
 		}
 	}
-	if errors.Is(err, tree.ErrNotExist) || errors.Is(err, linuxerr.ENOENT) {
-		if len(qids) == 0 {
-			logRespondError(r, linuxerr.ENOENT)
-			return
-		}
-		// Clear the error if it was of type "not found" and we could walk at least a node.
-		err = nil
-	}
-	if err != nil {
-		logRespondError(r, err)
-		return
-	}
 	if len(qids) == len(r.Tc.Wname) {
 		r.Newfid.Aux = node
-		if node.kind == muscleNode {
+		if node.kind != controlFile && node.kind != notesFile && node.kind != syntheticDir {
 			node.Ref()
 		}
 	}
@@ -308,8 +639,8 @@ func (ops *ops) walk(r *srv.Req) {
 }
 
 func (ops *ops) Walk(r *srv.Req) {
-	ops.mu.Lock()
-	defer ops.mu.Unlock()
+	ops.lock(r)
+	defer ops.unlock()
 	if len(r.Tc.Wname) == 0 {
 		ops.clone(r)
 	} else {
@@ -318,21 +649,30 @@ func (ops *ops) Walk(r *srv.Req) {
 }
 
 func (ops *ops) Open(r *srv.Req) {
-	ops.mu.Lock()
-	defer ops.mu.Unlock()
+	ops.lock(r)
+	defer ops.unlock()
 	if r.Tc.Mode&p.ORCLOSE != 0 {
 		logRespondError(r, linuxerr.EACCES)
+		return
 	}
 	node := r.Fid.Aux.(*fsNode)
 	switch node.kind {
 	case controlFile:
 		r.RespondRopen(&node.dir.Qid, 0)
+	case notesFile:
+		if r.Tc.Mode&p.OTRUNC != 0 {
+			if err := ops.annotations.truncate(node, 0); err != nil {
+				logRespondError(r, err)
+				return
+			}
+		}
+		r.RespondRopen(&node.dir.Qid, 0)
 	case syntheticDir:
 		node.prepareForReads()
 		r.RespondRopen(&node.dir.Qid, 0)
 	default:
 		if node.kind == historicNode && r.Tc.Mode&(p.OWRITE|p.ORDWR|p.OTRUNC|p.ORCLOSE) != 0 {
-			logRespondError(r, linuxerr.EACCES)
+			logRespondError(r, linuxerr.EROFS)
 			return
 		}
 		if node.Unlinked() {
@@ -341,9 +681,9 @@ func (ops *ops) Open(r *srv.Req) {
 		}
 		qid := p9util.NodeQID(node.Node)
 		if qid.Type&p.QTEXCL != 0 {
-			node.lock = lockNode(r.Fid, node.Node)
+			node.lock = lockNode(r.Fid, node.Node, ops.sessions.token(r.Conn))
 			if node.lock == nil {
-				logRespondError(r, fmt.Errorf("file already locked"))
+				logRespondError(r, fmt.Errorf("file already locked: %w", linuxerr.EBUSY))
 				return
 			}
 			qid.Type |= p.QTEXCL
@@ -368,21 +708,21 @@ func (ops *ops) Open(r *srv.Req) {
 }
 
 func (ops *ops) Create(r *srv.Req) {
-	ops.mu.Lock()
-	defer ops.mu.Unlock()
+	ops.lock(r)
+	defer ops.unlock()
 	parent := r.Fid.Aux.(*fsNode)
 	switch parent.kind {
-	case controlFile, historicNode, syntheticDir:
+	case controlFile, notesFile:
+		logRespondError(r, linuxerr.ENOTDIR)
+	case historicNode:
+		logRespondError(r, linuxerr.EROFS)
+	case syntheticDir:
 		logRespondError(r, linuxerr.EACCES)
 	default:
 		if parent.Unlinked() {
 			logRespondError(r, linuxerr.ENOENT)
 			return
 		}
-		if err := checkMode(nil, r.Tc.Perm); err != nil {
-			logRespondError(r, err)
-			return
-		}
 		node, err := parent.tree.Add(parent.Node, r.Tc.Name, r.Tc.Perm)
 		if err != nil {
 			logRespondError(r, err)
@@ -394,9 +734,9 @@ func (ops *ops) Create(r *srv.Req) {
 		r.Fid.Aux = child
 		qid := p9util.NodeQID(node)
 		if r.Tc.Perm&p.DMEXCL != 0 {
-			child.lock = lockNode(r.Fid, child.Node)
+			child.lock = lockNode(r.Fid, child.Node, ops.sessions.token(r.Conn))
 			if child.lock == nil {
-				logRespondError(r, fmt.Errorf("out of locks"))
+				logRespondError(r, fmt.Errorf("out of locks: %w", linuxerr.ENOLCK))
 				return
 			}
 			qid.Type |= p.QTEXCL
@@ -406,15 +746,15 @@ func (ops *ops) Create(r *srv.Req) {
 }
 
 func (ops *ops) Read(r *srv.Req) {
-	ops.mu.Lock()
-	defer ops.mu.Unlock()
+	ops.lock(r)
+	defer ops.unlock()
 	if err := p.InitRread(r.Rc, r.Tc.Count); err != nil {
 		logRespondError(r, err)
 		return
 	}
 	node := r.Fid.Aux.(*fsNode)
 	switch node.kind {
-	case controlFile:
+	case controlFile, notesFile:
 		node.dir.Atime = uint32(time.Now().Unix())
 		if o := int(r.Tc.Offset); o > len(node.data) {
 			p.SetRreadCount(r.Rc, 0)
@@ -424,7 +764,7 @@ func (ops *ops) Read(r *srv.Req) {
 		}
 	case syntheticDir:
 		node.dir.Atime = uint32(time.Now().Unix())
-		count, err := node.dirb.Read(r.Rc.Data[:r.Tc.Count], int(r.Tc.Offset))
+		count, err := node.readDir(r.Rc.Data[:r.Tc.Count], int(r.Tc.Offset))
 		if err != nil {
 			logRespondError(r, err)
 			return
@@ -434,7 +774,7 @@ func (ops *ops) Read(r *srv.Req) {
 		var count int
 		var err error
 		if node.IsDir() {
-			count, err = node.dirb.Read(r.Rc.Data[:r.Tc.Count], int(r.Tc.Offset))
+			count, err = node.readDir(r.Rc.Data[:r.Tc.Count], int(r.Tc.Offset))
 		} else {
 			count, err = node.ReadAt(r.Rc.Data[:r.Tc.Count], int64(r.Tc.Offset))
 		}
@@ -445,12 +785,48 @@ func (ops *ops) Read(r *srv.Req) {
 			logRespondError(r, err)
 			return
 		}
+		node.tree.Access(node.Node)
 		p.SetRreadCount(r.Rc, uint32(count))
 	}
 	r.Respond()
 }
 
-func runCommand(ops *ops, controlNode *fsNode, cmd string) error {
+// parseGraftFlags strips the leading --force and --preserve-mtime
+// flags from the arguments of the graft commands.
+func parseGraftFlags(args []string) (force bool, preserve bool, rest []string) {
+	for len(args) > 0 {
+		switch args[0] {
+		case "--force":
+			force = true
+		case "--preserve-mtime":
+			preserve = true
+		default:
+			return force, preserve, args
+		}
+		args = args[1:]
+	}
+	return force, preserve, args
+}
+
+// graftOptions returns the options for grafting a node whose parent,
+// in its source revision, is srcParent (nil for a root node).
+func (ops *ops) graftOptions(force bool, preserve bool, srcParent *tree.Node) []tree.GraftOption {
+	opts := []tree.GraftOption{tree.GraftForce(force)}
+	if (preserve || ops.cfg.PreserveMtime) && srcParent != nil {
+		opts = append(opts, tree.GraftParentModified(srcParent.Info().Modified))
+	}
+	return opts
+}
+
+// graftErrno maps a graft failure to the error reported to the client.
+func graftErrno(err error) error {
+	if errors.Is(err, linuxerr.EBUSY) {
+		return linuxerr.EBUSY
+	}
+	return linuxerr.EACCES
+}
+
+func runCommand(ops *ops, controlNode *fsNode, cmd string) (err error) {
 	const method = "runCommand"
 	args := strings.Fields(cmd)
 	if len(args) == 0 {
@@ -459,6 +835,16 @@ func runCommand(ops *ops, controlNode *fsNode, cmd string) error {
 	cmd = args[0]
 	args = args[1:]
 
+	parent := ops.current.Get()
+	span := ops.tracer.Start("ctl."+cmd, parent)
+	span.SetAttribute("args", strings.Join(args, " "))
+	ops.current.Set(span)
+	defer func() {
+		span.SetError(err)
+		span.End()
+		ops.current.Set(parent)
+	}()
+
 	outputBuffer := bytes.NewBuffer(nil)
 
 	// A helper function to return an error, and also add it to the output.
@@ -478,7 +864,29 @@ func runCommand(ops *ops, controlNode *fsNode, cmd string) error {
 		if err := ops.tree.Flush(); err != nil {
 			return fmt.Errorf("could not flush: %v", err)
 		}
-		return doDiff(outputBuffer, ops.tree, ops.treeStore, ops.cfg.MuscleFSMount, args)
+		return doDiff(outputBuffer, ops.tree, ops.treeStore, ops.cfg.MuscleFSMount, ops.cfg.DiffMaxSize, ops.branch, args)
+	case "status":
+		_, _ = fmt.Fprintf(outputBuffer, "branch %s\nstaged %d\nstaging-soft-limit %d\nstaging-hard-limit %d\n",
+			ops.branch, ops.staging.Usage(), ops.cfg.StagingSoftLimit, ops.cfg.StagingHardLimit)
+	case "stats":
+		if ops.metrics != nil {
+			_, _ = ops.metrics.WriteTo(outputBuffer)
+		}
+	case "stores":
+		if ops.failover == nil {
+			_, _ = fmt.Fprintln(outputBuffer, "no replicas configured")
+			break
+		}
+		for _, s := range ops.failover.Status() {
+			_, _ = fmt.Fprintln(outputBuffer, s)
+		}
+	case "backlog":
+		b := ops.pairedStore.Backlog()
+		_, _ = fmt.Fprintf(outputBuffer, "pending %d\nmissing %d\noldest-pending %v\n", b.Pending, b.Missing, b.Age().Truncate(time.Second))
+	case "remotes":
+		if err := ops.treeStore.WriteRemoteTags(context.Background(), outputBuffer, time.Now()); err != nil {
+			return output(err)
+		}
 	case "lsof":
 		paths := ops.tree.ListNodesInUse()
 		sort.Strings(paths)
@@ -488,54 +896,245 @@ func runCommand(ops *ops, controlNode *fsNode, cmd string) error {
 		}
 	case "dump":
 		ops.tree.DumpNodes(outputBuffer)
-	case "keep-local-for":
-		parts := strings.SplitN(args[0], "/", 2)
-		ops.tree.Ignore(parts[0], parts[1])
-		return nil
-	case "rename":
-		if len(args) != 2 {
-			_, _ = fmt.Fprintln(outputBuffer, "Usage: rename SOURCE TARGET")
+	case "filemap":
+		if len(args) != 1 {
+			_, _ = fmt.Fprint(outputBuffer, "Usage: filemap PATH\nPATH is a file path relative to the musclefs root.\n")
 			return linuxerr.EINVAL
 		}
-		err := ops.tree.Rename(args[0], args[1])
-		if err != nil {
-			_, _ = fmt.Fprintf(outputBuffer, "rename: %v\n", err)
-			return err
+		if err := ops.filemap(outputBuffer, args[0]); err != nil {
+			return output(err)
 		}
-	case "unlink":
-		usage := func() {
-			_, _ = fmt.Fprint(outputBuffer, "Usage: unlink NAME\nNAME is a non-empty path relative to the musclefs root.\n")
+	case "debug":
+		if len(args) == 1 && args[0] == "9p" {
+			_, _ = fmt.Fprintf(outputBuffer, "9p %v\n", &ops.fcalls)
+			break
 		}
-		if len(args) != 1 {
-			usage()
+		if len(args) == 2 && args[0] == "9p" {
+			if err := ops.fcalls.set(args[1]); err != nil {
+				return output(fmt.Errorf("%v: %w", err, linuxerr.EINVAL))
+			}
+			break
+		}
+		if len(args) == 1 && args[0] == "log" {
+			_, _ = fmt.Fprintf(outputBuffer, "log %s\n", debug.Level())
+			break
+		}
+		if len(args) == 2 && args[0] == "log" {
+			if err := debug.SetLevel(args[1]); err != nil {
+				return output(fmt.Errorf("%v: %w", err, linuxerr.EINVAL))
+			}
+			break
+		}
+		if len(args) < 2 || args[0] != "cat-blocks" {
+			_, _ = fmt.Fprintln(outputBuffer, "Usage: debug cat-blocks REF...\n       debug 9p [off|on|packets]\n       debug log [error|info|debug]")
 			return linuxerr.EINVAL
 		}
-		name := args[0]
-		if len(name) == 0 || name[0] == '/' {
-			usage()
+		refs := make([]block.Ref, len(args)-1)
+		for i, arg := range args[1:] {
+			if refs[i], err = block.ParseRef(arg); err != nil {
+				return output(err)
+			}
+		}
+		if err := ops.treeStore.CatBlocks(outputBuffer, refs); err != nil {
+			return output(err)
+		}
+	case "fsck-names":
+		repair := len(args) == 1 && args[0] == "--repair"
+		if len(args) > 0 && !repair {
+			_, _ = fmt.Fprintln(outputBuffer, "Usage: fsck-names [--repair]")
 			return linuxerr.EINVAL
 		}
-		elems := strings.Split(name, "/")
-		_, r := ops.tree.Root()
-		nn, err := ops.tree.Walk(r, elems...)
+		dupes, err := ops.tree.CheckNames(repair)
+		for _, d := range dupes {
+			if d.NewName != "" {
+				_, _ = fmt.Fprintf(outputBuffer, "%s: duplicate, renamed to %q\n", d.Path, d.NewName)
+			} else {
+				_, _ = fmt.Fprintf(outputBuffer, "%s: duplicate\n", d.Path)
+			}
+		}
 		if err != nil {
-			if errors.Is(err, tree.ErrNotExist) {
-				return linuxerr.ENOENT
+			return fmt.Errorf("fsck-names: %w", err)
+		}
+	case "retry-load":
+		if len(args) != 1 {
+			_, _ = fmt.Fprint(outputBuffer, "Usage: retry-load PATH\nPATH is a directory path relative to the musclefs root, or / for the root.\n")
+			return linuxerr.EINVAL
+		}
+		_, node := ops.tree.Root()
+		if elems := strings.Split(strings.Trim(args[0], "/"), "/"); elems[0] != "" {
+			nn, err := ops.tree.Walk(node, elems...)
+			if err != nil {
+				return output(err)
 			}
-			_, _ = fmt.Fprintln(outputBuffer, err)
-			return err
+			node = nn[len(nn)-1]
 		}
-		if len(nn) != len(elems) {
-			return linuxerr.ENOENT
+		failures, err := ops.tree.RetryLoad(node)
+		if err != nil {
+			return output(err)
 		}
-		return ops.tree.RemoveForMerge(nn[len(nn)-1])
-	case "graft2":
-		{
-			// Usage: graft2 srcNodeHex/src/path dst/path
-			// e.g. graft2 50f6060602543d6825a84ed5b6bd215df6944cf1a41f283a9329d41c2c70c956 tmp/test
-			// or graft2 50f6060602543d6825a84ed5b6bd215df6944cf1a41f283a9329d41c2c70c956/foo/bar baz
-			// The srcNodeHex can refer to _any_ node, not necessarily a tree root node!
-			parts := strings.Split(args[0], "/")
+		for _, f := range failures {
+			_, _ = fmt.Fprintln(outputBuffer, f)
+		}
+		if len(failures) > 0 {
+			return linuxerr.EIO
+		}
+		_, _ = fmt.Fprintf(outputBuffer, "%s: all children loaded\n", node.Path())
+	case "trace":
+		switch len(args) {
+		case 0:
+			ops.trace.dump(outputBuffer)
+		case 1:
+			n, err := strconv.Atoi(args[0])
+			if err != nil || n < 0 {
+				_, _ = fmt.Fprintln(outputBuffer, "Usage: trace [SIZE]")
+				return linuxerr.EINVAL
+			}
+			ops.trace.resize(n)
+		default:
+			_, _ = fmt.Fprintln(outputBuffer, "Usage: trace [SIZE]")
+			return linuxerr.EINVAL
+		}
+	case "snapshot-frequency", "flush-interval":
+		usage := func() error {
+			_, _ = fmt.Fprintf(outputBuffer, "Usage: %s [DURATION]\n", cmd)
+			return linuxerr.EINVAL
+		}
+		switch len(args) {
+		case 0:
+		case 1:
+			d, err := time.ParseDuration(args[0])
+			if err != nil || d < 0 {
+				return usage()
+			}
+			if cmd == "flush-interval" {
+				if err := ops.tree.SetFlushInterval(d); err != nil {
+					return output(err)
+				}
+			} else {
+				ops.setSnapshotFrequency(d)
+			}
+		default:
+			return usage()
+		}
+		if cmd == "flush-interval" {
+			_, _ = fmt.Fprintln(outputBuffer, ops.tree.FlushInterval())
+		} else {
+			_, _ = fmt.Fprintln(outputBuffer, time.Duration(atomic.LoadInt64(&ops.snapshotFrequency)))
+		}
+	case "drain":
+		var timeout time.Duration
+		switch len(args) {
+		case 0:
+		case 1:
+			if timeout, err = time.ParseDuration(args[0]); err != nil || timeout <= 0 {
+				_, _ = fmt.Fprintln(outputBuffer, "Usage: drain [TIMEOUT]")
+				return linuxerr.EINVAL
+			}
+		default:
+			_, _ = fmt.Fprintln(outputBuffer, "Usage: drain [TIMEOUT]")
+			return linuxerr.EINVAL
+		}
+		n, empty := ops.sessions.drain()
+		_, _ = fmt.Fprintf(outputBuffer, "draining, %d sessions open\n", n)
+		go ops.exitWhenDrained(empty, timeout)
+	case "dirty":
+		now := time.Now()
+		for _, n := range ops.tree.ListDirtyNodes() {
+			_, _ = fmt.Fprintf(outputBuffer, "%s %d %v\n", n.Path, n.Size, now.Sub(n.Modified).Truncate(time.Second))
+		}
+	case "keep-local-for":
+		if len(args) != 1 {
+			_, _ = fmt.Fprintln(outputBuffer, "Usage: keep-local-for REVISION/PATTERN")
+			return linuxerr.EINVAL
+		}
+		// Same as "keep-local add".
+		args = []string{"add", args[0]}
+		fallthrough
+	case "keep-local":
+		usage := func() error {
+			_, _ = fmt.Fprintln(outputBuffer, "Usage: keep-local list | add REVISION/PATTERN | remove REVISION/PATTERN")
+			return linuxerr.EINVAL
+		}
+		if len(args) == 0 {
+			return usage()
+		}
+		switch args[0] {
+		case "list":
+			if len(args) != 1 {
+				return usage()
+			}
+			for _, rule := range ops.tree.IgnoreRules() {
+				_, _ = fmt.Fprintln(outputBuffer, rule)
+			}
+			return nil
+		case "add", "remove":
+			if len(args) != 2 {
+				return usage()
+			}
+			revision, pattern, err := parseKeepLocalRule(args[1])
+			if err != nil {
+				return output(err)
+			}
+			if args[0] == "add" {
+				if err := ops.tree.Ignore(revision, pattern); err != nil {
+					return output(err)
+				}
+			} else if !ops.tree.Unignore(revision, pattern) {
+				return output(fmt.Errorf("%q: %w", args[1], linuxerr.ENOENT))
+			}
+			return saveKeepLocalRules(ops.tree, ops.cfg.KeepLocalFilePath())
+		default:
+			return usage()
+		}
+	case "rename":
+		if len(args) != 2 {
+			_, _ = fmt.Fprintln(outputBuffer, "Usage: rename SOURCE TARGET")
+			return linuxerr.EINVAL
+		}
+		err := ops.tree.Rename(args[0], args[1])
+		if err != nil {
+			_, _ = fmt.Fprintf(outputBuffer, "rename: %v\n", err)
+			return err
+		}
+	case "unlink":
+		usage := func() {
+			_, _ = fmt.Fprint(outputBuffer, "Usage: unlink NAME\nNAME is a non-empty path relative to the musclefs root.\n")
+		}
+		if len(args) != 1 {
+			usage()
+			return linuxerr.EINVAL
+		}
+		name := args[0]
+		if len(name) == 0 || name[0] == '/' {
+			usage()
+			return linuxerr.EINVAL
+		}
+		elems := strings.Split(name, "/")
+		_, r := ops.tree.Root()
+		nn, err := ops.tree.Walk(r, elems...)
+		if err != nil {
+			if errors.Is(err, tree.ErrNotExist) {
+				return linuxerr.ENOENT
+			}
+			_, _ = fmt.Fprintln(outputBuffer, err)
+			return err
+		}
+		if len(nn) != len(elems) {
+			return linuxerr.ENOENT
+		}
+		return ops.tree.RemoveForMerge(nn[len(nn)-1])
+	case "graft2":
+		{
+			// Usage: graft2 [--force] [--preserve-mtime] srcNodeHex/src/path dst/path
+			// e.g. graft2 50f6060602543d6825a84ed5b6bd215df6944cf1a41f283a9329d41c2c70c956 tmp/test
+			// or graft2 50f6060602543d6825a84ed5b6bd215df6944cf1a41f283a9329d41c2c70c956/foo/bar baz
+			// The srcNodeHex can refer to _any_ node, not necessarily a tree root node!
+			force, preserve, args := parseGraftFlags(args)
+			if len(args) != 2 {
+				_, _ = fmt.Fprintln(outputBuffer, "Usage: graft2 [--force] [--preserve-mtime] NODE[/SOURCE] TARGET")
+				return linuxerr.EINVAL
+			}
+			parts := strings.Split(args[0], "/")
 			srcNodeHex := parts[0]
 			srcPathElems := parts[1:]
 			dstPathElems := strings.Split(args[1], "/")
@@ -550,13 +1149,17 @@ func runCommand(ops *ops, controlNode *fsNode, cmd string) error {
 				return fmt.Errorf("graft2: load source tree: %v", err)
 			}
 			srcRoot := srcTree.Attach()
-			var srcLeafNode *tree.Node
+			var srcLeafNode, srcParent *tree.Node
 			if len(srcPathElems) > 0 {
 				wn, err := srcTree.Walk(srcRoot, srcPathElems...)
 				if err != nil || len(wn) != len(srcPathElems) {
 					return fmt.Errorf("graft2: walk to source: %v", err)
 				}
 				srcLeafNode = wn[len(wn)-1]
+				srcParent = srcRoot
+				if len(wn) > 1 {
+					srcParent = wn[len(wn)-2]
+				}
 			} else {
 				srcLeafNode = srcRoot
 			}
@@ -572,13 +1175,19 @@ func runCommand(ops *ops, controlNode *fsNode, cmd string) error {
 				dstReceiver = dstRoot
 			}
 			fmt.Printf("Grafting %s into %s\n", srcLeafNode, dstReceiver)
-			err = ops.tree.Graft(dstReceiver, srcLeafNode, dstLeafNodeName)
+			err = ops.tree.Graft(dstReceiver, srcLeafNode, dstLeafNodeName, ops.graftOptions(force, preserve, srcParent)...)
 			if err != nil {
 				log.Printf("graft2: %v", err)
-				return linuxerr.EACCES
+				_, _ = fmt.Fprintf(outputBuffer, "graft2: %v\n", err)
+				return graftErrno(err)
 			}
 		}
 	case "graft":
+		force, preserve, args := parseGraftFlags(args)
+		if len(args) != 2 {
+			_, _ = fmt.Fprintln(outputBuffer, "Usage: graft [--force] [--preserve-mtime] REVISION[/SOURCE] TARGET")
+			return linuxerr.EINVAL
+		}
 		parts := strings.Split(args[0], "/")
 		revision := parts[0]
 		historicalPath := parts[1:]
@@ -610,12 +1219,29 @@ func runCommand(ops *ops, controlNode *fsNode, cmd string) error {
 		if len(lNodes) > 0 {
 			localParent = lNodes[len(lNodes)-1]
 		}
-		historicalChild := hNodes[len(hNodes)-1]
+		historicalChild := historicalRoot
+		var historicalParent *tree.Node
+		if len(hNodes) > 0 {
+			historicalChild = hNodes[len(hNodes)-1]
+			historicalParent = historicalRoot
+			if len(hNodes) > 1 {
+				historicalParent = hNodes[len(hNodes)-2]
+			}
+		}
 
 		fmt.Printf("Attempting graft of %s into %s\n", historicalChild, localParent)
-		err = ops.tree.Graft(localParent, historicalChild, localBaseName)
+		err = ops.tree.Graft(localParent, historicalChild, localBaseName, ops.graftOptions(force, preserve, historicalParent)...)
 		if err != nil {
-			return errorf(method, "%v: %w", err, linuxerr.EACCES)
+			return errorf(method, "%v: %w", err, graftErrno(err))
+		}
+	case "copy-from":
+		force, preserve, args := parseGraftFlags(args)
+		if len(args) != 2 {
+			_, _ = fmt.Fprintln(outputBuffer, "Usage: copy-from [--force] [--preserve-mtime] SOURCE TARGET")
+			return linuxerr.EINVAL
+		}
+		if err := ops.copyFrom(outputBuffer, args[0], args[1], force, preserve); err != nil {
+			return output(err)
 		}
 	case "trim":
 		// This, I think, is the only protection against loading large
@@ -627,142 +1253,698 @@ func runCommand(ops *ops, controlNode *fsNode, cmd string) error {
 		if err := ops.tree.Flush(); err != nil {
 			return fmt.Errorf("could not flush: %v", err)
 		}
-		_, _ = fmt.Fprintln(outputBuffer, "flushed")
-	case "pull":
+		_, _ = fmt.Fprintf(outputBuffer, "flushed %v\n", ops.tree.LastFlushStats())
+	case "sync":
+		usage := func() error {
+			_, _ = fmt.Fprintln(outputBuffer, "Usage: sync [-remote] [TIMEOUT]")
+			return linuxerr.EINVAL
+		}
+		remote := len(args) > 0 && args[0] == "-remote"
+		if remote {
+			args = args[1:]
+		}
+		var timeout time.Duration
+		switch len(args) {
+		case 0:
+		case 1:
+			if timeout, err = time.ParseDuration(args[0]); err != nil || timeout <= 0 {
+				return usage()
+			}
+		default:
+			return usage()
+		}
 		if err := ops.tree.Flush(); err != nil {
 			return fmt.Errorf("could not flush: %v", err)
 		}
-		localbase, err := ops.treeStore.LocalBasePointer()
+		_, _ = fmt.Fprintf(outputBuffer, "flushed %v\n", ops.tree.LastFlushStats())
+		if !remote {
+			break
+		}
+		// Don't block file system operations while waiting for the
+		// propagation backlog to drain.
+		ops.unlock()
+		err = ops.pairedStore.Sync(timeout)
+		ops.lock(nil)
+		ops.current.Set(span)
 		if err != nil {
 			return output(err)
 		}
-		tag, err := ops.treeStore.RemoteTag("base")
+		_, _ = fmt.Fprintln(outputBuffer, "propagated")
+	case "pull":
+		var dryRun bool
+		var strategy string
+		flags := flag.NewFlagSet("pull", flag.ContinueOnError)
+		flags.SetOutput(outputBuffer)
+		flags.BoolVar(&dryRun, "n", false, "only list the commands to run, and preview their changes")
+		flags.StringVar(&strategy, "s", "", "resolve conflicts with `strategy` ours, theirs, newest, or manual, unless a configured rule applies")
+		if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+			_, _ = fmt.Fprintln(outputBuffer, "Usage: pull [-n] [-s STRATEGY]")
+			return linuxerr.EINVAL
+		}
+		var s tree.MergeStrategy
+		if strategy != "" {
+			if s, err = tree.ParseMergeStrategy(strategy); err != nil {
+				return output(err)
+			}
+		}
+		err := ops.pull(outputBuffer, controlNode, dryRun, s)
+		if !dryRun {
+			ops.refreshBinds(outputBuffer)
+		}
 		if err != nil {
 			return output(err)
 		}
-		if localbase.Equals(tag.Pointer) {
-			_, _ = fmt.Fprintln(outputBuffer, "local base matches remote base, pull is a no-op")
-			return nil
+	case "push":
+		var allowEmpty, keep bool
+		var message string
+		// The message is the rest of the line, as commands are split
+		// into fields.
+		for i, arg := range args {
+			if arg == "-m" {
+				message = strings.Join(args[i+1:], " ")
+				args = args[:i]
+				break
+			}
 		}
-		var localbasetree *tree.Tree
-		if localbase.IsNull() {
-			// Assume an empty base tree, e.g., we're sitting on a new “branch.”
-			localbasetree, err = tree.NewTree(ops.treeStore)
-		} else {
-			localbasetree, err = tree.NewTree(ops.treeStore, tree.WithRevision(localbase))
+		flags := flag.NewFlagSet("push", flag.ContinueOnError)
+		flags.SetOutput(outputBuffer)
+		flags.BoolVar(&allowEmpty, "allow-empty", false, "create a revision even if nothing changed since the local base")
+		flags.BoolVar(&keep, "keep", false, "mark the revision to be retained by garbage collection regardless of age")
+		if err := flags.Parse(args); err != nil {
+			_, _ = fmt.Fprintln(outputBuffer, "Usage: push [-allow-empty] [-keep] [TAG...] [-m MESSAGE...]")
+			return linuxerr.EINVAL
 		}
-		if err != nil {
+		return ops.push(outputBuffer, append([]string{ops.branch}, flags.Args()...), allowEmpty, keep, message)
+	case "reachable":
+		var tagNames string
+		var count int
+		flags := flag.NewFlagSet("reachable", flag.ContinueOnError)
+		flags.SetOutput(outputBuffer)
+		flags.StringVar(&tagNames, "b", "base", "comma-separated tag `names` whose history is retained")
+		flags.IntVar(&count, "n", 0, "number of `revisions` retained per tag, all if zero")
+		if err := flags.Parse(args); err != nil || flags.NArg() > 1 || (flags.NArg() == 1 && !path.IsAbs(flags.Arg(0))) {
+			_, _ = fmt.Fprintln(outputBuffer, "Usage: reachable [-b TAGS] [-n COUNT] [ABSOLUTE-PATH]")
+			return linuxerr.EINVAL
+		}
+		if err := ops.reachable(outputBuffer, strings.Split(tagNames, ","), count, flags.Arg(0)); err != nil {
 			return output(err)
 		}
-		remotebasetree, err := tree.NewTree(ops.treeStore, tree.WithRevision(tag.Pointer))
+	case "checkpoint":
+		if len(args) > 1 {
+			_, _ = fmt.Fprintln(outputBuffer, "Usage: checkpoint [NAME]")
+			return linuxerr.EINVAL
+		}
+		when := time.Now()
+		name := when.Format("20060102T150405")
+		if len(args) == 1 {
+			name = args[0]
+		}
+		// Sealing writes data to the local cache, the remote store is
+		// written to in the background. If metadata is written
+		// through, though, it is written to the remote store before
+		// the checkpoint is recorded.
+		cp, err := ops.tree.Checkpoint(name, when)
 		if err != nil {
 			return output(err)
 		}
-		commands, err := ops.tree.PullWorklog(ops.cfg, localbasetree, remotebasetree)
+		_, _ = fmt.Fprintf(outputBuffer, "checkpoint %s %v\n", cp.Name, cp.Root)
+	case "checkpoints":
+		cps, err := ops.treeStore.Checkpoints()
 		if err != nil {
 			return output(err)
 		}
-
-		// XXX It's a bit silly to return a string of concatenated commands
-		// and then split it! But let's first see if automatically running
-		// commands works out well and simplifies usage, and we'll refactor
-		// if so.
-		var cs []string
-		successful := 0
-		for _, c := range strings.Split(commands, "\n") {
-			args := strings.Fields(c)
-			if len(args) > 0 && (args[0] == "flush" || args[0] == "graft2" || args[0] == "unlink") {
-				log.Printf("DEBUG auto-running: %q", c)
-				if err := runCommand(ops, controlNode, c); err != nil {
-					cs = append(cs, c)
-				} else {
-					successful++
-				}
-			} else {
-				cs = append(cs, c)
-			}
+		for _, cp := range cps {
+			_, _ = fmt.Fprintf(outputBuffer, "%s %v %s\n", cp.Name, cp.Root, cp.When.Format(time.RFC3339))
 		}
-		commands = strings.Join(cs, "\n")
-
-		if len(commands) == 0 || commands == "pull\n" {
-			_, _ = fmt.Fprintf(outputBuffer, "# pull successful (%d commands run)\n", successful)
-			if err := ops.treeStore.SetLocalBasePointer(tag.Pointer); err != nil {
-				return output(err)
-			}
-			return nil
-		} else {
-			_, _ = fmt.Fprintf(outputBuffer, "# %d commands were run automatically\n", successful)
+	case "restore-checkpoint":
+		if len(args) != 1 {
+			_, _ = fmt.Fprintln(outputBuffer, "Usage: restore-checkpoint NAME")
+			return linuxerr.EINVAL
 		}
-		outputBuffer.WriteString(commands)
-		return nil
-	case "push":
-		tagNames := append([]string{"base"}, args...)
-		localbase, err := ops.treeStore.LocalBasePointer()
+		cps, err := ops.treeStore.Checkpoints()
 		if err != nil {
 			return output(err)
 		}
-		tags, err := ops.treeStore.RemoteTags(tagNames)
+		cp, ok := tree.FindCheckpoint(cps, args[0])
+		if !ok {
+			return output(fmt.Errorf("checkpoint %q: %w", args[0], linuxerr.ENOENT))
+		}
+		saved, err := tree.NewTree(ops.treeStore, tree.WithRoot(cp.Root))
 		if err != nil {
 			return output(err)
 		}
-		remotebase := tags[0].Pointer
-		if !localbase.Equals(remotebase) {
-			return output(fmt.Errorf("local base %v does not match remote base %v, pull first", localbase, remotebase))
+		if err := ops.tree.Replace(saved.Attach()); err != nil {
+			return output(err)
 		}
-		_, _ = fmt.Fprintln(outputBuffer, "local base matches remote base, push allowed")
-
 		if err := ops.tree.Flush(); err != nil {
 			return output(err)
 		}
-		_, _ = fmt.Fprintln(outputBuffer, "push: flushed")
+		_, _ = fmt.Fprintf(outputBuffer, "restored checkpoint %s %v\n", cp.Name, cp.Root)
+	case "checkout":
+		if len(args) != 1 {
+			_, _ = fmt.Fprintln(outputBuffer, "Usage: checkout TAG")
+			return linuxerr.EINVAL
+		}
+		return ops.checkout(outputBuffer, args[0])
+	default:
+		return fmt.Errorf("command not recognized: %q", cmd)
+	}
 
-		if err := ops.tree.Seal(); err != nil {
-			return output(err)
+	return nil
+}
+
+// pull merges the remote revision the branch points to into the local
+// tree, by running the graft2 and unlink commands that take the remote
+// changes, and writes what's left to do, e.g., resolving conflicts, to
+// w. The commands are recorded in a pullWorklog as they complete, and
+// a pull that was interrupted resumes where it stopped, before merging
+// again to find what's left. Once nothing is, the local base moves to
+// the remote revision. A dry run only writes the commands that would
+// run, and a preview of the changes they'd make, see previewPull.
+func (ops *ops) pull(w io.Writer, controlNode *fsNode, dryRun bool, strategy tree.MergeStrategy) error {
+	if !dryRun {
+		if err := ops.tree.Flush(); err != nil {
+			return fmt.Errorf("could not flush: %v", err)
 		}
-		_, _ = fmt.Fprintln(outputBuffer, "push: sealed")
+	}
+	localbase, err := ops.treeStore.LocalBasePointer()
+	if err != nil {
+		return err
+	}
+	tag, err := ops.treeStore.RemoteTag(ops.branch)
+	if err != nil {
+		return err
+	}
+	worklog, err := loadPullWorklog(ops.cfg.PullWorklogFilePath())
+	if err != nil {
+		return err
+	}
+	if localbase.Equals(tag.Pointer) {
+		if worklog != nil {
+			// Left behind by a pull that completed.
+			if err := worklog.remove(); err != nil {
+				return err
+			}
+		}
+		_, _ = fmt.Fprintln(w, "local base matches remote base, pull is a no-op")
+		return nil
+	}
+	if dryRun {
+		if worklog != nil {
+			_, _ = fmt.Fprintf(w, "# a pull of %v is in progress, %d of %d commands left\n", worklog.remote, len(worklog.pending()), len(worklog.commands))
+		}
+		commands, remote, err := ops.pullWorklog(localbase, tag.Pointer, strategy)
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprint(w, commands)
+		return previewPull(w, ops.tree, remote, ops.cfg.MuscleFSMount, ops.cfg.DiffMaxSize, commands)
+	}
 
-		_, localroot := ops.tree.Root()
-		revision := tree.NewRevision(localroot, tags)
-		if err := ops.treeStore.StoreRevision(revision); err != nil {
-			return output(err)
+	// run runs the commands of the worklog yet to complete, and
+	// records those that did once the tree is flushed. Running a
+	// command again after a crash is harmless: graft2 grafts the same
+	// node again, and unlink finds nothing to remove.
+	successful := 0
+	run := func() error {
+		var done []int
+		for _, i := range worklog.pending() {
+			c := worklog.commands[i]
+			debug.Logf(debug.Debug, "Auto-running: %q", c)
+			err := runCommand(ops, controlNode, c)
+			if err == nil || strings.HasPrefix(c, "unlink ") && errors.Is(err, linuxerr.ENOENT) {
+				done = append(done, i)
+			}
 		}
-		ops.tree.SetRevision(revision)
-		_, _ = fmt.Fprintf(outputBuffer, "push: revision created: %s\n", revision.ShortString())
+		if err := ops.tree.Flush(); err != nil {
+			return fmt.Errorf("could not flush: %v", err)
+		}
+		successful += len(done)
+		return worklog.markDone(done)
+	}
 
-		if err := ops.treeStore.SetRemoteTags(tagNames, revision.Key()); err != nil {
-			return output(err)
+	if worklog != nil && !worklog.remote.Equals(tag.Pointer) {
+		_, _ = fmt.Fprintf(w, "# remote moved from %v to %v during the pull, merging again\n", worklog.remote, tag.Pointer)
+		worklog = nil
+	}
+	if worklog != nil {
+		_, _ = fmt.Fprintf(w, "# resuming pull of %v, %d of %d commands left\n", worklog.remote, len(worklog.pending()), len(worklog.commands))
+		if err := run(); err != nil {
+			return err
 		}
-		_, _ = fmt.Fprintf(outputBuffer, "push: updated remote tags %v to %v\n", tagNames, revision.Key())
+		if len(worklog.pending()) > 0 {
+			pullLeft(w, successful, worklog, nil)
+			return nil
+		}
+	}
+
+	commands, _, err := ops.pullWorklog(localbase, tag.Pointer, strategy)
+	if err != nil {
+		return err
+	}
+	var auto, manual []string
+	for _, c := range strings.Split(commands, "\n") {
+		args := strings.Fields(c)
+		switch {
+		case len(args) == 0 || args[0] == "flush" || args[0] == "pull":
+			// Flushing is done below, and pull is suggested again
+			// if there's anything left.
+		case args[0] == "graft2" || args[0] == "unlink":
+			auto = append(auto, c)
+		default:
+			manual = append(manual, c)
+		}
+	}
+	if worklog, err = newPullWorklog(ops.cfg.PullWorklogFilePath(), tag.Pointer, auto); err != nil {
+		return err
+	}
+	if err := run(); err != nil {
+		return err
+	}
+	if len(worklog.pending()) > 0 || len(manual) > 0 {
+		pullLeft(w, successful, worklog, manual)
+		return nil
+	}
+	_, _ = fmt.Fprintf(w, "# pull successful (%d commands run)\n", successful)
+	if err := ops.treeStore.SetLocalBasePointer(tag.Pointer); err != nil {
+		return err
+	}
+	return worklog.remove()
+}
+
+// pullWorklog returns the commands to merge the remote revision into
+// the local tree, given the revision the latter is based on, see
+// tree.Tree.PullWorklog, and the remote tree.
+func (ops *ops) pullWorklog(localbase, remote storage.Pointer, strategy tree.MergeStrategy) (string, *tree.Tree, error) {
+	var localbasetree *tree.Tree
+	var err error
+	if localbase.IsNull() {
+		// Assume an empty base tree, e.g., we're sitting on a new “branch.”
+		localbasetree, err = tree.NewTree(ops.treeStore)
+	} else {
+		localbasetree, err = tree.NewTree(ops.treeStore, tree.WithRevision(localbase))
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	remotetree, err := tree.NewTree(ops.treeStore, tree.WithRevision(remote))
+	if err != nil {
+		return "", nil, err
+	}
+	commands, err := ops.tree.PullWorklog(ops.cfg, localbasetree, remotetree, strategy)
+	if err != nil {
+		return "", nil, err
+	}
+	return commands, remotetree, nil
+}
+
+// pullLeft writes what's left to do to complete a pull: the commands
+// of the worklog that failed, to be retried, and the manual steps,
+// e.g., for conflicts. The pull itself succeeds, so that its output
+// can be piped to "muscle control" to run them.
+func pullLeft(w io.Writer, successful int, worklog *pullWorklog, manual []string) {
+	_, _ = fmt.Fprintf(w, "# %d commands were run automatically\n", successful)
+	for _, i := range worklog.pending() {
+		_, _ = fmt.Fprintln(w, worklog.commands[i])
+	}
+	for _, c := range manual {
+		_, _ = fmt.Fprintln(w, c)
+	}
+	_, _ = fmt.Fprintln(w, "flush")
+	_, _ = fmt.Fprintln(w, "pull")
+}
 
-		if err := ops.treeStore.SetLocalBasePointer(revision.Key()); err != nil {
+// push creates a revision from the local tree, whose parents are the
+// revisions the given tags point to, and updates the tags to point to
+// it. The first tag is the branch, which must not have moved since the
+// local base. Unless allowEmpty is set, no revision is created if the
+// local tree did not change since the local base and the other tags
+// point to it already. Pushing to
+// tree.VerifiedTag is refused.
+func (ops *ops) push(w io.Writer, tagNames []string, allowEmpty, keep bool, message string) error {
+	// A helper function to return an error, and also add it to the output.
+	output := func(err error) error {
+		_, _ = fmt.Fprintf(w, "%+v", err)
+		return err
+	}
+
+	for _, name := range tagNames {
+		if name == tree.VerifiedTag {
+			return output(fmt.Errorf("tag %q is only moved by muscle verify: %w", name, linuxerr.EPERM))
+		}
+	}
+	localbase, err := ops.treeStore.LocalBasePointer()
+	if err != nil {
+		return output(err)
+	}
+	tags, err := ops.treeStore.RemoteTags(tagNames)
+	if err != nil {
+		return output(err)
+	}
+	if err := ops.treeStore.CheckFastForward(localbase, tags[0]); err != nil {
+		return output(err)
+	}
+	_, _ = fmt.Fprintln(w, "local base matches remote base, push allowed")
+
+	if err := ops.tree.Flush(); err != nil {
+		return output(err)
+	}
+	_, _ = fmt.Fprintln(w, "push: flushed")
+
+	if err := ops.preseal(); err != nil {
+		return output(err)
+	}
+	if err := ops.tree.Seal(); err != nil {
+		return output(err)
+	}
+	_, _ = fmt.Fprintln(w, "push: sealed")
+	ops.saveReadOrder()
+
+	if !allowEmpty && tagsAt(tags[1:], localbase) {
+		if unchanged, err := ops.unchangedSince(localbase); err != nil {
 			return output(err)
+		} else if unchanged {
+			_, _ = fmt.Fprintf(w, "push: nothing changed since %v, no revision created (see -allow-empty)\n", localbase)
+			return nil
+		}
+	}
+
+	_, localroot := ops.tree.Root()
+	revision := tree.NewRevision(localroot, tags)
+	revision.SetKeep(keep)
+	revision.SetMessage(message)
+	if err := ops.treeStore.StoreRevision(revision); err != nil {
+		return output(err)
+	}
+	ops.tree.SetRevision(revision)
+	_, _ = fmt.Fprintf(w, "push: revision created: %s\n", revision.ShortString())
+
+	if err := ops.reviveTombstoned(w); err != nil {
+		return output(err)
+	}
+
+	if err := ops.treeStore.UpdateRemoteTags(tags, revision.Key()); errors.Is(err, storage.ErrConflict) {
+		return output(fmt.Errorf("%v: another host pushed concurrently, pull first", err))
+	} else if err != nil {
+		return output(err)
+	}
+	_, _ = fmt.Fprintf(w, "push: updated remote tags %v to %v\n", tagNames, revision.Key())
+
+	if err := ops.treeStore.SetLocalBasePointer(revision.Key()); err != nil {
+		return output(err)
+	}
+	_, _ = fmt.Fprintf(w, "push: updated local base pointer: %v\n", revision.Key())
+	ops.pairedStore.Notify()
+	ops.lastPush = time.Now()
+	if err := ops.treeStore.Heartbeat(ops.instance()); err != nil {
+		log.Printf("Could not record the push for muscle status: %v", err)
+	}
+	return nil
+}
+
+// tagsAt reports whether all the given tags point to the given revision.
+func tagsAt(tags []tree.Tag, revision storage.Pointer) bool {
+	for _, tag := range tags {
+		if !tag.Pointer.Equals(revision) {
+			return false
+		}
+	}
+	return true
+}
+
+// reviveTombstoned removes the keys of the local tree from the
+// tombstone log before the revision is published, so that a concurrent
+// clean does not delete them, and uploads again those it deleted
+// already. The whole tree is visited, but only if the log is not empty,
+// i.e., while a clean is in progress.
+func (ops *ops) reviveTombstoned(w io.Writer) error {
+	tombstones, err := ops.treeStore.Tombstones()
+	if err != nil || len(tombstones) == 0 {
+		return err
+	}
+	inUse, err := ops.tree.ReachableKeys(nil)
+	if err != nil {
+		return err
+	}
+	revived, restored, err := ops.treeStore.Revive(inUse, func(key storage.Key) error {
+		value, err := ops.pairedStore.Get(key)
+		if err != nil {
+			return err
 		}
-		_, _ = fmt.Fprintf(outputBuffer, "push: updated local base pointer: %v\n", revision.Key())
-		ops.pairedStore.Notify()
+		return ops.pairedStore.WriteThrough().Put(key, value)
+	})
+	if err != nil {
+		return err
+	}
+	if revived > 0 {
+		_, _ = fmt.Fprintf(w, "push: revived %d keys marked as garbage, %d uploaded again\n", revived, restored)
+	}
+	return nil
+}
+
+// unchangedSince reports whether the local tree, once sealed, has the
+// same root as the given base revision.
+func (ops *ops) unchangedSince(localbase storage.Pointer) (bool, error) {
+	if localbase.IsNull() {
+		return false, nil
+	}
+	localroot, err := ops.treeStore.LocalRootKey()
+	if err != nil {
+		return false, err
+	}
+	r, err := ops.treeStore.LoadRevisionByKey(localbase)
+	if err != nil {
+		return false, err
+	}
+	return r.RootIs(localroot), nil
+}
+
+// checkout pushes the local tree to the current branch, unless it did
+// not change since the local base, then replaces it with the revision
+// the given tag points to, which becomes the branch for later pulls and
+// pushes. Nothing changes if files are open, except for the push.
+func (ops *ops) checkout(w io.Writer, name string) error {
+	// A helper function to return an error, and also add it to the output.
+	output := func(err error) error {
+		_, _ = fmt.Fprintf(w, "%+v", err)
+		return err
+	}
+
+	if name == ops.branch {
+		_, _ = fmt.Fprintf(w, "already on %s\n", name)
 		return nil
-	default:
-		return fmt.Errorf("command not recognized: %q", cmd)
+	}
+	if name == tree.VerifiedTag {
+		// It would be pushed to, see push.
+		return output(fmt.Errorf("tag %q is only moved by muscle verify: %w", name, linuxerr.EPERM))
+	}
+	tag, err := ops.treeStore.RemoteTag(name)
+	if err != nil {
+		return output(err)
+	}
+	if tag.Pointer.IsNull() {
+		return output(fmt.Errorf("tag %q: %w", name, linuxerr.ENOENT))
+	}
+	target, err := tree.NewTree(ops.treeStore, tree.WithRevision(tag.Pointer))
+	if err != nil {
+		return output(err)
+	}
+	// The live root is always in use, by ops.root.
+	if paths := ops.tree.ListNodesInUse(); len(paths) > 1 {
+		sort.Strings(paths)
+		return output(fmt.Errorf("in use: %s: %w", strings.Join(paths[1:], " "), linuxerr.EBUSY))
+	}
+
+	if err := ops.tree.Flush(); err != nil {
+		return output(err)
+	}
+	if err := ops.tree.Seal(); err != nil {
+		return output(err)
+	}
+	localbase, err := ops.treeStore.LocalBasePointer()
+	if err != nil {
+		return output(err)
+	}
+	unchanged, err := ops.unchangedSince(localbase)
+	if err != nil {
+		return output(err)
+	}
+	if unchanged {
+		_, _ = fmt.Fprintf(w, "checkout: %s unchanged since %v\n", ops.branch, localbase)
+	} else if err := ops.push(w, []string{ops.branch}, false, false, ""); err != nil {
+		return err
 	}
 
+	if err := ops.tree.Replace(target.Attach()); err != nil {
+		return output(err)
+	}
+	if err := ops.tree.Flush(); err != nil {
+		return output(err)
+	}
+	if err := ops.treeStore.SetLocalBasePointer(tag.Pointer); err != nil {
+		return output(err)
+	}
+	if err := ops.treeStore.SetLocalBranch(name); err != nil {
+		return output(err)
+	}
+	ops.branch = name
+	_, _ = fmt.Fprintf(w, "checkout: switched to %s at %v\n", name, tag.Pointer)
 	return nil
 }
 
+// setSnapshotFrequency sets how often the periodic flush goroutine
+// considers flushing. Zero means tree.SnapshotFrequency.
+func (ops *ops) setSnapshotFrequency(d time.Duration) {
+	if d == 0 {
+		d = tree.SnapshotFrequency
+	}
+	atomic.StoreInt64(&ops.snapshotFrequency, int64(d))
+}
+
+// preseal is the first phase of sealing: it uploads the staged blocks
+// of the tree, recording its progress in the seal journal, while the
+// tree lock, which the caller holds, is released, so that requests are
+// served meanwhile. Sealing the tree afterwards only uploads the blocks
+// changed since, and nodes. Failing to preseal only means sealing does
+// more work. The tree must have been flushed. If the branch or local
+// base changed while the lock was released, e.g., by a pull or a
+// checkout, or the root was replaced, preseal returns linuxerr.EAGAIN,
+// since what the caller checked before, e.g., that a push is a fast
+// forward, may no longer hold. Ordinary writes in the meantime don't
+// matter, since sealing picks them up, so that a tree written to all
+// the time can still be pushed.
+func (ops *ops) preseal() error {
+	refs, err := ops.tree.UnsealedBlocks()
+	if err != nil {
+		log.Printf("Could not list blocks to preseal: %v", err)
+		return nil
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+	_, root := ops.tree.Root()
+	branch := ops.branch
+	localbase, err := ops.treeStore.LocalBasePointer()
+	if err != nil {
+		return err
+	}
+	ops.unlock()
+	start := time.Now()
+	if err := ops.treeStore.Preseal(refs); err != nil {
+		log.Printf("Could not preseal: %v", err)
+	} else {
+		debug.Logf(debug.Info, "Presealed %d blocks in %v", len(refs), time.Since(start))
+	}
+	ops.lock(nil)
+	if _, now := ops.tree.Root(); now != root || ops.branch != branch {
+		return fmt.Errorf("the tree changed while presealing: %w", linuxerr.EAGAIN)
+	}
+	if now, err := ops.treeStore.LocalBasePointer(); err != nil {
+		return err
+	} else if !now.Equals(localbase) {
+		return fmt.Errorf("the local base changed while presealing: %w", linuxerr.EAGAIN)
+	}
+	return nil
+}
+
+// checkStaging returns linuxerr.ENOSPC if the staging area is over the
+// hard limit. If it is over the soft limit, it seals the tree in the
+// background, which moves the staged data to the cache, before checking
+// the hard limit, so that writes refused for lack of space can succeed
+// once the seal is done.
+func (ops *ops) checkStaging() error {
+	used := ops.staging.Usage()
+	if limit := ops.cfg.StagingSoftLimit; limit > 0 && used >= limit && atomic.CompareAndSwapInt32(&ops.sealing, 0, 1) {
+		go ops.sealStaging(used, limit)
+	}
+	if limit := ops.cfg.StagingHardLimit; limit > 0 && used >= limit {
+		return linuxerr.ENOSPC
+	}
+	return nil
+}
+
+// sealStaging seals the tree until the staging area is under the soft
+// limit, as changes made while sealing are staged too, or until sealing
+// doesn't free any space.
+func (ops *ops) sealStaging(used, limit int64) {
+	defer atomic.StoreInt32(&ops.sealing, 0)
+	for used >= limit {
+		ops.lock(nil)
+		log.Printf("Staging area over the soft limit (%d >= %d bytes), sealing.", used, limit)
+		if err := ops.tree.Flush(); err != nil {
+			log.Printf("Could not flush before sealing: %v", err)
+		}
+		// Changes made meanwhile are sealed too.
+		_ = ops.preseal()
+		if err := ops.tree.Seal(); err != nil {
+			log.Printf("Could not seal: %v", err)
+		}
+		ops.unlock()
+		before := used
+		if used = ops.staging.Usage(); used >= before {
+			log.Printf("Sealing did not free any space in the staging area (%d bytes used).", used)
+			return
+		}
+	}
+}
+
+// exitWhenDrained waits for all sessions to close, or for the timeout,
+// if positive, to expire, in which case it closes the sessions. Then it
+// asks the main goroutine to flush and exit.
+func (ops *ops) exitWhenDrained(empty <-chan struct{}, timeout time.Duration) {
+	if timeout > 0 {
+		select {
+		case <-empty:
+		case <-time.After(timeout):
+			log.Printf("Drain timed out after %v, closing remaining sessions", timeout)
+			ops.sessions.closeAll()
+			<-empty
+		}
+	} else {
+		<-empty
+	}
+	log.Print("All sessions closed")
+	select {
+	case ops.quit <- syscall.SIGTERM:
+	default:
+		// A signal is pending already.
+	}
+}
+
 func (ops *ops) Write(r *srv.Req) {
-	ops.mu.Lock()
-	defer ops.mu.Unlock()
+	ops.lock(r)
+	defer ops.unlock()
 	node := r.Fid.Aux.(*fsNode)
 	switch node.kind {
 	case controlFile:
 		node.dir.Mtime = uint32(time.Now().Unix())
-		// Assumption: One Twrite per command.
-		if err := runCommand(ops, node, string(r.Tc.Data)); err != nil {
+		// Assumption: One Twrite per command, or per script.
+		if err := runControl(ops, node, string(r.Tc.Data)); err != nil {
+			// The reply only carries an errno, so make sure the
+			// details can be read back.
+			if len(node.data) == 0 {
+				node.data = []byte(err.Error() + "\n")
+				node.dir.Length = uint64(len(node.data))
+			}
 			logRespondError(r, err)
 			return
 		}
 		r.RespondRwrite(uint32(len(r.Tc.Data)))
-	case historicNode, syntheticDir:
-		logRespondError(r, linuxerr.EACCES)
+	case notesFile:
+		if err := ops.annotations.write(node, r.Tc.Data, r.Tc.Offset); err != nil {
+			logRespondError(r, err)
+			return
+		}
+		r.RespondRwrite(uint32(len(r.Tc.Data)))
+	case historicNode:
+		logRespondError(r, linuxerr.EROFS)
+	case syntheticDir:
+		logRespondError(r, linuxerr.EISDIR)
 	default:
+		if err := ops.checkStaging(); err != nil {
+			logRespondError(r, err)
+			return
+		}
 		if err := node.WriteAt(r.Tc.Data, int64(r.Tc.Offset)); err != nil {
 			logRespondError(r, err)
 			return
@@ -772,11 +1954,11 @@ func (ops *ops) Write(r *srv.Req) {
 }
 
 func (ops *ops) Clunk(r *srv.Req) {
-	ops.mu.Lock()
-	defer ops.mu.Unlock()
+	ops.lock(r)
+	defer ops.unlock()
 	node := r.Fid.Aux.(*fsNode)
 	switch node.kind {
-	case controlFile, syntheticDir:
+	case controlFile, notesFile, syntheticDir:
 	default:
 		if node.lock != nil {
 			unlockNode(node.lock)
@@ -788,24 +1970,28 @@ func (ops *ops) Clunk(r *srv.Req) {
 }
 
 func (ops *ops) Remove(r *srv.Req) {
-	ops.mu.Lock()
-	defer ops.mu.Unlock()
+	ops.lock(r)
+	defer ops.unlock()
 	node := r.Fid.Aux.(*fsNode)
 	switch node.kind {
-	case controlFile, historicNode, syntheticDir:
+	case controlFile, syntheticDir:
 		logRespondError(r, linuxerr.EACCES)
+	case notesFile:
+		// The notes file stays, empty.
+		if err := ops.annotations.truncate(node, 0); err != nil {
+			logRespondError(r, err)
+		} else {
+			r.RespondRremove()
+		}
+	case historicNode:
+		logRespondError(r, linuxerr.EROFS)
 	default:
 		if node.Unlinked() {
 			logRespondError(r, linuxerr.ENOENT)
 			return
 		}
-		err := node.tree.Unlink(node.Node)
-		if err != nil {
-			if errors.Is(err, tree.ErrNotEmpty) {
-				logRespondError(r, linuxerr.ENOTEMPTY)
-			} else {
-				logRespondError(r, err)
-			}
+		if err := node.tree.Unlink(node.Node); err != nil {
+			logRespondError(r, err)
 		} else {
 			r.RespondRremove()
 		}
@@ -813,11 +1999,11 @@ func (ops *ops) Remove(r *srv.Req) {
 }
 
 func (ops *ops) Stat(r *srv.Req) {
-	ops.mu.Lock()
-	defer ops.mu.Unlock()
+	ops.lock(r)
+	defer ops.unlock()
 	node := r.Fid.Aux.(*fsNode)
 	switch node.kind {
-	case controlFile, syntheticDir:
+	case controlFile, notesFile, syntheticDir:
 		r.RespondRstat(&node.dir)
 	default:
 		if node.Unlinked() {
@@ -831,17 +2017,42 @@ func (ops *ops) Stat(r *srv.Req) {
 
 func (ops *ops) Wstat(r *srv.Req) {
 	const method = "ops.Wstat"
-	ops.mu.Lock()
-	defer ops.mu.Unlock()
+	ops.lock(r)
+	defer ops.unlock()
 	node := r.Fid.Aux.(*fsNode)
 	switch node.kind {
-	case controlFile, historicNode, syntheticDir:
+	case controlFile, syntheticDir:
 		logRespondError(r, linuxerr.EACCES)
+	case notesFile:
+		// Only the length can change; other changes, e.g., of the
+		// times set by touch, are ignored.
+		dir := r.Tc.Dir
+		if dir.ChangeName() {
+			logRespondError(r, linuxerr.EACCES)
+			return
+		}
+		if dir.ChangeLength() {
+			if err := ops.annotations.truncate(node, dir.Length); err != nil {
+				logRespondError(r, err)
+				return
+			}
+		}
+		r.RespondRwstat()
+	case historicNode:
+		logRespondError(r, linuxerr.EROFS)
 	default:
 		dir := r.Tc.Dir
+		// Check the mode first, not to apply other changes if it's
+		// going to fail.
+		if dir.ChangeMode() {
+			if err := tree.CheckMode(node.Node, dir.Mode); err != nil {
+				logRespondError(r, err)
+				return
+			}
+		}
 		if dir.ChangeLength() {
 			if node.IsDir() {
-				logRespondError(r, linuxerr.EACCES)
+				logRespondError(r, linuxerr.EISDIR)
 				return
 			}
 			eqid := p9util.NodeQID(node.Node)
@@ -873,7 +2084,11 @@ func (ops *ops) Wstat(r *srv.Req) {
 		}
 
 		if dir.ChangeName() {
-			if err := node.Rename(dir.Name); err != nil {
+			name, err := node.tree.CheckName(dir.Name)
+			if err == nil {
+				err = node.Rename(name)
+			}
+			if err != nil {
 				logRespondError(r, err)
 				return
 			}
@@ -883,11 +2098,10 @@ func (ops *ops) Wstat(r *srv.Req) {
 		}
 
 		if dir.ChangeMode() {
-			if err := checkMode(node.Node, dir.Mode); err != nil {
+			if err := node.SetMode(dir.Mode); err != nil {
 				logRespondError(r, err)
 				return
 			}
-			node.SetMode(dir.Mode)
 		}
 
 		// TODO: Not sure it's best to 'pretend' it works, or fail.
@@ -900,6 +2114,24 @@ func (ops *ops) Wstat(r *srv.Req) {
 	}
 }
 
+// monitorBacklog periodically checks the propagation backlog against
+// the configured limits, and complains loudly if they are exceeded.
+func monitorBacklog(pairedStore *storage.Paired, cfg *config.C) {
+	if cfg.PropagationAlertPending == 0 && cfg.PropagationAlertAge == 0 {
+		return
+	}
+	for {
+		time.Sleep(time.Minute)
+		b := pairedStore.Backlog()
+		if limit := cfg.PropagationAlertPending; limit > 0 && b.Pending+b.Missing > limit {
+			log.Printf("WARNING: propagation backlog has %d pending and %d missing items, limit is %d", b.Pending, b.Missing, limit)
+		}
+		if limit := cfg.PropagationAlertAge; limit > 0 && b.Age() > limit {
+			log.Printf("WARNING: oldest pending item in propagation backlog is %v old, limit is %v", b.Age().Truncate(time.Second), limit)
+		}
+	}
+}
+
 func main() {
 	// Do NOT turn on agent.ShutdownCleanup.
 	// The installed signal handler will call os.Exit, preventing
@@ -910,16 +2142,28 @@ func main() {
 	}
 
 	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
 
 	base := flag.String("base", config.DefaultBaseDirectoryPath, "Base directory for configuration, logs and cache files")
 	blockSize := flag.Int("fsdiff.blocksize", -1, "Do NOT use this for production file systems.")
-	debug := flag.Bool("D", false, "Print 9P dialogs.")
+	debug := flag.Bool("D", false, "Print 9P dialogs; see also the debug 9p control command.")
+	profileName := flag.String("profile", "", "Name of the profile whose base directory to use instead of -base, see "+config.ProfilesFilePath)
+	sandboxed := flag.Bool("sandbox", false, "Keep all changes in a temporary directory, discarded at exit, never writing to the base directory or the remote store.")
 	flag.Parse()
 	if *blockSize != -1 {
 		log.Printf("Overriding block size to %d bytes.", *blockSize)
 		config.BlockSize = uint32(*blockSize)
 	}
+	if *profileName != "" {
+		if *base != config.DefaultBaseDirectoryPath {
+			log.Fatal("The -base and -profile flags are mutually exclusive.")
+		}
+		dir, err := config.ProfileBase(*profileName)
+		if err != nil {
+			log.Fatalf("Could not resolve profile: %v", err)
+		}
+		*base = dir
+	}
 	cfg, err := config.Load(*base)
 	if err != nil {
 		log.Fatalf("Could not load config from %q: %v", *base, err)
@@ -930,9 +2174,83 @@ func main() {
 		log.Fatalf("Could not create remote store: %v", err)
 	}
 
-	stagingStore := storage.NewDiskStore(cfg.StagingDirectoryPath())
-	cacheStore := storage.NewDiskStore(cfg.CacheDirectoryPath())
-	pairedStore, err := storage.NewPaired(cacheStore, remoteBasicStore, cfg.PropagationLogFilePath())
+	var sb *sandbox
+	if *sandboxed {
+		if sb, cfg, err = newSandbox(cfg, *base); err != nil {
+			log.Fatalf("Could not create sandbox: %v", err)
+		}
+		*base = sb.dir
+		remoteBasicStore = sb.remote(remoteBasicStore)
+		log.Printf("Sandbox mode: changes go to %q and are discarded at exit.", sb.dir)
+	}
+
+	// A wrong key would otherwise surface as puzzling decoding errors
+	// while loading the tree. Stores written to before sentinels
+	// existed get one once the tree loads. If the remote store can't
+	// be reached, e.g., when offline, the key isn't checked.
+	sentinelErr := block.CheckSentinel(remoteBasicStore, cfg.EncryptionKeyBytes())
+	if errors.Is(sentinelErr, block.ErrWrongKey) {
+		log.Fatalf("Refusing to start, the encryption key in the configuration is not the one the remote store was written with: %v", sentinelErr)
+	} else if sentinelErr != nil && !errors.Is(sentinelErr, storage.ErrNotFound) {
+		log.Printf("Could not check the encryption key sentinel: %v", sentinelErr)
+	}
+
+	var tracer *otlp.Tracer
+	if cfg.OTLPEndpoint != "" {
+		tracer = otlp.NewTracer("musclefs", cfg.OTLPEndpoint)
+	}
+	current := new(otlp.Current)
+	metrics, err := storage.LoadMetrics(cfg.MetricsFilePath())
+	if err != nil {
+		log.Fatalf("Could not load metrics: %v", err)
+	}
+	instrument := func(store storage.Store, name string) storage.Store {
+		return storage.Traced(storage.LogSlow(storage.Metered(storage.Named(store, name), name, metrics), name, cfg.SlowThreshold), name, tracer, current)
+	}
+
+	stagingDisk := storage.NewDiskStore(cfg.StagingDirectoryPath())
+	if err := stagingDisk.TrackUsage(); err != nil {
+		log.Fatalf("Could not measure the staging area: %v", err)
+	}
+	stagingStore := instrument(sb.staging(stagingDisk), "staging")
+	cacheDisk := sb.cache(storage.NewDiskStore(cfg.CacheDirectoryPath()))
+	cacheStore := instrument(cacheDisk, "cache")
+	if cfg.MemoryTierCapacity > 0 {
+		promotion, err := storage.ParsePromotion(cfg.MemoryTierPromotion)
+		if err != nil {
+			log.Fatalf("Could not set up the memory tier: %v", err)
+		}
+		cacheStore = storage.NewTiered(
+			storage.Tier{Store: instrument(new(storage.InMemory), "memory"), Capacity: cfg.MemoryTierCapacity, Promotion: promotion},
+			storage.Tier{Store: cacheStore},
+		)
+	}
+	slowStore := instrument(remoteBasicStore, cfg.Storage)
+	var failover *storage.Failover
+	if len(cfg.Replicas) > 0 {
+		replicas := []storage.Replica{{Name: cfg.Storage, Store: slowStore}}
+		for _, r := range cfg.Replicas {
+			store, err := storage.NewReplicaStore(cfg, r)
+			if err != nil {
+				log.Fatalf("Could not set up replica %q: %v", r.Name, err)
+			}
+			replicas = append(replicas, storage.Replica{Name: r.Name, Store: instrument(store, "replica."+r.Name)})
+		}
+		failover = storage.NewFailover(replicas...)
+		failover.StartProbes(replicaProbeInterval)
+		slowStore = failover
+	}
+	if cfg.MirrorURL != "" {
+		slowStore = storage.NewTiered(
+			storage.Tier{Store: instrument(storage.NewHTTPMirror(cfg.MirrorURL, cfg.MirrorToken), "mirror"), Promotion: storage.PromoteNever},
+			storage.Tier{Store: slowStore},
+		)
+	}
+	var pairedOptions []storage.PairedOption
+	if cfg.CompressPropagationLog {
+		pairedOptions = append(pairedOptions, storage.WithCompressedLog())
+	}
+	pairedStore, err := storage.NewPaired(cacheStore, slowStore, cfg.PropagationLogFilePath(), pairedOptions...)
 	if err != nil {
 		log.Fatalf("Could not start new paired store with log %q: %v", cfg.PropagationLogFilePath(), err)
 	}
@@ -947,11 +2265,26 @@ func main() {
 	// propagation immediately.
 	pairedStore.EnsureBackgroundPuts()
 
-	blockFactory, err := block.NewFactory(stagingStore, pairedStore, cfg.EncryptionKeyBytes())
+	profile := block.NewReadProfile(readProfileSize)
+	journal, err := block.OpenSealJournal(cfg.SealJournalFilePath())
+	if err != nil {
+		log.Fatalf("Could not open seal journal: %v", err)
+	}
+	blockFactory, err := block.NewFactory(stagingStore, pairedStore, cfg.EncryptionKeyBytes(), block.WithCache(cfg.BlockCacheSize), block.WithReadProfile(profile), block.WithSealJournal(journal), block.WithFetchAhead(cfg.FetchAhead))
 	if err != nil {
 		log.Fatalf("Could not build block factory: %v", err)
 	}
-	treeStore, err := tree.NewStore(blockFactory, remoteBasicStore, *base)
+	var storeOptions []tree.StoreOption
+	if cfg.MetadataWriteThrough {
+		metadataFactory, err := block.NewFactory(stagingStore, pairedStore.WriteThrough(), cfg.EncryptionKeyBytes(), block.WithSharedCache(blockFactory), block.WithReadProfile(profile), block.WithSealJournal(journal))
+		if err != nil {
+			log.Fatalf("Could not build metadata block factory: %v", err)
+		}
+		storeOptions = append(storeOptions, tree.WithMetadataFactory(metadataFactory))
+	}
+	// Metered only, as the other wrappers would hide the conditional
+	// updates and listings of tags.
+	treeStore, err := tree.NewStore(blockFactory, storage.Metered(remoteBasicStore, cfg.Storage, metrics), *base, storeOptions...)
 	if err != nil {
 		log.Fatalf("Could not load tree: %v", err)
 	}
@@ -959,17 +2292,74 @@ func main() {
 	if err != nil {
 		log.Fatalf("Could not load tree: %v", err)
 	}
-	tt, err := tree.NewTree(treeStore, tree.WithRoot(rootKey), tree.WithRootName("live"), tree.WithMutable())
+	tt, err := tree.NewTree(treeStore, tree.WithRoot(rootKey), tree.WithRootName("live"), tree.WithMutable(), tree.WithSmallBlocks(cfg.SmallBlockSize, cfg.SmallBlockFiles), tree.WithAtime(cfg.Atime), tree.WithCaseInsensitive(cfg.CaseInsensitive), tree.WithNamePolicy(cfg.NamePolicy), tree.WithMaxDepth(cfg.MaxDepth), tree.WithFlushInterval(cfg.FlushInterval))
 	if err != nil {
 		log.Fatalf("Could not load tree: %v", err)
 	}
 
+	branch, err := treeStore.LocalBranch()
+	if err != nil {
+		log.Fatalf("Could not load branch: %v", err)
+	}
+
+	// A crash may have left values in the staging area that the tree
+	// doesn't refer to. A sandbox's staging area starts empty.
+	if sb == nil {
+		r, err := tt.RecoverStaging(context.Background(), stagingDisk, storage.NewDiskStore(cfg.QuarantineDirectoryPath()))
+		if err != nil {
+			log.Printf("Could not recover the staging area: %v", err)
+		} else if r.Orphaned > 0 {
+			log.Printf("Found %d staged values not in use: %d reattached, %d quarantined in %q.", r.Orphaned, r.Reattached, r.Quarantined, cfg.QuarantineDirectoryPath())
+		}
+	} else if err := tt.CountStaged(); err != nil {
+		log.Printf("Could not count the staged values: %v", err)
+	}
+
+	if errors.Is(sentinelErr, storage.ErrNotFound) {
+		// The local tree may be new, so the key is only vouched for if
+		// it decrypts what the remote store holds already, if anything.
+		tag, err := treeStore.RemoteTag(tree.DefaultBranch)
+		if err == nil && !tag.Pointer.IsNull() {
+			_, err = treeStore.LoadRevisionByKey(tag.Pointer)
+		}
+		if errors.Is(err, block.ErrAuthentication) {
+			log.Fatalf("Refusing to start, the encryption key in the configuration is not the one the remote store was written with: %v", err)
+		} else if err != nil {
+			log.Printf("Could not check the encryption key before writing the sentinel: %v", err)
+		} else if err := block.WriteSentinel(remoteBasicStore, cfg.EncryptionKeyBytes()); err != nil {
+			log.Printf("Could not write the encryption key sentinel: %v", err)
+		}
+	}
+
+	if err := loadKeepLocalRules(tt, cfg.KeepLocalFilePath()); err != nil {
+		log.Fatalf("Could not load keep-local rules: %v", err)
+	}
+
 	ops := &ops{
 		pairedStore: pairedStore,
 		treeStore:   treeStore,
 		tree:        tt,
 		cfg:         cfg,
+		slow:        cfg.SlowThreshold,
+		tracer:      tracer,
+		current:     current,
+		spans:       make(map[*srv.Req]*otlp.Span),
+		limits:      newRateLimits(cfg.RateLimitOps, cfg.RateLimitBytes),
+		sessions:    newSessions(),
+		quit:        sigc,
+		branch:      branch,
+		staging:     stagingDisk,
+		metrics:     metrics,
+		profile:     profile,
+		annotations: newAnnotations(cfg.AnnotationsDirectoryPath()),
+		failover:    failover,
 	}
+	if ops.pins, err = tree.NewPins(cfg.PinsDirectoryPath()); err != nil {
+		log.Fatalf("Could not set up pins: %v", err)
+	}
+	ops.setSnapshotFrequency(cfg.SnapshotFrequency)
+	ops.trace.resize(cfg.TraceRequests)
+	ops.trace.setSlow(cfg.SlowThreshold)
 
 	now := time.Now()
 	controlNode := &fsNode{
@@ -1003,19 +2393,43 @@ func main() {
 			},
 		},
 	}
+	ops.root.lookup = ops.lookupRevision
 	ops.root.children = append(ops.root.children, controlNode)
 
+	now = time.Now()
+	ops.root.children = append(ops.root.children, &fsNode{
+		kind:   syntheticDir,
+		lookup: ops.lookupTag,
+		dir: p.Dir{
+			Name:  "tags",
+			Mode:  p.DMDIR | 0555,
+			Uid:   p9util.NodeUID,
+			Gid:   p9util.NodeGID,
+			Atime: uint32(now.Unix()),
+			Mtime: uint32(now.Unix()),
+			Qid: p.Qid{
+				Type: p.QTDIR,
+				Path: uint64(now.UnixNano()),
+			},
+		},
+	})
+
 	live := ops.tree.Attach()
 	live.Ref()
 	ops.root.children = append(ops.root.children, &fsNode{kind: muscleNode, tree: ops.tree, Node: live})
 
+	var binds strings.Builder
+	ops.refreshBinds(&binds)
+	if binds.Len() > 0 {
+		log.Print(binds.String())
+	}
 	ops.root.prepareForReads()
 
 	fs := &srv.Srv{}
 	fs.Dotu = false
 	fs.Id = "muscle"
 	if *debug {
-		fs.Debuglevel = srv.DbgPrintFcalls
+		_ = ops.fcalls.set("on")
 	}
 	if !fs.Start(ops) {
 		log.Fatal("go9p/p/srv.Srv.Start returned false")
@@ -1024,37 +2438,110 @@ func main() {
 	go func() {
 		if listener, err := netutil.Listen(cfg.ListenNet, cfg.ListenAddr); err != nil {
 			log.Fatalf("Could not start net listener: %v", err)
-		} else if err := fs.StartListener(listener); err != nil {
+		} else if err := fs.StartListener(sessionListener{listener}); err != nil {
 			log.Fatalf("Could not start 9P listener: %v", err)
 		}
 	}()
 
+	go func() {
+		if err := ops.serveControlSocket(cfg.ControlSocketPath()); err != nil {
+			log.Printf("Could not serve the control socket: %v", err)
+		}
+	}()
+
 	// need to be flushed to the disk cache.
 	go func() {
 		for {
 			// This may interfere with fsdiff's crash inducing code!!!
 			// Adds non-determinism to the process.
-			time.Sleep(tree.SnapshotFrequency)
-			ops.mu.Lock()
-			if err := ops.tree.FlushIfNotDoneRecently(); err != nil {
+			time.Sleep(time.Duration(atomic.LoadInt64(&ops.snapshotFrequency)))
+			ops.lock(nil)
+			span := ops.tracer.Start("flush.periodic", nil)
+			before := ops.tree.LastFlushStats()
+			done, ok := ops.tree.StartFlush()
+			ops.unlock()
+			if !ok {
+				span.End()
+				continue
+			}
+			// Writes keep being served while the frozen changes
+			// are written to the staging area.
+			<-done
+			ops.lock(nil)
+			ops.current.Set(span)
+			if err := ops.tree.FinishFlush(); err != nil {
+				span.SetError(err)
 				log.Printf("Could not flush: %v", err)
+			} else if after := ops.tree.LastFlushStats(); after.Started != before.Started && after.Nodes > 0 {
+				log.Printf("Periodic flush: %v", after)
 			}
-			ops.mu.Unlock()
+			span.End()
+			ops.unlock()
+			_ = ops.checkStaging()
 		}
 	}()
 
+	go monitorBacklog(pairedStore, cfg)
+	go ops.heartbeats(cfg.HeartbeatInterval)
+
+	if cfg.MirrorListenAddr != "" {
+		go func() {
+			log.Printf("Serving cached blocks on %q.", cfg.MirrorListenAddr)
+			if err := http.ListenAndServe(cfg.MirrorListenAddr, storage.MirrorHandler(cacheDisk, cfg.MirrorToken)); err != nil {
+				log.Printf("Could not serve cached blocks: %v", err)
+			}
+		}()
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			if err := metrics.Save(cfg.MetricsFilePath()); err != nil {
+				log.Printf("Could not save metrics: %v", err)
+			}
+		}
+	}()
+
+	if cfg.IdleTimeout > 0 {
+		go ops.sessions.reapIdle(cfg.IdleTimeout)
+	}
+
 	log.Print("Awaiting a signal to flush and exit.")
 	for sig := range sigc {
+		if sig == syscall.SIGQUIT {
+			pathname, locked, err := ops.dumpState()
+			if err != nil {
+				log.Printf("Could not dump state: %v", err)
+			} else {
+				log.Printf("Dumped state to %q.", pathname)
+			}
+			if !locked {
+				// Flushing would hang too.
+				log.Print("Exiting without flushing, the tree lock is held.")
+				os.Exit(2)
+			}
+			ops.unlock()
+		}
 		log.Printf("Got signal %q, flushing before exiting.", sig)
-		ops.mu.Lock()
+		ops.lock(nil)
 		if err := tt.Flush(); err != nil {
 			log.Printf("Flushing failed, won't quit: %+v", err)
-			ops.mu.Unlock()
+			ops.unlock()
 			continue
 		}
 		log.Print("Flushed, quitting.")
-		ops.mu.Unlock()
+		ops.unlock()
 		break
 	}
+	if err := ops.pins.Release(); err != nil {
+		log.Printf("Could not release pins: %v", err)
+	}
+	if err := metrics.Save(cfg.MetricsFilePath()); err != nil {
+		log.Printf("Could not save metrics: %v", err)
+	}
+	ops.saveReadOrder()
+	if err := sb.remove(); err != nil {
+		log.Printf("Could not remove sandbox: %v", err)
+	}
 	agent.Close()
 }
@@ -3,15 +3,18 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/lionkov/go9p/p"
 	"github.com/lionkov/go9p/p/clnt"
+	"github.com/lionkov/go9p/p/srv"
 	"github.com/nicolagi/muscle/internal/block"
 	"github.com/nicolagi/muscle/internal/config"
 	"github.com/nicolagi/muscle/internal/netutil"
@@ -94,7 +97,55 @@ func TestConformsToManualPages(t *testing.T) {
 		assert.Equal(t, "live", dir.Name)
 	})
 	t.Run("walk to . from dir gives dir", func(t *testing.T) {
-		// TODO
+		client, _, tearDown := setUp(t)
+		defer tearDown(t)
+		must := &mustHelpers{t: t, c: client}
+
+		fid := must.walk("live")
+		newfid := client.FidAlloc()
+		qids, err := client.Walk(fid, newfid, []string{"."})
+		require.Nil(t, err)
+		require.Len(t, qids, 1)
+
+		dir, err := client.Stat(newfid)
+		require.Nil(t, err)
+		assert.Equal(t, "live", dir.Name)
+	})
+	t.Run("walk to .. from tree root gives server root", func(t *testing.T) {
+		client, _, tearDown := setUp(t)
+		defer tearDown(t)
+		must := &mustHelpers{t: t, c: client}
+
+		fid := must.walk("live")
+		newfid := client.FidAlloc()
+		qids, err := client.Walk(fid, newfid, []string{"tmp", "..", ".."})
+		require.Nil(t, err)
+		require.Len(t, qids, 3)
+
+		dir, err := client.Stat(newfid)
+		require.Nil(t, err)
+		assert.Equal(t, "muscle", dir.Name)
+	})
+	// From walk(5):
+	// If the first element cannot be walked for any reason, Rerror is returned. Otherwise, the walk will return
+	// an Rwalk message containing nwqid qids corresponding, in order, to the files that are visited by the nwqid
+	// successful elementwise walks; nwqid is therefore either nwname or the index of the first elementwise walk
+	// that failed.
+	t.Run("walk returns partial qids if an element other than the first fails", func(t *testing.T) {
+		client, _, tearDown := setUp(t)
+		defer tearDown(t)
+
+		newfid := client.FidAlloc()
+		qids, err := client.Walk(client.Root, newfid, []string{"live", "tmp", "missing", "more"})
+		require.Nil(t, err)
+		require.Len(t, qids, 2)
+
+		qids, err = client.Walk(client.Root, newfid, []string{"ctl", "file"})
+		require.Nil(t, err)
+		require.Len(t, qids, 1)
+
+		_, err = client.Walk(client.Root, newfid, []string{"missing", "tmp"})
+		require.NotNil(t, err)
 	})
 }
 
@@ -123,6 +174,143 @@ func Test(t *testing.T) {
 		// let's check that we can still walk to the control file.
 		must.clunk(must.walk("ctl"))
 	})
+	t.Run("remote tags can be browsed by name", func(t *testing.T) {
+		must := &mustHelpers{t: t, c: client}
+
+		fid := must.walk("live")
+		must.create(fid, "pushed", 0600, p.OWRITE)
+		must.write(fid, []byte("as pushed"))
+		must.clunk(fid)
+		fid = must.walk("ctl")
+		must.open(fid, p.OWRITE)
+		must.write(fid, []byte("push"))
+		must.clunk(fid)
+
+		fid = must.walk("tags", "base", "pushed")
+		must.open(fid, p.OREAD)
+		if got, want := string(must.read(fid, 0, 8192)), "as pushed"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		must.clunk(fid)
+		if qids, err := client.Walk(client.Root, client.FidAlloc(), []string{"tags", "nonexistent"}); err == nil && len(qids) == 2 {
+			t.Error("no error walking to a nonexistent tag")
+		}
+
+		// Nothing changed since, so pushing again creates no revision.
+		fid = must.walk("ctl")
+		must.open(fid, p.ORDWR)
+		must.write(fid, []byte("push"))
+		if got := string(must.read(fid, 0, 8192)); !strings.Contains(got, "no revision created") {
+			t.Errorf("got %q, want a push creating no revision", got)
+		}
+		must.clunk(fid)
+
+		// Still nothing changed, but a new tag must be moved.
+		fid = must.walk("ctl")
+		must.open(fid, p.ORDWR)
+		must.write(fid, []byte("push extra"))
+		if got := string(must.read(fid, 0, 8192)); !strings.Contains(got, "updated remote tags") {
+			t.Errorf("got %q, want a push updating the tags", got)
+		}
+		must.clunk(fid)
+		fid = must.walk("tags", "extra", "pushed")
+		must.open(fid, p.OREAD)
+		if got, want := string(must.read(fid, 0, 8192)), "as pushed"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		must.clunk(fid)
+	})
+	t.Run("copy from a tag and from the live tree via control file", func(t *testing.T) {
+		must := &mustHelpers{t: t, c: client}
+
+		fid := must.walk("live")
+		must.create(fid, "copy-source", 0700|p.DMDIR, 0)
+		must.clunk(fid)
+		fid = must.walk("live", "copy-source")
+		must.create(fid, "f", 0600, p.OWRITE)
+		must.write(fid, []byte("as pushed"))
+		must.clunk(fid)
+		fid = must.walk("ctl")
+		must.open(fid, p.OWRITE)
+		must.write(fid, []byte("push"))
+		must.clunk(fid)
+		fid = must.walk("live", "copy-source", "f")
+		must.open(fid, p.OWRITE|p.OTRUNC)
+		must.write(fid, []byte("as changed"))
+		must.clunk(fid)
+
+		fid = must.walk("ctl")
+		must.open(fid, p.OWRITE)
+		must.write(fid, []byte("copy-from tags/base/copy-source copy-of-tag\n"))
+		must.clunk(fid)
+		fid = must.walk("ctl")
+		must.open(fid, p.OWRITE)
+		must.write(fid, []byte("copy-from live/copy-source copy-of-live\n"))
+		must.clunk(fid)
+
+		if got, want := must.readFile("copy-of-tag", "f"), "as pushed"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if got, want := must.readFile("copy-of-live", "f"), "as changed"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		// Copies are independent of their source.
+		fid = must.walk("live", "copy-of-live", "f")
+		must.open(fid, p.OWRITE|p.OTRUNC)
+		must.write(fid, []byte("copy changed"))
+		must.clunk(fid)
+		if got, want := must.readFile("copy-source", "f"), "as changed"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+	t.Run("commands with a token run once", func(t *testing.T) {
+		must := &mustHelpers{t: t, c: client}
+
+		fid := must.walk("live")
+		must.create(fid, "once-source", 0700|p.DMDIR, 0)
+		must.clunk(fid)
+		command := []byte("once t1 copy-from live/once-source once-copy")
+		for i := 0; i < 2; i++ {
+			// Without the token, the second copy would fail, as the
+			// target exists.
+			fid = must.walk("ctl")
+			must.open(fid, p.ORDWR)
+			must.write(fid, command)
+			if got, want := string(must.read(fid, 0, 8192)), "copied live/once-source to once-copy\n"; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			must.clunk(fid)
+		}
+		fid = must.walk("ctl")
+		must.open(fid, p.OWRITE)
+		if _, err := client.Write(fid, []byte("once t1 copy-from live/once-source other-copy"), 0); err == nil {
+			t.Error("reused a token for another command")
+		}
+		must.clunk(fid)
+	})
+	t.Run("bound tag is updated on pull", func(t *testing.T) {
+		must := &mustHelpers{t: t, c: client}
+
+		// Created on pull, since the tag didn't exist at startup.
+		if qids, err := client.Walk(client.Root, client.FidAlloc(), []string{"bound"}); err == nil && len(qids) == 1 {
+			t.Error("bound directory exists before pull")
+		}
+		fid := must.walk("ctl")
+		must.open(fid, p.OWRITE)
+		must.write(fid, []byte("pull"))
+		must.clunk(fid)
+		fid = must.walk("bound", "pushed")
+		must.open(fid, p.OREAD)
+		if got, want := string(must.read(fid, 0, 8192)), "as pushed"; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		must.clunk(fid)
+		fid = must.walk("bound")
+		if err := client.Create(fid, "new", 0600, p.OWRITE, ""); err == nil {
+			t.Error("created a file in the bound directory")
+		}
+		must.clunk(fid)
+	})
 	t.Run("try to change dir length and fail", func(t *testing.T) {
 		must := &mustHelpers{t: t, c: client}
 
@@ -165,6 +353,47 @@ func Test(t *testing.T) {
 			t.Fatalf("got %q, want %q", got, "hello world")
 		}
 	})
+	t.Run("script is rolled back if a command fails", func(t *testing.T) {
+		must := &mustHelpers{t: t, c: client}
+		fid := must.walk("live")
+		must.create(fid, "script-old", 0700|p.DMDIR, 0)
+		must.clunk(fid)
+
+		fid = must.walk("ctl")
+		must.open(fid, p.OWRITE)
+		cmd := []byte("script\nrename script-old script-new\nunlink script-missing\n")
+		_, err := must.c.Write(fid, cmd, 0)
+		assert.NotNil(t, err)
+		must.clunk(fid)
+
+		must.clunk(must.walk("live", "script-old"))
+		must.notExist("script-new")
+	})
+	t.Run("script is rolled back while other files are open", func(t *testing.T) {
+		must := &mustHelpers{t: t, c: client}
+		open := must.walk("live")
+		must.create(open, "script-open", 0600, p.OWRITE)
+		defer must.clunk(open)
+
+		fid := must.walk("ctl")
+		must.open(fid, p.OWRITE)
+		cmd := []byte("script\nrename script-old script-new\nunlink script-missing\n")
+		_, err := must.c.Write(fid, cmd, 0)
+		assert.NotNil(t, err)
+		must.clunk(fid)
+		must.clunk(must.walk("live", "script-old"))
+		must.notExist("script-new")
+
+		// Nothing is run if what would be rolled back is open.
+		fid = must.walk("ctl")
+		must.open(fid, p.OWRITE)
+		cmd = []byte("script\nrename script-old script-new\nunlink script-open\n")
+		_, err = must.c.Write(fid, cmd, 0)
+		assert.NotNil(t, err)
+		must.clunk(fid)
+		must.clunk(must.walk("live", "script-old"))
+		must.notExist("script-new")
+	})
 	// There used to be a bug where if you did a graft with a command like "graft revision:music music" and "music/song" is
 	// currently open, any changes to the "music/song" are silently lost. This is how the scenario used to play out:
 	// 1. root -> music -> song is the initial in-memory state
@@ -227,6 +456,35 @@ func Test(t *testing.T) {
 		// Finally verify that the song was NOT lost.
 		must.walk("live", "music", "song")
 	})
+	t.Run("a new directory listing sees entries created after open", func(t *testing.T) {
+		must := &mustHelpers{t: t, c: client}
+
+		fid := must.walk("live")
+		must.create(fid, "listing", 0700|p.DMDIR, 0)
+		must.clunk(fid)
+
+		countEntries := func(b []byte) int {
+			n := 0
+			for len(b) > 0 {
+				_, rest, _, err := p.UnpackDir(b, false)
+				require.Nil(t, err)
+				b = rest
+				n++
+			}
+			return n
+		}
+
+		dirfid := must.walk("live", "listing")
+		must.open(dirfid, p.OREAD)
+		assert.Equal(t, 0, countEntries(must.read(dirfid, 0, 8192)))
+
+		fid = must.walk("live", "listing")
+		must.create(fid, "file", 0600, p.OWRITE)
+		must.clunk(fid)
+
+		assert.Equal(t, 1, countEntries(must.read(dirfid, 0, 8192)))
+		must.clunk(dirfid)
+	})
 	t.Run("creating or removing a file updates the directory timestamp", func(t *testing.T) {
 		must := &mustHelpers{t: t, c: client}
 
@@ -296,7 +554,19 @@ func setUp(t *testing.T) (client *clnt.Clnt, store *tree.Store, tearDown func(*t
 	}
 	t.Logf("The temporary directory is at %q", dir)
 
-	if err := config.Initialize(dir); err != nil {
+	if err := config.Initialize(dir, "memory"); err != nil {
+		t.Fatal(err)
+	}
+	// Shows the base tag as "bound", see the bind test.
+	f, err := os.OpenFile(path.Join(dir, "config"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString("bind base bound\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
 		t.Fatal(err)
 	}
 	c, err := config.Load(dir)
@@ -373,6 +643,28 @@ func setUp(t *testing.T) (client *clnt.Clnt, store *tree.Store, tearDown func(*t
 	}
 }
 
+// setUpTree is the in-process counterpart of setUp: it returns a
+// mutable tree backed by in-memory stores, with the tree store and
+// block factory it uses, and no musclefs server.
+func setUpTree(t *testing.T) (lt *tree.Tree, store *tree.Store, factory *block.Factory) {
+	t.Helper()
+	key := make([]byte, 16)
+	rand.Read(key)
+	factory, err := block.NewFactory(&storage.InMemory{}, &storage.InMemory{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err = tree.NewStore(factory, nil, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt, err = tree.NewTree(store, tree.WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lt, store, factory
+}
+
 type mustHelpers struct {
 	t *testing.T
 	c *clnt.Clnt
@@ -470,3 +762,34 @@ func (m *mustHelpers) readFile(names ...string) string {
 	m.clunk(fid)
 	return string(b)
 }
+
+// A client disconnecting without clunking a fid open for writing ends
+// the write session all the same, so that the next one bumps the
+// version again.
+func TestConnClosedEndsWriteSession(t *testing.T) {
+	lt, _, _ := setUpTree(t)
+	_, root := lt.Root()
+	node, err := lt.Add(root, "f", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := node.Info().Version
+	node.Ref()
+	ops := &ops{cfg: &config.C{}, sessions: newSessions()}
+	c := &srv.Conn{Fidpool: make(map[uint32]*srv.Fid)}
+	ops.ConnOpened(c)
+	fid := &srv.Fid{Fconn: c, Omode: p.ORDWR, Aux: &fsNode{kind: muscleNode, tree: lt, Node: node}}
+	c.Fidpool[1] = fid
+	if err := node.WriteAt([]byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	ops.ConnClosed(c)
+	// What go9p does next, which must not end the write session again.
+	ops.FidDestroy(fid)
+	if err := node.WriteAt([]byte("b"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := node.Info().Version, version+2; got != want {
+		t.Errorf("got version %d, want %d", got, want)
+	}
+}
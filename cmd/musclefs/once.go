@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nicolagi/muscle/internal/debug"
+	"github.com/nicolagi/muscle/internal/linuxerr"
+)
+
+// How many tokens of commands run once are remembered, see runOnce.
+const onceWindow = 64
+
+// onceRuns remembers the outcomes of the latest commands run once, so
+// that they can be replayed. Accessed under the ops lock.
+type onceRuns struct {
+	runs  map[string]*onceRun
+	order []string // Oldest first.
+}
+
+type onceRun struct {
+	command string
+	done    chan struct{} // Closed once output and err are set.
+	output  []byte
+	err     error
+}
+
+// splitOnce splits a command prefixed with "once TOKEN" into the token
+// and the command, or returns false if the command isn't prefixed.
+func splitOnce(line string) (token string, command string, ok bool) {
+	fields := strings.SplitN(strings.TrimLeft(line, " \t"), " ", 3)
+	if len(fields) != 3 || fields[0] != "once" || fields[1] == "" {
+		return "", "", false
+	}
+	return fields[1], fields[2], true
+}
+
+// runOnce runs the command, which may be a script or invoke an alias,
+// unless one with the same token was run recently, in which case its
+// output and outcome are replayed instead. That way, a client retrying
+// a write to the control file after a timeout, e.g., of a script of
+// grafts and unlinks, can't have it applied twice. The run is recorded
+// before the command starts, because some commands, e.g., push and
+// sync -remote, release the ops lock while they wait; a retry arriving
+// meanwhile waits for the outcome. Tokens are chosen by clients, e.g.,
+// at random, and must not be reused for another command.
+func (ops *ops) runOnce(controlNode *fsNode, token string, command string) error {
+	if run, ok := ops.once.runs[token]; ok {
+		if run.command != command {
+			return fmt.Errorf("token %q was used for another command: %w", token, linuxerr.EINVAL)
+		}
+		select {
+		case <-run.done:
+		default:
+			debug.Logf(debug.Info, "Waiting for the command with token %q to complete.", token)
+			ops.unlock()
+			<-run.done
+			ops.lock(nil)
+		}
+		debug.Logf(debug.Info, "Replaying the outcome of the command with token %q.", token)
+		controlNode.data = append([]byte(nil), run.output...)
+		controlNode.dir.Length = uint64(len(controlNode.data))
+		return run.err
+	}
+	if ops.once.runs == nil {
+		ops.once.runs = make(map[string]*onceRun)
+	}
+	for len(ops.once.order) >= onceWindow {
+		delete(ops.once.runs, ops.once.order[0])
+		ops.once.order = ops.once.order[1:]
+	}
+	run := &onceRun{command: command, done: make(chan struct{})}
+	ops.once.runs[token] = run
+	ops.once.order = append(ops.once.order, token)
+	run.err = runControl(ops, controlNode, command)
+	run.output = append([]byte(nil), controlNode.data...)
+	close(run.done)
+	return run.err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// prefetchDirs loads the directories of the live tree down to the given
+// depth, so that their metadata is in the cache by the time a client
+// lists them, e.g., right after mounting on a host whose cache is cold.
+// The directories are loaded into a tree of their own, without holding
+// the tree lock, so clients aren't kept waiting. Only one prefetch runs
+// at a time.
+func (ops *ops) prefetchDirs(depth int) {
+	if depth <= 0 || !atomic.CompareAndSwapInt32(&ops.prefetching, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&ops.prefetching, 0)
+	ops.lock(nil)
+	_, root := ops.tree.Root()
+	pointer := root.Pointer()
+	ops.unlock()
+	if pointer.IsNull() {
+		return
+	}
+	start := time.Now()
+	t, err := tree.NewTree(ops.treeStore, tree.WithRoot(pointer))
+	if err != nil {
+		log.Printf("Could not prefetch directories: %v", err)
+		return
+	}
+	dirs, err := prefetchTree(t, depth)
+	if err != nil {
+		log.Printf("Could not prefetch all directories: %v", err)
+	}
+	log.Printf("Prefetched %d directories, %d levels deep, in %v.", dirs, depth, time.Since(start))
+}
+
+// prefetchTree grows the directories of the tree level by level, down
+// to the given depth, returning how many it grew and the first error,
+// if any: directories that fail to load are skipped.
+func prefetchTree(t *tree.Tree, depth int) (dirs int, err error) {
+	level := []*tree.Node{t.Attach()}
+	for ; depth > 0 && len(level) > 0; depth-- {
+		var next []*tree.Node
+		for _, dir := range level {
+			if gerr := t.Grow(dir); gerr != nil && err == nil {
+				err = gerr
+			}
+			dirs++
+			for _, child := range dir.Children() {
+				if child.IsDir() {
+					next = append(next, child)
+				}
+			}
+		}
+		level = next
+	}
+	return dirs, err
+}
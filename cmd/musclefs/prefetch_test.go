@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+func TestPrefetchTree(t *testing.T) {
+	lt, store, _ := setUpTree(t)
+	// Creates root/a/b/c and root/a/f.
+	_, parent := lt.Root()
+	var err error
+	for _, name := range []string{"a", "b", "c"} {
+		if parent, err = lt.Add(parent, name, 0700|tree.DMDIR); err != nil {
+			t.Fatal(err)
+		}
+		if name == "a" {
+			if _, err := lt.Add(parent, "f", 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := lt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	_, root := lt.Root()
+	for depth, want := range []int{0, 1, 2, 3, 4, 4} {
+		cold, err := tree.NewTree(store, tree.WithRoot(root.Pointer()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := prefetchTree(cold, depth); err != nil || got != want {
+			t.Errorf("depth %d: got %d, %v, want %d directories", depth, got, err, want)
+		}
+	}
+}
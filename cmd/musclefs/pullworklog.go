@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// A pullWorklog holds the commands a pull runs automatically to merge
+// a remote revision, and which of them completed. It is persisted, so
+// that a pull that is interrupted, e.g., by musclefs stopping, resumes
+// where it stopped instead of merging again against a local tree that
+// is half way through the merge.
+//
+// The file starts with a line "remote HEX" and a line "cmd COMMAND"
+// per command, written at once, followed by a line "done INDEX" per
+// completed command, appended as they complete.
+type pullWorklog struct {
+	pathname string
+	remote   storage.Pointer
+	commands []string
+	done     []bool
+}
+
+// loadPullWorklog reads the worklog persisted at pathname. A missing
+// file means there is no pull in progress, and nil is returned.
+func loadPullWorklog(pathname string) (*pullWorklog, error) {
+	const method = "loadPullWorklog"
+	f, err := os.Open(pathname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errorv(method, err)
+	}
+	defer func() { _ = f.Close() }()
+	w := &pullWorklog{pathname: pathname}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var verb, arg string
+		if fields := strings.SplitN(s.Text(), " ", 2); len(fields) == 2 {
+			verb, arg = fields[0], fields[1]
+		}
+		switch verb {
+		case "remote":
+			if w.remote, err = storage.NewPointerFromHex(arg); err != nil {
+				return nil, errorf(method, "line %q: %v", s.Text(), err)
+			}
+		case "cmd":
+			w.commands = append(w.commands, arg)
+			w.done = append(w.done, false)
+		case "done":
+			i, err := strconv.Atoi(arg)
+			if err != nil || i < 0 || i >= len(w.done) {
+				return nil, errorf(method, "malformed line %q", s.Text())
+			}
+			w.done[i] = true
+		default:
+			return nil, errorf(method, "malformed line %q", s.Text())
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errorv(method, err)
+	}
+	if w.remote == nil {
+		return nil, errorf(method, "%s: no remote revision", pathname)
+	}
+	return w, nil
+}
+
+// newPullWorklog persists a worklog for merging the remote revision by
+// running the given commands, replacing any previous one.
+func newPullWorklog(pathname string, remote storage.Pointer, commands []string) (*pullWorklog, error) {
+	const method = "newPullWorklog"
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "remote %s\n", remote.Hex())
+	for _, c := range commands {
+		_, _ = fmt.Fprintf(&b, "cmd %s\n", c)
+	}
+	// Write it whole or not at all, or a crash could leave a
+	// worklog with only some of the commands.
+	temp := pathname + ".new"
+	if err := ioutil.WriteFile(temp, []byte(b.String()), 0600); err != nil {
+		return nil, errorv(method, err)
+	}
+	if err := os.Rename(temp, pathname); err != nil {
+		return nil, errorv(method, err)
+	}
+	return &pullWorklog{
+		pathname: pathname,
+		remote:   remote,
+		commands: commands,
+		done:     make([]bool, len(commands)),
+	}, nil
+}
+
+// pending returns the indexes of the commands yet to complete.
+func (w *pullWorklog) pending() (indexes []int) {
+	for i, done := range w.done {
+		if !done {
+			indexes = append(indexes, i)
+		}
+	}
+	return
+}
+
+// markDone records that the commands with the given indexes completed.
+// Only call it once their effects are persisted, i.e., after flushing
+// the tree.
+func (w *pullWorklog) markDone(indexes []int) error {
+	const method = "pullWorklog.markDone"
+	if len(indexes) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	for _, i := range indexes {
+		_, _ = fmt.Fprintf(&b, "done %d\n", i)
+	}
+	f, err := os.OpenFile(w.pathname, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errorv(method, err)
+	}
+	_, werr := f.WriteString(b.String())
+	if err := f.Close(); err != nil {
+		return errorv(method, err)
+	}
+	if werr != nil {
+		return errorv(method, werr)
+	}
+	for _, i := range indexes {
+		w.done[i] = true
+	}
+	return nil
+}
+
+// remove deletes the persisted worklog, once the pull it's for is over.
+func (w *pullWorklog) remove() error {
+	if err := os.Remove(w.pathname); err != nil && !os.IsNotExist(err) {
+		return errorv("pullWorklog.remove", err)
+	}
+	return nil
+}
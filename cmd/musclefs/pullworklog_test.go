@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestPullWorklog(t *testing.T) {
+	pathname := filepath.Join(t.TempDir(), "pull.worklog")
+	if w, err := loadPullWorklog(pathname); w != nil || err != nil {
+		t.Fatalf("got %v, %v, want no worklog", w, err)
+	}
+	remote := storage.RandomPointer()
+	commands := []string{"graft2 abc/a a", "unlink b", "graft2 abc/c d/c"}
+	w, err := newPullWorklog(pathname, remote, commands)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.markDone([]int{0, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// As if resuming after a restart.
+	w, err = loadPullWorklog(pathname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.remote.Equals(remote) {
+		t.Errorf("got remote %v, want %v", w.remote, remote)
+	}
+	if !reflect.DeepEqual(w.commands, commands) {
+		t.Errorf("got %q, want %q", w.commands, commands)
+	}
+	if got := w.pending(); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("got pending %v, want [1]", got)
+	}
+
+	// A new worklog replaces the old one.
+	if w, err = newPullWorklog(pathname, remote, commands[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if w, err = loadPullWorklog(pathname); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.pending(); !reflect.DeepEqual(got, []int{0}) {
+		t.Errorf("got pending %v, want [0]", got)
+	}
+
+	if err := w.remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pathname); !os.IsNotExist(err) {
+		t.Errorf("got %v, want the worklog removed", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+// tokenBucket allows rate units per second on average, with bursts of
+// up to one second worth of units. Requests larger than the burst are
+// allowed and repaid by the following ones.
+type tokenBucket struct {
+	rate   float64 // Zero or negative means unlimited.
+	tokens float64 // Negative when in debt.
+	last   time.Time
+}
+
+// take takes n units at the given time and returns how long the caller
+// must wait before using them.
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	if b.last.IsZero() {
+		b.tokens = b.rate
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// connLimiter limits the requests of a single connection.
+type connLimiter struct {
+	mu    sync.Mutex
+	ops   tokenBucket
+	bytes tokenBucket
+}
+
+// delay returns how long to wait before processing the request.
+func (l *connLimiter) delay(r *srv.Req, now time.Time) time.Duration {
+	var n int
+	switch r.Tc.Type {
+	case p.Tversion, p.Tflush:
+		// Never delay version negotiation and aborting requests.
+		return 0
+	case p.Tread:
+		n = int(r.Tc.Count)
+	case p.Twrite:
+		n = len(r.Tc.Data)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d := l.ops.take(1, now)
+	if bd := l.bytes.take(float64(n), now); bd > d {
+		d = bd
+	}
+	return d
+}
+
+// rateLimits holds a limiter per connection. A nil *rateLimits limits
+// nothing.
+type rateLimits struct {
+	ops   float64
+	bytes float64
+
+	mu    sync.Mutex
+	conns map[*srv.Conn]*connLimiter
+}
+
+// newRateLimits returns nil if neither limit is positive.
+func newRateLimits(opsPerSec, bytesPerSec int) *rateLimits {
+	if opsPerSec <= 0 && bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimits{
+		ops:   float64(opsPerSec),
+		bytes: float64(bytesPerSec),
+		conns: make(map[*srv.Conn]*connLimiter),
+	}
+}
+
+func (rl *rateLimits) open(c *srv.Conn) {
+	if rl == nil {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.conns[c] = &connLimiter{
+		ops:   tokenBucket{rate: rl.ops},
+		bytes: tokenBucket{rate: rl.bytes},
+	}
+}
+
+func (rl *rateLimits) close(c *srv.Conn) {
+	if rl == nil {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	delete(rl.conns, c)
+}
+
+// wait blocks until the request's connection is within its limits.
+func (rl *rateLimits) wait(r *srv.Req) {
+	if rl == nil {
+		return
+	}
+	rl.mu.Lock()
+	l := rl.conns[r.Conn]
+	rl.mu.Unlock()
+	if l == nil {
+		return
+	}
+	if d := l.delay(r, time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
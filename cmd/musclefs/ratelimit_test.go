@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := tokenBucket{rate: 10}
+	for i := 0; i < 10; i++ {
+		if d := b.take(1, now); d != 0 {
+			t.Fatalf("take %d: got delay %v within the burst", i, d)
+		}
+	}
+	if got, want := b.take(1, now), 100*time.Millisecond; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// After a second, the debt is repaid and there are 9 tokens.
+	now = now.Add(time.Second)
+	if got, want := b.take(19, now), time.Second; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Idle time does not accumulate more than one second of tokens.
+	now = now.Add(time.Hour)
+	if got := b.take(10, now); got != 0 {
+		t.Errorf("got %v, want no delay", got)
+	}
+	if got := b.take(1, now); got == 0 {
+		t.Error("got no delay after the burst")
+	}
+
+	unlimited := tokenBucket{}
+	if got := unlimited.take(1e9, now); got != 0 {
+		t.Errorf("got %v, want no delay", got)
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	if newRateLimits(0, 0) != nil {
+		t.Error("got limits when both are disabled")
+	}
+	l := connLimiter{
+		ops:   tokenBucket{rate: 100},
+		bytes: tokenBucket{rate: 1000},
+	}
+	now := time.Now()
+	req := func(typ uint8, count uint32) *srv.Req {
+		return &srv.Req{Tc: &p.Fcall{Type: typ, Count: count}}
+	}
+	if d := l.delay(req(p.Tread, 1000), now); d != 0 {
+		t.Errorf("got %v, want no delay", d)
+	}
+	if got, want := l.delay(req(p.Tread, 500), now), 500*time.Millisecond; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if d := l.delay(req(p.Tflush, 0), now); d != 0 {
+		t.Errorf("got %v for flush, want no delay", d)
+	}
+}
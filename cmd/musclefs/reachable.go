@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// reachable writes to the file at pathname, by default in the base
+// directory, the keys needed by the live tree, the
+// latest count revisions of each of the tags, and the pinned
+// revisions, for "muscle clean -needed". Unlike "muscle reachable",
+// it walks the tree musclefs has, flushed, so that it includes the
+// changes not pushed yet, and doesn't load from storage the nodes it
+// has in memory. The tree lock is only held to flush and collect the
+// keys of those; the nodes not loaded, and the retained revisions, are
+// loaded without it, so clients aren't kept waiting on storage.
+func (ops *ops) reachable(w io.Writer, tagNames []string, count int, pathname string) error {
+	const method = "reachable"
+	if pathname == "" {
+		pathname = ops.cfg.ReachableFilePath()
+	}
+	// Flushed, the live tree matches the local root clean starts from.
+	if err := ops.tree.Flush(); err != nil {
+		return errorv(method, err)
+	}
+	revision, _ := ops.tree.Root()
+	needed := make(map[string]struct{})
+	if !revision.IsNull() {
+		needed[revision.Hex()] = struct{}{}
+	}
+	unloaded := ops.tree.LoadedKeys(needed)
+	ops.unlock()
+	defer ops.lock(nil)
+	if err := ops.treeStore.AddReachableKeys(unloaded, needed); err != nil {
+		return errorv(method, err)
+	}
+	pinned, err := tree.PinnedRevisions(ops.cfg.PinsDirectoryPath())
+	if err != nil {
+		return errorv(method, err)
+	}
+	if err := ops.treeStore.AddRetainedKeys(needed, tagNames, count, pinned); err != nil {
+		return errorv(method, err)
+	}
+	if err := writeKeys(pathname, needed); err != nil {
+		return errorv(method, err)
+	}
+	_, _ = fmt.Fprintf(w, "%d keys written to %s\n", len(needed), pathname)
+	return nil
+}
+
+// writeKeys atomically replaces the file at pathname with the keys,
+// sorted, one per line.
+func writeKeys(pathname string, keys map[string]struct{}) error {
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	var buf bytes.Buffer
+	for _, k := range sorted {
+		buf.WriteString(k)
+		buf.WriteByte('\n')
+	}
+	if err := ioutil.WriteFile(pathname+".new", buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(pathname+".new", pathname)
+}
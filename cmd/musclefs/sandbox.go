@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/nicolagi/muscle/internal/config"
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// Files in the base directory not copied to a sandbox: the sandbox
+// must not propagate the real tree's pending blocks, and its metrics
+// are its own.
+var sandboxSkip = map[string]bool{
+	"metrics":         true,
+	"propagation.log": true,
+}
+
+// sandbox lets musclefs serve the real tree while keeping all changes
+// in a temporary directory, so that commands such as pull or graft can
+// be rehearsed against production data. The real base directory, cache
+// and staging area, and the remote store are only read.
+type sandbox struct {
+	dir  string
+	real *config.C
+}
+
+// newSandbox creates a temporary base directory with copies of the
+// files in the real one, e.g., those holding the local root and
+// branch, and returns it with the configuration rebased on it.
+func newSandbox(real *config.C, base string) (*sandbox, *config.C, error) {
+	const method = "newSandbox"
+	dir, err := ioutil.TempDir("", "musclefs-sandbox")
+	if err != nil {
+		return nil, nil, errorf(method, "%v", err)
+	}
+	sb := &sandbox{dir: dir, real: real}
+	entries, err := ioutil.ReadDir(base)
+	if err != nil {
+		_ = sb.remove()
+		return nil, nil, errorf(method, "%v", err)
+	}
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || sandboxSkip[e.Name()] {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(base, e.Name()))
+		if err != nil {
+			_ = sb.remove()
+			return nil, nil, errorf(method, "%v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, e.Name()), b, e.Mode().Perm()); err != nil {
+			_ = sb.remove()
+			return nil, nil, errorf(method, "%v", err)
+		}
+	}
+	return sb, real.Rebase(dir), nil
+}
+
+// remote returns the remote store as seen from the sandbox, if any.
+func (sb *sandbox) remote(store storage.Store) storage.Store {
+	if sb == nil {
+		return store
+	}
+	return storage.Overlay(storage.NewDiskStore(filepath.Join(sb.dir, "remote")), storage.ReadOnly(store))
+}
+
+// staging returns the sandbox staging area over the real one, if in
+// a sandbox, since the real tree's unsealed blocks are there.
+func (sb *sandbox) staging(store storage.Store) storage.Store {
+	if sb == nil {
+		return store
+	}
+	return storage.Overlay(store, storage.ReadOnly(storage.NewDiskStore(sb.real.StagingDirectoryPath())))
+}
+
+// cache returns the sandbox cache over the real one, if in a sandbox.
+func (sb *sandbox) cache(store storage.Store) storage.Store {
+	if sb == nil {
+		return store
+	}
+	return storage.Overlay(store, storage.ReadOnly(storage.NewDiskStore(sb.real.CacheDirectoryPath())))
+}
+
+// remove discards the changes made in the sandbox, if any.
+func (sb *sandbox) remove() error {
+	if sb == nil {
+		return nil
+	}
+	return os.RemoveAll(sb.dir)
+}
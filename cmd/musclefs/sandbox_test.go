@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/config"
+	"github.com/nicolagi/muscle/internal/storage"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+func TestNewSandbox(t *testing.T) {
+	base := t.TempDir()
+	if err := config.Initialize(base, "memory"); err != nil {
+		t.Fatal(err)
+	}
+	real, err := config.Load(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"root", "branch", "propagation.log"} {
+		if err := ioutil.WriteFile(filepath.Join(base, name), []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sb, cfg, err := newSandbox(real, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = sb.remove() }()
+	for _, name := range []string{"root", "branch"} {
+		if b, err := ioutil.ReadFile(filepath.Join(sb.dir, name)); err != nil || string(b) != name {
+			t.Errorf("%s: got %q, %v, want a copy", name, b, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(sb.dir, "propagation.log")); !os.IsNotExist(err) {
+		t.Errorf("got %v, want the propagation log not copied", err)
+	}
+	if got, want := cfg.StagingDirectoryPath(), filepath.Join(sb.dir, "staging"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The real staging area is read, but writes stay in the sandbox.
+	realStaging := storage.NewDiskStore(real.StagingDirectoryPath())
+	key := storage.RandomPointer().Key()
+	if err := realStaging.Put(key, storage.Value("real")); err != nil {
+		t.Fatal(err)
+	}
+	staging := sb.staging(storage.NewDiskStore(cfg.StagingDirectoryPath()))
+	if v, err := staging.Get(key); err != nil || string(v) != "real" {
+		t.Errorf("got %q, %v, want the real value", v, err)
+	}
+	if err := staging.Put(key, storage.Value("sandbox")); err != nil {
+		t.Fatal(err)
+	}
+	if err := staging.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := realStaging.Get(key); err != nil || string(v) != "real" {
+		t.Errorf("got %q, %v, want the real value unchanged", v, err)
+	}
+	if err := sb.remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sb.dir); !os.IsNotExist(err) {
+		t.Errorf("got %v, want the sandbox removed", err)
+	}
+}
+
+func TestSandboxRemoteTags(t *testing.T) {
+	base := t.TempDir()
+	if err := config.Initialize(base, "memory"); err != nil {
+		t.Fatal(err)
+	}
+	real, err := config.Load(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, _, err := newSandbox(real, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = sb.remove() }()
+	_, _, factory := setUpTree(t)
+	remote := &storage.InMemory{}
+	realStore, err := tree.NewStore(factory, remote, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	realTags, err := realStore.RemoteTags([]string{"base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed := storage.RandomPointer()
+	if err := realStore.UpdateRemoteTags(realTags, pushed); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := tree.NewStore(factory, storage.Metered(sb.remote(remote), "memory", storage.NewMetrics()), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := s.RemoteTags([]string{"base", "sandbox"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tags[0].Pointer.Equals(pushed) {
+		t.Fatalf("got %v, want the real tag", tags[0])
+	}
+	moved := storage.RandomPointer()
+	if err := s.UpdateRemoteTags(tags, moved); err != nil {
+		t.Fatal(err)
+	}
+	// Compare-and-swap still detects concurrent updates.
+	if err := s.UpdateRemoteTags(tags, storage.RandomPointer()); !errors.Is(err, storage.ErrConflict) {
+		t.Errorf("got %v, want %v", err, storage.ErrConflict)
+	}
+	listed, err := s.ListRemoteTags(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 || listed[0].Name != "base" || !listed[0].Pointer.Equals(moved) || listed[1].Name != "sandbox" {
+		t.Errorf("got %v, want base and sandbox, moved", listed)
+	}
+	if tag, err := realStore.RemoteTag("base"); err != nil || !tag.Pointer.Equals(pushed) {
+		t.Errorf("got %v, %v, want the real tag unchanged", tag, err)
+	}
+}
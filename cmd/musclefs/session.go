@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/muscle/internal/debug"
+)
+
+// sessionListener wraps accepted connections so that they can be
+// closed from a *srv.Conn, which doesn't expose its net.Conn.
+type sessionListener struct {
+	net.Listener
+}
+
+func (l sessionListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return sessionConn{Conn: c}, nil
+}
+
+type sessionConn struct {
+	net.Conn
+}
+
+func (c sessionConn) RemoteAddr() net.Addr {
+	return sessionAddr{Addr: c.Conn.RemoteAddr(), conn: c.Conn}
+}
+
+// sessionAddr is what srv.Conn.RemoteAddr returns for connections
+// accepted by a sessionListener.
+type sessionAddr struct {
+	net.Addr // May be nil, e.g., for some Unix domain sockets.
+	conn     net.Conn
+}
+
+func (a sessionAddr) String() string {
+	if a.Addr == nil {
+		return ""
+	}
+	return a.Addr.String()
+}
+
+// closeSession closes the network connection underlying c, which makes
+// the 9P server destroy its fids and forget about it.
+func closeSession(c *srv.Conn) {
+	if a, ok := c.RemoteAddr().(sessionAddr); ok {
+		_ = a.conn.Close()
+	}
+}
+
+type session struct {
+	last    time.Time // Last request received or responded to.
+	pending int       // Requests not yet responded to.
+	token   string    // Given by the client at attach time, see parkLocks.
+}
+
+// sessions tracks the activity of 9P connections, to close those that
+// have been idle for too long, and to know when all clients are gone
+// after draining has started.
+type sessions struct {
+	mu       sync.Mutex
+	conns    map[*srv.Conn]*session
+	draining bool
+	empty    chan struct{} // Closed when draining and no sessions are left.
+	emptied  bool
+}
+
+func newSessions() *sessions {
+	return &sessions{
+		conns: make(map[*srv.Conn]*session),
+		empty: make(chan struct{}),
+	}
+}
+
+func (s *sessions) open(c *srv.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[c] = &session{last: time.Now()}
+}
+
+func (s *sessions) close(c *srv.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+	s.checkEmpty()
+}
+
+// isOpen tells whether c was opened and not closed yet.
+func (s *sessions) isOpen(c *srv.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.conns[c]
+	return ok
+}
+
+func (s *sessions) checkEmpty() {
+	if s.draining && len(s.conns) == 0 && !s.emptied {
+		close(s.empty)
+		s.emptied = true
+	}
+}
+
+func (s *sessions) begin(r *srv.Req) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess := s.conns[r.Conn]; sess != nil {
+		sess.last = time.Now()
+		sess.pending++
+	}
+}
+
+func (s *sessions) end(r *srv.Req) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess := s.conns[r.Conn]; sess != nil {
+		sess.last = time.Now()
+		sess.pending--
+	}
+}
+
+// setToken records the session token the client gave at attach time.
+func (s *sessions) setToken(c *srv.Conn, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess := s.conns[c]; sess != nil {
+		sess.token = token
+	}
+}
+
+// token returns the session token of c, or the empty string if the
+// client did not give one.
+func (s *sessions) token(c *srv.Conn) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess := s.conns[c]; sess != nil {
+		return sess.token
+	}
+	return ""
+}
+
+// isDraining tells whether new attaches must be refused.
+func (s *sessions) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// drain starts draining and returns the number of open sessions and a
+// channel that is closed when none is left.
+func (s *sessions) drain() (int, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.draining = true
+	s.checkEmpty()
+	return len(s.conns), s.empty
+}
+
+// idle returns the sessions with no requests in progress and no
+// activity for at least the given duration.
+func (s *sessions) idle(d time.Duration, now time.Time) []*srv.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var conns []*srv.Conn
+	for c, sess := range s.conns {
+		if sess.pending == 0 && now.Sub(sess.last) >= d {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// closeAll closes all sessions.
+func (s *sessions) closeAll() {
+	s.mu.Lock()
+	var conns []*srv.Conn
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	for _, c := range conns {
+		closeSession(c)
+	}
+}
+
+// reapIdle closes sessions idle for at least d, checking periodically.
+func (s *sessions) reapIdle(d time.Duration) {
+	interval := d / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for now := range time.Tick(interval) {
+		for _, c := range s.idle(d, now) {
+			debug.Logf(debug.Info, "Closing session %s, idle for at least %v", c.Id, d)
+			closeSession(c)
+		}
+	}
+}
+
+// dump writes, for each session, its activity and, if fids is set, the
+// fids it holds, with the nodes they refer to. The latter requires the
+// tree lock.
+func (s *sessions) dump(w io.Writer, fids bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for c, sess := range s.conns {
+		_, _ = fmt.Fprintf(w, "%s pending %d idle %v\n", c.Id, sess.pending, now.Sub(sess.last).Truncate(time.Second))
+		if !fids {
+			continue
+		}
+		c.Lock()
+		for n, fid := range c.Fidpool {
+			var name string
+			if node, ok := fid.Aux.(*fsNode); ok && node.Node != nil {
+				name = node.Node.Path()
+			} else if ok {
+				name = node.dir.Name
+			}
+			_, _ = fmt.Fprintf(w, "\tfid %d mode %#o %s\n", n, fid.Omode, name)
+		}
+		c.Unlock()
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+func TestSessions(t *testing.T) {
+	s := newSessions()
+	a, b := new(srv.Conn), new(srv.Conn)
+	s.open(a)
+	s.open(b)
+	r := &srv.Req{Conn: a, Tc: &p.Fcall{Type: p.Tread}}
+	s.begin(r)
+
+	// Session a has a request in progress, so only b is idle.
+	later := time.Now().Add(time.Hour)
+	if got := s.idle(time.Minute, later); len(got) != 1 || got[0] != b {
+		t.Errorf("got %v, want only the second session", got)
+	}
+	s.end(r)
+	if got := s.idle(time.Minute, later); len(got) != 2 {
+		t.Errorf("got %d idle sessions, want 2", len(got))
+	}
+	if got := s.idle(time.Minute, time.Now()); len(got) != 0 {
+		t.Errorf("got %d idle sessions, want none", len(got))
+	}
+
+	if s.isDraining() {
+		t.Fatal("draining before drain")
+	}
+	n, empty := s.drain()
+	if n != 2 || !s.isDraining() {
+		t.Fatalf("got %d sessions and draining %v", n, s.isDraining())
+	}
+	s.close(a)
+	select {
+	case <-empty:
+		t.Fatal("drained with a session left")
+	default:
+	}
+	s.close(b)
+	select {
+	case <-empty:
+	default:
+		t.Fatal("not drained with no sessions left")
+	}
+	// Draining again is harmless.
+	if n, empty := s.drain(); n != 0 || empty == nil {
+		t.Errorf("got %d sessions", n)
+	}
+}
+
+func TestSessionsDump(t *testing.T) {
+	s := newSessions()
+	c := &srv.Conn{Id: "client", Fidpool: map[uint32]*srv.Fid{
+		7: {Omode: p.OREAD, Aux: &fsNode{kind: controlFile, dir: p.Dir{Name: "ctl"}}},
+	}}
+	s.open(c)
+	var b strings.Builder
+	s.dump(&b, false)
+	if got, want := b.String(), "client pending 0 idle 0s\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	b.Reset()
+	s.dump(&b, true)
+	if got, want := b.String(), "client pending 0 idle 0s\n\tfid 7 mode 0 ctl\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
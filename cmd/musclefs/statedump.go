@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"runtime/pprof"
+	"time"
+)
+
+// How long dumpState waits for the tree lock, which a hung request may
+// be holding.
+const dumpLockTimeout = 5 * time.Second
+
+// dumpState writes what helps tell why musclefs hangs, e.g., on
+// SIGQUIT, to a new file in the base directory: the stacks of all
+// goroutines, the propagation backlog, the sessions and, if the tree
+// lock can be acquired in time, the dirty nodes, the nodes in use with
+// their reference counts, and the fids of each session. It reports
+// whether the lock was acquired; if so, it is held on return.
+func (ops *ops) dumpState() (pathname string, locked bool, err error) {
+	const method = "ops.dumpState"
+	acquired := make(chan struct{})
+	go func() {
+		ops.lock(nil)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		locked = true
+	case <-time.After(dumpLockTimeout):
+	}
+
+	now := time.Now()
+	pathname = ops.cfg.StateDumpFilePath(now)
+	f, err := os.OpenFile(pathname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", locked, errorv(method, err)
+	}
+	w := bufio.NewWriter(f)
+	_, _ = fmt.Fprintf(w, "# musclefs state at %v\n", now.Format(time.RFC3339))
+	if !locked {
+		_, _ = fmt.Fprintf(w, "# tree lock not acquired within %v, tree state omitted\n", dumpLockTimeout)
+	}
+	b := ops.pairedStore.Backlog()
+	_, _ = fmt.Fprintf(w, "\n# backlog\npending %d\nmissing %d\noldest-pending %v\n", b.Pending, b.Missing, b.Age().Truncate(time.Second))
+	_, _ = fmt.Fprintln(w, "\n# sessions")
+	ops.sessions.dump(w, locked)
+	if locked {
+		_, _ = fmt.Fprintln(w, "\n# dirty nodes")
+		for _, n := range ops.tree.ListDirtyNodes() {
+			_, _ = fmt.Fprintf(w, "%s %d %v\n", n.Path, n.Size, now.Sub(n.Modified).Truncate(time.Second))
+		}
+		_, _ = fmt.Fprintln(w, "\n# nodes in use, with reference counts")
+		_ = ops.tree.DumpRefs(w)
+	}
+	_, _ = fmt.Fprintln(w, "\n# goroutines")
+	_ = pprof.Lookup("goroutine").WriteTo(w, 2)
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return pathname, locked, errorv(method, err)
+	}
+	if err := f.Close(); err != nil {
+		return pathname, locked, errorv(method, err)
+	}
+	return pathname, locked, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+	"github.com/nicolagi/muscle/internal/debug"
+)
+
+var opNames = map[uint8]string{
+	p.Tversion: "version",
+	p.Tauth:    "auth",
+	p.Tattach:  "attach",
+	p.Tflush:   "flush",
+	p.Twalk:    "walk",
+	p.Topen:    "open",
+	p.Tcreate:  "create",
+	p.Tread:    "read",
+	p.Twrite:   "write",
+	p.Tclunk:   "clunk",
+	p.Tremove:  "remove",
+	p.Tstat:    "stat",
+	p.Twstat:   "wstat",
+}
+
+// traceEntry describes a request that has been responded to.
+type traceEntry struct {
+	start   time.Time
+	op      string
+	fid     uint32
+	node    *fsNode // Nil if the request had no fid, or an unknown one.
+	latency time.Duration
+	err     string
+}
+
+// traceRing records the last requests served, so that stalls can be
+// investigated without printing all 9P messages. It also logs requests
+// slower than a threshold. The zero value is a disabled ring that
+// records nothing.
+type traceRing struct {
+	mu      sync.Mutex
+	entries []traceEntry
+	next    int // Where the next entry goes.
+	full    bool
+	slow    time.Duration
+	started map[*srv.Req]time.Time
+}
+
+// resize discards all entries and makes room for n entries.
+// Zero disables tracing.
+func (ring *traceRing) resize(n int) {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	ring.entries = nil
+	if n > 0 {
+		ring.entries = make([]traceEntry, n)
+	}
+	ring.next = 0
+	ring.full = false
+	ring.track()
+}
+
+// setSlow makes the ring log requests that take at least d to be
+// responded to. Zero disables logging.
+func (ring *traceRing) setSlow(d time.Duration) {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	ring.slow = d
+	ring.track()
+}
+
+// track ensures start times are tracked only if needed.
+func (ring *traceRing) track() {
+	if ring.entries == nil && ring.slow == 0 {
+		ring.started = nil
+	} else if ring.started == nil {
+		ring.started = make(map[*srv.Req]time.Time)
+	}
+}
+
+func (ring *traceRing) begin(r *srv.Req) {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	if ring.started != nil {
+		ring.started[r] = time.Now()
+	}
+}
+
+func (ring *traceRing) end(r *srv.Req) {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	start, ok := ring.started[r]
+	if !ok {
+		return
+	}
+	delete(ring.started, r)
+	e := traceEntry{
+		start:   start,
+		op:      opNames[r.Tc.Type],
+		fid:     r.Tc.Fid,
+		latency: time.Since(start),
+	}
+	if r.Fid != nil {
+		e.node, _ = r.Fid.Aux.(*fsNode)
+	}
+	if r.Rc != nil && r.Rc.Type == p.Rerror {
+		e.err = r.Rc.Error
+	}
+	if ring.slow > 0 && e.latency >= ring.slow {
+		// Responses are sent while holding the tree lock, so it's
+		// safe to compute the path.
+		debug.Logf(debug.Info, "Slow 9P request: %s fid=%d path=%q took %v", e.op, e.fid, tracePath(e.node), e.latency)
+	}
+	if ring.entries == nil {
+		return
+	}
+	ring.entries[ring.next] = e
+	ring.next++
+	if ring.next == len(ring.entries) {
+		ring.next = 0
+		ring.full = true
+	}
+}
+
+// dump writes one line per entry, oldest first, followed by one line
+// per request still in progress. Paths are computed at dump time, so
+// the caller must hold the lock serializing access to the tree.
+func (ring *traceRing) dump(w io.Writer) {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	if ring.entries == nil {
+		_, _ = fmt.Fprintln(w, "tracing disabled")
+		return
+	}
+	line := func(e traceEntry) {
+		_, _ = fmt.Fprintf(w, "%s %s fid=%d path=%q latency=%v", e.start.Format("15:04:05.000000"), e.op, e.fid, tracePath(e.node), e.latency)
+		if e.err != "" {
+			_, _ = fmt.Fprintf(w, " error=%q", e.err)
+		}
+		_, _ = fmt.Fprintln(w)
+	}
+	if ring.full {
+		for _, e := range ring.entries[ring.next:] {
+			line(e)
+		}
+	}
+	for _, e := range ring.entries[:ring.next] {
+		line(e)
+	}
+	now := time.Now()
+	for r, start := range ring.started {
+		_, _ = fmt.Fprintf(w, "%s %s fid=%d in-progress=%v\n", start.Format("15:04:05.000000"), opNames[r.Tc.Type], r.Tc.Fid, now.Sub(start))
+	}
+}
+
+func tracePath(node *fsNode) string {
+	if node == nil {
+		return ""
+	}
+	switch node.kind {
+	case controlFile, syntheticDir:
+		return node.dir.Name
+	default:
+		return node.Path()
+	}
+}
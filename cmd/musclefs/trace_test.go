@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/lionkov/go9p/p"
+	"github.com/lionkov/go9p/p/srv"
+)
+
+func TestTraceRing(t *testing.T) {
+	var ring traceRing
+	respond := func(typ uint8, fid uint32, errstr string) {
+		r := &srv.Req{Tc: &p.Fcall{Type: typ, Fid: fid}, Rc: &p.Fcall{}}
+		ring.begin(r)
+		if errstr != "" {
+			r.Rc.Type = p.Rerror
+			r.Rc.Error = errstr
+		}
+		ring.end(r)
+	}
+	dump := func() []string {
+		var b bytes.Buffer
+		ring.dump(&b)
+		return strings.Split(strings.TrimSpace(b.String()), "\n")
+	}
+
+	respond(p.Tstat, 1, "")
+	if got := dump(); len(got) != 1 || got[0] != "tracing disabled" {
+		t.Fatalf("got %q, want tracing disabled", got)
+	}
+
+	ring.resize(2)
+	respond(p.Tstat, 1, "")
+	respond(p.Twalk, 2, "")
+	respond(p.Topen, 3, "permission denied")
+	got := dump()
+	if len(got) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(got), got)
+	}
+	if !strings.Contains(got[0], " walk fid=2 ") {
+		t.Errorf("got %q, want the walk first", got[0])
+	}
+	if !strings.Contains(got[1], " open fid=3 ") || !strings.Contains(got[1], `error="permission denied"`) {
+		t.Errorf("got %q, want the failed open last", got[1])
+	}
+
+	in := &srv.Req{Tc: &p.Fcall{Type: p.Tread, Fid: 4}}
+	ring.begin(in)
+	if got := dump(); !strings.Contains(got[len(got)-1], "read fid=4 in-progress=") {
+		t.Errorf("got %q, want the read in progress", got[len(got)-1])
+	}
+}
@@ -3,7 +3,7 @@ package block
 import (
 	"errors"
 	"fmt"
-	"log"
+	"sync"
 	"time"
 
 	"github.com/nicolagi/muscle/internal/storage"
@@ -44,9 +44,20 @@ type Block struct {
 	cipher     blockCipher
 	index      storage.Store
 	repository storage.Store
+	cache      *cache
+	profile    *ReadProfile
+	journal    *SealJournal
+	fetcher    *fetcher
+	garbage    *garbage
 
 	// When was the block last used?
 	atime time.Time
+
+	// Incremented on every change to the value, to tell whether a
+	// frozen copy is still current.
+	generation uint64
+
+	discarded bool
 }
 
 // TODO: panic if block is dirty.
@@ -54,6 +65,20 @@ func (block *Block) Ref() Ref {
 	return block.ref
 }
 
+// Location tells where the value of the block is, for diagnostics:
+// "dirty" if it's only in memory, "staging" if it's in the index, i.e.,
+// the staging area, "repository" otherwise.
+func (block *Block) Location() string {
+	switch {
+	case block.state == dirty:
+		return "dirty"
+	case block.location == index:
+		return "staging"
+	default:
+		return "repository"
+	}
+}
+
 func (block *Block) Size() (n int, err error) {
 	block.atime = time.Now()
 	if err := block.ensureReadable(); err != nil {
@@ -73,6 +98,64 @@ func (block *Block) Read(p []byte, off int) (n int, err error) {
 	return copy(p, block.value[off:]), nil
 }
 
+// How many blocks Load loads at a time.
+const loadParallelism = 8
+
+// Load loads the values of the blocks that need loading, a few at a
+// time, so that those of a request spanning many blocks are read from
+// storage and decrypted together rather than in turn. The blocks must
+// be distinct and not be used otherwise until Load returns. The error
+// is that of the first block that failed, in order.
+func Load(blocks []*Block) error {
+	var pending []*Block
+	for _, b := range blocks {
+		if b.state == primed {
+			pending = append(pending, b)
+		}
+	}
+	if len(pending) < 2 {
+		for _, b := range pending {
+			if err := b.ensureReadable(); err != nil {
+				return fmt.Errorf("block.Load: %w", err)
+			}
+		}
+		return nil
+	}
+	errs := make([]error, len(pending))
+	slots := make(chan struct{}, loadParallelism)
+	var wg sync.WaitGroup
+	for i, b := range pending {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, b *Block) {
+			defer wg.Done()
+			errs[i] = b.ensureReadable()
+			<-slots
+		}(i, b)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return fmt.Errorf("block.Load: %w", err)
+		}
+	}
+	return nil
+}
+
+// Fetch starts getting the value of the block from the repository in
+// the background, for a read expected soon, if the block needs loading
+// and its factory fetches ahead, see WithFetchAhead. Values in the
+// cache aren't fetched again.
+func (block *Block) Fetch() {
+	if block.fetcher == nil || block.state != primed || block.location != repository {
+		return
+	}
+	if block.cache != nil && block.cache.contains(block.ref.Key()) {
+		return
+	}
+	block.fetcher.start(block.ref.Key())
+}
+
 // ReadAll returns a copy of the content of the block.
 func (block *Block) ReadAll() ([]byte, error) {
 	block.atime = time.Now()
@@ -94,6 +177,7 @@ func (block *Block) Truncate(size int) error {
 	if err := block.ensureWritable(); err != nil {
 		return fmt.Errorf("block.Block.Truncate: %w", err)
 	}
+	block.generation++
 	if size <= len(block.value) {
 		block.value = block.value[:size]
 		block.state = dirty
@@ -125,9 +209,34 @@ func (block *Block) Write(p []byte, off int) (n int, sizeIncrease int, err error
 		block.value = append(block.value, p[copied:]...)
 	}
 	block.state = dirty
+	block.generation++
 	return len(p), len(block.value) - before, nil
 }
 
+// Overwrite replaces the whole value of the block with p, without
+// loading the value it replaces, e.g., for a write covering the block.
+func (block *Block) Overwrite(p []byte) error {
+	block.atime = time.Now()
+	if len(p) > block.capacity {
+		return fmt.Errorf("block.Block.Overwrite: %d bytes with capacity %d", len(p), block.capacity)
+	}
+	if block.location == repository {
+		ref, err := NewRef(nil)
+		if err != nil {
+			return fmt.Errorf("block.Block.Overwrite: %w", err)
+		}
+		block.ref = ref
+		block.location = index
+	}
+	if block.state == primed {
+		block.value = nil
+	}
+	block.value = append(block.value[:0], p...)
+	block.state = dirty
+	block.generation++
+	return nil
+}
+
 // Flush ensures the block is synced to disk.
 // Returns whether the block needed flushing or not, or an error.
 func (block *Block) Flush() (flushed bool, err error) {
@@ -146,18 +255,41 @@ func (block *Block) Flush() (flushed bool, err error) {
 // Pre-condition: the block is dirty and backed by the index.
 // Post-condition: the block is clean and backed by the index, or an error is returned.
 func (block *Block) flush() error {
-	ciphertext, err := block.cipher.encrypt(block.value)
-	if err != nil {
-		return fmt.Errorf("block.Block.flush: %w", err)
-	}
-	err = block.index.Put(block.ref.Key(), ciphertext)
-	if err != nil {
+	block.restage()
+	if err := stage(block.index, block.cipher, block.ref, block.value); err != nil {
 		return fmt.Errorf("block.Block.flush: %w", err)
 	}
 	block.state = clean
 	return nil
 }
 
+// restage points the dirty block to where its value is staged, which
+// depends on the value only, so that staging the same value again,
+// e.g., for an editor saving a whole file, reuses the staged copy. The
+// copy staged before, if any, may be shared by other blocks, so it is
+// only deleted once none refers to it, see garbage.
+func (block *Block) restage() {
+	ref := stagedRefOf(block.value)
+	if ref == block.ref {
+		return
+	}
+	block.garbage.release(block.ref.Key())
+	block.garbage.acquire(ref.Key())
+	block.ref = ref
+}
+
+// stage writes the value under the ref, unless it is staged already.
+func stage(index storage.Store, cipher blockCipher, ref Ref, value []byte) error {
+	if ok, err := index.Contains(ref.Key()); err == nil && ok {
+		return nil
+	}
+	ciphertext, err := cipher.encrypt(value, ref.Bytes())
+	if err != nil {
+		return err
+	}
+	return index.Put(ref.Key(), ciphertext)
+}
+
 // Seal ensures a read-only version of the block is written to the repository.
 func (block *Block) Seal() (sealed bool, err error) {
 	block.atime = time.Now()
@@ -177,16 +309,22 @@ func (block *Block) Seal() (sealed bool, err error) {
 // Post-condition: block state is clean, backed by repository.
 func (block *Block) seal() error {
 	ref := RefOf(block.value)
-	ciphertext, err := block.cipher.encrypt(block.value)
-	if err != nil {
-		return fmt.Errorf("block.Block.seal: %w", err)
-	}
-	if err := block.repository.Put(ref.Key(), ciphertext); err != nil {
-		return fmt.Errorf("block.Block.seal: %w", err)
+	if block.journal == nil || !block.journal.isUploaded(ref) {
+		ciphertext, err := block.cipher.encrypt(block.value, ref.Bytes())
+		if err != nil {
+			return fmt.Errorf("block.Block.seal: %w", err)
+		}
+		if err := block.repository.Put(ref.Key(), ciphertext); err != nil {
+			return fmt.Errorf("block.Block.seal: %w", err)
+		}
 	}
-	if err := block.index.Delete(block.ref.Key()); err != nil && !errors.Is(err, storage.ErrNotFound) {
-		log.Printf("block.Block.seal: left garbage behind: %v", err)
+	// Record the replacement before the staged copy is gone.
+	if block.journal != nil {
+		if err := block.journal.record(block.ref.(IndexRef), ref); err != nil {
+			return fmt.Errorf("block.Block.seal: %w", err)
+		}
 	}
+	block.garbage.release(block.ref.Key())
 	block.ref = ref
 	block.state = clean
 	block.location = repository
@@ -213,15 +351,17 @@ func (block *Block) forget() {
 	block.value = nil
 }
 
-// Discard nils out the block value and tries to remove the block from the index,
-// if it's backed by the index. The block should not be used for anything after
-// this method is called.
+// Discard nils out the block value and marks the block for removal from the
+// index, if it's backed by the index, see garbage. The block should
+// not be used for anything after this method is called.
 func (block *Block) Discard() {
+	if block.discarded {
+		return
+	}
 	block.value = nil
+	block.discarded = true
 	if block.location == index {
-		if err := block.index.Delete(block.ref.Key()); err != nil && !errors.Is(err, storage.ErrNotFound) {
-			log.Printf("block.Block.Discard left garbage behind: %v", err)
-		}
+		block.garbage.release(block.ref.Key())
 	}
 }
 
@@ -272,19 +412,54 @@ func (block *Block) load() (err error) {
 	switch block.location {
 	case index:
 		ciphertext, err = block.index.Get(block.ref.Key())
+		if errors.Is(err, storage.ErrNotFound) && block.journal != nil {
+			// Sealed by a seal that was interrupted before the
+			// tree pointing to the staged block was saved.
+			if repo, ok := block.journal.replacement(block.ref.(IndexRef)); ok {
+				block.ref = repo
+				block.location = repository
+				return block.load()
+			}
+		}
 	case repository:
-		ciphertext, err = block.repository.Get(block.ref.Key())
+		if block.profile != nil {
+			block.profile.record(block.ref.Key())
+		}
+		if block.cache != nil {
+			if value, ok := block.cache.get(block.ref.Key()); ok {
+				block.value = value
+				block.state = clean
+				return nil
+			}
+		}
+		var fetched bool
+		if block.fetcher != nil {
+			ciphertext, fetched, err = block.fetcher.take(block.ref.Key())
+		}
+		if !fetched {
+			ciphertext, err = block.repository.Get(block.ref.Key())
+		}
 	default:
 		panic("block.Block.load: unknown location")
 	}
 	if err != nil {
 		return errorv(method, err)
 	}
-	if l, min := len(ciphertext), block.cipher.BlockSize(); l < min {
-		return errorf(method, "%v is %d bytes long; need at least %d bytes", block.ref.Key(), l, min)
+	value, legacy, err := block.cipher.decrypt(ciphertext, block.ref.Bytes())
+	if err != nil {
+		return errorf(method, "%v: %w", block.ref.Key(), err)
+	}
+	// Legacy ciphertexts aren't bound to their refs, but repository
+	// refs are hashes of the values, which is as good. Legacy staged
+	// values can't be checked, as they may have random refs.
+	if repo, ok := block.ref.(RepositoryRef); legacy && ok && RefOf(value) != repo {
+		return errorf(method, "%v: value does not match: %w", block.ref.Key(), ErrAuthentication)
 	}
-	block.value = block.cipher.decrypt(ciphertext)
+	block.value = value
 	block.state = clean
+	if block.cache != nil && block.location == repository {
+		block.cache.add(block.ref.Key(), block.value)
+	}
 	return nil
 }
 
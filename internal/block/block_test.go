@@ -2,6 +2,7 @@ package block
 
 import (
 	"bytes"
+	"errors"
 	"math/rand"
 	"strings"
 	"testing"
@@ -191,3 +192,161 @@ func TestCorruptedBlockHandling(t *testing.T) {
 		}
 	})
 }
+
+func TestSubstitutedBlockDetection(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	repository := &storage.InMemory{}
+	factory, err := NewFactory(&storage.InMemory{}, repository, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seal := func(value string) Ref {
+		t.Helper()
+		b, err := factory.New(nil, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := b.Write([]byte(value), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Seal(); err != nil {
+			t.Fatal(err)
+		}
+		return b.Ref()
+	}
+	load := func(ref Ref) error {
+		t.Helper()
+		b, err := factory.New(ref, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = b.ReadAll()
+		return err
+	}
+	a, b := seal("a"), seal("b")
+	if err := load(b); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("authenticated", func(t *testing.T) {
+		ciphertext, err := repository.Get(a.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repository.Put(b.Key(), ciphertext); err != nil {
+			t.Fatal(err)
+		}
+		if err := load(b); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("got %v, want %v", err, ErrAuthentication)
+		}
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		iv := make([]byte, factory.cipher.BlockSize())
+		rand.Read(iv)
+		if err := repository.Put(b.Key(), append(iv, factory.cipher.xor([]byte("a"), iv)...)); err != nil {
+			t.Fatal(err)
+		}
+		if err := load(b); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("got %v, want %v", err, ErrAuthentication)
+		}
+		if err := repository.Put(b.Key(), append(iv, factory.cipher.xor([]byte("b"), iv)...)); err != nil {
+			t.Fatal(err)
+		}
+		if err := load(b); err != nil {
+			t.Errorf("got %v for a legacy block matching its ref", err)
+		}
+	})
+}
+
+func TestLoad(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	index := &storage.InMemory{}
+	factory, err := NewFactory(index, nil, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []Ref
+	for _, value := range []string{"a", "b", "c"} {
+		b, err := factory.New(nil, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := b.Write([]byte(value), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, b.Ref())
+	}
+	primed := func() []*Block {
+		t.Helper()
+		var blocks []*Block
+		for _, ref := range refs {
+			b, err := factory.New(ref, 8192)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blocks = append(blocks, b)
+		}
+		return blocks
+	}
+
+	t.Run("loads all", func(t *testing.T) {
+		blocks := primed()
+		if err := Load(blocks); err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range []string{"a", "b", "c"} {
+			if blocks[i].state != clean {
+				t.Errorf("block %d: got state %v, want clean", i, blocks[i].state)
+			}
+			if got := string(blocks[i].value); got != want {
+				t.Errorf("block %d: got %q, want %q", i, got, want)
+			}
+		}
+	})
+
+	t.Run("fails if one fails", func(t *testing.T) {
+		blocks := primed()
+		if err := index.Delete(refs[1].Key()); err != nil {
+			t.Fatal(err)
+		}
+		if err := Load(blocks); err == nil {
+			t.Error("got no error")
+		}
+	})
+}
+
+func TestBlockOverwrite(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	// Nothing can be loaded from the empty stores.
+	factory, err := NewFactory(&storage.InMemory{}, &storage.InMemory{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := NewRef(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := factory.New(ref, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Overwrite([]byte("abcde")); err == nil {
+		t.Error("got no error overwriting past capacity")
+	}
+	if err := b.Overwrite([]byte("abcd")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := b.ReadAll(); err != nil || string(got) != "abcd" {
+		t.Errorf("got %q, %v, want %q", got, err, "abcd")
+	}
+	if b.state != dirty {
+		t.Errorf("got state %v, want dirty", b.state)
+	}
+}
@@ -0,0 +1,192 @@
+package block
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// cache holds the plaintext of blocks loaded from the repository, which
+// are immutable, so that hot blocks, e.g., those of directories, aren't
+// read from the disk cache and decrypted on every traversal. Entries
+// are evicted least recently used first, but a new entry is admitted
+// only if it's been requested more often than the entry it would evict
+// (TinyLFU), so that a one-off scan of a large file doesn't flush out
+// the hot blocks.
+type cache struct {
+	mu       sync.Mutex
+	capacity int
+	size     int
+	lru      *list.List // Of *cacheEntry, most recently used first.
+	entries  map[storage.Key]*list.Element
+	sketch   *frequencySketch
+
+	hits   uint64
+	misses uint64
+}
+
+type cacheEntry struct {
+	key   storage.Key
+	value []byte
+}
+
+// CacheStats describes the usage of a block cache.
+type CacheStats struct {
+	Capacity int
+	Size     int
+	Entries  int
+	Hits     uint64
+	Misses   uint64
+}
+
+func newCache(capacity int) *cache {
+	// Assume blocks average a few KiB to size the sketch.
+	width := capacity / 4096
+	if width < 64 {
+		width = 64
+	}
+	return &cache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[storage.Key]*list.Element),
+		sketch:   newFrequencySketch(width),
+	}
+}
+
+// get returns a copy of the cached value, since block values are
+// modified in place.
+func (c *cache) get(key storage.Key) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sketch.increment(key)
+	e, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	value := e.Value.(*cacheEntry).value
+	dup := make([]byte, len(value))
+	copy(dup, value)
+	return dup, true
+}
+
+// contains tells whether the key is cached, without counting as a
+// request for it.
+func (c *cache) contains(key storage.Key) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[key]
+	return ok
+}
+
+// add adds a copy of the value, subject to the admission policy.
+func (c *cache) add(key storage.Key, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(value) > c.capacity {
+		return
+	}
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	// Find the victims first, so that nothing is evicted if the
+	// new entry is not admitted.
+	freq := c.sketch.estimate(key)
+	need := c.size + len(value) - c.capacity
+	var victims []*list.Element
+	for e := c.lru.Back(); need > 0; e = e.Prev() {
+		victim := e.Value.(*cacheEntry)
+		if c.sketch.estimate(victim.key) >= freq {
+			return
+		}
+		victims = append(victims, e)
+		need -= len(victim.value)
+	}
+	for _, e := range victims {
+		victim := c.lru.Remove(e).(*cacheEntry)
+		delete(c.entries, victim.key)
+		c.size -= len(victim.value)
+	}
+	dup := make([]byte, len(value))
+	copy(dup, value)
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, value: dup})
+	c.size += len(dup)
+}
+
+func (c *cache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Capacity: c.capacity,
+		Size:     c.size,
+		Entries:  len(c.entries),
+		Hits:     c.hits,
+		Misses:   c.misses,
+	}
+}
+
+// frequencySketch estimates how often keys were requested recently,
+// in constant space (a count-min sketch with 4-bit saturating
+// counters). Counts are halved periodically, so that keys that used to
+// be hot don't stay in the cache forever.
+type frequencySketch struct {
+	rows    [4][]uint8
+	mask    uint64
+	added   int
+	resetAt int
+}
+
+func newFrequencySketch(width int) *frequencySketch {
+	n := 1
+	for n < width {
+		n <<= 1
+	}
+	s := &frequencySketch{mask: uint64(n - 1), resetAt: 10 * n}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, n)
+	}
+	return s
+}
+
+func (s *frequencySketch) indexes(key storage.Key) (ii [4]uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	// Derive the other hashes from the first one (Kirsch-Mitzenmacher).
+	h1, h2 := sum, sum>>32|sum<<32
+	for i := range ii {
+		ii[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return
+}
+
+func (s *frequencySketch) increment(key storage.Key) {
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < 15 {
+			s.rows[i][j]++
+		}
+	}
+	s.added++
+	if s.added >= s.resetAt {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] >>= 1
+			}
+		}
+		s.added /= 2
+	}
+}
+
+func (s *frequencySketch) estimate(key storage.Key) uint8 {
+	min := uint8(15)
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < min {
+			min = s.rows[i][j]
+		}
+	}
+	return min
+}
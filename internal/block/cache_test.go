@@ -0,0 +1,141 @@
+package block
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestCacheAdmission(t *testing.T) {
+	c := newCache(10)
+	hot := func(key storage.Key, n int) {
+		for i := 0; i < n; i++ {
+			c.get(key)
+		}
+	}
+	hot("a", 3)
+	c.add("a", make([]byte, 5))
+	hot("b", 3)
+	c.add("b", make([]byte, 5))
+
+	// A key requested less often than the entries is not admitted.
+	hot("c", 1)
+	c.add("c", make([]byte, 5))
+	if _, ok := c.get("c"); ok {
+		t.Error("c was admitted")
+	}
+	for _, key := range []storage.Key{"a", "b"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+
+	// Once requested more often, it replaces the least recently
+	// used entry.
+	hot("c", 10)
+	c.add("c", make([]byte, 5))
+	if _, ok := c.get("c"); !ok {
+		t.Error("c was not admitted")
+	}
+	if _, ok := c.get("a"); ok {
+		t.Error("a was not evicted")
+	}
+	if stats := c.stats(); stats.Size != 10 || stats.Entries != 2 {
+		t.Errorf("got %+v, want 2 entries totaling 10 bytes", stats)
+	}
+
+	// Entries larger than the cache are never admitted.
+	hot("d", 15)
+	c.add("d", make([]byte, 11))
+	if _, ok := c.get("d"); ok {
+		t.Error("d was admitted")
+	}
+}
+
+func TestFactoryWithCache(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	factory, err := NewFactory(&storage.InMemory{}, &storage.InMemory{}, key, WithCache(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := factory.New(nil, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.Write([]byte("content"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	ref := b.Ref()
+	read := func() *Block {
+		t.Helper()
+		b, err := factory.New(ref, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := b.ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, []byte("content")) {
+			t.Errorf("got %q, want %q", value, "content")
+		}
+		return b
+	}
+	read()
+	// Changes to a block loaded from the cache don't affect the cache.
+	if _, _, err := read().Write([]byte("changed"), 0); err != nil {
+		t.Fatal(err)
+	}
+	read()
+	stats, ok := factory.CacheStats()
+	if !ok {
+		t.Fatal("no cache")
+	}
+	if stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("got %+v, want 2 hits and 1 miss", stats)
+	}
+}
+
+func TestFactoryWithSharedCache(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	repository := &storage.InMemory{}
+	factory, err := NewFactory(&storage.InMemory{}, repository, key, WithCache(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewFactory(&storage.InMemory{}, repository, key, WithSharedCache(factory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := other.New(nil, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.Write([]byte("content"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []*Factory{other, factory} {
+		b, err := f.New(b.Ref(), 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.ReadAll(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, _ := factory.CacheStats()
+	shared, _ := other.CacheStats()
+	if stats != shared || stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("got %+v and %+v, want 1 hit and 1 miss, shared", stats, shared)
+	}
+}
@@ -0,0 +1,39 @@
+package block
+
+import (
+	"encoding/hex"
+	"io"
+)
+
+// ParseRef parses the hexadecimal form of a ref, as it appears, e.g.,
+// in the output of the dump control command.
+func ParseRef(s string) (Ref, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, errorv("ParseRef", err)
+	}
+	if len(b) == 0 {
+		return nil, errorf("ParseRef", "empty ref")
+	}
+	return NewRef(b)
+}
+
+// Cat writes the values of the blocks to w, in order, e.g., to recover
+// the contents of a file from the refs of its blocks when its node, or
+// an ancestor's, is damaged.
+func (factory *Factory) Cat(w io.Writer, refs []Ref) error {
+	for _, ref := range refs {
+		b, err := factory.New(ref, 0)
+		if err != nil {
+			return errorv("Factory.Cat", err)
+		}
+		value, err := b.ReadAll()
+		if err != nil {
+			return errorf("Factory.Cat", "%v: %v", ref, err)
+		}
+		if _, err := w.Write(value); err != nil {
+			return errorv("Factory.Cat", err)
+		}
+	}
+	return nil
+}
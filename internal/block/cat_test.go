@@ -0,0 +1,53 @@
+package block
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestFactoryCat(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	factory, err := NewFactory(&storage.InMemory{}, &storage.InMemory{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []Ref
+	for _, value := range []string{"staged, ", "sealed"} {
+		b, err := factory.New(nil, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := b.Write([]byte(value), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if value == "sealed" {
+			if _, err := b.Seal(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ref, err := ParseRef(b.Ref().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+	var buf bytes.Buffer
+	if err := factory.Cat(&buf, refs); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "staged, sealed"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	missing, _ := NewRef(nil)
+	if err := factory.Cat(&buf, []Ref{missing}); err == nil {
+		t.Error("got nil error for a missing block")
+	}
+	if _, err := ParseRef("xyz"); err == nil {
+		t.Error("got nil error for a malformed ref")
+	}
+}
@@ -1,35 +1,75 @@
 package block
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"fmt"
 )
 
+// ErrAuthentication means a ciphertext was not encrypted with the key
+// and additional data given to decrypt it, e.g., because a block was
+// replaced in the store by another one, or damaged.
+var ErrAuthentication = errors.New("ciphertext authentication failed")
+
+// aeadMagic starts the ciphertexts encrypted with AES-GCM. Legacy
+// ciphertexts, encrypted with AES-CTR and not authenticated, start with
+// a random initialization vector instead, which is this unlikely to
+// look like the magic.
+var aeadMagic = []byte("muscle\x00\x02")
+
 type blockCipher struct {
 	cipher.Block
+	aead cipher.AEAD
 }
 
 func newBlockCipher(key []byte) (blockCipher, error) {
 	block, err := aes.NewCipher(key)
-	return blockCipher{block}, err
+	if err != nil {
+		return blockCipher{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	return blockCipher{Block: block, aead: aead}, err
 }
 
-func (c *blockCipher) encrypt(cleartext []byte) (ciphertext []byte, err error) {
-	iv := make([]byte, c.BlockSize())
-	if _, err := rand.Read(iv); err != nil {
+// encrypt encrypts and authenticates the cleartext together with the
+// additional data, e.g., the ref the ciphertext is stored under, so
+// that decrypt fails unless it is given the same additional data.
+func (c *blockCipher) encrypt(cleartext []byte, additional []byte) (ciphertext []byte, err error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
 		return nil, fmt.Errorf("could not read random bytes for nonce: %v", err)
 	}
-	return append(iv, c.xor(cleartext, iv)...), nil
+	ciphertext = make([]byte, 0, len(aeadMagic)+len(nonce)+len(cleartext)+c.aead.Overhead())
+	ciphertext = append(ciphertext, aeadMagic...)
+	ciphertext = append(ciphertext, nonce...)
+	return c.aead.Seal(ciphertext, nonce, cleartext, additional), nil
 }
 
-// decrypt expects the ciphertext to contain at least the initialization vector.
-// It will panic if the ciphertext is shorter than the AES block size (16).
-func (c *blockCipher) decrypt(ciphertext []byte) (cleartext []byte) {
-	iv := ciphertext[:c.BlockSize()]
-	ciphertext = ciphertext[c.BlockSize():]
-	return c.xor(ciphertext, iv)
+// decrypt reverses encrypt, failing with an error wrapping
+// ErrAuthentication if the additional data differs or the ciphertext
+// was altered. Legacy ciphertexts are decrypted too, reported as such:
+// nothing about them can be verified here.
+func (c *blockCipher) decrypt(ciphertext []byte, additional []byte) (cleartext []byte, legacy bool, err error) {
+	if !bytes.HasPrefix(ciphertext, aeadMagic) {
+		if l, min := len(ciphertext), c.BlockSize(); l < min {
+			return nil, true, fmt.Errorf("ciphertext is %d bytes long; need at least %d bytes", l, min)
+		}
+		iv := ciphertext[:c.BlockSize()]
+		return c.xor(ciphertext[c.BlockSize():], iv), true, nil
+	}
+	ciphertext = ciphertext[len(aeadMagic):]
+	if l, min := len(ciphertext), c.aead.NonceSize()+c.aead.Overhead(); l < min {
+		return nil, false, fmt.Errorf("ciphertext is %d bytes long; need at least %d bytes", l+len(aeadMagic), min+len(aeadMagic))
+	}
+	nonce, sealed := ciphertext[:c.aead.NonceSize()], ciphertext[c.aead.NonceSize():]
+	cleartext, err = c.aead.Open(make([]byte, 0, len(sealed)-c.aead.Overhead()), nonce, sealed, additional)
+	if err != nil {
+		return nil, false, ErrAuthentication
+	}
+	return cleartext, false, nil
 }
 
 func (c *blockCipher) xor(in, iv []byte) (out []byte) {
@@ -2,6 +2,8 @@ package block
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"errors"
 	"fmt"
 	"math/rand"
 	"testing"
@@ -17,13 +19,14 @@ func TestBlockCipherRoundTrip(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			f := func(cleartext []byte) bool {
-				ciphertext, err := cipher.encrypt(cleartext)
+			f := func(cleartext []byte, additional []byte) bool {
+				ciphertext, err := cipher.encrypt(cleartext, additional)
 				if err != nil {
 					t.Log(err)
 					return false
 				}
-				return bytes.Equal(cipher.decrypt(ciphertext), cleartext)
+				got, legacy, err := cipher.decrypt(ciphertext, additional)
+				return err == nil && !legacy && bytes.Equal(got, cleartext)
 			}
 			if err := quick.Check(f, nil); err != nil {
 				t.Error(err)
@@ -31,3 +34,46 @@ func TestBlockCipherRoundTrip(t *testing.T) {
 		})
 	}
 }
+
+func TestBlockCipherAuthentication(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	c, err := newBlockCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := c.encrypt([]byte("cleartext"), []byte("ref 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("other additional data", func(t *testing.T) {
+		if _, _, err := c.decrypt(ciphertext, []byte("ref 2")); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("got %v, want %v", err, ErrAuthentication)
+		}
+	})
+	t.Run("altered ciphertext", func(t *testing.T) {
+		altered := append([]byte(nil), ciphertext...)
+		altered[len(altered)-1] ^= 1
+		if _, _, err := c.decrypt(altered, []byte("ref 1")); !errors.Is(err, ErrAuthentication) {
+			t.Errorf("got %v, want %v", err, ErrAuthentication)
+		}
+	})
+	t.Run("legacy ciphertext", func(t *testing.T) {
+		iv := make([]byte, c.BlockSize())
+		rand.Read(iv)
+		legacy := make([]byte, len("cleartext"))
+		cipher.NewCTR(c.Block, iv).XORKeyStream(legacy, []byte("cleartext"))
+		got, isLegacy, err := c.decrypt(append(iv, legacy...), []byte("anything"))
+		if err != nil || !isLegacy || string(got) != "cleartext" {
+			t.Errorf("got %q, %v, %v, want cleartext decrypted as legacy", got, isLegacy, err)
+		}
+	})
+	t.Run("short ciphertext", func(t *testing.T) {
+		if _, _, err := c.decrypt(ciphertext[:len(aeadMagic)+1], []byte("ref 1")); err == nil {
+			t.Error("got no error")
+		}
+		if _, _, err := c.decrypt([]byte("short"), nil); err == nil {
+			t.Error("got no error")
+		}
+	})
+}
@@ -10,20 +10,112 @@ type Factory struct {
 	cipher     blockCipher
 	index      storage.Store
 	repository storage.Store
+
+	// Nil unless caching, see WithCache.
+	cache *cache
+
+	// Nil unless profiling, see WithReadProfile.
+	profile *ReadProfile
+
+	// Nil unless journaling seals, see WithSealJournal.
+	journal *SealJournal
+
+	// Nil unless fetching ahead, see WithFetchAhead.
+	fetcher *fetcher
+
+	// Staged values no longer used, see garbage.
+	garbage *garbage
+}
+
+// FactoryOption follows the functional options pattern to configure a Factory.
+type FactoryOption func(*Factory)
+
+// WithCache makes the blocks created by the factory share an in-memory
+// cache of up to the given number of bytes of blocks loaded from the
+// repository. Zero disables the cache.
+func WithCache(bytes int) FactoryOption {
+	return func(factory *Factory) {
+		if bytes > 0 {
+			factory.cache = newCache(bytes)
+		}
+	}
+}
+
+// WithSharedCache makes the blocks created by the factory share the
+// cache of the other factory, if any, e.g., so that factories for the
+// same repository don't each hold a copy of the blocks within budget.
+func WithSharedCache(other *Factory) FactoryOption {
+	return func(factory *Factory) {
+		factory.cache = other.cache
+	}
+}
+
+// WithReadProfile makes the blocks created by the factory record in
+// the profile the order in which they are read from the repository.
+func WithReadProfile(profile *ReadProfile) FactoryOption {
+	return func(factory *Factory) {
+		factory.profile = profile
+	}
+}
+
+// WithSealJournal makes the blocks created by the factory record their
+// progress sealing in the journal, and skip uploading values recorded
+// as uploaded already. Factories sharing an index should share the
+// journal too.
+func WithSealJournal(journal *SealJournal) FactoryOption {
+	return func(factory *Factory) {
+		factory.journal = journal
+	}
+}
+
+// WithFetchAhead lets the blocks created by the factory be fetched
+// from the repository ahead of being read, see Block.Fetch, with up to
+// the given number of fetches in progress. Zero disables fetching
+// ahead, so that Block.Fetch does nothing.
+func WithFetchAhead(parallelism int) FactoryOption {
+	return func(factory *Factory) {
+		if parallelism > 0 {
+			factory.fetcher = newFetcher(factory.repository, parallelism)
+		}
+	}
 }
 
 // NewFactory creates a factory that creates blocks sharing the given cipher,
 // index, and repository.
-func NewFactory(index storage.Store, repository storage.Store, key []byte) (*Factory, error) {
+func NewFactory(index storage.Store, repository storage.Store, key []byte, opts ...FactoryOption) (*Factory, error) {
 	cipher, err := newBlockCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	return &Factory{
+	factory := &Factory{
 		cipher:     cipher,
 		index:      index,
 		repository: repository,
-	}, nil
+		garbage:    newGarbage(),
+	}
+	for _, opt := range opts {
+		opt(factory)
+	}
+	return factory, nil
+}
+
+// CacheStats describes the usage of the factory's cache, if any.
+func (factory *Factory) CacheStats() (stats CacheStats, ok bool) {
+	if factory.cache == nil {
+		return stats, false
+	}
+	return factory.cache.stats(), true
+}
+
+// Contains tells whether the repository holds the value of the block
+// with the given ref, without loading it, e.g., to tell a block that
+// is missing from one that fails to load.
+func (factory *Factory) Contains(ref Ref) (bool, error) {
+	ok, err := factory.repository.Contains(ref.Key())
+	if err != nil {
+		return false, errorv("Factory.Contains", err)
+	}
+	return ok, nil
 }
 
 func (factory *Factory) New(ref Ref, capacity int) (*Block, error) {
@@ -32,6 +124,11 @@ func (factory *Factory) New(ref Ref, capacity int) (*Block, error) {
 		cipher:     factory.cipher,
 		index:      factory.index,
 		repository: factory.repository,
+		cache:      factory.cache,
+		profile:    factory.profile,
+		journal:    factory.journal,
+		fetcher:    factory.fetcher,
+		garbage:    factory.garbage,
 	}
 	switch ref.(type) {
 	case nil:
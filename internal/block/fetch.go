@@ -0,0 +1,82 @@
+package block
+
+import (
+	"sync"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// fetcher gets values from the repository ahead of the blocks being
+// loaded, at most a few at a time, so that a reader skipping through a
+// large file, e.g., a video player, doesn't wait for each block in
+// turn. The values are held until loaded, or until too many others
+// were fetched since, if the reader went elsewhere.
+type fetcher struct {
+	repository storage.Store
+	slots      chan struct{} // Bounds the fetches in progress.
+	max        int
+
+	mu      sync.Mutex
+	fetches map[storage.Key]*fetch
+	order   []storage.Key // Oldest first.
+}
+
+type fetch struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+func newFetcher(repository storage.Store, parallelism int) *fetcher {
+	return &fetcher{
+		repository: repository,
+		slots:      make(chan struct{}, parallelism),
+		max:        4 * parallelism,
+		fetches:    make(map[storage.Key]*fetch),
+	}
+}
+
+// start fetches the value for the key in the background, unless it is
+// being fetched already.
+func (f *fetcher) start(key storage.Key) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.fetches[key]; ok {
+		return
+	}
+	for len(f.order) >= f.max {
+		delete(f.fetches, f.order[0])
+		f.order = f.order[1:]
+	}
+	ft := &fetch{done: make(chan struct{})}
+	f.fetches[key] = ft
+	f.order = append(f.order, key)
+	go func() {
+		f.slots <- struct{}{}
+		ft.value, ft.err = f.repository.Get(key)
+		<-f.slots
+		close(ft.done)
+	}()
+}
+
+// take waits for the value for the key, if it is being fetched, and
+// forgets it, as blocks keep their values once loaded.
+func (f *fetcher) take(key storage.Key) (value []byte, ok bool, err error) {
+	f.mu.Lock()
+	ft, ok := f.fetches[key]
+	if ok {
+		delete(f.fetches, key)
+		for i, k := range f.order {
+			if k == key {
+				f.order = append(f.order[:i], f.order[i+1:]...)
+				break
+			}
+		}
+	}
+	f.mu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+	<-ft.done
+	return ft.value, true, ft.err
+}
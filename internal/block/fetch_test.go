@@ -0,0 +1,100 @@
+package block
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// countingStore counts the values got for each key.
+type countingStore struct {
+	storage.InMemory
+	mu   sync.Mutex
+	gets map[storage.Key]int
+}
+
+func (s *countingStore) Get(key storage.Key) (storage.Value, error) {
+	s.mu.Lock()
+	s.gets[key]++
+	s.mu.Unlock()
+	return s.InMemory.Get(key)
+}
+
+func TestBlockFetch(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	repository := &countingStore{gets: make(map[storage.Key]int)}
+	factory, err := NewFactory(&storage.InMemory{}, repository, key, WithFetchAhead(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []Ref
+	for _, value := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+		b, err := factory.New(nil, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := b.Write([]byte(value), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Seal(); err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, b.Ref())
+	}
+	load := func(i int, fetch int) string {
+		t.Helper()
+		b, err := factory.New(refs[i], 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < fetch; j++ {
+			b.Fetch()
+		}
+		value, err := b.ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Loaded blocks aren't fetched again.
+		b.Fetch()
+		return string(value)
+	}
+	gets := func(i int) int {
+		repository.mu.Lock()
+		defer repository.mu.Unlock()
+		return repository.gets[refs[i].Key()]
+	}
+
+	if got := load(0, 2); got != "a" {
+		t.Errorf("got %q, want a", got)
+	}
+	if got := gets(0); got != 1 {
+		t.Errorf("got %d gets, want 1", got)
+	}
+	if got := load(0, 0); got != "a" || gets(0) != 2 {
+		t.Errorf("got %q after %d gets, want a after 2", got, gets(0))
+	}
+
+	// Values fetched but not read are dropped once there are too many.
+	for i := 1; i < 10; i++ {
+		b, err := factory.New(refs[i], 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Fetch()
+	}
+	factory.fetcher.mu.Lock()
+	if got := len(factory.fetcher.fetches); got != factory.fetcher.max {
+		t.Errorf("got %d fetches held, want %d", got, factory.fetcher.max)
+	}
+	_, held := factory.fetcher.fetches[refs[1].Key()]
+	factory.fetcher.mu.Unlock()
+	if held {
+		t.Error("the oldest fetch is still held")
+	}
+	if got := load(9, 0); got != "j" {
+		t.Errorf("got %q, want j", got)
+	}
+}
@@ -0,0 +1,115 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// Frozen is an immutable copy of a dirty block value, to be written
+// to the index while the block itself keeps changing. Unlike the
+// methods of Block, Frozen.Flush is safe to call concurrently with
+// other operations on the block.
+type Frozen struct {
+	block      *Block // Nil for values not backed by a block.
+	generation uint64
+	ref        Ref
+	value      []byte
+	cipher     blockCipher
+	index      storage.Store
+	garbage    *garbage
+}
+
+// Freeze returns a copy of the block value if the block is dirty, or
+// nil otherwise. The block stays dirty until Frozen.Done is called,
+// but it already points to where the copy will be staged, see restage.
+func (block *Block) Freeze() *Frozen {
+	if block.state != dirty {
+		return nil
+	}
+	block.restage()
+	value := make([]byte, len(block.value))
+	copy(value, block.value)
+	return &Frozen{
+		block:      block,
+		generation: block.generation,
+		ref:        block.ref,
+		value:      value,
+		cipher:     block.cipher,
+		index:      block.index,
+		garbage:    block.garbage,
+	}
+}
+
+// Freeze returns a frozen value, not backed by any block, to be
+// stored in the index under the given ref, e.g., for encoded metadata.
+func (factory *Factory) Freeze(ref IndexRef, value []byte) *Frozen {
+	return &Frozen{
+		ref:    ref,
+		value:  value,
+		cipher: factory.cipher,
+		index:  factory.index,
+	}
+}
+
+// Ref returns the ref the value is stored under.
+func (f *Frozen) Ref() Ref {
+	return f.ref
+}
+
+// Len returns the length of the value, before encryption.
+func (f *Frozen) Len() int {
+	return len(f.value)
+}
+
+// Flush writes the value to the index, unless a block value is staged
+// there already.
+func (f *Frozen) Flush() error {
+	if f.block == nil {
+		ciphertext, err := f.cipher.encrypt(f.value, f.ref.Bytes())
+		if err != nil {
+			return fmt.Errorf("block.Frozen.Flush: %w", err)
+		}
+		if err := f.index.Put(f.ref.Key(), ciphertext); err != nil {
+			return fmt.Errorf("block.Frozen.Flush: %w", err)
+		}
+		return nil
+	}
+	if err := stage(f.index, f.cipher, f.ref, f.value); err != nil {
+		return fmt.Errorf("block.Frozen.Flush: %w", err)
+	}
+	return nil
+}
+
+// Done must be called after a successful Flush, serialized with the
+// other operations on the block. It marks the block clean unless it
+// changed after being frozen. If the block was sealed or discarded in
+// the meantime, the value just written is garbage, and it is deleted.
+func (f *Frozen) Done() {
+	b := f.block
+	if b == nil {
+		return
+	}
+	if b.discarded || b.ref != f.ref {
+		f.Discard()
+		return
+	}
+	if b.state == dirty && b.generation == f.generation {
+		b.state = clean
+	}
+}
+
+// Discard deletes the value from the index, if it was written. A block
+// value may be shared with other blocks, so it is only deleted once
+// none refers to it, see garbage.
+func (f *Frozen) Discard() {
+	if f.block != nil {
+		f.garbage.add(f.ref.Key())
+		return
+	}
+	if err := f.index.Delete(f.ref.Key()); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("block.Frozen.Discard left garbage behind: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package block
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestFrozen(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	index := &storage.InMemory{}
+	factory, err := NewFactory(index, &storage.InMemory{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newFrozen := func(value string) (*Block, *Frozen) {
+		t.Helper()
+		b, err := factory.New(nil, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := b.Write([]byte(value), 0); err != nil {
+			t.Fatal(err)
+		}
+		f := b.Freeze()
+		if err := f.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return b, f
+	}
+
+	t.Run("unchanged block becomes clean", func(t *testing.T) {
+		b, f := newFrozen("hello")
+		f.Done()
+		if b.state != clean {
+			t.Errorf("got state %v, want clean", b.state)
+		}
+		if b.Freeze() != nil {
+			t.Error("froze a clean block")
+		}
+	})
+	t.Run("block changed after freezing stays dirty", func(t *testing.T) {
+		b, f := newFrozen("hello")
+		if _, _, err := b.Write([]byte("j"), 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Done()
+		if b.state != dirty {
+			t.Errorf("got state %v, want dirty", b.state)
+		}
+		// The frozen value is what was written.
+		reloaded, err := factory.New(b.Ref(), 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := reloaded.ReadAll(); err != nil || string(got) != "hello" {
+			t.Errorf("got %q, %v, want the frozen value", got, err)
+		}
+	})
+	t.Run("value of discarded block is deleted after sweeping", func(t *testing.T) {
+		b, f := newFrozen("discarded")
+		b.Discard()
+		f.Done()
+		// Other blocks may share the value until the tree is sealed.
+		if _, err := index.Get(f.Ref().Key()); err != nil {
+			t.Errorf("got %v, want the value kept until sweeping", err)
+		}
+		factory.SweepStaging()
+		if _, err := index.Get(f.Ref().Key()); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+		}
+	})
+	t.Run("blocks with the same value share the staged copy", func(t *testing.T) {
+		a, f := newFrozen("shared")
+		f.Done()
+		b, g := newFrozen("shared")
+		g.Done()
+		if a.Ref() != b.Ref() {
+			t.Errorf("got refs %v and %v, want the same", a.Ref(), b.Ref())
+		}
+		if _, _, err := b.Write([]byte("S"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if f := b.Freeze(); f == nil || f.Ref() == a.Ref() {
+			t.Error("changed value staged in place")
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package block
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// garbage keeps track of the staged values that blocks no longer use.
+// Since blocks with the same value share the staged copy, a value can
+// only be deleted once no block of the tree refers to it, whether
+// loaded or not. Once the refs of the whole tree are counted, see
+// Factory.CountStaged, a value the last block moved off is deleted
+// after the next flush, see Factory.UnusedStaging. Until then, and for
+// values not counted, e.g., those of node metadata, they are only
+// deleted after the next seal, see Factory.SweepStaging.
+type garbage struct {
+	mu      sync.Mutex
+	counted bool
+	refs    map[storage.Key]int
+	unused  map[storage.Key]struct{} // Deleted after the next flush.
+	sealed  map[storage.Key]struct{} // Deleted after the next seal.
+}
+
+func newGarbage() *garbage {
+	return &garbage{
+		refs:   make(map[storage.Key]int),
+		unused: make(map[storage.Key]struct{}),
+		sealed: make(map[storage.Key]struct{}),
+	}
+}
+
+// acquire records that a block moved onto the key.
+func (g *garbage) acquire(key storage.Key) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.counted {
+		g.refs[key]++
+	}
+}
+
+// release records that a block moved off the key.
+func (g *garbage) release(key storage.Key) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n, ok := g.refs[key]
+	switch {
+	case !ok:
+		g.sealed[key] = struct{}{}
+	case n > 1:
+		g.refs[key] = n - 1
+	default:
+		delete(g.refs, key)
+		g.unused[key] = struct{}{}
+	}
+}
+
+// add records that the value staged under the key may not be in use,
+// e.g., written for a block that moved off it in the meantime.
+func (g *garbage) add(key storage.Key) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch {
+	case !g.counted:
+		g.sealed[key] = struct{}{}
+	case g.refs[key] == 0:
+		g.unused[key] = struct{}{}
+	}
+}
+
+// CountStaged makes the factory count the blocks referring to each
+// staged value, starting from the given refs, which must be those of
+// the whole tree, e.g., as collected by tree.Tree.RecoverStaging, with
+// repetitions. It must be called before the tree changes.
+func (factory *Factory) CountStaged(inUse []IndexRef) {
+	g := factory.garbage
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.counted = true
+	for _, ref := range inUse {
+		g.refs[ref.Key()]++
+	}
+}
+
+// UnusedStaging returns the keys of the staged values that no block
+// refers to since they were last returned. They are to be deleted with
+// DeleteStaging once the tree saved as the local root no longer refers
+// to them, e.g., after the next flush.
+func (factory *Factory) UnusedStaging() []storage.Key {
+	g := factory.garbage
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	keys := make([]storage.Key, 0, len(g.unused))
+	for key := range g.unused {
+		keys = append(keys, key)
+	}
+	g.unused = make(map[storage.Key]struct{})
+	return keys
+}
+
+// DeleteStaging deletes from the index the values staged under the
+// given keys that no block refers to, e.g., those returned by
+// UnusedStaging. It returns how many values were deleted.
+func (factory *Factory) DeleteStaging(keys []storage.Key) (n int) {
+	g := factory.garbage
+	g.mu.Lock()
+	var unused []storage.Key
+	for _, key := range keys {
+		// Staged again since, by a block moving onto it.
+		if g.refs[key] == 0 {
+			unused = append(unused, key)
+		}
+	}
+	g.mu.Unlock()
+	return factory.deleteStaging(unused)
+}
+
+// SweepStaging deletes from the index the staged values no longer used
+// by the blocks made by the factory. It must only be called once the
+// tree is sealed, i.e., once no block is backed by the index. It
+// returns how many values were deleted.
+func (factory *Factory) SweepStaging() (n int) {
+	g := factory.garbage
+	g.mu.Lock()
+	var keys []storage.Key
+	for _, m := range []map[storage.Key]struct{}{g.unused, g.sealed} {
+		for key := range m {
+			// Still used by a node not sealed, e.g., an open
+			// file that was removed.
+			if g.refs[key] == 0 {
+				keys = append(keys, key)
+			}
+		}
+	}
+	g.unused = make(map[storage.Key]struct{})
+	g.sealed = make(map[storage.Key]struct{})
+	g.mu.Unlock()
+	return factory.deleteStaging(keys)
+}
+
+func (factory *Factory) deleteStaging(keys []storage.Key) (n int) {
+	for _, key := range keys {
+		if err := factory.index.Delete(key); err == nil {
+			n++
+		} else if !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("block.Factory.SweepStaging left garbage behind: %v", err)
+		}
+	}
+	return n
+}
@@ -0,0 +1,170 @@
+package block
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// SealJournal records the progress of sealing, i.e., which values were
+// uploaded to the repository, and which repository blocks replace which
+// staged blocks. Sealing a large tree can then resume where it stopped
+// rather than upload everything again, and the blocks it sealed can
+// still be loaded, from the repository, if their staged copies are gone.
+//
+// Each line of the file is the hex of a staged block's ref followed by
+// that of the repository block it was sealed to. Later lines win.
+type SealJournal struct {
+	mu       sync.Mutex
+	f        *os.File
+	uploaded map[RepositoryRef]struct{}
+	replaced map[IndexRef]RepositoryRef
+}
+
+// OpenSealJournal opens the journal at pathname, creating it if it
+// doesn't exist, and reads the progress recorded so far.
+func OpenSealJournal(pathname string) (*SealJournal, error) {
+	const method = "OpenSealJournal"
+	f, err := os.OpenFile(pathname, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errorv(method, err)
+	}
+	j := &SealJournal{
+		f:        f,
+		uploaded: make(map[RepositoryRef]struct{}),
+		replaced: make(map[IndexRef]RepositoryRef),
+	}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// Skip malformed lines, e.g., one partially written
+		// before a crash.
+		if index, repo, ok := parseJournalLine(s.Text()); ok {
+			j.uploaded[repo] = struct{}{}
+			j.replaced[index] = repo
+		}
+	}
+	if err := s.Err(); err != nil {
+		_ = f.Close()
+		return nil, errorv(method, err)
+	}
+	return j, nil
+}
+
+func parseJournalLine(line string) (index IndexRef, repo RepositoryRef, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return
+	}
+	if b, err := hex.DecodeString(fields[0]); err != nil || len(b) != indexRefLen {
+		return
+	} else {
+		copy(index[:], b)
+	}
+	if b, err := hex.DecodeString(fields[1]); err != nil || len(b) != repositoryRefLen {
+		return
+	} else {
+		copy(repo[:], b)
+	}
+	return index, repo, true
+}
+
+// record persists that the staged block is, or will be, replaced by
+// the repository block, which was uploaded.
+func (j *SealJournal) record(index IndexRef, repo RepositoryRef) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := fmt.Fprintf(j.f, "%v %v\n", index, repo); err != nil {
+		return errorv("SealJournal.record", err)
+	}
+	// The staged block may be deleted next.
+	if err := j.f.Sync(); err != nil {
+		return errorv("SealJournal.record", err)
+	}
+	j.uploaded[repo] = struct{}{}
+	j.replaced[index] = repo
+	return nil
+}
+
+func (j *SealJournal) isUploaded(repo RepositoryRef) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, ok := j.uploaded[repo]
+	return ok
+}
+
+func (j *SealJournal) replacement(index IndexRef) (RepositoryRef, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	repo, ok := j.replaced[index]
+	return repo, ok
+}
+
+// Clear forgets the progress recorded, once the sealed tree is saved.
+func (j *SealJournal) Clear() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.f.Truncate(0); err != nil {
+		return errorv("SealJournal.Clear", err)
+	}
+	j.uploaded = make(map[RepositoryRef]struct{})
+	j.replaced = make(map[IndexRef]RepositoryRef)
+	return nil
+}
+
+// Close closes the journal file, keeping the progress recorded.
+func (j *SealJournal) Close() error {
+	return j.f.Close()
+}
+
+// Preseal uploads the value of the staged block to the repository,
+// recording it in the seal journal, so that sealing the block later
+// does not upload it again, unless it changed. Unlike the methods of
+// Block, it can run concurrently with other uses of the blocks. It does
+// nothing without a seal journal, or if the block is not staged.
+func (factory *Factory) Preseal(ref IndexRef) error {
+	const method = "Factory.Preseal"
+	if factory.journal == nil {
+		return nil
+	}
+	ciphertext, err := factory.index.Get(ref.Key())
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return errorv(method, err)
+	}
+	value, _, err := factory.cipher.decrypt(ciphertext, ref.Bytes())
+	if err != nil {
+		return errorf(method, "%v: %w", ref.Key(), err)
+	}
+	repo := RefOf(value)
+	if factory.journal.isUploaded(repo) {
+		return nil
+	}
+	// Encrypted again, as ciphertexts are bound to their refs.
+	if ciphertext, err = factory.cipher.encrypt(value, repo.Bytes()); err != nil {
+		return errorv(method, err)
+	}
+	if err := factory.repository.Put(repo.Key(), ciphertext); err != nil {
+		return errorv(method, err)
+	}
+	if err := factory.journal.record(ref, repo); err != nil {
+		return errorv(method, err)
+	}
+	return nil
+}
+
+// ClearSealJournal forgets the progress recorded in the seal journal,
+// if any, once the sealed tree is saved.
+func (factory *Factory) ClearSealJournal() error {
+	if factory.journal == nil {
+		return nil
+	}
+	return factory.journal.Clear()
+}
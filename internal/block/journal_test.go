@@ -0,0 +1,105 @@
+package block
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestSealJournal(t *testing.T) {
+	pathname := filepath.Join(t.TempDir(), "seal.journal")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	index := &storage.InMemory{}
+	repository := &storage.InMemory{}
+	metrics := storage.NewMetrics()
+	puts := func() int64 {
+		t.Helper()
+		_, entries := metrics.Snapshot()
+		for _, e := range entries {
+			if e.Op == "put" {
+				return e.Calls
+			}
+		}
+		return 0
+	}
+	journal, err := OpenSealJournal(pathname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory, err := NewFactory(index, storage.Metered(repository, "repository", metrics), key, WithSealJournal(journal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage := func(value string) *Block {
+		t.Helper()
+		b, err := factory.New(nil, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := b.Write([]byte(value), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	presealed := stage("presealed")
+	changed := stage("changed")
+	staged := presealed.Ref().(IndexRef)
+
+	// The first phase uploads the staged values.
+	for _, b := range []*Block{presealed, changed} {
+		if err := factory.Preseal(b.Ref().(IndexRef)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := puts(); got != 2 {
+		t.Fatalf("got %d puts, want 2", got)
+	}
+
+	// The second phase only uploads what changed meanwhile.
+	if _, _, err := changed.Write([]byte("C"), 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*Block{presealed, changed} {
+		if _, err := b.Seal(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := puts(); got != 3 {
+		t.Errorf("got %d puts, want 3", got)
+	}
+
+	// The progress survives a restart, and the sealed blocks can still
+	// be loaded if their staged copies are gone.
+	factory.SweepStaging()
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if journal, err = OpenSealJournal(pathname); err != nil {
+		t.Fatal(err)
+	}
+	if factory, err = NewFactory(index, repository, key, WithSealJournal(journal)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := factory.New(staged, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := b.ReadAll(); err != nil || string(value) != "presealed" {
+		t.Errorf("got %q, %v, want the presealed value", value, err)
+	}
+	if _, ok := b.Ref().(RepositoryRef); !ok {
+		t.Errorf("got %T, want the block to be found in the repository", b.Ref())
+	}
+
+	if err := factory.ClearSealJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := journal.replacement(staged); ok {
+		t.Error("replacement still recorded after clearing")
+	}
+	_ = journal.Close()
+}
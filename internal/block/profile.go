@@ -0,0 +1,91 @@
+package block
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// ReadProfile records the order in which blocks are first read from
+// the repository, e.g., as a media file is played, so that the blocks
+// can later be prefetched in the order they are needed.
+type ReadProfile struct {
+	mu   sync.Mutex
+	max  int
+	seen map[storage.Key]struct{}
+	keys []storage.Key
+}
+
+// NewReadProfile returns a profile recording up to max keys; later
+// reads are not recorded.
+func NewReadProfile(max int) *ReadProfile {
+	return &ReadProfile{max: max, seen: make(map[storage.Key]struct{})}
+}
+
+func (p *ReadProfile) record(key storage.Key) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.keys) >= p.max {
+		return
+	}
+	if _, ok := p.seen[key]; ok {
+		return
+	}
+	p.seen[key] = struct{}{}
+	p.keys = append(p.keys, key)
+}
+
+// Keys returns the keys read so far, in the order they were first
+// read.
+func (p *ReadProfile) Keys() []storage.Key {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]storage.Key(nil), p.keys...)
+}
+
+// Save atomically replaces the file at pathname with the keys read so
+// far, one per line, in read order. Nothing is written if no keys were
+// read, not to lose the hint saved by a previous run.
+func (p *ReadProfile) Save(pathname string) error {
+	keys := p.Keys()
+	if len(keys) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(string(k))
+		b.WriteByte('\n')
+	}
+	if err := ioutil.WriteFile(pathname+".new", []byte(b.String()), 0600); err != nil {
+		return errorv("ReadProfile.Save", err)
+	}
+	if err := os.Rename(pathname+".new", pathname); err != nil {
+		return errorv("ReadProfile.Save", err)
+	}
+	return nil
+}
+
+// LoadReadOrder reads the keys saved by ReadProfile.Save.
+func LoadReadOrder(pathname string) ([]storage.Key, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return nil, fmt.Errorf("github.com/nicolagi/muscle/internal/block.LoadReadOrder: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	var keys []storage.Key
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			keys = append(keys, storage.Key(line))
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errorv("LoadReadOrder", err)
+	}
+	return keys, nil
+}
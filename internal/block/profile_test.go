@@ -0,0 +1,62 @@
+package block
+
+import (
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestReadProfile(t *testing.T) {
+	index, repository := &storage.InMemory{}, &storage.InMemory{}
+	key := make([]byte, 16)
+	rand.Read(key)
+	writer, err := NewFactory(index, repository, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []Ref
+	for _, content := range []string{"one", "two", "three"} {
+		b, err := writer.New(nil, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := b.Write([]byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Seal(); err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, b.Ref())
+	}
+
+	profile := NewReadProfile(2)
+	reader, err := NewFactory(index, repository, key, WithReadProfile(profile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{1, 0, 1, 2} {
+		b, err := reader.New(refs[i], 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.ReadAll(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The third block is not recorded, the profile is full.
+	want := []storage.Key{refs[1].Key(), refs[0].Key()}
+	if got := profile.Keys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	pathname := filepath.Join(t.TempDir(), "read.order")
+	if err := profile.Save(pathname); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := LoadReadOrder(pathname); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, %v, want %v", got, err, want)
+	}
+}
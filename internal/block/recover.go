@@ -0,0 +1,101 @@
+package block
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// StagingRecovery describes what RecoverStaging did.
+type StagingRecovery struct {
+	// Staged values not in use.
+	Orphaned int
+
+	// Orphans deleted because the seal journal maps them to
+	// repository blocks, which replace them.
+	Reattached int
+
+	// Orphans moved to the quarantine store.
+	Quarantined int
+}
+
+// RecoverStaging finds the values staged in the index, which the
+// lister lists, that are not in use, e.g., left behind by a crash
+// between a flush and saving the root referring to them. An orphan the
+// seal journal maps to a block in the repository is reattached: loading
+// its ref finds the repository block, so the staged copy is deleted.
+// Any other orphan is moved to the quarantine store, under the same
+// key, rather than deleted, in case it is needed after all.
+//
+// The refs in use must be complete, e.g., collected from the whole
+// tree, and no block may be staged meanwhile.
+func (factory *Factory) RecoverStaging(ctx context.Context, staging storage.Lister, inUse []IndexRef, quarantine storage.Store) (r StagingRecovery, err error) {
+	const method = "Factory.RecoverStaging"
+	used := make(map[storage.Key]struct{}, len(inUse))
+	for _, ref := range inUse {
+		used[ref.Key()] = struct{}{}
+	}
+	var orphans []IndexRef
+	err = storage.ListAll(ctx, staging, func(ki storage.KeyInfo) error {
+		if _, ok := used[ki.Key]; ok {
+			return nil
+		}
+		// Leave alone what isn't a staged block.
+		b, err := hex.DecodeString(string(ki.Key))
+		if err != nil || len(b) != indexRefLen {
+			return nil
+		}
+		var ref IndexRef
+		copy(ref[:], b)
+		orphans = append(orphans, ref)
+		return nil
+	})
+	if err != nil {
+		return r, errorv(method, err)
+	}
+	r.Orphaned = len(orphans)
+	for _, ref := range orphans {
+		if reattached, err := factory.reattach(ref); err != nil {
+			return r, errorv(method, err)
+		} else if reattached {
+			r.Reattached++
+			continue
+		}
+		value, err := factory.index.Get(ref.Key())
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return r, errorv(method, err)
+		}
+		if err := quarantine.Put(ref.Key(), value); err != nil {
+			return r, errorv(method, err)
+		}
+		if err := factory.index.Delete(ref.Key()); err != nil {
+			return r, errorv(method, err)
+		}
+		r.Quarantined++
+	}
+	return r, nil
+}
+
+// reattach deletes the staged value if the seal journal maps it to a
+// block the repository has.
+func (factory *Factory) reattach(ref IndexRef) (bool, error) {
+	if factory.journal == nil {
+		return false, nil
+	}
+	repo, ok := factory.journal.replacement(ref)
+	if !ok {
+		return false, nil
+	}
+	if ok, err := factory.repository.Contains(repo.Key()); err != nil || !ok {
+		return false, err
+	}
+	if err := factory.index.Delete(ref.Key()); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,78 @@
+package block
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestFactoryRecoverStaging(t *testing.T) {
+	journal, err := OpenSealJournal(filepath.Join(t.TempDir(), "seal.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = journal.Close() }()
+	index := &storage.InMemory{}
+	factory, err := NewFactory(index, &storage.InMemory{}, make([]byte, 16), WithSealJournal(journal))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage := func(value string) IndexRef {
+		t.Helper()
+		b, err := factory.New(nil, 8192)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := b.Write([]byte(value), 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return b.Ref().(IndexRef)
+	}
+	used := stage("used")
+	sealed := stage("sealed")
+	lost := stage("lost")
+	if err := factory.Preseal(sealed); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Put("lock", []byte("not a block")); err != nil {
+		t.Fatal(err)
+	}
+
+	quarantine := &storage.InMemory{}
+	r, err := factory.RecoverStaging(context.Background(), index, []IndexRef{used}, quarantine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (StagingRecovery{Orphaned: 2, Reattached: 1, Quarantined: 1}); r != want {
+		t.Errorf("got %+v, want %+v", r, want)
+	}
+	for _, c := range []struct {
+		store storage.Store
+		key   storage.Key
+		want  bool
+	}{
+		{index, used.Key(), true},
+		{index, sealed.Key(), false},
+		{index, lost.Key(), false},
+		{index, "lock", true},
+		{quarantine, lost.Key(), true},
+	} {
+		if ok, _ := c.store.Contains(c.key); ok != c.want {
+			t.Errorf("%v: got %v, want %v", c.key, ok, c.want)
+		}
+	}
+
+	// The reattached block loads from the repository.
+	b, err := factory.New(sealed, 8192)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := b.ReadAll(); err != nil || string(value) != "sealed" {
+		t.Errorf("got %q, %v, want the sealed value", value, err)
+	}
+}
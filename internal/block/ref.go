@@ -67,6 +67,14 @@ func (ref IndexRef) String() string {
 	return fmt.Sprintf("%x", ref[:])
 }
 
+// stagedRefOf returns where a block value is staged, see
+// Block.restage.
+func stagedRefOf(value []byte) (ref IndexRef) {
+	sum := sha256.Sum256(value)
+	copy(ref[:], sum[:])
+	return
+}
+
 type RepositoryRef [repositoryRefLen]byte
 
 func RefOf(value []byte) RepositoryRef {
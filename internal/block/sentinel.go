@@ -0,0 +1,60 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// SentinelKey is the key, in the store of tags, of a known cleartext
+// encrypted with the encryption key. Keeping it next to the tags, rather
+// than on each host, lets a new host configured with the wrong key for
+// an existing store find out before it uses the key on blocks.
+const SentinelKey storage.Key = "sentinel"
+
+// The cleartext of the sentinel. Decrypting with the wrong key fails
+// authentication, but the cleartext is compared all the same.
+var sentinelCleartext = []byte("muscle encryption key sentinel\n")
+
+// ErrWrongKey means the encryption key is not the one the sentinel
+// was written with.
+var ErrWrongKey = errors.New("wrong encryption key")
+
+// WriteSentinel writes a known cleartext encrypted with the key to the
+// store under SentinelKey, so that CheckSentinel can later tell
+// whether a key is the same, before using it on blocks.
+func WriteSentinel(store storage.Store, key []byte) error {
+	const method = "WriteSentinel"
+	c, err := newBlockCipher(key)
+	if err != nil {
+		return errorv(method, err)
+	}
+	ciphertext, err := c.encrypt(sentinelCleartext, []byte(SentinelKey))
+	if err != nil {
+		return errorv(method, err)
+	}
+	if err := store.Put(SentinelKey, ciphertext); err != nil {
+		return errorf(method, "%w", err)
+	}
+	return nil
+}
+
+// CheckSentinel returns an error wrapping ErrWrongKey if the key does
+// not decrypt the sentinel in the store, and one wrapping
+// storage.ErrNotFound if there is no sentinel.
+func CheckSentinel(store storage.Store, key []byte) error {
+	const method = "CheckSentinel"
+	ciphertext, err := store.Get(SentinelKey)
+	if err != nil {
+		return errorf(method, "%w", err)
+	}
+	c, err := newBlockCipher(key)
+	if err != nil {
+		return errorv(method, err)
+	}
+	if cleartext, _, err := c.decrypt(ciphertext, []byte(SentinelKey)); err != nil || !bytes.Equal(cleartext, sentinelCleartext) {
+		return errorf(method, "%w", ErrWrongKey)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package block
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestSentinel(t *testing.T) {
+	store := &storage.InMemory{}
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := CheckSentinel(store, key); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("got %v, want %v", err, storage.ErrNotFound)
+	}
+	if err := WriteSentinel(store, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSentinel(store, key); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	other := []byte("fedcba9876543210fedcba9876543210")
+	if err := CheckSentinel(store, other); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("got %v, want %v", err, ErrWrongKey)
+	}
+	if err := store.Put(SentinelKey, []byte("short")); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSentinel(store, key); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("got %v, want %v", err, ErrWrongKey)
+	}
+}
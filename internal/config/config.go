@@ -14,6 +14,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -65,22 +66,247 @@ type C struct {
 	// data.
 	EncryptionKey string
 
+	// If set, instead of EncryptionKey, S3SecretKey, B2ApplicationKey
+	// and WebDAVPassword, commands run
+	// with the shell at load time that write the secrets to standard
+	// output, e.g., "pass show muscle/key", so that the secrets need
+	// not be in the configuration file.
+	EncryptionKeyCommand    string
+	S3SecretCommand         string
+	B2ApplicationKeyCommand string
+	WebDAVPasswordCommand   string
+
 	// Path to cache. Defaults to $HOME/lib/muscle/cache.
 	CacheDirectory string
 
-	// Permanent storage type - can be "s3" or "null" at present.
+	// Permanent storage type - can be "b2", "disk", "memory", "null",
+	// "s3", "sftp" or "webdav".
+	// Memory storage lasts as long as the process, for demos and tests.
 	Storage string
 
-	// These only make sense if the storage type is "s3".
+	// These only make sense if the storage type is "s3". Without
+	// the keys, credentials are found as the AWS tools would, e.g.,
+	// in the environment or from the instance profile on EC2.
 	S3Region    string
 	S3Bucket    string
 	S3AccessKey string
 	S3SecretKey string
 
+	// These only make sense if the storage type is "sftp". The host is
+	// passed to ssh, so it can be an alias from ~/.ssh/config, and the
+	// directory is on the host, relative to the home directory unless
+	// absolute. The command, if set, is run with the shell instead of
+	// "ssh -s HOST sftp" and must speak SFTP on its standard input and
+	// output, e.g., to pass options to ssh.
+	SFTPHost    string
+	SFTPDir     string
+	SFTPCommand string
+
+	// These only make sense if the storage type is "b2". Requests
+	// failing because B2 is busy are retried with exponential backoff,
+	// but at most B2RetryBudget retries per request are made in the
+	// long run, 0.1 if zero, so that a struggling B2 doesn't get many
+	// more requests than it would if nothing were retried.
+	B2KeyID          string
+	B2ApplicationKey string
+	B2Bucket         string
+	B2RetryBudget    float64
+
+	// These only make sense if the storage type is "webdav", which
+	// also works with plain HTTP servers accepting PUT and DELETE,
+	// except for listing. The URL is of the directory holding the
+	// items. Without a user and password, requests aren't
+	// authenticated.
+	WebDAVURL      string
+	WebDAVUser     string
+	WebDAVPassword string
+
 	// These only make sense if the storage type is "disk".
 	// If the path is relative, it will be assumed relative to the base dir.
 	DiskStoreDir string
 
+	// Log warnings when the propagation backlog (items in the cache
+	// that are not yet in permanent storage) exceeds either limit.
+	// Zero values disable the corresponding check.
+	PropagationAlertPending int
+	PropagationAlertAge     time.Duration
+
+	// If set, the segments of the propagation log are compressed with
+	// zstd once full, keeping a separate index of the items' states,
+	// so that a large backlog takes less space.
+	CompressPropagationLog bool
+
+	// If set, revisions and nodes are written to permanent storage
+	// synchronously when sealed, rather than propagated in the
+	// background like data blocks, so remote tags never point to
+	// metadata that was not uploaded.
+	MetadataWriteThrough bool
+
+	// How many of the most recent 9P requests musclefs keeps for the
+	// trace control command. Zero disables tracing.
+	TraceRequests int
+
+	// Log 9P requests, waits for the tree lock, and storage calls
+	// that take at least this long. Zero disables logging.
+	SlowThreshold time.Duration
+
+	// How often musclefs checks whether to flush changes to the
+	// staging area, and the minimum time between such flushes. Zero
+	// means tree.SnapshotFrequency. Both can be changed at run time
+	// with the snapshot-frequency and flush-interval commands.
+	SnapshotFrequency time.Duration
+	FlushInterval     time.Duration
+
+	// Limits on the bytes in the staging area. Past the soft limit,
+	// musclefs seals the tree, which moves staged data to the cache;
+	// past the hard limit, writes fail with ENOSPC. Zero values
+	// disable the corresponding limit.
+	StagingSoftLimit int64
+	StagingHardLimit int64
+
+	// Size in bytes of the in-memory cache of decrypted blocks, so
+	// that hot blocks, e.g., of directories, aren't read from the
+	// disk cache and decrypted on every traversal. If metadata is
+	// written through, its blocks share the same cache. Zero disables
+	// the cache.
+	BlockCacheSize int
+
+	// How many blocks musclefs fetches at a time from permanent
+	// storage ahead of reads: the other blocks a read needs, and,
+	// for sequential or strided reads, those the next reads will
+	// need. Zero disables fetching ahead.
+	FetchAhead int
+
+	// If set, musclefs exports OpenTelemetry spans for 9P requests,
+	// control commands, and storage calls to this OTLP/HTTP endpoint,
+	// e.g., http://localhost:4318 for a local Jaeger.
+	OTLPEndpoint string
+
+	// If MirrorListenAddr is set, musclefs serves the blocks in its
+	// cache over HTTP on that address, e.g., ":4000", to requests
+	// bearing MirrorToken. If MirrorURL is set, e.g., to
+	// "http://peer:4000", musclefs reads blocks from that peer before
+	// the remote store, sending MirrorToken. Blocks are encrypted, but
+	// the token should still be kept secret.
+	MirrorListenAddr string
+	MirrorURL        string
+	MirrorToken      string
+
+	// Read-only copies of the remote store, e.g., kept in sync by
+	// other means, defined by lines like "replica nas disk
+	// /mnt/nas/muscle" or "replica peer mirror http://peer:4000". The
+	// latter use MirrorToken. Reads go to the healthy store, the
+	// remote store included, with the lowest latency, and fail over to
+	// the others on errors; writes go to the remote store only.
+	Replicas []Replica
+
+	// Remote tags shown as read-only directories at the root of the
+	// file system, next to the live tree, defined by lines like "bind
+	// laptop" or "bind laptop other", the second field naming the
+	// directory if given, e.g., to copy files from the latest push of
+	// another host. They are updated on startup and on pull.
+	Binds []Bind
+
+	// If positive, musclefs keeps up to this many bytes of encrypted
+	// blocks in memory, above the disk cache, defined by a line like
+	// "memory-tier 268435456 second-read". The optional policy, one of
+	// "always" (the default), "second-read", or "never", says when
+	// blocks read from the disk cache are copied into memory.
+	MemoryTierCapacity  int64
+	MemoryTierPromotion string
+
+	// Per-connection limits on the 9P requests per second and on the
+	// bytes read or written per second, so that one client can't
+	// starve the others. Requests over the limits are delayed. Zero
+	// values disable the corresponding limit.
+	RateLimitOps   int
+	RateLimitBytes int
+
+	// New files that are append-only or whose names match any of the
+	// patterns use blocks of this size rather than BlockSize, so that
+	// appending or changing a few bytes re-uploads less data.
+	// Zero disables the option.
+	SmallBlockSize  uint32
+	SmallBlockFiles []string
+
+	// Control file commands that expand to a sequence of commands
+	// separated by semicolons, defined by lines like
+	// "alias sync flush; pull; push".
+	Aliases map[string]string
+
+	// Strategies to resolve pull conflicts for paths matching the
+	// patterns without manual intervention, defined by lines like
+	// "merge-strategy *.log theirs", tried in order. See
+	// MergeStrategyRule.
+	MergeStrategies []MergeStrategyRule
+
+	// The cost model for the remote store, used by "muscle stats" to
+	// estimate the monthly bill: prices per thousand calls of an
+	// operation (get, put, delete, contains, list for a page of keys,
+	// deletebatch for a batch of deletions, and cas for a conditional
+	// update), defined by lines like "request-cost get 0.0004", and
+	// the price per GiB read, defined by a line like
+	// "transfer-cost 0.09".
+	RequestCosts map[string]float64
+	TransferCost float64
+
+	// When musclefs updates access times: "off" (the default), "on",
+	// or "relatime", for updates only if the access time is older than
+	// the modification time or than a day. Access times are persisted,
+	// so updating them causes flushes and uploads even if nothing was
+	// modified.
+	Atime string
+
+	// If set, file names are looked up ignoring case, though they are
+	// stored as created, as expected by macOS and Windows clients.
+	CaseInsensitive bool
+
+	// What to do with names of new or renamed files that are not
+	// valid UTF-8 or have trailing spaces: "allow" them (the default),
+	// "reject" them, or "normalize" them. Names that can't be walked
+	// to, like "..", are always rejected.
+	NamePolicy string
+
+	// Maximum depth of directories reached by walks and diffs, as a
+	// protection against loops. Zero means the tree package default.
+	MaxDepth int
+
+	// Files larger than this many bytes are not diffed by the diff
+	// commands; the byte ranges of their blocks that changed are
+	// reported instead. Zero means the tree package default.
+	DiffMaxSize int64
+
+	// If set, grafts (including those made to pull) set the
+	// modification time of the destination directory to that of the
+	// source directory, as with the --preserve-mtime graft flag.
+	PreserveMtime bool
+
+	// Close 9P connections with no requests for this long, destroying
+	// their fids, e.g., for clients that went away without closing
+	// them. Zero disables the timeout.
+	IdleTimeout time.Duration
+
+	// How long the DMEXCL locks of a 9P connection that went away are
+	// kept, if the client attached with a session token ("session=TOKEN"
+	// as the attach name), so that it can reclaim them by attaching
+	// again with the same token. Zero releases locks right away.
+	SessionGrace time.Duration
+
+	// How often musclefs records, in the remote store, its host and
+	// when it last flushed and pushed, for "muscle status -all"; it also
+	// does after each push. Zero means every 15 minutes.
+	HeartbeatInterval time.Duration
+
+	// "muscle status" flags hosts that haven't pushed for longer than
+	// this. Zero means a week.
+	StaleAfter time.Duration
+
+	// After each attach, musclefs loads the directories of the live
+	// tree this many levels deep in the background, so that listing
+	// them on a cold cache doesn't wait for one load after the other.
+	// Zero disables prefetching.
+	PrefetchDepth int
+
 	// Directory holding muscle config file and other files.
 	// Other directories and files are derived from this.
 	base string
@@ -89,6 +315,33 @@ type C struct {
 	encryptionKey []byte
 }
 
+// A MergeStrategyRule says how pull resolves conflicts for the paths
+// matching Pattern, with the syntax of path.Match, which is matched
+// against the last element of the path if it has no slashes, e.g.,
+// "*.log", and against the path relative to the root otherwise. The
+// Strategy is one of "ours" (keep the local version), "theirs" (take
+// the remote one), "newest" (take the one modified last), or "manual"
+// (leave the conflict to be resolved by hand).
+type MergeStrategyRule struct {
+	Pattern  string
+	Strategy string
+}
+
+// A Replica is a read-only copy of the remote store. Kind is "disk",
+// with Location the directory, relative to the base directory unless
+// absolute, or "mirror", with Location the URL of a peer's mirror.
+type Replica struct {
+	Name     string
+	Kind     string
+	Location string
+}
+
+// A Bind shows the remote tag Tag as the directory Name, see C.Binds.
+type Bind struct {
+	Tag  string
+	Name string
+}
+
 // Load loads the configuration from the file called "config" in the provided base
 // directory.
 func Load(base string) (*C, error) {
@@ -108,22 +361,40 @@ func Load(base string) (*C, error) {
 		_ = f.Close()
 	}()
 	c, err := load(f)
-	if err == nil {
-		c.base = base
+	if err != nil {
+		return nil, err
+	}
+	c.base = base
+	if err := c.resolveSecrets(); err != nil {
+		return nil, err
 	}
 	c.encryptionKey, err = hex.DecodeString(c.EncryptionKey)
-	if err != nil {
+	if err != nil && c.EncryptionKeyCommand != "" {
+		// Don't log the secret.
+		err = fmt.Errorf("output of encryption-key-command: %w", err)
+	} else if err != nil {
 		err = fmt.Errorf("%q: %w", c.EncryptionKey, err)
 	}
 	if c.DiskStoreDir != "" && !filepath.IsAbs(c.DiskStoreDir) {
 		c.DiskStoreDir = filepath.Clean(filepath.Join(c.base, c.DiskStoreDir))
 	}
+	for i, r := range c.Replicas {
+		if r.Kind == "disk" && !filepath.IsAbs(r.Location) {
+			c.Replicas[i].Location = filepath.Clean(filepath.Join(c.base, r.Location))
+		}
+		if err == nil && r.Kind == "mirror" && c.MirrorToken == "" {
+			err = fmt.Errorf("mirror-token is required with mirror replicas")
+		}
+	}
 	if c.ListenNet == "" && c.ListenAddr == "" {
 		c.ListenNet = "unix"
 	}
 	if c.ListenNet == "unix" && c.ListenAddr == "" {
 		c.ListenAddr = fmt.Sprintf("%s/muscle", clientNamespace())
 	}
+	if err == nil && (c.MirrorListenAddr != "" || c.MirrorURL != "") && c.MirrorToken == "" {
+		err = fmt.Errorf("mirror-token is required with mirror-listen-addr or mirror-url")
+	}
 	return c, err
 }
 
@@ -140,26 +411,349 @@ func load(f io.Reader) (*C, error) {
 			return nil, fmt.Errorf("load: no separator in %q", line)
 		}
 		switch key, val := line[:i], strings.TrimSpace(line[i:]); key {
+		case "atime":
+			switch val {
+			case "off", "on", "relatime":
+				c.Atime = val
+			default:
+				return nil, fmt.Errorf("load: %q: unknown value %q", key, val)
+			}
+		case "case-insensitive":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.CaseInsensitive = b
 		case "cache-directory":
 			c.CacheDirectory = val
+		case "compress-propagation-log":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.CompressPropagationLog = b
+		case "diff-max-size":
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			if n < 0 {
+				return nil, fmt.Errorf("load: %q: negative value %d", key, n)
+			}
+			c.DiffMaxSize = n
 		case "disk-store-dir":
 			c.DiskStoreDir = val
 		case "encryption-key":
 			c.EncryptionKey = val
+		case "encryption-key-command":
+			c.EncryptionKeyCommand = val
+		case "flush-interval":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			if d < 0 {
+				return nil, fmt.Errorf("load: %q: negative value %v", key, d)
+			}
+			c.FlushInterval = d
+		case "idle-timeout":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.IdleTimeout = d
+		case "heartbeat-interval":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.HeartbeatInterval = d
+		case "stale-after":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.StaleAfter = d
+		case "session-grace":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.SessionGrace = d
 		case "listen-addr":
 			c.ListenAddr = val
 		case "listen-net":
 			c.ListenNet = val
+		case "metadata-write-through":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.MetadataWriteThrough = b
+		case "memory-tier":
+			fields := strings.Fields(val)
+			if len(fields) < 1 || len(fields) > 2 {
+				return nil, fmt.Errorf("load: %q: want a capacity and an optional policy, got %q", key, val)
+			}
+			n, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.MemoryTierCapacity = n
+			c.MemoryTierPromotion = "always"
+			if len(fields) == 2 {
+				switch fields[1] {
+				case "always", "second-read", "never":
+				default:
+					return nil, fmt.Errorf("load: %q: unknown policy %q", key, fields[1])
+				}
+				c.MemoryTierPromotion = fields[1]
+			}
+		case "mirror-listen-addr":
+			c.MirrorListenAddr = val
+		case "mirror-token":
+			c.MirrorToken = val
+		case "mirror-url":
+			c.MirrorURL = val
 		case "musclefs-mount":
 			c.MuscleFSMount = val
+		case "otlp-endpoint":
+			c.OTLPEndpoint = val
+		case "prefetch-depth":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			if n < 0 {
+				return nil, fmt.Errorf("load: %q: negative value %d", key, n)
+			}
+			c.PrefetchDepth = n
+		case "preserve-mtime":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.PreserveMtime = b
+		case "max-depth":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			if n < 0 {
+				return nil, fmt.Errorf("load: %q: negative value %d", key, n)
+			}
+			c.MaxDepth = n
+		case "name-policy":
+			switch val {
+			case "allow", "reject", "normalize":
+				c.NamePolicy = val
+			default:
+				return nil, fmt.Errorf("load: %q: unknown value %q", key, val)
+			}
+		case "propagation-alert-age":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.PropagationAlertAge = d
+		case "propagation-alert-pending":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.PropagationAlertPending = n
+		case "rate-limit-bytes":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.RateLimitBytes = n
+		case "rate-limit-ops":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.RateLimitOps = n
+		case "b2-application-key":
+			c.B2ApplicationKey = val
+		case "b2-application-key-command":
+			c.B2ApplicationKeyCommand = val
+		case "b2-bucket":
+			c.B2Bucket = val
+		case "b2-key-id":
+			c.B2KeyID = val
+		case "b2-retry-budget":
+			f, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			if f < 0 {
+				return nil, fmt.Errorf("load: %q: negative value %v", key, f)
+			}
+			c.B2RetryBudget = f
 		case "s3-bucket":
 			c.S3Bucket = val
 		case "s3-access-key":
 			c.S3AccessKey = val
 		case "s3-secret-key":
 			c.S3SecretKey = val
+		case "s3-secret-command":
+			c.S3SecretCommand = val
 		case "s3-region":
 			c.S3Region = val
+		case "trace-requests":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.TraceRequests = n
+		case "alias":
+			j := strings.IndexAny(val, " 	")
+			if j == -1 {
+				return nil, fmt.Errorf("load: %q: want a name and commands, got %q", key, val)
+			}
+			if c.Aliases == nil {
+				c.Aliases = make(map[string]string)
+			}
+			c.Aliases[val[:j]] = strings.TrimSpace(val[j:])
+		case "merge-strategy":
+			fields := strings.Fields(val)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("load: %q: want a pattern and a strategy, got %q", key, val)
+			}
+			if _, err := path.Match(fields[0], ""); err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			switch fields[1] {
+			case "manual", "ours", "theirs", "newest":
+			default:
+				return nil, fmt.Errorf("load: %q: unknown strategy %q", key, fields[1])
+			}
+			c.MergeStrategies = append(c.MergeStrategies, MergeStrategyRule{Pattern: fields[0], Strategy: fields[1]})
+		case "replica":
+			fields := strings.Fields(val)
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("load: %q: want a name, a kind, and a location, got %q", key, val)
+			}
+			switch fields[1] {
+			case "disk", "mirror":
+			default:
+				return nil, fmt.Errorf("load: %q: unknown kind %q", key, fields[1])
+			}
+			for _, r := range c.Replicas {
+				if r.Name == fields[0] {
+					return nil, fmt.Errorf("load: %q: duplicate name %q", key, fields[0])
+				}
+			}
+			c.Replicas = append(c.Replicas, Replica{Name: fields[0], Kind: fields[1], Location: fields[2]})
+		case "request-cost":
+			fields := strings.Fields(val)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("load: %q: want an operation and a price, got %q", key, val)
+			}
+			switch fields[0] {
+			case "get", "put", "delete", "contains", "list", "deletebatch", "cas":
+			default:
+				return nil, fmt.Errorf("load: %q: unknown operation %q", key, fields[0])
+			}
+			price, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			if c.RequestCosts == nil {
+				c.RequestCosts = make(map[string]float64)
+			}
+			c.RequestCosts[fields[0]] = price
+		case "transfer-cost":
+			price, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.TransferCost = price
+		case "small-block-files":
+			c.SmallBlockFiles = strings.Fields(val)
+		case "bind":
+			fields := strings.Fields(val)
+			if len(fields) != 1 && len(fields) != 2 {
+				return nil, fmt.Errorf("load: %q: want a tag and an optional name, got %q", key, val)
+			}
+			b := Bind{Tag: fields[0], Name: fields[0]}
+			if len(fields) == 2 {
+				b.Name = fields[1]
+			}
+			switch b.Name {
+			case "ctl", "live", "tags", ".", "..":
+				return nil, fmt.Errorf("load: %q: reserved name %q", key, b.Name)
+			}
+			for _, other := range c.Binds {
+				if other.Name == b.Name {
+					return nil, fmt.Errorf("load: %q: duplicate name %q", key, b.Name)
+				}
+			}
+			c.Binds = append(c.Binds, b)
+		case "fetch-ahead":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			if n < 0 {
+				return nil, fmt.Errorf("load: %q: negative value %d", key, n)
+			}
+			c.FetchAhead = n
+		case "block-cache-size":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.BlockCacheSize = n
+		case "staging-soft-limit", "staging-hard-limit":
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			if key == "staging-soft-limit" {
+				c.StagingSoftLimit = n
+			} else {
+				c.StagingHardLimit = n
+			}
+		case "small-block-size":
+			n, err := strconv.ParseUint(val, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			if n > uint64(BlockSize) {
+				return nil, fmt.Errorf("load: %q: %d exceeds the block size %d", key, n, BlockSize)
+			}
+			c.SmallBlockSize = uint32(n)
+		case "sftp-command":
+			c.SFTPCommand = val
+		case "sftp-dir":
+			c.SFTPDir = val
+		case "sftp-host":
+			c.SFTPHost = val
+		case "webdav-password":
+			c.WebDAVPassword = val
+		case "webdav-password-command":
+			c.WebDAVPasswordCommand = val
+		case "webdav-url":
+			c.WebDAVURL = val
+		case "webdav-user":
+			c.WebDAVUser = val
+		case "slow-threshold":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			c.SlowThreshold = d
+		case "snapshot-frequency":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return nil, fmt.Errorf("load: %q: %w", key, err)
+			}
+			if d < 0 {
+				return nil, fmt.Errorf("load: %q: negative value %v", key, d)
+			}
+			c.SnapshotFrequency = d
 		case "storage":
 			c.Storage = val
 		default:
@@ -172,6 +766,16 @@ func load(f io.Reader) (*C, error) {
 	return &c, nil
 }
 
+// Rebase returns a copy of the configuration whose local files, e.g.,
+// the staging area, the cache, and logs, are under dir instead, as for
+// a sandbox. The remote store is the same.
+func (c *C) Rebase(dir string) *C {
+	rebased := *c
+	rebased.base = dir
+	rebased.CacheDirectory = ""
+	return &rebased
+}
+
 func (c *C) CacheDirectoryPath() string {
 	if c.CacheDirectory != "" {
 		return c.CacheDirectory
@@ -180,17 +784,91 @@ func (c *C) CacheDirectoryPath() string {
 }
 
 // An instance of *storage.Paired will log keys to propagate from the
-// fast store to the slow store to this append-only log.  This will
-// ensure all data is eventually copied to the slow store, even if
-// musclefs restarts.
+// fast store to the slow store to this append-only log, a directory
+// of segment files.  This will ensure all data is eventually copied
+// to the slow store, even if musclefs restarts.
 func (c *C) PropagationLogFilePath() string {
 	return path.Join(c.base, "propagation.log")
 }
 
+// KeepLocalFilePath is where musclefs persists the rules for
+// resolving pull conflicts in favor of the local version.
+func (c *C) KeepLocalFilePath() string {
+	return path.Join(c.base, "keep-local")
+}
+
+// PinsDirectoryPath is where musclefs records the revisions in use,
+// e.g., being browsed, which clean must not delete.
+func (c *C) PinsDirectoryPath() string {
+	return path.Join(c.base, "pins")
+}
+
+// ReachableFilePath is where the reachable control command of
+// musclefs writes the keys needed, by default, for "muscle clean".
+func (c *C) ReachableFilePath() string {
+	return path.Join(c.base, "reachable")
+}
+
+// PullWorklogFilePath is where musclefs records the commands a pull
+// runs automatically, and which of them completed, so that an
+// interrupted pull resumes where it stopped.
+func (c *C) PullWorklogFilePath() string {
+	return path.Join(c.base, "pull.worklog")
+}
+
+// SealJournalFilePath is where musclefs records its progress sealing
+// the tree, so that an interrupted seal can resume.
+func (c *C) SealJournalFilePath() string {
+	return path.Join(c.base, "seal.journal")
+}
+
+// ReadOrderFilePath is where musclefs saves the order in which it
+// first read blocks, as a hint for "muscle prefetch".
+func (c *C) ReadOrderFilePath() string {
+	return path.Join(c.base, "read.order")
+}
+
+// AnnotationsDirectoryPath is where musclefs keeps the notes on
+// revisions written to their NOTES files.
+func (c *C) AnnotationsDirectoryPath() string {
+	return path.Join(c.base, "annotations")
+}
+
+// MetricsFilePath is where musclefs accumulates the counts of calls
+// to its stores, across runs, for "muscle stats".
+func (c *C) MetricsFilePath() string {
+	return path.Join(c.base, "metrics")
+}
+
+// CommandMetricsFilePath is where the muscle command accumulates the
+// counts of its calls to the remote store, apart from musclefs, which
+// overwrites its own file with the counts it keeps in memory.
+func (c *C) CommandMetricsFilePath() string {
+	return path.Join(c.base, "metrics.muscle")
+}
+
 func (c *C) StagingDirectoryPath() string {
 	return path.Join(c.base, "staging")
 }
 
+// ControlSocketPath is where musclefs listens for the commands of
+// its control file, see "muscle control -socket".
+func (c *C) ControlSocketPath() string {
+	return path.Join(c.base, "ctl.sock")
+}
+
+// StateDumpFilePath is where musclefs dumps its state at the given
+// time, e.g., on SIGQUIT.
+func (c *C) StateDumpFilePath(t time.Time) string {
+	return path.Join(c.base, "state."+t.UTC().Format("20060102T150405Z"))
+}
+
+// QuarantineDirectoryPath is where staged values found not in use are
+// moved, see "muscle recover-staging".
+func (c *C) QuarantineDirectoryPath() string {
+	return path.Join(c.base, "quarantine")
+}
+
 func (c *C) EncryptionKeyBytes() []byte {
 	return c.encryptionKey
 }
@@ -256,8 +934,13 @@ func (c *C) UmountCommands() ([]string, error) {
 	}
 }
 
-// Initialize generates an initial configuration at the given directory.
-func Initialize(baseDir string) error {
+// Initialize generates an initial configuration at the given
+// directory, for the given storage type, which must be "disk" or
+// "memory".
+func Initialize(baseDir string, storageType string) error {
+	if storageType != "disk" && storageType != "memory" {
+		return fmt.Errorf("%q: unsupported storage type for initialization", storageType)
+	}
 	if err := os.MkdirAll(baseDir, 0700); err != nil {
 		return fmt.Errorf("%q: could not mkdir: %w", baseDir, err)
 	}
@@ -285,8 +968,10 @@ func Initialize(baseDir string) error {
 		return fmt.Errorf("could not read 32 random bytes, got only %d", n)
 	}
 	fmt.Fprintf(&buf, "encryption-key %02x\n", b)
-	buf.WriteString("storage disk\n")
-	buf.WriteString("disk-store-dir permanent\n")
+	fmt.Fprintf(&buf, "storage %s\n", storageType)
+	if storageType == "disk" {
+		buf.WriteString("disk-store-dir permanent\n")
+	}
 	err = ioutil.WriteFile(path, buf.Bytes(), 0600)
 	if err != nil {
 		return fmt.Errorf("config.Initialize %q: %w", path, err)
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ProfilesFilePath is the registry of profiles, see ProfileBase. It
+// is $MUSCLE_PROFILES if set, otherwise $HOME/lib/muscle/profiles,
+// regardless of $MUSCLE_BASE.
+var ProfilesFilePath string
+
+func init() {
+	if pathname := os.Getenv("MUSCLE_PROFILES"); pathname != "" {
+		ProfilesFilePath = pathname
+	} else {
+		ProfilesFilePath = os.ExpandEnv("$HOME/lib/muscle/profiles")
+	}
+}
+
+// ProfileBase returns the base directory of the named profile, as
+// registered in the file at ProfilesFilePath. Each line of the file
+// is a profile name followed by its base directory, e.g.,
+//
+//	work $HOME/lib/muscle-work
+//
+// Environment variables in directories are expanded, and relative
+// directories are relative to the file's. Blank lines and lines
+// starting with '#' are ignored.
+func ProfileBase(name string) (string, error) {
+	const method = "ProfileBase"
+	f, err := os.Open(ProfilesFilePath)
+	if err != nil {
+		return "", errorf(method, "%v", err)
+	}
+	defer func() {
+		// Ignore error closing file opened only for reading.
+		_ = f.Close()
+	}()
+	s := bufio.NewScanner(f)
+	for lineno := 1; s.Scan(); lineno++ {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexAny(line, " \t")
+		if i == -1 {
+			return "", errorf(method, "%s:%d: no separator in %q", ProfilesFilePath, lineno, line)
+		}
+		if line[:i] != name {
+			continue
+		}
+		dir := os.ExpandEnv(strings.TrimSpace(line[i:]))
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(ProfilesFilePath), dir)
+		}
+		return filepath.Clean(dir), nil
+	}
+	if err := s.Err(); err != nil {
+		return "", errorf(method, "%v", err)
+	}
+	return "", errorf(method, "%q: no such profile in %s", name, ProfilesFilePath)
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// secretFromCommand runs the command with the shell and returns the
+// secret it writes to standard output, e.g., "pass show muscle/key",
+// without the trailing newline. The command shares standard input and
+// standard error, so that it can prompt for a passphrase.
+func secretFromCommand(command string) (string, error) {
+	const method = "secretFromCommand"
+	var stdout bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", errorf(method, "%q: %w", command, err)
+	}
+	// Tools like pass may follow the secret with other lines.
+	secret := strings.TrimSpace(strings.SplitN(stdout.String(), "\n", 2)[0])
+	if secret == "" {
+		return "", errorf(method, "%q: no output", command)
+	}
+	return secret, nil
+}
+
+// resolveSecrets sets the secrets configured to come from commands.
+// A secret can't be given both ways.
+func (c *C) resolveSecrets() error {
+	for _, s := range []struct {
+		key, commandKey string
+		command         string
+		secret          *string
+	}{
+		{"encryption-key", "encryption-key-command", c.EncryptionKeyCommand, &c.EncryptionKey},
+		{"s3-secret-key", "s3-secret-command", c.S3SecretCommand, &c.S3SecretKey},
+		{"b2-application-key", "b2-application-key-command", c.B2ApplicationKeyCommand, &c.B2ApplicationKey},
+		{"webdav-password", "webdav-password-command", c.WebDAVPasswordCommand, &c.WebDAVPassword},
+	} {
+		if s.command == "" {
+			continue
+		}
+		if *s.secret != "" {
+			return errorf("C.resolveSecrets", "%s and %s are mutually exclusive", s.key, s.commandKey)
+		}
+		secret, err := secretFromCommand(s.command)
+		if err != nil {
+			return err
+		}
+		*s.secret = secret
+	}
+	return nil
+}
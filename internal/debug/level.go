@@ -0,0 +1,43 @@
+package debug
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Levels of logging, from the least to the most verbose. Errors and
+// warnings are always logged; messages at the other levels only if the
+// level set is at least theirs.
+const (
+	Error int32 = iota
+	Info
+	Debug
+)
+
+var levels = []string{"error", "info", "debug"}
+
+var level = Info // Accessed atomically.
+
+// SetLevel sets the logging level by name, e.g., "debug".
+func SetLevel(name string) error {
+	for i, n := range levels {
+		if n == name {
+			atomic.StoreInt32(&level, int32(i))
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown level %q, want one of %v", name, levels)
+}
+
+// Level returns the name of the logging level.
+func Level() string {
+	return levels[atomic.LoadInt32(&level)]
+}
+
+// Logf logs like log.Printf if the logging level is at least l.
+func Logf(l int32, format string, v ...interface{}) {
+	if l <= atomic.LoadInt32(&level) {
+		log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,40 @@
+package debug
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestLogf(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer func() { _ = SetLevel("info") }()
+	if got := Level(); got != "info" {
+		t.Errorf("got level %q, want info", got)
+	}
+	for _, c := range []struct {
+		level string
+		want  int
+	}{
+		{"error", 1},
+		{"info", 2},
+		{"debug", 3},
+	} {
+		if err := SetLevel(c.level); err != nil {
+			t.Fatal(err)
+		}
+		buf.Reset()
+		Logf(Error, "error")
+		Logf(Info, "info")
+		Logf(Debug, "debug")
+		if got := bytes.Count(buf.Bytes(), []byte("\n")); got != c.want {
+			t.Errorf("%s: got %d lines, want %d", c.level, got, c.want)
+		}
+	}
+	if err := SetLevel("verbose"); err == nil {
+		t.Error("got no error for an unknown level")
+	}
+}
@@ -0,0 +1,324 @@
+// Package otlp implements just enough OpenTelemetry tracing for
+// musclefs: spans with attributes, exported in batches to a collector
+// (e.g., Jaeger) using the OTLP/HTTP protocol with JSON encoding.
+//
+// A nil *Tracer and a nil *Span are valid and do nothing, so that
+// instrumented code needs no checks when tracing is disabled.
+package otlp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	batchSize     = 512
+	flushInterval = 5 * time.Second
+	queueSize     = 4096
+)
+
+// Tracer creates spans and exports them once they end.
+type Tracer struct {
+	service  string
+	endpoint string
+	client   *http.Client
+	queue    chan *Span
+}
+
+// NewTracer creates a tracer that exports spans to the collector at
+// the given endpoint, e.g., http://localhost:4318, on behalf of the
+// given service. Spans are dropped, rather than blocking the caller,
+// if the collector can't keep up.
+func NewTracer(service string, endpoint string) *Tracer {
+	return newTracer(service, endpoint, flushInterval)
+}
+
+func newTracer(service string, endpoint string, interval time.Duration) *Tracer {
+	t := &Tracer{
+		service:  service,
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *Span, queueSize),
+	}
+	go t.export(interval)
+	return t
+}
+
+// Start starts a span. If parent is nil, the span starts a new trace.
+func (t *Tracer) Start(name string, parent *Span) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		tracer: t,
+		name:   name,
+		start:  time.Now(),
+		id:     randomHex(8),
+	}
+	if parent != nil {
+		s.trace = parent.trace
+		s.parent = parent.id
+	} else {
+		s.trace = randomHex(16)
+	}
+	return s
+}
+
+func (t *Tracer) export(interval time.Duration) {
+	var batch []*Span
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.send(batch); err != nil {
+			log.Printf("Could not export %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+func (t *Tracer) send(batch []*Span) error {
+	b, err := json.Marshal(t.encode(batch))
+	if err != nil {
+		return err
+	}
+	res, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %d status code", t.endpoint, res.StatusCode)
+	}
+	return nil
+}
+
+// Span is an operation being traced. Its methods are safe for
+// concurrent use.
+type Span struct {
+	tracer *Tracer
+	name   string
+	trace  string
+	id     string
+	parent string
+	start  time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []attribute
+	err   string
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// SetAttribute records a string, boolean, or integer attribute.
+// Values of other types are recorded as strings.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attribute{key: key, value: value})
+}
+
+// SetError marks the span as failed, unless err is nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End ends the span and queues it for export.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	select {
+	case s.tracer.queue <- s:
+	default:
+	}
+}
+
+// Current holds the span that operations in progress should use as
+// parent, for code that can't pass spans along. A nil *Current holds
+// no span.
+type Current struct {
+	mu   sync.Mutex
+	span *Span
+}
+
+// Set sets the current span; nil clears it.
+func (c *Current) Set(s *Span) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.span = s
+	c.mu.Unlock()
+}
+
+// Get returns the current span, possibly nil.
+func (c *Current) Get() *Span {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.span
+}
+
+// The types below follow the JSON encoding of the OTLP protobuf
+// messages, see opentelemetry-proto's trace.proto.
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []jsonSpan `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type jsonSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            status     `json:"status"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	spanKindInternal = 1
+	statusOK         = 1
+	statusError      = 2
+)
+
+func (t *Tracer) encode(batch []*Span) exportRequest {
+	var spans []jsonSpan
+	for _, s := range batch {
+		s.mu.Lock()
+		js := jsonSpan{
+			TraceID:           s.trace,
+			SpanID:            s.id,
+			ParentSpanID:      s.parent,
+			Name:              s.name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            status{Code: statusOK},
+		}
+		for _, a := range s.attrs {
+			js.Attributes = append(js.Attributes, keyValue{Key: a.key, Value: valueOf(a.value)})
+		}
+		if s.err != "" {
+			js.Status = status{Code: statusError, Message: s.err}
+		}
+		s.mu.Unlock()
+		spans = append(spans, js)
+	}
+	service := t.service
+	return exportRequest{
+		ResourceSpans: []resourceSpans{{
+			Resource: resource{
+				Attributes: []keyValue{{Key: "service.name", Value: anyValue{StringValue: &service}}},
+			},
+			ScopeSpans: []scopeSpans{{
+				Scope: scope{Name: "github.com/nicolagi/muscle"},
+				Spans: spans,
+			}},
+		}},
+	}
+}
+
+func valueOf(v interface{}) anyValue {
+	var s string
+	switch v := v.(type) {
+	case bool:
+		return anyValue{BoolValue: &v}
+	case int:
+		s = strconv.FormatInt(int64(v), 10)
+		return anyValue{IntValue: &s}
+	case int64:
+		s = strconv.FormatInt(v, 10)
+		return anyValue{IntValue: &s}
+	case uint32:
+		s = strconv.FormatUint(uint64(v), 10)
+		return anyValue{IntValue: &s}
+	case uint64:
+		s = strconv.FormatUint(v, 10)
+		return anyValue{IntValue: &s}
+	case string:
+		s = v
+	default:
+		s = fmt.Sprint(v)
+	}
+	return anyValue{StringValue: &s}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
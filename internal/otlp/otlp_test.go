@@ -0,0 +1,67 @@
+package otlp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.Start("noop", nil)
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("ignored"))
+	span.End()
+	var current *Current
+	current.Set(span)
+	if current.Get() != nil {
+		t.Error("got a span from a nil current")
+	}
+}
+
+func TestTracerExport(t *testing.T) {
+	received := make(chan exportRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("got path %q, want /v1/traces", r.URL.Path)
+		}
+		var req exportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		received <- req
+	}))
+	defer srv.Close()
+
+	tracer := newTracer("test", srv.URL+"/", 10*time.Millisecond)
+	parent := tracer.Start("parent", nil)
+	child := tracer.Start("child", parent)
+	child.SetAttribute("bytes", 42)
+	child.SetError(errors.New("failed"))
+	child.End()
+	parent.End()
+
+	var spans []jsonSpan
+	timeout := time.After(5 * time.Second)
+	for len(spans) < 2 {
+		select {
+		case req := <-received:
+			spans = append(spans, req.ResourceSpans[0].ScopeSpans[0].Spans...)
+		case <-timeout:
+			t.Fatalf("timed out with %d spans", len(spans))
+		}
+	}
+	c, p := spans[0], spans[1]
+	if c.TraceID != p.TraceID || c.ParentSpanID != p.SpanID || p.ParentSpanID != "" {
+		t.Errorf("got child %+v and parent %+v, want them linked", c, p)
+	}
+	if c.Status.Code != statusError || c.Status.Message != "failed" {
+		t.Errorf("got status %+v", c.Status)
+	}
+	if len(c.Attributes) != 1 || c.Attributes[0].Key != "bytes" || *c.Attributes[0].Value.IntValue != "42" {
+		t.Errorf("got attributes %+v", c.Attributes)
+	}
+}
@@ -71,6 +71,9 @@ func NodeDirVar(node *tree.Node, dir *p.Dir) {
 	dir.Length = ni.Size
 	dir.Mode = ni.Mode
 	dir.Mtime = ni.Modified
-	dir.Atime = ni.Modified
+	dir.Atime = ni.Accessed
+	if dir.Atime == 0 {
+		dir.Atime = ni.Modified
+	}
 	dir.Name = ni.Name
 }
@@ -0,0 +1,539 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/config"
+)
+
+const (
+	b2AuthorizeURL = "https://api.backblazeb2.com/b2api/v2/b2_authorize_account"
+
+	// Attempts of a request, including the first, budget permitting.
+	b2MaxAttempts = 5
+
+	// The wait before the first retry of a request, which doubles at
+	// each further retry unless B2 says how long to wait.
+	b2RetryInterval = time.Second
+
+	// Retries allowed in a row, before requests refill the budget.
+	b2RetryReserve = 10
+
+	// Retries per request, in the long run, unless configured.
+	b2DefaultRetryBudget = 0.1
+
+	// Versions of a file to list per request when deleting it.
+	b2DeletePageSize = 100
+)
+
+// errB2Expired is the class of errors due to an authorization token
+// having expired, which are retried with a new token.
+var errB2Expired = errors.New("authorization expired")
+
+// b2Store talks the B2 native API rather than the S3-compatible one,
+// so that it can do as B2 asks when it answers an upload with a 503,
+// which is routine: retry with another upload URL.
+// Failed requests are retried with exponential backoff, within a
+// retry budget shared by all requests, so that when B2 is struggling
+// the store gives up quickly and leaves waiting to its callers, e.g.,
+// the propagation of items from the cache.
+//
+// Keys are file names. Overwriting a key adds a version of its file,
+// and deleting a key deletes all versions.
+type b2Store struct {
+	keyID          string
+	applicationKey string
+	bucket         string
+	authorizeURL   string
+	client         *http.Client
+	budget         *retryBudget
+	interval       time.Duration
+
+	mu      sync.Mutex
+	auth    *b2Auth
+	uploads []*b2Upload // Not in use, see B2's upload docs.
+}
+
+var _ Store = (*b2Store)(nil)
+
+// b2Auth is an account authorization, with the URLs to use with it.
+type b2Auth struct {
+	token       string
+	apiURL      string
+	downloadURL string
+	bucketID    string
+}
+
+// b2Upload is an upload URL and its authorization. An upload URL can
+// only be used for one upload at a time.
+type b2Upload struct {
+	url   string
+	token string
+}
+
+func newB2Store(c *config.C) (Store, error) {
+	if c.B2KeyID == "" || c.B2ApplicationKey == "" {
+		return nil, errorf("newB2Store", "b2-key-id or b2-application-key not configured")
+	}
+	if c.B2Bucket == "" {
+		return nil, errorf("newB2Store", "b2-bucket not configured")
+	}
+	ratio := c.B2RetryBudget
+	if ratio == 0 {
+		ratio = b2DefaultRetryBudget
+	}
+	return &b2Store{
+		keyID:          c.B2KeyID,
+		applicationKey: c.B2ApplicationKey,
+		bucket:         c.B2Bucket,
+		authorizeURL:   b2AuthorizeURL,
+		client:         http.DefaultClient,
+		budget:         newRetryBudget(ratio, b2RetryReserve),
+		interval:       b2RetryInterval,
+	}, nil
+}
+
+// b2Error is an unsuccessful response.
+type b2Error struct {
+	status     int
+	code       string
+	message    string
+	retryAfter time.Duration
+	class      error
+}
+
+// b2ResponseError describes an unsuccessful response, with the error
+// class telling whether to retry, see retry.go.
+func b2ResponseError(res *http.Response, body []byte) *b2Error {
+	var e struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	_ = json.Unmarshal(body, &e)
+	err := &b2Error{status: res.StatusCode, code: e.Code, message: e.Message}
+	if seconds, convErr := strconv.Atoi(res.Header.Get("Retry-After")); convErr == nil && seconds > 0 {
+		err.retryAfter = time.Duration(seconds) * time.Second
+	}
+	switch {
+	case res.StatusCode == http.StatusUnauthorized && (e.Code == "expired_auth_token" || e.Code == "bad_auth_token"):
+		err.class = errB2Expired
+	case res.StatusCode == http.StatusNotFound, e.Code == "file_not_present", e.Code == "no_such_file":
+		err.class = ErrNotFound
+	case res.StatusCode == http.StatusTooManyRequests:
+		err.class = ErrThrottled
+	case res.StatusCode == http.StatusRequestTimeout, res.StatusCode >= 500:
+		err.class = ErrUnavailable
+	case res.StatusCode == http.StatusUnauthorized, res.StatusCode == http.StatusForbidden:
+		err.class = ErrDenied
+	}
+	return err
+}
+
+func (e *b2Error) Error() string {
+	detail := fmt.Sprintf("%d status code", e.status)
+	if e.code != "" {
+		detail += ": " + e.code
+	}
+	if e.message != "" {
+		detail += ": " + e.message
+	}
+	if e.class != nil {
+		detail += ": " + e.class.Error()
+	}
+	return detail
+}
+
+func (e *b2Error) Unwrap() error {
+	return e.class
+}
+
+// b2Retryable tells whether a request failing with err may succeed if
+// made again. Errors other than responses, e.g., network errors, are
+// assumed to be transient.
+func b2Retryable(err error) bool {
+	var e *b2Error
+	if errors.As(err, &e) {
+		return errors.Is(e.class, errB2Expired) || errors.Is(e.class, ErrThrottled) || errors.Is(e.class, ErrUnavailable)
+	}
+	return !errors.Is(err, ErrDenied) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// exchange makes a single attempt of the request, returning the body
+// of a successful response.
+func (s *b2Store) exchange(req *http.Request) ([]byte, error) {
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, b2ResponseError(res, body)
+	}
+	return body, nil
+}
+
+// authorization returns the current account authorization, making a
+// new one if needed. The first one also finds the bucket ID.
+func (s *b2Store) authorization(ctx context.Context) (*b2Auth, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.auth != nil {
+		return s.auth, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", s.authorizeURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(s.keyID, s.applicationKey)
+	body, err := s.exchange(req)
+	if err != nil {
+		return nil, fmt.Errorf("authorize: %w", err)
+	}
+	var account struct {
+		AccountID          string `json:"accountId"`
+		AuthorizationToken string `json:"authorizationToken"`
+		APIURL             string `json:"apiUrl"`
+		DownloadURL        string `json:"downloadUrl"`
+		Allowed            struct {
+			BucketID   string `json:"bucketId"`
+			BucketName string `json:"bucketName"`
+		} `json:"allowed"`
+	}
+	if err := json.Unmarshal(body, &account); err != nil {
+		return nil, fmt.Errorf("authorize: %w", err)
+	}
+	auth := &b2Auth{
+		token:       account.AuthorizationToken,
+		apiURL:      account.APIURL,
+		downloadURL: account.DownloadURL,
+		bucketID:    account.Allowed.BucketID,
+	}
+	if auth.bucketID != "" && account.Allowed.BucketName != s.bucket {
+		return nil, fmt.Errorf("key restricted to bucket %q: %w", account.Allowed.BucketName, ErrDenied)
+	}
+	if auth.bucketID == "" {
+		req, err := s.newAPIRequest(ctx, auth, "b2_list_buckets", map[string]string{
+			"accountId":  account.AccountID,
+			"bucketName": s.bucket,
+		})
+		if err != nil {
+			return nil, err
+		}
+		body, err := s.exchange(req)
+		if err != nil {
+			return nil, fmt.Errorf("find bucket: %w", err)
+		}
+		var list struct {
+			Buckets []struct {
+				BucketID string `json:"bucketId"`
+			} `json:"buckets"`
+		}
+		if err := json.Unmarshal(body, &list); err != nil {
+			return nil, fmt.Errorf("find bucket: %w", err)
+		}
+		if len(list.Buckets) == 0 {
+			return nil, fmt.Errorf("no bucket %q: %w", s.bucket, ErrDenied)
+		}
+		auth.bucketID = list.Buckets[0].BucketID
+	}
+	s.auth = auth
+	return auth, nil
+}
+
+// expire forgets the account authorization, unless already replaced.
+func (s *b2Store) expire(auth *b2Auth) {
+	s.mu.Lock()
+	if s.auth == auth {
+		s.auth = nil
+	}
+	s.mu.Unlock()
+}
+
+// do makes the request built by newRequest with the current account
+// authorization, retrying it with exponential backoff, or after the
+// wait B2 asks for, as long as the failure is transient and the retry
+// budget allows. Requests failing because the authorization expired
+// are retried with a new one. It returns the body of the successful
+// response.
+func (s *b2Store) do(ctx context.Context, newRequest func(*b2Auth) (*http.Request, error)) ([]byte, error) {
+	s.budget.request()
+	interval := s.interval
+	for attempt := 1; ; attempt++ {
+		auth, err := s.authorization(ctx)
+		var body []byte
+		if err == nil {
+			var req *http.Request
+			if req, err = newRequest(auth); err == nil {
+				body, err = s.exchange(req.WithContext(ctx))
+			}
+		}
+		if err == nil {
+			return body, nil
+		}
+		if errors.Is(err, errB2Expired) && auth != nil {
+			s.expire(auth)
+		}
+		if !b2Retryable(err) || attempt == b2MaxAttempts {
+			return nil, err
+		}
+		if !s.budget.retry() {
+			return nil, fmt.Errorf("retry budget exhausted: %w", err)
+		}
+		wait := interval
+		var e *b2Error
+		if errors.As(err, &e) && e.retryAfter > 0 {
+			wait = e.retryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		if interval *= 2; interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
+}
+
+func (s *b2Store) newAPIRequest(ctx context.Context, auth *b2Auth, name string, request interface{}) (*http.Request, error) {
+	b, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", auth.apiURL+"/b2api/v2/"+name, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", auth.token)
+	return req, nil
+}
+
+// call calls the named API function, with the request returned by
+// the given function for the current authorization, and decodes the
+// response, if not nil.
+func (s *b2Store) call(ctx context.Context, name string, request func(*b2Auth) interface{}, response interface{}) error {
+	body, err := s.do(ctx, func(auth *b2Auth) (*http.Request, error) {
+		return s.newAPIRequest(ctx, auth, name, request(auth))
+	})
+	if err != nil {
+		return err
+	}
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(body, response)
+}
+
+// fileURL is where to download the file for the key from.
+func (s *b2Store) fileURL(auth *b2Auth, key Key) string {
+	return auth.downloadURL + "/file/" + url.PathEscape(s.bucket) + "/" + url.PathEscape(string(key))
+}
+
+func (s *b2Store) Get(key Key) (Value, error) {
+	body, err := s.do(context.Background(), func(auth *b2Auth) (*http.Request, error) {
+		req, err := http.NewRequest("GET", s.fileURL(auth, key), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", auth.token)
+		return req, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("b2Store.Get %q: %w", key, err)
+	}
+	return body, nil
+}
+
+// Contains issues a HEAD request, so the value is not downloaded.
+func (s *b2Store) Contains(key Key) (bool, error) {
+	_, err := s.do(context.Background(), func(auth *b2Auth) (*http.Request, error) {
+		req, err := http.NewRequest("HEAD", s.fileURL(auth, key), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", auth.token)
+		return req, nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("b2Store.Contains %q: %w", key, err)
+	}
+	return true, nil
+}
+
+// uploadURL returns an upload URL not in use, getting a new one if
+// there's none.
+func (s *b2Store) uploadURL(auth *b2Auth) (*b2Upload, error) {
+	s.mu.Lock()
+	if n := len(s.uploads); n > 0 {
+		u := s.uploads[n-1]
+		s.uploads = s.uploads[:n-1]
+		s.mu.Unlock()
+		return u, nil
+	}
+	s.mu.Unlock()
+	req, err := s.newAPIRequest(context.Background(), auth, "b2_get_upload_url", map[string]string{
+		"bucketId": auth.bucketID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	body, err := s.exchange(req)
+	if err != nil {
+		return nil, fmt.Errorf("get upload URL: %w", err)
+	}
+	var u struct {
+		UploadURL          string `json:"uploadUrl"`
+		AuthorizationToken string `json:"authorizationToken"`
+	}
+	if err := json.Unmarshal(body, &u); err != nil {
+		return nil, fmt.Errorf("get upload URL: %w", err)
+	}
+	return &b2Upload{url: u.UploadURL, token: u.AuthorizationToken}, nil
+}
+
+// Put uploads the value. An upload URL that failed is not used again:
+// each attempt after a failure uses a new one, as B2 asks.
+func (s *b2Store) Put(key Key, value Value) error {
+	sum := sha1.Sum(value)
+	var upload *b2Upload
+	_, err := s.do(context.Background(), func(auth *b2Auth) (*http.Request, error) {
+		u, err := s.uploadURL(auth)
+		if err != nil {
+			return nil, err
+		}
+		upload = u
+		req, err := http.NewRequest("POST", u.url, bytes.NewReader(value))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", u.token)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("X-Bz-File-Name", url.PathEscape(string(key)))
+		req.Header.Set("X-Bz-Content-Sha1", hex.EncodeToString(sum[:]))
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("b2Store.Put %q: %w", key, err)
+	}
+	s.mu.Lock()
+	s.uploads = append(s.uploads, upload)
+	s.mu.Unlock()
+	return nil
+}
+
+// Delete deletes all versions of the file for the key.
+func (s *b2Store) Delete(key Key) error {
+	ctx := context.Background()
+	for {
+		var versions struct {
+			Files []struct {
+				FileName string `json:"fileName"`
+				FileID   string `json:"fileId"`
+			} `json:"files"`
+		}
+		err := s.call(ctx, "b2_list_file_versions", func(auth *b2Auth) interface{} {
+			return map[string]interface{}{
+				"bucketId":      auth.bucketID,
+				"startFileName": string(key),
+				"prefix":        string(key),
+				"maxFileCount":  b2DeletePageSize,
+			}
+		}, &versions)
+		if err != nil {
+			return fmt.Errorf("b2Store.Delete %q: %w", key, err)
+		}
+		deleted := 0
+		for _, f := range versions.Files {
+			if f.FileName != string(key) {
+				continue
+			}
+			err := s.call(ctx, "b2_delete_file_version", func(*b2Auth) interface{} {
+				return map[string]string{"fileName": f.FileName, "fileId": f.FileID}
+			}, nil)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return fmt.Errorf("b2Store.Delete %q: %w", key, err)
+			}
+			deleted++
+		}
+		if deleted < b2DeletePageSize {
+			return nil
+		}
+	}
+}
+
+type b2Lister struct {
+	store  *b2Store
+	prefix string
+	start  string
+	done   bool
+}
+
+// List lists the latest version of each file, a page per request.
+func (s *b2Store) List() ListIterator {
+	return &b2Lister{store: s}
+}
+
+// ListPrefix has B2 filter the file names by the prefix.
+func (s *b2Store) ListPrefix(prefix string) ListIterator {
+	return &b2Lister{store: s, prefix: prefix}
+}
+
+func (it *b2Lister) Next(ctx context.Context) ([]KeyInfo, error) {
+	if it.done {
+		return nil, io.EOF
+	}
+	var result struct {
+		Files []struct {
+			FileName      string `json:"fileName"`
+			ContentLength int64  `json:"contentLength"`
+			Action        string `json:"action"`
+		} `json:"files"`
+		NextFileName *string `json:"nextFileName"`
+	}
+	err := it.store.call(ctx, "b2_list_file_names", func(auth *b2Auth) interface{} {
+		request := map[string]interface{}{
+			"bucketId":     auth.bucketID,
+			"maxFileCount": ListPageSize,
+			"prefix":       it.prefix,
+		}
+		if it.start != "" {
+			request["startFileName"] = it.start
+		}
+		return request
+	}, &result)
+	if err != nil {
+		return nil, fmt.Errorf("b2Lister.Next: %w", err)
+	}
+	page := make([]KeyInfo, 0, len(result.Files))
+	for _, f := range result.Files {
+		if f.Action == "upload" {
+			page = append(page, KeyInfo{Key: Key(f.FileName), Size: f.ContentLength})
+		}
+	}
+	if result.NextFileName == nil {
+		it.done = true
+	} else {
+		it.start = *result.NextFileName
+	}
+	return page, nil
+}
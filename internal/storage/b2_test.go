@@ -0,0 +1,364 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// b2TestServer serves the subset of the B2 API the store uses. It
+// returns at most two files per listing, to exercise paging.
+type b2TestServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	token    string
+	files    map[string][]b2TestVersion // Latest last.
+	versions int
+	uploads  int
+	fail     int    // Requests to answer with 503s.
+	failPath string // Only requests for paths with this prefix fail.
+	requests int
+	used     map[string]int // Uploads per upload URL.
+}
+
+type b2TestVersion struct {
+	id   string
+	data string
+}
+
+func newB2TestServer() *b2TestServer {
+	s := &b2TestServer{
+		token: "token 1",
+		files: make(map[string][]b2TestVersion),
+		used:  make(map[string]int),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+func (s *b2TestServer) respond(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *b2TestServer) error(w http.ResponseWriter, status int, code string) {
+	s.respond(w, status, map[string]interface{}{"status": status, "code": code, "message": code})
+}
+
+func (s *b2TestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.fail > 0 && strings.HasPrefix(r.URL.Path, s.failPath) {
+		s.fail--
+		s.error(w, http.StatusServiceUnavailable, "service_unavailable")
+		return
+	}
+	if r.URL.Path == "/b2api/v2/b2_authorize_account" {
+		if id, key, _ := r.BasicAuth(); id != "id" || key != "key" {
+			s.error(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		s.respond(w, 200, map[string]interface{}{
+			"accountId":          "account",
+			"authorizationToken": s.token,
+			"apiUrl":             s.URL,
+			"downloadUrl":        s.URL,
+			"allowed":            map[string]interface{}{},
+		})
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/upload/") {
+		s.used[r.URL.Path]++
+		if r.Header.Get("Authorization") != "upload "+r.URL.Path {
+			s.error(w, http.StatusUnauthorized, "bad_auth_token")
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		sum := sha1.Sum(body)
+		if r.Header.Get("X-Bz-Content-Sha1") != hex.EncodeToString(sum[:]) {
+			s.error(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		name, _ := url.PathUnescape(r.Header.Get("X-Bz-File-Name"))
+		s.versions++
+		s.files[name] = append(s.files[name], b2TestVersion{id: strconv.Itoa(s.versions), data: string(body)})
+		s.respond(w, 200, map[string]string{"fileName": name})
+		return
+	}
+	if r.Header.Get("Authorization") != s.token {
+		s.error(w, http.StatusUnauthorized, "expired_auth_token")
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/file/bucket/") {
+		versions := s.files[strings.TrimPrefix(r.URL.Path, "/file/bucket/")]
+		if len(versions) == 0 {
+			s.error(w, http.StatusNotFound, "not_found")
+			return
+		}
+		_, _ = io.WriteString(w, versions[len(versions)-1].data)
+		return
+	}
+	var request struct {
+		BucketID      string `json:"bucketId"`
+		StartFileName string `json:"startFileName"`
+		Prefix        string `json:"prefix"`
+		FileName      string `json:"fileName"`
+		FileID        string `json:"fileId"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&request)
+	var names []string
+	for name := range s.files {
+		if strings.HasPrefix(name, request.Prefix) && name >= request.StartFileName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	switch r.URL.Path {
+	case "/b2api/v2/b2_list_buckets":
+		s.respond(w, 200, map[string]interface{}{"buckets": []map[string]string{{"bucketId": "bucket id"}}})
+	case "/b2api/v2/b2_get_upload_url":
+		s.uploads++
+		u := "/upload/" + strconv.Itoa(s.uploads)
+		s.respond(w, 200, map[string]string{"uploadUrl": s.URL + u, "authorizationToken": "upload " + u})
+	case "/b2api/v2/b2_list_file_names":
+		var files []map[string]interface{}
+		var next interface{}
+		for i, name := range names {
+			if i == 2 {
+				next = name
+				break
+			}
+			versions := s.files[name]
+			files = append(files, map[string]interface{}{
+				"fileName":      name,
+				"contentLength": len(versions[len(versions)-1].data),
+				"action":        "upload",
+			})
+		}
+		s.respond(w, 200, map[string]interface{}{"files": files, "nextFileName": next})
+	case "/b2api/v2/b2_list_file_versions":
+		var files []map[string]string
+		for _, name := range names {
+			for _, v := range s.files[name] {
+				files = append(files, map[string]string{"fileName": name, "fileId": v.id})
+			}
+		}
+		s.respond(w, 200, map[string]interface{}{"files": files})
+	case "/b2api/v2/b2_delete_file_version":
+		var kept []b2TestVersion
+		for _, v := range s.files[request.FileName] {
+			if v.id != request.FileID {
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) == len(s.files[request.FileName]) {
+			s.error(w, http.StatusBadRequest, "file_not_present")
+			return
+		}
+		if len(kept) == 0 {
+			delete(s.files, request.FileName)
+		} else {
+			s.files[request.FileName] = kept
+		}
+		s.respond(w, 200, request)
+	default:
+		s.error(w, http.StatusBadRequest, "bad_request")
+	}
+}
+
+func newTestB2Store(server *b2TestServer, ratio float64, reserve int) *b2Store {
+	return &b2Store{
+		keyID:          "id",
+		applicationKey: "key",
+		bucket:         "bucket",
+		authorizeURL:   server.URL + "/b2api/v2/b2_authorize_account",
+		client:         server.Client(),
+		budget:         newRetryBudget(ratio, reserve),
+		interval:       time.Millisecond,
+	}
+}
+
+func TestB2Store(t *testing.T) {
+	server := newB2TestServer()
+	defer server.Close()
+	s := newTestB2Store(server, b2DefaultRetryBudget, b2RetryReserve)
+	values := map[Key]Value{
+		"0123":        []byte("small"),
+		"0199":        []byte("other"),
+		"1234":        []byte{},
+		"remote.base": []byte("pointer"),
+	}
+	for k, v := range values {
+		if err := s.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Overwriting adds a version, the latest is read.
+	values["remote.base"] = []byte("new pointer")
+	if err := s.Put("remote.base", values["remote.base"]); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range values {
+		got, err := s.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(v) {
+			t.Errorf("%q: got %q, want %q", k, got, v)
+		}
+	}
+	if _, err := s.Get("0000"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+	if ok, err := s.Contains("0123"); !ok || err != nil {
+		t.Errorf("got %v, %v, want true, nil", ok, err)
+	}
+	if ok, err := s.Contains("0000"); ok || err != nil {
+		t.Errorf("got %v, %v, want false, nil", ok, err)
+	}
+
+	list := func(prefix string) (keys []Key) {
+		it := s.ListPrefix(prefix)
+		for {
+			page, err := it.Next(context.Background())
+			if errors.Is(err, io.EOF) {
+				return keys
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ki := range page {
+				if ki.Size != int64(len(values[ki.Key])) {
+					t.Errorf("%q: got size %d, want %d", ki.Key, ki.Size, len(values[ki.Key]))
+				}
+				keys = append(keys, ki.Key)
+			}
+		}
+	}
+	if diff := cmp.Diff([]Key{"0123", "0199", "1234", "remote.base"}, list("")); diff != "" {
+		t.Errorf("list all (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]Key{"0123"}, list("012")); diff != "" {
+		t.Errorf("list prefix (-want +got):\n%s", diff)
+	}
+
+	if err := s.Delete("remote.base"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("remote.base"); err != nil {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+	if ok, err := s.Contains("remote.base"); ok || err != nil {
+		t.Errorf("got %v, %v, want false, nil", ok, err)
+	}
+
+	t.Run("expired authorization", func(t *testing.T) {
+		server.mu.Lock()
+		server.token = "token 2"
+		server.mu.Unlock()
+		if _, err := s.Get("0123"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("failed uploads use other URLs", func(t *testing.T) {
+		server.mu.Lock()
+		server.fail, server.failPath = 2, "/upload/"
+		server.mu.Unlock()
+		if err := s.Put("2345", []byte("retried")); err != nil {
+			t.Fatal(err)
+		}
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		for u, n := range server.used {
+			if n > 1 && u != "/upload/1" {
+				t.Errorf("%s: used %d times", u, n)
+			}
+		}
+		if got := server.files["2345"]; len(got) != 1 {
+			t.Errorf("got %d versions, want 1", len(got))
+		}
+	})
+}
+
+func TestB2StoreRetryBudget(t *testing.T) {
+	server := newB2TestServer()
+	defer server.Close()
+	// No refills, so only the reserve of three retries is available.
+	s := newTestB2Store(server, 0, 3)
+	server.fail = 100
+	requests := func() int {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		n := server.requests
+		server.requests = 0
+		return n
+	}
+	if _, err := s.Get("0123"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("got %v, want %v", err, ErrUnavailable)
+	}
+	if got := requests(); got != 4 {
+		t.Errorf("got %d requests, want 4", got)
+	}
+	if _, err := s.Get("0123"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("got %v, want %v", err, ErrUnavailable)
+	}
+	if got := requests(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+
+	// Requests refill the budget: with one retry per two requests,
+	// failing requests are retried every other time.
+	s = newTestB2Store(server, 0.5, 1)
+	s.budget.tokens = 0
+	for i := 0; i < 4; i++ {
+		_, _ = s.Get("0123")
+	}
+	if got := requests(); got != 6 {
+		t.Errorf("got %d requests, want 6", got)
+	}
+
+	// Requests denied are not retried.
+	s = newTestB2Store(server, 0, 3)
+	s.applicationKey = "wrong"
+	server.fail = 0
+	if _, err := s.Get("0123"); !errors.Is(err, ErrDenied) {
+		t.Errorf("got %v, want %v", err, ErrDenied)
+	}
+	if got := requests(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(0.25, 2)
+	var got []bool
+	for i := 0; i < 3; i++ {
+		got = append(got, b.retry())
+	}
+	for i := 0; i < 4; i++ {
+		b.request()
+	}
+	got = append(got, b.retry(), b.retry())
+	if diff := cmp.Diff([]bool{true, true, false, true, false}, got); diff != "" {
+		t.Errorf("(-want +got):\n%s", diff)
+	}
+}
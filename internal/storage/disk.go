@@ -1,15 +1,22 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"syscall"
 )
 
 type DiskStore struct {
 	dir string
+
+	// Bytes stored, maintained only if tracking, see TrackUsage.
+	tracking bool
+	used     int64
 }
 
 func NewDiskStore(dir string) *DiskStore {
@@ -24,27 +31,143 @@ func (s *DiskStore) Get(k Key) (Value, error) {
 	return b, err
 }
 
+// TrackUsage computes how many bytes the store holds, and makes the
+// store keep the count up to date as items are put and deleted, see
+// Usage. It must be called before the store is used.
+func (s *DiskStore) TrackUsage() error {
+	var used int64
+	err := filepath.Walk(s.dir, func(p string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == s.dir {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if s.isItem(p, fi) {
+			used += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.used = used
+	s.tracking = true
+	return nil
+}
+
+// Usage returns how many bytes the store holds, if tracking.
+func (s *DiskStore) Usage() int64 {
+	return atomic.LoadInt64(&s.used)
+}
+
+// size returns the size of the item at pathname, zero if missing.
+func size(pathname string) int64 {
+	if fi, err := os.Stat(pathname); err == nil {
+		return fi.Size()
+	}
+	return 0
+}
+
+// Put writes the value to a temporary file of its own, then renames
+// it over the item, so that processes sharing the directory, e.g.,
+// musclefs and the muscle command sharing a cache, never see, nor
+// produce, partially written items.
 func (s *DiskStore) Put(k Key, v Value) error {
 	p := s.pathFor(k)
-	pnew := p + ".new"
-	err := os.WriteFile(pnew, v, 0666)
+	var prev int64
+	if s.tracking {
+		prev = size(p)
+	}
+	pnew, err := writeTemp(p, v)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			return err
-		}
-		if err = os.MkdirAll(filepath.Dir(pnew), 0777); err != nil {
-			return err
+		return err
+	}
+	if err := syscall.Rename(pnew, p); err != nil {
+		_ = os.Remove(pnew)
+		return err
+	}
+	if s.tracking {
+		atomic.AddInt64(&s.used, int64(len(v))-prev)
+	}
+	return nil
+}
+
+// Suffix of the temporary files Put writes, ignored when listing.
+const tempSuffix = ".new"
+
+// writeTemp writes the value to a new, uniquely named file next to
+// pathname, creating the directory if needed, and returns its name.
+func writeTemp(pathname string, v Value) (string, error) {
+	dir, base := filepath.Split(pathname)
+	f, err := ioutil.TempFile(dir, base+".*"+tempSuffix)
+	if os.IsNotExist(err) {
+		if err = os.MkdirAll(dir, 0777); err != nil {
+			return "", err
 		}
-		err = os.WriteFile(pnew, v, 0666)
+		f, err = ioutil.TempFile(dir, base+".*"+tempSuffix)
+	}
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(v)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// isItem reports whether the file at p, found while walking the
+// store's directory, is an item, rather than, e.g., the lock file or a
+// temporary file.
+func (s *DiskStore) isItem(p string, fi os.FileInfo) bool {
+	return !fi.IsDir() && p != s.lockPath() && !strings.HasSuffix(p, tempSuffix)
+}
+
+// CompareAndSwap serializes updates across processes sharing the
+// directory by means of an advisory lock on a file in the directory.
+func (s *DiskStore) CompareAndSwap(k Key, old, new Value) error {
+	if err := os.MkdirAll(s.dir, 0777); err != nil {
+		return err
 	}
+	f, err := os.OpenFile(s.lockPath(), os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
 		return err
 	}
-	return syscall.Rename(pnew, p)
+	defer func() {
+		// Closing the file releases the lock.
+		_ = f.Close()
+	}()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	current, err := s.Get(k)
+	found := err == nil
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if !matches(current, found, old) {
+		return fmt.Errorf("%q: %w", k, ErrConflict)
+	}
+	return s.Put(k, new)
 }
 
 func (s *DiskStore) Delete(k Key) error {
+	var prev int64
+	if s.tracking {
+		prev = size(s.pathFor(k))
+	}
 	err := os.Remove(s.pathFor(k))
+	if err == nil && s.tracking {
+		atomic.AddInt64(&s.used, -prev)
+	}
 	if err != nil {
 		perr, ok := err.(*os.PathError)
 		if ok {
@@ -63,7 +186,7 @@ func (s *DiskStore) ForEach(cb func(Key) error) error {
 		if err != nil {
 			return err
 		}
-		if !fi.IsDir() {
+		if s.isItem(p, fi) {
 			kk = append(kk, Key(filepath.Base(p)))
 		}
 		return nil
@@ -79,6 +202,36 @@ func (s *DiskStore) ForEach(cb func(Key) error) error {
 	return nil
 }
 
+func (s *DiskStore) List() ListIterator {
+	return s.ListPrefix("")
+}
+
+// ListPrefix only walks the directory the keys with the prefix are
+// stored in, if the prefix is long enough to name one.
+func (s *DiskStore) ListPrefix(prefix string) ListIterator {
+	root := s.dir
+	if len(prefix) >= 2 {
+		root = filepath.Join(s.dir, prefix[:2])
+	}
+	return &sliceIterator{load: func() ([]KeyInfo, error) {
+		var keys []KeyInfo
+		err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if os.IsNotExist(err) && p == root {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if !s.isItem(p, fi) || !strings.HasPrefix(filepath.Base(p), prefix) {
+				return nil
+			}
+			keys = append(keys, KeyInfo{Key: Key(filepath.Base(p)), Size: fi.Size()})
+			return nil
+		})
+		return keys, err
+	}}
+}
+
 func (s *DiskStore) Contains(k Key) (bool, error) {
 	_, err := os.Stat(s.pathFor(k))
 	if os.IsNotExist(err) {
@@ -87,6 +240,10 @@ func (s *DiskStore) Contains(k Key) (bool, error) {
 	return true, err
 }
 
+func (s *DiskStore) lockPath() string {
+	return filepath.Join(s.dir, "lock")
+}
+
 func (s *DiskStore) pathFor(key Key) string {
 	k := string(key)
 	return filepath.Join(s.dir, k[:2], k)
@@ -1,6 +1,10 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
 	"testing"
 	"testing/quick"
 
@@ -79,4 +83,106 @@ func TestDiskStore(t *testing.T) {
 			t.Error(err)
 		}
 	})
+	t.Run("tracks usage", func(t *testing.T) {
+		dir := t.TempDir()
+		store := NewDiskStore(dir)
+		if err := store.TrackUsage(); err != nil {
+			t.Fatal(err)
+		}
+		a, b := randomKey(32), randomKey(32)
+		for _, step := range []struct {
+			op   func() error
+			want int64
+		}{
+			{func() error { return store.Put(a, make(Value, 10)) }, 10},
+			{func() error { return store.Put(b, make(Value, 5)) }, 15},
+			{func() error { return store.Put(a, make(Value, 3)) }, 8},
+			{func() error { return store.Delete(b) }, 3},
+			{func() error { return store.Delete(b) }, 3},
+		} {
+			if err := step.op(); err != nil {
+				t.Fatal(err)
+			}
+			if got := store.Usage(); got != step.want {
+				t.Errorf("got %d, want %d", got, step.want)
+			}
+		}
+		// The count is recomputed from the directory.
+		store = NewDiskStore(dir)
+		if err := store.TrackUsage(); err != nil {
+			t.Fatal(err)
+		}
+		if got := store.Usage(); got != 3 {
+			t.Errorf("got %d, want 3", got)
+		}
+	})
+	t.Run("concurrent writers never leave partial items", func(t *testing.T) {
+		dir := t.TempDir()
+		// Separate stores, as if in separate processes.
+		var writers []*DiskStore
+		for i := 0; i < 8; i++ {
+			writers = append(writers, NewDiskStore(dir))
+		}
+		key := RandomPointer().Key()
+		values := make(map[string]bool)
+		var wg sync.WaitGroup
+		for i, w := range writers {
+			value := bytes.Repeat([]byte{byte('a' + i)}, 1<<16)
+			values[string(value)] = true
+			wg.Add(1)
+			go func(w *DiskStore) {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					if err := w.Put(key, value); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(w)
+		}
+		reader := NewDiskStore(dir)
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		for {
+			if v, err := reader.Get(key); err == nil && !values[string(v)] {
+				t.Fatalf("got a partial or mixed value of %d bytes", len(v))
+			}
+			select {
+			case <-done:
+				var keys []Key
+				if err := reader.ForEach(func(k Key) error {
+					keys = append(keys, k)
+					return nil
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if len(keys) != 1 || keys[0] != key {
+					t.Errorf("got %v, want only %v, and no temporary files", keys, key)
+				}
+				return
+			default:
+			}
+		}
+	})
+	t.Run("lists by prefix", func(t *testing.T) {
+		store := NewDiskStore(t.TempDir())
+		for _, k := range []Key{"remote.root.a", "remote.root.b", "remote.other", "base"} {
+			if err := store.Put(k, Value("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		page, err := store.ListPrefix("remote.root.").Next(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != 2 || page[0].Key != "remote.root.a" || page[1].Key != "remote.root.b" {
+			t.Errorf("got %v, want the two remote.root keys", page)
+		}
+		if _, err := store.ListPrefix("missing").Next(context.Background()); err != io.EOF {
+			t.Errorf("got %v, want %v for a prefix without keys", err, io.EOF)
+		}
+	})
 }
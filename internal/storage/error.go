@@ -5,3 +5,59 @@ import "fmt"
 func errorf(typeMethod, format string, a ...interface{}) error {
 	return fmt.Errorf("github.com/nicolagi/muscle/internal/storage."+typeMethod+": "+format, a...)
 }
+
+// Error describes a failed call to a store, naming the store, so that
+// a failure reported far from the store, e.g., to a 9P client, still
+// tells which store and key failed. See Named.
+type Error struct {
+	Op      string // E.g., "get".
+	Key     Key
+	Backend string // E.g., "cache" or "s3".
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s store: %s %s: %v", e.Backend, e.Op, e.Key, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// named wraps the errors of a store in Error values.
+type named struct {
+	store Store
+	name  string
+}
+
+// Named wraps the store so that the errors it returns are *Error
+// values with the given store name, e.g., "cache" or "s3". The
+// returned store only implements the Store interface.
+func Named(store Store, name string) Store {
+	return &named{store: store, name: name}
+}
+
+func (s *named) wrap(op string, k Key, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Op: op, Key: k, Backend: s.name, Err: err}
+}
+
+func (s *named) Get(k Key) (Value, error) {
+	v, err := s.store.Get(k)
+	return v, s.wrap("get", k, err)
+}
+
+func (s *named) Put(k Key, v Value) error {
+	return s.wrap("put", k, s.store.Put(k, v))
+}
+
+func (s *named) Delete(k Key) error {
+	return s.wrap("delete", k, s.store.Delete(k))
+}
+
+func (s *named) Contains(k Key) (bool, error) {
+	ok, err := s.store.Contains(k)
+	return ok, s.wrap("contains", k, err)
+}
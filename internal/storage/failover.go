@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Weight of the latest sample in the moving average of latencies.
+const failoverLatencyWeight = 0.2
+
+// The key probes ask for: it has the form of the content-addressed keys
+// replicas serve, but no value has it.
+const failoverProbeKey = Key("0000000000000000000000000000000000000000000000000000000000000000")
+
+// A Replica is a store holding copies of the values of another, e.g.,
+// a disk kept in sync by other means, or a peer's mirror.
+type Replica struct {
+	Name  string
+	Store Store
+}
+
+// ReplicaStatus describes the health of a replica, see Failover.Status.
+type ReplicaStatus struct {
+	Name      string
+	Healthy   bool
+	Latency   time.Duration // Moving average of successful calls.
+	Reads     int64         // Values read from the replica.
+	Failures  int64
+	LastError error
+}
+
+func (s ReplicaStatus) String() string {
+	health := "healthy"
+	if !s.Healthy {
+		health = "unhealthy"
+	}
+	line := fmt.Sprintf("%s %s latency %v reads %d failures %d", s.Name, health, s.Latency.Round(time.Microsecond), s.Reads, s.Failures)
+	if s.LastError != nil {
+		line += " last-error " + strings.ReplaceAll(s.LastError.Error(), "\n", " ")
+	}
+	return line
+}
+
+type replicaState struct {
+	Replica
+	status ReplicaStatus
+}
+
+// Failover is a store whose values can be read from any of several
+// replicas, for content-addressed values only, which can't be stale.
+// Reads go to the healthy replica with the lowest latency; a replica
+// that fails is marked unhealthy, and the read fails over to the next,
+// until Probe finds it healthy again. A replica missing the value
+// doesn't count as failing, e.g., it may lag behind. Only reads fail
+// over: Contains, Put and Delete go to the first replica only, the
+// primary.
+type Failover struct {
+	mu       sync.Mutex
+	replicas []*replicaState
+}
+
+// NewFailover returns a store reading from the replicas, the first
+// being the primary.
+func NewFailover(replicas ...Replica) *Failover {
+	f := &Failover{}
+	for _, r := range replicas {
+		f.replicas = append(f.replicas, &replicaState{Replica: r, status: ReplicaStatus{Name: r.Name, Healthy: true}})
+	}
+	return f
+}
+
+// ordered returns the replicas healthy ones first, by latency.
+func (f *Failover) ordered() []*replicaState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rr := append([]*replicaState(nil), f.replicas...)
+	sort.SliceStable(rr, func(i, j int) bool {
+		a, b := rr[i].status, rr[j].status
+		if a.Healthy != b.Healthy {
+			return a.Healthy
+		}
+		return a.Latency < b.Latency
+	})
+	return rr
+}
+
+// record updates the status of the replica after a call that took d.
+func (f *Failover) record(r *replicaState, d time.Duration, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		r.status.Healthy = false
+		r.status.Failures++
+		r.status.LastError = err
+		return
+	}
+	r.status.Healthy = true
+	if r.status.Latency == 0 {
+		r.status.Latency = d
+	} else {
+		r.status.Latency += time.Duration(failoverLatencyWeight * float64(d-r.status.Latency))
+	}
+}
+
+func (f *Failover) Get(k Key) (Value, error) {
+	var errs []string
+	for _, r := range f.ordered() {
+		start := time.Now()
+		v, err := r.Store.Get(k)
+		f.record(r, time.Since(start), err)
+		if err == nil {
+			f.mu.Lock()
+			r.status.Reads++
+			f.mu.Unlock()
+			return v, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			errs = append(errs, fmt.Sprintf("%s: %v", r.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("storage.Failover.Get %q: %s", k, strings.Join(errs, "; "))
+	}
+	return nil, fmt.Errorf("storage.Failover.Get %q: %w", k, ErrNotFound)
+}
+
+// Contains only asks the primary: a value held by a replica but not
+// the primary must still be written to it, e.g., by Paired.
+func (f *Failover) Contains(k Key) (bool, error) {
+	return f.replicas[0].Store.Contains(k)
+}
+
+func (f *Failover) Put(k Key, v Value) error {
+	return f.replicas[0].Store.Put(k, v)
+}
+
+func (f *Failover) Delete(k Key) error {
+	return f.replicas[0].Store.Delete(k)
+}
+
+// Probe checks every replica, updating its health and latency.
+func (f *Failover) Probe() {
+	var wg sync.WaitGroup
+	for _, r := range f.replicas {
+		wg.Add(1)
+		go func(r *replicaState) {
+			defer wg.Done()
+			start := time.Now()
+			_, err := r.Store.Contains(failoverProbeKey)
+			f.record(r, time.Since(start), err)
+		}(r)
+	}
+	wg.Wait()
+}
+
+// StartProbes probes the replicas at the interval, in the background.
+func (f *Failover) StartProbes(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			f.Probe()
+		}
+	}()
+}
+
+// Status returns the status of the replicas, in the order given to
+// NewFailover.
+func (f *Failover) Status() []ReplicaStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ss []ReplicaStatus
+	for _, r := range f.replicas {
+		ss = append(ss, r.status)
+	}
+	return ss
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFailover(t *testing.T) {
+	primary, near := new(InMemory), new(InMemory)
+	down := true
+	flaky := storeFuncs{
+		get: func(Key) (Value, error) {
+			if down {
+				return nil, errors.New("connection refused")
+			}
+			return Value("from flaky"), nil
+		},
+		contains: func(Key) (bool, error) {
+			if down {
+				return false, errors.New("connection refused")
+			}
+			return false, nil
+		},
+	}
+	slow := storeFuncs{
+		get: func(k Key) (Value, error) {
+			time.Sleep(10 * time.Millisecond)
+			return primary.Get(k)
+		},
+		put:    primary.Put,
+		delete: primary.Delete,
+		contains: func(k Key) (bool, error) {
+			time.Sleep(10 * time.Millisecond)
+			return primary.Contains(k)
+		},
+	}
+	f := NewFailover(Replica{Name: "primary", Store: slow}, Replica{Name: "flaky", Store: flaky}, Replica{Name: "near", Store: near})
+	status := func(name string) ReplicaStatus {
+		t.Helper()
+		for _, s := range f.Status() {
+			if s.Name == name {
+				return s
+			}
+		}
+		t.Fatalf("no replica %q", name)
+		return ReplicaStatus{}
+	}
+
+	// Writes go to the primary only.
+	if err := f.Put("k", Value("v")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := near.Contains("k"); ok {
+		t.Fatal("put went to a replica")
+	}
+	// A value only a replica holds is not in the store, so that it
+	// gets written to the primary.
+	if err := near.Put("other", Value("v")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := f.Contains("other"); ok || err != nil {
+		t.Errorf("got %v, %v, want false, nil", ok, err)
+	}
+	if err := near.Delete("other"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The probes find the flaky replica down, and the near one faster
+	// than the primary.
+	f.Probe()
+	if s := status("flaky"); s.Healthy || s.Failures != 1 || s.LastError == nil {
+		t.Errorf("got %v, want the flaky replica unhealthy", s)
+	}
+	if p, n := status("primary"), status("near"); p.Latency <= n.Latency {
+		t.Errorf("got latencies %v and %v, want the near replica faster", p.Latency, n.Latency)
+	}
+
+	// The near replica lags behind, so the read falls back to the
+	// primary, without counting as a failure.
+	if v, err := f.Get("k"); err != nil || string(v) != "v" {
+		t.Errorf("got %q, %v, want the value from the primary", v, err)
+	}
+	if s := status("near"); !s.Healthy || s.Failures != 0 {
+		t.Errorf("got %v, want the lagging replica healthy", s)
+	}
+	if err := near.Put("k", Value("v")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Get("k"); err != nil {
+		t.Fatal(err)
+	}
+	if s := status("near"); s.Reads != 1 {
+		t.Errorf("got %v, want one read from the near replica", s)
+	}
+
+	// Once the flaky replica recovers, a probe finds it healthy.
+	down = false
+	f.Probe()
+	if s := status("flaky"); !s.Healthy {
+		t.Errorf("got %v, want the flaky replica healthy again", s)
+	}
+}
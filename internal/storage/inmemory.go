@@ -1,10 +1,14 @@
 package storage
 
 import (
+	"fmt"
+	"strings"
 	"sync"
 )
 
-// InMemory implements Store, meant to be used in unit tests in other packages.
+// InMemory implements Store, keeping all values in memory. It backs the
+// "memory" storage type, meant for demos and hermetic tests, and is
+// used in unit tests in other packages.
 type InMemory struct {
 	sync.Mutex
 	m map[Key]Value
@@ -33,9 +37,63 @@ func (s *InMemory) Put(k Key, v Value) error {
 	return nil
 }
 
+func (s *InMemory) Contains(k Key) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.m[k]
+	return ok, nil
+}
+
+func (s *InMemory) CompareAndSwap(k Key, old, new Value) error {
+	s.Lock()
+	defer s.Unlock()
+	current, found := s.m[k]
+	if !matches(current, found, old) {
+		return fmt.Errorf("%q: %w", k, ErrConflict)
+	}
+	if s.m == nil {
+		s.m = make(map[Key]Value)
+	}
+	s.m[k] = new
+	return nil
+}
+
 func (s *InMemory) Delete(k Key) error {
 	s.Lock()
 	defer s.Unlock()
 	delete(s.m, k)
 	return nil
 }
+
+func (s *InMemory) ForEach(cb func(Key) error) error {
+	s.Lock()
+	kk := make([]Key, 0, len(s.m))
+	for k := range s.m {
+		kk = append(kk, k)
+	}
+	s.Unlock()
+	for _, k := range kk {
+		if err := cb(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *InMemory) List() ListIterator {
+	return s.ListPrefix("")
+}
+
+func (s *InMemory) ListPrefix(prefix string) ListIterator {
+	return &sliceIterator{load: func() ([]KeyInfo, error) {
+		s.Lock()
+		defer s.Unlock()
+		keys := make([]KeyInfo, 0, len(s.m))
+		for k, v := range s.m {
+			if strings.HasPrefix(string(k), prefix) {
+				keys = append(keys, KeyInfo{Key: k, Size: int64(len(v))})
+			}
+		}
+		return keys, nil
+	}}
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+)
+
+// KeyInfo describes a key listed by a ListIterator.
+type KeyInfo struct {
+	Key  Key
+	Size int64
+}
+
+// A ListIterator returns the keys in a store a page at a time, so that
+// listing a large store can be stopped between pages, and errors are
+// reported for the page they affect rather than for the whole listing.
+type ListIterator interface {
+	// Next returns the next page of keys, or io.EOF after the last
+	// page. After any other error, the iterator is positioned at the
+	// same page, so calling Next again retries it. The context
+	// bounds the time spent fetching the page, including retries of
+	// throttled requests.
+	Next(ctx context.Context) ([]KeyInfo, error)
+}
+
+// ListPageSize is the number of keys per page for stores without a
+// natural page size.
+const ListPageSize = 1000
+
+// ListAll calls the function for each key listed by the store, page by
+// page, until all keys are listed, the function returns an error, or
+// the context is done.
+func ListAll(ctx context.Context, store Lister, cb func(KeyInfo) error) error {
+	it := store.List()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		page, err := it.Next(ctx)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, ki := range page {
+			if err := cb(ki); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sliceIterator pages through keys known in advance, loaded on the
+// first call to Next.
+type sliceIterator struct {
+	load   func() ([]KeyInfo, error)
+	keys   []KeyInfo
+	loaded bool
+}
+
+func (it *sliceIterator) Next(ctx context.Context) ([]KeyInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !it.loaded {
+		keys, err := it.load()
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].Key < keys[j].Key
+		})
+		it.keys, it.loaded = keys, true
+	}
+	if len(it.keys) == 0 {
+		return nil, io.EOF
+	}
+	n := ListPageSize
+	if n > len(it.keys) {
+		n = len(it.keys)
+	}
+	page := it.keys[:n]
+	it.keys = it.keys[n:]
+	return page, nil
+}
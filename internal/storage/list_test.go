@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestListAll(t *testing.T) {
+	store := &InMemory{}
+	for i := 0; i < ListPageSize+1; i++ {
+		if err := store.Put(Key(fmt.Sprintf("k%04d", i)), Value("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("pages", func(t *testing.T) {
+		it := store.List()
+		ctx := context.Background()
+		page, err := it.Next(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != ListPageSize {
+			t.Errorf("got %d keys, want %d", len(page), ListPageSize)
+		}
+		if page[0] != (KeyInfo{Key: "k0000", Size: 1}) {
+			t.Errorf("got %+v, want k0000 of size 1", page[0])
+		}
+		if page, err = it.Next(ctx); err != nil || len(page) != 1 {
+			t.Errorf("got %d keys and %v, want 1 key", len(page), err)
+		}
+		if _, err = it.Next(ctx); err != io.EOF {
+			t.Errorf("got %v, want %v", err, io.EOF)
+		}
+	})
+
+	t.Run("all keys", func(t *testing.T) {
+		n := 0
+		err := ListAll(context.Background(), store, func(KeyInfo) error {
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != ListPageSize+1 {
+			t.Errorf("got %d keys, want %d", n, ListPageSize+1)
+		}
+	})
+
+	t.Run("stops when the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		n := 0
+		err := ListAll(ctx, store, func(KeyInfo) error {
+			n++
+			cancel()
+			return nil
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want %v", err, context.Canceled)
+		}
+		if n != ListPageSize {
+			t.Errorf("got %d keys, want the first page of %d", n, ListPageSize)
+		}
+	})
+}
@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics counts the calls made to stores, and the bytes transferred,
+// by store and operation, e.g., to estimate what a usage pattern costs
+// with a backend that charges per request. Counts can be persisted and
+// loaded, so that they accumulate across runs.
+type Metrics struct {
+	mu     sync.Mutex
+	since  time.Time
+	counts map[metricsKey]*MetricsEntry
+}
+
+type metricsKey struct {
+	store string
+	op    string
+}
+
+// MetricsEntry is the count of calls of one operation on one store.
+type MetricsEntry struct {
+	Store string
+	Op    string // E.g., "get", "put", "delete", "contains", "list".
+	Calls int64
+	Bytes int64 // Read by gets, written by puts.
+}
+
+// NewMetrics returns metrics with no calls counted since now.
+func NewMetrics() *Metrics {
+	return &Metrics{since: time.Now(), counts: make(map[metricsKey]*MetricsEntry)}
+}
+
+// Add counts a call.
+func (m *Metrics) Add(store, op string, bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := metricsKey{store: store, op: op}
+	e := m.counts[k]
+	if e == nil {
+		e = &MetricsEntry{Store: store, Op: op}
+		m.counts[k] = e
+	}
+	e.Calls++
+	e.Bytes += int64(bytes)
+}
+
+// Merge adds the counts of other to m, e.g., to report the calls made
+// by different programs together. Counting started at the earlier of
+// the two times.
+func (m *Metrics) Merge(other *Metrics) {
+	since, entries := other.Snapshot()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if since.Before(m.since) {
+		m.since = since
+	}
+	for _, o := range entries {
+		k := metricsKey{store: o.Store, op: o.Op}
+		e := m.counts[k]
+		if e == nil {
+			e = &MetricsEntry{Store: o.Store, Op: o.Op}
+			m.counts[k] = e
+		}
+		e.Calls += o.Calls
+		e.Bytes += o.Bytes
+	}
+}
+
+// Snapshot returns when counting started and the counts so far, sorted
+// by store and operation.
+func (m *Metrics) Snapshot() (since time.Time, entries []MetricsEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.counts {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Store != entries[j].Store {
+			return entries[i].Store < entries[j].Store
+		}
+		return entries[i].Op < entries[j].Op
+	})
+	return m.since, entries
+}
+
+// WriteTo writes the metrics in the format LoadMetrics reads: a line
+// "since UNIXTIME", then a line "STORE OP CALLS BYTES" per entry.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	since, entries := m.Snapshot()
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "since %d\n", since.Unix())
+	for _, e := range entries {
+		_, _ = fmt.Fprintf(&b, "%s %s %d %d\n", e.Store, e.Op, e.Calls, e.Bytes)
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Save atomically replaces the file at pathname with the metrics.
+func (m *Metrics) Save(pathname string) error {
+	var b strings.Builder
+	_, _ = m.WriteTo(&b)
+	if err := ioutil.WriteFile(pathname+".new", []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("storage.Metrics.Save: %w", err)
+	}
+	if err := os.Rename(pathname+".new", pathname); err != nil {
+		return fmt.Errorf("storage.Metrics.Save: %w", err)
+	}
+	return nil
+}
+
+// LoadMetrics reads the metrics saved at pathname. A missing file
+// means new metrics.
+func LoadMetrics(pathname string) (*Metrics, error) {
+	f, err := os.Open(pathname)
+	if os.IsNotExist(err) {
+		return NewMetrics(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("storage.LoadMetrics: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	m := NewMetrics()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		switch {
+		case len(fields) == 2 && fields[0] == "since":
+			seconds, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("storage.LoadMetrics: line %q: %w", s.Text(), err)
+			}
+			m.since = time.Unix(seconds, 0)
+		case len(fields) == 4:
+			calls, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("storage.LoadMetrics: line %q: %w", s.Text(), err)
+			}
+			bytes, err := strconv.ParseInt(fields[3], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("storage.LoadMetrics: line %q: %w", s.Text(), err)
+			}
+			m.counts[metricsKey{store: fields[0], op: fields[1]}] = &MetricsEntry{Store: fields[0], Op: fields[1], Calls: calls, Bytes: bytes}
+		default:
+			return nil, fmt.Errorf("storage.LoadMetrics: malformed line %q", s.Text())
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("storage.LoadMetrics: %w", err)
+	}
+	return m, nil
+}
+
+// metered counts the calls to the wrapped store.
+type metered struct {
+	store   Store
+	name    string
+	metrics *Metrics
+}
+
+var (
+	_ Lister       = (*metered)(nil)
+	_ PrefixLister = (*metered)(nil)
+	_ BatchDeleter = (*metered)(nil)
+	_ Swapper      = (*metered)(nil)
+)
+
+// Metered wraps the store so that its calls are counted in the metrics
+// under the given store name, e.g., "s3". Nil metrics return the store
+// unchanged. Each page listed counts as a "list" call, each batch
+// deleted as a "deletebatch" call, and each conditional update as a
+// "cas" call, as backends charge for those requests.
+//
+// The returned store implements Lister, PrefixLister, BatchDeleter
+// and Swapper, so that it can stand in for a remote store or a store
+// of tags. If the wrapped store doesn't implement them, listing fails
+// with ErrNotImplemented, listing by prefix filters a full listing,
+// batches are deleted a key at a time, and conditional updates are
+// unconditional puts, which is what callers do for such stores.
+func Metered(store Store, name string, metrics *Metrics) Store {
+	if metrics == nil {
+		return store
+	}
+	return &metered{store: store, name: name, metrics: metrics}
+}
+
+func (s *metered) Get(k Key) (Value, error) {
+	v, err := s.store.Get(k)
+	s.metrics.Add(s.name, "get", len(v))
+	return v, err
+}
+
+func (s *metered) Put(k Key, v Value) error {
+	s.metrics.Add(s.name, "put", len(v))
+	return s.store.Put(k, v)
+}
+
+func (s *metered) Delete(k Key) error {
+	s.metrics.Add(s.name, "delete", 0)
+	return s.store.Delete(k)
+}
+
+func (s *metered) Contains(k Key) (bool, error) {
+	s.metrics.Add(s.name, "contains", 0)
+	return s.store.Contains(k)
+}
+
+func (s *metered) List() ListIterator {
+	lister, ok := s.store.(Lister)
+	if !ok {
+		return &failingIterator{err: fmt.Errorf("storage.metered.List: %T: %w", s.store, ErrNotImplemented)}
+	}
+	return &meteredIterator{it: lister.List(), store: s}
+}
+
+func (s *metered) ListPrefix(prefix string) ListIterator {
+	if lister, ok := s.store.(PrefixLister); ok {
+		return &meteredIterator{it: lister.ListPrefix(prefix), store: s}
+	}
+	return &prefixIterator{it: s.List(), prefix: prefix}
+}
+
+func (s *metered) DeleteBatch(keys []Key) (map[Key]error, error) {
+	batcher, ok := s.store.(BatchDeleter)
+	if !ok {
+		failed := make(map[Key]error)
+		for _, k := range keys {
+			if err := s.Delete(k); err != nil {
+				failed[k] = err
+			}
+		}
+		return failed, nil
+	}
+	s.metrics.Add(s.name, "deletebatch", 0)
+	return batcher.DeleteBatch(keys)
+}
+
+func (s *metered) CompareAndSwap(k Key, old, new Value) error {
+	swapper, ok := s.store.(Swapper)
+	if !ok {
+		return s.Put(k, new)
+	}
+	s.metrics.Add(s.name, "cas", len(new))
+	return swapper.CompareAndSwap(k, old, new)
+}
+
+// meteredIterator counts the pages fetched, successfully or not, as
+// list calls.
+type meteredIterator struct {
+	it    ListIterator
+	store *metered
+}
+
+func (it *meteredIterator) Next(ctx context.Context) ([]KeyInfo, error) {
+	page, err := it.it.Next(ctx)
+	if !errors.Is(err, io.EOF) {
+		it.store.metrics.Add(it.store.name, "list", 0)
+	}
+	return page, err
+}
+
+// prefixIterator keeps only the keys with the prefix, skipping the
+// pages left empty.
+type prefixIterator struct {
+	it     ListIterator
+	prefix string
+}
+
+func (it *prefixIterator) Next(ctx context.Context) ([]KeyInfo, error) {
+	for {
+		page, err := it.it.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var kept []KeyInfo
+		for _, ki := range page {
+			if strings.HasPrefix(string(ki.Key), it.prefix) {
+				kept = append(kept, ki)
+			}
+		}
+		if len(kept) > 0 {
+			return kept, nil
+		}
+	}
+}
+
+// failingIterator fails every call to Next with the same error.
+type failingIterator struct {
+	err error
+}
+
+func (it *failingIterator) Next(context.Context) ([]KeyInfo, error) {
+	return nil, it.err
+}
+
+// CostModel is what a backend charges: per thousand calls, by
+// operation, and per GiB read.
+type CostModel struct {
+	PerThousandCalls map[string]float64
+	PerGiBRead       float64
+}
+
+// Cost returns the cost of the calls counted in the entries for the
+// given store.
+func (c CostModel) Cost(entries []MetricsEntry, store string) float64 {
+	var cost float64
+	for _, e := range entries {
+		if e.Store != store {
+			continue
+		}
+		cost += float64(e.Calls) / 1000 * c.PerThousandCalls[e.Op]
+		if e.Op == "get" {
+			cost += float64(e.Bytes) / (1 << 30) * c.PerGiBRead
+		}
+	}
+	return cost
+}
+
+// Monthly extrapolates a cost incurred over the given period to a
+// 30-day month.
+func Monthly(cost float64, period time.Duration) float64 {
+	if period <= 0 {
+		return 0
+	}
+	return cost * float64(30*24*time.Hour) / float64(period)
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetered(t *testing.T) {
+	inner := &InMemory{}
+	if got := Metered(inner, "memory", nil); got != Store(inner) {
+		t.Errorf("got %v, want the store unchanged", got)
+	}
+
+	metrics := NewMetrics()
+	s := Metered(inner, "remote", metrics)
+	if err := s.Put("k1", Value("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("k2"); err != ErrNotFound {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+	if _, err := s.Contains("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("k1"); err != nil {
+		t.Fatal(err)
+	}
+	_, got := metrics.Snapshot()
+	want := []MetricsEntry{
+		{Store: "remote", Op: "contains", Calls: 1},
+		{Store: "remote", Op: "delete", Calls: 1},
+		{Store: "remote", Op: "get", Calls: 2, Bytes: 5},
+		{Store: "remote", Op: "put", Calls: 1, Bytes: 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	t.Run("save and load", func(t *testing.T) {
+		pathname := filepath.Join(t.TempDir(), "metrics")
+		if err := metrics.Save(pathname); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadMetrics(pathname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded.Add("remote", "get", 1)
+		since, got := loaded.Snapshot()
+		if wantSince, _ := metrics.Snapshot(); !since.Equal(wantSince.Truncate(time.Second)) {
+			t.Errorf("got %v, want %v", since, wantSince.Truncate(time.Second))
+		}
+		want[2].Calls, want[2].Bytes = 3, 6
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("missing file means new metrics", func(t *testing.T) {
+		loaded, err := LoadMetrics(filepath.Join(t.TempDir(), "metrics"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, entries := loaded.Snapshot(); len(entries) != 0 {
+			t.Errorf("got %+v, want no entries", entries)
+		}
+	})
+}
+
+func TestMeteredOptionalInterfaces(t *testing.T) {
+	inner := &InMemory{}
+	for i := 0; i < ListPageSize+1; i++ {
+		if err := inner.Put(Key(fmt.Sprintf("k%04d", i)), Value("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metrics := NewMetrics()
+	s := Metered(inner, "remote", metrics)
+	var listed int
+	if err := ListAll(context.Background(), s.(Lister), func(KeyInfo) error {
+		listed++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if listed != ListPageSize+1 {
+		t.Errorf("listed %d keys, want %d", listed, ListPageSize+1)
+	}
+	if err := s.(Swapper).CompareAndSwap("tag", nil, Value("p1")); err != nil {
+		t.Fatal(err)
+	}
+	// The in-memory store can't delete in batches.
+	if failed, err := s.(BatchDeleter).DeleteBatch([]Key{"k0000", "k0001"}); err != nil || len(failed) != 0 {
+		t.Fatalf("got %v, %v, want no failures", failed, err)
+	}
+	_, got := metrics.Snapshot()
+	want := []MetricsEntry{
+		{Store: "remote", Op: "cas", Calls: 1, Bytes: 2},
+		{Store: "remote", Op: "delete", Calls: 2},
+		{Store: "remote", Op: "list", Calls: 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	t.Run("store that can't list", func(t *testing.T) {
+		s := Metered(NullStore{}, "null", NewMetrics())
+		if _, err := s.(Lister).List().Next(context.Background()); !errors.Is(err, ErrNotImplemented) {
+			t.Errorf("got %v, want %v", err, ErrNotImplemented)
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		other := NewMetrics()
+		other.since = other.since.Add(-time.Hour)
+		other.Add("remote", "list", 0)
+		other.Add("remote", "deletebatch", 0)
+		metrics.Merge(other)
+		since, got := metrics.Snapshot()
+		if wantSince, _ := other.Snapshot(); !since.Equal(wantSince) {
+			t.Errorf("got %v, want %v", since, wantSince)
+		}
+		want := []MetricsEntry{
+			{Store: "remote", Op: "cas", Calls: 1, Bytes: 2},
+			{Store: "remote", Op: "delete", Calls: 2},
+			{Store: "remote", Op: "deletebatch", Calls: 1},
+			{Store: "remote", Op: "list", Calls: 3},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+}
+
+func TestCostModel(t *testing.T) {
+	model := CostModel{
+		PerThousandCalls: map[string]float64{"get": 0.4, "put": 5},
+		PerGiBRead:       0.1,
+	}
+	entries := []MetricsEntry{
+		{Store: "cache", Op: "get", Calls: 1000000, Bytes: 1 << 40},
+		{Store: "s3", Op: "contains", Calls: 1000},
+		{Store: "s3", Op: "get", Calls: 2000, Bytes: 10 << 30},
+		{Store: "s3", Op: "put", Calls: 500},
+	}
+	if got, want := model.Cost(entries, "s3"), 0.8+2.5+1; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := Monthly(1, 24*time.Hour), 30.0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := Monthly(1, 0); got != 0 {
+		t.Errorf("got %v, want 0", got)
+	}
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MirrorHandler serves the values of content-addressed keys in the
+// store, e.g., the cache of a musclefs on the LAN, to requests like
+// GET /KEY bearing the token, with support for range requests. Other
+// keys, e.g., those of tags, are not served, since they are mutable.
+func MirrorHandler(store Store, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		if _, err := NewPointerFromHex(key); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		value, err := store.Get(Key(key))
+		if errors.Is(err, ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(value))
+	})
+}
+
+// httpMirror reads values from a MirrorHandler.
+type httpMirror struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewHTTPMirror returns a store reading from the MirrorHandler at the
+// URL, e.g., http://peer:4000. Puts and deletes fail with ErrReadOnly.
+func NewHTTPMirror(url string, token string) Store {
+	return &httpMirror{
+		url:    strings.TrimSuffix(url, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *httpMirror) do(method string, k Key) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url+"/"+string(k), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	return s.client.Do(req)
+}
+
+func (s *httpMirror) Get(k Key) (Value, error) {
+	res, err := s.do(http.MethodGet, k)
+	if err != nil {
+		return nil, fmt.Errorf("httpMirror.Get %q: %w", k, err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("httpMirror.Get %q: %w", k, err)
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("httpMirror.Get %q: %w", k, ErrNotFound)
+	default:
+		return nil, fmt.Errorf("httpMirror.Get %q: %d status code", k, res.StatusCode)
+	}
+}
+
+func (s *httpMirror) Put(k Key, _ Value) error {
+	return fmt.Errorf("httpMirror.Put %q: %w", k, ErrReadOnly)
+}
+
+func (s *httpMirror) Delete(k Key) error {
+	return fmt.Errorf("httpMirror.Delete %q: %w", k, ErrReadOnly)
+}
+
+func (s *httpMirror) Contains(k Key) (bool, error) {
+	res, err := s.do(http.MethodHead, k)
+	if err != nil {
+		return false, fmt.Errorf("httpMirror.Contains %q: %w", k, err)
+	}
+	_ = res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("httpMirror.Contains %q: %d status code", k, res.StatusCode)
+	}
+}
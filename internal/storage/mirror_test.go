@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMirror(t *testing.T) {
+	cache := &InMemory{}
+	key := RandomPointer().Key()
+	if err := cache.Put(key, Value("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Put("remote.root.base", Value("mutable")); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(MirrorHandler(cache, "secret"))
+	defer server.Close()
+
+	t.Run("token required", func(t *testing.T) {
+		if _, err := NewHTTPMirror(server.URL, "wrong").Get(key); err == nil {
+			t.Error("got nil, want an error")
+		}
+	})
+
+	t.Run("range requests", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/"+string(key), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("Range", "bytes=2-4")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		_ = res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusPartialContent || string(body) != "234" {
+			t.Errorf("got %d %q, want %d %q", res.StatusCode, body, http.StatusPartialContent, "234")
+		}
+	})
+
+	mirror := NewHTTPMirror(server.URL, "secret")
+	if v, err := mirror.Get(key); err != nil || string(v) != "0123456789" {
+		t.Errorf("got %q, %v, want the cached value", v, err)
+	}
+	if ok, err := mirror.Contains(key); err != nil || !ok {
+		t.Errorf("got %v, %v, want true", ok, err)
+	}
+	if _, err := mirror.Get("remote.root.base"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+	if err := mirror.Put(key, nil); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("got %v, want %v", err, ErrReadOnly)
+	}
+
+	t.Run("tiered falls back to the store", func(t *testing.T) {
+		remote := &InMemory{}
+		other := RandomPointer().Key()
+		if err := remote.Put(other, Value("remote")); err != nil {
+			t.Fatal(err)
+		}
+		s := NewTiered(Tier{Store: mirror, Promotion: PromoteNever}, Tier{Store: remote})
+		if v, err := s.Get(key); err != nil || string(v) != "0123456789" {
+			t.Errorf("got %q, %v, want the mirrored value", v, err)
+		}
+		if v, err := s.Get(other); err != nil || string(v) != "remote" {
+			t.Errorf("got %q, %v, want the remote value", v, err)
+		}
+		if err := s.Put(key, Value("put")); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := remote.Get(key); err != nil || string(v) != "put" {
+			t.Errorf("got %q, %v, want the put value in the store", v, err)
+		}
+	})
+}
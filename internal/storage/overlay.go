@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// readOnly rejects writes to the wrapped store.
+type readOnly struct {
+	store Store
+}
+
+// ReadOnly wraps the store so that puts and deletes fail with
+// ErrReadOnly. The returned store also lists the keys, see Lister and
+// PrefixLister, failing with ErrNotImplemented if the store can't.
+func ReadOnly(store Store) Store {
+	return readOnly{store: store}
+}
+
+func (s readOnly) Get(k Key) (Value, error) {
+	return s.store.Get(k)
+}
+
+func (s readOnly) Put(k Key, _ Value) error {
+	return fmt.Errorf("storage.readOnly.Put %q: %w", k, ErrReadOnly)
+}
+
+func (s readOnly) Delete(k Key) error {
+	return fmt.Errorf("storage.readOnly.Delete %q: %w", k, ErrReadOnly)
+}
+
+func (s readOnly) Contains(k Key) (bool, error) {
+	return s.store.Contains(k)
+}
+
+func (s readOnly) List() ListIterator {
+	return listStore("storage.readOnly.List", s.store)
+}
+
+func (s readOnly) ListPrefix(prefix string) ListIterator {
+	return listStorePrefix("storage.readOnly.ListPrefix", s.store, prefix)
+}
+
+// listStore lists the store, if it's a Lister.
+func listStore(method string, store Store) ListIterator {
+	if lister, ok := store.(Lister); ok {
+		return lister.List()
+	}
+	return &failingIterator{err: fmt.Errorf("%s: %T: %w", method, store, ErrNotImplemented)}
+}
+
+// listStorePrefix lists the keys of the store with the prefix, filtering a
+// listing of the whole store if it isn't a PrefixLister.
+func listStorePrefix(method string, store Store, prefix string) ListIterator {
+	if lister, ok := store.(PrefixLister); ok {
+		return lister.ListPrefix(prefix)
+	}
+	return &prefixIterator{it: listStore(method, store), prefix: prefix}
+}
+
+// overlay reads from the lower store what's not in the upper store,
+// and writes only to the upper store.
+type overlay struct {
+	upper Store
+	lower Store
+
+	mu sync.Mutex
+	// Keys deleted from the overlay, which may still be in the
+	// lower store.
+	deleted map[Key]struct{}
+
+	// Serializes CompareAndSwap, which reads from both stores.
+	swapping sync.Mutex
+}
+
+// Overlay returns a store that writes to upper, leaving lower
+// untouched, and reads from upper, falling back to lower. Keys deleted
+// from the overlay are no longer read from lower, for the lifetime of
+// the overlay. The returned store also lists the keys of both stores,
+// see Lister and PrefixLister, and implements Swapper, swapping the
+// values in upper.
+func Overlay(upper, lower Store) Store {
+	return &overlay{upper: upper, lower: lower, deleted: make(map[Key]struct{})}
+}
+
+func (s *overlay) isDeleted(k Key) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.deleted[k]
+	return ok
+}
+
+func (s *overlay) Get(k Key) (Value, error) {
+	v, err := s.upper.Get(k)
+	if errors.Is(err, ErrNotFound) && !s.isDeleted(k) {
+		return s.lower.Get(k)
+	}
+	return v, err
+}
+
+func (s *overlay) Put(k Key, v Value) error {
+	if err := s.upper.Put(k, v); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.deleted, k)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *overlay) Delete(k Key) error {
+	if err := s.upper.Delete(k); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.deleted[k] = struct{}{}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *overlay) Contains(k Key) (bool, error) {
+	ok, err := s.upper.Contains(k)
+	if err != nil || ok || s.isDeleted(k) {
+		return ok, err
+	}
+	return s.lower.Contains(k)
+}
+
+func (s *overlay) List() ListIterator {
+	return &overlayIterator{
+		s:      s,
+		upper:  listStore("storage.overlay.List", s.upper),
+		lower:  listStore("storage.overlay.List", s.lower),
+		listed: make(map[Key]struct{}),
+	}
+}
+
+func (s *overlay) ListPrefix(prefix string) ListIterator {
+	return &overlayIterator{
+		s:      s,
+		upper:  listStorePrefix("storage.overlay.ListPrefix", s.upper, prefix),
+		lower:  listStorePrefix("storage.overlay.ListPrefix", s.lower, prefix),
+		listed: make(map[Key]struct{}),
+	}
+}
+
+// CompareAndSwap compares the value as read from the overlay, and
+// swaps it in upper, with upper's CompareAndSwap if it's a Swapper.
+func (s *overlay) CompareAndSwap(k Key, old, new Value) error {
+	s.swapping.Lock()
+	defer s.swapping.Unlock()
+	inUpper, err := s.upper.Contains(k)
+	if err != nil {
+		return err
+	}
+	swapper, ok := s.upper.(Swapper)
+	if inUpper && ok {
+		return swapper.CompareAndSwap(k, old, new)
+	}
+	current, err := s.Get(k)
+	found := err == nil
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if !matches(current, found, old) {
+		return fmt.Errorf("storage.overlay.CompareAndSwap %q: %w", k, ErrConflict)
+	}
+	if ok {
+		// Not in upper, as checked above, unless it was put since.
+		err = swapper.CompareAndSwap(k, nil, new)
+	} else {
+		err = s.upper.Put(k, new)
+	}
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.deleted, k)
+	s.mu.Unlock()
+	return nil
+}
+
+// overlayIterator lists the keys of upper, then those of lower that
+// are neither in upper nor deleted from the overlay.
+type overlayIterator struct {
+	s      *overlay
+	upper  ListIterator // Nil once listed.
+	lower  ListIterator
+	listed map[Key]struct{} // By upper.
+}
+
+func (it *overlayIterator) Next(ctx context.Context) ([]KeyInfo, error) {
+	if it.upper != nil {
+		page, err := it.upper.Next(ctx)
+		switch {
+		case errors.Is(err, io.EOF):
+			it.upper = nil
+		case err != nil:
+			return nil, err
+		default:
+			for _, ki := range page {
+				it.listed[ki.Key] = struct{}{}
+			}
+			return page, nil
+		}
+	}
+	for {
+		page, err := it.lower.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var kept []KeyInfo
+		for _, ki := range page {
+			if _, ok := it.listed[ki.Key]; !ok && !it.s.isDeleted(ki.Key) {
+				kept = append(kept, ki)
+			}
+		}
+		if len(kept) > 0 {
+			return kept, nil
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	lower := new(InMemory)
+	if err := lower.Put("k1", Value("lower")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReadOnly(lower).Put("k2", nil); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("got %v, want %v", err, ErrReadOnly)
+	}
+	if err := ReadOnly(lower).Delete("k1"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("got %v, want %v", err, ErrReadOnly)
+	}
+
+	upper := new(InMemory)
+	s := Overlay(upper, ReadOnly(lower))
+	if v, err := s.Get("k1"); err != nil || string(v) != "lower" {
+		t.Errorf("got %q, %v, want the lower value", v, err)
+	}
+	if err := s.Put("k1", Value("upper")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Get("k1"); err != nil || string(v) != "upper" {
+		t.Errorf("got %q, %v, want the upper value", v, err)
+	}
+	if err := s.Delete("k1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("k1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+	if ok, err := s.Contains("k1"); err != nil || ok {
+		t.Errorf("got %v, %v, want the deleted key not to be found", ok, err)
+	}
+	if v, err := lower.Get("k1"); err != nil || string(v) != "lower" {
+		t.Errorf("got %q, %v, want the lower store unchanged", v, err)
+	}
+}
@@ -4,14 +4,19 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
-// Valid prefix byte in the propagation log lines. A pending item is only in the
+// Valid state bytes of the propagation log records. A pending item is only in the
 // fast store, that needs to copied to the slow store. A done item is in the slow
 // store and may or may not be in the fast store (might have been evicted). A
 // missing item is one that was to be propagated from fast to slow store, but
@@ -22,84 +27,471 @@ const (
 	itemDone    = 'd'
 )
 
-// The log consists of lines of known length (a byte, a key, a newline).
-const logLineLength = 66
+// The log is a directory of segments, files named after their sequence
+// number, in hexadecimal, holding records of known length: a state byte
+// and a key, keys being 64 bytes long.
+const (
+	logKeyLength    = 64
+	logRecordLength = 1 + logKeyLength
+)
+
+// How many records a segment holds, by default. Once all the items of a
+// segment no longer written to are done, the segment is deleted: that
+// is how the log is compacted, without rewriting it, so that resuming
+// only reads the segments with items not done.
+const logSegmentRecords = 1 << 14
+
+// If the log is compressed, see WithCompressedLog, a segment no longer
+// written to is packed into two files named after it: the keys of its
+// records, compressed with zstd, and an index holding the state byte
+// of each record, updated in place. Resuming reads the indexes, and
+// only decompresses the keys of segments with items not done.
+const (
+	logKeysSuffix  = ".zst"
+	logIndexSuffix = ".idx"
+)
 
+// A logSegment is one of the files of the log, or, once packed, the
+// index of a packed segment.
+type logSegment struct {
+	pathname    string // Of the unpacked segment.
+	file        *os.File
+	packed      bool
+	records     int // Written so far.
+	outstanding int // Records not done.
+}
+
+// stateOffset returns the offset of the state byte of the i-th record
+// within the segment's file.
+func (seg *logSegment) stateOffset(i int) int64 {
+	if seg.packed {
+		return int64(i)
+	}
+	return int64(i) * logRecordLength
+}
+
+// Offsets into the propagation log are logical: they are the offsets
+// the items would have if the log were a single file without the items
+// done before it was loaded. An item's segment and physical offset
+// within it are tracked in its backlog entry.
 type propagationLog struct {
 	readOffset int64
 
 	notify chan struct{}
 
-	mu   sync.Mutex
-	file *os.File
+	mu       sync.Mutex
+	dir      string
+	seq      uint64 // Sequence number of the next segment.
+	active   *logSegment
+	segments map[*logSegment]struct{}
+	size     int64 // Logical.
+
+	// Records per segment, see logSegmentRecords.
+	segmentRecords int
+
+	// Whether segments are packed once no longer written to.
+	compress bool
+
+	// Items not yet propagated, indexed by offset within the log.
+	backlog map[int64]backlogItem
+
+	// Closed, and replaced, whenever an item is marked.
+	changed chan struct{}
+}
+
+type backlogItem struct {
+	state   byte
+	since   time.Time // When added to the log, or when the log was loaded.
+	segment *logSegment
+	record  int // Index within the segment.
+	key     Key // Only for packed segments, whose keys are compressed.
+}
+
+// Backlog summarizes the items still to be propagated from the fast
+// store to the slow store.
+type Backlog struct {
+	Pending       int
+	Missing       int
+	OldestPending time.Time // Zero if nothing is pending.
 }
 
-// newLog reads the log at pathname (creating it if necessary), compacts it, and time stamps the previous version.
-func newLog(pathname string) (*propagationLog, error) {
+// Age returns how long the oldest pending item has been waiting.
+func (b Backlog) Age() time.Duration {
+	if b.OldestPending.IsZero() {
+		return 0
+	}
+	return time.Since(b.OldestPending)
+}
+
+// newLog loads the log in directory pathname, creating it if
+// necessary, deleting the segments whose items are all done. A log in
+// the format of older versions, a file of lines, is converted. If
+// compress is set, the segments loaded are packed.
+func newLog(pathname string, compress bool) (*propagationLog, error) {
 	const method = "newLog"
-	curr, err := os.OpenFile(pathname, os.O_RDONLY|os.O_CREATE, 0666)
+	legacy := pathname + ".legacy"
+	if fi, err := os.Stat(pathname); err == nil && fi.Mode().IsRegular() {
+		if err := os.Rename(pathname, legacy); err != nil {
+			return nil, errorf(method, "%v", err)
+		}
+	}
+	if err := os.MkdirAll(pathname, 0755); err != nil {
+		return nil, errorf(method, "%v", err)
+	}
+	names, err := ioutil.ReadDir(pathname)
+	if err != nil {
+		return nil, errorf(method, "%v", err)
+	}
+	pl := &propagationLog{
+		dir:            pathname,
+		segments:       make(map[*logSegment]struct{}),
+		segmentRecords: logSegmentRecords,
+		compress:       compress,
+		backlog:        make(map[int64]backlogItem),
+		notify:         make(chan struct{}),
+		changed:        make(chan struct{}),
+	}
+	now := time.Now()
+	// Names have the same length, so they sort as the sequence numbers.
+	// The files of a packed segment follow the segment's name.
+	var bases []string
+	files := make(map[string]map[string]bool)
+	for _, fi := range names {
+		name := fi.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// Left by packing interrupted before its completion.
+			if err := os.Remove(filepath.Join(pathname, name)); err != nil {
+				return nil, errorf(method, "%v", err)
+			}
+			continue
+		}
+		base, suffix := name, ""
+		if ext := filepath.Ext(name); ext == logKeysSuffix || ext == logIndexSuffix {
+			base, suffix = strings.TrimSuffix(name, ext), ext
+		}
+		if files[base] == nil {
+			bases = append(bases, base)
+			files[base] = make(map[string]bool)
+		}
+		files[base][suffix] = true
+	}
+	for _, base := range bases {
+		seq, err := strconv.ParseUint(base, 16, 64)
+		if err != nil {
+			return nil, errorf(method, "unexpected file %q in %q", base, pathname)
+		}
+		segment := filepath.Join(pathname, base)
+		switch have := files[base]; {
+		case have[""]:
+			// Not packed, or packing was interrupted: the segment is
+			// complete, the packed files may not be.
+			for _, suffix := range []string{logKeysSuffix, logIndexSuffix} {
+				if have[suffix] {
+					if err = os.Remove(segment + suffix); err != nil {
+						break
+					}
+				}
+			}
+			if err == nil {
+				err = pl.load(segment, now)
+			}
+		case have[logKeysSuffix] && have[logIndexSuffix]:
+			err = pl.loadPacked(segment, now)
+		default:
+			err = fmt.Errorf("%q: incomplete packed segment", segment)
+		}
+		if err != nil {
+			pl.close()
+			return nil, errorf(method, "%v", err)
+		}
+		pl.seq = seq + 1
+	}
+	if _, err := os.Stat(legacy); err == nil {
+		if err := pl.convert(legacy, now); err != nil {
+			pl.close()
+			return nil, errorf(method, "%v", err)
+		}
+	}
+	return pl, nil
+}
+
+// load adds the items of the segment not done to the backlog, or
+// deletes the segment if there are none.
+func (pl *propagationLog) load(pathname string, now time.Time) error {
+	b, err := ioutil.ReadFile(pathname)
+	if err != nil {
+		return err
+	}
+	seg := &logSegment{pathname: pathname, records: len(b) / logRecordLength}
+	var items []backlogItem
+	for i := 0; i < seg.records; i++ {
+		switch state := b[i*logRecordLength]; state {
+		case itemPending, itemMissing:
+			items = append(items, backlogItem{state: state, since: now, segment: seg, record: i})
+		case itemDone:
+		default:
+			return fmt.Errorf("%q: unrecognized item state: %d", pathname, state)
+		}
+	}
+	if len(items) == 0 {
+		return os.Remove(pathname)
+	}
+	if seg.file, err = os.OpenFile(pathname, os.O_RDWR, 0); err != nil {
+		return err
+	}
+	seg.outstanding = len(items)
+	pl.segments[seg] = struct{}{}
+	for _, item := range items {
+		pl.backlog[pl.size] = item
+		pl.size += logRecordLength
+	}
+	if pl.compress {
+		return pl.pack(seg)
+	}
+	return nil
+}
+
+// loadPacked adds the items of the packed segment not done to the
+// backlog, or deletes the segment if there are none, in which case its
+// keys aren't decompressed.
+func (pl *propagationLog) loadPacked(pathname string, now time.Time) error {
+	states, err := ioutil.ReadFile(pathname + logIndexSuffix)
+	if err != nil {
+		return err
+	}
+	seg := &logSegment{pathname: pathname, packed: true, records: len(states)}
+	var records []int
+	for i, state := range states {
+		switch state {
+		case itemPending, itemMissing:
+			records = append(records, i)
+		case itemDone:
+		default:
+			return fmt.Errorf("%q: unrecognized item state: %d", pathname+logIndexSuffix, state)
+		}
+	}
+	if len(records) == 0 {
+		return removePacked(pathname)
+	}
+	compressed, err := ioutil.ReadFile(pathname + logKeysSuffix)
+	if err != nil {
+		return err
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return err
+	}
+	keys, err := dec.DecodeAll(compressed, nil)
+	dec.Close()
+	if err != nil {
+		return fmt.Errorf("%q: %w", pathname+logKeysSuffix, err)
+	}
+	if len(keys) != seg.records*logKeyLength {
+		return fmt.Errorf("%q: got %d bytes of keys for %d records", pathname+logKeysSuffix, len(keys), seg.records)
+	}
+	if seg.file, err = os.OpenFile(pathname+logIndexSuffix, os.O_RDWR, 0); err != nil {
+		return err
+	}
+	seg.outstanding = len(records)
+	pl.segments[seg] = struct{}{}
+	for _, i := range records {
+		key := Key(keys[i*logKeyLength : (i+1)*logKeyLength])
+		pl.backlog[pl.size] = backlogItem{state: states[i], since: now, segment: seg, record: i, key: key}
+		pl.size += logRecordLength
+	}
+	return nil
+}
+
+// pack replaces the segment, which is no longer written to, with its
+// compressed keys and its index, see logKeysSuffix. The keys of its
+// items not done are kept in memory from then on. It must be called
+// with the lock held, or before the log is used.
+func (pl *propagationLog) pack(seg *logSegment) error {
+	b := make([]byte, seg.records*logRecordLength)
+	if _, err := seg.file.ReadAt(b, 0); err != nil {
+		return err
+	}
+	states := make([]byte, seg.records)
+	keys := make([]byte, 0, seg.records*logKeyLength)
+	for i := range states {
+		record := b[i*logRecordLength : (i+1)*logRecordLength]
+		states[i] = record[0]
+		keys = append(keys, record[1:]...)
+	}
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return err
+	}
+	compressed := enc.EncodeAll(keys, nil)
+	_ = enc.Close()
+	// The keys go first: a segment found next to its keys on startup
+	// was being packed, see newLog.
+	if err := writeFileAtomically(seg.pathname+logKeysSuffix, compressed); err != nil {
+		return err
+	}
+	if err := writeFileAtomically(seg.pathname+logIndexSuffix, states); err != nil {
+		return err
+	}
+	index, err := os.OpenFile(seg.pathname+logIndexSuffix, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	_ = seg.file.Close()
+	seg.file = index
+	seg.packed = true
+	if err := os.Remove(seg.pathname); err != nil {
+		return err
+	}
+	for off, item := range pl.backlog {
+		if item.segment == seg {
+			item.key = Key(keys[item.record*logKeyLength : (item.record+1)*logKeyLength])
+			pl.backlog[off] = item
+		}
+	}
+	return nil
+}
+
+// writeFileAtomically writes the file under a temporary name, then
+// renames it, so that the file is either complete or absent.
+func writeFileAtomically(pathname string, b []byte) error {
+	tmp := pathname + ".tmp"
+	f, err := os.Create(tmp)
 	if err != nil {
-		return nil, errorf(method, "open %q read-only: %v", pathname, err)
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, pathname)
+	}
+	return err
+}
+
+// removePacked deletes the files of a packed segment.
+func removePacked(pathname string) error {
+	if err := os.Remove(pathname + logIndexSuffix); err != nil {
+		return err
 	}
-	next, err := os.OpenFile(pathname+".new", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	return os.Remove(pathname + logKeysSuffix)
+}
+
+// convert adds the items not done of a log in the format of older
+// versions, lines with a state byte and a key, then deletes it.
+func (pl *propagationLog) convert(pathname string, now time.Time) error {
+	f, err := os.Open(pathname)
 	if err != nil {
-		return nil, errorf(method, "open %q write-only: %v", pathname+".new", err)
+		return err
 	}
-	s := bufio.NewScanner(curr)
+	defer func() { _ = f.Close() }()
+	s := bufio.NewScanner(f)
 	for s.Scan() {
 		line := s.Text()
 		switch state := line[0]; state {
 		case itemPending, itemMissing:
-			if _, err := fmt.Fprintln(next, line); err != nil {
-				return nil, errorf(method, "copying line from %q to %q: %v", curr.Name(), next.Name(), err)
+			if err := pl.append(state, Key(line[1:]), now); err != nil {
+				return err
 			}
 		case itemDone:
 		default:
-			return nil, errorf(method, "unrecognized item state: %d", state)
+			return fmt.Errorf("%q: unrecognized item state: %d", pathname, state)
 		}
 	}
 	if err := s.Err(); err != nil {
-		return nil, errorf(method, "scan %q: %v", curr.Name(), err)
+		return err
 	}
-	if err := curr.Close(); err != nil {
-		return nil, errorf(method, "close %q: %v", curr.Name(), err)
+	return os.Remove(pathname)
+}
+
+func (pl *propagationLog) add(key Key) error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.append(itemPending, key, time.Now())
+}
+
+// append writes a record to the active segment, starting a new one if
+// needed. It must be called with the lock held.
+func (pl *propagationLog) append(state byte, key Key, since time.Time) error {
+	if len(key) != logKeyLength {
+		return fmt.Errorf("key %q is not %d bytes long", key, logKeyLength)
 	}
-	if err := next.Close(); err != nil {
-		return nil, errorf(method, "close %q: %v", next.Name(), err)
+	if pl.active == nil || pl.active.records >= pl.segmentRecords {
+		if err := pl.roll(); err != nil {
+			return err
+		}
 	}
-	if err := os.Rename(next.Name(), curr.Name()); err != nil && !os.IsNotExist(err) {
-		return nil, errorf(method, "rename %q to %q: %v", next.Name(), curr.Name(), err)
+	seg := pl.active
+	record := make([]byte, 0, logRecordLength)
+	record = append(record, state)
+	record = append(record, key...)
+	// A partial record is overwritten by the next one.
+	if _, err := seg.file.WriteAt(record, seg.stateOffset(seg.records)); err != nil {
+		return err
 	}
-	curr, err = os.OpenFile(pathname, os.O_RDWR|os.O_CREATE, 0644)
+	pl.backlog[pl.size] = backlogItem{state: state, since: since, segment: seg, record: seg.records}
+	seg.records++
+	seg.outstanding++
+	pl.size += logRecordLength
+	return nil
+}
+
+// roll starts a new segment, retiring the active one if its items are
+// all done. It must be called with the lock held.
+func (pl *propagationLog) roll() error {
+	name := filepath.Join(pl.dir, fmt.Sprintf("%016x", pl.seq))
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		return nil, errorf(method, "open %q read-write: %v", pathname, err)
+		return err
 	}
-	// Seek to end for writes. (Reads will use ReadAt instead.)
-	if _, err := curr.Seek(0, io.SeekEnd); err != nil {
-		return nil, errorf(method, "seek %q to EOF: %v", curr.Name(), err)
+	pl.seq++
+	if prev := pl.active; prev != nil && prev.outstanding == 0 {
+		pl.retire(prev)
+	} else if prev != nil && pl.compress {
+		if err := pl.pack(prev); err != nil {
+			// The segment stays as it is, which works all the same.
+			log.Printf("Could not pack propagation log segment %q: %v", prev.pathname, err)
+		}
 	}
-	return &propagationLog{
-		file:   curr,
-		notify: make(chan struct{}),
-	}, nil
+	pl.active = &logSegment{pathname: name, file: f}
+	pl.segments[pl.active] = struct{}{}
+	return nil
 }
 
-func (pl *propagationLog) add(key Key) error {
-	pl.mu.Lock()
-	n, err := fmt.Fprintf(pl.file, "%c%s\n", itemPending, key)
-	pl.mu.Unlock()
-	if n != logLineLength {
-		return fmt.Errorf("written only %d of %d bytes", n, logLineLength)
+// retire deletes a segment whose items are all done. It must be called
+// with the lock held.
+func (pl *propagationLog) retire(seg *logSegment) {
+	_ = seg.file.Close()
+	var err error
+	if seg.packed {
+		err = removePacked(seg.pathname)
+	} else {
+		err = os.Remove(seg.pathname)
 	}
-	return err
+	if err != nil {
+		log.Printf("Could not delete propagation log segment %q: %v", seg.pathname, err)
+	}
+	delete(pl.segments, seg)
 }
 
+// next reads the record at the read offset, waiting for it to be added
+// if necessary. Records not read yet are pending, hence in the backlog.
 func (pl *propagationLog) next(p []byte) {
 	for {
 		pl.mu.Lock()
-		n, err := pl.file.ReadAt(p, pl.readOffset)
+		var n int
+		var err error
+		if item, ok := pl.backlog[pl.readOffset]; ok && item.segment.packed {
+			p[0] = item.state
+			n = 1 + copy(p[1:], item.key)
+		} else if ok {
+			n, err = item.segment.file.ReadAt(p, item.segment.stateOffset(item.record))
+		}
 		pl.mu.Unlock()
-		if n == logLineLength && err == nil {
+		if n == logRecordLength && err == nil {
 			break
 		}
 		<-pl.notify
@@ -108,18 +500,95 @@ func (pl *propagationLog) next(p []byte) {
 
 func (pl *propagationLog) mark(state byte, off int64) error {
 	pl.mu.Lock()
-	n, err := pl.file.WriteAt([]byte{state}, off)
-	pl.mu.Unlock()
+	defer pl.mu.Unlock()
+	item, ok := pl.backlog[off]
+	if !ok {
+		// Already done, and possibly deleted with its segment.
+		return nil
+	}
+	n, err := item.segment.file.WriteAt([]byte{state}, item.segment.stateOffset(item.record))
+	if state == itemDone {
+		delete(pl.backlog, off)
+		item.segment.outstanding--
+		if item.segment.outstanding == 0 && item.segment != pl.active {
+			pl.retire(item.segment)
+		}
+	} else {
+		item.state = state
+		pl.backlog[off] = item
+	}
+	close(pl.changed)
+	pl.changed = make(chan struct{})
 	if n != 1 {
 		return fmt.Errorf("wrote %d bytes instead of 1", n)
 	}
 	return err
 }
 
+func (pl *propagationLog) stats() (b Backlog) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	for _, item := range pl.backlog {
+		switch item.state {
+		case itemPending:
+			b.Pending++
+			if b.OldestPending.IsZero() || item.since.Before(b.OldestPending) {
+				b.OldestPending = item.since
+			}
+		case itemMissing:
+			b.Missing++
+		}
+	}
+	return
+}
+
+// wait blocks until none of the items before offset end is pending, or
+// until the timeout channel fires. It returns how many of those items
+// are missing, and whether it timed out. Since the propagation
+// goroutine may be waiting for a notification, it pokes it regularly.
+func (pl *propagationLog) wait(end int64, timeout <-chan time.Time) (missing int, ok bool) {
+	poke := time.NewTicker(time.Second)
+	defer poke.Stop()
+	for {
+		pending := 0
+		missing = 0
+		pl.mu.Lock()
+		for off, item := range pl.backlog {
+			if off >= end {
+				continue
+			}
+			if item.state == itemPending {
+				pending++
+			} else {
+				missing++
+			}
+		}
+		changed := pl.changed
+		pl.mu.Unlock()
+		if pending == 0 {
+			return missing, true
+		}
+		select {
+		case pl.notify <- struct{}{}:
+		default:
+		}
+		select {
+		case <-changed:
+		case <-poke.C:
+		case <-timeout:
+			return missing, false
+		}
+	}
+}
+
 func (pl *propagationLog) close() {
 	pl.mu.Lock()
-	_ = pl.file.Close()
-	pl.file = nil // panic if somebody tries to use the log after this.
+	for seg := range pl.segments {
+		_ = seg.file.Close()
+	}
+	// panic if somebody tries to use the log after this.
+	pl.segments = nil
+	pl.active = nil
 	pl.mu.Unlock()
 }
 
@@ -139,15 +608,36 @@ type Paired struct {
 	log *propagationLog
 }
 
+// PairedOption follows the functional options pattern to configure a
+// Paired store.
+type PairedOption func(*pairedOptions)
+
+type pairedOptions struct {
+	compressLog bool
+}
+
+// WithCompressedLog makes the propagation log pack segments no longer
+// written to, compressing their keys, see logKeysSuffix. Packed
+// segments are read whether or not the option is given.
+func WithCompressedLog() PairedOption {
+	return func(o *pairedOptions) {
+		o.compressLog = true
+	}
+}
+
 // NewPaired creates a write-back cache from fast to slow.
 // If the log path is empty, the cache is read-only and puts will fail.
-func NewPaired(fast, slow Store, logPath string) (p *Paired, err error) {
+func NewPaired(fast, slow Store, logPath string, opts ...PairedOption) (p *Paired, err error) {
+	var o pairedOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
 	p = new(Paired)
 	p.retryInterval = 5 * time.Second
 	p.fast = fast
 	p.slow = slow
 	if logPath != "" {
-		p.log, err = newLog(logPath)
+		p.log, err = newLog(logPath, o.compressLog)
 		if err != nil {
 			return
 		}
@@ -203,30 +693,37 @@ func (p *Paired) EnsureBackgroundPuts() {
 func (p *Paired) propagate() {
 	sem := make(chan struct{}, 16)
 	up1 := func(key Key, off int64) {
+		defer func() { <-sem }()
 		value, err := p.fast.Get(key)
 		if err != nil {
 			// If we can't update it in the log, it will be re-processed (needless but idempotent).
 			_ = p.log.mark(itemMissing, off)
 			return
 		}
-		for {
+		for attempts := 1; ; attempts++ {
+			// Items are content-addressed: if the slow store has the
+			// key already, e.g., uploaded by another host, there is no
+			// need to upload it again.
+			if ok, err := p.slow.Contains(key); err == nil && ok {
+				break
+			}
 			if err = p.slow.Put(key, value); err == nil {
 				break
 			}
-			log.Printf("failure to put %q to slow store (will retry): %v", key, err)
-			time.Sleep(p.retryInterval)
+			wait := retryDelay(err, attempts, p.retryInterval)
+			log.Printf("failure to put %q to slow store (will retry in %v): %v", key, wait, err)
+			time.Sleep(wait)
 		}
 		// If we can't update it in the log, it will be re-processed (needless but idempotent).
 		_ = p.log.mark(itemDone, off)
-		<-sem
 	}
-	line := make([]byte, logLineLength)
+	record := make([]byte, logRecordLength)
 	for {
-		p.log.next(line)
-		k := Key(line[1:65])
+		p.log.next(record)
+		k := Key(record[1:])
 		off := p.log.readOffset
-		p.log.readOffset += logLineLength // Advance to next line.
-		if state := line[0]; state != itemPending && state != itemMissing {
+		p.log.readOffset += logRecordLength // Advance to next record.
+		if state := record[0]; state != itemPending && state != itemMissing {
 			log.Printf("skipping item with unexpected state: %d", state)
 			continue
 		}
@@ -235,6 +732,53 @@ func (p *Paired) propagate() {
 	}
 }
 
+// WriteThrough returns a view of the paired store whose Put writes
+// synchronously to both the fast and the slow store. It is meant for
+// items that remote pointers refer to, e.g., revisions and nodes, so
+// that a pointer can't be updated to refer to an item that only exists
+// locally. All other operations are those of the paired store.
+func (p *Paired) WriteThrough() Store {
+	return writeThrough{p}
+}
+
+type writeThrough struct {
+	*Paired
+}
+
+// Put writes to the fast store and then to the slow store. If the
+// latter fails, the item is enqueued for asynchronous propagation, as
+// in Paired.Put, but the error is returned all the same.
+func (w writeThrough) Put(k Key, v Value) error {
+	if w.log == nil {
+		return ErrReadOnly
+	}
+	if err := w.fast.Put(k, v); err != nil {
+		return err
+	}
+	if err := w.slow.Put(k, v); err != nil {
+		w.EnsureBackgroundPuts()
+		if e := w.log.add(k); e != nil {
+			log.Printf("Could not enqueue item %v for propagation: %v", k, e)
+		}
+		return err
+	}
+	return nil
+}
+
+// Cached tells whether the fast store has the item, so that getting
+// it does not involve the slow store.
+func (p *Paired) Cached(k Key) (bool, error) {
+	return p.fast.Contains(k)
+}
+
+// Contains checks the fast store first, then the slow store.
+func (p *Paired) Contains(k Key) (bool, error) {
+	if ok, err := p.fast.Contains(k); ok || err != nil {
+		return ok, err
+	}
+	return p.slow.Contains(k)
+}
+
 // Delete deletes an item from the slow store first, then from the fast store second. Note that if done in the other
 // order, a concurrent Get could replenish the fast store from the slow store after the deletion, e.g., (1) delete from
 // fast, (2) get from slow, (3) replenish fast, (4) delete from slow. Steps (1) and (4) belong to this method while (2)
@@ -246,6 +790,44 @@ func (p *Paired) Delete(k Key) error {
 	return p.fast.Delete(k)
 }
 
+// Backlog returns a summary of the items that still need to be
+// propagated to the slow store.
+func (p *Paired) Backlog() Backlog {
+	if p.log == nil {
+		return Backlog{}
+	}
+	return p.log.stats()
+}
+
+// Sync waits until the items put so far have been propagated to the
+// slow store, or until the timeout, if positive, expires. Items that
+// went missing from the fast store can't be propagated, so they are
+// not waited for, but they make Sync fail.
+func (p *Paired) Sync(timeout time.Duration) error {
+	const method = "Paired.Sync"
+	if p.log == nil {
+		return nil
+	}
+	p.EnsureBackgroundPuts()
+	p.log.mu.Lock()
+	end := p.log.size
+	p.log.mu.Unlock()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	missing, ok := p.log.wait(end, expired)
+	if !ok {
+		return errorf(method, "timed out after %v", timeout)
+	}
+	if missing > 0 {
+		return errorf(method, "%d items missing from the fast store", missing)
+	}
+	return nil
+}
+
 func (s *Paired) Notify() {
 	s.log.notify <- struct{}{}
 }
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"testing/quick"
 	"time"
@@ -23,7 +24,7 @@ func TestPropagationLogPreservesStateAcrossRestarts(t *testing.T) {
 		r := require.New(t)
 		dir := t.TempDir()
 		logFile := filepath.Join(dir, "logfile")
-		log, err := newLog(logFile)
+		log, err := newLog(logFile, false)
 		r.NoError(err)
 
 		keys := make([]Key, len(byteKeys))
@@ -32,7 +33,7 @@ func TestPropagationLogPreservesStateAcrossRestarts(t *testing.T) {
 			keys[i] = k
 			r.NoError(log.add(k))
 		}
-		p := make([]byte, logLineLength)
+		p := make([]byte, logRecordLength)
 		i := 0
 		stop := 0
 		if len(byteKeys) > 0 {
@@ -44,18 +45,18 @@ func TestPropagationLogPreservesStateAcrossRestarts(t *testing.T) {
 				t.Errorf("unknown state %d", p[0])
 				return false
 			}
-			if nextKey := Key(p[1:65]); nextKey != keys[i] {
+			if nextKey := Key(p[1:]); nextKey != keys[i] {
 				t.Errorf("key mismatch, got %q, want %q", nextKey, keys[i])
 				return false
 			}
 			r.NoError(log.mark(itemDone, log.readOffset))
-			log.readOffset += logLineLength
+			log.readOffset += logRecordLength
 		}
 		// Shutdown.
 		log.close()
 
 		// Restart and process the rest.
-		log, err = newLog(logFile)
+		log, err = newLog(logFile, false)
 		r.NoError(err)
 		for ; i < len(byteKeys); i++ {
 			log.next(p)
@@ -63,12 +64,12 @@ func TestPropagationLogPreservesStateAcrossRestarts(t *testing.T) {
 				t.Errorf("unknown state %d", p[0])
 				return false
 			}
-			if nextKey := Key(p[1:65]); nextKey != keys[i] {
+			if nextKey := Key(p[1:]); nextKey != keys[i] {
 				t.Errorf("key mismatch, got %q, want %q", nextKey, keys[i])
 				return false
 			}
 			r.NoError(log.mark(itemDone, log.readOffset))
-			log.readOffset += logLineLength
+			log.readOffset += logRecordLength
 		}
 
 		return true
@@ -78,6 +79,195 @@ func TestPropagationLogPreservesStateAcrossRestarts(t *testing.T) {
 	}
 }
 
+func TestPropagationLogBacklog(t *testing.T) {
+	r := require.New(t)
+	logFile := filepath.Join(t.TempDir(), "logfile")
+	log, err := newLog(logFile, false)
+	r.NoError(err)
+	for i := 0; i < 3; i++ {
+		r.NoError(log.add(randomKey(32)))
+	}
+	r.NoError(log.mark(itemDone, 0))
+	r.NoError(log.mark(itemMissing, logRecordLength))
+	b := log.stats()
+	assert.Equal(t, 1, b.Pending)
+	assert.Equal(t, 1, b.Missing)
+	assert.False(t, b.OldestPending.IsZero())
+	log.close()
+
+	// The done item is compacted away on restart, the others survive.
+	log, err = newLog(logFile, false)
+	r.NoError(err)
+	defer log.close()
+	b = log.stats()
+	assert.Equal(t, 1, b.Pending)
+	assert.Equal(t, 1, b.Missing)
+}
+
+func TestPropagationLogDeletesDoneSegments(t *testing.T) {
+	r := require.New(t)
+	logDir := filepath.Join(t.TempDir(), "logdir")
+	log, err := newLog(logDir, false)
+	r.NoError(err)
+	log.segmentRecords = 2
+	var keys []Key
+	for i := 0; i < 5; i++ {
+		keys = append(keys, randomKey(32))
+		r.NoError(log.add(keys[i]))
+	}
+	segments := func() []string {
+		t.Helper()
+		names, err := filepath.Glob(filepath.Join(logDir, "*"))
+		r.NoError(err)
+		for i, name := range names {
+			names[i] = filepath.Base(name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"0000000000000000", "0000000000000001", "0000000000000002"}, segments())
+	for i := 0; i < 3; i++ {
+		r.NoError(log.mark(itemDone, int64(i*logRecordLength)))
+	}
+	// The second segment still has an item to propagate.
+	assert.Equal(t, []string{"0000000000000001", "0000000000000002"}, segments())
+
+	// Offsets are unaffected by the deletion.
+	r.NoError(log.mark(itemMissing, 3*logRecordLength))
+	log.readOffset = 4 * logRecordLength
+	p := make([]byte, logRecordLength)
+	log.next(p)
+	assert.Equal(t, keys[4], Key(p[1:]))
+	r.NoError(log.add(randomKey(32)))
+	b := log.stats()
+	assert.Equal(t, 2, b.Pending)
+	assert.Equal(t, 1, b.Missing)
+	log.close()
+
+	log, err = newLog(logDir, false)
+	r.NoError(err)
+	defer log.close()
+	b = log.stats()
+	assert.Equal(t, 2, b.Pending)
+	assert.Equal(t, 1, b.Missing)
+	log.readOffset = logRecordLength
+	log.next(p)
+	assert.Equal(t, keys[4], Key(p[1:]))
+}
+
+func TestPropagationLogPacksSegments(t *testing.T) {
+	r := require.New(t)
+	logDir := filepath.Join(t.TempDir(), "logdir")
+	log, err := newLog(logDir, true)
+	r.NoError(err)
+	log.segmentRecords = 2
+	var keys []Key
+	for i := 0; i < 5; i++ {
+		keys = append(keys, randomKey(32))
+		r.NoError(log.add(keys[i]))
+	}
+	segments := func() []string {
+		t.Helper()
+		names, err := filepath.Glob(filepath.Join(logDir, "*"))
+		r.NoError(err)
+		for i, name := range names {
+			names[i] = filepath.Base(name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{
+		"0000000000000000.idx", "0000000000000000.zst",
+		"0000000000000001.idx", "0000000000000001.zst",
+		"0000000000000002",
+	}, segments())
+	p := make([]byte, logRecordLength)
+	for i := 0; i < 3; i++ {
+		log.readOffset = int64(i * logRecordLength)
+		log.next(p)
+		assert.Equal(t, byte(itemPending), p[0])
+		assert.Equal(t, keys[i], Key(p[1:]))
+		r.NoError(log.mark(itemDone, log.readOffset))
+	}
+	// The second segment still has an item to propagate.
+	assert.Equal(t, []string{
+		"0000000000000001.idx", "0000000000000001.zst",
+		"0000000000000002",
+	}, segments())
+	r.NoError(log.mark(itemMissing, 3*logRecordLength))
+	log.close()
+
+	// Packed segments are read even without compression.
+	log, err = newLog(logDir, false)
+	r.NoError(err)
+	b := log.stats()
+	assert.Equal(t, 1, b.Pending)
+	assert.Equal(t, 1, b.Missing)
+	log.next(p)
+	assert.Equal(t, byte(itemMissing), p[0])
+	assert.Equal(t, keys[3], Key(p[1:]))
+	r.NoError(log.mark(itemDone, 0))
+	log.close()
+	assert.Equal(t, []string{"0000000000000002"}, segments())
+
+	// Segments loaded are packed with compression.
+	log, err = newLog(logDir, true)
+	r.NoError(err)
+	defer log.close()
+	assert.Equal(t, []string{"0000000000000002.idx", "0000000000000002.zst"}, segments())
+	log.next(p)
+	assert.Equal(t, keys[4], Key(p[1:]))
+}
+
+// A segment found next to packed files was being packed when musclefs
+// stopped: it has the states, the packed files are discarded.
+func TestPropagationLogInterruptedPacking(t *testing.T) {
+	r := require.New(t)
+	logDir := filepath.Join(t.TempDir(), "logdir")
+	log, err := newLog(logDir, false)
+	r.NoError(err)
+	keys := []Key{randomKey(32), randomKey(32)}
+	for _, k := range keys {
+		r.NoError(log.add(k))
+	}
+	segment := filepath.Join(logDir, "0000000000000000")
+	r.NoError(ioutil.WriteFile(segment+logKeysSuffix, []byte("garbage"), 0644))
+	r.NoError(ioutil.WriteFile(segment+logIndexSuffix, []byte("dd"), 0644))
+	r.NoError(ioutil.WriteFile(segment+logIndexSuffix+".tmp", nil, 0644))
+	r.NoError(log.mark(itemDone, 0))
+	log.close()
+
+	log, err = newLog(logDir, false)
+	r.NoError(err)
+	defer log.close()
+	assert.Equal(t, 1, log.stats().Pending)
+	p := make([]byte, logRecordLength)
+	log.readOffset = 0
+	log.next(p)
+	assert.Equal(t, keys[1], Key(p[1:]))
+	names, err := filepath.Glob(segment + ".*")
+	r.NoError(err)
+	assert.Empty(t, names)
+}
+
+func TestPropagationLogConvertsLegacyFormat(t *testing.T) {
+	r := require.New(t)
+	logPath := filepath.Join(t.TempDir(), "logfile")
+	keys := []Key{randomKey(32), randomKey(32), randomKey(32)}
+	legacy := fmt.Sprintf("d%s\np%s\nm%s\n", keys[0], keys[1], keys[2])
+	r.NoError(ioutil.WriteFile(logPath, []byte(legacy), 0644))
+	log, err := newLog(logPath, false)
+	r.NoError(err)
+	defer log.close()
+	b := log.stats()
+	assert.Equal(t, 1, b.Pending)
+	assert.Equal(t, 1, b.Missing)
+	p := make([]byte, logRecordLength)
+	log.next(p)
+	assert.Equal(t, keys[1], Key(p[1:]))
+	if _, err := os.Stat(logPath + ".legacy"); !os.IsNotExist(err) {
+		t.Errorf("got %v, want the legacy log deleted", err)
+	}
+}
+
 func TestPaired(t *testing.T) {
 
 	t.Run("Successful put and get from fast store regardless of slow store", func(t *testing.T) {
@@ -235,6 +425,111 @@ func TestPaired(t *testing.T) {
 			t.Errorf("timed out waiting for item to be in slow store")
 		}
 	})
+
+	t.Run("Write-through put reaches the slow store synchronously", func(t *testing.T) {
+		fast := &InMemory{}
+		slow := &InMemory{}
+		pathname, cleanupLog := disposablePathName(t)
+		defer cleanupLog()
+		store, err := NewPaired(fast, slow, pathname)
+		require.Nil(t, err)
+		k := randomKey(32)
+		require.Nil(t, store.WriteThrough().Put(k, []byte("value")))
+		after, err := slow.Get(k)
+		assert.Nil(t, err)
+		assert.EqualValues(t, "value", after)
+		assert.Equal(t, 0, store.Backlog().Pending)
+	})
+
+	t.Run("Write-through put failure enqueues the item", func(t *testing.T) {
+		cannedErr := errors.New("failed")
+		slow := storeFuncs{put: func(Key, Value) error { return cannedErr }}
+		pathname, cleanupLog := disposablePathName(t)
+		defer cleanupLog()
+		store, err := NewPaired(&InMemory{}, slow, pathname)
+		require.Nil(t, err)
+		store.retryInterval = time.Hour
+		assert.Equal(t, cannedErr, store.WriteThrough().Put(randomKey(32), []byte("value")))
+		assert.Equal(t, 1, store.Backlog().Pending)
+	})
+
+	t.Run("Propagation skips keys the slow store already contains", func(t *testing.T) {
+		k := randomKey(32)
+		puts := make(chan Key, 1)
+		slow := storeFuncs{
+			put:      func(k Key, v Value) error { puts <- k; return nil },
+			contains: func(Key) (bool, error) { return true, nil },
+		}
+		pathname, cleanupLog := disposablePathName(t)
+		defer cleanupLog()
+		store, err := NewPaired(&InMemory{}, slow, pathname)
+		require.Nil(t, err)
+		require.Nil(t, store.Put(k, []byte("value")))
+		deadline := time.Now().Add(time.Second)
+		for store.Backlog().Pending > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, 0, store.Backlog().Pending)
+		select {
+		case k := <-puts:
+			t.Errorf("unexpected put of %v", k)
+		default:
+		}
+	})
+
+	t.Run("Put is retried later if the slow store denies it", func(t *testing.T) {
+		var puts int32
+		slow := storeFuncs{
+			put: func(Key, Value) error {
+				atomic.AddInt32(&puts, 1)
+				return fmt.Errorf("403 status code: AccessDenied: %w", ErrDenied)
+			},
+			contains: func(Key) (bool, error) { return false, nil },
+		}
+		pathname, cleanupLog := disposablePathName(t)
+		defer cleanupLog()
+		store, err := NewPaired(&InMemory{}, slow, pathname)
+		require.Nil(t, err)
+		store.retryInterval = time.Millisecond
+		require.Nil(t, store.Put(randomKey(32), []byte("value")))
+		// Rather than given up on, the item stays pending, and the
+		// next attempt is far off, whatever the retry interval.
+		assert.NotNil(t, store.Sync(100*time.Millisecond))
+		assert.Equal(t, 1, store.Backlog().Pending)
+		assert.EqualValues(t, 1, atomic.LoadInt32(&puts))
+	})
+
+	t.Run("Sync waits for the items put so far", func(t *testing.T) {
+		var failing int32 = 1
+		slow := &InMemory{}
+		flaky := storeFuncs{
+			put: func(k Key, v Value) error {
+				if atomic.LoadInt32(&failing) == 1 {
+					return errors.New("failed")
+				}
+				return slow.Put(k, v)
+			},
+			contains: slow.Contains,
+		}
+		pathname, cleanupLog := disposablePathName(t)
+		defer cleanupLog()
+		store, err := NewPaired(&InMemory{}, flaky, pathname)
+		require.Nil(t, err)
+		store.retryInterval = 10 * time.Millisecond
+		keys := []Key{randomKey(32), randomKey(32), randomKey(32)}
+		for _, k := range keys {
+			require.Nil(t, store.Put(k, []byte("value")))
+		}
+		assert.NotNil(t, store.Sync(50*time.Millisecond))
+		atomic.StoreInt32(&failing, 0)
+		require.Nil(t, store.Sync(time.Second))
+		assert.Equal(t, 0, store.Backlog().Pending)
+		for _, k := range keys {
+			ok, err := slow.Contains(k)
+			assert.Nil(t, err)
+			assert.True(t, ok)
+		}
+	})
 }
 
 func disposablePathName(t *testing.T) (pathname string, cleanup func()) {
@@ -242,6 +537,6 @@ func disposablePathName(t *testing.T) (pathname string, cleanup func()) {
 	require.Nil(t, err)
 	require.Nil(t, f.Close())
 	return f.Name(), func() {
-		assert.Nil(t, os.Remove(f.Name()))
+		assert.Nil(t, os.RemoveAll(f.Name()))
 	}
 }
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Classes of store failures, which callers tell apart with errors.Is
+// to decide whether and when to retry. Failures not in any class,
+// e.g., network errors, are assumed to be transient.
+var (
+	// The store asks to slow down.
+	ErrThrottled = errors.New("throttled")
+
+	// The store failed on its side, e.g., with a 5xx status code.
+	ErrUnavailable = errors.New("unavailable")
+
+	// Requests are rejected because the local clock is too far off,
+	// so that their signatures look expired or not yet valid. Stores
+	// that can tell the time of the server, e.g., S3, sign the
+	// following requests with it.
+	ErrClockSkew = errors.New("clock skew")
+
+	// Requests are rejected, e.g., because the credentials are
+	// wrong, or don't allow the operation. Retrying only helps once
+	// the credentials, or the permissions, are fixed.
+	ErrDenied = errors.New("access denied")
+)
+
+// The longest wait between attempts suggested by retryDelay, and the
+// one after a denial.
+const (
+	maxRetryInterval    = 5 * time.Minute
+	deniedRetryInterval = 30 * time.Minute
+)
+
+// retryDelay returns how long to wait before the next attempt of an
+// operation that failed with err, after the given number of attempts,
+// starting from the given interval. The wait doubles at each attempt,
+// except in case of a denial, which is not going away soon, but may
+// once someone fixes the credentials.
+func retryDelay(err error, attempts int, interval time.Duration) time.Duration {
+	if errors.Is(err, ErrDenied) {
+		return deniedRetryInterval
+	}
+	for i := 1; i < attempts && interval < maxRetryInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxRetryInterval {
+		interval = maxRetryInterval
+	}
+	return interval
+}
+
+// retryBudget bounds the retries of a store to a fraction of its
+// requests, so that a store failing across the board gets few more
+// requests than it would if nothing were retried, rather than several
+// times as many. It is a bucket of tokens, each allowing one retry,
+// filled by a fraction of a token per request up to a reserve, which
+// is also how many retries are allowed before any request is made.
+type retryBudget struct {
+	mu      sync.Mutex
+	ratio   float64
+	reserve float64
+	tokens  float64
+}
+
+func newRetryBudget(ratio float64, reserve int) *retryBudget {
+	return &retryBudget{
+		ratio:   ratio,
+		reserve: float64(reserve),
+		tokens:  float64(reserve),
+	}
+}
+
+// request adds to the budget, for a request about to be made.
+func (b *retryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > b.reserve {
+		b.tokens = b.reserve
+	}
+}
+
+// retry takes from the budget, for a retry about to be made, or
+// returns false if the budget is exhausted.
+func (b *retryBudget) retry() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
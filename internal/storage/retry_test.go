@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	for _, c := range []struct {
+		err      error
+		attempts int
+		want     time.Duration
+	}{
+		{errors.New("connection reset"), 1, time.Second},
+		{fmt.Errorf("503 status code: %w", ErrUnavailable), 3, 4 * time.Second},
+		{fmt.Errorf("503 status code: SlowDown: %w", ErrThrottled), 20, maxRetryInterval},
+		{fmt.Errorf("403 status code: %w", ErrClockSkew), 1, time.Second},
+		{fmt.Errorf("403 status code: %w", ErrDenied), 1, deniedRetryInterval},
+	} {
+		if got := retryDelay(c.err, c.attempts, time.Second); got != c.want {
+			t.Errorf("%v after %d attempts: got %v, want %v", c.err, c.attempts, got, c.want)
+		}
+	}
+}
+
+func TestS3ResponseError(t *testing.T) {
+	response := func(status int, date time.Time) *http.Response {
+		res := &http.Response{StatusCode: status, Header: make(http.Header)}
+		res.Header.Set("Date", date.UTC().Format(http.TimeFormat))
+		return res
+	}
+	body := func(code string) []byte {
+		return []byte("<Error><Code>" + code + "</Code><Message>details</Message></Error>")
+	}
+	now := time.Now()
+	for _, c := range []struct {
+		res  *http.Response
+		body []byte
+		want error
+	}{
+		{response(http.StatusServiceUnavailable, now), body("SlowDown"), ErrThrottled},
+		{response(http.StatusInternalServerError, now), body("InternalError"), ErrUnavailable},
+		{response(http.StatusForbidden, now), body("RequestTimeTooSkewed"), ErrClockSkew},
+		{response(http.StatusForbidden, now.Add(-time.Hour)), nil, ErrClockSkew},
+		{response(http.StatusForbidden, now), body("AccessDenied"), ErrDenied},
+		{response(http.StatusForbidden, now), nil, ErrDenied},
+	} {
+		if err := s3ResponseError(c.res, c.body, now); !errors.Is(err, c.want) {
+			t.Errorf("%d %s: got %v, want %v", c.res.StatusCode, c.body, err, c.want)
+		}
+	}
+	err := s3ResponseError(response(http.StatusBadRequest, now), body("InvalidArgument"), now)
+	for _, class := range []error{ErrThrottled, ErrUnavailable, ErrClockSkew, ErrDenied} {
+		if errors.Is(err, class) {
+			t.Errorf("%v: got class %v", err, class)
+		}
+	}
+}
+
+func TestS3StoreResponseError(t *testing.T) {
+	s := &s3Store{creds: newS3CredentialChain("STATIC", "static-secret")}
+	ahead := time.Now().Add(time.Hour)
+	res := &http.Response{StatusCode: http.StatusForbidden, Header: make(http.Header)}
+	res.Header.Set("Date", ahead.UTC().Format(http.TimeFormat))
+	if err := s.responseError(res, nil); !errors.Is(err, ErrClockSkew) {
+		t.Fatalf("got %v, want %v", err, ErrClockSkew)
+	}
+	if d := s.now().Sub(ahead); d < -2*time.Second || d > 2*time.Second {
+		t.Errorf("got the corrected time off by %v", d)
+	}
+	// Against the corrected time, the same response is a denial.
+	if err := s.responseError(res, nil); !errors.Is(err, ErrDenied) {
+		t.Errorf("got %v, want %v", err, ErrDenied)
+	}
+	if !s.creds.stale {
+		t.Error("got the credentials not expired after a denial")
+	}
+}
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
 	"net/rpc"
 	"strings"
 )
@@ -26,6 +28,29 @@ type DeleteArgs struct {
 
 type DeleteReply struct{}
 
+type ContainsArgs struct {
+	Key Key
+}
+
+type ContainsReply struct {
+	Found bool
+}
+
+type CompareAndSwapArgs struct {
+	Key Key
+	Old Value
+	New Value
+
+	// Gob does not distinguish nil from empty slices.
+	Absent bool
+}
+
+// CompareAndSwapReply reports conflicts in a field rather than as an
+// error, because errors do not retain their identity across RPC calls.
+type CompareAndSwapReply struct {
+	Conflict bool
+}
+
 // StoreService wraps a Store implementation for use in a net/rpc client-server application.
 type StoreService struct {
 	delegate Store
@@ -52,6 +77,30 @@ func (s *StoreService) Delete(args DeleteArgs, reply *DeleteReply) error {
 	return s.delegate.Delete(args.Key)
 }
 
+func (s *StoreService) CompareAndSwap(args CompareAndSwapArgs, reply *CompareAndSwapReply) error {
+	swapper, ok := s.delegate.(Swapper)
+	if !ok {
+		return ErrNotImplemented
+	}
+	old := args.Old
+	if args.Absent {
+		old = nil
+	} else if old == nil {
+		old = Value{}
+	}
+	err := swapper.CompareAndSwap(args.Key, old, args.New)
+	if errors.Is(err, ErrConflict) {
+		reply.Conflict = true
+		return nil
+	}
+	return err
+}
+
+func (s *StoreService) Contains(args ContainsArgs, reply *ContainsReply) (err error) {
+	reply.Found, err = s.delegate.Contains(args.Key)
+	return
+}
+
 // RemoteStore implements Store by calling a remote endpoint serving a StoreService using net/rpc.
 type RemoteStore struct {
 	client *rpc.Client
@@ -84,3 +133,22 @@ func (s *RemoteStore) Put(key Key, value Value) error {
 func (s *RemoteStore) Delete(key Key) error {
 	return s.client.Call("StoreService.Delete", DeleteArgs{Key: key}, nil)
 }
+
+func (s *RemoteStore) Contains(key Key) (bool, error) {
+	var reply ContainsReply
+	if err := s.client.Call("StoreService.Contains", ContainsArgs{Key: key}, &reply); err != nil {
+		return false, err
+	}
+	return reply.Found, nil
+}
+
+func (s *RemoteStore) CompareAndSwap(key Key, old, new Value) error {
+	var reply CompareAndSwapReply
+	if err := s.client.Call("StoreService.CompareAndSwap", CompareAndSwapArgs{Key: key, Old: old, New: new, Absent: old == nil}, &reply); err != nil {
+		return err
+	}
+	if reply.Conflict {
+		return fmt.Errorf("%q: %w", key, ErrConflict)
+	}
+	return nil
+}
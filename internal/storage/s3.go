@@ -1,35 +1,87 @@
 package storage
 
 import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/nicolagi/muscle/internal/config"
-	"github.com/nicolagi/signit"
 )
 
 type s3Store struct {
-	region    string
-	bucket    string
-	accessKey string
-	secretKey string
+	region string
+	bucket string
+	creds  *s3CredentialChain
+
+	// How far the clock of S3 is ahead of the local one, in
+	// nanoseconds, as last found from a response rejected for clock
+	// skew. Accessed atomically.
+	offset int64
 }
 
 var _ Store = (*s3Store)(nil)
 
+// newS3Store returns a store using the configured credentials, if
+// any, otherwise those found as the AWS tools would, see
+// s3CredentialChain; likewise for the region, which may come from
+// AWS_REGION or AWS_DEFAULT_REGION.
 func newS3Store(c *config.C) (Store, error) {
+	region := c.S3Region
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region == "" {
+			region = os.Getenv(name)
+		}
+	}
 	return &s3Store{
-		region:    c.S3Region,
-		bucket:    c.S3Bucket,
-		accessKey: c.S3AccessKey,
-		secretKey: c.S3SecretKey,
+		region: region,
+		bucket: c.S3Bucket,
+		creds:  newS3CredentialChain(c.S3AccessKey, c.S3SecretKey),
 	}, nil
 }
 
+func (s *s3Store) newRequest(method, url string, body []byte) (*s3Request, error) {
+	creds, err := s.creds.get()
+	if err != nil {
+		return nil, err
+	}
+	return newS3Request(creds, s.region, method, url, body, s.now())
+}
+
+// now returns the local time corrected by the clock offset, if any.
+func (s *s3Store) now() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&s.offset)))
+}
+
+// responseError returns s3ResponseError for an unsuccessful response.
+// If the clock was too far off, requests from then on are signed with
+// the time of S3, from the Date header, so that retrying succeeds. If
+// access was denied, the credentials are resolved again, in case they
+// were rotated.
+func (s *s3Store) responseError(res *http.Response, body []byte) error {
+	err := s3ResponseError(res, body, s.now())
+	switch {
+	case errors.Is(err, ErrClockSkew):
+		if t, perr := http.ParseTime(res.Header.Get("Date")); perr == nil {
+			atomic.StoreInt64(&s.offset, int64(time.Until(t)))
+		}
+	case errors.Is(err, ErrDenied):
+		s.creds.expire()
+	}
+	return err
+}
+
 func (s *s3Store) Get(key Key) (contents Value, err error) {
 	url := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s.bucket, string(key))
-	req, err := signit.NewRequest(s.accessKey, s.secretKey, s.region, "s3", "GET", url, nil)
+	req, err := s.newRequest("GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("s3Store.Get %q: %w", key, err)
 	}
@@ -46,14 +98,14 @@ func (s *s3Store) Get(key Key) (contents Value, err error) {
 		return nil, fmt.Errorf("s3Store.Get %q: %w", key, ErrNotFound)
 	}
 	if res.StatusCode != 200 {
-		return nil, fmt.Errorf("s3Store.Get %q: %d status code", key, res.StatusCode)
+		return nil, fmt.Errorf("s3Store.Get %q: %w", key, s.responseError(res, body))
 	}
 	return body, nil
 }
 
 func (s *s3Store) Put(key Key, value Value) (err error) {
 	url := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s.bucket, string(key))
-	req, err := signit.NewRequest(s.accessKey, s.secretKey, s.region, "s3", "PUT", url, value)
+	req, err := s.newRequest("PUT", url, value)
 	if err != nil {
 		return fmt.Errorf("s3Store.Put %q: %w", key, err)
 	}
@@ -62,16 +114,91 @@ func (s *s3Store) Put(key Key, value Value) (err error) {
 	if err != nil {
 		return fmt.Errorf("s3Store.Put %q: %w", key, err)
 	}
+	body, _ := ioutil.ReadAll(res.Body)
 	_ = res.Body.Close()
 	if res.StatusCode != 200 {
-		return fmt.Errorf("s3Store.Put %q: %d status code", key, res.StatusCode)
+		return fmt.Errorf("s3Store.Put %q: %w", key, s.responseError(res, body))
 	}
 	return nil
 }
 
+// Contains issues a HEAD request, so the value is not downloaded.
+func (s *s3Store) Contains(key Key) (bool, error) {
+	url := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s.bucket, string(key))
+	req, err := s.newRequest("HEAD", url, nil)
+	if err != nil {
+		return false, fmt.Errorf("s3Store.Contains %q: %w", key, err)
+	}
+	res, err := http.DefaultClient.Do(req.Sign())
+	if err != nil {
+		return false, fmt.Errorf("s3Store.Contains %q: %w", key, err)
+	}
+	_ = res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("s3Store.Contains %q: %w", key, s.responseError(res, nil))
+	}
+}
+
+// CompareAndSwap reads the current value along with its entity tag,
+// then writes the new value only if the entity tag is unchanged (or,
+// if the key is expected not to exist, only if it still doesn't).
+func (s *s3Store) CompareAndSwap(key Key, old, new Value) error {
+	url := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s.bucket, string(key))
+	req, err := s.newRequest("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("s3Store.CompareAndSwap %q: %w", key, err)
+	}
+	res, err := http.DefaultClient.Do(req.Sign())
+	if err != nil {
+		return fmt.Errorf("s3Store.CompareAndSwap %q: %w", key, err)
+	}
+	current, err := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return fmt.Errorf("s3Store.CompareAndSwap %q: %w", key, err)
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("s3Store.CompareAndSwap %q: %w", key, s.responseError(res, current))
+	}
+	found := res.StatusCode == http.StatusOK
+	if !matches(current, found, old) {
+		return fmt.Errorf("s3Store.CompareAndSwap %q: %w", key, ErrConflict)
+	}
+	etag := res.Header.Get("ETag")
+	req, err = s.newRequest("PUT", url, new)
+	if err != nil {
+		return fmt.Errorf("s3Store.CompareAndSwap %q: %w", key, err)
+	}
+	req.AddNextHeader("content-type", "application/octet-stream")
+	if found {
+		req.AddNextHeader("if-match", etag)
+	} else {
+		req.AddNextHeader("if-none-match", "*")
+	}
+	res, err = http.DefaultClient.Do(req.Sign())
+	if err != nil {
+		return fmt.Errorf("s3Store.CompareAndSwap %q: %w", key, err)
+	}
+	response, _ := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return fmt.Errorf("s3Store.CompareAndSwap %q: %w", key, ErrConflict)
+	default:
+		return fmt.Errorf("s3Store.CompareAndSwap %q: %w", key, s.responseError(res, response))
+	}
+}
+
 func (s *s3Store) Delete(key Key) error {
 	url := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s.bucket, string(key))
-	req, err := signit.NewRequest(s.accessKey, s.secretKey, s.region, "s3", "DELETE", url, nil)
+	req, err := s.newRequest("DELETE", url, nil)
 	if err != nil {
 		return fmt.Errorf("s3Store.Delete %q: %w", key, err)
 	}
@@ -79,9 +206,238 @@ func (s *s3Store) Delete(key Key) error {
 	if err != nil {
 		return fmt.Errorf("s3Store.Delete %q: %w", key, err)
 	}
+	body, _ := ioutil.ReadAll(res.Body)
 	_ = res.Body.Close()
 	if res.StatusCode != 204 {
-		return fmt.Errorf("s3Store.Delete %q: %d status code", key, res.StatusCode)
+		return fmt.Errorf("s3Store.Delete %q: %w", key, s.responseError(res, body))
 	}
 	return nil
 }
+
+// The parts of a ListObjectsV2 response List uses.
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key  string
+		Size int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// How many times, and after how long at first, an s3Lister retries a
+// page after being throttled. The wait doubles at each attempt.
+const (
+	s3ListAttempts  = 6
+	s3ListFirstWait = 500 * time.Millisecond
+)
+
+// s3Lister pages through the bucket with ListObjectsV2 requests,
+// which return up to 1000 keys each.
+type s3Lister struct {
+	store  *s3Store
+	prefix string
+	token  string
+	done   bool
+}
+
+// List returns an iterator making a ListObjectsV2 request per page.
+// Throttled requests are retried with exponential backoff.
+func (s *s3Store) List() ListIterator {
+	return &s3Lister{store: s}
+}
+
+// ListPrefix has S3 filter the keys by the prefix.
+func (s *s3Store) ListPrefix(prefix string) ListIterator {
+	return &s3Lister{store: s, prefix: prefix}
+}
+
+func (it *s3Lister) Next(ctx context.Context) ([]KeyInfo, error) {
+	if it.done {
+		return nil, io.EOF
+	}
+	wait := s3ListFirstWait
+	for attempt := 1; ; attempt++ {
+		result, throttled, err := it.fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if throttled {
+			if attempt == s3ListAttempts {
+				return nil, fmt.Errorf("s3Lister.Next: throttled %d times", attempt)
+			}
+			select {
+			case <-ctx.Done():
+				return nil, fmt.Errorf("s3Lister.Next: %w", ctx.Err())
+			case <-time.After(wait):
+			}
+			wait *= 2
+			continue
+		}
+		page := make([]KeyInfo, 0, len(result.Contents))
+		for _, c := range result.Contents {
+			page = append(page, KeyInfo{Key: Key(c.Key), Size: c.Size})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			it.done = true
+		}
+		it.token = result.NextContinuationToken
+		return page, nil
+	}
+}
+
+// fetch makes one ListObjectsV2 request, reporting whether it was
+// throttled rather than failing.
+func (it *s3Lister) fetch(ctx context.Context) (result *s3ListBucketResult, throttled bool, err error) {
+	s := it.store
+	url := fmt.Sprintf("https://%s.s3.amazonaws.com/", s.bucket)
+	req, err := s.newRequest("GET", url, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("s3Lister.fetch: %w", err)
+	}
+	if it.token != "" {
+		req.AddNextParam("continuation-token", it.token)
+	}
+	req.AddNextParam("list-type", "2")
+	if it.prefix != "" {
+		req.AddNextParam("prefix", it.prefix)
+	}
+	res, err := http.DefaultClient.Do(req.Sign().WithContext(ctx))
+	if err != nil {
+		return nil, false, fmt.Errorf("s3Lister.fetch: %w", err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return nil, false, fmt.Errorf("s3Lister.fetch: %w", err)
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+		return nil, true, nil
+	default:
+		return nil, false, fmt.Errorf("s3Lister.fetch: %w", s.responseError(res, body))
+	}
+	result = new(s3ListBucketResult)
+	if err := xml.Unmarshal(body, result); err != nil {
+		return nil, false, fmt.Errorf("s3Lister.fetch: %w", err)
+	}
+	return result, false, nil
+}
+
+// S3MaxDeleteBatch is the maximum number of keys in a DeleteObjects
+// request, hence in a batch passed to DeleteBatch.
+const S3MaxDeleteBatch = 1000
+
+// The parts of a DeleteObjects request and response DeleteBatch uses.
+type s3Delete struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool
+	Objects []s3DeleteObject `xml:"Object"`
+}
+
+type s3DeleteObject struct {
+	Key string
+}
+
+type s3DeleteResult struct {
+	Errors []struct {
+		Key     string
+		Code    string
+		Message string
+	} `xml:"Error"`
+}
+
+// DeleteBatch deletes up to S3MaxDeleteBatch keys with a single
+// DeleteObjects request, in quiet mode, so that only failures are
+// reported back.
+func (s *s3Store) DeleteBatch(keys []Key) (map[Key]error, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	if len(keys) > S3MaxDeleteBatch {
+		return nil, fmt.Errorf("s3Store.DeleteBatch: %d keys, at most %d allowed", len(keys), S3MaxDeleteBatch)
+	}
+	request := s3Delete{Quiet: true}
+	for _, k := range keys {
+		request.Objects = append(request.Objects, s3DeleteObject{Key: string(k)})
+	}
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("s3Store.DeleteBatch: %w", err)
+	}
+	sum := md5.Sum(body)
+	url := fmt.Sprintf("https://%s.s3.amazonaws.com/", s.bucket)
+	req, err := s.newRequest("POST", url, body)
+	if err != nil {
+		return nil, fmt.Errorf("s3Store.DeleteBatch: %w", err)
+	}
+	req.AddNextHeader("content-md5", base64.StdEncoding.EncodeToString(sum[:]))
+	req.AddNextHeader("content-type", "application/xml")
+	req.AddNextParam("delete", "")
+	res, err := http.DefaultClient.Do(req.Sign())
+	if err != nil {
+		return nil, fmt.Errorf("s3Store.DeleteBatch: %w", err)
+	}
+	response, err := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("s3Store.DeleteBatch: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("s3Store.DeleteBatch: %w", s.responseError(res, response))
+	}
+	var result s3DeleteResult
+	if err := xml.Unmarshal(response, &result); err != nil {
+		return nil, fmt.Errorf("s3Store.DeleteBatch: %w", err)
+	}
+	var failed map[Key]error
+	for _, e := range result.Errors {
+		if failed == nil {
+			failed = make(map[Key]error)
+		}
+		failed[Key(e.Key)] = fmt.Errorf("s3Store.DeleteBatch %q: %s: %s", e.Key, e.Code, e.Message)
+	}
+	return failed, nil
+}
+
+// How far the time of a request may be from that of S3.
+const s3MaxSkew = 15 * time.Minute
+
+// s3ResponseError describes an unsuccessful response, with the error
+// code in the body, if any, wrapping the class of the failure, e.g.,
+// ErrThrottled. Responses to HEAD requests have no body, so clock skew
+// is also detected from the Date header, against the given time.
+func s3ResponseError(res *http.Response, body []byte, now time.Time) error {
+	var e struct {
+		Code    string
+		Message string
+	}
+	_ = xml.Unmarshal(body, &e)
+	detail := fmt.Sprintf("%d status code", res.StatusCode)
+	if e.Code != "" {
+		detail += ": " + e.Code
+	}
+	if e.Message != "" {
+		detail += ": " + e.Message
+	}
+	var skew time.Duration
+	if t, err := http.ParseTime(res.Header.Get("Date")); err == nil {
+		skew = now.Sub(t).Round(time.Second)
+	}
+	var class error
+	switch {
+	case e.Code == "RequestTimeTooSkewed",
+		res.StatusCode == http.StatusForbidden && (skew > s3MaxSkew || skew < -s3MaxSkew):
+		class = ErrClockSkew
+		detail += fmt.Sprintf(" (the request time is off by %v)", skew)
+	case e.Code == "SlowDown", res.StatusCode == http.StatusTooManyRequests:
+		class = ErrThrottled
+	case res.StatusCode >= 500:
+		class = ErrUnavailable
+	case res.StatusCode == http.StatusForbidden:
+		class = ErrDenied
+	default:
+		return errors.New(detail)
+	}
+	return fmt.Errorf("%s: %w", detail, class)
+}
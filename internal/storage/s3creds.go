@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3Credentials sign requests to S3. The token is only set for
+// temporary credentials, e.g., those of an instance profile, which
+// expire.
+type s3Credentials struct {
+	accessKey string
+	secretKey string
+	token     string
+	expires   time.Time
+}
+
+// How long before they expire temporary credentials are refreshed.
+const s3CredentialsRefreshMargin = 5 * time.Minute
+
+// The instance metadata service, which serves the credentials of the
+// IAM role of an EC2 instance.
+const imdsEndpoint = "http://169.254.169.254"
+
+// s3CredentialChain resolves credentials the way the AWS tools do,
+// if none are configured: from the environment (AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN), then from the shared
+// credentials file (AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials,
+// profile AWS_PROFILE or default), then from the instance metadata
+// service. Credentials are cached, and refreshed before they expire.
+type s3CredentialChain struct {
+	static   s3Credentials
+	getenv   func(string) string
+	endpoint string
+	client   *http.Client
+
+	mu     sync.Mutex
+	cached s3Credentials
+	ok     bool
+	stale  bool
+}
+
+func newS3CredentialChain(accessKey, secretKey string) *s3CredentialChain {
+	return &s3CredentialChain{
+		static:   s3Credentials{accessKey: accessKey, secretKey: secretKey},
+		getenv:   os.Getenv,
+		endpoint: imdsEndpoint,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (c *s3CredentialChain) get() (s3Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ok && !c.stale && (c.cached.expires.IsZero() || time.Until(c.cached.expires) > s3CredentialsRefreshMargin) {
+		return c.cached, nil
+	}
+	creds, err := c.resolve()
+	if err != nil {
+		// Better stale credentials than none, until they expire.
+		if c.ok && time.Now().Before(c.cached.expires) {
+			return c.cached, nil
+		}
+		return s3Credentials{}, err
+	}
+	c.cached, c.ok, c.stale = creds, true, false
+	return creds, nil
+}
+
+// expire has the next get resolve the credentials again, e.g.,
+// because those cached were rejected.
+func (c *s3CredentialChain) expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stale = true
+}
+
+func (c *s3CredentialChain) resolve() (s3Credentials, error) {
+	if c.static.accessKey != "" {
+		return c.static, nil
+	}
+	if creds := c.fromEnvironment(); creds.accessKey != "" {
+		return creds, nil
+	}
+	if creds, err := c.fromSharedFile(); err != nil {
+		return s3Credentials{}, fmt.Errorf("s3CredentialChain.resolve: %w", err)
+	} else if creds.accessKey != "" {
+		return creds, nil
+	}
+	creds, err := c.fromInstanceMetadata()
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("s3CredentialChain.resolve: no credentials in the configuration, the environment, or the shared credentials file, and %w", err)
+	}
+	return creds, nil
+}
+
+func (c *s3CredentialChain) fromEnvironment() s3Credentials {
+	return s3Credentials{
+		accessKey: c.getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: c.getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     c.getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// fromSharedFile returns zero credentials, and no error, if the file
+// or the profile does not exist.
+func (c *s3CredentialChain) fromSharedFile() (creds s3Credentials, err error) {
+	pathname := c.getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if pathname == "" {
+		home := c.getenv("HOME")
+		if home == "" {
+			return creds, nil
+		}
+		pathname = home + "/.aws/credentials"
+	}
+	profile := c.getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	f, err := os.Open(pathname)
+	if errors.Is(err, os.ErrNotExist) {
+		return creds, nil
+	}
+	if err != nil {
+		return creds, fmt.Errorf("s3CredentialChain.fromSharedFile: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	var section string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i == -1 {
+			continue
+		}
+		switch key, val := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]); key {
+		case "aws_access_key_id":
+			creds.accessKey = val
+		case "aws_secret_access_key":
+			creds.secretKey = val
+		case "aws_session_token":
+			creds.token = val
+		}
+	}
+	if err := s.Err(); err != nil {
+		return s3Credentials{}, fmt.Errorf("s3CredentialChain.fromSharedFile: %w", err)
+	}
+	return creds, nil
+}
+
+// fromInstanceMetadata gets the credentials of the instance profile
+// from the instance metadata service, with a session token (IMDSv2).
+func (c *s3CredentialChain) fromInstanceMetadata() (s3Credentials, error) {
+	const path = "/latest/meta-data/iam/security-credentials/"
+	var creds s3Credentials
+	req, err := http.NewRequest(http.MethodPut, c.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return creds, fmt.Errorf("s3CredentialChain.fromInstanceMetadata: %w", err)
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := c.imdsDo(req)
+	if err != nil {
+		return creds, fmt.Errorf("s3CredentialChain.fromInstanceMetadata: getting a token: %w", err)
+	}
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequest(http.MethodGet, c.endpoint+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return c.imdsDo(req)
+	}
+	roles, err := get(path)
+	if err != nil {
+		return creds, fmt.Errorf("s3CredentialChain.fromInstanceMetadata: getting the role: %w", err)
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return creds, fmt.Errorf("s3CredentialChain.fromInstanceMetadata: the instance has no role")
+	}
+	body, err := get(path + role)
+	if err != nil {
+		return creds, fmt.Errorf("s3CredentialChain.fromInstanceMetadata: getting the credentials of %q: %w", role, err)
+	}
+	var response struct {
+		Code            string
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return creds, fmt.Errorf("s3CredentialChain.fromInstanceMetadata: %w", err)
+	}
+	if response.Code != "Success" {
+		return creds, fmt.Errorf("s3CredentialChain.fromInstanceMetadata: credentials of %q: %s", role, response.Code)
+	}
+	return s3Credentials{
+		accessKey: response.AccessKeyID,
+		secretKey: response.SecretAccessKey,
+		token:     response.Token,
+		expires:   response.Expiration,
+	}, nil
+}
+
+func (c *s3CredentialChain) imdsDo(req *http.Request) ([]byte, error) {
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%d status code", res.StatusCode)
+	}
+	return body, nil
+}
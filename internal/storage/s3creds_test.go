@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestS3CredentialChain(t *testing.T) {
+	env := make(map[string]string)
+	var imdsCalls int
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		imdsCalls++
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			_, _ = fmt.Fprint(w, "imds-token")
+		case r.Header.Get("X-aws-ec2-metadata-token") != "imds-token":
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+			_, _ = fmt.Fprint(w, "muscle-role")
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/muscle-role":
+			_, _ = fmt.Fprintf(w, `{"Code": "Success", "AccessKeyId": "ROLE", "SecretAccessKey": "role-secret", "Token": "role-token", "Expiration": %q}`, expires.Format(time.RFC3339))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer imds.Close()
+	chain := func(accessKey, secretKey string) *s3CredentialChain {
+		c := newS3CredentialChain(accessKey, secretKey)
+		c.getenv = func(name string) string { return env[name] }
+		c.endpoint = imds.URL
+		return c
+	}
+	check := func(c *s3CredentialChain, want s3Credentials) {
+		t.Helper()
+		got, err := c.get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+
+	check(chain("STATIC", "static-secret"), s3Credentials{accessKey: "STATIC", secretKey: "static-secret"})
+
+	env["HOME"] = t.TempDir()
+	c := chain("", "")
+	check(c, s3Credentials{accessKey: "ROLE", secretKey: "role-secret", token: "role-token", expires: expires})
+	calls := imdsCalls
+	check(c, s3Credentials{accessKey: "ROLE", secretKey: "role-secret", token: "role-token", expires: expires})
+	if imdsCalls != calls {
+		t.Errorf("got %d more calls to the metadata service, want the credentials cached", imdsCalls-calls)
+	}
+	c.expire()
+	check(c, s3Credentials{accessKey: "ROLE", secretKey: "role-secret", token: "role-token", expires: expires})
+	if imdsCalls == calls {
+		t.Error("got no more calls to the metadata service, want the expired credentials resolved again")
+	}
+
+	pathname := filepath.Join(t.TempDir(), "credentials")
+	if err := ioutil.WriteFile(pathname, []byte("[default]\naws_access_key_id = DEFAULT\naws_secret_access_key = default-secret\n\n[work]\nregion = eu-west-1\naws_access_key_id = WORK\naws_secret_access_key = work-secret\naws_session_token = work-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	env["AWS_SHARED_CREDENTIALS_FILE"] = pathname
+	check(chain("", ""), s3Credentials{accessKey: "DEFAULT", secretKey: "default-secret"})
+	env["AWS_PROFILE"] = "work"
+	check(chain("", ""), s3Credentials{accessKey: "WORK", secretKey: "work-secret", token: "work-token"})
+
+	env["AWS_ACCESS_KEY_ID"] = "ENV"
+	env["AWS_SECRET_ACCESS_KEY"] = "env-secret"
+	check(chain("", ""), s3Credentials{accessKey: "ENV", secretKey: "env-secret"})
+
+	env = map[string]string{"HOME": t.TempDir()}
+	c = chain("", "")
+	c.endpoint = "http://127.0.0.1:1"
+	if _, err := c.get(); err == nil {
+		t.Error("got nil error without any credentials")
+	}
+}
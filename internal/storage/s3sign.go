@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const s3DateTimeFormat = "20060102T150405Z"
+
+// s3Request is a request to S3 signed with AWS Signature Version 4,
+// as of the time it was created with, rather than the local time, so
+// that the clock can be corrected for skew. Headers and parameters
+// must be added in lexicographical order; the host,
+// x-amz-content-sha256, and x-amz-date headers are added as needed
+// to keep that order, and must not be added explicitly.
+type s3Request struct {
+	hr        *http.Request
+	creds     s3Credentials
+	region    string
+	method    string
+	timestamp string
+	bodyHash  [sha256.Size]byte
+	names     []string
+	values    []string
+	params    bytes.Buffer
+	host      bool
+	body      bool
+	date      bool
+}
+
+func newS3Request(creds s3Credentials, region, method, url string, body []byte, now time.Time) (*s3Request, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	hr, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Request{
+		hr:        hr,
+		creds:     creds,
+		region:    region,
+		method:    method,
+		timestamp: now.UTC().Format(s3DateTimeFormat),
+		bodyHash:  sha256.Sum256(body),
+	}, nil
+}
+
+// AddNextHeader adds a header, whose name must be lower case and sort
+// after those of the headers added before it.
+func (r *s3Request) AddNextHeader(name, value string) {
+	if "host" < name {
+		r.ensureHost()
+	}
+	if "x-amz-content-sha256" < name {
+		r.ensureBody()
+	}
+	if "x-amz-date" < name {
+		r.ensureDate()
+	}
+	r.add(name, value)
+}
+
+// AddNextParam adds a query string parameter, whose name must sort
+// after those of the parameters added before it.
+func (r *s3Request) AddNextParam(name, value string) {
+	if r.params.Len() > 0 {
+		r.params.WriteByte('&')
+	}
+	r.params.WriteString(s3Escape(name, false))
+	r.params.WriteByte('=')
+	r.params.WriteString(s3Escape(value, false))
+}
+
+// Sign adds the session token, if any, after any other headers, as
+// it sorts last, and the signature, and returns the request to send.
+func (r *s3Request) Sign() *http.Request {
+	r.ensureHost()
+	r.ensureBody()
+	r.ensureDate()
+	if r.creds.token != "" {
+		r.add("x-amz-security-token", r.creds.token)
+	}
+	// Send the path and query as signed, rather than as encoded by
+	// net/url, which differs, e.g., for spaces and reserved characters.
+	r.hr.URL.RawPath = s3Escape(r.hr.URL.Path, true)
+	if r.hr.URL.RawPath == "" {
+		r.hr.URL.RawPath = "/"
+	}
+	r.hr.URL.RawQuery = r.params.String()
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", r.timestamp[:8], r.region)
+	signed := strings.Join(r.names, ";")
+	canonical := sha256.Sum256([]byte(r.canonical()))
+	key := s3HMAC([]byte("AWS4"+r.creds.secretKey), r.timestamp[:8])
+	key = s3HMAC(key, r.region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	signature := s3HMAC(key, fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%02x", r.timestamp, scope, canonical[:]))
+	for i, name := range r.names {
+		r.hr.Header.Set(name, r.values[i])
+	}
+	r.hr.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%02x",
+		r.creds.accessKey, scope, signed, signature))
+	return r.hr
+}
+
+// canonical returns the canonical request, which is what gets signed.
+// It must be called after the path and query are set by Sign.
+func (r *s3Request) canonical() string {
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "%s\n%s\n%s\n", r.method, r.hr.URL.RawPath, r.hr.URL.RawQuery)
+	for i, name := range r.names {
+		_, _ = fmt.Fprintf(&b, "%s:%s\n", name, r.values[i])
+	}
+	_, _ = fmt.Fprintf(&b, "\n%s\n%02x", strings.Join(r.names, ";"), r.bodyHash[:])
+	return b.String()
+}
+
+func (r *s3Request) add(name, value string) {
+	r.names = append(r.names, name)
+	r.values = append(r.values, value)
+}
+
+func (r *s3Request) ensureHost() {
+	if !r.host {
+		r.add("host", r.hr.URL.Host)
+		r.host = true
+	}
+}
+
+func (r *s3Request) ensureBody() {
+	if !r.body {
+		r.add("x-amz-content-sha256", fmt.Sprintf("%02x", r.bodyHash[:]))
+		r.body = true
+	}
+}
+
+func (r *s3Request) ensureDate() {
+	if !r.date {
+		r.add("x-amz-date", r.timestamp)
+		r.date = true
+	}
+}
+
+// s3Escape percent-encodes all bytes of s but the unreserved characters
+// and, if slash is set, the slashes separating path segments, as
+// Signature Version 4 requires. Unlike url.PathEscape and
+// url.QueryEscape, it encodes reserved characters such as ':' and '=',
+// and spaces as %20 rather than '+'.
+func s3Escape(s string, slash bool) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', slash && c == '/':
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+		}
+	}
+	return b.String()
+}
+
+func s3HMAC(key []byte, value string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = io.WriteString(h, value)
+	return h.Sum(nil)
+}
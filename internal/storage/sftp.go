@@ -0,0 +1,868 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/nicolagi/muscle/internal/config"
+)
+
+// Packet types of version 3 of the SFTP protocol, the one OpenSSH
+// implements, see draft-ietf-secsh-filexfer-02.
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpFstat    = 8
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+	sftpExtended = 200
+)
+
+// Flags for opening files.
+const (
+	sftpFlagRead  = 0x01
+	sftpFlagWrite = 0x02
+	sftpFlagCreat = 0x08
+	sftpFlagTrunc = 0x10
+	sftpFlagExcl  = 0x20
+)
+
+// Flags telling which attributes follow.
+const (
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+)
+
+// Status codes.
+const (
+	sftpOK         = 0
+	sftpEOF        = 1
+	sftpNoSuchFile = 2
+)
+
+// The extension renaming over an existing file, which plain SFTP
+// renames refuse to do.
+const sftpPosixRename = "posix-rename@openssh.com"
+
+// Bytes read or written per request: servers accept packets of at
+// least 32 KiB, data included.
+const sftpChunkSize = 32 * 1024
+
+// Requests in flight when reading or writing a file, so that a block
+// isn't transferred at the pace of one round trip per chunk.
+const sftpWindow = 16
+
+// Largest packet accepted from the server.
+const sftpMaxPacket = 256 * 1024
+
+// sftpStatusError is a status other than success sent by the server.
+type sftpStatusError struct {
+	code    uint32
+	message string
+}
+
+func (e *sftpStatusError) Error() string {
+	return fmt.Sprintf("sftp status %d: %s", e.code, e.message)
+}
+
+// isSFTPStatus tells whether the error is a status with the given code.
+func isSFTPStatus(err error, code uint32) bool {
+	var se *sftpStatusError
+	return errors.As(err, &se) && se.code == code
+}
+
+type sftpEncoder struct {
+	b []byte
+}
+
+func (e *sftpEncoder) uint32(v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	e.b = append(e.b, buf[:]...)
+}
+
+func (e *sftpEncoder) uint64(v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	e.b = append(e.b, buf[:]...)
+}
+
+func (e *sftpEncoder) string(s string) {
+	e.uint32(uint32(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *sftpEncoder) bytes(p []byte) {
+	e.uint32(uint32(len(p)))
+	e.b = append(e.b, p...)
+}
+
+// sftpDecoder decodes a packet, remembering the first error, so that
+// fields can be decoded one after the other and the error checked once.
+type sftpDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *sftpDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.b) < n {
+		d.err = fmt.Errorf("sftp packet too short: %d bytes left, need %d", len(d.b), n)
+		return nil
+	}
+	p := d.b[:n]
+	d.b = d.b[n:]
+	return p
+}
+
+func (d *sftpDecoder) uint32() uint32 {
+	if p := d.next(4); p != nil {
+		return binary.BigEndian.Uint32(p)
+	}
+	return 0
+}
+
+func (d *sftpDecoder) uint64() uint64 {
+	if p := d.next(8); p != nil {
+		return binary.BigEndian.Uint64(p)
+	}
+	return 0
+}
+
+func (d *sftpDecoder) bytes() []byte {
+	n := d.uint32()
+	if d.err != nil {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+func (d *sftpDecoder) string() string {
+	return string(d.bytes())
+}
+
+// attrs decodes attributes, keeping only those the store needs.
+func (d *sftpDecoder) attrs() (size uint64, isDir bool) {
+	flags := d.uint32()
+	if flags&sftpAttrSize != 0 {
+		size = d.uint64()
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		d.uint32()
+		d.uint32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		isDir = d.uint32()&0170000 == 0040000
+	}
+	if flags&sftpAttrACModTime != 0 {
+		d.uint32()
+		d.uint32()
+	}
+	if flags&sftpAttrExtended != 0 {
+		for n := d.uint32(); n > 0 && d.err == nil; n-- {
+			d.string()
+			d.string()
+		}
+	}
+	return size, isDir
+}
+
+type sftpResponse struct {
+	typ byte
+	*sftpDecoder
+}
+
+// status returns the error for a status response, nil for success, or
+// an error if the response is of another type.
+func (r sftpResponse) status() error {
+	if r.typ != sftpStatus {
+		return fmt.Errorf("sftp response type %d, want status", r.typ)
+	}
+	code := r.uint32()
+	message := r.string()
+	if r.err != nil {
+		return r.err
+	}
+	if code != sftpOK {
+		return &sftpStatusError{code: code, message: message}
+	}
+	return nil
+}
+
+// expect checks the response is of the given type, returning the
+// error carried by a status response otherwise.
+func (r sftpResponse) expect(typ byte) error {
+	if r.typ == typ {
+		return nil
+	}
+	if err := r.status(); err != nil {
+		return err
+	}
+	return fmt.Errorf("sftp response type %d, want %d", r.typ, typ)
+}
+
+// sftpConn is a client connection, over which requests from many
+// goroutines can be in flight at once: a goroutine reads the responses
+// and hands each to the goroutine waiting for it.
+type sftpConn struct {
+	w        io.Writer
+	shutdown func() error
+
+	// Serializes writing requests.
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan sftpResponse
+	// Set once the connection fails, after which all requests fail.
+	err error
+
+	extensions map[string]string
+}
+
+// newSFTPConn negotiates the protocol version over the given reader and
+// writer, talking to a server, then starts reading responses. The
+// shutdown function is called by close, e.g., to wait for ssh to exit.
+func newSFTPConn(r io.Reader, w io.Writer, shutdown func() error) (*sftpConn, error) {
+	c := &sftpConn{
+		w:          w,
+		shutdown:   shutdown,
+		pending:    make(map[uint32]chan sftpResponse),
+		extensions: make(map[string]string),
+	}
+	var e sftpEncoder
+	e.uint32(3)
+	if err := writeSFTPPacket(w, sftpInit, e.b); err != nil {
+		return nil, err
+	}
+	typ, body, err := readSFTPPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if typ != sftpVersion {
+		return nil, fmt.Errorf("sftp response type %d, want version", typ)
+	}
+	d := &sftpDecoder{b: body}
+	if v := d.uint32(); v != 3 && d.err == nil {
+		return nil, fmt.Errorf("sftp version %d, want 3", v)
+	}
+	for len(d.b) > 0 && d.err == nil {
+		name := d.string()
+		c.extensions[name] = d.string()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	go c.readResponses(r)
+	return c, nil
+}
+
+func writeSFTPPacket(w io.Writer, typ byte, payload []byte) error {
+	b := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(1+len(payload)))
+	b[4] = typ
+	_, err := w.Write(append(b, payload...))
+	return err
+}
+
+func readSFTPPacket(r io.Reader) (typ byte, body []byte, err error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:4])
+	if n < 1 || n > sftpMaxPacket {
+		return 0, nil, fmt.Errorf("sftp packet length %d out of range", n)
+	}
+	body = make([]byte, n-1)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[4], body, nil
+}
+
+func (c *sftpConn) readResponses(r io.Reader) {
+	for {
+		typ, body, err := readSFTPPacket(r)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		d := &sftpDecoder{b: body}
+		id := d.uint32()
+		if d.err != nil {
+			c.fail(d.err)
+			return
+		}
+		c.mu.Lock()
+		ch := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- sftpResponse{typ: typ, sftpDecoder: d}
+		}
+	}
+}
+
+// fail makes the connection unusable, failing the requests in flight.
+func (c *sftpConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = fmt.Errorf("sftp connection: %w", err)
+	}
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+func (c *sftpConn) failed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+func (c *sftpConn) close() error {
+	c.fail(errors.New("closed"))
+	return c.shutdown()
+}
+
+// send sends a request, whose fields after the id are written by the
+// given function, and returns where its response will be delivered.
+func (c *sftpConn) send(typ byte, fields func(*sftpEncoder)) (<-chan sftpResponse, error) {
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	id := c.nextID
+	c.nextID++
+	ch := make(chan sftpResponse, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+	var e sftpEncoder
+	e.uint32(id)
+	fields(&e)
+	c.wmu.Lock()
+	err := writeSFTPPacket(c.w, typ, e.b)
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (c *sftpConn) wait(ch <-chan sftpResponse) (sftpResponse, error) {
+	r, ok := <-ch
+	if !ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return r, c.err
+	}
+	return r, nil
+}
+
+func (c *sftpConn) request(typ byte, fields func(*sftpEncoder)) (sftpResponse, error) {
+	ch, err := c.send(typ, fields)
+	if err != nil {
+		return sftpResponse{}, err
+	}
+	return c.wait(ch)
+}
+
+// requestStatus sends a request whose response is a status.
+func (c *sftpConn) requestStatus(typ byte, fields func(*sftpEncoder)) error {
+	r, err := c.request(typ, fields)
+	if err != nil {
+		return err
+	}
+	return r.status()
+}
+
+func (c *sftpConn) open(pathname string, flags uint32) (handle string, err error) {
+	r, err := c.request(sftpOpen, func(e *sftpEncoder) {
+		e.string(pathname)
+		e.uint32(flags)
+		if flags&sftpFlagCreat != 0 {
+			e.uint32(sftpAttrPermissions)
+			e.uint32(0644)
+		} else {
+			e.uint32(0)
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := r.expect(sftpHandle); err != nil {
+		return "", err
+	}
+	handle = r.string()
+	return handle, r.err
+}
+
+func (c *sftpConn) closeHandle(handle string) error {
+	return c.requestStatus(sftpClose, func(e *sftpEncoder) { e.string(handle) })
+}
+
+// sftpPendingRead is a read request in flight.
+type sftpPendingRead struct {
+	off uint64
+	n   uint32
+	ch  <-chan sftpResponse
+}
+
+// readFile reads the whole file, with up to sftpWindow requests in
+// flight. Reads returning fewer bytes than requested are followed by
+// reads of the rest.
+func (c *sftpConn) readFile(pathname string) (contents []byte, err error) {
+	handle, err := c.open(pathname, sftpFlagRead)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := c.closeHandle(handle); err == nil {
+			err = cerr
+		}
+	}()
+	r, err := c.request(sftpFstat, func(e *sftpEncoder) { e.string(handle) })
+	if err != nil {
+		return nil, err
+	}
+	if err := r.expect(sftpAttrs); err != nil {
+		return nil, err
+	}
+	size, _ := r.attrs()
+	if r.err != nil {
+		return nil, r.err
+	}
+	contents = make([]byte, size)
+	var inflight []sftpPendingRead
+	read := func(off uint64, n uint32) error {
+		ch, err := c.send(sftpRead, func(e *sftpEncoder) {
+			e.string(handle)
+			e.uint64(off)
+			e.uint32(n)
+		})
+		if err == nil {
+			inflight = append(inflight, sftpPendingRead{off: off, n: n, ch: ch})
+		}
+		return err
+	}
+	var next uint64
+	for next < size || len(inflight) > 0 {
+		for next < size && len(inflight) < sftpWindow {
+			n := uint64(sftpChunkSize)
+			if size-next < n {
+				n = size - next
+			}
+			if err := read(next, uint32(n)); err != nil {
+				return nil, err
+			}
+			next += n
+		}
+		req := inflight[0]
+		inflight = inflight[1:]
+		r, err := c.wait(req.ch)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.expect(sftpData); err != nil {
+			if isSFTPStatus(err, sftpEOF) {
+				err = fmt.Errorf("%q shrank while being read", pathname)
+			}
+			return nil, err
+		}
+		data := r.bytes()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if len(data) == 0 || len(data) > int(req.n) {
+			return nil, fmt.Errorf("read %d bytes at %d of %q, asked for %d", len(data), req.off, pathname, req.n)
+		}
+		copy(contents[req.off:], data)
+		if rest := req.n - uint32(len(data)); rest > 0 {
+			if err := read(req.off+uint64(len(data)), rest); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return contents, nil
+}
+
+// writeFile creates the file, which must not exist, and writes the
+// contents to it, with up to sftpWindow requests in flight.
+func (c *sftpConn) writeFile(pathname string, contents []byte) (err error) {
+	handle, err := c.open(pathname, sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc|sftpFlagExcl)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := c.closeHandle(handle); err == nil {
+			err = cerr
+		}
+	}()
+	var inflight []<-chan sftpResponse
+	for off := 0; off < len(contents) || len(inflight) > 0; {
+		for off < len(contents) && len(inflight) < sftpWindow {
+			chunk := contents[off:]
+			if len(chunk) > sftpChunkSize {
+				chunk = chunk[:sftpChunkSize]
+			}
+			o := off
+			ch, err := c.send(sftpWrite, func(e *sftpEncoder) {
+				e.string(handle)
+				e.uint64(uint64(o))
+				e.bytes(chunk)
+			})
+			if err != nil {
+				return err
+			}
+			inflight = append(inflight, ch)
+			off += len(chunk)
+		}
+		r, err := c.wait(inflight[0])
+		inflight = inflight[1:]
+		if err != nil {
+			return err
+		}
+		if err := r.status(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *sftpConn) stat(pathname string) (size uint64, isDir bool, err error) {
+	r, err := c.request(sftpStat, func(e *sftpEncoder) { e.string(pathname) })
+	if err != nil {
+		return 0, false, err
+	}
+	if err := r.expect(sftpAttrs); err != nil {
+		return 0, false, err
+	}
+	size, isDir = r.attrs()
+	return size, isDir, r.err
+}
+
+func (c *sftpConn) remove(pathname string) error {
+	return c.requestStatus(sftpRemove, func(e *sftpEncoder) { e.string(pathname) })
+}
+
+func (c *sftpConn) mkdir(pathname string) error {
+	return c.requestStatus(sftpMkdir, func(e *sftpEncoder) {
+		e.string(pathname)
+		e.uint32(0)
+	})
+}
+
+// rename renames oldpath to newpath, replacing newpath if it exists:
+// atomically if the server supports the extension for it, otherwise
+// by removing newpath first.
+func (c *sftpConn) rename(oldpath, newpath string) error {
+	if _, ok := c.extensions[sftpPosixRename]; ok {
+		return c.requestStatus(sftpExtended, func(e *sftpEncoder) {
+			e.string(sftpPosixRename)
+			e.string(oldpath)
+			e.string(newpath)
+		})
+	}
+	if err := c.remove(newpath); err != nil && !isSFTPStatus(err, sftpNoSuchFile) {
+		return err
+	}
+	return c.requestStatus(sftpRename, func(e *sftpEncoder) {
+		e.string(oldpath)
+		e.string(newpath)
+	})
+}
+
+type sftpEntry struct {
+	name  string
+	size  uint64
+	isDir bool
+}
+
+func (c *sftpConn) readDir(pathname string) (entries []sftpEntry, err error) {
+	r, err := c.request(sftpOpendir, func(e *sftpEncoder) { e.string(pathname) })
+	if err != nil {
+		return nil, err
+	}
+	if err := r.expect(sftpHandle); err != nil {
+		return nil, err
+	}
+	handle := r.string()
+	if r.err != nil {
+		return nil, r.err
+	}
+	defer func() {
+		if cerr := c.closeHandle(handle); err == nil {
+			err = cerr
+		}
+	}()
+	for {
+		r, err := c.request(sftpReaddir, func(e *sftpEncoder) { e.string(handle) })
+		if err != nil {
+			return nil, err
+		}
+		if err := r.expect(sftpName); err != nil {
+			if isSFTPStatus(err, sftpEOF) {
+				return entries, nil
+			}
+			return nil, err
+		}
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			var entry sftpEntry
+			entry.name = r.string()
+			_ = r.string() // The long name, as listed by ls -l.
+			entry.size, entry.isDir = r.attrs()
+			if entry.name != "." && entry.name != ".." {
+				entries = append(entries, entry)
+			}
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+}
+
+// sftpStore keeps items in a directory on a host reachable with ssh,
+// laid out as in a DiskStore, so that one can be copied to the other.
+// It doesn't implement Swapper: SFTP has no means to update a file
+// conditionally.
+type sftpStore struct {
+	dir  string
+	dial func() (*sftpConn, error)
+
+	mu   sync.Mutex
+	conn *sftpConn
+}
+
+var (
+	_ Store        = (*sftpStore)(nil)
+	_ Lister       = (*sftpStore)(nil)
+	_ PrefixLister = (*sftpStore)(nil)
+)
+
+// newSFTPStore returns a store connecting, when first used and again
+// after the connection fails, by running ssh or the configured command.
+func newSFTPStore(c *config.C) (Store, error) {
+	if c.SFTPHost == "" && c.SFTPCommand == "" {
+		return nil, errorf("newSFTPStore", "neither sftp-host nor sftp-command configured")
+	}
+	if c.SFTPDir == "" {
+		return nil, errorf("newSFTPStore", "sftp-dir not configured")
+	}
+	return &sftpStore{
+		dir: c.SFTPDir,
+		dial: func() (*sftpConn, error) {
+			var cmd *exec.Cmd
+			if c.SFTPCommand != "" {
+				cmd = exec.Command("sh", "-c", c.SFTPCommand)
+			} else {
+				cmd = exec.Command("ssh", "-s", c.SFTPHost, "sftp")
+			}
+			return startSFTP(cmd)
+		},
+	}, nil
+}
+
+// startSFTP starts the command and talks SFTP over its standard input
+// and output. Its standard error is ours, so that ssh errors are logged.
+func startSFTP(cmd *exec.Cmd) (*sftpConn, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	shutdown := func() error {
+		_ = stdin.Close()
+		return cmd.Wait()
+	}
+	c, err := newSFTPConn(stdout, stdin, shutdown)
+	if err != nil {
+		_ = shutdown()
+		return nil, err
+	}
+	return c, nil
+}
+
+// connection returns the current connection, replacing a failed one.
+func (s *sftpStore) connection() (*sftpConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil && s.conn.failed() {
+		go func(c *sftpConn) { _ = c.close() }(s.conn)
+		s.conn = nil
+	}
+	if s.conn == nil {
+		c, err := s.dial()
+		if err != nil {
+			return nil, err
+		}
+		s.conn = c
+	}
+	return s.conn, nil
+}
+
+func (s *sftpStore) pathFor(key Key) string {
+	k := string(key)
+	return path.Join(s.dir, k[:2], k)
+}
+
+func (s *sftpStore) Get(key Key) (Value, error) {
+	c, err := s.connection()
+	if err != nil {
+		return nil, fmt.Errorf("sftpStore.Get %q: %w", key, err)
+	}
+	value, err := c.readFile(s.pathFor(key))
+	if isSFTPStatus(err, sftpNoSuchFile) {
+		return nil, fmt.Errorf("sftpStore.Get %q: %w", key, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sftpStore.Get %q: %w", key, err)
+	}
+	return value, nil
+}
+
+// Put writes the value to a temporary file, then renames it over the
+// item, as DiskStore.Put does, creating the directories it needs.
+func (s *sftpStore) Put(key Key, value Value) error {
+	c, err := s.connection()
+	if err != nil {
+		return fmt.Errorf("sftpStore.Put %q: %w", key, err)
+	}
+	p := s.pathFor(key)
+	var suffix [8]byte
+	if _, err := rand.Read(suffix[:]); err != nil {
+		return fmt.Errorf("sftpStore.Put %q: %w", key, err)
+	}
+	temp := p + "." + hex.EncodeToString(suffix[:]) + tempSuffix
+	err = c.writeFile(temp, value)
+	if isSFTPStatus(err, sftpNoSuchFile) {
+		// Errors are ignored, e.g., for directories that exist;
+		// writing again tells whether the ones needed do.
+		_ = c.mkdir(s.dir)
+		_ = c.mkdir(path.Dir(p))
+		err = c.writeFile(temp, value)
+	}
+	if err == nil {
+		if err = c.rename(temp, p); err != nil {
+			_ = c.remove(temp)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("sftpStore.Put %q: %w", key, err)
+	}
+	return nil
+}
+
+func (s *sftpStore) Delete(key Key) error {
+	c, err := s.connection()
+	if err != nil {
+		return fmt.Errorf("sftpStore.Delete %q: %w", key, err)
+	}
+	if err := c.remove(s.pathFor(key)); err != nil && !isSFTPStatus(err, sftpNoSuchFile) {
+		return fmt.Errorf("sftpStore.Delete %q: %w", key, err)
+	}
+	return nil
+}
+
+func (s *sftpStore) Contains(key Key) (bool, error) {
+	c, err := s.connection()
+	if err != nil {
+		return false, fmt.Errorf("sftpStore.Contains %q: %w", key, err)
+	}
+	_, _, err = c.stat(s.pathFor(key))
+	if isSFTPStatus(err, sftpNoSuchFile) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("sftpStore.Contains %q: %w", key, err)
+	}
+	return true, nil
+}
+
+func (s *sftpStore) List() ListIterator {
+	return s.ListPrefix("")
+}
+
+// ListPrefix only lists the directory the keys with the prefix are
+// stored in, if the prefix is long enough to name one.
+func (s *sftpStore) ListPrefix(prefix string) ListIterator {
+	return &sliceIterator{load: func() ([]KeyInfo, error) {
+		c, err := s.connection()
+		if err != nil {
+			return nil, fmt.Errorf("sftpStore.ListPrefix %q: %w", prefix, err)
+		}
+		var dirs []string
+		if len(prefix) >= 2 {
+			dirs = []string{prefix[:2]}
+		} else {
+			entries, err := c.readDir(s.dir)
+			if isSFTPStatus(err, sftpNoSuchFile) {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("sftpStore.ListPrefix %q: %w", prefix, err)
+			}
+			for _, e := range entries {
+				if e.isDir && strings.HasPrefix(e.name, prefix) {
+					dirs = append(dirs, e.name)
+				}
+			}
+		}
+		var keys []KeyInfo
+		for _, dir := range dirs {
+			entries, err := c.readDir(path.Join(s.dir, dir))
+			if isSFTPStatus(err, sftpNoSuchFile) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("sftpStore.ListPrefix %q: %w", prefix, err)
+			}
+			for _, e := range entries {
+				if e.isDir || strings.HasSuffix(e.name, tempSuffix) || !strings.HasPrefix(e.name, prefix) {
+					continue
+				}
+				keys = append(keys, KeyInfo{Key: Key(e.name), Size: int64(e.size)})
+			}
+		}
+		return keys, nil
+	}}
+}
@@ -0,0 +1,317 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// sftpTestServer serves the subset of SFTP the store uses from a local
+// directory. It returns at most maxRead bytes per read, to exercise
+// the handling of short reads.
+type sftpTestServer struct {
+	root    string
+	maxRead int
+	handles map[string]interface{}
+	next    int
+}
+
+func (s *sftpTestServer) serve(r io.Reader, w io.Writer, extensions ...string) {
+	typ, _, err := readSFTPPacket(r)
+	if err != nil || typ != sftpInit {
+		return
+	}
+	var e sftpEncoder
+	e.uint32(3)
+	for _, name := range extensions {
+		e.string(name)
+		e.string("1")
+	}
+	if err := writeSFTPPacket(w, sftpVersion, e.b); err != nil {
+		return
+	}
+	for {
+		typ, body, err := readSFTPPacket(r)
+		if err != nil {
+			return
+		}
+		d := &sftpDecoder{b: body}
+		var e sftpEncoder
+		e.uint32(d.uint32())
+		rtyp := s.handle(typ, d, &e)
+		if err := writeSFTPPacket(w, rtyp, e.b); err != nil {
+			return
+		}
+	}
+}
+
+func (s *sftpTestServer) status(e *sftpEncoder, err error) byte {
+	code := uint32(sftpOK)
+	switch {
+	case errors.Is(err, io.EOF):
+		code = sftpEOF
+	case os.IsNotExist(err):
+		code = sftpNoSuchFile
+	case err != nil:
+		code = 4
+	}
+	e.uint32(code)
+	e.string(errString(err))
+	e.string("")
+	return sftpStatus
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func (s *sftpTestServer) attrs(e *sftpEncoder, fi os.FileInfo) {
+	e.uint32(sftpAttrSize | sftpAttrPermissions)
+	e.uint64(uint64(fi.Size()))
+	perm := uint32(fi.Mode().Perm())
+	if fi.IsDir() {
+		perm |= 0040000
+	} else {
+		perm |= 0100000
+	}
+	e.uint32(perm)
+}
+
+func (s *sftpTestServer) newHandle(v interface{}) string {
+	s.next++
+	h := strconv.Itoa(s.next)
+	s.handles[h] = v
+	return h
+}
+
+func (s *sftpTestServer) handle(typ byte, d *sftpDecoder, e *sftpEncoder) byte {
+	local := func(p string) string { return filepath.Join(s.root, p) }
+	switch typ {
+	case sftpOpen:
+		name := d.string()
+		pflags := d.uint32()
+		flags := os.O_RDONLY
+		if pflags&sftpFlagWrite != 0 {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC | os.O_EXCL
+		}
+		f, err := os.OpenFile(local(name), flags, 0644)
+		if err != nil {
+			return s.status(e, err)
+		}
+		e.string(s.newHandle(f))
+		return sftpHandle
+	case sftpClose:
+		h := d.string()
+		if f, ok := s.handles[h].(*os.File); ok {
+			_ = f.Close()
+		}
+		delete(s.handles, h)
+		return s.status(e, nil)
+	case sftpRead:
+		f := s.handles[d.string()].(*os.File)
+		off := d.uint64()
+		n := int(d.uint32())
+		if n > s.maxRead {
+			n = s.maxRead
+		}
+		buf := make([]byte, n)
+		n, err := f.ReadAt(buf, int64(off))
+		if n == 0 {
+			return s.status(e, err)
+		}
+		e.bytes(buf[:n])
+		return sftpData
+	case sftpWrite:
+		f := s.handles[d.string()].(*os.File)
+		off := d.uint64()
+		_, err := f.WriteAt(d.bytes(), int64(off))
+		return s.status(e, err)
+	case sftpFstat:
+		fi, err := s.handles[d.string()].(*os.File).Stat()
+		if err != nil {
+			return s.status(e, err)
+		}
+		s.attrs(e, fi)
+		return sftpAttrs
+	case sftpStat:
+		fi, err := os.Stat(local(d.string()))
+		if err != nil {
+			return s.status(e, err)
+		}
+		s.attrs(e, fi)
+		return sftpAttrs
+	case sftpOpendir:
+		infos, err := ioutil.ReadDir(local(d.string()))
+		if err != nil {
+			return s.status(e, err)
+		}
+		e.string(s.newHandle(infos))
+		return sftpHandle
+	case sftpReaddir:
+		h := d.string()
+		infos := s.handles[h].([]os.FileInfo)
+		if len(infos) == 0 {
+			return s.status(e, io.EOF)
+		}
+		// Two entries at a time, to exercise repeated reads.
+		if len(infos) > 2 {
+			infos, s.handles[h] = infos[:2], infos[2:]
+		} else {
+			s.handles[h] = []os.FileInfo(nil)
+		}
+		e.uint32(uint32(len(infos)))
+		for _, fi := range infos {
+			e.string(fi.Name())
+			e.string(fi.Name())
+			s.attrs(e, fi)
+		}
+		return sftpName
+	case sftpRemove:
+		return s.status(e, os.Remove(local(d.string())))
+	case sftpMkdir:
+		return s.status(e, os.Mkdir(local(d.string()), 0755))
+	case sftpRename:
+		oldpath, newpath := local(d.string()), local(d.string())
+		if _, err := os.Stat(newpath); err == nil {
+			return s.status(e, errors.New("target exists"))
+		}
+		return s.status(e, os.Rename(oldpath, newpath))
+	case sftpExtended:
+		if d.string() != sftpPosixRename {
+			return s.status(e, errors.New("unsupported extension"))
+		}
+		return s.status(e, os.Rename(local(d.string()), local(d.string())))
+	default:
+		return s.status(e, errors.New("unsupported request"))
+	}
+}
+
+// newTestSFTPStore returns a store whose connections are served from
+// the directory, and a function breaking the current connection.
+func newTestSFTPStore(root string, extensions ...string) (*sftpStore, func()) {
+	var breakConn func()
+	s := &sftpStore{
+		dir: "store",
+		dial: func() (*sftpConn, error) {
+			requests, requestsWriter := io.Pipe()
+			responses, responsesWriter := io.Pipe()
+			server := &sftpTestServer{root: root, maxRead: 1000, handles: make(map[string]interface{})}
+			go func() {
+				server.serve(requests, responsesWriter, extensions...)
+				_ = responsesWriter.Close()
+				_ = requests.Close()
+			}()
+			breakConn = func() { _ = responsesWriter.Close() }
+			return newSFTPConn(responses, requestsWriter, requestsWriter.Close)
+		},
+	}
+	return s, func() { breakConn() }
+}
+
+func TestSFTPStore(t *testing.T) {
+	for _, extensions := range [][]string{nil, {sftpPosixRename}} {
+		t.Run("extensions "+strconv.Itoa(len(extensions)), func(t *testing.T) {
+			root := t.TempDir()
+			s, breakConn := newTestSFTPStore(root, extensions...)
+			large := make([]byte, sftpChunkSize*sftpWindow*2+123)
+			rand.Read(large)
+			values := map[Key]Value{
+				"0123":        []byte("small"),
+				"0199":        large,
+				"1234":        []byte{},
+				"remote.base": []byte("pointer"),
+			}
+			for k, v := range values {
+				if err := s.Put(k, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Overwriting replaces the value.
+			values["remote.base"] = []byte("new pointer")
+			if err := s.Put("remote.base", values["remote.base"]); err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range values {
+				got, err := s.Get(k)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, v) {
+					t.Errorf("%q: got %d bytes, want %d", k, len(got), len(v))
+				}
+			}
+			if _, err := s.Get("0000"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v, want %v", err, ErrNotFound)
+			}
+			if ok, err := s.Contains("0123"); !ok || err != nil {
+				t.Errorf("got %v, %v, want true, nil", ok, err)
+			}
+			if ok, err := s.Contains("0000"); ok || err != nil {
+				t.Errorf("got %v, %v, want false, nil", ok, err)
+			}
+
+			list := func(prefix string) (keys []Key) {
+				it := s.ListPrefix(prefix)
+				for {
+					page, err := it.Next(context.Background())
+					if errors.Is(err, io.EOF) {
+						return keys
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, ki := range page {
+						if ki.Size != int64(len(values[ki.Key])) {
+							t.Errorf("%q: got size %d, want %d", ki.Key, ki.Size, len(values[ki.Key]))
+						}
+						keys = append(keys, ki.Key)
+					}
+				}
+			}
+			if diff := cmp.Diff([]Key{"0123", "0199", "1234", "remote.base"}, list("")); diff != "" {
+				t.Errorf("list all (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff([]Key{"0123"}, list("012")); diff != "" {
+				t.Errorf("list prefix (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff([]Key(nil), list("99")); diff != "" {
+				t.Errorf("list missing dir (-want +got):\n%s", diff)
+			}
+
+			if err := s.Delete("0123"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("0123"); err != nil {
+				t.Errorf("deleting a missing key: %v", err)
+			}
+			if ok, err := s.Contains("0123"); ok || err != nil {
+				t.Errorf("got %v, %v, want false, nil", ok, err)
+			}
+
+			// A broken connection fails the request in flight, if any,
+			// and is replaced for the next one.
+			breakConn()
+			for i := 0; i < 2; i++ {
+				_, err := s.Get("1234")
+				if err == nil {
+					break
+				}
+				if i == 1 {
+					t.Errorf("not reconnected: %v", err)
+				}
+			}
+		})
+	}
+}
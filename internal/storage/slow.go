@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/nicolagi/muscle/internal/debug"
+)
+
+// slowLogger logs the calls to the wrapped store that take longer
+// than a threshold, naming the store, so that stalls can be attributed
+// to the right backend.
+type slowLogger struct {
+	store     Store
+	name      string
+	threshold time.Duration
+}
+
+// LogSlow wraps the store so that calls taking at least the threshold
+// are logged along with the given store name, e.g., "cache" or "s3".
+// A non-positive threshold returns the store unchanged. The returned
+// store only implements the Store interface.
+func LogSlow(store Store, name string, threshold time.Duration) Store {
+	if threshold <= 0 {
+		return store
+	}
+	return &slowLogger{store: store, name: name, threshold: threshold}
+}
+
+func (s *slowLogger) done(op string, k Key, start time.Time) {
+	if d := time.Since(start); d >= s.threshold {
+		debug.Logf(debug.Info, "Slow %s store: %s %s took %v", s.name, op, k, d)
+	}
+}
+
+func (s *slowLogger) Get(k Key) (Value, error) {
+	defer s.done("get", k, time.Now())
+	return s.store.Get(k)
+}
+
+func (s *slowLogger) Put(k Key, v Value) error {
+	defer s.done("put", k, time.Now())
+	return s.store.Put(k, v)
+}
+
+func (s *slowLogger) Delete(k Key) error {
+	defer s.done("delete", k, time.Now())
+	return s.store.Delete(k)
+}
+
+func (s *slowLogger) Contains(k Key) (bool, error) {
+	defer s.done("contains", k, time.Now())
+	return s.store.Contains(k)
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogSlow(t *testing.T) {
+	inner := &InMemory{}
+	if got := LogSlow(inner, "memory", 0); got != Store(inner) {
+		t.Errorf("got %v, want the store unchanged", got)
+	}
+
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+	slow := storeFuncs{get: func(Key) (Value, error) {
+		time.Sleep(5 * time.Millisecond)
+		return nil, ErrNotFound
+	}}
+	s := LogSlow(slow, "remote", time.Millisecond)
+	if _, err := s.Get("k1"); err != ErrNotFound {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+	if err := s.Put("k2", nil); err != nil {
+		t.Error(err)
+	}
+	if got := buf.String(); !strings.Contains(got, "Slow remote store: get k1 took ") {
+		t.Errorf("got %q, want slow get logged", got)
+	} else if strings.Contains(got, "k2") {
+		t.Errorf("got %q, want fast put not logged", got)
+	}
+}
+
+func TestNamed(t *testing.T) {
+	s := Named(&InMemory{}, "cache")
+	if err := s.Put("k1", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.Get("k2")
+	var serr *Error
+	if !errors.As(err, &serr) || !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want an *Error wrapping %v", err, ErrNotFound)
+	}
+	if serr.Op != "get" || serr.Key != "k2" || serr.Backend != "cache" {
+		t.Errorf("got %+v", serr)
+	}
+	if got, want := err.Error(), "cache store: get k2: not found"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 
@@ -8,6 +9,7 @@ import (
 )
 
 var (
+	ErrConflict       = errors.New("conflict")
 	ErrNotFound       = errors.New("not found")
 	ErrNotImplemented = errors.New("not implemented")
 )
@@ -20,19 +22,57 @@ type Store interface {
 	Get(Key) (Value, error)
 	Put(Key, Value) error
 	Delete(Key) error
+
+	// Contains reports whether the store has a value for the key,
+	// without retrieving the value.
+	Contains(Key) (bool, error)
 }
 
+// Swapper is implemented by stores that support conditional updates.
+// It is meant for mutable keys, e.g., remote tags, that several hosts
+// might update concurrently.
+type Swapper interface {
+	// CompareAndSwap sets the value for the key to new, provided the
+	// current value is old. A nil old value means that the key must
+	// not exist. If the condition does not hold, the error wraps
+	// ErrConflict.
+	CompareAndSwap(k Key, old, new Value) error
+}
+
+// matches tells whether the current value, found or not, is the
+// expected value for CompareAndSwap.
+func matches(current Value, found bool, expected Value) bool {
+	if expected == nil {
+		return !found
+	}
+	return found && bytes.Equal(current, expected)
+}
+
+// A Lister lists the keys in a store along with the sizes of their
+// values, without reading the values, e.g., to account for what's
+// stored or to find what can be deleted.
 type Lister interface {
-	// TODO: This interface is strange; how can the error be known right away, but the
-	// keys are progressively written to the channel? Isn't it possible to encounter an error
-	// after List() returns, e.g., paginating results sets?
-	List() (keys chan string, err error)
+	List() ListIterator
+}
+
+// A PrefixLister lists only the keys starting with the given prefix,
+// e.g., the remote tags among all the blocks, without listing the
+// whole store.
+type PrefixLister interface {
+	ListPrefix(prefix string) ListIterator
+}
+
+// A BatchDeleter deletes many keys per request, e.g., to make
+// deleting hundreds of thousands of keys practical. The returned map
+// has the keys that could not be deleted, and why; the error is for
+// failures affecting the whole batch.
+type BatchDeleter interface {
+	DeleteBatch(keys []Key) (failed map[Key]error, err error)
 }
 
 type Enumerable interface {
+	// TODO: Can we prevent embedding the Store?
 	Store
-	// TODO: "Contains" does not pertain to an Enumerable entity. Also, can we prevent embedding the Store?
-	Contains(Key) (bool, error)
 	ForEach(func(Key) error) error
 }
 
@@ -40,11 +80,32 @@ func NewStore(c *config.C) (Store, error) {
 	switch c.Storage {
 	case "disk":
 		return NewDiskStore(c.DiskStoreDir), nil
+	case "memory":
+		return new(InMemory), nil
 	case "null":
 		return NullStore{}, nil
+	case "b2":
+		return newB2Store(c)
 	case "s3":
 		return newS3Store(c)
+	case "sftp":
+		return newSFTPStore(c)
+	case "webdav":
+		return newWebDAVStore(c)
 	default:
 		return nil, fmt.Errorf("%q: %w", c.Storage, ErrNotImplemented)
 	}
 }
+
+// NewReplicaStore returns the store reading from the replica of the
+// remote store, see config.Replica.
+func NewReplicaStore(c *config.C, r config.Replica) (Store, error) {
+	switch r.Kind {
+	case "disk":
+		return ReadOnly(NewDiskStore(r.Location)), nil
+	case "mirror":
+		return NewHTTPMirror(r.Location, c.MirrorToken), nil
+	default:
+		return nil, fmt.Errorf("%q: %w", r.Kind, ErrNotImplemented)
+	}
+}
@@ -24,9 +24,10 @@ import (
 // Its behavior is fully configurable by setting get, put, delete functions.
 // Intended for unit tests in this package.
 type storeFuncs struct {
-	get    func(Key) (Value, error)
-	put    func(Key, Value) error
-	delete func(Key) error
+	get      func(Key) (Value, error)
+	put      func(Key, Value) error
+	delete   func(Key) error
+	contains func(Key) (bool, error)
 }
 
 func (s storeFuncs) Get(key Key) (Value, error) {
@@ -49,6 +50,13 @@ func (s storeFuncs) Delete(key Key) error {
 	return nil
 }
 
+func (s storeFuncs) Contains(key Key) (bool, error) {
+	if s.contains != nil {
+		return s.contains(key)
+	}
+	return false, nil
+}
+
 // Generate implements quick.Generator.
 // Intended for unit tests in this package.
 func (Key) Generate(rand *rand.Rand, size int) reflect.Value {
@@ -110,6 +118,12 @@ func TestStoreImplementations(t *testing.T) {
 		name  string
 		setup func(*testing.T) (impl Store, teardown func())
 	}{
+		{
+			"in-memory",
+			func(t *testing.T) (impl Store, teardown func()) {
+				return new(InMemory), nil
+			},
+		},
 		{
 			"disk",
 			func(t *testing.T) (impl Store, teardown func()) {
@@ -117,6 +131,18 @@ func TestStoreImplementations(t *testing.T) {
 				return
 			},
 		},
+		{
+			"overlay",
+			func(t *testing.T) (impl Store, teardown func()) {
+				return Overlay(new(InMemory), ReadOnly(new(InMemory))), nil
+			},
+		},
+		{
+			"tiered",
+			func(t *testing.T) (impl Store, teardown func()) {
+				return NewTiered(Tier{Store: new(InMemory), Capacity: 1 << 20}, Tier{Store: new(InMemory)}), nil
+			},
+		},
 		{
 			"s3",
 			func(t *testing.T) (impl Store, teardown func()) {
@@ -220,6 +246,59 @@ func testStore(t *testing.T, impl Store) {
 			t.Error(err)
 		}
 	})
+	t.Run("contains reflects put and delete", func(t *testing.T) {
+		f := func(key Key, value Value) bool {
+			if err := impl.Put(key, value); err != nil {
+				t.Fatal(err)
+			}
+			before, err := impl.Contains(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := impl.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			after, err := impl.Contains(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return before && !after
+		}
+		if err := quick.Check(f, &quick.Config{MaxCount: 10}); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("compare and swap", func(t *testing.T) {
+		swapper, ok := impl.(Swapper)
+		if !ok {
+			t.Skip()
+		}
+		f := func(key Key, v1, v2 Value) bool {
+			if err := impl.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			if err := swapper.CompareAndSwap(key, v1, v2); !errors.Is(err, ErrConflict) {
+				t.Errorf("got %v, want conflict for missing key", err)
+			}
+			if err := swapper.CompareAndSwap(key, nil, v1); err != nil {
+				t.Fatal(err)
+			}
+			if err := swapper.CompareAndSwap(key, nil, v2); !errors.Is(err, ErrConflict) {
+				t.Errorf("got %v, want conflict for existing key", err)
+			}
+			if err := swapper.CompareAndSwap(key, v1, v2); err != nil {
+				t.Fatal(err)
+			}
+			v, err := impl.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return bytes.Equal(v, v2)
+		}
+		if err := quick.Check(f, &quick.Config{MaxCount: 10}); err != nil {
+			t.Error(err)
+		}
+	})
 	t.Run("delete inexistent key is successful", func(t *testing.T) {
 		f := func(key Key) bool {
 			err := impl.Delete(key)
@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Promotion is a policy for copying values read from a lower tier of
+// a Tiered store into a higher one.
+type Promotion int
+
+const (
+	// PromoteAlways copies every value read from below.
+	PromoteAlways Promotion = iota
+
+	// PromoteSecondRead copies a value the second time it is read
+	// from below, while the first miss is remembered, so that values
+	// read once, e.g., while scanning a large file, don't evict those
+	// read repeatedly.
+	PromoteSecondRead
+
+	// PromoteNever never copies values, e.g., into a read-only tier
+	// such as a LAN mirror.
+	PromoteNever
+)
+
+// ParsePromotion parses "always", "second-read", or "never".
+func ParsePromotion(s string) (Promotion, error) {
+	switch s {
+	case "always":
+		return PromoteAlways, nil
+	case "second-read":
+		return PromoteSecondRead, nil
+	case "never":
+		return PromoteNever, nil
+	default:
+		return 0, fmt.Errorf("storage.ParsePromotion: unknown promotion policy %q", s)
+	}
+}
+
+// How many misses a tier with the PromoteSecondRead policy remembers.
+const tierMissesRemembered = 1 << 12
+
+// Tier is a level of a Tiered store.
+type Tier struct {
+	Store Store
+
+	// Values promoted into the tier, or put into it, are evicted,
+	// least recently used first, once they exceed this many bytes.
+	// Only values written by the Tiered store are accounted for.
+	// Zero means no limit. It does not apply to the last tier.
+	Capacity int64
+
+	Promotion Promotion
+}
+
+type tierEntry struct {
+	key  Key
+	size int64
+}
+
+// tierState is the bookkeeping for a tier's capacity and promotion
+// policy.
+type tierState struct {
+	Tier
+
+	used    int64
+	lru     *list.List // Of tierEntry, most recently used first.
+	entries map[Key]*list.Element
+
+	misses     map[Key]struct{}
+	missesFIFO []Key
+}
+
+// Tiered is a store made of a chain of stores, fastest first, e.g., an
+// in-memory store above a disk cache, or a LAN mirror above a cloud
+// store. Reads go down the chain until a tier has the value, which is
+// then promoted into the tiers above according to their policies.
+// Writes go to the last tier, which holds all values, and to the tiers
+// above that promote always.
+type Tiered struct {
+	mu    sync.Mutex
+	tiers []*tierState
+}
+
+var _ Store = (*Tiered)(nil)
+
+// NewTiered returns a store made of the tiers, fastest first.
+func NewTiered(tiers ...Tier) *Tiered {
+	t := new(Tiered)
+	for _, tier := range tiers {
+		t.tiers = append(t.tiers, &tierState{
+			Tier:    tier,
+			lru:     list.New(),
+			entries: make(map[Key]*list.Element),
+			misses:  make(map[Key]struct{}),
+		})
+	}
+	return t
+}
+
+func (t *Tiered) last() *tierState {
+	return t.tiers[len(t.tiers)-1]
+}
+
+// Get reads from each tier in turn. Failures other than ErrNotFound
+// are logged, and the value is looked for further down.
+func (t *Tiered) Get(k Key) (Value, error) {
+	var err error
+	for i, tier := range t.tiers {
+		var v Value
+		v, err = tier.Store.Get(k)
+		if err == nil {
+			t.touch(tier, k)
+			t.promote(t.tiers[:i], k, v)
+			return v, nil
+		}
+		if !errors.Is(err, ErrNotFound) && tier != t.last() {
+			log.Printf("storage.Tiered.Get: tier %d: %v", i, err)
+		}
+	}
+	return nil, err
+}
+
+// promote copies the value into the tiers, as their policies dictate.
+func (t *Tiered) promote(tiers []*tierState, k Key, v Value) {
+	for _, tier := range tiers {
+		switch tier.Promotion {
+		case PromoteNever:
+			continue
+		case PromoteSecondRead:
+			if !t.missed(tier, k) {
+				continue
+			}
+		}
+		if err := tier.Store.Put(k, v); err != nil {
+			log.Printf("storage.Tiered: could not promote %q: %v", k, err)
+			continue
+		}
+		t.account(tier, k, int64(len(v)))
+	}
+}
+
+// missed reports whether the key missed the tier before, and
+// remembers it did now otherwise.
+func (t *Tiered) missed(tier *tierState, k Key) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := tier.misses[k]; ok {
+		delete(tier.misses, k)
+		return true
+	}
+	if len(tier.missesFIFO) >= tierMissesRemembered {
+		delete(tier.misses, tier.missesFIFO[0])
+		tier.missesFIFO = tier.missesFIFO[1:]
+	}
+	tier.misses[k] = struct{}{}
+	tier.missesFIFO = append(tier.missesFIFO, k)
+	return false
+}
+
+// touch marks the key as recently used in the tier.
+func (t *Tiered) touch(tier *tierState, k Key) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := tier.entries[k]; ok {
+		tier.lru.MoveToFront(e)
+	}
+}
+
+// account records a value written to the tier, and evicts the least
+// recently used values if over capacity.
+func (t *Tiered) account(tier *tierState, k Key, size int64) {
+	if tier.Capacity <= 0 || tier == t.last() {
+		return
+	}
+	t.mu.Lock()
+	if e, ok := tier.entries[k]; ok {
+		tier.used -= e.Value.(tierEntry).size
+		tier.lru.Remove(e)
+	}
+	tier.entries[k] = tier.lru.PushFront(tierEntry{key: k, size: size})
+	tier.used += size
+	var evicted []Key
+	for tier.used > tier.Capacity && tier.lru.Len() > 1 {
+		e := tier.lru.Back()
+		entry := tier.lru.Remove(e).(tierEntry)
+		delete(tier.entries, entry.key)
+		tier.used -= entry.size
+		evicted = append(evicted, entry.key)
+	}
+	t.mu.Unlock()
+	for _, k := range evicted {
+		if err := tier.Store.Delete(k); err != nil {
+			log.Printf("storage.Tiered: could not evict %q: %v", k, err)
+		}
+	}
+}
+
+func (t *Tiered) forget(tier *tierState, k Key) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := tier.entries[k]; ok {
+		tier.used -= e.Value.(tierEntry).size
+		tier.lru.Remove(e)
+		delete(tier.entries, k)
+	}
+}
+
+// Put writes to the last tier, then to the tiers above that promote
+// always, on a best effort basis.
+func (t *Tiered) Put(k Key, v Value) error {
+	if err := t.last().Store.Put(k, v); err != nil {
+		return err
+	}
+	for _, tier := range t.tiers[:len(t.tiers)-1] {
+		if tier.Promotion != PromoteAlways {
+			continue
+		}
+		if err := tier.Store.Put(k, v); err != nil {
+			log.Printf("storage.Tiered.Put: %v", err)
+			continue
+		}
+		t.account(tier, k, int64(len(v)))
+	}
+	return nil
+}
+
+// Delete deletes from the last tier, then from the others, except
+// those that are read-only.
+func (t *Tiered) Delete(k Key) error {
+	if err := t.last().Store.Delete(k); err != nil {
+		return err
+	}
+	for _, tier := range t.tiers[:len(t.tiers)-1] {
+		t.forget(tier, k)
+		if err := tier.Store.Delete(k); err != nil && !errors.Is(err, ErrReadOnly) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Contains checks the last tier, which holds all values.
+func (t *Tiered) Contains(k Key) (bool, error) {
+	return t.last().Store.Contains(k)
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTiered(t *testing.T) {
+	has := func(t *testing.T, s Store, k Key) bool {
+		t.Helper()
+		ok, err := s.Contains(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	t.Run("promotion policies", func(t *testing.T) {
+		always, secondRead, never, bottom := new(InMemory), new(InMemory), new(InMemory), new(InMemory)
+		s := NewTiered(
+			Tier{Store: always},
+			Tier{Store: secondRead, Promotion: PromoteSecondRead},
+			Tier{Store: ReadOnly(never), Promotion: PromoteNever},
+			Tier{Store: bottom},
+		)
+		if err := bottom.Put("k", Value("v")); err != nil {
+			t.Fatal(err)
+		}
+		if err := never.Put("n", Value("from never")); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := s.Get("n"); err != nil || string(v) != "from never" {
+			t.Errorf("got %q, %v, want the value from the read-only tier", v, err)
+		}
+		if v, err := s.Get("k"); err != nil || string(v) != "v" {
+			t.Fatalf("got %q, %v, want %q", v, err, "v")
+		}
+		if !has(t, always, "k") {
+			t.Error("got the key not promoted, want it promoted always")
+		}
+		if has(t, secondRead, "k") {
+			t.Error("got the key promoted on the first read")
+		}
+		if err := always.Delete("k"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get("k"); err != nil {
+			t.Fatal(err)
+		}
+		if !has(t, secondRead, "k") {
+			t.Error("got the key not promoted, want it promoted on the second read")
+		}
+	})
+
+	t.Run("capacity", func(t *testing.T) {
+		top, bottom := new(InMemory), new(InMemory)
+		s := NewTiered(Tier{Store: top, Capacity: 10}, Tier{Store: bottom})
+		for _, k := range []Key{"a", "b", "c"} {
+			if err := s.Put(k, Value("12345")); err != nil {
+				t.Fatal(err)
+			}
+			if k == "b" {
+				// Now "a" is the most recently used.
+				if _, err := s.Get("a"); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if !has(t, top, "a") || has(t, top, "b") || !has(t, top, "c") {
+			t.Error("want b, the least recently used, evicted from the top tier")
+		}
+		for _, k := range []Key{"a", "b", "c"} {
+			if !has(t, s, k) {
+				t.Errorf("%v: got false, want it in the last tier", k)
+			}
+		}
+	})
+
+	t.Run("delete skips read-only tiers", func(t *testing.T) {
+		mirror, bottom := new(InMemory), new(InMemory)
+		for _, store := range []Store{mirror, bottom} {
+			if err := store.Put("k", Value("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s := NewTiered(Tier{Store: ReadOnly(mirror), Promotion: PromoteNever}, Tier{Store: bottom})
+		if err := s.Delete("k"); err != nil {
+			t.Fatal(err)
+		}
+		if has(t, s, "k") {
+			t.Error("got true, want the key deleted from the last tier")
+		}
+		if err := s.Put("k", Value("v")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put("x", nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mirror.Get("x"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, want nothing put to a tier that never promotes", err)
+		}
+	})
+}
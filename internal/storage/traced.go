@@ -0,0 +1,63 @@
+package storage
+
+import "github.com/nicolagi/muscle/internal/otlp"
+
+// traced creates a span for each call to the wrapped store.
+type traced struct {
+	store   Store
+	name    string
+	tracer  *otlp.Tracer
+	current *otlp.Current
+}
+
+// Traced wraps the store so that each call creates a span named after
+// the store and the operation, e.g., "storage.s3.get", child of the
+// current span. A nil tracer returns the store unchanged. The returned
+// store only implements the Store interface.
+func Traced(store Store, name string, tracer *otlp.Tracer, current *otlp.Current) Store {
+	if tracer == nil {
+		return store
+	}
+	return &traced{store: store, name: name, tracer: tracer, current: current}
+}
+
+func (s *traced) start(op string, k Key) *otlp.Span {
+	span := s.tracer.Start("storage."+s.name+"."+op, s.current.Get())
+	span.SetAttribute("key", string(k))
+	return span
+}
+
+func (s *traced) Get(k Key) (Value, error) {
+	span := s.start("get", k)
+	v, err := s.store.Get(k)
+	span.SetAttribute("bytes", len(v))
+	span.SetError(err)
+	span.End()
+	return v, err
+}
+
+func (s *traced) Put(k Key, v Value) error {
+	span := s.start("put", k)
+	span.SetAttribute("bytes", len(v))
+	err := s.store.Put(k, v)
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+func (s *traced) Delete(k Key) error {
+	span := s.start("delete", k)
+	err := s.store.Delete(k)
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+func (s *traced) Contains(k Key) (bool, error) {
+	span := s.start("contains", k)
+	ok, err := s.store.Contains(k)
+	span.SetAttribute("found", ok)
+	span.SetError(err)
+	span.End()
+	return ok, err
+}
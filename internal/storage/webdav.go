@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/nicolagi/muscle/internal/config"
+)
+
+// webdavStore keeps items on an HTTP server accepting GET, PUT, HEAD
+// and DELETE, e.g., nginx with the dav module, or "rclone serve
+// webdav". Items are laid out as in a disk store, so that one can be
+// copied to the other. Listing needs WebDAV, see ListPrefix, and so
+// does creating the directories, unless the server creates them on
+// PUT, e.g., nginx with create_full_put_path.
+//
+// Values are written with a single PUT, so a value is only ever seen
+// whole if the server, like nginx and rclone, writes the body to a
+// temporary file and renames it.
+type webdavStore struct {
+	base     *url.URL // The directory, with a trailing slash.
+	user     string
+	password string
+	client   *http.Client
+}
+
+var _ Store = (*webdavStore)(nil)
+
+func newWebDAVStore(c *config.C) (Store, error) {
+	if c.WebDAVURL == "" {
+		return nil, errorf("newWebDAVStore", "webdav-url not configured")
+	}
+	base, err := url.Parse(c.WebDAVURL)
+	if err != nil {
+		return nil, errorf("newWebDAVStore", "webdav-url: %v", err)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	return &webdavStore{
+		base:     base,
+		user:     c.WebDAVUser,
+		password: c.WebDAVPassword,
+		client:   http.DefaultClient,
+	}, nil
+}
+
+// urlFor returns the URL of the file at the given path, relative to
+// the base directory, e.g., "01/0123..." or "01/".
+func (s *webdavStore) urlFor(p string) string {
+	u := *s.base
+	u.Path += p
+	u.RawPath = ""
+	return u.String()
+}
+
+func (s *webdavStore) keyURL(key Key) string {
+	k := string(key)
+	return s.urlFor(k[:2] + "/" + k)
+}
+
+func (s *webdavStore) do(method, url string, body []byte, header http.Header) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if s.user != "" || s.password != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	response, err := ioutil.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, response, nil
+}
+
+// webdavResponseError describes an unsuccessful response, with the
+// error class telling whether to retry, see retry.go.
+func webdavResponseError(res *http.Response) error {
+	detail := fmt.Sprintf("%d status code", res.StatusCode)
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%s: %w", detail, ErrThrottled)
+	case res.StatusCode >= 500:
+		return fmt.Errorf("%s: %w", detail, ErrUnavailable)
+	case res.StatusCode == http.StatusUnauthorized, res.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("%s: %w", detail, ErrDenied)
+	default:
+		return fmt.Errorf("%s", detail)
+	}
+}
+
+func (s *webdavStore) Get(key Key) (Value, error) {
+	res, body, err := s.do("GET", s.keyURL(key), nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("webdavStore.Get %q: %w", key, err)
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("webdavStore.Get %q: %w", key, ErrNotFound)
+	default:
+		return nil, fmt.Errorf("webdavStore.Get %q: %w", key, webdavResponseError(res))
+	}
+}
+
+// Put creates the directories on the server if the PUT fails because
+// they are missing, which servers report with a 409 or a 404.
+func (s *webdavStore) Put(key Key, value Value) error {
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	res, _, err := s.do("PUT", s.keyURL(key), value, header)
+	if err == nil && (res.StatusCode == http.StatusConflict || res.StatusCode == http.StatusNotFound) {
+		for _, dir := range []string{"", string(key)[:2] + "/"} {
+			if err = s.mkcol(dir); err != nil {
+				return fmt.Errorf("webdavStore.Put %q: %w", key, err)
+			}
+		}
+		res, _, err = s.do("PUT", s.keyURL(key), value, header)
+	}
+	if err != nil {
+		return fmt.Errorf("webdavStore.Put %q: %w", key, err)
+	}
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("webdavStore.Put %q: %w", key, webdavResponseError(res))
+	}
+	return nil
+}
+
+// mkcol creates the directory, unless it exists already, in which
+// case the server answers 405 Method Not Allowed.
+func (s *webdavStore) mkcol(dir string) error {
+	res, _, err := s.do("MKCOL", s.urlFor(dir), nil, nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode/100 != 2 && res.StatusCode != http.StatusMethodNotAllowed {
+		return fmt.Errorf("MKCOL %q: %w", dir, webdavResponseError(res))
+	}
+	return nil
+}
+
+func (s *webdavStore) Delete(key Key) error {
+	res, _, err := s.do("DELETE", s.keyURL(key), nil, nil)
+	if err != nil {
+		return fmt.Errorf("webdavStore.Delete %q: %w", key, err)
+	}
+	if res.StatusCode/100 != 2 && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("webdavStore.Delete %q: %w", key, webdavResponseError(res))
+	}
+	return nil
+}
+
+// Contains issues a HEAD request, so the value is not downloaded.
+func (s *webdavStore) Contains(key Key) (bool, error) {
+	res, _, err := s.do("HEAD", s.keyURL(key), nil, nil)
+	if err != nil {
+		return false, fmt.Errorf("webdavStore.Contains %q: %w", key, err)
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("webdavStore.Contains %q: %w", key, webdavResponseError(res))
+	}
+}
+
+const webdavPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/></prop></propfind>`
+
+// webdavEntry is a file or directory in a directory listing.
+type webdavEntry struct {
+	name  string
+	isDir bool
+	size  int64
+}
+
+// readDir lists the directory with a PROPFIND request, returning
+// ErrNotFound if it doesn't exist.
+func (s *webdavStore) readDir(dir string) ([]webdavEntry, error) {
+	header := http.Header{
+		"Depth":        {"1"},
+		"Content-Type": {`application/xml; charset="utf-8"`},
+	}
+	res, body, err := s.do("PROPFIND", s.urlFor(dir), []byte(webdavPropfind), header)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusMultiStatus:
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, fmt.Errorf("PROPFIND: %w", ErrNotImplemented)
+	default:
+		return nil, fmt.Errorf("PROPFIND %q: %w", dir, webdavResponseError(res))
+	}
+	var ms struct {
+		Responses []struct {
+			Href     string `xml:"DAV: href"`
+			Propstat []struct {
+				Prop struct {
+					ResourceType struct {
+						Collection *struct{} `xml:"DAV: collection"`
+					} `xml:"DAV: resourcetype"`
+					ContentLength int64 `xml:"DAV: getcontentlength"`
+				} `xml:"DAV: prop"`
+				Status string `xml:"DAV: status"`
+			} `xml:"DAV: propstat"`
+		} `xml:"DAV: response"`
+	}
+	if err := xml.Unmarshal(body, &ms); err != nil {
+		return nil, fmt.Errorf("PROPFIND %q: %w", dir, err)
+	}
+	self := path.Clean(s.base.Path + dir)
+	var entries []webdavEntry
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("PROPFIND %q: %w", dir, err)
+		}
+		p := path.Clean(href.Path)
+		if p == self {
+			continue
+		}
+		e := webdavEntry{name: path.Base(p)}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			e.isDir = e.isDir || ps.Prop.ResourceType.Collection != nil
+			if ps.Prop.ContentLength != 0 {
+				e.size = ps.Prop.ContentLength
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (s *webdavStore) List() ListIterator {
+	return s.ListPrefix("")
+}
+
+// ListPrefix only lists the directory the keys with the prefix are
+// stored in, if the prefix is long enough to name one. Listing fails
+// with ErrNotImplemented if the server doesn't speak WebDAV.
+func (s *webdavStore) ListPrefix(prefix string) ListIterator {
+	return &sliceIterator{load: func() ([]KeyInfo, error) {
+		var dirs []string
+		if len(prefix) >= 2 {
+			dirs = []string{prefix[:2]}
+		} else {
+			entries, err := s.readDir("")
+			if errors.Is(err, ErrNotFound) {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("webdavStore.ListPrefix %q: %w", prefix, err)
+			}
+			for _, e := range entries {
+				if e.isDir && strings.HasPrefix(e.name, prefix) {
+					dirs = append(dirs, e.name)
+				}
+			}
+		}
+		var keys []KeyInfo
+		for _, dir := range dirs {
+			entries, err := s.readDir(dir + "/")
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("webdavStore.ListPrefix %q: %w", prefix, err)
+			}
+			for _, e := range entries {
+				if e.isDir || !strings.HasPrefix(e.name, prefix) {
+					continue
+				}
+				keys = append(keys, KeyInfo{Key: Key(e.name), Size: e.size})
+			}
+		}
+		return keys, nil
+	}}
+}
@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nicolagi/muscle/internal/config"
+)
+
+// webdavTestServer serves the directory under /dav/, with the subset
+// of WebDAV the store uses, or only plain HTTP, creating directories
+// on PUT like nginx with create_full_put_path.
+type webdavTestServer struct {
+	root  string
+	plain bool
+}
+
+func (s *webdavTestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, password, _ := r.BasicAuth(); user != "user" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/dav/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	local := filepath.Join(s.root, filepath.FromSlash(strings.TrimPrefix(r.URL.Path, "/dav/")))
+	status := func(err error) int {
+		switch {
+		case err == nil:
+			return http.StatusCreated
+		case os.IsNotExist(err):
+			return http.StatusConflict
+		case os.IsExist(err):
+			return http.StatusMethodNotAllowed
+		default:
+			return http.StatusInternalServerError
+		}
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		b, err := ioutil.ReadFile(local)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "GET" {
+			_, _ = w.Write(b)
+		}
+	case "PUT":
+		if s.plain {
+			_ = os.MkdirAll(filepath.Dir(local), 0755)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(status(ioutil.WriteFile(local, b, 0644)))
+	case "DELETE":
+		if err := os.Remove(local); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case "MKCOL":
+		if s.plain {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(status(os.Mkdir(local, 0755)))
+	case "PROPFIND":
+		if s.plain || r.Header.Get("Depth") != "1" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		infos, err := ioutil.ReadDir(local)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var b bytes.Buffer
+		b.WriteString(`<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:">`)
+		entry := func(href string, fi os.FileInfo) {
+			fmt.Fprintf(&b, `<D:response><D:href>%s</D:href><D:propstat><D:prop>`, href)
+			if fi.IsDir() {
+				b.WriteString(`<D:resourcetype><D:collection/></D:resourcetype>`)
+			} else {
+				fmt.Fprintf(&b, `<D:resourcetype/><D:getcontentlength>%d</D:getcontentlength>`, fi.Size())
+			}
+			b.WriteString(`</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>`)
+		}
+		self, _ := os.Stat(local)
+		entry(r.URL.Path, self)
+		for _, fi := range infos {
+			href := strings.TrimSuffix(r.URL.Path, "/") + "/" + fi.Name()
+			if fi.IsDir() {
+				href += "/"
+			}
+			entry(href, fi)
+		}
+		b.WriteString(`</D:multistatus>`)
+		w.WriteHeader(http.StatusMultiStatus)
+		_, _ = w.Write(b.Bytes())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestWebDAVStore(t *testing.T) {
+	for _, plain := range []bool{false, true} {
+		t.Run(fmt.Sprintf("plain %t", plain), func(t *testing.T) {
+			root := t.TempDir()
+			server := httptest.NewServer(&webdavTestServer{root: root, plain: plain})
+			defer server.Close()
+			if !plain {
+				// The store creates the directory of the items.
+				if err := os.Mkdir(filepath.Join(root, "muscle"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c := &config.C{WebDAVURL: server.URL + "/dav/muscle/store", WebDAVUser: "user", WebDAVPassword: "secret"}
+			store, err := newWebDAVStore(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := store.(*webdavStore)
+			values := map[Key]Value{
+				"0123":        []byte("small"),
+				"0199":        []byte("other"),
+				"1234":        []byte{},
+				"remote.base": []byte("pointer"),
+			}
+			for k, v := range values {
+				if err := s.Put(k, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			values["remote.base"] = []byte("new pointer")
+			if err := s.Put("remote.base", values["remote.base"]); err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range values {
+				got, err := s.Get(k)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, v) {
+					t.Errorf("%q: got %q, want %q", k, got, v)
+				}
+			}
+			// Laid out as in a disk store.
+			if _, err := os.Stat(filepath.Join(root, "muscle", "store", "01", "0123")); err != nil {
+				t.Error(err)
+			}
+			if _, err := s.Get("0000"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("got %v, want %v", err, ErrNotFound)
+			}
+			if ok, err := s.Contains("0123"); !ok || err != nil {
+				t.Errorf("got %v, %v, want true, nil", ok, err)
+			}
+			if ok, err := s.Contains("0000"); ok || err != nil {
+				t.Errorf("got %v, %v, want false, nil", ok, err)
+			}
+
+			list := func(prefix string) (keys []Key, err error) {
+				it := s.ListPrefix(prefix)
+				for {
+					page, err := it.Next(context.Background())
+					if errors.Is(err, io.EOF) {
+						return keys, nil
+					}
+					if err != nil {
+						return nil, err
+					}
+					for _, ki := range page {
+						if ki.Size != int64(len(values[ki.Key])) {
+							t.Errorf("%q: got size %d, want %d", ki.Key, ki.Size, len(values[ki.Key]))
+						}
+						keys = append(keys, ki.Key)
+					}
+				}
+			}
+			if plain {
+				if _, err := list(""); !errors.Is(err, ErrNotImplemented) {
+					t.Errorf("got %v, want %v", err, ErrNotImplemented)
+				}
+			} else {
+				for _, c := range []struct {
+					prefix string
+					want   []Key
+				}{
+					{"", []Key{"0123", "0199", "1234", "remote.base"}},
+					{"012", []Key{"0123"}},
+					{"99", nil},
+				} {
+					got, err := list(c.prefix)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if diff := cmp.Diff(c.want, got); diff != "" {
+						t.Errorf("list %q (-want +got):\n%s", c.prefix, diff)
+					}
+				}
+			}
+
+			if err := s.Delete("0123"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("0123"); err != nil {
+				t.Errorf("deleting a missing key: %v", err)
+			}
+			if ok, err := s.Contains("0123"); ok || err != nil {
+				t.Errorf("got %v, %v, want false, nil", ok, err)
+			}
+
+			s.password = "wrong"
+			if _, err := s.Get("1234"); !errors.Is(err, ErrDenied) {
+				t.Errorf("got %v, want %v", err, ErrDenied)
+			}
+		})
+	}
+}
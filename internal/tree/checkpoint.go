@@ -0,0 +1,120 @@
+package tree
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// A Checkpoint is a sealed root of the local tree recorded under a
+// name, on this host only, as a save point that can be restored later.
+// It is retained by garbage collection, see Store.NeededKeys.
+type Checkpoint struct {
+	Name string
+	Root storage.Pointer
+	When time.Time
+}
+
+// Checkpoints reads the checkpoints recorded in the base directory,
+// oldest first.
+func (s *Store) Checkpoints() ([]Checkpoint, error) {
+	const method = "Store.Checkpoints"
+	f, err := os.Open(filepath.Join(s.baseDir, "checkpoints"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errorv(method, err)
+	}
+	defer func() { _ = f.Close() }()
+	var cps []Checkpoint
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, errorf(method, "malformed line %q", sc.Text())
+		}
+		root, err := storage.NewPointerFromHex(fields[1])
+		if err != nil {
+			return nil, errorf(method, "line %q: %v", sc.Text(), err)
+		}
+		seconds, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, errorf(method, "line %q: %v", sc.Text(), err)
+		}
+		cps = append(cps, Checkpoint{Name: fields[0], Root: root, When: time.Unix(seconds, 0)})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errorv(method, err)
+	}
+	return cps, nil
+}
+
+// AddCheckpoint records the checkpoint after the others.
+func (s *Store) AddCheckpoint(cp Checkpoint) error {
+	const method = "Store.AddCheckpoint"
+	cps, err := s.Checkpoints()
+	if err != nil {
+		return errorv(method, err)
+	}
+	if err := s.setCheckpoints(append(cps, cp)); err != nil {
+		return errorv(method, err)
+	}
+	return nil
+}
+
+// setCheckpoints atomically replaces the recorded checkpoints.
+func (s *Store) setCheckpoints(cps []Checkpoint) error {
+	const method = "Store.setCheckpoints"
+	var buf bytes.Buffer
+	for _, cp := range cps {
+		_, _ = fmt.Fprintf(&buf, "%s\t%s\t%d\n", cp.Name, cp.Root.Hex(), cp.When.Unix())
+	}
+	pathname := filepath.Join(s.baseDir, "checkpoints")
+	if err := ioutil.WriteFile(pathname+".new", buf.Bytes(), 0600); err != nil {
+		return errorv(method, err)
+	}
+	if err := os.Rename(pathname+".new", pathname); err != nil {
+		return errorv(method, err)
+	}
+	return nil
+}
+
+// Checkpoint seals the tree and records its root under the given name.
+// The root must be sealed, as the staging keys of the nodes are reused
+// by later flushes, which would change the checkpoint.
+func (tree *Tree) Checkpoint(name string, when time.Time) (Checkpoint, error) {
+	const method = "Tree.Checkpoint"
+	if err := tree.Flush(); err != nil {
+		return Checkpoint{}, errorv(method, err)
+	}
+	if err := tree.Seal(); err != nil {
+		return Checkpoint{}, errorv(method, err)
+	}
+	cp := Checkpoint{Name: name, Root: tree.root.pointer, When: when}
+	if err := tree.store.AddCheckpoint(cp); err != nil {
+		return Checkpoint{}, errorv(method, err)
+	}
+	return cp, nil
+}
+
+// FindCheckpoint returns the latest checkpoint with the given name.
+func FindCheckpoint(cps []Checkpoint, name string) (Checkpoint, bool) {
+	for i := len(cps) - 1; i >= 0; i-- {
+		if cps[i].Name == name {
+			return cps[i], true
+		}
+	}
+	return Checkpoint{}, false
+}
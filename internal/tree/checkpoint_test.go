@@ -0,0 +1,115 @@
+package tree
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestStoreCheckpoints(t *testing.T) {
+	s := newTestStore(t)
+	cps, err := s.Checkpoints()
+	if err != nil || len(cps) != 0 {
+		t.Fatalf("got %v, %v, want no checkpoints", cps, err)
+	}
+	when := time.Unix(1600000000, 0)
+	added := []Checkpoint{
+		{Name: "before-merge", Root: storage.RandomPointer(), When: when},
+		{Name: "other", Root: storage.RandomPointer(), When: when.Add(time.Minute)},
+		{Name: "before-merge", Root: storage.RandomPointer(), When: when.Add(time.Hour)},
+	}
+	for _, cp := range added {
+		if err := s.AddCheckpoint(cp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cps, err = s.Checkpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cps) != len(added) {
+		t.Fatalf("got %d checkpoints, want %d", len(cps), len(added))
+	}
+	for i, cp := range cps {
+		if cp.Name != added[i].Name || !cp.Root.Equals(added[i].Root) || !cp.When.Equal(added[i].When) {
+			t.Errorf("got %+v, want %+v", cp, added[i])
+		}
+	}
+	if cp, ok := FindCheckpoint(cps, "before-merge"); !ok || !cp.Root.Equals(added[2].Root) {
+		t.Errorf("got %+v, %v, want the latest checkpoint with the name", cp, ok)
+	}
+	if _, ok := FindCheckpoint(cps, "missing"); ok {
+		t.Error("found a checkpoint that does not exist")
+	}
+}
+
+func TestTreeCheckpoint(t *testing.T) {
+	s := newTestStore(t)
+	s.pointers = &storage.InMemory{}
+	live, err := NewTree(s, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := live.Root()
+	file, err := live.Add(root, "file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.WriteAt([]byte("saved"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := live.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := live.Checkpoint("cp", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Later flushes, which reuse the staging keys of the live tree,
+	// and seals leave the checkpoint alone.
+	if err := file.WriteAt([]byte("later"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := live.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	readFile := func() (*Node, string) {
+		t.Helper()
+		saved, err := NewTree(s, WithRoot(cp.Root))
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, err := saved.Walk(saved.Attach(), "file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := make([]byte, 5)
+		if _, err := node[0].ReadAt(p, 0); err != nil {
+			t.Fatal(err)
+		}
+		return node[0], string(p)
+	}
+	if _, got := readFile(); got != "saved" {
+		t.Errorf("after flush: got %q, want %q", got, "saved")
+	}
+	if err := live.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	node, got := readFile()
+	if got != "saved" {
+		t.Errorf("after seal: got %q, want %q", got, "saved")
+	}
+
+	// Garbage collection retains the checkpoint.
+	needed, err := s.NeededKeys(live, nil, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range node.BlockMap() {
+		if _, ok := needed[string(e.Ref.Key())]; !ok {
+			t.Errorf("block %v of the checkpoint not needed", e.Ref)
+		}
+	}
+}
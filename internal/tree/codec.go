@@ -98,5 +98,6 @@ func newStandardCodec() *multiCodec {
 	codec.register(14, &codecV14{})
 	codec.register(15, &codecV15{})
 	codec.register(16, &codec16{})
+	codec.register(17, &codec17{})
 	return codec
 }
@@ -1,6 +1,7 @@
 package tree
 
 import (
+	"bytes"
 	"testing"
 	"testing/quick"
 
@@ -15,6 +16,7 @@ func TestLatestCodecForNodes(t *testing.T) {
 	c.register(14, &codecV14{})
 	c.register(15, &codecV15{})
 	c.register(16, &codec16{})
+	c.register(17, &codec17{})
 	key := make([]byte, 16)
 	factory, err := block.NewFactory(nil, nil, key)
 	if err != nil {
@@ -29,19 +31,21 @@ func TestLatestCodecForNodes(t *testing.T) {
 			bsize uint32,
 			mode uint32,
 			mtime uint32,
+			atime uint32,
 			length uint64,
 			children [][]byte,
 			indexBlocks [][16]byte,
 			repositoryBlocks [][32]byte,
 		) bool {
 			input := &Node{}
-			input.flags = nodeFlags(flags) & ^(loaded | dirty)
+			input.flags = nodeFlags(flags) & ^transientFlags
 			input.bsize = bsize
 			input.info.ID = qidPath
 			input.info.Version = qidVersion
 			input.info.Name = name
 			input.info.Mode = mode
 			input.info.Modified = mtime
+			input.info.Accessed = atime
 			input.info.Size = length
 			for _, b := range children {
 				input.children = append(input.children, &Node{
@@ -113,6 +117,8 @@ func TestLatestCodecForNodes(t *testing.T) {
 			parents []tag,
 			when int64,
 			hostname string,
+			keep bool,
+			message string,
 		) bool {
 			input := &Revision{}
 			input.rootKey = storage.NewPointer(rootKey)
@@ -124,6 +130,8 @@ func TestLatestCodecForNodes(t *testing.T) {
 			}
 			input.when = when
 			input.host = hostname
+			input.keep = keep
+			input.message = message
 			b, err := c.encodeRevision(input)
 			if err != nil {
 				t.Log(err)
@@ -134,6 +142,10 @@ func TestLatestCodecForNodes(t *testing.T) {
 				t.Log(err)
 				return false
 			}
+			if b[0] != 16 && !keep && message == "" {
+				t.Logf("got codec version %d for a revision without flags", b[0])
+				return false
+			}
 			return assert.Equal(t, *input, output)
 		}
 		if err := quick.Check(f, nil); err != nil {
@@ -141,3 +153,20 @@ func TestLatestCodecForNodes(t *testing.T) {
 		}
 	})
 }
+
+func TestCodec16IgnoresTransientFlags(t *testing.T) {
+	var c codec16
+	node := &Node{flags: sealed}
+	want, err := c.encodeNode(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.flags |= transientFlags
+	got, err := c.encodeNode(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
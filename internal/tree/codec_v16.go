@@ -13,6 +13,9 @@ var _ Codec = codec16{}
 
 func (codec16) encodeNode(node *Node) ([]byte, error) {
 	size := 49
+	if node.info.Accessed != 0 {
+		size += 4
+	}
 	size += len(node.info.Name)
 	size += len(node.children)
 	size += len(node.blocks)
@@ -30,12 +33,18 @@ func (codec16) encodeNode(node *Node) ([]byte, error) {
 	ptr = pint64(node.info.ID, ptr)
 	ptr = pint32(node.info.Version, ptr)
 	ptr = pstr(node.info.Name, ptr)
-	ptr = pint8(uint8(node.flags & ^(loaded|dirty)), ptr)
+	ptr = pint8(uint8(node.flags & ^transientFlags), ptr)
 	ptr = pint32(node.bsize, ptr)
 	ptr = pint32(node.info.Mode, ptr)
 	ptr = pint64(node.info.Size, ptr)
 	ptr = pint32(node.info.Modified, ptr)
-	ptr = pint32(0, ptr)
+	// Length of optional fields, which older versions skip.
+	if node.info.Accessed != 0 {
+		ptr = pint32(4, ptr)
+		ptr = pint32(node.info.Accessed, ptr)
+	} else {
+		ptr = pint32(0, ptr)
+	}
 	ptr = pint32(uint32(len(node.children)), ptr)
 	for _, c := range node.children {
 		ptr = pint8(c.pointer.Len(), ptr)
@@ -64,7 +73,8 @@ func (codec16) decodeNode(data []byte, dest *Node) error {
 	dest.info.Version, ptr = gint32(ptr)
 	dest.info.Name, ptr = gstr(ptr)
 	u8, ptr = gint8(ptr)
-	dest.flags = nodeFlags(u8)
+	// Older builds leaked transient flags into storage.
+	dest.flags = nodeFlags(u8) & ^transientFlags
 	dest.bsize, ptr = gint32(ptr)
 	dest.info.Mode, ptr = gint32(ptr)
 	if dest.info.Mode&DMDIR != 0 {
@@ -75,7 +85,11 @@ func (codec16) decodeNode(data []byte, dest *Node) error {
 	}
 	dest.info.Modified, ptr = gint32(ptr)
 
+	// Optional fields; skip any this version doesn't know about.
 	u32, ptr = gint32(ptr)
+	if u32 >= 4 {
+		dest.info.Accessed, _ = gint32(ptr)
+	}
 	if u32 > 0 {
 		ptr = ptr[u32:]
 	}
@@ -0,0 +1,74 @@
+package tree
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Flags of revisions encoded by codec17.
+const (
+	revisionKeep    uint8 = 1 << 0
+	revisionMessage uint8 = 1 << 1
+)
+
+// codec17 adds a flags byte to revisions, for the retention hint, and
+// for whether the message, and its length, precede the flags byte.
+// Nodes, and revisions without flags, are encoded as by codec16, so
+// that older versions can still read them.
+type codec17 struct {
+	codec16
+}
+
+var _ Codec = codec17{}
+
+func (c codec17) encodeRevision(rev *Revision) ([]byte, error) {
+	var flags uint8
+	if rev.keep {
+		flags |= revisionKeep
+	}
+	if rev.message != "" {
+		if len(rev.message) > math.MaxUint16 {
+			return nil, fmt.Errorf("codec17.encodeRevision: message of %d bytes is too long", len(rev.message))
+		}
+		flags |= revisionMessage
+	}
+	buf, err := c.codec16.encodeRevision(rev)
+	if err != nil || flags == 0 {
+		return buf, err
+	}
+	buf[0] = 17
+	if flags&revisionMessage != 0 {
+		buf = append(buf, rev.message...)
+		buf = append(buf, make([]byte, 2)...)
+		pint16(uint16(len(rev.message)), buf[len(buf)-2:])
+	}
+	return append(buf, flags), nil
+}
+
+func (c codec17) decodeRevision(data []byte, rev *Revision) error {
+	if len(data) == 0 {
+		return errors.New("codec17.decodeRevision: no data")
+	}
+	flags := data[len(data)-1]
+	data = data[:len(data)-1]
+	var message string
+	if flags&revisionMessage != 0 {
+		if len(data) < 2 {
+			return errors.New("codec17.decodeRevision: no message length")
+		}
+		n, _ := gint16(data[len(data)-2:])
+		data = data[:len(data)-2]
+		if len(data) < int(n) {
+			return fmt.Errorf("codec17.decodeRevision: message of %d bytes is truncated", n)
+		}
+		message = string(data[len(data)-int(n):])
+		data = data[:len(data)-int(n)]
+	}
+	if err := c.codec16.decodeRevision(data, rev); err != nil {
+		return err
+	}
+	rev.keep = flags&revisionKeep != 0
+	rev.message = message
+	return nil
+}
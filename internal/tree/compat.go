@@ -7,10 +7,23 @@ type NodeInfo struct {
 	Size     uint64
 	Mode     uint32
 	Modified uint32
+	Accessed uint32 // Zero unless access times are tracked, see WithAtime.
 }
 
 const (
 	DMDIR    = 0x80000000
 	DMAPPEND = 0x40000000
 	DMEXCL   = 0x20000000
+
+	// Not supported, see CheckMode.
+	DMMOUNT     = 0x10000000
+	DMAUTH      = 0x08000000
+	DMTMP       = 0x04000000
+	DMSYMLINK   = 0x02000000
+	DMLINK      = 0x01000000
+	DMDEVICE    = 0x00800000
+	DMNAMEDPIPE = 0x00200000
+	DMSOCKET    = 0x00100000
+	DMSETUID    = 0x00080000
+	DMSETGID    = 0x00040000
 )
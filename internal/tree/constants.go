@@ -6,4 +6,8 @@ import (
 
 const SnapshotFrequency = 3 * time.Minute
 
+// DefaultMaxDepth is the default maximum depth of nodes reached by
+// walks and diffs, see WithMaxDepth.
+const DefaultMaxDepth = 255
+
 var RemoteRootKeyPrefix = "remote.root."
@@ -1,9 +1,13 @@
 package tree
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"path"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/block"
 )
 
 func (tree *Tree) DumpNodes(w io.Writer) {
@@ -18,7 +22,11 @@ func (tree *Tree) dumpNodesFrom(w io.Writer, werr error, node *Node, pathname st
 	}
 	out("%s bsize=%d pointer=%v", pathname, node.bsize, node.pointer)
 	for _, c := range node.children {
-		out(" childpointer=%v", c.pointer)
+		if c.flags&loadFailed != 0 {
+			out(" failedchildpointer=%v", c.pointer)
+		} else {
+			out(" childpointer=%v", c.pointer)
+		}
 	}
 	for _, blk := range node.blocks {
 		out(" block=%v", blk.Ref())
@@ -46,3 +54,105 @@ func (tree *Tree) ListNodesInUse() (paths []string) {
 	list(tree.root, "")
 	return
 }
+
+// DumpRefs writes the path and reference count of each node in use,
+// e.g., held by a fid, in depth-first order.
+func (tree *Tree) DumpRefs(w io.Writer) error {
+	var werr error
+	var dump func(*Node, string)
+	dump = func(node *Node, prefix string) {
+		if node.refs == 0 || werr != nil {
+			return
+		}
+		p := path.Join(prefix, node.info.Name)
+		_, werr = fmt.Fprintf(w, "%s %d\n", p, node.refs)
+		for _, c := range node.children {
+			dump(c, p)
+		}
+	}
+	dump(tree.root, "")
+	return werr
+}
+
+// DirtyNode describes a node that changed since the last flush.
+type DirtyNode struct {
+	Path     string
+	Size     uint64
+	Modified time.Time
+}
+
+// ListDirtyNodes lists the loaded nodes that need to be flushed to
+// the staging area, in depth-first order.
+func (tree *Tree) ListDirtyNodes() (nodes []DirtyNode) {
+	var list func(*Node, string)
+	list = func(node *Node, prefix string) {
+		if node.flags&dirty == 0 || node.flags&loaded == 0 {
+			return
+		}
+		p := path.Join(prefix, node.info.Name)
+		nodes = append(nodes, DirtyNode{
+			Path:     p,
+			Size:     node.info.Size,
+			Modified: time.Unix(int64(node.info.Modified), 0),
+		})
+		for _, c := range node.children {
+			list(c, p)
+		}
+	}
+	list(tree.root, "")
+	return
+}
+
+// A BlockExtent describes one of the blocks of a file, see BlockMap.
+type BlockExtent struct {
+	Offset   uint64
+	Length   uint64
+	Ref      block.Ref
+	Location string // See block.Block.Location.
+}
+
+// BlockMap describes the blocks of the file, in order, without loading
+// them. The lengths are those the size of the file implies, all blocks
+// being full but the last.
+func (node *Node) BlockMap() []BlockExtent {
+	bs := uint64(node.bsize)
+	extents := make([]BlockExtent, len(node.blocks))
+	for i, b := range node.blocks {
+		e := &extents[i]
+		e.Offset = uint64(i) * bs
+		if e.Offset < node.info.Size {
+			e.Length = node.info.Size - e.Offset
+			if e.Length > bs {
+				e.Length = bs
+			}
+		}
+		e.Ref = b.Ref()
+		e.Location = b.Location()
+	}
+	return extents
+}
+
+// WriteRemoteTags writes a line for each remote tag, with the
+// revision it points to, the time and host of that revision, and how
+// long before now that was, to see which hosts pushed and how stale
+// each tag is. A revision that can't be loaded is reported on its
+// tag's line rather than failing the whole listing.
+func (s *Store) WriteRemoteTags(ctx context.Context, w io.Writer, now time.Time) error {
+	tags, err := s.ListRemoteTags(ctx)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		r, err := s.LoadRevisionByKey(tag.Pointer)
+		if err != nil {
+			_, err = fmt.Fprintf(w, "%s %v error %v\n", tag.Name, tag.Pointer, err)
+		} else {
+			when := r.Time()
+			_, err = fmt.Fprintf(w, "%s %v %s %s %v\n", tag.Name, tag.Pointer, when.Format(time.RFC3339), r.Host(), now.Sub(when).Truncate(time.Second))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
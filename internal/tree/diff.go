@@ -2,6 +2,7 @@ package tree
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,13 +10,21 @@ import (
 	"sort"
 	"strings"
 	"time"
+
+	"github.com/nicolagi/muscle/internal/linuxerr"
 )
 
+// DefaultDiffMaxSize is the size, in bytes, above which DiffTrees
+// reports the byte ranges of the blocks that changed rather than a diff
+// command, unless overridden with DiffTreesMaxSize.
+const DefaultDiffMaxSize = 256 << 10
+
 type diffTreesOptions struct {
 	namesOnly   bool
 	verbose     bool
 	output      io.Writer
 	initialPath string
+	maxSize     uint64
 }
 
 // DiffTreesOption follows the functional options pattern to pass options to DiffTrees.
@@ -45,10 +54,23 @@ func DiffTreesVerbose(value bool) DiffTreesOption {
 	}
 }
 
+// DiffTreesMaxSize sets the size, in bytes, above which files are not
+// diffed; instead, the byte ranges of their blocks that changed are
+// reported, e.g., "Files A and B differ at bytes 0-8191,16384-16999".
+// Zero means DefaultDiffMaxSize.
+func DiffTreesMaxSize(value uint64) DiffTreesOption {
+	return func(opts *diffTreesOptions) {
+		if value != 0 {
+			opts.maxSize = value
+		}
+	}
+}
+
 // DiffTrees produces a metadata diff of the two trees.
 func DiffTrees(a, b *Tree, arootpath, brootpath string, options ...DiffTreesOption) error {
 	opts := diffTreesOptions{
-		output: ioutil.Discard,
+		output:  ioutil.Discard,
+		maxSize: DefaultDiffMaxSize,
 	}
 	for _, opt := range options {
 		opt(&opts)
@@ -56,19 +78,35 @@ func DiffTrees(a, b *Tree, arootpath, brootpath string, options ...DiffTreesOpti
 	aInitial := a.root
 	bInitial := b.root
 	if opts.initialPath != "" {
+		// The path may be missing from one of the trees, e.g.,
+		// added or removed, but not both.
 		elements := strings.Split(opts.initialPath, "/")
 		visitedNodes, err := a.Walk(a.root, elements...)
-		if err != nil {
+		if errors.Is(err, ErrNotExist) {
+			aInitial = nil
+		} else if err != nil {
 			return fmt.Errorf("could not walk left tree along %s: %v", opts.initialPath, err)
+		} else {
+			aInitial = visitedNodes[len(visitedNodes)-1]
 		}
-		aInitial = visitedNodes[len(visitedNodes)-1]
 		visitedNodes, err = b.Walk(b.root, elements...)
-		if err != nil {
+		if errors.Is(err, ErrNotExist) && aInitial != nil {
+			bInitial = nil
+		} else if err != nil {
 			return fmt.Errorf("could not walk right tree along %s: %v", opts.initialPath, err)
+		} else {
+			bInitial = visitedNodes[len(visitedNodes)-1]
 		}
-		bInitial = visitedNodes[len(visitedNodes)-1]
 	}
-	return diffTrees(a, b, arootpath, brootpath, aInitial, bInitial, &opts)
+	initial := aInitial
+	if initial == nil {
+		initial = bInitial
+	}
+	depth, err := a.depth(initial)
+	if err != nil {
+		return err
+	}
+	return diffTrees(a, b, arootpath, brootpath, aInitial, bInitial, depth, &opts)
 }
 
 func metaDiff(a, b *Node) string {
@@ -148,11 +186,20 @@ func metaDiff(a, b *Node) string {
 	return w.String()
 }
 
-func diffTrees(atree, btree *Tree, arootpath, brootpath string, a, b *Node, opts *diffTreesOptions) error {
+func diffTrees(atree, btree *Tree, arootpath, brootpath string, a, b *Node, depth int, opts *diffTreesOptions) error {
 	output := metaDiff(a, b)
 	if output == "" {
 		return nil
 	}
+	if depth > atree.maxDepth || depth > btree.maxDepth {
+		var p string
+		if a == nil {
+			p = b.Path()
+		} else {
+			p = a.Path()
+		}
+		return fmt.Errorf("%q: deeper than %d: %w", p, atree.maxDepth, linuxerr.ELOOP)
+	}
 
 	var ap, bp string
 	if a == nil {
@@ -186,6 +233,11 @@ func diffTrees(atree, btree *Tree, arootpath, brootpath string, a, b *Node, opts
 			} else {
 				_, _ = fmt.Fprintln(opts.output, bp)
 			}
+		} else if (a == nil || !a.IsDir()) && (b == nil || !b.IsDir()) && (fileSize(a) > opts.maxSize || fileSize(b) > opts.maxSize) {
+			// Too large to diff; nothing to report if only metadata changed.
+			if ranges := changedRanges(a, b); len(ranges) > 0 {
+				_, _ = fmt.Fprintf(opts.output, "Files %s and %s differ at bytes %s\n", ap, bp, formatRanges(ranges))
+			}
 		} else {
 			_, _ = fmt.Fprintf(opts.output, "diff -u %s %s\n", ap, bp)
 		}
@@ -203,7 +255,7 @@ func diffTrees(atree, btree *Tree, arootpath, brootpath string, a, b *Node, opts
 	achildren := a.childrenMap()
 	bchildren := b.childrenMap()
 	for _, name := range orderedUnionOfChildrenNames(achildren, bchildren) {
-		if err := diffTrees(atree, btree, arootpath, brootpath, achildren[name], bchildren[name], opts); err != nil {
+		if err := diffTrees(atree, btree, arootpath, brootpath, achildren[name], bchildren[name], depth+1, opts); err != nil {
 			return err
 		}
 	}
@@ -225,3 +277,177 @@ func orderedUnionOfChildrenNames(a, b map[string]*Node) []string {
 	sort.Strings(names)
 	return names
 }
+
+// DiffStat summarizes the differences between two trees, counting
+// files but not directories.
+type DiffStat struct {
+	Added    int
+	Modified int
+	Deleted  int
+
+	// Bytes in the blocks added, changed, or removed.
+	Bytes uint64
+}
+
+func (stat DiffStat) String() string {
+	return fmt.Sprintf("%d added, %d modified, %d deleted, %d bytes churned", stat.Added, stat.Modified, stat.Deleted, stat.Bytes)
+}
+
+// DiffTreesStat compares the trees without reading file contents:
+// subtrees with the same pointer are skipped, and files are compared
+// block by block via their references. A file whose blocks did not
+// change, e.g., one that was only touched, is not counted.
+func DiffTreesStat(a, b *Tree) (stat DiffStat, err error) {
+	err = diffTreesStat(a, b, a.root, b.root, 0, &stat)
+	return
+}
+
+func diffTreesStat(atree, btree *Tree, a, b *Node, depth int, stat *DiffStat) error {
+	if a != nil && b != nil && a.pointer.Equals(b.pointer) {
+		return nil
+	}
+	if depth > atree.maxDepth || depth > btree.maxDepth {
+		return fmt.Errorf("deeper than %d: %w", atree.maxDepth, linuxerr.ELOOP)
+	}
+	switch {
+	case a == nil:
+		return countFiles(btree, b, depth, &stat.Added, &stat.Bytes)
+	case b == nil:
+		return countFiles(atree, a, depth, &stat.Deleted, &stat.Bytes)
+	case a.IsDir() && b.IsDir():
+		if err := atree.Grow(a); err != nil {
+			return fmt.Errorf("could not grow %q: %v", a.Path(), err)
+		}
+		if err := btree.Grow(b); err != nil {
+			return fmt.Errorf("could not grow %q: %v", b.Path(), err)
+		}
+		achildren := a.childrenMap()
+		bchildren := b.childrenMap()
+		for _, name := range orderedUnionOfChildrenNames(achildren, bchildren) {
+			if err := diffTreesStat(atree, btree, achildren[name], bchildren[name], depth+1, stat); err != nil {
+				return err
+			}
+		}
+		return nil
+	case a.IsDir() || b.IsDir():
+		if err := countFiles(atree, a, depth, &stat.Deleted, &stat.Bytes); err != nil {
+			return err
+		}
+		return countFiles(btree, b, depth, &stat.Added, &stat.Bytes)
+	default:
+		if churn := blockChurn(a, b); churn > 0 || a.info.Size != b.info.Size {
+			stat.Modified++
+			stat.Bytes += churn
+		}
+		return nil
+	}
+}
+
+// countFiles adds the files at or below the node to count, and their
+// sizes to size.
+func countFiles(tree *Tree, node *Node, depth int, count *int, size *uint64) error {
+	if depth > tree.maxDepth {
+		return fmt.Errorf("%q: deeper than %d: %w", node.Path(), tree.maxDepth, linuxerr.ELOOP)
+	}
+	if !node.IsDir() {
+		*count++
+		*size += node.info.Size
+		return nil
+	}
+	if err := tree.Grow(node); err != nil {
+		return fmt.Errorf("could not grow %q: %v", node.Path(), err)
+	}
+	for _, child := range node.children {
+		if err := countFiles(tree, child, depth+1, count, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockChurn returns how many bytes are in blocks that differ between
+// the two files, taking the larger of the two blocks at each index.
+func blockChurn(a, b *Node) (churn uint64) {
+	blockSize := func(node *Node, i int) uint64 {
+		if i >= len(node.blocks) || node.bsize == 0 {
+			return 0
+		}
+		start := uint64(i) * uint64(node.bsize)
+		if start >= node.info.Size {
+			return 0
+		}
+		if n := node.info.Size - start; n < uint64(node.bsize) {
+			return n
+		}
+		return uint64(node.bsize)
+	}
+	n := len(a.blocks)
+	if len(b.blocks) > n {
+		n = len(b.blocks)
+	}
+	for i := 0; i < n; i++ {
+		if i < len(a.blocks) && i < len(b.blocks) && bytes.Equal(a.blocks[i].Ref().Bytes(), b.blocks[i].Ref().Bytes()) {
+			continue
+		}
+		asize, bsize := blockSize(a, i), blockSize(b, i)
+		if asize > bsize {
+			churn += asize
+		} else {
+			churn += bsize
+		}
+	}
+	return
+}
+
+func fileSize(node *Node) uint64 {
+	if node == nil {
+		return 0
+	}
+	return node.info.Size
+}
+
+// changedRanges returns the byte ranges, as pairs of the first and last
+// offsets, of the blocks that differ between the two files, either of
+// which may be nil for a file that does not exist. Contiguous ranges
+// are merged. Files with different block sizes differ everywhere.
+func changedRanges(a, b *Node) (ranges [][2]uint64) {
+	size := fileSize(a)
+	if n := fileSize(b); n > size {
+		size = n
+	}
+	if size == 0 {
+		return nil
+	}
+	if a == nil || b == nil || a.bsize != b.bsize || a.bsize == 0 {
+		return [][2]uint64{{0, size - 1}}
+	}
+	bsize := uint64(a.bsize)
+	for start := uint64(0); start < size; start += bsize {
+		i := int(start / bsize)
+		if i < len(a.blocks) && i < len(b.blocks) && start < a.info.Size && start < b.info.Size && bytes.Equal(a.blocks[i].Ref().Bytes(), b.blocks[i].Ref().Bytes()) {
+			// The same block, unless it's the last one of a file that
+			// was truncated or extended within it.
+			if end := start + bsize; end <= a.info.Size && end <= b.info.Size || a.info.Size == b.info.Size {
+				continue
+			}
+		}
+		last := start + bsize - 1
+		if last >= size {
+			last = size - 1
+		}
+		if n := len(ranges); n > 0 && ranges[n-1][1]+1 == start {
+			ranges[n-1][1] = last
+		} else {
+			ranges = append(ranges, [2]uint64{start, last})
+		}
+	}
+	return ranges
+}
+
+func formatRanges(ranges [][2]uint64) string {
+	s := make([]string, len(ranges))
+	for i, r := range ranges {
+		s[i] = fmt.Sprintf("%d-%d", r[0], r[1])
+	}
+	return strings.Join(s, ",")
+}
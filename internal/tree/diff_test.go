@@ -2,6 +2,7 @@ package tree
 
 import (
 	"math/rand"
+	"strings"
 	"testing"
 
 	"github.com/nicolagi/muscle/internal/block"
@@ -136,7 +137,7 @@ func TestNodeMetaContent(t *testing.T) {
 	})
 }
 
-func blockFactory(t *testing.T, storeErr error) *block.Factory {
+func blockFactory(t testing.TB, storeErr error) *block.Factory {
 	t.Helper()
 	key := make([]byte, 16)
 	rand.Read(key)
@@ -157,3 +158,159 @@ func newBlock(t *testing.T, f *block.Factory, ref block.Ref) *block.Block {
 	}
 	return b
 }
+
+func TestDiffTreesInitialPathMissingFromOneTree(t *testing.T) {
+	add := func(tree *Tree, names ...string) {
+		t.Helper()
+		_, node := tree.Root()
+		for _, name := range names {
+			var err error
+			if node, err = tree.Add(node, name, 0700|DMDIR); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	a, err := NewTree(newTestStore(t), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewTree(newTestStore(t), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	add(a, "removed")
+	add(b, "added")
+	for initialPath, want := range map[string]string{
+		"removed": "diff -u /a/removed /dev/null\n",
+		"added":   "diff -u /dev/null /b/added\n",
+	} {
+		var output strings.Builder
+		if err := DiffTrees(a, b, "/a", "/b", DiffTreesOutput(&output), DiffTreesInitialPath(initialPath)); err != nil {
+			t.Errorf("%s: %v", initialPath, err)
+		} else if got := output.String(); got != want {
+			t.Errorf("%s: got %q, want %q", initialPath, got, want)
+		}
+	}
+	if err := DiffTrees(a, b, "/a", "/b", DiffTreesInitialPath("neither")); err == nil {
+		t.Error("no error for a path missing from both trees")
+	}
+}
+
+func TestDiffTreesStat(t *testing.T) {
+	tree, err := NewTree(newTestStore(t), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	dir, err := tree.Add(root, "dir", 0700|DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(parent *Node, name, content string) *Node {
+		t.Helper()
+		node, err := tree.Add(parent, name, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := node.WriteAt([]byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
+		return node
+	}
+	// Like for revisions, compare sealed trees, whose pointers change
+	// with the contents.
+	snapshot := func() *Tree {
+		t.Helper()
+		if err := tree.Seal(); err != nil {
+			t.Fatal(err)
+		}
+		key, err := tree.store.LocalRootKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := NewTree(tree.store, WithRoot(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return other
+	}
+	write(dir, "same", "unchanged")
+	touched := write(dir, "touched", "unchanged")
+	changed := write(dir, "changed", "four")
+	gone := write(root, "gone", "twelve bytes")
+	before := snapshot()
+
+	touched.Touch(1)
+	if err := changed.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := changed.WriteAt([]byte("seven!!"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Unlink(gone); err != nil {
+		t.Fatal(err)
+	}
+	write(dir, "new", "five!")
+	after := snapshot()
+
+	stat, err := DiffTreesStat(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (DiffStat{Added: 1, Modified: 1, Deleted: 1, Bytes: 5 + 7 + 12}); stat != want {
+		t.Errorf("got %v, want %v", stat, want)
+	}
+	if stat, err := DiffTreesStat(after, after); err != nil || stat != (DiffStat{}) {
+		t.Errorf("got %v, %v, want no differences", stat, err)
+	}
+}
+
+func TestDiffTreesMaxSize(t *testing.T) {
+	tree, err := NewTree(newTestStore(t), WithMutable(), WithSmallBlocks(16, []string{"*"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	file, err := tree.Add(root, "file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := func() *Tree {
+		t.Helper()
+		if err := tree.Seal(); err != nil {
+			t.Fatal(err)
+		}
+		key, err := tree.store.LocalRootKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := NewTree(tree.store, WithRoot(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return other
+	}
+	if err := file.WriteAt([]byte(strings.Repeat("x", 64)), 0); err != nil {
+		t.Fatal(err)
+	}
+	before := snapshot()
+	if err := file.WriteAt([]byte("yy"), 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.WriteAt([]byte("appended"), 64); err != nil {
+		t.Fatal(err)
+	}
+	after := snapshot()
+
+	for maxSize, want := range map[uint64]string{
+		0:  "diff -u /a/file /b/file\n",
+		32: "Files /a/file and /b/file differ at bytes 16-31,64-71\n",
+	} {
+		var output strings.Builder
+		if err := DiffTrees(before, after, "/a", "/b", DiffTreesOutput(&output), DiffTreesMaxSize(maxSize)); err != nil {
+			t.Errorf("%d: %v", maxSize, err)
+		} else if got := output.String(); got != want {
+			t.Errorf("%d: got %q, want %q", maxSize, got, want)
+		}
+	}
+}
@@ -3,7 +3,9 @@ package tree
 import "fmt"
 
 var (
+	ErrDiverged   = fmt.Errorf("diverged")
 	ErrExist      = fmt.Errorf("exists")
+	ErrMode       = fmt.Errorf("invalid mode")
 	ErrNotEmpty   = fmt.Errorf("not empty")
 	ErrNotExist   = fmt.Errorf("does not exist")
 	ErrPermission = fmt.Errorf("permission denied")
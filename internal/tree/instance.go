@@ -0,0 +1,122 @@
+package tree
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// InstanceKeyPrefix is the prefix of the keys, in the store of tags,
+// of the records each musclefs instance keeps up to date with when it
+// last flushed and pushed, one per host.
+const InstanceKeyPrefix = "instance."
+
+// Instance is the record a musclefs instance keeps in the store of
+// tags, see Store.Heartbeat. Zero times mean never.
+type Instance struct {
+	Host    string
+	Seen    time.Time // Last heartbeat.
+	Flushed time.Time
+	Pushed  time.Time
+}
+
+func (i Instance) marshal() []byte {
+	unix := func(t time.Time) int64 {
+		if t.IsZero() {
+			return 0
+		}
+		return t.Unix()
+	}
+	return []byte(fmt.Sprintf("host %s\nseen %d\nflushed %d\npushed %d\n", i.Host, unix(i.Seen), unix(i.Flushed), unix(i.Pushed)))
+}
+
+func (i *Instance) unmarshal(value []byte) error {
+	s := bufio.NewScanner(bytes.NewReader(value))
+	for s.Scan() {
+		fields := strings.SplitN(s.Text(), " ", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("malformed line %q", s.Text())
+		}
+		if fields[0] == "host" {
+			i.Host = fields[1]
+			continue
+		}
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("line %q: %w", s.Text(), err)
+		}
+		var t time.Time
+		if n != 0 {
+			t = time.Unix(n, 0)
+		}
+		switch fields[0] {
+		case "seen":
+			i.Seen = t
+		case "flushed":
+			i.Flushed = t
+		case "pushed":
+			i.Pushed = t
+		}
+	}
+	return s.Err()
+}
+
+// later returns the later of the two times.
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// Heartbeat updates the record of the instance's host. Times only move
+// forward, so that an instance that was restarted and hasn't pushed
+// yet doesn't erase when it last did.
+func (s *Store) Heartbeat(i Instance) error {
+	const method = "Store.Heartbeat"
+	key := storage.Key(InstanceKeyPrefix + i.Host)
+	return s.updatePointers(method, key, func(old []byte) ([]byte, bool, error) {
+		var prev Instance
+		if old != nil {
+			if err := prev.unmarshal(old); err != nil {
+				return nil, false, errorf(method, "%s: %v", key, err)
+			}
+		}
+		i.Seen = later(prev.Seen, i.Seen)
+		i.Flushed = later(prev.Flushed, i.Flushed)
+		i.Pushed = later(prev.Pushed, i.Pushed)
+		return i.marshal(), true, nil
+	})
+}
+
+// Instances returns the records of all instances, sorted by host.
+func (s *Store) Instances(ctx context.Context) ([]Instance, error) {
+	const method = "Store.Instances"
+	hosts, err := s.listPointers(ctx, method, InstanceKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var instances []Instance
+	for _, host := range hosts {
+		value, err := s.pointers.Get(storage.Key(InstanceKeyPrefix + host))
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, errorv(method, err)
+		}
+		i := Instance{Host: host}
+		if err := i.unmarshal(value); err != nil {
+			return nil, errorf(method, "%s: %v", host, err)
+		}
+		instances = append(instances, i)
+	}
+	return instances, nil
+}
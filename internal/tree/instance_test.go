@@ -0,0 +1,47 @@
+package tree
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestStoreHeartbeat(t *testing.T) {
+	s, err := NewStore(nil, &storage.InMemory{}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Unix(1600000000, 0)
+	beats := []Instance{
+		{Host: "laptop", Seen: t0, Flushed: t0, Pushed: t0},
+		// Restarted, hasn't pushed yet.
+		{Host: "laptop", Seen: t0.Add(time.Hour), Flushed: t0.Add(time.Minute)},
+		{Host: "desktop", Seen: t0, Flushed: t0},
+	}
+	for _, i := range beats {
+		if err := s.Heartbeat(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := s.Instances(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Instance{
+		{Host: "desktop", Seen: t0, Flushed: t0},
+		{Host: "laptop", Seen: t0.Add(time.Hour), Flushed: t0.Add(time.Minute), Pushed: t0},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i].Host != want[i].Host || !got[i].Seen.Equal(want[i].Seen) || !got[i].Flushed.Equal(want[i].Flushed) || !got[i].Pushed.Equal(want[i].Pushed) {
+			t.Errorf("got %+v, want %+v", got[i], want[i])
+		}
+	}
+	if !got[0].Pushed.IsZero() {
+		t.Errorf("got %v, want the zero time for a host that never pushed", got[0].Pushed)
+	}
+}
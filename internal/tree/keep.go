@@ -0,0 +1,91 @@
+package tree
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// KeepKey is the key, in the store of tags, of the list of revisions
+// garbage collection retains regardless of age. It complements the
+// retention hint revisions can be pushed with (see Revision.Keep),
+// which can't be changed afterwards, as revisions are content-addressed.
+const KeepKey = "keep"
+
+func parseKept(value []byte) (map[string]struct{}, error) {
+	m := make(map[string]struct{})
+	s := bufio.NewScanner(bytes.NewReader(value))
+	for s.Scan() {
+		if _, err := storage.NewPointerFromHex(s.Text()); err != nil {
+			return nil, err
+		}
+		m[s.Text()] = struct{}{}
+	}
+	return m, s.Err()
+}
+
+// KeptRevisions returns the revisions listed under KeepKey.
+func (s *Store) KeptRevisions() ([]storage.Pointer, error) {
+	const method = "Store.KeptRevisions"
+	value, err := s.pointers.Get(KeepKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errorv(method, err)
+	}
+	m, err := parseKept(value)
+	if err != nil {
+		return nil, errorv(method, err)
+	}
+	var kept []storage.Pointer
+	for k := range m {
+		p, _ := storage.NewPointerFromHex(k)
+		kept = append(kept, p)
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Hex() < kept[j].Hex() })
+	return kept, nil
+}
+
+// SetKept adds the revision to, or removes it from, the list under
+// KeepKey. The revision must exist, to catch typos. Revisions pushed
+// with the retention hint are retained in any case, so they can't be
+// removed.
+func (s *Store) SetKept(revision storage.Pointer, keep bool) error {
+	const method = "Store.SetKept"
+	r, err := s.LoadRevisionByKey(revision)
+	if err != nil {
+		return errorv(method, err)
+	}
+	if r.Keep() && !keep {
+		return errorf(method, "revision %v was pushed with the retention hint", revision)
+	}
+	return s.updatePointers(method, KeepKey, func(old []byte) ([]byte, bool, error) {
+		m, err := parseKept(old)
+		if err != nil {
+			return nil, false, errorv(method, err)
+		}
+		if _, ok := m[revision.Hex()]; ok == keep {
+			return nil, false, nil
+		}
+		if keep {
+			m[revision.Hex()] = struct{}{}
+		} else {
+			delete(m, revision.Hex())
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var buf bytes.Buffer
+		for _, k := range keys {
+			buf.WriteString(k)
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes(), true, nil
+	})
+}
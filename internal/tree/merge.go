@@ -5,29 +5,42 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/nicolagi/muscle/internal/config"
+	"github.com/nicolagi/muscle/internal/linuxerr"
 )
 
+// AnyRevision can be used in place of a revision in Ignore and
+// Unignore, to make the rule apply to merges of any revision.
+const AnyRevision = "*"
+
 func (tree *Tree) isIgnored(revision string, pathname string) bool {
-	if tree.ignored == nil {
-		return false
-	}
-	m := tree.ignored[revision]
-	if m == nil {
-		return false
+	for _, r := range []string{revision, AnyRevision} {
+		for pattern := range tree.ignored[r] {
+			if pattern == pathname {
+				return true
+			}
+			if matched, err := path.Match(pattern, pathname); err == nil && matched {
+				return true
+			}
+		}
 	}
-	_, ok := m[pathname]
-	return ok
+	return false
 }
 
-// Ignore marks the given pathname within the given revision as
-// ignored for the purpose of pull (merge) operations. In other
-// words, a conflict for pathname when merging the revision will
-// result in the local version to be kept.
-func (tree *Tree) Ignore(revision string, pathname string) {
+// Ignore marks the pathnames matching the given pattern within the
+// given revision as ignored for the purpose of pull (merge)
+// operations. In other words, a conflict for a matching pathname when
+// merging the revision will result in the local version to be kept.
+// The pattern syntax is that of path.Match.
+func (tree *Tree) Ignore(revision string, pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("%q: %w", pattern, err)
+	}
 	if tree.ignored == nil {
 		tree.ignored = make(map[string]map[string]struct{})
 	}
@@ -36,7 +49,146 @@ func (tree *Tree) Ignore(revision string, pathname string) {
 		m = make(map[string]struct{})
 		tree.ignored[revision] = m
 	}
-	m[pathname] = struct{}{}
+	m[pattern] = struct{}{}
+	return nil
+}
+
+// Unignore removes a rule previously added with Ignore, and reports
+// whether the rule was found.
+func (tree *Tree) Unignore(revision string, pattern string) bool {
+	m := tree.ignored[revision]
+	if _, ok := m[pattern]; !ok {
+		return false
+	}
+	delete(m, pattern)
+	if len(m) == 0 {
+		delete(tree.ignored, revision)
+	}
+	return true
+}
+
+// IgnoreRules lists the rules added with Ignore, in the form
+// revision/pattern, sorted.
+func (tree *Tree) IgnoreRules() (rules []string) {
+	for revision, m := range tree.ignored {
+		for pattern := range m {
+			rules = append(rules, revision+"/"+pattern)
+		}
+	}
+	sort.Strings(rules)
+	return
+}
+
+// A MergeStrategy says how PullWorklog resolves a conflict, i.e., a
+// path changed both locally and remotely.
+type MergeStrategy string
+
+const (
+	// MergeManual leaves the conflict to be resolved by hand.
+	MergeManual MergeStrategy = "manual"
+	// MergeOurs keeps the local version.
+	MergeOurs MergeStrategy = "ours"
+	// MergeTheirs takes the remote version.
+	MergeTheirs MergeStrategy = "theirs"
+	// MergeNewest takes the version modified last, and the remote
+	// version if the local one was removed.
+	MergeNewest MergeStrategy = "newest"
+)
+
+// ParseMergeStrategy returns the strategy with the given name.
+func ParseMergeStrategy(name string) (MergeStrategy, error) {
+	switch s := MergeStrategy(name); s {
+	case MergeManual, MergeOurs, MergeTheirs, MergeNewest:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown merge strategy %q: %w", name, linuxerr.EINVAL)
+}
+
+// mergeStrategy returns the strategy for a conflict at the given path,
+// relative to the root: that of the first rule in the configuration
+// matching it, if any, or else the given one.
+func mergeStrategy(cfg *config.C, pathname string, fallback MergeStrategy) MergeStrategy {
+	for _, r := range cfg.MergeStrategies {
+		if matchPattern(r.Pattern, pathname) {
+			return MergeStrategy(r.Strategy)
+		}
+	}
+	if fallback == "" {
+		return MergeManual
+	}
+	return fallback
+}
+
+// matchPattern reports whether the path, relative to the root,
+// matches the pattern, with the syntax of path.Match. A pattern with no
+// slashes, e.g., "*.log", is matched against the last element of the
+// path, a pattern with slashes against the whole path.
+func matchPattern(pattern, pathname string) bool {
+	if !strings.Contains(pattern, "/") {
+		pathname = path.Base(pathname)
+	}
+	matched, err := path.Match(pattern, pathname)
+	return err == nil && matched
+}
+
+// KeepLocalFile is the name of the file in the root of the tree that
+// lists patterns, one per line, of paths that pulls leave alone, e.g.,
+// per-machine configuration or sockets. Unlike the rules added with
+// Ignore, which only apply to conflicts on one host, these apply to
+// any change, and, being in the tree, on all hosts. Blank lines and
+// lines starting with # are skipped. See matchPattern for the syntax.
+const KeepLocalFile = ".muscle-keep-local"
+
+// keepLocalPatterns returns the patterns listed in the tree's
+// KeepLocalFile, if any. Invalid patterns are logged and skipped.
+func (tree *Tree) keepLocalPatterns() ([]string, error) {
+	if tree.root == nil {
+		return nil, nil
+	}
+	if err := tree.Grow(tree.root); err != nil {
+		return nil, err
+	}
+	node := tree.root.childrenMap()[KeepLocalFile]
+	if node == nil || node.IsDir() {
+		return nil, nil
+	}
+	buf := make([]byte, node.info.Size)
+	n, err := node.ReadAt(buf, 0)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", KeepLocalFile, err)
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(buf[:n]), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := path.Match(line, ""); err != nil {
+			log.Printf("Skipping pattern %q in %s: %v", line, KeepLocalFile, err)
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
+
+// mergeOptions holds what, beside the trees, determines the outcome of
+// a merge.
+type mergeOptions struct {
+	// Strategy for conflicts not covered by the rules in the
+	// configuration.
+	strategy MergeStrategy
+	// Patterns of paths that are left alone, see KeepLocalFile.
+	keep []string
+}
+
+func (opts *mergeOptions) keepLocal(pathname string) bool {
+	for _, pattern := range opts.keep {
+		if matchPattern(pattern, pathname) {
+			return true
+		}
+	}
+	return false
 }
 
 func sameKeyOrBothNil(a, b *Node) bool {
@@ -48,7 +200,20 @@ func sameKeyOrBothNil(a, b *Node) bool {
 
 // Returns proposed commands to execute via the ctl file.
 // If empty, and no error, it means there's nothing to pull.
-func (tree *Tree) PullWorklog(cfg *config.C, baseTree *Tree, remoteTree *Tree) (output string, err error) {
+// Conflicts are resolved according to the merge strategy rules in the
+// configuration, and by the given strategy for the paths that match
+// none; the empty strategy means MergeManual. Paths matching the
+// patterns in the KeepLocalFile of either the local or the remote tree
+// are left alone.
+func (tree *Tree) PullWorklog(cfg *config.C, baseTree *Tree, remoteTree *Tree, strategy MergeStrategy) (output string, err error) {
+	opts := mergeOptions{strategy: strategy}
+	for _, t := range []*Tree{tree, remoteTree} {
+		patterns, err := t.keepLocalPatterns()
+		if err != nil {
+			return "", err
+		}
+		opts.keep = append(opts.keep, patterns...)
+	}
 	var buf bytes.Buffer
 	err = merge3way(
 		tree,       // tree to merge into
@@ -61,6 +226,7 @@ func (tree *Tree) PullWorklog(cfg *config.C, baseTree *Tree, remoteTree *Tree) (
 		remoteTree.revision.Hex(),
 		remoteTree.root.pointer.Hex(),
 		cfg,
+		&opts,
 		&buf,
 	)
 	if buf.Len() > 0 {
@@ -71,11 +237,25 @@ func (tree *Tree) PullWorklog(cfg *config.C, baseTree *Tree, remoteTree *Tree) (
 	return
 }
 
-func merge3way(localTree, baseTree, remoteTree *Tree, local, base, remote *Node, baseRev, remoteRev string, remoteRoot string, cfg *config.C, output io.Writer) error {
+func merge3way(localTree, baseTree, remoteTree *Tree, local, base, remote *Node, baseRev, remoteRev string, remoteRoot string, cfg *config.C, opts *mergeOptions, output io.Writer) error {
 	if sameKeyOrBothNil(local, remote) {
 		return nil
 	}
 
+	if len(opts.keep) > 0 {
+		var p string
+		for _, n := range []*Node{local, remote, base} {
+			if n != nil {
+				p = strings.TrimPrefix(n.Path(), "/")
+				break
+			}
+		}
+		if p != "" && opts.keepLocal(p) {
+			log.Printf("Keeping path %q as is, as it matches a pattern in %s\n", p, KeepLocalFile)
+			return nil
+		}
+	}
+
 	if same, err := sameContents(local, remote); err != nil {
 		return err
 	} else if same {
@@ -112,39 +292,76 @@ func merge3way(localTree, baseTree, remoteTree *Tree, local, base, remote *Node,
 	// If local and remote have different type, we have a conflict (unless marked resolved).
 	// Otherwise, we can try recursion (losing metadata diffs for the directories, but it's something I can stand at the moment).
 
-	if remote != nil {
-		resolved := localTree.isIgnored(remoteRoot, strings.TrimPrefix(remote.Path(), "/"))
-		if resolved {
-			log.Printf("There was a conflict at path %q but it is marked as locally resolved\n", remote.Path())
-			return nil
-		}
+	// Either side of the conflict may have been removed, not both.
+	conflicted := remote
+	if conflicted == nil {
+		conflicted = local
+	}
+	p := strings.TrimPrefix(conflicted.Path(), "/")
+	if localTree.isIgnored(remoteRoot, p) {
+		log.Printf("There was a conflict at path %q but it is marked as locally resolved\n", p)
+		return nil
 	}
 
 	if !(local != nil && remote != nil && local.IsDir()) || !remote.IsDir() {
-		if remote != nil {
-			p := remote.Path()
-			p = strings.TrimPrefix(p, "/")
-			localVersion := filepath.Join(
-				cfg.MuscleFSMount,
-				p,
-			)
-			baseVersion := filepath.Join(
-				cfg.MuscleFSMount,
-				baseRev,
-				p,
-			)
-			remoteVersion := filepath.Join(
-				cfg.MuscleFSMount,
-				remoteRev,
-				p,
-			)
-			_, _ = fmt.Fprintf(output, "# meld %s %s %s\n", localVersion, baseVersion, remoteVersion)
-			_, _ = fmt.Fprintf(output, "# meld %s %s\n", localVersion, remoteVersion)
-			_, _ = fmt.Fprintf(output, "# diff3 %s %s %s\n", localVersion, baseVersion, remoteVersion)
-			_, _ = fmt.Fprintf(output, "# diff %s %s\n", localVersion, remoteVersion)
-			_, _ = fmt.Fprintf(output, "# graft2 %s/%s %s\n", remoteRoot, p, p)
+		s := mergeStrategy(cfg, p, opts.strategy)
+		if s == MergeNewest {
+			theirs := local == nil
+			if remote == nil {
+				deleted, err := remoteTree.deletedAt(p)
+				if err != nil {
+					return fmt.Errorf("tree.merge3way: %w", err)
+				}
+				theirs = deleted > local.info.Modified
+			} else if local != nil {
+				theirs = remote.info.Modified > local.info.Modified
+			}
+			if theirs {
+				s = MergeTheirs
+			} else {
+				s = MergeOurs
+			}
+		}
+		switch s {
+		case MergeOurs:
+			log.Printf("There was a conflict at path %q, resolved keeping the local version\n", p)
+			return nil
+		case MergeTheirs:
+			log.Printf("There was a conflict at path %q, resolved taking the remote version\n", p)
+			if remote == nil {
+				_, _ = fmt.Fprintf(output, "unlink %s\n", p)
+			} else {
+				_, _ = fmt.Fprintf(output, "graft2 %s/%s %s\n", remoteRoot, p, p)
+			}
+			return nil
+		}
+		localVersion := filepath.Join(
+			cfg.MuscleFSMount,
+			p,
+		)
+		baseVersion := filepath.Join(
+			cfg.MuscleFSMount,
+			baseRev,
+			p,
+		)
+		if remote == nil {
+			_, _ = fmt.Fprintf(output, "# %s changed locally, removed remotely\n", p)
+			_, _ = fmt.Fprintf(output, "# diff %s %s\n", baseVersion, localVersion)
+			_, _ = fmt.Fprintf(output, "# unlink %s\n", p)
 			_, _ = fmt.Fprintf(output, "# keep-local-for %s/%s\n", remoteRoot, p)
+			return nil
 		}
+		remoteVersion := filepath.Join(
+			cfg.MuscleFSMount,
+			remoteRev,
+			p,
+		)
+		_, _ = fmt.Fprintf(output, "# meld %s %s %s\n", localVersion, baseVersion, remoteVersion)
+		_, _ = fmt.Fprintf(output, "# meld %s %s\n", localVersion, remoteVersion)
+		_, _ = fmt.Fprintf(output, "# diff3 %s %s %s\n", localVersion, baseVersion, remoteVersion)
+		_, _ = fmt.Fprintf(output, "# diff %s %s\n", localVersion, remoteVersion)
+		_, _ = fmt.Fprintf(output, "# graft2 %s/%s %s\n", remoteRoot, p, p)
+		_, _ = fmt.Fprintf(output, "# keep-local-for %s/%s\n", remoteRoot, p)
 		return nil
 	}
 
@@ -173,7 +390,7 @@ func merge3way(localTree, baseTree, remoteTree *Tree, local, base, remote *Node,
 	}
 
 	for name := range mergeNames {
-		if err := merge3way(localTree, baseTree, remoteTree, getChild(localChildren, name), getChild(baseChildren, name), getChild(remoteChildren, name), baseRev, remoteRev, remoteRoot, cfg, output); err != nil {
+		if err := merge3way(localTree, baseTree, remoteTree, getChild(localChildren, name), getChild(baseChildren, name), getChild(remoteChildren, name), baseRev, remoteRev, remoteRoot, cfg, opts, output); err != nil {
 			return err
 		}
 	}
@@ -181,6 +398,28 @@ func merge3way(localTree, baseTree, remoteTree *Tree, local, base, remote *Node,
 	return nil
 }
 
+// deletedAt approximates when the file at the path was removed from
+// the tree with the modification time of its parent directory, which
+// the removal updated.
+func (tree *Tree) deletedAt(pathname string) (uint32, error) {
+	var elems []string
+	if dir := path.Dir(pathname); dir != "." {
+		elems = strings.Split(dir, "/")
+	}
+	parent := tree.root
+	if len(elems) > 0 {
+		walked, err := tree.Walk(tree.root, elems...)
+		if err != nil {
+			return 0, err
+		}
+		if len(walked) != len(elems) {
+			return 0, fmt.Errorf("%q: %w", pathname, ErrNotExist)
+		}
+		parent = walked[len(walked)-1]
+	}
+	return parent.info.Modified, nil
+}
+
 func sameContents(a *Node, b *Node) (bool, error) {
 	if a == nil || b == nil || a.IsDir() || b.IsDir() {
 		return false, nil
@@ -0,0 +1,145 @@
+package tree
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/config"
+)
+
+func TestMergeStrategy(t *testing.T) {
+	cfg := &config.C{
+		MergeStrategies: []config.MergeStrategyRule{
+			{Pattern: "*.log", Strategy: "theirs"},
+			{Pattern: "src/*.lock", Strategy: "ours"},
+			{Pattern: "*.lock", Strategy: "newest"},
+		},
+	}
+	testCases := []struct {
+		pathname string
+		fallback MergeStrategy
+		want     MergeStrategy
+	}{
+		{"build.log", "", MergeTheirs},
+		{"a/b/build.log", MergeOurs, MergeTheirs},
+		{"src/go.lock", "", MergeOurs},
+		{"src/sub/go.lock", "", MergeNewest},
+		{"main.go", "", MergeManual},
+		{"main.go", MergeNewest, MergeNewest},
+	}
+	for _, tc := range testCases {
+		if got := mergeStrategy(cfg, tc.pathname, tc.fallback); got != tc.want {
+			t.Errorf("%s, %q: got %q, want %q", tc.pathname, tc.fallback, got, tc.want)
+		}
+	}
+	if _, err := ParseMergeStrategy("mine"); err == nil {
+		t.Error("no error for an unknown strategy")
+	}
+	if s, err := ParseMergeStrategy("theirs"); err != nil || s != MergeTheirs {
+		t.Errorf("got %q, %v, want %q", s, err, MergeTheirs)
+	}
+}
+
+func TestPullWorklogKeepsLocalPatterns(t *testing.T) {
+	store := newTestStore(t)
+	newTree := func(files map[string]string) *Tree {
+		t.Helper()
+		tree, err := NewTree(store, WithMutable())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, root := tree.Root()
+		for name, contents := range files {
+			node, err := tree.Add(root, name, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := node.WriteAt([]byte(contents), 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tree.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return tree
+	}
+	base := newTree(nil)
+	local := newTree(map[string]string{
+		KeepLocalFile: "# per-machine files\n*.sock\n",
+		"agent.sock":  "local",
+	})
+	remote := newTree(map[string]string{
+		"agent.sock": "remote",
+		"notes":      "remote",
+	})
+	output, err := local.PullWorklog(&config.C{}, base, remote, MergeTheirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteRoot := remote.root.pointer.Hex()
+	if want := "graft2 " + remoteRoot + "/notes notes\nflush\npull\n"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+}
+
+func TestPullWorklogRemoteDeletion(t *testing.T) {
+	store := newTestStore(t)
+	newTree := func(files map[string]string, modified uint32) *Tree {
+		t.Helper()
+		tree, err := NewTree(store, WithMutable())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, root := tree.Root()
+		for name, contents := range files {
+			node, err := tree.Add(root, name, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := node.WriteAt([]byte(contents), 0); err != nil {
+				t.Fatal(err)
+			}
+			node.Touch(modified)
+		}
+		root.Touch(modified)
+		if err := tree.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return tree
+	}
+	base := newTree(map[string]string{"f": "base"}, 1000)
+	testCases := []struct {
+		strategy      MergeStrategy
+		localModified uint32
+		deleted       uint32
+		want          string
+	}{
+		{MergeTheirs, 2000, 3000, "unlink f\nflush\npull\n"},
+		{MergeOurs, 2000, 3000, ""},
+		{MergeNewest, 2000, 3000, "unlink f\nflush\npull\n"},
+		{MergeNewest, 3000, 2000, ""},
+	}
+	for _, tc := range testCases {
+		local := newTree(map[string]string{"f": "local"}, tc.localModified)
+		remote := newTree(nil, tc.deleted)
+		output, err := local.PullWorklog(&config.C{}, base, remote, tc.strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output != tc.want {
+			t.Errorf("%s, local modified at %d, deleted at %d: got %q, want %q", tc.strategy, tc.localModified, tc.deleted, output, tc.want)
+		}
+	}
+
+	t.Run("manual", func(t *testing.T) {
+		local := newTree(map[string]string{"f": "local"}, 2000)
+		remote := newTree(nil, 3000)
+		output, err := local.PullWorklog(&config.C{}, base, remote, MergeManual)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(output, "# unlink f\n") || !strings.Contains(output, "# keep-local-for ") {
+			t.Errorf("got %q, want hints to resolve the conflict", output)
+		}
+	})
+}
@@ -1,33 +1,139 @@
 package tree
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"time"
 
+	"github.com/nicolagi/muscle/internal/block"
 	"github.com/nicolagi/muscle/internal/debug"
+	"github.com/nicolagi/muscle/internal/linuxerr"
+	"github.com/nicolagi/muscle/internal/storage"
 )
 
 func (tree *Tree) Seal() error {
 	if tree.readOnly {
 		return ErrReadOnly
 	}
+	// Nodes are sealed from memory, the outcome of the flush only
+	// matters to the staging area.
+	if err := tree.FinishFlush(); err != nil {
+		log.Printf("tree.Tree.Seal: flush in progress failed: %v", err)
+	}
 	if err := tree.seal(tree.root); err != nil {
 		return err
 	}
-	return tree.store.updateLocalRootPointer(tree.root.pointer)
+	if err := tree.store.updateLocalRootPointer(tree.root.pointer); err != nil {
+		return err
+	}
+	// The staged nodes pointing to the blocks deleted by sealing are
+	// no longer reachable.
+	if err := tree.store.blockFactory.ClearSealJournal(); err != nil {
+		log.Printf("tree.Tree.Seal: %v", err)
+	}
+	// No block is backed by the staging area any more.
+	n := tree.store.blockFactory.DeleteStaging(tree.unswept)
+	tree.unswept = nil
+	n += tree.store.blockFactory.SweepStaging()
+	if tree.store.metadataFactory != tree.store.blockFactory {
+		n += tree.store.metadataFactory.SweepStaging()
+	}
+	if n > 0 {
+		debug.Logf(debug.Info, "tree.Tree.Seal: deleted %d staged values", n)
+	}
+	return nil
+}
+
+// UnsealedBlocks returns the refs of the staged data blocks of the
+// tree, to upload them with Store.Preseal before sealing. Call Flush
+// first, or the dirty blocks won't be staged yet.
+func (tree *Tree) UnsealedBlocks() ([]block.IndexRef, error) {
+	var refs []block.IndexRef
+	err := tree.unsealedBlocks("UnsealedBlocks", tree.root, 0, false, &refs)
+	return refs, err
+}
+
+// RecoverStaging reattaches or quarantines the values in the staging
+// area, listed by staging, that the tree doesn't use, see
+// block.Factory.RecoverStaging. The refs in use are those of all the
+// staged blocks of the tree, of the nodes as well as of their data, so
+// nothing is recovered unless all the staged nodes load. It must run
+// before the tree changes, e.g., at startup. It also counts the staged
+// refs, see CountStaged.
+func (tree *Tree) RecoverStaging(ctx context.Context, staging storage.Lister, quarantine storage.Store) (block.StagingRecovery, error) {
+	var refs []block.IndexRef
+	if err := tree.unsealedBlocks("RecoverStaging", tree.root, 0, true, &refs); err != nil {
+		return block.StagingRecovery{}, err
+	}
+	r, err := tree.store.blockFactory.RecoverStaging(ctx, staging, refs, quarantine)
+	if err != nil {
+		return r, fmt.Errorf("tree.Tree.RecoverStaging: %w", err)
+	}
+	tree.store.blockFactory.CountStaged(refs)
+	return r, nil
+}
+
+// CountStaged makes the block factory count the blocks of the tree
+// referring to each staged value, so that values no longer used are
+// deleted after each flush rather than only after sealing, see
+// block.Factory.CountStaged. RecoverStaging does it too. It must run
+// before the tree changes, e.g., at startup.
+func (tree *Tree) CountStaged() error {
+	var refs []block.IndexRef
+	if err := tree.unsealedBlocks("CountStaged", tree.root, 0, true, &refs); err != nil {
+		return err
+	}
+	tree.store.blockFactory.CountStaged(refs)
+	return nil
+}
+
+func (tree *Tree) unsealedBlocks(method string, node *Node, depth int, nodes bool, refs *[]block.IndexRef) error {
+	if node.flags&sealed != 0 {
+		return nil
+	}
+	if depth > tree.maxDepth {
+		return fmt.Errorf("tree.Tree.%s: %v: deeper than %d: %w", method, node, tree.maxDepth, linuxerr.ELOOP)
+	}
+	if node.flags&loaded == 0 {
+		if err := tree.store.LoadNode(node); err != nil {
+			return fmt.Errorf("tree.Tree.%s: %v: %w", method, node, err)
+		}
+		if node.flags&sealed != 0 {
+			return nil
+		}
+	}
+	// A node never flushed has no pointer yet.
+	if nodes && len(node.pointer) > 0 {
+		if ref, err := block.NewRef([]byte(node.pointer)); err == nil {
+			if ref, ok := ref.(block.IndexRef); ok {
+				*refs = append(*refs, ref)
+			}
+		}
+	}
+	for _, child := range node.children {
+		if err := tree.unsealedBlocks(method, child, depth+1, nodes, refs); err != nil {
+			return err
+		}
+	}
+	for _, b := range node.blocks {
+		if ref, ok := b.Ref().(block.IndexRef); ok {
+			*refs = append(*refs, ref)
+		}
+	}
+	return nil
 }
 
 func (tree *Tree) seal(node *Node) error {
 	debug.Assert(node.flags&unlinked == 0)
 	// Might've been loaded but then trimmed; in that case we still now whether it's sealed or not.
 	if node.flags&sealed != 0 {
-		log.Printf("Already sealed: %v", node)
+		debug.Logf(debug.Debug, "Already sealed: %v", node)
 		return nil
 	}
 
 	if node.flags&loaded == 0 {
-		log.Printf("Loading node: %v", node)
+		debug.Logf(debug.Debug, "Loading node: %v", node)
 		if err := tree.store.LoadNode(node); err != nil {
 			// Contrary to tree.Tree.Grow(), we won't handle the case where the node is
 			// not found or the codec necessary to decode it is not found. If we did,
@@ -37,7 +143,7 @@ func (tree *Tree) seal(node *Node) error {
 	}
 	// After loading, we may find it was sealed in fact, e.g., when the node was never loaded.
 	if node.flags&sealed != 0 {
-		log.Printf("Already sealed (after loading): %v", node)
+		debug.Logf(debug.Debug, "Already sealed (after loading): %v", node)
 		return nil
 	}
 	for _, child := range node.children {
@@ -45,39 +151,185 @@ func (tree *Tree) seal(node *Node) error {
 			return err
 		}
 	}
+	node.dirtyChildren = nil
 	for _, b := range node.blocks {
 		if _, err := b.Seal(); err != nil {
 			return err
 		}
 	}
-	log.Printf("Sealing node: %v", node)
+	debug.Logf(debug.Debug, "Sealing node: %v", node)
 	if err := tree.store.SealNode(node); err != nil {
 		return err
 	}
-	log.Printf("Sealed: %v", node)
+	debug.Logf(debug.Debug, "Sealed: %v", node)
 	return nil
 }
 
+// FlushStats describes what a flush wrote to the staging area.
+type FlushStats struct {
+	Nodes    int   // Node metadata blocks written.
+	Blocks   int   // Data blocks written.
+	Bytes    int64 // Size of the data blocks written (before encryption).
+	Started  time.Time
+	Duration time.Duration
+}
+
+// String implements fmt.Stringer.
+func (stats FlushStats) String() string {
+	return fmt.Sprintf("%d nodes, %d blocks, %d bytes in %v", stats.Nodes, stats.Blocks, stats.Bytes, stats.Duration)
+}
+
+// LastFlushStats returns statistics about the most recent flush that
+// actually took place (a flush skipped because one was done recently
+// does not count).
+func (tree *Tree) LastFlushStats() FlushStats {
+	return tree.lastFlushStats
+}
+
+// FlushInterval returns the minimum time between flushes made by
+// FlushIfNotDoneRecently and StartFlush.
+func (tree *Tree) FlushInterval() time.Duration {
+	return tree.flushInterval
+}
+
+// SetFlushInterval changes the minimum time between flushes made by
+// FlushIfNotDoneRecently and StartFlush. Zero means SnapshotFrequency.
+func (tree *Tree) SetFlushInterval(d time.Duration) error {
+	const method = "Tree.SetFlushInterval"
+	switch {
+	case d < 0:
+		return errorf(method, "negative interval %v", d)
+	case d == 0:
+		tree.flushInterval = SnapshotFrequency
+	default:
+		tree.flushInterval = d
+	}
+	return nil
+}
+
+// pendingFlush is a frozen copy of the dirty nodes and blocks of the
+// tree, being written to the staging area.
+type pendingFlush struct {
+	done   chan struct{}
+	frozen []*block.Frozen // Children before parents.
+	nodes  []frozenNode
+	root   storage.Pointer
+	unused []storage.Key // Staged values to delete once root is saved.
+	stats  FlushStats
+	err    error // Set before done is closed.
+}
+
+type frozenNode struct {
+	node   *Node
+	frozen *block.Frozen
+}
+
 // FlushIfNotDoneRecently dumps the in-memory changes to the staging area if not done recently (according to the snapshot frequency constant).
 func (tree *Tree) FlushIfNotDoneRecently() error {
-	if time.Since(tree.lastFlushed) < SnapshotFrequency {
+	done, ok := tree.StartFlush()
+	if !ok {
 		return nil
 	}
-	err := tree.depthFirstSave(tree.root)
-	if err != nil {
-		return err
+	<-done
+	return tree.FinishFlush()
+}
+
+// StartFlush is like FlushIfNotDoneRecently, but the changes are
+// written in the background, so that the tree can keep changing in the
+// meantime. It freezes the dirty nodes and blocks, which are no longer
+// dirty unless changed again, and starts writing them. Once the
+// returned channel is closed, FinishFlush must be called. If a flush
+// is in progress already, StartFlush returns its channel instead. It
+// returns false if no flush is needed.
+func (tree *Tree) StartFlush() (done <-chan struct{}, ok bool) {
+	if tree.pending != nil {
+		return tree.pending.done, true
+	}
+	if time.Since(tree.lastFlushed) < tree.flushInterval {
+		return nil, false
 	}
+	pending := &pendingFlush{
+		done:  make(chan struct{}),
+		stats: FlushStats{Started: time.Now()},
+	}
+	tree.pending = pending
 	if tree.readOnly {
-		return ErrReadOnly
+		pending.err = ErrReadOnly
+	} else {
+		pending.err = tree.freeze(tree.root, pending)
+		pending.root = tree.root.pointer
+		// Those released by freezing too, for the root doesn't refer
+		// to them.
+		pending.unused = append(tree.unswept, tree.store.blockFactory.UnusedStaging()...)
+		tree.unswept = nil
 	}
-	err = tree.store.updateLocalRootPointer(tree.root.pointer)
-	if err != nil {
+	if pending.err != nil {
+		close(pending.done)
+		return pending.done, true
+	}
+	go func() {
+		for _, f := range pending.frozen {
+			if err := f.Flush(); err != nil {
+				pending.err = err
+				break
+			}
+		}
+		close(pending.done)
+	}()
+	return pending.done, true
+}
+
+// FinishFlush waits for the flush in progress, if any, and applies its
+// outcome to the tree. It must be serialized with all other operations
+// on the tree. If writing failed, the frozen nodes are marked dirty
+// again, to be written by the next flush.
+func (tree *Tree) FinishFlush() error {
+	pending := tree.pending
+	if pending == nil {
+		return nil
+	}
+	<-pending.done
+	tree.pending = nil
+	if pending.err != nil {
+		for _, fn := range pending.nodes {
+			fn.node.markDirty()
+		}
+		tree.unswept = append(tree.unswept, pending.unused...)
+		return pending.err
+	}
+	for _, f := range pending.frozen {
+		f.Done()
+	}
+	for _, fn := range pending.nodes {
+		// The node was sealed or discarded after being frozen.
+		if !fn.node.pointer.Equals(storage.Pointer(fn.frozen.Ref().Bytes())) {
+			fn.frozen.Discard()
+		}
+	}
+	if err := tree.store.updateLocalRootPointer(pending.root); err != nil {
+		tree.unswept = append(tree.unswept, pending.unused...)
 		return err
 	}
+	if n := tree.store.blockFactory.DeleteStaging(pending.unused); n > 0 {
+		debug.Logf(debug.Info, "tree.Tree.FinishFlush: deleted %d staged values", n)
+	}
 	tree.lastFlushed = time.Now()
+	pending.stats.Duration = tree.lastFlushed.Sub(pending.stats.Started)
+	tree.lastFlushStats = pending.stats
 	return nil
 }
 
+// Dirty tells whether the tree changed since it was last flushed.
+func (tree *Tree) Dirty() bool {
+	return tree.root.flags&dirty != 0
+}
+
+// Revision returns the key of the revision the tree was loaded from or
+// last pushed as, or storage.Null if none.
+func (tree *Tree) Revision() storage.Pointer {
+	return tree.revision
+}
+
 // TODO This is a very ugly hack
 func (tree *Tree) SetRevision(r *Revision) {
 	if !tree.root.pointer.Equals(r.rootKey) {
@@ -86,23 +338,34 @@ func (tree *Tree) SetRevision(r *Revision) {
 	tree.revision = r.key
 }
 
-func (tree *Tree) depthFirstSave(node *Node) error {
+func (tree *Tree) freeze(node *Node, pending *pendingFlush) error {
 	debug.Assert(node.flags&unlinked == 0)
 	if node.flags&dirty == 0 {
 		return nil
 	}
-	for _, child := range node.children {
-		if err := tree.depthFirstSave(child); err != nil {
-			return err
+	for child := range node.dirtyChildren {
+		if child.parent == node && child.flags&unlinked == 0 {
+			if err := tree.freeze(child, pending); err != nil {
+				return err
+			}
 		}
+		delete(node.dirtyChildren, child)
 	}
 	for _, b := range node.blocks {
-		_, err := b.Flush()
-		if err != nil {
-			return err
+		if f := b.Freeze(); f != nil {
+			pending.frozen = append(pending.frozen, f)
+			pending.stats.Blocks++
+			pending.stats.Bytes += int64(f.Len())
 		}
 	}
-	return tree.store.StoreNode(node)
+	f, err := tree.store.freezeNode(node)
+	if err != nil {
+		return err
+	}
+	pending.frozen = append(pending.frozen, f)
+	pending.nodes = append(pending.nodes, frozenNode{node: node, frozen: f})
+	pending.stats.Nodes++
+	return nil
 }
 
 // When marking a node dirty (i.e., to be persisted because it changed contents
@@ -118,7 +381,17 @@ func (tree *Tree) depthFirstSave(node *Node) error {
 // from such pack (or packs would keep growing). (This mechanism makes for
 // bigger node metadata blocks but fewer overall node metadata blocks.)
 func (node *Node) markDirty() {
-	if node == nil || node.flags&dirty != 0 || node.flags&unlinked != 0 {
+	if node == nil || node.flags&unlinked != 0 {
+		return
+	}
+	// Even if already dirty, the node may have been moved to a new parent.
+	if p := node.parent; p != nil {
+		if p.dirtyChildren == nil {
+			p.dirtyChildren = make(map[*Node]struct{})
+		}
+		p.dirtyChildren[node] = struct{}{}
+	}
+	if node.flags&dirty != 0 {
 		return
 	}
 	node.flags |= dirty
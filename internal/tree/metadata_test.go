@@ -1,8 +1,10 @@
 package tree
 
 import (
+	"context"
 	"testing"
 
+	"github.com/nicolagi/muscle/internal/block"
 	"github.com/nicolagi/muscle/internal/storage"
 	"github.com/stretchr/testify/assert"
 )
@@ -39,3 +41,190 @@ func TestMarkDirty(t *testing.T) {
 		assert.Equal(t, expected, a.pointer)
 	})
 }
+
+func TestTreeUnsealedBlocks(t *testing.T) {
+	tree, err := NewTree(newTestStore(t), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	file, err := tree.Add(root, "file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.WriteAt([]byte("staged"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	refs, err := tree.UnsealedBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0] != file.blocks[0].Ref() {
+		t.Errorf("got %v, want the file's block", refs)
+	}
+	if err := tree.store.Preseal(refs); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	if refs, err := tree.UnsealedBlocks(); err != nil || len(refs) != 0 {
+		t.Errorf("got %v, %v, want no blocks after sealing", refs, err)
+	}
+}
+
+func TestTreeRecoverStaging(t *testing.T) {
+	index := &storage.InMemory{}
+	factory, err := block.NewFactory(index, &storage.InMemory{}, make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(factory, nil, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := NewTree(store, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	dir, err := tree.Add(root, "dir", 0700|DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := tree.Add(dir, "file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.WriteAt([]byte("staged"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	orphan := storage.Key("00112233445566778899aabbccddeeff")
+	if err := index.Put(orphan, storage.Value("left behind")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start over from the staged root, as after a crash.
+	tree, err = NewTree(store, WithRoot(root.pointer), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	quarantine := &storage.InMemory{}
+	r, err := tree.RecoverStaging(context.Background(), index, quarantine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Orphaned != 1 || r.Quarantined != 1 {
+		t.Errorf("got %+v, want the one orphan quarantined", r)
+	}
+	if ok, _ := quarantine.Contains(orphan); !ok {
+		t.Error("orphan not in quarantine")
+	}
+	if ok, _ := index.Contains(orphan); ok {
+		t.Error("orphan still staged")
+	}
+	nodes, err := tree.Walk(tree.root, "dir", "file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 6)
+	if n, err := nodes[len(nodes)-1].ReadAt(b, 0); err != nil || string(b[:n]) != "staged" {
+		t.Errorf("got %q, %v, want the staged contents", b[:n], err)
+	}
+}
+
+func TestTreeFlushDeletesUnusedStaging(t *testing.T) {
+	index := &storage.InMemory{}
+	factory, err := block.NewFactory(index, &storage.InMemory{}, make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(factory, nil, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := NewTree(store, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	for _, name := range []string{"a", "b"} {
+		f, err := tree.Add(root, name, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.WriteAt([]byte("same"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Start over from the staged root, as after a restart.
+	tree, err = NewTree(store, WithRoot(root.pointer), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.CountStaged(); err != nil {
+		t.Fatal(err)
+	}
+	rewrite := func(name, value string) block.Ref {
+		t.Helper()
+		nodes, err := tree.Walk(tree.root, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := nodes[0]
+		before := f.blocks[0].Ref()
+		if err := f.WriteAt([]byte(value), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return before
+	}
+	staged := func(ref block.Ref) bool {
+		t.Helper()
+		ok, err := index.Contains(ref.Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	same := rewrite("a", "abc1")
+	if !staged(same) {
+		t.Error("deleted a value another file uses")
+	}
+	if prev := rewrite("a", "abc2"); staged(prev) {
+		t.Errorf("%v still staged after the last block moved off it", prev)
+	}
+	rewrite("b", "abc2")
+	if staged(same) {
+		t.Errorf("%v still staged after the last block moved off it", same)
+	}
+
+	// What's staged is what the tree refers to.
+	tree, err = NewTree(store, WithRoot(tree.root.pointer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		nodes, err := tree.Walk(tree.root, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := make([]byte, 4)
+		if n, err := nodes[0].ReadAt(p, 0); err != nil || string(p[:n]) != "abc2" {
+			t.Errorf("%s: got %q, %v, want %q", name, p[:n], err, "abc2")
+		}
+	}
+}
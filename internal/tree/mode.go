@@ -0,0 +1,57 @@
+package tree
+
+import "fmt"
+
+// Mode bits that nodes can't have, and why.
+var unsupportedModes = []struct {
+	bit    uint32
+	reason string
+}{
+	{DMMOUNT, "mounted channels are not supported"},
+	{DMAUTH, "authentication files are not supported"},
+	{DMTMP, "temporary files are not supported"},
+	{DMSYMLINK, "symbolic links are not supported"},
+	{DMLINK, "hard links are not supported"},
+	{DMDEVICE, "device files are not supported"},
+	{DMNAMEDPIPE, "named pipes are not supported"},
+	{DMSOCKET, "sockets are not supported"},
+	{DMSETUID, "setuid files are not supported"},
+	{DMSETGID, "setgid files are not supported"},
+}
+
+// Mode bits that nodes can have.
+const validMode = 0x000001ff | DMDIR | DMAPPEND | DMEXCL
+
+// CheckMode returns an error wrapping ErrMode if the mode is not valid
+// for a new node, if node is nil, or as the new mode of the node:
+//
+//   - only the permission bits, DMDIR, DMAPPEND, and DMEXCL can be set;
+//   - directories can't be append-only or exclusive;
+//   - append-only files can't be exclusive;
+//   - a file can't become a directory, nor a directory a file.
+func CheckMode(node *Node, mode uint32) error {
+	for _, u := range unsupportedModes {
+		if mode&u.bit != 0 {
+			return fmt.Errorf("%s: %w", u.reason, ErrMode)
+		}
+	}
+	if extra := mode &^ validMode; extra != 0 {
+		return fmt.Errorf("unrecognized mode bits %#x: %w", extra, ErrMode)
+	}
+	if mode&DMDIR != 0 && mode&(DMAPPEND|DMEXCL) != 0 {
+		return fmt.Errorf("directories can't be append-only or exclusive: %w", ErrMode)
+	}
+	if mode&DMAPPEND != 0 && mode&DMEXCL != 0 {
+		return fmt.Errorf("append-only files can't be exclusive: %w", ErrMode)
+	}
+	if node == nil {
+		return nil
+	}
+	if node.IsDir() && mode&DMDIR == 0 {
+		return fmt.Errorf("a directory cannot become a regular file: %w", ErrMode)
+	}
+	if !node.IsDir() && mode&DMDIR != 0 {
+		return fmt.Errorf("a regular file cannot become a directory: %w", ErrMode)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package tree
+
+import (
+	"errors"
+	"testing"
+	"testing/quick"
+)
+
+func TestCheckMode(t *testing.T) {
+	tree, err := NewTree(newTestStore(t), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	file, err := tree.Add(root, "file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := tree.Add(root, "dir", 0700|DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every combination of the supported bits, for a new node, a file,
+	// and a directory.
+	nodes := []struct {
+		name string
+		node *Node
+	}{{"new", nil}, {"file", file}, {"dir", dir}}
+	for bits := uint32(0); bits < 8; bits++ {
+		mode := 0644 | bits<<29
+		isDir, appendOnly, exclusive := mode&DMDIR != 0, mode&DMAPPEND != 0, mode&DMEXCL != 0
+		for _, n := range nodes {
+			valid := !(isDir && (appendOnly || exclusive)) && !(appendOnly && exclusive)
+			if n.node != nil && n.node.IsDir() != isDir {
+				valid = false
+			}
+			err := CheckMode(n.node, mode)
+			if valid && err != nil {
+				t.Errorf("%s, %#x: got %v, want nil", n.name, mode, err)
+			}
+			if !valid && !errors.Is(err, ErrMode) {
+				t.Errorf("%s, %#x: got %v, want %v", n.name, mode, err, ErrMode)
+			}
+		}
+	}
+
+	// Create and Wstat agree: a mode is accepted by Add if and only if
+	// it is accepted by CheckMode, and by SetMode on a node of the same
+	// kind, which then has exactly that mode.
+	f := func(mode uint32) bool {
+		err := CheckMode(nil, mode)
+		if (err == nil) != (mode&^validMode == 0 && mode&(DMAPPEND|DMEXCL) != DMAPPEND|DMEXCL && (mode&DMDIR == 0 || mode&(DMAPPEND|DMEXCL) == 0)) {
+			return false
+		}
+		if err != nil && !errors.Is(err, ErrMode) {
+			return false
+		}
+		node, addErr := tree.Add(root, "new", mode)
+		if (addErr == nil) != (err == nil) {
+			return false
+		}
+		if addErr == nil {
+			if node.info.Mode != mode {
+				return false
+			}
+			if err := tree.Unlink(node); err != nil {
+				return false
+			}
+		}
+		target := file
+		if mode&DMDIR != 0 {
+			target = dir
+		}
+		if err := target.SetMode(mode); (err == nil) != (CheckMode(nil, mode) == nil) {
+			return false
+		} else if err == nil && target.info.Mode != mode {
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+	// Random modes mostly have unsupported bits set.
+	for _, mode := range []uint32{0, 0777, DMDIR | 0700, DMAPPEND | 0600, DMEXCL | 0600, DMSETUID | 0755, 0x1000} {
+		if !f(mode) {
+			t.Errorf("%#x: Add, SetMode, and CheckMode disagree", mode)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package tree
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nicolagi/muscle/internal/linuxerr"
+)
+
+// Policies for names that are valid but likely to cause trouble, e.g.,
+// when exporting to other file systems, see WithNamePolicy.
+const (
+	NamesAllow     = "allow"
+	NamesReject    = "reject"
+	NamesNormalize = "normalize"
+)
+
+// Names longer than this many bytes are rejected, as most file systems
+// would.
+const maxNameLength = 255
+
+// CheckName returns the name to give a node being created or renamed,
+// or an error wrapping linuxerr.EINVAL if the name is unacceptable.
+// Names that could not be walked to, i.e., the empty name, ".", "..",
+// and names containing a slash, are always rejected, as are names too
+// long, with linuxerr.ENAMETOOLONG. Names that are
+// not valid UTF-8 or have trailing spaces are accepted, rejected, or
+// normalized (invalid bytes replaced by U+FFFD, trailing spaces
+// removed) according to the tree's name policy.
+func (tree *Tree) CheckName(name string) (string, error) {
+	if tree.namePolicy == NamesNormalize {
+		name = strings.TrimRight(strings.ToValidUTF8(name, string(utf8.RuneError)), " ")
+	}
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", fmt.Errorf("name %q: %w", name, linuxerr.EINVAL)
+	}
+	if len(name) > maxNameLength {
+		return "", fmt.Errorf("name of %d bytes: %w", len(name), linuxerr.ENAMETOOLONG)
+	}
+	if tree.namePolicy == NamesReject {
+		if !utf8.ValidString(name) {
+			return "", fmt.Errorf("name %q: invalid UTF-8: %w", name, linuxerr.EINVAL)
+		}
+		if strings.HasSuffix(name, " ") {
+			return "", fmt.Errorf("name %q: trailing space: %w", name, linuxerr.EINVAL)
+		}
+	}
+	return name, nil
+}
+
+// DuplicateName describes a node with the same name as an earlier
+// sibling, which hides it from walks.
+type DuplicateName struct {
+	Path    string // Shared with the earlier sibling.
+	NewName string // Set if the node was renamed.
+}
+
+// CheckNames loads the whole tree looking for nodes with the same name
+// as an earlier sibling (or a name differing in case only, if the tree
+// is case insensitive). If repair is set, it renames each such node
+// by appending ".dupeN" to its name, with N the smallest positive
+// integer giving an unused name. Since the order of children is
+// persisted, repairs are deterministic.
+func (tree *Tree) CheckNames(repair bool) (dupes []DuplicateName, err error) {
+	if repair && tree.readOnly {
+		return nil, ErrReadOnly
+	}
+	key := func(name string) string {
+		if tree.caseInsensitive {
+			return strings.ToLower(name)
+		}
+		return name
+	}
+	var check func(*Node) error
+	check = func(node *Node) error {
+		if node.info.Mode&DMDIR == 0 {
+			return nil
+		}
+		if err := tree.Grow(node); err != nil {
+			return err
+		}
+		seen := make(map[string]struct{}, len(node.children))
+		for _, c := range node.children {
+			seen[key(c.info.Name)] = struct{}{}
+		}
+		used := make(map[string]struct{}, len(node.children))
+		for _, c := range node.children {
+			k := key(c.info.Name)
+			if _, ok := used[k]; !ok {
+				used[k] = struct{}{}
+				continue
+			}
+			d := DuplicateName{Path: c.Path()}
+			if repair {
+				for n := 1; ; n++ {
+					name := fmt.Sprintf("%s.dupe%d", c.info.Name, n)
+					if _, ok := seen[key(name)]; !ok {
+						d.NewName = name
+						break
+					}
+				}
+				seen[key(d.NewName)] = struct{}{}
+				c.info.Name = d.NewName
+				c.markDirty()
+				node.info.Version++
+				node.markDirty()
+			}
+			dupes = append(dupes, d)
+		}
+		for _, c := range node.children {
+			if err := check(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = check(tree.root)
+	return
+}
@@ -0,0 +1,131 @@
+package tree
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/linuxerr"
+)
+
+func TestTreeCheckName(t *testing.T) {
+	testCases := []struct {
+		policy string
+		name   string
+		want   string // Empty if the name must be rejected.
+	}{
+		{NamesAllow, "", ""},
+		{NamesAllow, ".", ""},
+		{NamesAllow, "..", ""},
+		{NamesAllow, "a/b", ""},
+		{NamesAllow, "a b", "a b"},
+		{NamesAllow, "a ", "a "},
+		{NamesAllow, "a\xff", "a\xff"},
+		{NamesReject, "a ", ""},
+		{NamesReject, "a\xff", ""},
+		{NamesReject, "à", "à"},
+		{NamesNormalize, "a  ", "a"},
+		{NamesNormalize, "a\xff", "a�"},
+		{NamesNormalize, "   ", ""},
+		{NamesNormalize, ".. ", ""},
+	}
+	for _, tc := range testCases {
+		tree, err := NewTree(newTestStore(t), WithMutable(), WithNamePolicy(tc.policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := tree.CheckName(tc.name)
+		if tc.want == "" {
+			if !errors.Is(err, linuxerr.EINVAL) {
+				t.Errorf("%s %q: got %q, %v, want a wrapper of %v", tc.policy, tc.name, got, err, linuxerr.EINVAL)
+			}
+		} else if got != tc.want || err != nil {
+			t.Errorf("%s %q: got %q, %v, want %q", tc.policy, tc.name, got, err, tc.want)
+		}
+	}
+	tree, err := NewTree(newTestStore(t), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.CheckName(strings.Repeat("x", maxNameLength)); err != nil {
+		t.Errorf("got %v, want nil", err)
+	}
+	if _, err := tree.CheckName(strings.Repeat("x", maxNameLength+1)); !errors.Is(err, linuxerr.ENAMETOOLONG) {
+		t.Errorf("got %v, want a wrapper of %v", err, linuxerr.ENAMETOOLONG)
+	}
+}
+
+func TestTreeNamePolicyOnRename(t *testing.T) {
+	tree, err := NewTree(newTestStore(t), WithMutable(), WithNamePolicy(NamesNormalize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	file, err := tree.Add(root, "notes ", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := file.Path(), "/notes"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := tree.Rename("notes", "todo "); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := file.Path(), "/todo"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if err := tree.Rename("todo", ".."); !errors.Is(err, linuxerr.EINVAL) {
+		t.Errorf("got %v, want a wrapper of %v", err, linuxerr.EINVAL)
+	}
+}
+
+func TestTreeCheckNames(t *testing.T) {
+	tree, err := NewTree(newTestStore(t), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	dir, err := tree.Add(root, "dir", 0700|DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []*Node
+	for _, name := range []string{"a", "a.dupe1", "b"} {
+		f, err := tree.Add(dir, name, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+	// Simulate the outcome of a bad merge.
+	files[1].info.Name = "a"
+	files[2].info.Name = "a"
+
+	dupes, err := tree.CheckNames(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DuplicateName{{Path: "/dir/a"}, {Path: "/dir/a"}}
+	if !reflect.DeepEqual(dupes, want) {
+		t.Errorf("got %v, want %v", dupes, want)
+	}
+
+	dupes, err = tree.CheckNames(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []DuplicateName{{Path: "/dir/a", NewName: "a.dupe1"}, {Path: "/dir/a", NewName: "a.dupe2"}}
+	if !reflect.DeepEqual(dupes, want) {
+		t.Errorf("got %v, want %v", dupes, want)
+	}
+	for i, want := range []string{"/dir/a", "/dir/a.dupe1", "/dir/a.dupe2"} {
+		if got := files[i].Path(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	if dupes, err := tree.CheckNames(false); err != nil || len(dupes) != 0 {
+		t.Errorf("got %v, %v, want no duplicates left", dupes, err)
+	}
+}
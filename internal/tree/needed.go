@@ -0,0 +1,146 @@
+package tree
+
+import (
+	"math"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// NeededKeys returns the keys reachable from the retained revisions:
+// the latest count revisions in the lineage of each of the tags (all
+// of them if count is not positive), the older ones pushed with the
+// retention hint, the revisions listed under KeepKey, the revision
+// VerifiedTag points to, the pinned revisions, the checkpoints, and
+// the given live tree. The revisions between the latest and those
+// older ones are kept too, but not their trees. The live tree is
+// visited first. Each retained revision is loaded as a tree of its own,
+// but not below the nodes whose keys were visited already, so what it
+// shares with the live tree or an earlier revision is loaded at most
+// down to the shared nodes.
+func (s *Store) NeededKeys(live *Tree, tagNames []string, count int, pinned []storage.Pointer) (map[string]struct{}, error) {
+	const method = "Store.NeededKeys"
+	needed := make(map[string]struct{})
+	if _, err := live.ReachableKeys(needed); err != nil {
+		return nil, errorf(method, "live tree: %v", err)
+	}
+	if err := s.AddRetainedKeys(needed, tagNames, count, pinned); err != nil {
+		return nil, err
+	}
+	return needed, nil
+}
+
+// AddRetainedKeys is like NeededKeys, but the keys of the live tree are
+// in needed already, e.g., as collected by LoadedKeys and
+// AddReachableKeys, and it adds those of the retained revisions.
+func (s *Store) AddRetainedKeys(needed map[string]struct{}, tagNames []string, count int, pinned []storage.Pointer) error {
+	const method = "Store.AddRetainedKeys"
+	if count <= 0 {
+		count = math.MaxInt32
+	}
+	// The live tree may have changed since its revision, which is in
+	// needed already, so revisions retained are tracked separately.
+	retained := make(map[string]struct{})
+	retain := func(revision storage.Pointer) error {
+		if _, ok := retained[revision.Hex()]; ok {
+			return nil
+		}
+		retained[revision.Hex()] = struct{}{}
+		t, err := NewTree(s, WithRevision(revision))
+		if err != nil {
+			return errorf(method, "revision %v: %v", revision, err)
+		}
+		if _, err := t.ReachableKeys(needed); err != nil {
+			return errorf(method, "revision %v: %v", revision, err)
+		}
+		return nil
+	}
+	for _, name := range tagNames {
+		tag, err := s.RemoteTag(name)
+		if err != nil {
+			return errorv(method, err)
+		}
+		if tag.Pointer.IsNull() {
+			continue
+		}
+		head, err := s.LoadRevisionByKey(tag.Pointer)
+		if err != nil {
+			return errorv(method, err)
+		}
+		// A truncated history would make needed keys look like
+		// garbage, so it's an error.
+		rr, err := s.History(count, head, name)
+		if err != nil {
+			return errorv(method, err)
+		}
+		for _, r := range rr {
+			if err := retain(r.Key()); err != nil {
+				return err
+			}
+		}
+		if len(rr) < count {
+			continue
+		}
+		// Older revisions are only retained if pushed with the
+		// retention hint, together with the revisions between them,
+		// without their trees, for the history to reach them. An
+		// earlier clean deleted those older than the oldest retained,
+		// so the history ends there.
+		var between []storage.Pointer
+		for r := rr[len(rr)-1]; ; {
+			tag, ok := r.Parent(name)
+			if !ok || tag.Pointer.IsNull() {
+				break
+			}
+			r, err = s.LoadRevisionByKey(tag.Pointer)
+			if err != nil {
+				if ok, cerr := s.containsRevision(tag.Pointer); cerr == nil && !ok {
+					break
+				}
+				return errorv(method, err)
+			}
+			between = append(between, r.Key())
+			if r.Keep() {
+				for _, p := range between {
+					needed[p.Hex()] = struct{}{}
+				}
+				between = nil
+				if err := retain(r.Key()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// So that the revision verified as restorable stays so.
+	verified, err := s.RemoteTag(VerifiedTag)
+	if err != nil {
+		return errorv(method, err)
+	}
+	if !verified.Pointer.IsNull() {
+		if err := retain(verified.Pointer); err != nil {
+			return err
+		}
+	}
+	kept, err := s.KeptRevisions()
+	if err != nil {
+		return errorv(method, err)
+	}
+	for _, revision := range append(kept, pinned...) {
+		if err := retain(revision); err != nil {
+			return err
+		}
+	}
+	cps, err := s.Checkpoints()
+	if err != nil {
+		return errorv(method, err)
+	}
+	for _, cp := range cps {
+		t, err := NewTree(s, WithRoot(cp.Root))
+		if err != nil {
+			return errorf(method, "checkpoint %s: %v", cp.Name, err)
+		}
+		if _, err := t.ReachableKeys(needed); err != nil {
+			return errorf(method, "checkpoint %s: %v", cp.Name, err)
+		}
+	}
+	return nil
+}
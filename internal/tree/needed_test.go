@@ -0,0 +1,180 @@
+package tree
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestStoreNeededKeys(t *testing.T) {
+	s := newTestStore(t)
+	s.pointers = &storage.InMemory{}
+	live, err := NewTree(s, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := live.Root()
+	file, err := live.Add(root, "file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(content string) storage.Pointer {
+		t.Helper()
+		if err := file.WriteAt([]byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := live.Seal(); err != nil {
+			t.Fatal(err)
+		}
+		_, root := live.Root()
+		return root.pointer
+	}
+	pushed := write("pushed")
+	tags, err := s.RemoteTags([]string{"base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root = live.Root()
+	revision := NewRevision(root, tags)
+	if err := s.StoreRevision(revision); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateRemoteTags(tags, revision.Key()); err != nil {
+		t.Fatal(err)
+	}
+	live.SetRevision(revision)
+	// The live tree changes after the revision it is based on.
+	changed := write("changed")
+
+	needed, err := s.NeededKeys(live, []string{"base"}, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []storage.Pointer{revision.Key(), pushed, changed} {
+		if _, ok := needed[p.Hex()]; !ok {
+			t.Errorf("%v not needed", p)
+		}
+	}
+}
+
+func TestStoreNeededKeysKeep(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	repository := &storage.InMemory{}
+	factory, err := block.NewFactory(&storage.InMemory{}, repository, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStore(factory, &storage.InMemory{}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := NewTree(s, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := live.Root()
+	file, err := live.Add(root, "file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := func(content string, keep bool) *Revision {
+		t.Helper()
+		if err := file.WriteAt([]byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := live.Seal(); err != nil {
+			t.Fatal(err)
+		}
+		tags, err := s.RemoteTags([]string{"base"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, root := live.Root()
+		revision := NewRevision(root, tags)
+		revision.SetKeep(keep)
+		if err := s.StoreRevision(revision); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateRemoteTags(tags, revision.Key()); err != nil {
+			t.Fatal(err)
+		}
+		live.SetRevision(revision)
+		return revision
+	}
+	ancient := push("ancient", false)
+	hinted := push("hinted", true)
+	dropped := push("dropped", false)
+	listed := push("listed", false)
+	latest := push("latest", false)
+	if err := s.SetKept(listed.Key(), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetKept(hinted.Key(), false); err == nil {
+		t.Error("got no error removing a revision pushed with the retention hint")
+	}
+	if kept, err := s.KeptRevisions(); err != nil || len(kept) != 1 || !kept[0].Equals(listed.Key()) {
+		t.Errorf("got %v, %v, want only %v", kept, err, listed.Key())
+	}
+
+	check := func() {
+		t.Helper()
+		needed, err := s.NeededKeys(live, []string{"base"}, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range []*Revision{hinted, listed, latest} {
+			if _, ok := needed[r.Key().Hex()]; !ok {
+				t.Errorf("%v not needed", r.Key())
+			}
+			if _, ok := needed[r.RootKey().Hex()]; !ok {
+				t.Errorf("root %v not needed", r.RootKey())
+			}
+		}
+		// The history goes through the revision to the one pushed
+		// with the retention hint, but its tree isn't retained.
+		if _, ok := needed[dropped.Key().Hex()]; !ok {
+			t.Errorf("%v not needed", dropped.Key())
+		}
+		if _, ok := needed[dropped.RootKey().Hex()]; ok {
+			t.Errorf("root %v needed", dropped.RootKey())
+		}
+		if _, ok := needed[ancient.Key().Hex()]; ok {
+			t.Errorf("%v needed", ancient.Key())
+		}
+	}
+	check()
+
+	// The history ends at the revisions deleted by an earlier clean.
+	if err := repository.Delete(storage.Key(ancient.Key().Hex())); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// The revision verified as restorable is retained.
+	if err := s.SetRemoteTags([]string{VerifiedTag}, dropped.Key()); err != nil {
+		t.Fatal(err)
+	}
+	needed, err := s.NeededKeys(live, []string{"base"}, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := needed[dropped.RootKey().Hex()]; !ok {
+		t.Errorf("root %v of the verified revision not needed", dropped.RootKey())
+	}
+	if ok, err := s.Descends(latest.Key(), hinted.Key()); !ok || err != nil {
+		t.Errorf("got %v, %v, want true, nil", ok, err)
+	}
+	if ok, err := s.Descends(hinted.Key(), latest.Key()); ok || err != nil {
+		t.Errorf("got %v, %v, want false, nil", ok, err)
+	}
+
+	if err := s.SetKept(listed.Key(), false); err != nil {
+		t.Fatal(err)
+	}
+	if kept, err := s.KeptRevisions(); err != nil || len(kept) != 0 {
+		t.Errorf("got %v, %v, want none", kept, err)
+	}
+}
@@ -24,9 +24,17 @@ const (
 	sealed nodeFlags = 1 << 2
 	// The node was unlinked from the tree by a merge or rename operation.
 	unlinked nodeFlags = 1 << 3
+	// The node could not be loaded by the last grow of its parent.
+	loadFailed nodeFlags = 1 << 4
+	// The version was bumped by a write since the last EndWrites.
+	versioned nodeFlags = 1 << 5
 	// If you add flags here, add them to nodeFlags.String as well.
 )
 
+// Flags describing the state of a node in memory only. They are never
+// encoded, so that identical nodes encode identically.
+const transientFlags = loaded | dirty | loadFailed | versioned
+
 // String implements fmt.Stringer for debugging purposes.
 func (ff nodeFlags) String() string {
 	if ff == 0 {
@@ -45,7 +53,13 @@ func (ff nodeFlags) String() string {
 	if ff&unlinked != 0 {
 		buf.WriteString("unlinked,")
 	}
-	if ff & ^(loaded|dirty|sealed|unlinked) != 0 {
+	if ff&loadFailed != 0 {
+		buf.WriteString("loadFailed,")
+	}
+	if ff&versioned != 0 {
+		buf.WriteString("versioned,")
+	}
+	if ff & ^(loaded|dirty|sealed|unlinked|loadFailed|versioned) != 0 {
 		buf.WriteString("extraneous,")
 	}
 	buf.Truncate(buf.Len() - 1)
@@ -86,6 +100,23 @@ type Node struct {
 	// relevant for regular files.
 	children []*Node
 	blocks   []*block.Block
+
+	// The children that are dirty, so that flushing does not need to
+	// look at all loaded nodes. It may also contain children that
+	// were since removed, which must be ignored.
+	dirtyChildren map[*Node]struct{}
+
+	// Where the last write ended, to tell sequential writes apart.
+	writeEnd uint64
+
+	// Where the last read started and ended, the distance from the
+	// start of the read before, and how many reads in a row followed
+	// a pattern, to tell sequential and strided reads from seeks, see
+	// fetchAhead.
+	readOff    int64
+	readEnd    int64
+	readStride int64
+	readStreak int
 }
 
 // Info returns a copy of the node's information struct.
@@ -93,6 +124,12 @@ func (node *Node) Info() NodeInfo {
 	return node.info
 }
 
+// Pointer returns the key the node was last stored under, which a dirty
+// node only matches once its tree is flushed.
+func (node *Node) Pointer() storage.Pointer {
+	return node.pointer
+}
+
 func (node *Node) followBranch(name string) (*Node, error) {
 	const method = "Node.followBranch"
 	if node.flags&loaded == 0 {
@@ -142,10 +179,22 @@ func (node *Node) addChild(newChild *Node) error {
 	}
 	newChild.parent = node
 	node.children = append(node.children, newChild)
+	node.info.Version++
 	newChild.markLinked()
 	return nil
 }
 
+// hasAncestor tells whether the given node is the node itself or one of
+// its ancestors. It assumes the chain of ancestors has no loops.
+func (node *Node) hasAncestor(other *Node) bool {
+	for n := node; n != nil; n = n.parent {
+		if n == other {
+			return true
+		}
+	}
+	return false
+}
+
 // Path returns the full path to the node, e.g.,
 // "/src/muscle/tree/node.go". A non-loaded node is represented by an
 // asterisk; as a consequence, a path can take the form
@@ -211,11 +260,11 @@ func (node *Node) hasEqualBlocks(other *Node) (bool, error) {
 	}
 	// Legacy check. File systems should no longer have mixed-size blocks.
 	if node.bsize != other.bsize {
-		log.Printf("Different block sizes (%d and %d), assuming nodes have different contents", node.bsize, other.bsize)
+		debug.Logf(debug.Debug, "Different block sizes (%d and %d), assuming nodes have different contents", node.bsize, other.bsize)
 		return false, nil
 	}
 	if len(node.blocks) != len(other.blocks) {
-		log.Printf("Different number of blocks: %v %v", node, other)
+		debug.Logf(debug.Debug, "Different number of blocks: %v %v", node, other)
 		return false, nil
 	}
 	for i, b := range node.blocks {
@@ -231,10 +280,7 @@ func (node *Node) hasEqualBlocks(other *Node) (bool, error) {
 }
 
 // Ref increments the node's ref count, and that of all its ancestors.
-// It also sets the node's access time. Since we can only stat() after
-// walk(), this means we're updating the atime also to answer a stat
-// syscall. That's not correct. But the use case for atime is, as I said,
-// to track when last used in musclefs. It should perhaps be called last ref'd.
+// Access times are tracked separately, see Tree.Access.
 func (node *Node) Ref() int {
 	for n := node; n != nil; n = n.parent {
 		n.refs++
@@ -242,6 +288,22 @@ func (node *Node) Ref() int {
 	return node.refs
 }
 
+// InUse reports whether the node, or any loaded node below it, is
+// referenced by a fid. The reference counts of ancestors should make
+// the recursion unnecessary, but since losing writes is at stake, we
+// don't rely on that alone.
+func (node *Node) InUse() bool {
+	if node.refs > 0 {
+		return true
+	}
+	for _, c := range node.children {
+		if c.flags&loaded != 0 && c.InUse() {
+			return true
+		}
+	}
+	return false
+}
+
 // Unref decrements the node's ref count, and that of all its ancestors.
 func (node *Node) Unref() int {
 	for n := node; n != nil; n = n.parent {
@@ -277,7 +339,7 @@ func (node *Node) trim() {
 		if node.IsRoot() || node.flags&dirty != 0 || node.refs != 0 || age < minAge {
 			for _, b := range node.blocks {
 				if b.Forget() {
-					log.Printf("Trimmed node %q block %q", node.Path(), b.Ref())
+					debug.Logf(debug.Debug, "Trimmed node %q block %q", node.Path(), b.Ref())
 				}
 			}
 			return
@@ -287,6 +349,7 @@ func (node *Node) trim() {
 		node.info.Name = ""
 		node.blocks = nil
 		node.children = nil
+		node.dirtyChildren = nil
 	}
 
 	aux(node)
@@ -299,11 +362,13 @@ func (node *Node) removeChild(name string) (removedCount int) {
 		if child.info.Name != name {
 			newChildren = append(newChildren, child)
 		} else {
+			delete(node.dirtyChildren, child)
 			removedCount++
 		}
 	}
 	node.children = newChildren
 	if removedCount > 0 {
+		node.info.Version++
 		node.touchNow()
 	}
 	return
@@ -325,11 +390,14 @@ func (node *Node) IsRoot() bool {
 	return node.info.Mode&DMDIR != 0 && node.parent == nil
 }
 
-const validMode = 0x000001ff | DMDIR | DMAPPEND | DMEXCL
-
-func (node *Node) SetMode(mode uint32) {
-	node.info.Mode = mode & validMode
+// SetMode changes the mode of the node, if CheckMode allows it.
+func (node *Node) SetMode(mode uint32) error {
+	if err := CheckMode(node, mode); err != nil {
+		return err
+	}
+	node.info.Mode = mode
 	node.markDirty()
+	return nil
 }
 
 // Rename changes the node's name. If the parent already contains a
@@ -356,6 +424,9 @@ func (node *Node) Rename(newName string) error {
 			}
 		}
 		p.children = kept
+		// The parent's listing changes even if nothing was replaced.
+		p.info.Version++
+		p.markDirty()
 	}
 	node.info.Name = newName
 	node.markDirty()
@@ -441,9 +512,15 @@ func (node *Node) shrink(requestedSize uint64) error {
 }
 
 func (node *Node) WriteAt(p []byte, off int64) error {
-	if node.info.Mode&DMAPPEND != 0 {
+	appending := node.info.Mode&DMAPPEND != 0
+	if appending {
 		off = int64(node.info.Size)
 	}
+	// A flush since the last write ends the write session too, so
+	// that the version flushed isn't also that of later contents.
+	if node.flags&dirty == 0 {
+		node.flags &^= versioned
+	}
 	if err := node.ensureBlocksForWriting(off + int64(len(p))); err != nil {
 		return err
 	}
@@ -451,24 +528,95 @@ func (node *Node) WriteAt(p []byte, off int64) error {
 	if err != nil {
 		return err
 	}
-	node.touchNow()
-	node.info.Version++
+	if appending {
+		node.sealFilledBlocks(uint64(off))
+	}
+	// Editors may write a file in tiny chunks. A write continuing the
+	// previous one in the same block finds the node still dirty, so
+	// only the modification time needs updating.
+	if uint64(off) == node.writeEnd && off%int64(node.bsize) != 0 && node.flags&dirty != 0 {
+		node.info.Modified = uint32(time.Now().Unix())
+	} else {
+		node.touchNow()
+	}
+	node.writeEnd = uint64(off) + uint64(len(p))
+	// The version is bumped once per write session, see EndWrites.
+	if node.flags&versioned == 0 {
+		node.info.Version++
+		node.flags |= versioned
+	}
 	return nil
 }
 
-func (node *Node) write(p []byte, off int64) error {
-	if len(p) == 0 {
-		return nil
+// EndWrites ends a write session, e.g., when a file opened for
+// writing is closed, so that the next write bumps the version again.
+func (node *Node) EndWrites() {
+	node.flags &^= versioned
+	node.writeEnd = 0
+}
+
+// sealFilledBlocks seals the blocks of an append-only file that were
+// filled by appending at the given offset, as they can't change
+// anymore (short of truncating the file). That way, only the last
+// block is dirty, and flushing and sealing the file don't need to
+// write the other blocks again. Errors are only logged, as blocks
+// that failed to seal are written to the staging area as usual.
+func (node *Node) sealFilledBlocks(off uint64) {
+	if node.info.Size == 0 {
+		return
+	}
+	bs := uint64(node.bsize)
+	last := (node.info.Size - 1) / bs
+	for i := off / bs; i < last; i++ {
+		if _, err := node.blocks[i].Seal(); err != nil {
+			log.Printf("tree.Node.sealFilledBlocks: %q block %d: %v", node.Path(), i, err)
+		}
 	}
+}
+
+// write writes p at off across the blocks it spans, which must exist,
+// see ensureBlocksForWriting. The blocks it covers within the current
+// size of the file are overwritten without loading their values, and
+// those it only partly covers are loaded together beforehand.
+func (node *Node) write(p []byte, off int64) error {
 	bs := int64(node.bsize)
-	written, delta, err := node.getBlock(off).Write(p, int(off%bs))
-	if err != nil {
+	end := off + int64(len(p))
+	var partial []*block.Block
+	for i := off / bs; i*bs < end; i++ {
+		if !node.overwrites(i, off, end) {
+			partial = append(partial, node.blocks[i])
+		}
+	}
+	if err := block.Load(partial); err != nil {
 		return err
 	}
-	off -= off % bs
-	off += bs
-	node.info.Size += uint64(delta)
-	return node.write(p[written:], off)
+	for len(p) > 0 {
+		i := off / bs
+		if node.overwrites(i, off, end) {
+			if err := node.blocks[i].Overwrite(p[:bs]); err != nil {
+				return err
+			}
+			p = p[bs:]
+			off += bs
+			continue
+		}
+		written, delta, err := node.blocks[i].Write(p, int(off%bs))
+		if err != nil {
+			return err
+		}
+		node.info.Size += uint64(delta)
+		p = p[written:]
+		off += bs - off%bs
+	}
+	return nil
+}
+
+// overwrites tells whether a write from off to end covers the whole of
+// block i and the block is full, so that the size of the file doesn't
+// change and the block's value needn't be loaded.
+func (node *Node) overwrites(i int64, off int64, end int64) bool {
+	bs := int64(node.bsize)
+	return off <= i*bs && (i+1)*bs <= end && uint64((i+1)*bs) <= node.info.Size
 }
 
 // This adds blocks so that looking them up by offset does not panic,
@@ -499,21 +647,83 @@ func (node *Node) getBlock(off int64) *block.Block {
 	return node.blocks[index]
 }
 
+// ReadAt reads into p the content starting at off, across as many
+// blocks as needed, and returns the number of bytes read, which is
+// less than len(p) only at the end of the file. The blocks are loaded
+// together before copying, see block.Load.
 func (node *Node) ReadAt(p []byte, off int64) (int, error) {
-	if len(p) == 0 {
-		return 0, nil
+	node.fetchAhead(off, len(p))
+	bs := int64(node.bsize)
+	first := off / bs
+	last := (off + int64(len(p)) + bs - 1) / bs
+	if last > int64(len(node.blocks)) {
+		last = int64(len(node.blocks))
+	}
+	if first < last {
+		if err := block.Load(node.blocks[first:last]); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	for n < len(p) {
+		block := node.getBlock(off)
+		if block == nil {
+			break
+		}
+		m, err := block.Read(p[n:], int(off%bs))
+		n += m
+		if m == 0 || err != nil {
+			return n, err
+		}
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// How many blocks past the current read to fetch for sequential reads,
+// and how many strided reads ahead to fetch blocks for.
+const fetchAheadBlocks = 4
+
+// fetchAhead starts fetching the blocks a read of n bytes at off needs
+// besides the first, which the read loads right away, so that they
+// arrive in parallel. Once reads follow a pattern, i.e., each starts
+// where the previous ended, or as far from the previous as that from
+// the one before, the blocks the next few reads will need are fetched
+// too. After a seek, only the blocks needed are fetched, rather than
+// the rest of a file that may be a large video. See Block.Fetch.
+func (node *Node) fetchAhead(off int64, n int) {
+	if n == 0 || len(node.blocks) == 0 {
+		return
+	}
+	end := off + int64(n)
+	stride := off - node.readOff
+	sequential := off == node.readEnd && off != 0
+	if sequential || (stride == node.readStride && stride != 0) {
+		node.readStreak++
+	} else {
+		node.readStreak = 0
 	}
-	block := node.getBlock(off)
-	if block == nil {
-		return 0, nil
+	node.readOff, node.readEnd, node.readStride = off, end, stride
+	bs := int64(node.bsize)
+	fetch := func(from, to int64) {
+		if from < 0 {
+			return
+		}
+		for i := from / bs; i <= (to-1)/bs && i < int64(len(node.blocks)); i++ {
+			node.blocks[i].Fetch()
+		}
 	}
-	o := int(off % int64(node.bsize))
-	n, err := block.Read(p, o)
-	if n == 0 || err != nil {
-		return n, err
+	fetch(off/bs*bs+bs, end)
+	switch {
+	case node.readStreak == 0:
+	case sequential:
+		fetch(end, end/bs*bs+fetchAheadBlocks*bs)
+	default:
+		for i := int64(1); i <= fetchAheadBlocks; i++ {
+			next := off + i*stride
+			fetch(next, next+int64(n))
+		}
 	}
-	m, err := node.ReadAt(p[n:], off+int64(n))
-	return n + m, err
 }
 
 func (node *Node) metadataBlock() (*block.Block, error) {
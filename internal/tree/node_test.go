@@ -1,9 +1,13 @@
 package tree
 
 import (
+	"errors"
 	"math/rand"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/nicolagi/muscle/internal/block"
 	"github.com/nicolagi/muscle/internal/storage"
 	"github.com/stretchr/testify/assert"
@@ -18,8 +22,10 @@ func TestNodeFlagsString(t *testing.T) {
 		{loaded, "loaded"},
 		{dirty, "dirty"},
 		{sealed, "sealed"},
+		{versioned, "versioned"},
 		{loaded | dirty, "loaded,dirty"},
-		{42, "dirty,unlinked,extraneous"}, // bits 1, 3, 5
+		{42, "dirty,unlinked,versioned"},   // bits 1, 3, 5
+		{138, "dirty,unlinked,extraneous"}, // bits 1, 3, 7
 	}
 	for _, tc := range testCases {
 		if got, want := tc.input.String(), tc.output; got != want {
@@ -180,3 +186,280 @@ func TestNodeWriting(t *testing.T) {
 		}
 	})
 }
+
+func TestNodeWriteSessions(t *testing.T) {
+	node := &Node{
+		blockFactory: blockFactory(t, nil),
+		pointer:      storage.RandomPointer(),
+		bsize:        6,
+	}
+	for i, c := range "0123456789" {
+		mustWrite(t, node, []byte{byte(c)}, int64(i))
+	}
+	if got, want := mustRead(t, node), "0123456789"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := node.info.Version, uint32(1); got != want {
+		t.Errorf("got version %d, want %d after one write session", got, want)
+	}
+
+	// As if flushed: the next sequential write must mark the node
+	// dirty again, and bump the version, so that it differs from the
+	// one flushed.
+	node.flags &^= dirty
+	mustWrite(t, node, []byte("a"), 10)
+	if node.flags&dirty == 0 {
+		t.Error("got a clean node after writing")
+	}
+	if got, want := node.info.Version, uint32(2); got != want {
+		t.Errorf("got version %d, want %d after a flush", got, want)
+	}
+
+	node.EndWrites()
+	mustWrite(t, node, []byte("b"), 11)
+	if got, want := node.info.Version, uint32(3); got != want {
+		t.Errorf("got version %d, want %d after three write sessions", got, want)
+	}
+	if got, want := mustRead(t, node), "0123456789ab"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNodeWriteOverwritesWholeBlocks(t *testing.T) {
+	// The blocks can't be loaded, so only writes that don't need
+	// their values succeed.
+	bf := blockFactory(t, errors.New("no loading"))
+	node := &Node{
+		blockFactory: bf,
+		pointer:      storage.RandomPointer(),
+		bsize:        4,
+	}
+	node.info.Size = 12
+	for i := 0; i < 3; i++ {
+		ref, err := block.NewRef(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := bf.New(ref, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.blocks = append(node.blocks, b)
+	}
+	mustWrite(t, node, []byte("abcdefgh"), 4)
+	if got, want := node.info.Size, uint64(12); got != want {
+		t.Errorf("got a %d-byte node, want %d bytes", got, want)
+	}
+	p := make([]byte, 8)
+	if n, err := node.ReadAt(p, 4); err != nil || string(p[:n]) != "abcdefgh" {
+		t.Errorf("got %q, %v, want %q", p[:n], err, "abcdefgh")
+	}
+	if err := node.WriteAt([]byte("xy"), 0); err == nil {
+		t.Error("no error writing part of a block that can't be loaded")
+	}
+}
+
+// slowStore adds a delay to gets, as for a disk or a network.
+type slowStore struct {
+	storage.Store
+	delay time.Duration
+}
+
+func (s slowStore) Get(k storage.Key) (storage.Value, error) {
+	time.Sleep(s.delay)
+	return s.Store.Get(k)
+}
+
+// benchmarkNode returns a node with 1 MiB of content in blocks staged
+// in a store with the given delay, and a function that makes the
+// blocks as if the node was just loaded, so that reads load them.
+func benchmarkNode(b *testing.B, delay time.Duration) (*Node, func()) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	index := &storage.InMemory{}
+	bf, err := block.NewFactory(slowStore{Store: index, delay: delay}, &storage.InMemory{}, key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	bs := uint32(8192)
+	node := &Node{
+		blockFactory: bf,
+		pointer:      storage.RandomPointer(),
+		bsize:        bs,
+	}
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	if err := node.WriteAt(data, 0); err != nil {
+		b.Fatal(err)
+	}
+	var refs []block.Ref
+	for _, blk := range node.blocks {
+		if _, err := blk.Flush(); err != nil {
+			b.Fatal(err)
+		}
+		refs = append(refs, blk.Ref())
+	}
+	return node, func() {
+		node.blocks = node.blocks[:0]
+		for _, ref := range refs {
+			blk, err := bf.New(ref, int(bs))
+			if err != nil {
+				b.Fatal(err)
+			}
+			node.blocks = append(node.blocks, blk)
+		}
+	}
+}
+
+// The benchmarks read and write 1 MiB of a file whose blocks aren't
+// loaded yet, from a store taking 100µs per get, e.g., a disk.
+
+func BenchmarkNodeReadAt(b *testing.B) {
+	node, reset := benchmarkNode(b, 100*time.Microsecond)
+	p := make([]byte, node.info.Size)
+	b.SetBytes(int64(len(p)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		reset()
+		b.StartTimer()
+		if _, err := node.ReadAt(p, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNodeWriteAt(b *testing.B) {
+	node, reset := benchmarkNode(b, 100*time.Microsecond)
+	data := make([]byte, node.info.Size)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		reset()
+		b.StartTimer()
+		// Off by one byte, so that the first block is written
+		// in part and needs loading.
+		if err := node.WriteAt(data[:len(data)-1], 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestNodeBlockMap(t *testing.T) {
+	node := &Node{
+		blockFactory: blockFactory(t, nil),
+		pointer:      storage.RandomPointer(),
+		bsize:        6,
+	}
+	mustWrite(t, node, []byte("0123456789"), 0)
+	extents := node.BlockMap()
+	if len(extents) != 2 {
+		t.Fatalf("got %d extents, want 2", len(extents))
+	}
+	for i, want := range []BlockExtent{{Offset: 0, Length: 6}, {Offset: 6, Length: 4}} {
+		if got := extents[i]; got.Offset != want.Offset || got.Length != want.Length || got.Location != "dirty" {
+			t.Errorf("got %+v, want offset %d, length %d, dirty", got, want.Offset, want.Length)
+		}
+	}
+	if _, err := node.blocks[0].Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := node.BlockMap()[0].Location; got != "staging" {
+		t.Errorf("got %q, want staging after flushing", got)
+	}
+}
+
+// gettingStore records the keys got.
+type gettingStore struct {
+	storage.InMemory
+	mu   sync.Mutex
+	keys map[storage.Key]bool
+}
+
+func (s *gettingStore) Get(key storage.Key) (storage.Value, error) {
+	s.mu.Lock()
+	s.keys[key] = true
+	s.mu.Unlock()
+	return s.InMemory.Get(key)
+}
+
+func TestNodeFetchAhead(t *testing.T) {
+	var repository *gettingStore
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWX")
+	// newNode returns a file of 10 blocks of 6 bytes, none loaded, in
+	// a repository of its own.
+	newNode := func() *Node {
+		key := make([]byte, 16)
+		rand.Read(key)
+		repository = &gettingStore{}
+		factory, err := block.NewFactory(&storage.InMemory{}, repository, key, block.WithFetchAhead(8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := &Node{blockFactory: factory, pointer: storage.RandomPointer(), bsize: 6}
+		mustWrite(t, node, data, 0)
+		for i, b := range node.blocks {
+			if _, err := b.Seal(); err != nil {
+				t.Fatal(err)
+			}
+			node.blocks[i] = newBlock(t, factory, b.Ref())
+		}
+		repository.mu.Lock()
+		repository.keys = make(map[storage.Key]bool)
+		repository.mu.Unlock()
+		return node
+	}
+	read := func(node *Node, off int64, n int) {
+		t.Helper()
+		p := make([]byte, n)
+		if _, err := node.ReadAt(p, off); err != nil {
+			t.Fatal(err)
+		}
+		if want := data[off : off+int64(n)]; string(p) != string(want) {
+			t.Errorf("got %q, want %q", p, want)
+		}
+	}
+	// fetched waits for the blocks got from the repository to be the
+	// wanted ones, as they are fetched in the background.
+	fetched := func(node *Node, want ...int) {
+		t.Helper()
+		wanted := make(map[storage.Key]bool)
+		for _, i := range want {
+			wanted[node.blocks[i].Ref().Key()] = true
+		}
+		var got map[storage.Key]bool
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+			repository.mu.Lock()
+			got = make(map[storage.Key]bool)
+			for k := range repository.keys {
+				got[k] = true
+			}
+			repository.mu.Unlock()
+			if len(got) >= len(wanted) {
+				break
+			}
+		}
+		if diff := cmp.Diff(wanted, got); diff != "" {
+			t.Errorf("blocks got (-want +got):\n%s", diff)
+		}
+	}
+
+	node := newNode()
+	// A seek only gets the block needed.
+	read(node, 30, 2)
+	fetched(node, 5)
+	// Reading on fetches the next blocks.
+	read(node, 32, 2)
+	fetched(node, 5, 6, 7, 8)
+	// A read across blocks after a seek gets only those.
+	read(node, 2, 10)
+	fetched(node, 0, 1, 5, 6, 7, 8)
+
+	// Strided reads fetch the blocks of the next reads only.
+	node = newNode()
+	read(node, 0, 1)
+	read(node, 12, 1)
+	read(node, 24, 1)
+	fetched(node, 0, 2, 4, 6, 8)
+}
@@ -0,0 +1,181 @@
+package tree
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// Pins is a registry of the revisions a process is using, e.g.,
+// because they are being browsed through musclefs, so that garbage
+// collection, which runs in another process, does not delete the
+// blocks they need. Each process records its pins in a file named
+// after its process id, in a directory shared by all processes using
+// the same base directory. Pins are counted, and last until as many
+// calls to Unpin, until Release, or until the process exits.
+type Pins struct {
+	dir      string
+	mu       sync.Mutex
+	pinned   map[string]int
+	pathname string
+}
+
+// NewPins returns a registry for the calling process, which records
+// its pins in the given directory, creating it if needed.
+func NewPins(dir string) (*Pins, error) {
+	const method = "NewPins"
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errorv(method, err)
+	}
+	return &Pins{
+		dir:      dir,
+		pinned:   make(map[string]int),
+		pathname: filepath.Join(dir, strconv.Itoa(os.Getpid())),
+	}, nil
+}
+
+// Pin records that the revision is in use.
+func (p *Pins) Pin(revision storage.Pointer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := revision.Hex()
+	if p.pinned[key] > 0 {
+		p.pinned[key]++
+		return nil
+	}
+	p.pinned[key] = 1
+	if err := p.save(); err != nil {
+		delete(p.pinned, key)
+		return errorv("Pins.Pin", err)
+	}
+	return nil
+}
+
+// Unpin records that the revision is no longer in use, for one of the
+// calls to Pin.
+func (p *Pins) Unpin(revision storage.Pointer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := revision.Hex()
+	if p.pinned[key] > 1 {
+		p.pinned[key]--
+		return nil
+	}
+	if _, ok := p.pinned[key]; !ok {
+		return nil
+	}
+	delete(p.pinned, key)
+	if err := p.save(); err != nil {
+		// The pin is left behind, which is only a missed
+		// opportunity for garbage collection.
+		return errorv("Pins.Unpin", err)
+	}
+	return nil
+}
+
+func (p *Pins) save() error {
+	if len(p.pinned) == 0 {
+		if err := os.Remove(p.pathname); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var keys []string
+	for k := range p.pinned {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		buf.WriteString(k)
+		buf.WriteByte('\n')
+	}
+	if err := ioutil.WriteFile(p.pathname+".new", buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(p.pathname+".new", p.pathname)
+}
+
+// Release removes all the pins of the calling process.
+func (p *Pins) Release() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pinned = make(map[string]int)
+	if err := os.Remove(p.pathname); err != nil && !os.IsNotExist(err) {
+		return errorv("Pins.Release", err)
+	}
+	return nil
+}
+
+// PinnedRevisions lists the revisions pinned by any process in the
+// given directory. Pins of processes that exited without releasing
+// them are removed. A missing directory means there are no pins.
+func PinnedRevisions(dir string) ([]storage.Pointer, error) {
+	const method = "PinnedRevisions"
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errorv(method, err)
+	}
+	seen := make(map[string]struct{})
+	var revisions []storage.Pointer
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			// E.g., a file being written by Pin.
+			continue
+		}
+		pathname := filepath.Join(dir, e.Name())
+		if !processExists(pid) {
+			if err := os.Remove(pathname); err != nil && !os.IsNotExist(err) {
+				return nil, errorv(method, err)
+			}
+			continue
+		}
+		f, err := os.Open(pathname)
+		if os.IsNotExist(err) {
+			// Released in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, errorv(method, err)
+		}
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if _, ok := seen[s.Text()]; ok {
+				continue
+			}
+			revision, err := storage.NewPointerFromHex(s.Text())
+			if err != nil {
+				_ = f.Close()
+				return nil, errorf(method, "%s: %v", pathname, err)
+			}
+			seen[s.Text()] = struct{}{}
+			revisions = append(revisions, revision)
+		}
+		err = s.Err()
+		_ = f.Close()
+		if err != nil {
+			return nil, errorv(method, err)
+		}
+	}
+	return revisions, nil
+}
+
+// processExists reports whether a process with the given id exists,
+// erring on the side of caution.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return !errors.Is(err, syscall.ESRCH)
+}
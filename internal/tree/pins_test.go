@@ -0,0 +1,65 @@
+package tree
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestPins(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "pins")
+	if revisions, err := PinnedRevisions(dir); err != nil || len(revisions) != 0 {
+		t.Fatalf("got %v, %v, want no pins", revisions, err)
+	}
+	pins, err := NewPins(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := storage.RandomPointer(), storage.RandomPointer()
+	for _, revision := range []storage.Pointer{a, b, a} {
+		if err := pins.Pin(revision); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Pins of a process that no longer exists are ignored and removed.
+	stale := filepath.Join(dir, "99999999")
+	if err := ioutil.WriteFile(stale, []byte(storage.RandomPointer().Hex()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	revisions, err := PinnedRevisions(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("got %d pinned revisions, want 2", len(revisions))
+	}
+	for _, r := range revisions {
+		if !r.Equals(a) && !r.Equals(b) {
+			t.Errorf("unexpected pinned revision %v", r)
+		}
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("got %v, want stale pins removed", err)
+	}
+
+	// Pinned twice, so a is still pinned after one unpin.
+	for _, revision := range []storage.Pointer{a, b} {
+		if err := pins.Unpin(revision); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if revisions, err := PinnedRevisions(dir); err != nil || len(revisions) != 1 || !revisions[0].Equals(a) {
+		t.Errorf("got %v, %v, want only %v pinned", revisions, err, a)
+	}
+
+	if err := pins.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if revisions, err := PinnedRevisions(dir); err != nil || len(revisions) != 0 {
+		t.Errorf("got %v, %v, want no pins after release", revisions, err)
+	}
+}
@@ -22,6 +22,8 @@ type Revision struct {
 	rootKey storage.Pointer
 	host    string // From where the snapshot was taken.
 	when    int64  // When the snapshot was taken (in seconds).
+	keep    bool   // Retained by garbage collection regardless of age.
+	message string // Given at push time, if any.
 }
 
 func NewRevision(root *Node, parents []Tag) *Revision {
@@ -48,8 +50,32 @@ func (r *Revision) Parent(tagName string) (Tag, bool) {
 	return Tag{}, false
 }
 
+// Parents returns the tags the revision was pushed to, pointing to the
+// revisions they pointed to before the push.
+func (r *Revision) Parents() []Tag {
+	return append([]Tag(nil), r.parents...)
+}
+
 func (r *Revision) RootKey() storage.Pointer { return r.rootKey }
 
+// Host returns the name of the host the revision was pushed from.
+func (r *Revision) Host() string { return r.host }
+
+// Keep tells whether the revision was pushed with the retention hint,
+// so that garbage collection retains it regardless of age.
+func (r *Revision) Keep() bool { return r.keep }
+
+// SetKeep sets the retention hint, which must be done before storing
+// the revision, as it is part of its content.
+func (r *Revision) SetKeep(keep bool) { r.keep = keep }
+
+// Message returns the message the revision was pushed with, if any.
+func (r *Revision) Message() string { return r.message }
+
+// SetMessage sets the message, which must be done before storing the
+// revision, as it is part of its content.
+func (r *Revision) SetMessage(message string) { r.message = message }
+
 func (r *Revision) Time() time.Time {
 	return time.Unix(r.when, 0)
 }
@@ -67,6 +93,12 @@ func (r *Revision) ShortString() string {
 	for _, p := range r.parents {
 		_, _ = fmt.Fprintf(&b, " parent-%s=%v", p.Name, p.Pointer)
 	}
+	if r.keep {
+		b.WriteString(" keep")
+	}
+	if r.message != "" {
+		_, _ = fmt.Fprintf(&b, " message=%q", r.message)
+	}
 	return b.String()
 }
 
@@ -81,6 +113,12 @@ func (r *Revision) String() string {
 		fmt.Fprintf(&buf, "parent-%s %v\n", p.Name, p.Pointer)
 	}
 	fmt.Fprintf(&buf, "root %v\n", r.rootKey)
+	if r.keep {
+		buf.WriteString("keep\n")
+	}
+	if r.message != "" {
+		fmt.Fprintf(&buf, "message %s\n", r.message)
+	}
 	return buf.String()
 }
 
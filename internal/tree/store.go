@@ -1,12 +1,15 @@
 package tree
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -29,53 +32,66 @@ type Store struct {
 	pointers     storage.Store
 	codec        Codec
 	baseDir      string // e.g., $HOME/lib/muscle.
+
+	// Used to seal nodes and revisions. Defaults to blockFactory.
+	metadataFactory *block.Factory
+}
+
+// StoreOption values influence the behavior of NewStore.
+type StoreOption func(*Store)
+
+// WithMetadataFactory specifies the block factory used to seal nodes
+// and revisions, e.g., one whose repository writes through to
+// permanent storage.
+func WithMetadataFactory(factory *block.Factory) StoreOption {
+	return func(s *Store) {
+		s.metadataFactory = factory
+	}
 }
 
 func NewStore(
 	blockFactory *block.Factory,
 	pointers storage.Store,
 	baseDir string,
+	opts ...StoreOption,
 ) (*Store, error) {
-	return &Store{
-		blockFactory: blockFactory,
-		pointers:     pointers,
-		codec:        newStandardCodec(),
-		baseDir:      baseDir,
-	}, nil
+	s := &Store{
+		blockFactory:    blockFactory,
+		pointers:        pointers,
+		codec:           newStandardCodec(),
+		baseDir:         baseDir,
+		metadataFactory: blockFactory,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	return s, nil
 }
 
-func (s *Store) StoreNode(node *Node) error {
+// freezeNode encodes the node for writing to the staging area, and
+// points the node to where it will be written. The node is no longer
+// dirty, so further changes will make it dirty again.
+func (s *Store) freezeNode(node *Node) (*block.Frozen, error) {
 	errw := func(e error) error {
-		return fmt.Errorf("tree.Store.StoreNode: %w", e)
+		return fmt.Errorf("tree.Store.freezeNode: %w", e)
 	}
 	encoded, err := s.codec.encodeNode(node)
 	if err != nil {
-		return errw(err)
-	}
-	var blk *block.Block
-	if len(node.pointer) > 0 {
-		blk, err = node.metadataBlock()
-	} else {
-		blk, err = s.blockFactory.New(nil, metadataBlockMaxSize)
-	}
-	if err != nil {
-		return errw(err)
+		return nil, errw(err)
 	}
-	if err := blk.Truncate(0); err != nil {
-		return errw(err)
+	if len(encoded) > metadataBlockMaxSize {
+		return nil, errw(fmt.Errorf("(actual) %d > (max) %d bytes", len(encoded), metadataBlockMaxSize))
 	}
-	if n, _, err := blk.Write(encoded, 0); err != nil {
-		return errw(err)
-	} else if n != len(encoded) {
-		// We get here if we try to write a more than 32 GB file.
-		return errw(fmt.Errorf("(actual) %d != (expected) %d", n, len(encoded)))
-	}
-	if _, err := blk.Flush(); err != nil {
-		return errw(err)
+	// Reuse the staging key, if any, not to leave garbage behind.
+	ref, _ := block.NewRef([]byte(node.pointer))
+	if _, ok := ref.(block.IndexRef); !ok {
+		if ref, err = block.NewRef(nil); err != nil {
+			return nil, errw(err)
+		}
 	}
-	node.pointer = storage.Pointer(blk.Ref().Bytes())
+	node.pointer = storage.Pointer(ref.Bytes())
 	node.flags &^= dirty
-	return nil
+	return s.blockFactory.Freeze(ref.(block.IndexRef), encoded), nil
 }
 
 func (s *Store) SealNode(node *Node) error {
@@ -96,7 +112,7 @@ func (s *Store) SealNode(node *Node) error {
 			return errw(err)
 		}
 	}
-	blk, err := s.blockFactory.New(ref, metadataBlockMaxSize)
+	blk, err := s.metadataFactory.New(ref, metadataBlockMaxSize)
 	if err != nil {
 		return errw(err)
 	}
@@ -131,7 +147,7 @@ func (s *Store) StoreRevision(r *Revision) error {
 			return errw(err)
 		}
 	}
-	blk, err := s.blockFactory.New(ref, metadataBlockMaxSize)
+	blk, err := s.metadataFactory.New(ref, metadataBlockMaxSize)
 	if err != nil {
 		return errw(err)
 	}
@@ -165,6 +181,9 @@ func (s *Store) LoadNode(dst *Node) error {
 	if err != nil {
 		return errw(err)
 	}
+	// The block is found in the repository instead, if the staged
+	// node was sealed by an interrupted seal, see block.SealJournal.
+	dst.pointer = storage.Pointer(blk.Ref().Bytes())
 	if err := s.codec.decodeNode(encoded, dst); err != nil {
 		return errw(err)
 	}
@@ -178,6 +197,24 @@ func (s *Store) LoadNode(dst *Node) error {
 	return nil
 }
 
+// CatBlocks writes the values of the blocks to w, in order, see
+// block.Factory.Cat.
+func (s *Store) CatBlocks(w io.Writer, refs []block.Ref) error {
+	return s.blockFactory.Cat(w, refs)
+}
+
+// Preseal uploads the staged blocks, which can be done without holding
+// the tree lock, so that sealing the tree afterwards only uploads the
+// blocks that changed since. See block.Factory.Preseal.
+func (s *Store) Preseal(refs []block.IndexRef) error {
+	for _, ref := range refs {
+		if err := s.blockFactory.Preseal(ref); err != nil {
+			return fmt.Errorf("tree.Store.Preseal: %w", err)
+		}
+	}
+	return nil
+}
+
 // TODO: Belongs to musclefs, not to the tree package.
 func (s *Store) updateLocalRootPointer(rootKey storage.Pointer) error {
 	return setLocalPointer(filepath.Join(s.baseDir, "root"), rootKey)
@@ -190,6 +227,47 @@ func (s *Store) LocalBasePointer() (storage.Pointer, error) {
 	return localPointer(pathname)
 }
 
+// DefaultBranch is the tag musclefs pushes to and pulls from unless
+// another one is checked out, see LocalBranch.
+const DefaultBranch = "base"
+
+// VerifiedTag is the tag that only "muscle verify" moves, to a revision
+// whose nodes and blocks it found in the remote store and decrypted,
+// so that it can be trusted for disaster recovery. Pushes to it are
+// refused.
+const VerifiedTag = "verified"
+
+// LocalBranch reads the file $HOME/lib/muscle/branch, which names the
+// tag whose revisions the local tree builds on, defaulting to
+// DefaultBranch.
+func (s *Store) LocalBranch() (string, error) {
+	const method = "Store.LocalBranch"
+	content, err := ioutil.ReadFile(filepath.Join(s.baseDir, "branch"))
+	if os.IsNotExist(err) {
+		return DefaultBranch, nil
+	}
+	if err != nil {
+		return "", errorv(method, err)
+	}
+	if name := strings.TrimSpace(string(content)); name != "" {
+		return name, nil
+	}
+	return DefaultBranch, nil
+}
+
+// SetLocalBranch atomically updates $HOME/lib/muscle/branch.
+func (s *Store) SetLocalBranch(name string) error {
+	const method = "Store.SetLocalBranch"
+	pathname := filepath.Join(s.baseDir, "branch")
+	if err := ioutil.WriteFile(pathname+".new", []byte(name), 0666); err != nil {
+		return errorv(method, err)
+	}
+	if err := os.Rename(pathname+".new", pathname); err != nil {
+		return errorv(method, err)
+	}
+	return nil
+}
+
 func localPointer(pathname string) (storage.Pointer, error) {
 	const method = "localPointer"
 	content, err := ioutil.ReadFile(pathname)
@@ -264,6 +342,48 @@ func (s *Store) RemoteTags(tagNames []string) (tags []Tag, err error) {
 	return
 }
 
+// ListRemoteTags returns all remote tags, e.g., those pushed by
+// other hosts, sorted by name.
+func (s *Store) ListRemoteTags(ctx context.Context) ([]Tag, error) {
+	names, err := s.listPointers(ctx, "Store.ListRemoteTags", RemoteRootKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return s.RemoteTags(names)
+}
+
+// listPointers returns the keys with the given prefix in the store of
+// tags, without the prefix, sorted. The store must be a
+// storage.Lister, and is listed by prefix if it is a
+// storage.PrefixLister.
+func (s *Store) listPointers(ctx context.Context, method string, prefix string) ([]string, error) {
+	var it storage.ListIterator
+	if lister, ok := s.pointers.(storage.PrefixLister); ok {
+		it = lister.ListPrefix(prefix)
+	} else if lister, ok := s.pointers.(storage.Lister); ok {
+		it = lister.List()
+	} else {
+		return nil, errorf(method, "pointers store %T can't list keys", s.pointers)
+	}
+	var names []string
+	for {
+		page, err := it.Next(ctx)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, errorv(method, err)
+		}
+		for _, ki := range page {
+			if name := strings.TrimPrefix(string(ki.Key), prefix); name != string(ki.Key) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
 func (s *Store) tagPointer(tag string) (storage.Pointer, error) {
 	if content, err := s.pointers.Get(storage.Key(RemoteRootKeyPrefix + tag)); errors.Is(err, storage.ErrNotFound) {
 		return storage.Null, nil
@@ -288,6 +408,36 @@ func (s *Store) SetRemoteTags(tagNames []string, pointer storage.Pointer) error
 	return nil
 }
 
+// UpdateRemoteTags is like SetRemoteTags, but each tag is only updated
+// if it still has the pointer it had when it was read, as recorded in
+// the given tags. If another host updated a tag in the meantime, the
+// returned error wraps storage.ErrConflict and the caller should pull.
+// If the pointers store does not support conditional updates, tags are
+// overwritten unconditionally.
+func (s *Store) UpdateRemoteTags(tags []Tag, pointer storage.Pointer) error {
+	const method = "Store.UpdateRemoteTags"
+	swapper, ok := s.pointers.(storage.Swapper)
+	if !ok {
+		var tagNames []string
+		for _, tag := range tags {
+			tagNames = append(tagNames, tag.Name)
+		}
+		return s.SetRemoteTags(tagNames, pointer)
+	}
+	value := []byte(pointer.Hex())
+	for _, tag := range tags {
+		var old []byte
+		if !tag.Pointer.IsNull() {
+			old = []byte(tag.Pointer.Hex())
+		}
+		key := storage.Key(RemoteRootKeyPrefix + tag.Name)
+		if err := swapper.CompareAndSwap(key, old, value); err != nil {
+			return fmt.Errorf("github.com/nicolagi/muscle/internal/tree.%s: tag %q: %w", method, tag.Name, err)
+		}
+	}
+	return nil
+}
+
 func (s *Store) LocalRootKey() (storage.Pointer, error) {
 	return localPointer(filepath.Join(s.baseDir, "root"))
 }
@@ -327,6 +477,16 @@ func (s *Store) LoadRevisionByKey(key storage.Pointer) (*Revision, error) {
 	return r, err
 }
 
+// containsRevision tells whether the revision is stored, e.g., to
+// tell a revision deleted by clean from one that failed to load.
+func (s *Store) containsRevision(key storage.Pointer) (bool, error) {
+	ref, err := block.NewRef([]byte(key))
+	if err != nil {
+		return false, err
+	}
+	return s.blockFactory.Contains(ref)
+}
+
 func (s *Store) loadRoot(key storage.Pointer) (*Node, error) {
 	root := &Node{
 		pointer: key,
@@ -342,7 +502,7 @@ func (s *Store) History(maxRevisions int, head *Revision, tagName string) (rr []
 	for r := head; r != nil && maxRevisions > 0; maxRevisions-- {
 		rr = append(rr, r)
 		tag, ok := r.Parent(tagName)
-		if !ok {
+		if !ok || tag.Pointer.IsNull() {
 			break
 		}
 		r, err = s.LoadRevisionByKey(tag.Pointer)
@@ -353,3 +513,134 @@ func (s *Store) History(maxRevisions int, head *Revision, tagName string) (rr []
 	}
 	return
 }
+
+// SpliceHistory repairs the history of the tag starting at head, where
+// a revision's parent along the tag, oldParent, is lost, e.g., deleted
+// by mistake, so that the history stops there. That revision gets
+// newParent as parent instead. Revisions are content-addressed, so that
+// revision and all the later ones are stored again with new keys,
+// otherwise the same.
+// It returns the replacements, by hex key of the revision replaced,
+// including the new head, to which the caller must point the tag.
+func (s *Store) SpliceHistory(head storage.Pointer, tagName string, oldParent, newParent storage.Pointer) (map[string]storage.Pointer, error) {
+	const method = "Store.SpliceHistory"
+	if _, err := s.LoadRevisionByKey(newParent); err != nil {
+		return nil, errorf(method, "new parent %v: %v", newParent, err)
+	}
+	// From the head down to the child of oldParent.
+	var chain []*Revision
+	for key := head; ; {
+		if key.IsNull() {
+			return nil, errorf(method, "%v is not the parent of a revision in the history of %q: %w", oldParent, tagName, ErrNotExist)
+		}
+		r, err := s.LoadRevisionByKey(key)
+		if err != nil {
+			return nil, errorv(method, err)
+		}
+		chain = append(chain, r)
+		parent, ok := r.Parent(tagName)
+		if !ok {
+			return nil, errorf(method, "%v is not the parent of a revision in the history of %q: %w", oldParent, tagName, ErrNotExist)
+		}
+		if parent.Pointer.Equals(oldParent) {
+			break
+		}
+		key = parent.Pointer
+	}
+	replaced := make(map[string]storage.Pointer)
+	for i := len(chain) - 1; i >= 0; i-- {
+		r := chain[i]
+		// All fields but the key and the parents are kept, e.g., the
+		// retention hint.
+		spliced := new(Revision)
+		*spliced = *r
+		spliced.key = nil
+		spliced.parents = r.Parents()
+		for j, p := range spliced.parents {
+			if p.Name == tagName {
+				spliced.parents[j].Pointer = newParent
+			}
+		}
+		if err := s.StoreRevision(spliced); err != nil {
+			return nil, errorv(method, err)
+		}
+		replaced[r.key.Hex()] = spliced.key
+		newParent = spliced.key
+	}
+	return replaced, nil
+}
+
+// How many revisions CheckFastForward examines looking for the local
+// base in the remote base's lineage.
+const lineageLimit = 1000
+
+// CheckFastForward verifies that a new revision on top of the local
+// base can replace the remote base, i.e., the revision the remote tag
+// points to, without losing revisions pushed by other hosts, i.e.,
+// that the two bases are the same. Otherwise, the returned error wraps
+// ErrDiverged and explains whether the remote base descends from the
+// local base (other hosts pushed since the last pull) or the histories
+// diverged, naming the hosts involved.
+func (s *Store) CheckFastForward(localBase storage.Pointer, remote Tag) error {
+	const method = "Store.CheckFastForward"
+	remoteBase := remote.Pointer
+	if localBase.Equals(remoteBase) {
+		return nil
+	}
+	if remoteBase.IsNull() {
+		return errorf(method, "remote base is missing, local base is %v: %w", localBase, ErrDiverged)
+	}
+	head, err := s.LoadRevisionByKey(remoteBase)
+	if err != nil {
+		return errorv(method, err)
+	}
+	rr, err := s.History(lineageLimit, head, remote.Name)
+	if err != nil {
+		return errorv(method, err)
+	}
+	var hosts []string
+	seen := make(map[string]bool)
+	for i, r := range rr {
+		if r.key.Equals(localBase) {
+			return errorf(method, "remote base %v is %d revisions ahead of local base %v, pushed by %s, pull first: %w",
+				remoteBase, i, localBase, strings.Join(hosts, ", "), ErrDiverged)
+		}
+		if !seen[r.host] {
+			seen[r.host] = true
+			hosts = append(hosts, r.host)
+		}
+	}
+	return errorf(method, "remote base %v, pushed by %s at %v, does not descend from local base %v (within %d revisions), pull first: %w",
+		remoteBase, head.host, head.Time().Format(time.RFC3339), localBase, len(rr), ErrDiverged)
+}
+
+// Descends tells whether the revision is the ancestor or descends from
+// it, following the parents along all tags, within lineageLimit
+// revisions, as far as the history wasn't deleted by clean.
+func (s *Store) Descends(revision, ancestor storage.Pointer) (bool, error) {
+	const method = "Store.Descends"
+	seen := map[string]bool{revision.Hex(): true}
+	queue := []storage.Pointer{revision}
+	for len(queue) > 0 && len(seen) <= lineageLimit {
+		p := queue[0]
+		queue = queue[1:]
+		if p.Equals(ancestor) {
+			return true, nil
+		}
+		r, err := s.LoadRevisionByKey(p)
+		if err != nil {
+			if ok, cerr := s.containsRevision(p); cerr == nil && !ok {
+				// Deleted by clean, the history ends here.
+				continue
+			}
+			return false, errorv(method, err)
+		}
+		for _, tag := range r.Parents() {
+			if !tag.Pointer.IsNull() && !seen[tag.Pointer.Hex()] {
+				seen[tag.Pointer.Hex()] = true
+				queue = append(queue, tag.Pointer)
+			}
+		}
+	}
+	return false, nil
+}
@@ -1,8 +1,13 @@
 package tree
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"math/rand"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/nicolagi/muscle/internal/block"
 	"github.com/nicolagi/muscle/internal/storage"
@@ -12,8 +17,7 @@ func newTestBlockFactory(t *testing.T) *block.Factory {
 	t.Helper()
 	key := make([]byte, 16)
 	rand.Read(key)
-	index := &storage.InMemory{}
-	bf, err := block.NewFactory(index, nil, key)
+	bf, err := block.NewFactory(&storage.InMemory{}, &storage.InMemory{}, key)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -29,3 +33,225 @@ func newTestStore(t *testing.T) *Store {
 	}
 	return treeStore
 }
+
+func TestStoreUpdateRemoteTags(t *testing.T) {
+	s := newTestStore(t)
+	s.pointers = &storage.InMemory{}
+	p1 := storage.RandomPointer()
+	p2 := storage.RandomPointer()
+	tags, err := s.RemoteTags([]string{"base", "laptop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateRemoteTags(tags, p1); err != nil {
+		t.Fatal(err)
+	}
+	// Pretend another host pushed after we read the tags.
+	if err := s.UpdateRemoteTags(tags, p2); !errors.Is(err, storage.ErrConflict) {
+		t.Fatalf("got %v, want conflict", err)
+	}
+	tags, err = s.RemoteTags([]string{"base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tags[0].Pointer.Equals(p1) {
+		t.Fatalf("got %v, want %v", tags[0].Pointer, p1)
+	}
+	if err := s.UpdateRemoteTags(tags, p2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreCheckFastForward(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	bf, err := block.NewFactory(&storage.InMemory{}, &storage.InMemory{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStore(bf, nil, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := func(host string, base storage.Pointer) storage.Pointer {
+		t.Helper()
+		r := &Revision{
+			parents: []Tag{{Name: "base", Pointer: base}},
+			rootKey: storage.RandomPointer(),
+			host:    host,
+			when:    time.Now().Unix(),
+		}
+		if err := s.StoreRevision(r); err != nil {
+			t.Fatal(err)
+		}
+		return r.key
+	}
+	r1 := push("laptop", storage.Null)
+	r2 := push("desktop", r1)
+	r3 := push("desktop", r2)
+	other := push("laptop", r1)
+	if err := s.CheckFastForward(r3, Tag{Name: "base", Pointer: r3}); err != nil {
+		t.Errorf("same bases: got %v", err)
+	}
+	if err := s.CheckFastForward(r1, Tag{Name: "base", Pointer: r3}); !errors.Is(err, ErrDiverged) {
+		t.Errorf("remote ahead: got %v, want %v", err, ErrDiverged)
+	} else if !strings.Contains(err.Error(), "2 revisions ahead") || !strings.Contains(err.Error(), "desktop") {
+		t.Errorf("remote ahead: got %q", err)
+	}
+	if err := s.CheckFastForward(other, Tag{Name: "base", Pointer: r3}); !errors.Is(err, ErrDiverged) {
+		t.Errorf("diverged: got %v, want %v", err, ErrDiverged)
+	} else if !strings.Contains(err.Error(), "does not descend") {
+		t.Errorf("diverged: got %q", err)
+	}
+	// The lineage follows the parents for the tag being checked.
+	if err := s.CheckFastForward(r1, Tag{Name: "other", Pointer: r3}); !errors.Is(err, ErrDiverged) {
+		t.Errorf("other tag: got %v, want %v", err, ErrDiverged)
+	} else if !strings.Contains(err.Error(), "does not descend") {
+		t.Errorf("other tag: got %q", err)
+	}
+}
+
+func TestStoreWriteRemoteTags(t *testing.T) {
+	key := make([]byte, 16)
+	rand.Read(key)
+	bf, err := block.NewFactory(&storage.InMemory{}, &storage.InMemory{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pointers := &storage.InMemory{}
+	s, err := NewStore(bf, pointers, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	push := func(tagName, host string, age time.Duration) storage.Pointer {
+		t.Helper()
+		r := &Revision{
+			rootKey: storage.RandomPointer(),
+			host:    host,
+			when:    now.Add(-age).Unix(),
+		}
+		if err := s.StoreRevision(r); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetRemoteTags([]string{tagName}, r.key); err != nil {
+			t.Fatal(err)
+		}
+		return r.key
+	}
+	laptop := push("laptop", "laptop", time.Hour)
+	desktop := push("desktop", "desktop", 3*24*time.Hour)
+	missing := storage.RandomPointer()
+	if err := s.SetRemoteTags([]string{"lost"}, missing); err != nil {
+		t.Fatal(err)
+	}
+	// Not a tag.
+	if err := pointers.Put("base", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	if err := s.WriteRemoteTags(context.Background(), &b, now); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %q, want 3 lines", b.String())
+	}
+	if want := fmt.Sprintf("desktop %v %s desktop 72h0m0s", desktop, now.Add(-72*time.Hour).Format(time.RFC3339)); lines[0] != want {
+		t.Errorf("got %q, want %q", lines[0], want)
+	}
+	if want := fmt.Sprintf("laptop %v %s laptop 1h0m0s", laptop, now.Add(-time.Hour).Format(time.RFC3339)); lines[1] != want {
+		t.Errorf("got %q, want %q", lines[1], want)
+	}
+	if want := fmt.Sprintf("lost %v error ", missing); !strings.HasPrefix(lines[2], want) {
+		t.Errorf("got %q, want prefix %q", lines[2], want)
+	}
+}
+
+func TestStoreSpliceHistory(t *testing.T) {
+	s := newTestStore(t)
+	push := func(host string, base storage.Pointer) *Revision {
+		t.Helper()
+		r := &Revision{
+			parents: []Tag{{Name: "base", Pointer: base}, {Name: host, Pointer: storage.Null}},
+			rootKey: storage.RandomPointer(),
+			host:    host,
+			when:    time.Now().Unix(),
+		}
+		if err := s.StoreRevision(r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	r1 := push("laptop", storage.Null)
+	r2 := push("desktop", r1.key)
+	r3 := &Revision{
+		parents: []Tag{{Name: "base", Pointer: r2.key}, {Name: "desktop", Pointer: storage.Null}},
+		rootKey: storage.RandomPointer(),
+		host:    "desktop",
+		when:    time.Now().Unix(),
+	}
+	r3.SetKeep(true)
+	if err := s.StoreRevision(r3); err != nil {
+		t.Fatal(err)
+	}
+	r4 := push("laptop", r3.key)
+
+	// Say r2 was lost.
+	replaced, err := s.SpliceHistory(r4.key, "base", r2.key, r1.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replaced) != 2 {
+		t.Fatalf("got %d replacements, want 2", len(replaced))
+	}
+	head, ok := replaced[r4.key.Hex()]
+	if !ok {
+		t.Fatal("head not replaced")
+	}
+	rr, err := s.History(10, mustLoadRevision(t, s, head), "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rr) != 3 || !rr[1].key.Equals(replaced[r3.key.Hex()]) || !rr[2].key.Equals(r1.key) {
+		t.Fatalf("got %v, want the head, r3, and r1", rr)
+	}
+	for i, want := range []*Revision{r4, r3} {
+		if got := rr[i]; got.host != want.host || got.when != want.when || !got.rootKey.Equals(want.rootKey) || got.Keep() != want.Keep() {
+			t.Errorf("got %v, want %v, but for the parent", got, want)
+		}
+	}
+	if p, _ := rr[0].Parent(rr[0].host); !p.Pointer.IsNull() {
+		t.Errorf("got %v, want the other parents unchanged", p)
+	}
+
+	if _, err := s.SpliceHistory(r4.key, "base", storage.RandomPointer(), r1.key); !errors.Is(err, ErrNotExist) {
+		t.Errorf("got %v, want %v", err, ErrNotExist)
+	}
+}
+
+func mustLoadRevision(t *testing.T, s *Store, key storage.Pointer) *Revision {
+	t.Helper()
+	r, err := s.LoadRevisionByKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestStoreLocalBranch(t *testing.T) {
+	s, err := NewStore(nil, nil, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.LocalBranch(); got != DefaultBranch || err != nil {
+		t.Errorf("got %q, %v, want %q", got, err, DefaultBranch)
+	}
+	if err := s.SetLocalBranch("experiment"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.LocalBranch(); got != "experiment" || err != nil {
+		t.Errorf("got %q, %v, want %q", got, err, "experiment")
+	}
+}
@@ -0,0 +1,199 @@
+package tree
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+// TombstonesKey is the key, in the store of tags, of the tombstone log,
+// which makes deleting garbage safe while other hosts push: garbage is
+// first marked, then swept after a grace period, and hosts pushing
+// revisions that use marked keys revive them in the meantime.
+const TombstonesKey = "tombstones"
+
+// States of the keys in the tombstone log.
+const (
+	// Garbage, to be deleted once the grace period is over, unless
+	// revived.
+	TombstoneMarked = "marked"
+
+	// Being deleted. Pushes using the key must wait.
+	TombstoneSweeping = "sweeping"
+
+	// Deleted. Pushes using the key must upload it again. Swept keys
+	// are forgotten after another grace period.
+	TombstoneSwept = "swept"
+)
+
+// ErrSweeping is returned by Revive if keys in use are being deleted.
+var ErrSweeping = errors.New("sweep in progress")
+
+// How many times UpdateTombstones, and other updates to the store of
+// tags, retry after losing a race with another host.
+const tombstoneAttempts = 10
+
+// A Tombstone records the state of a key in the tombstone log, and
+// since when it is in that state.
+type Tombstone struct {
+	State string
+	Since time.Time
+}
+
+func parseTombstones(value []byte) (map[string]Tombstone, error) {
+	m := make(map[string]Tombstone)
+	s := bufio.NewScanner(bytes.NewReader(value))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("malformed tombstone %q", s.Text())
+		}
+		switch fields[1] {
+		case TombstoneMarked, TombstoneSweeping, TombstoneSwept:
+		default:
+			return nil, fmt.Errorf("tombstone %q: unknown state", s.Text())
+		}
+		since, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("tombstone %q: %w", s.Text(), err)
+		}
+		m[fields[0]] = Tombstone{State: fields[1], Since: time.Unix(since, 0)}
+	}
+	return m, s.Err()
+}
+
+func formatTombstones(m map[string]Tombstone) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(&buf, "%s %s %d\n", k, m[k].State, m[k].Since.Unix())
+	}
+	return buf.Bytes()
+}
+
+// Tombstones returns the tombstone log, by key.
+func (s *Store) Tombstones() (map[string]Tombstone, error) {
+	const method = "Store.Tombstones"
+	value, err := s.pointers.Get(TombstonesKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		return make(map[string]Tombstone), nil
+	}
+	if err != nil {
+		return nil, errorv(method, err)
+	}
+	m, err := parseTombstones(value)
+	if err != nil {
+		return nil, errorv(method, err)
+	}
+	return m, nil
+}
+
+// UpdateTombstones applies the changes f makes to the tombstone log,
+// if it reports any. If another host changed the log in the meantime,
+// f is called again with the new log, so it must not have effects
+// other than changing the log that can't be repeated. If the store of
+// tags does not support conditional updates, the log is overwritten
+// unconditionally.
+func (s *Store) UpdateTombstones(f func(map[string]Tombstone) (bool, error)) error {
+	const method = "Store.UpdateTombstones"
+	return s.updatePointers(method, TombstonesKey, func(old []byte) ([]byte, bool, error) {
+		m, err := parseTombstones(old)
+		if err != nil {
+			return nil, false, errorv(method, err)
+		}
+		if changed, err := f(m); err != nil || !changed {
+			return nil, false, err
+		}
+		return formatTombstones(m), true, nil
+	})
+}
+
+// updatePointers replaces the value of key in the store of tags with
+// the one f computes from the current one, nil if there is none, if f
+// reports a change. If another host changed the value in the meantime,
+// f is called again with the new value. Stores of tags that don't
+// support conditional updates are overwritten unconditionally.
+func (s *Store) updatePointers(method string, key storage.Key, f func([]byte) ([]byte, bool, error)) error {
+	for attempt := 0; attempt < tombstoneAttempts; attempt++ {
+		// For CompareAndSwap, nil means the value does not exist, as
+		// opposed to being empty.
+		old, err := s.pointers.Get(key)
+		if errors.Is(err, storage.ErrNotFound) {
+			old, err = nil, nil
+		} else if err == nil && old == nil {
+			old = storage.Value{}
+		}
+		if err != nil {
+			return errorv(method, err)
+		}
+		value, changed, err := f(old)
+		if err != nil {
+			return err
+		} else if !changed {
+			return nil
+		}
+		swapper, ok := s.pointers.(storage.Swapper)
+		if !ok {
+			if err := s.pointers.Put(key, value); err != nil {
+				return errorv(method, err)
+			}
+			return nil
+		}
+		err = swapper.CompareAndSwap(key, old, value)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, storage.ErrConflict) {
+			return errorv(method, err)
+		}
+	}
+	return errorf(method, "still changing after %d attempts: %w", tombstoneAttempts, storage.ErrConflict)
+}
+
+// Revive removes the keys in use from the tombstone log, so that they
+// are not swept, before a revision using them is pushed. Keys swept
+// already are restored by calling restore, e.g., to upload them again
+// from the cache, before they are removed from the log. If keys in use
+// are being swept, it fails with ErrSweeping, and the push must be
+// tried again later. It returns how many keys were revived, restored
+// included, and how many were restored.
+func (s *Store) Revive(inUse map[string]struct{}, restore func(storage.Key) error) (revived, restored int, err error) {
+	const method = "Store.Revive"
+	err = s.UpdateTombstones(func(m map[string]Tombstone) (bool, error) {
+		revived, restored = 0, 0
+		var sweeping int
+		for k, t := range m {
+			if _, ok := inUse[k]; !ok {
+				continue
+			}
+			switch t.State {
+			case TombstoneSweeping:
+				sweeping++
+				continue
+			case TombstoneSwept:
+				if err := restore(storage.Key(k)); err != nil {
+					return false, errorf(method, "restoring %s: %v", k, err)
+				}
+				restored++
+			}
+			delete(m, k)
+			revived++
+		}
+		if sweeping > 0 {
+			return false, errorf(method, "%d keys in use are being deleted: %w", sweeping, ErrSweeping)
+		}
+		return revived > 0, nil
+	})
+	return revived, restored, err
+}
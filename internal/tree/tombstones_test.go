@@ -0,0 +1,63 @@
+package tree
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/storage"
+)
+
+func TestStoreRevive(t *testing.T) {
+	s, err := NewStore(nil, &storage.InMemory{}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := s.Tombstones(); err != nil || len(m) != 0 {
+		t.Fatalf("got %v, %v, want an empty log", m, err)
+	}
+	since := time.Unix(1600000000, 0)
+	err = s.UpdateTombstones(func(m map[string]Tombstone) (bool, error) {
+		m["marked"] = Tombstone{State: TombstoneMarked, Since: since}
+		m["swept"] = Tombstone{State: TombstoneSwept, Since: since}
+		m["unused"] = Tombstone{State: TombstoneMarked, Since: since}
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var restored []storage.Key
+	restore := func(k storage.Key) error {
+		restored = append(restored, k)
+		return nil
+	}
+	inUse := map[string]struct{}{"marked": {}, "swept": {}, "fresh": {}}
+	if revived, n, err := s.Revive(inUse, restore); err != nil || revived != 2 || n != 1 {
+		t.Fatalf("got %d, %d, %v, want 2 revived, 1 restored", revived, n, err)
+	}
+	if len(restored) != 1 || restored[0] != "swept" {
+		t.Errorf("got %v restored, want the swept key", restored)
+	}
+	m, err := s.Tombstones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m["unused"] != (Tombstone{State: TombstoneMarked, Since: since}) {
+		t.Errorf("got %v, want only the unused key", m)
+	}
+
+	err = s.UpdateTombstones(func(m map[string]Tombstone) (bool, error) {
+		m["unused"] = Tombstone{State: TombstoneSweeping, Since: since}
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Revive(map[string]struct{}{"unused": {}}, restore); !errors.Is(err, ErrSweeping) {
+		t.Errorf("got %v, want %v", err, ErrSweeping)
+	}
+	if _, _, err := s.Revive(inUse, restore); err != nil {
+		t.Errorf("got %v, want keys not in use being swept to be ignored", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"path"
 	"path/filepath"
 	godebug "runtime/debug"
 	"strings"
@@ -24,13 +25,26 @@ type Tree struct {
 	root      *Node
 	blockSize uint32 // For new nodes.
 
+	// For new append-only files or files matching the patterns.
+	smallBlockSize     uint32
+	smallBlockPatterns []string
+
 	rootName string
 	readOnly bool
+	atime    string // Policy for access times, see WithAtime.
+
+	caseInsensitive bool   // See WithCaseInsensitive.
+	namePolicy      string // See WithNamePolicy.
+	maxDepth        int    // See WithMaxDepth.
 
 	ignored map[string]map[string]struct{}
 
-	lastFlushed time.Time
-	lastTrimmed time.Time
+	flushInterval  time.Duration // See WithFlushInterval.
+	lastFlushed    time.Time
+	lastFlushStats FlushStats
+	pending        *pendingFlush // Flush in progress, if any.
+	unswept        []storage.Key // Staged values a failed flush didn't delete.
+	lastTrimmed    time.Time
 }
 
 // NewTree constructs a new tree object using the given store, and
@@ -38,11 +52,13 @@ type Tree struct {
 func NewTree(store *Store, opts ...TreeOption) (*Tree, error) {
 	debug.Assert(store.blockFactory != nil)
 	t := &Tree{
-		store:       store,
-		rootName:    "root",
-		readOnly:    true,
-		blockSize:   config.BlockSize,
-		lastTrimmed: time.Now(),
+		store:         store,
+		rootName:      "root",
+		readOnly:      true,
+		blockSize:     config.BlockSize,
+		maxDepth:      DefaultMaxDepth,
+		flushInterval: SnapshotFrequency,
+		lastTrimmed:   time.Now(),
 	}
 	for _, o := range opts {
 		if err := o(t); err != nil {
@@ -78,14 +94,21 @@ func (tree *Tree) Root() (storage.Pointer, *Node) { return tree.revision, tree.r
 
 func (tree *Tree) Add(node *Node, name string, perm uint32) (*Node, error) {
 	debug.Assert(node.blockFactory != nil)
+	name, err := tree.CheckName(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckMode(nil, perm); err != nil {
+		return nil, err
+	}
 	child := &Node{
 		flags:        loaded | dirty,
 		blockFactory: node.blockFactory,
-		bsize:        uint32(tree.blockSize),
+		bsize:        tree.newBlockSize(name, perm),
 		parent:       node,
 		info: NodeInfo{
 			Name: name,
-			Mode: perm & validMode,
+			Mode: perm,
 		},
 	}
 	child.info.ID = uint64(time.Now().UnixNano())
@@ -94,6 +117,13 @@ func (tree *Tree) Add(node *Node, name string, perm uint32) (*Node, error) {
 	if err := tree.Grow(node); err != nil {
 		return nil, err
 	}
+	if tree.caseInsensitive {
+		if cn, err := tree.followBranch(node, name); err != nil {
+			return nil, err
+		} else if cn != nil {
+			return nil, fmt.Errorf("%q within %q: %w", name, node.Path(), ErrExist)
+		}
+	}
 	if err := node.addChild(child); err != nil {
 		return nil, err
 	}
@@ -102,6 +132,57 @@ func (tree *Tree) Add(node *Node, name string, perm uint32) (*Node, error) {
 	return child, nil
 }
 
+// followBranch is like Node.followBranch, but if the tree is case
+// insensitive and no child has exactly the given name, it returns the
+// first one whose name matches ignoring case.
+func (tree *Tree) followBranch(node *Node, name string) (*Node, error) {
+	child, err := node.followBranch(name)
+	if err != nil || child != nil || !tree.caseInsensitive {
+		return child, err
+	}
+	for _, c := range node.children {
+		if strings.EqualFold(c.info.Name, name) {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+func (tree *Tree) newBlockSize(name string, perm uint32) uint32 {
+	if tree.smallBlockSize == 0 || perm&DMDIR != 0 {
+		return tree.blockSize
+	}
+	if perm&DMAPPEND != 0 {
+		return tree.smallBlockSize
+	}
+	for _, p := range tree.smallBlockPatterns {
+		if ok, _ := path.Match(p, name); ok {
+			return tree.smallBlockSize
+		}
+	}
+	return tree.blockSize
+}
+
+// Access records that the node was read, according to the policy set
+// with WithAtime.
+func (tree *Tree) Access(node *Node) {
+	if tree.readOnly {
+		return
+	}
+	now := uint32(time.Now().Unix())
+	switch tree.atime {
+	case AtimeOn:
+	case AtimeRelative:
+		if a := node.info.Accessed; a > node.info.Modified && now-a < 24*60*60 {
+			return
+		}
+	default:
+		return
+	}
+	node.info.Accessed = now
+	node.markDirty()
+}
+
 func (tree *Tree) Unlink(node *Node) error {
 	if node.IsRoot() {
 		return fmt.Errorf("unlink root: %w", linuxerr.EPERM)
@@ -129,37 +210,28 @@ func (tree *Tree) Discard(node *Node) {
 // The code will panic if the parent of the node is nil. That would be a programming error
 // and I don't want to defend against that.
 func (tree *Tree) RemoveForMerge(node *Node) error {
+	return tree.removeForMerge(node, false)
+}
+
+// removeForMerge implements RemoveForMerge. If force is true, nodes
+// in use are unlinked anyway; they are not discarded, but what is
+// written to them will not be part of the tree.
+func (tree *Tree) removeForMerge(node *Node, force bool) error {
 	if node.IsRoot() {
 		return errors.New("the root cannot be removed")
 	}
-	if node.refs > 0 {
+	if !force && node.InUse() {
 		return linuxerr.EBUSY
 	}
 	node.markUnlinked()
-	var g func(*Node) error
-	g = func(n *Node) error {
-		// We actually need to recurse only of the node is in the index.
-		// If it's in the repository, so are all its children nodes or data blocks.
-		if len(n.pointer) == 32 {
-			return nil
-		}
-		if n.flags&loaded == 0 {
-			if err := tree.store.LoadNode(n); err != nil {
-				return err
-			}
-		}
-		for _, c := range n.children {
-			if err := g(c); err != nil {
-				return err
-			}
-		}
+	var staged []*Node
+	if err := tree.stagedNodes(node, &staged); err != nil {
+		return err
+	}
+	for _, n := range staged {
 		if n.refs == 0 {
 			n.discard()
 		}
-		return nil
-	}
-	if err := g(node); err != nil {
-		return err
 	}
 	if removed := node.parent.removeChild(node.info.Name); removed == 0 {
 		log.Printf("warning: %q does not contain %q; remove is a no-op", node.parent.Path(), node.info.Name)
@@ -170,6 +242,132 @@ func (tree *Tree) RemoveForMerge(node *Node) error {
 	return nil
 }
 
+// stagedNodes appends the node and its descendants that are in the
+// staging area to the slice, children first, loading them if needed.
+// The sealed ones are skipped along with their descendants, which are
+// sealed too.
+func (tree *Tree) stagedNodes(node *Node, staged *[]*Node) error {
+	if len(node.pointer) == 32 {
+		return nil
+	}
+	if node.flags&loaded == 0 {
+		if err := tree.store.LoadNode(node); err != nil {
+			return err
+		}
+	}
+	for _, c := range node.children {
+		if err := tree.stagedNodes(c, staged); err != nil {
+			return err
+		}
+	}
+	*staged = append(*staged, node)
+	return nil
+}
+
+// Replace makes the children of the given node, e.g., the root of a
+// revision, the children of the tree's root, as if grafting each of
+// them after removing the current ones. It fails before changing
+// anything if any node below the root is in use, with an error
+// wrapping linuxerr.EBUSY, or if the new children can't be added,
+// e.g., because two of them have the same name, so that the swap is
+// all or nothing. The root itself is kept, so that references to it
+// remain valid.
+func (tree *Tree) Replace(root *Node) error {
+	if err := tree.Grow(tree.root); err != nil {
+		return err
+	}
+	if err := tree.Grow(root); err != nil {
+		return err
+	}
+	var names []string
+	for _, c := range tree.root.children {
+		names = append(names, c.info.Name)
+	}
+	for _, c := range root.children {
+		names = append(names, c.info.Name)
+	}
+	return tree.ReplaceChildren(root, names)
+}
+
+// ReplaceChildren is like Replace, but only for the children of the
+// tree's root with the given names: each is removed, if present, and
+// the child of the given node with the same name, if any, is added in
+// its place. The other children of the tree's root are left alone,
+// even if in use.
+func (tree *Tree) ReplaceChildren(root *Node, names []string) error {
+	const method = "Tree.ReplaceChildren"
+	if err := tree.Grow(tree.root); err != nil {
+		return err
+	}
+	if err := tree.Grow(root); err != nil {
+		return err
+	}
+	replaced := make(map[string]bool, len(names))
+	for _, name := range names {
+		replaced[name] = true
+	}
+	var removed []*Node
+	var staged []*Node
+	for _, c := range tree.root.children {
+		if !replaced[c.info.Name] {
+			continue
+		}
+		if c.InUse() {
+			return fmt.Errorf("%q: %w", c.Path(), linuxerr.EBUSY)
+		}
+		if err := tree.stagedNodes(c, &staged); err != nil {
+			return errorf(method, "removing %q: %w", c.Path(), err)
+		}
+		removed = append(removed, c)
+	}
+	var added []*Node
+	seen := make(map[string]struct{}, len(root.children))
+	for _, c := range root.children {
+		if !replaced[c.info.Name] {
+			continue
+		}
+		if c.flags&loaded == 0 {
+			return errorf(method, "adding %v, which wasn't loaded", c)
+		}
+		// The names aren't checked, as they were stored by an
+		// earlier revision and may predate the current rules.
+		if _, ok := seen[c.info.Name]; ok {
+			return errorf(method, "adding %q: %w", c.info.Name, ErrExist)
+		}
+		seen[c.info.Name] = struct{}{}
+		added = append(added, c)
+	}
+
+	for _, c := range removed {
+		c.markUnlinked()
+	}
+	for _, n := range staged {
+		if n.refs == 0 {
+			n.discard()
+		}
+	}
+	children := make([]*Node, 0, len(tree.root.children)-len(removed)+len(added))
+	for _, c := range tree.root.children {
+		if !replaced[c.info.Name] {
+			children = append(children, c)
+		}
+	}
+	tree.root.children = append(children, added...)
+	for c := range tree.root.dirtyChildren {
+		if replaced[c.info.Name] {
+			delete(tree.root.dirtyChildren, c)
+		}
+	}
+	tree.root.info.Version++
+	for _, c := range added {
+		c.parent = tree.root
+		c.markLinked()
+		c.markDirty()
+	}
+	tree.root.Touch(root.info.Modified)
+	return nil
+}
+
 func (tree *Tree) ReachableKeys(accumulator map[string]struct{}) (map[string]struct{}, error) {
 	if accumulator == nil {
 		accumulator = make(map[string]struct{})
@@ -179,11 +377,57 @@ func (tree *Tree) ReachableKeys(accumulator map[string]struct{}) (map[string]str
 	return accumulator, err
 }
 
+// LoadedKeys is like ReachableKeys, but it only visits what the tree
+// has in memory, so that it doesn't wait on storage, e.g., to be
+// called while clients wait for the tree. It returns the pointers of
+// the nodes not loaded, whose keys and those below them are to be
+// added by Store.AddReachableKeys. The tree must be flushed, so that
+// all the nodes have pointers. The revision is not added.
+func (tree *Tree) LoadedKeys(accumulator map[string]struct{}) (unloaded []storage.Pointer) {
+	var visit func(*Node)
+	visit = func(node *Node) {
+		if node.flags&loaded == 0 {
+			unloaded = append(unloaded, node.pointer)
+			return
+		}
+		accumulator[node.pointer.Hex()] = struct{}{}
+		for _, b := range node.blocks {
+			accumulator[string(b.Ref().Key())] = struct{}{}
+		}
+		for _, child := range node.children {
+			visit(child)
+		}
+	}
+	visit(tree.root)
+	return unloaded
+}
+
+// AddReachableKeys adds to the accumulator the keys reachable from the
+// nodes with the given pointers, e.g., those LoadedKeys didn't visit,
+// loading them from storage.
+func (s *Store) AddReachableKeys(pointers []storage.Pointer, accumulator map[string]struct{}) error {
+	const method = "Store.AddReachableKeys"
+	for _, p := range pointers {
+		t, err := NewTree(s, WithRoot(p))
+		if err != nil {
+			return errorf(method, "node %v: %v", p, err)
+		}
+		if err := t.reachableKeys(t.root, accumulator); err != nil {
+			return errorf(method, "node %v: %v", p, err)
+		}
+	}
+	return nil
+}
+
 func (tree *Tree) reachableKeys(node *Node, accumulator map[string]struct{}) error {
 	if node == nil {
 		return nil
 	}
 	key := node.pointer
+	if _, ok := accumulator[key.Hex()]; ok && !key.IsNull() {
+		// Already visited, e.g., as part of another revision.
+		return nil
+	}
 	accumulator[key.Hex()] = struct{}{}
 	for _, b := range node.blocks {
 		accumulator[string(b.Ref().Key())] = struct{}{}
@@ -200,25 +444,63 @@ func (tree *Tree) reachableKeys(node *Node, accumulator map[string]struct{}) err
 }
 
 func (tree *Tree) Flush() error {
+	// Changes made after a flush in progress was started need another
+	// one, which also retries writing the changes if it failed.
+	if err := tree.FinishFlush(); err != nil {
+		log.Printf("tree.Tree.Flush: flush in progress failed: %v", err)
+	}
 	// Make sure it looks like more than 5 minutes have passed.
 	tree.lastFlushed = time.Unix(0, 0)
 	return tree.FlushIfNotDoneRecently()
 }
 
+type graftOptions struct {
+	force          bool
+	parentModified uint32
+}
+
+// GraftOption follows the functional options pattern to pass options to Graft.
+type GraftOption func(*graftOptions)
+
+// GraftForce makes Graft replace the node at the destination even if
+// it, or any node below it, is in use. Data written through fids
+// referring to the replaced nodes will be lost.
+func GraftForce(value bool) GraftOption {
+	return func(opts *graftOptions) {
+		opts.force = value
+	}
+}
+
+// GraftParentModified makes Graft set the modification time of the
+// parent to the given one, e.g., that of the parent of the grafted
+// node in its source revision, rather than leaving it alone or setting
+// it to the current time. Zero means no change.
+func GraftParentModified(seconds uint32) GraftOption {
+	return func(opts *graftOptions) {
+		opts.parentModified = seconds
+	}
+}
+
 // Graft is a low-level operation. The child may come from a historical tree.
 // The parent from the local tree. We will make the child a child of
-// the parent.
-func (tree *Tree) Graft(parent *Node, child *Node, childName string) error {
+// the parent. If the parent already has a child with the given name,
+// that child is replaced, unless it or any node below it is in use,
+// in which case the error wraps linuxerr.EBUSY.
+func (tree *Tree) Graft(parent *Node, child *Node, childName string, options ...GraftOption) error {
+	var opts graftOptions
+	for _, o := range options {
+		o(&opts)
+	}
 	if e := tree.Grow(parent); e != nil {
 		return e
 	}
-	if node, err := parent.followBranch(childName); err != nil {
+	if node, err := tree.followBranch(parent, childName); err != nil {
 		return err
 	} else if node != nil {
-		if node.refs > 0 {
+		if !opts.force && node.InUse() {
 			return fmt.Errorf("%q: %w", childName, linuxerr.EBUSY)
 		}
-		if err := tree.RemoveForMerge(node); err != nil {
+		if err := tree.removeForMerge(node, opts.force); err != nil {
 			return fmt.Errorf("tree.Tree.Graft: parent: %v: %w", parent, err)
 		}
 	}
@@ -227,6 +509,13 @@ func (tree *Tree) Graft(parent *Node, child *Node, childName string) error {
 	}
 	child.info.Name = childName
 	child.markDirty()
+	// The child may have been dirty already, e.g., the root of a tree
+	// loaded under another name, in which case the above stops short
+	// of its new ancestors.
+	parent.markDirty()
+	if opts.parentModified != 0 {
+		parent.Touch(opts.parentModified)
+	}
 	return nil
 }
 
@@ -250,6 +539,12 @@ func (tree *Tree) Rename(sourcepath, targetpath string) error {
 
 	snames := strings.Split(sourcepath, "/")
 	tnames := strings.Split(targetpath, "/")
+	name, err := tree.CheckName(tnames[len(tnames)-1])
+	if err != nil {
+		return err
+	}
+	tnames[len(tnames)-1] = name
+	targetpath = strings.Join(tnames, "/")
 
 	snodes, err := tree.trywalk(snames)
 	if err != nil {
@@ -302,6 +597,17 @@ func (tree *Tree) Rename(sourcepath, targetpath string) error {
 		}
 	}
 
+	// Names that differ in case only may refer to the same nodes
+	// in case-insensitive trees, which the checks on paths above miss.
+	if target == source {
+		target = nil
+	}
+	for n := targetparent; n != nil; n = n.parent {
+		if n == source {
+			return fmt.Errorf("nesting: %w", linuxerr.EINVAL)
+		}
+	}
+
 	if target != nil {
 		if target.info.Mode&DMDIR != 0 && source.info.Mode&DMDIR == 0 {
 			return fmt.Errorf("file to directory: %w", linuxerr.EISDIR)
@@ -330,6 +636,7 @@ func (tree *Tree) Rename(sourcepath, targetpath string) error {
 	source.info.Name = tnames[len(tnames)-1]
 	source.parent = targetparent
 	targetparent.children = append(targetparent.children, source)
+	targetparent.info.Version++
 	sourceparent.markDirty()
 	source.markDirty()
 	// The source may already be dirty, and fail to propagate the flag to the root of the tree!
@@ -338,6 +645,10 @@ func (tree *Tree) Rename(sourcepath, targetpath string) error {
 }
 
 func (tree *Tree) Trim() {
+	// Nodes being flushed can't be reloaded from the staging area yet.
+	if tree.pending != nil {
+		return
+	}
 	if time.Since(tree.lastTrimmed) > time.Minute {
 		tree.root.trim()
 		godebug.FreeOSMemory()
@@ -2,7 +2,9 @@ package tree
 
 import (
 	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/nicolagi/muscle/internal/linuxerr"
 	"github.com/stretchr/testify/assert"
@@ -75,6 +77,56 @@ func TestTreeWalking(t *testing.T) {
 	assert.Equal(t, "/foo/bar", nodes[1].Path())
 }
 
+func TestTreeCaseInsensitive(t *testing.T) {
+	tree, err := NewTree(newTestStore(t), WithMutable(), WithCaseInsensitive(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	dir, err := tree.Add(root, "Dir", 0700|DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := tree.Add(dir, "ReadMe", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := tree.Walk(root, "dir", "README")
+	assert.Nil(t, err)
+	assert.Equal(t, []*Node{dir, file}, nodes)
+	assert.Equal(t, "/Dir/ReadMe", file.Path())
+
+	_, err = tree.Add(dir, "readme", 0600)
+	assert.True(t, errors.Is(err, ErrExist))
+
+	// Changing case only renames the node in place.
+	if err := tree.Rename("dir/readme", "dir/README"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/Dir/README", file.Path())
+	assert.Len(t, dir.children, 1)
+
+	// Moving a directory within itself is caught regardless of case.
+	err = tree.Rename("Dir", "dir/sub")
+	assert.True(t, errors.Is(err, linuxerr.EINVAL))
+
+	// An exact match wins over a case-insensitive one, e.g., for names
+	// created before the option was set.
+	tree.caseInsensitive = false
+	other, err := tree.Add(root, "DIR", 0700|DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.caseInsensitive = true
+	nodes, err = tree.Walk(root, "DIR")
+	assert.Nil(t, err)
+	assert.Equal(t, []*Node{other}, nodes)
+	nodes, err = tree.Walk(root, "Dir")
+	assert.Nil(t, err)
+	assert.Equal(t, []*Node{dir}, nodes)
+}
+
 func newTestTree(t *testing.T) *Tree {
 	t.Helper()
 	treeStore := newTestStore(t)
@@ -84,3 +136,514 @@ func newTestTree(t *testing.T) *Tree {
 	}
 	return tree
 }
+
+func TestTreeFlushStats(t *testing.T) {
+	tree, err := NewTree(newTestStore(t), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	child, err := tree.Add(root, "file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	dirty := tree.ListDirtyNodes()
+	if got, want := len(dirty), 2; got != want {
+		t.Fatalf("got %d, want %d dirty nodes", got, want)
+	}
+	if got, want := dirty[1].Path, "root/file"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := dirty[1].Size, uint64(5); got != want {
+		t.Errorf("got %d, want %d bytes", got, want)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	stats := tree.LastFlushStats()
+	if stats.Nodes != 2 || stats.Blocks != 1 || stats.Bytes != 5 {
+		t.Errorf("got %v, want 2 nodes, 1 block, 5 bytes", stats)
+	}
+	if got := tree.ListDirtyNodes(); len(got) != 0 {
+		t.Errorf("got %v, want no dirty nodes after flush", got)
+	}
+}
+
+func TestTreeFlushInterval(t *testing.T) {
+	tree, err := NewTree(newTestStore(t), WithMutable(), WithFlushInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tree.StartFlush(); ok {
+		t.Error("flush started within the interval")
+	}
+	if err := tree.SetFlushInterval(time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	done, ok := tree.StartFlush()
+	if !ok {
+		t.Fatal("flush not started after the interval")
+	}
+	<-done
+	if err := tree.FinishFlush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.SetFlushInterval(0); err != nil || tree.FlushInterval() != SnapshotFrequency {
+		t.Errorf("got %v, %v, want %v", tree.FlushInterval(), err, SnapshotFrequency)
+	}
+	if err := tree.SetFlushInterval(-time.Second); err == nil {
+		t.Error("got nil error for a negative interval")
+	}
+}
+
+func TestTreeStartFlush(t *testing.T) {
+	tree, err := NewTree(newTestStore(t), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	child, err := tree.Add(root, "file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.WriteAt([]byte("one"), 0); err != nil {
+		t.Fatal(err)
+	}
+	flushed := func() string {
+		t.Helper()
+		key, err := tree.store.LocalRootKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := NewTree(tree.store, WithRoot(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes, err := other.Walk(other.Attach(), "file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 3)
+		if _, err := nodes[0].ReadAt(b, 0); err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	done, ok := tree.StartFlush()
+	if !ok {
+		t.Fatal("flush not started")
+	}
+	// Changes made while the flush is in progress are not part of it.
+	if err := child.WriteAt([]byte("two"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := tree.StartFlush(); again != done {
+		t.Error("started a second flush while one is in progress")
+	}
+	<-done
+	if err := tree.FinishFlush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(tree.ListDirtyNodes()); got != 2 {
+		t.Errorf("got %d, want 2 dirty nodes after the flush", got)
+	}
+	if got := flushed(); got != "one" {
+		t.Errorf("got %q, want the content when the flush started", got)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := flushed(); got != "two" {
+		t.Errorf("got %q, want the latest content", got)
+	}
+}
+
+func TestTreeFlushDirtyChildren(t *testing.T) {
+	tree, err := NewTree(newTestStore(t), WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	a, err := tree.Add(root, "a", 0700|DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.Add(root, "b", 0700|DMDIR); err != nil {
+		t.Fatal(err)
+	}
+	var file *Node
+	for _, name := range []string{"f1", "f2", "f3"} {
+		if file, err = tree.Add(a, name, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatal(err)
+	}
+	// The file is already dirty when moved to a clean directory.
+	if err := tree.Rename("a/f3", "b/f3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tree.LastFlushStats().Nodes, 4; got != want {
+		t.Errorf("got %d, want %d nodes flushed", got, want)
+	}
+	key, err := tree.store.LocalRootKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewTree(tree.store, WithRoot(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := other.Walk(other.Attach(), "b", "f3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := nodes[1].Info().Size; got != 4 {
+		t.Errorf("got size %d, want 4", got)
+	}
+}
+
+func TestTreeSmallBlocks(t *testing.T) {
+	tree, err := NewTree(newTestStore(t), WithMutable(), WithSmallBlocks(4, []string{"*.log"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	for _, c := range []struct {
+		name  string
+		perm  uint32
+		bsize uint32
+	}{
+		{"app.log", 0600, 4},
+		{"journal", 0600 | DMAPPEND, 4},
+		{"notes.txt", 0600, tree.blockSize},
+		{"logs.log", 0700 | DMDIR, tree.blockSize},
+	} {
+		node, err := tree.Add(root, c.name, c.perm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.bsize != c.bsize {
+			t.Errorf("%s: got block size %d, want %d", c.name, node.bsize, c.bsize)
+		}
+		if c.perm&DMDIR != 0 {
+			continue
+		}
+		if err := node.WriteAt([]byte("0123456789"), 0); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 10)
+		if n, err := node.ReadAt(b, 0); err != nil || string(b[:n]) != "0123456789" {
+			t.Errorf("%s: got %q, %v", c.name, b[:n], err)
+		}
+	}
+	if _, err := NewTree(newTestStore(t), WithSmallBlocks(4, []string{"["})); err == nil {
+		t.Error("got no error for a malformed pattern")
+	}
+}
+
+func TestTreeAppendOnlySealsFilledBlocks(t *testing.T) {
+	tree, err := NewTree(newTestStore(t), WithMutable(), WithSmallBlocks(4, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := tree.Root()
+	node, err := tree.Add(root, "journal", 0600|DMAPPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing to seal, in an empty file.
+	if err := node.WriteAt(nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"012", "3456", "789"} {
+		if err := node.WriteAt([]byte(s), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := len(node.blocks); got != 3 {
+		t.Fatalf("got %d, want 3 blocks", got)
+	}
+	for i, b := range node.blocks {
+		sealed := b.Ref().Len() == 32
+		if want := i < 2; sealed != want {
+			t.Errorf("block %d: got sealed %v, want %v", i, sealed, want)
+		}
+	}
+	b := make([]byte, 16)
+	if n, err := node.ReadAt(b, 0); err != nil || string(b[:n]) != "0123456789" {
+		t.Errorf("got %q, %v", b[:n], err)
+	}
+}
+
+func TestTreeAccess(t *testing.T) {
+	newFile := func(policy string) (*Tree, *Node) {
+		t.Helper()
+		tree, err := NewTree(newTestStore(t), WithMutable(), WithAtime(policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, root := tree.Root()
+		node, err := tree.Add(root, "file", 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return tree, node
+	}
+	t.Run("off", func(t *testing.T) {
+		tree, node := newFile(AtimeOff)
+		tree.Access(node)
+		if node.info.Accessed != 0 || len(tree.ListDirtyNodes()) != 0 {
+			t.Errorf("got access time %d", node.info.Accessed)
+		}
+	})
+	t.Run("on", func(t *testing.T) {
+		tree, node := newFile(AtimeOn)
+		node.info.Accessed = node.info.Modified + 1
+		tree.Access(node)
+		if node.info.Accessed == node.info.Modified+1 || len(tree.ListDirtyNodes()) != 2 {
+			t.Errorf("got access time %d", node.info.Accessed)
+		}
+	})
+	t.Run("relatime", func(t *testing.T) {
+		tree, node := newFile(AtimeRelative)
+		tree.Access(node)
+		if node.info.Accessed == 0 {
+			t.Fatal("access time not set")
+		}
+		if err := tree.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		// Not older than the modification time, nor than a day.
+		node.info.Modified -= 10
+		node.info.Accessed = node.info.Modified + 1
+		tree.Access(node)
+		if node.info.Accessed != node.info.Modified+1 || len(tree.ListDirtyNodes()) != 0 {
+			t.Errorf("got access time %d", node.info.Accessed)
+		}
+	})
+	if _, err := NewTree(newTestStore(t), WithAtime("sometimes")); err == nil {
+		t.Error("got no error for an unknown policy")
+	}
+}
+
+func TestTreeIgnore(t *testing.T) {
+	const revision = "50f6060602543d6825a84ed5b6bd215df6944cf1a41f283a9329d41c2c70c956"
+	tree := newTestTree(t)
+	if err := tree.Ignore(revision, "src/*.go"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Ignore(AnyRevision, "notes"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Ignore(revision, "["); err == nil {
+		t.Error("got nil, want error for malformed pattern")
+	}
+	assert.True(t, tree.isIgnored(revision, "src/main.go"))
+	assert.False(t, tree.isIgnored(revision, "src/lib/main.go"))
+	assert.False(t, tree.isIgnored("other", "src/main.go"))
+	assert.True(t, tree.isIgnored("other", "notes"))
+	assert.Equal(t, []string{"*/notes", revision + "/src/*.go"}, tree.IgnoreRules())
+	assert.True(t, tree.Unignore(revision, "src/*.go"))
+	assert.False(t, tree.Unignore(revision, "src/*.go"))
+	assert.False(t, tree.isIgnored(revision, "src/main.go"))
+}
+
+func TestTreeGraft(t *testing.T) {
+	setUp := func(t *testing.T) (tree *Tree, root, file, donor *Node) {
+		tree = newTestTree(t)
+		_, root = tree.Root()
+		dir, err := tree.Add(root, "dir", 0700|DMDIR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file, err = tree.Add(dir, "file", 0600); err != nil {
+			t.Fatal(err)
+		}
+		other := newTestTree(t)
+		_, otherRoot := other.Root()
+		if donor, err = other.Add(otherRoot, "donor", 0700|DMDIR); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	t.Run("refuses to replace a subtree with open files", func(t *testing.T) {
+		tree, root, file, donor := setUp(t)
+		file.Ref()
+		err := tree.Graft(root, donor, "dir")
+		if !errors.Is(err, linuxerr.EBUSY) {
+			t.Errorf("got %v, want a wrapper of %v", err, linuxerr.EBUSY)
+		}
+		assert.False(t, file.Unlinked())
+	})
+	t.Run("replaces a subtree with open files if forced", func(t *testing.T) {
+		tree, root, file, donor := setUp(t)
+		file.Ref()
+		if err := tree.Graft(root, donor, "dir", GraftForce(true)); err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, file.Unlinked())
+		nodes, err := tree.Walk(root, "dir")
+		assert.Nil(t, err)
+		assert.Equal(t, []*Node{donor}, nodes)
+	})
+	t.Run("sets the parent modification time if requested", func(t *testing.T) {
+		tree, root, _, donor := setUp(t)
+		if err := tree.Graft(root, donor, "dir", GraftParentModified(1234567890)); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, uint32(1234567890), root.Info().Modified)
+	})
+}
+
+func TestTreeReplace(t *testing.T) {
+	setUp := func(t *testing.T) (tree *Tree, file *Node, other *Tree) {
+		tree = newTestTree(t)
+		_, root := tree.Root()
+		var err error
+		if file, err = tree.Add(root, "file", 0600); err != nil {
+			t.Fatal(err)
+		}
+		other = newTestTree(t)
+		_, otherRoot := other.Root()
+		for _, name := range []string{"a", "b"} {
+			if _, err := other.Add(otherRoot, name, 0700|DMDIR); err != nil {
+				t.Fatal(err)
+			}
+		}
+		otherRoot.Touch(1234567890)
+		return
+	}
+	t.Run("refuses to replace nodes in use", func(t *testing.T) {
+		tree, file, other := setUp(t)
+		file.Ref()
+		err := tree.Replace(other.Attach())
+		if !errors.Is(err, linuxerr.EBUSY) {
+			t.Errorf("got %v, want a wrapper of %v", err, linuxerr.EBUSY)
+		}
+		assert.False(t, file.Unlinked())
+	})
+	t.Run("replaces children and keeps the root", func(t *testing.T) {
+		tree, file, other := setUp(t)
+		_, root := tree.Root()
+		root.Ref()
+		if err := tree.Replace(other.Attach()); err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, file.Unlinked())
+		_, after := tree.Root()
+		assert.Equal(t, root, after)
+		var names []string
+		for _, c := range after.Children() {
+			names = append(names, c.Info().Name)
+			assert.Equal(t, after, c.parent)
+		}
+		assert.Equal(t, []string{"a", "b"}, names)
+		assert.Equal(t, uint32(1234567890), after.Info().Modified)
+	})
+	t.Run("changes nothing if the new children can't be added", func(t *testing.T) {
+		tree, file, other := setUp(t)
+		other.Attach().Children()[1].info.Name = "a"
+		if err := tree.Replace(other.Attach()); !errors.Is(err, ErrExist) {
+			t.Errorf("got %v, want a wrapper of %v", err, ErrExist)
+		}
+		assert.False(t, file.Unlinked())
+		_, root := tree.Root()
+		assert.Equal(t, []*Node{file}, root.Children())
+	})
+	t.Run("replaces only the named children", func(t *testing.T) {
+		tree, file, other := setUp(t)
+		file.Ref()
+		if err := tree.ReplaceChildren(other.Attach(), []string{"a", "missing"}); err != nil {
+			t.Fatal(err)
+		}
+		assert.False(t, file.Unlinked())
+		_, root := tree.Root()
+		var names []string
+		for _, c := range root.Children() {
+			names = append(names, c.Info().Name)
+		}
+		assert.Equal(t, []string{"file", "a"}, names)
+	})
+	t.Run("keeps names stored by older revisions", func(t *testing.T) {
+		tree, _, other := setUp(t)
+		legacy := []string{strings.Repeat("x", 300), "trailing "}
+		for i, c := range other.Attach().Children() {
+			c.info.Name = legacy[i]
+		}
+		if err := tree.Replace(other.Attach()); err != nil {
+			t.Fatal(err)
+		}
+		_, root := tree.Root()
+		var names []string
+		for _, c := range root.Children() {
+			names = append(names, c.Info().Name)
+		}
+		assert.Equal(t, legacy, names)
+	})
+}
+
+func TestTreeLoadedKeys(t *testing.T) {
+	s := newTestStore(t)
+	live, err := NewTree(s, WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := live.Root()
+	dir, err := live.Add(root, "dir", 0700|DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, parent := range []*Node{root, dir} {
+		f, err := live.Add(parent, "file", 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.WriteAt([]byte(parent.info.Name), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := live.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the root and its children are loaded.
+	live, err = NewTree(s, WithRoot(root.pointer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := live.Walk(live.root, "dir"); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]struct{})
+	unloaded := live.LoadedKeys(got)
+	if len(unloaded) != 1 {
+		t.Fatalf("got %d nodes not loaded, want 1", len(unloaded))
+	}
+	if err := s.AddReachableKeys(unloaded, got); err != nil {
+		t.Fatal(err)
+	}
+	want, err := live.ReachableKeys(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(want, live.revision.Hex())
+	assert.Equal(t, want, got)
+}
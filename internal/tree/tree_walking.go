@@ -2,9 +2,13 @@ package tree
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/nicolagi/muscle/internal/linuxerr"
+	"github.com/nicolagi/muscle/internal/storage"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -19,21 +23,49 @@ func (tree *Tree) walk(sourceNode *Node, growFn func(*Node) error, branchNames .
 		return
 	}
 	n := sourceNode
+	depth, err := tree.depth(n)
+	if err != nil {
+		return
+	}
 	for _, name := range branchNames {
 		if err = growFn(n); err != nil {
 			break
 		}
-		if n, err = n.followBranch(name); err != nil {
+		parent := n
+		if n, err = tree.followBranch(n, name); err != nil {
 			break
 		} else if n == nil {
 			err = fmt.Errorf("child %q: %w", name, ErrNotExist)
 			break
 		}
+		if name == ".." {
+			if depth > 0 {
+				depth--
+			}
+		} else if depth++; depth > tree.maxDepth {
+			err = fmt.Errorf("child %q: deeper than %d: %w", name, tree.maxDepth, linuxerr.ELOOP)
+			break
+		} else if parent.hasAncestor(n) {
+			err = fmt.Errorf("child %q: loop: %w", name, linuxerr.ELOOP)
+			break
+		}
 		visitedNodes = append(visitedNodes, n)
 	}
 	return
 }
 
+// depth returns the number of ancestors of the node, failing if it is
+// more than the tree's maximum depth, which also catches loops.
+func (tree *Tree) depth(node *Node) (int, error) {
+	depth := 0
+	for p := node.parent; p != nil; p = p.parent {
+		if depth++; depth > tree.maxDepth {
+			return 0, fmt.Errorf("%q: deeper than %d: %w", node.info.Name, tree.maxDepth, linuxerr.ELOOP)
+		}
+	}
+	return depth, nil
+}
+
 // trywalk walks as many names as possible starting from the root.
 // The returned list of nodes may be shorter than the list of names, but no error is set in this case.
 // An error is returned in case of errors loading data, or in the case a non-directory needs to be traversed.
@@ -46,7 +78,7 @@ func (tree *Tree) trywalk(names []string) (nodes []*Node, err error) {
 		if n.info.Mode&DMDIR == 0 {
 			return nodes, fmt.Errorf("%q: %w", n.info.Name, linuxerr.ENOTDIR)
 		}
-		if n, err = n.followBranch(name); n == nil || err != nil {
+		if n, err = tree.followBranch(n, name); n == nil || err != nil {
 			break
 		}
 		nodes = append(nodes, n)
@@ -68,24 +100,92 @@ func (tree *Tree) Grow(parent *Node) error {
 	return tree.grow(parent, tree.store.LoadNode)
 }
 
+// LoadFailure describes a child node that could not be loaded.
+type LoadFailure struct {
+	Key   storage.Pointer
+	Store string // Where the node is stored, "staging" or "repository".
+	Err   error
+}
+
+func (f LoadFailure) String() string {
+	return fmt.Sprintf("%v (%s): %v", f.Key, f.Store, f.Err)
+}
+
+// GrowError lists the children of a node that could not be loaded.
+// The other children are loaded, the failed ones are marked as such
+// (see DumpNodes) and are loaded again on the next grow, e.g., by the
+// RetryLoad method.
+type GrowError struct {
+	Path     string
+	Failures []LoadFailure
+}
+
+func (e *GrowError) Error() string {
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "loading %d children of %q:", len(e.Failures), e.Path)
+	for _, f := range e.Failures {
+		_, _ = fmt.Fprintf(&b, " %v;", f)
+	}
+	return strings.TrimSuffix(b.String(), ";")
+}
+
+// Unwrap returns the first failure's error, so that, e.g., a missing
+// node can be told apart from a storage failure.
+func (e *GrowError) Unwrap() error {
+	return e.Failures[0].Err
+}
+
 // TODO: load should take a context for cancellation.
 func (tree *Tree) grow(parent *Node, load func(*Node) error) error {
-	const method = "Tree.grow"
 	semc := make(chan struct{}, 8)
 	g, _ := errgroup.WithContext(context.Background())
-	for _, child := range parent.children {
+	failures := make([]*LoadFailure, len(parent.children))
+	for i, child := range parent.children {
 		if child.flags&loaded != 0 {
 			continue
 		}
-		child := child
+		i, child := i, child
 		g.Go(func() error {
 			semc <- struct{}{}
 			defer func() { <-semc }()
 			if err := load(child); err != nil {
-				return errorf(method, "loading a child of %q: %v", parent.Path(), err)
+				store := "repository"
+				if len(child.pointer) != sha256.Size {
+					store = "staging"
+				}
+				failures[i] = &LoadFailure{Key: child.pointer, Store: store, Err: err}
 			}
 			return nil
 		})
 	}
-	return g.Wait()
+	_ = g.Wait()
+	var gerr *GrowError
+	for i, child := range parent.children {
+		if failures[i] == nil {
+			child.flags &^= loadFailed
+			continue
+		}
+		child.flags |= loadFailed
+		if gerr == nil {
+			gerr = &GrowError{Path: parent.Path()}
+		}
+		gerr.Failures = append(gerr.Failures, *failures[i])
+	}
+	if gerr != nil {
+		return gerr
+	}
+	return nil
+}
+
+// RetryLoad loads the children of the node that aren't loaded yet,
+// typically because they failed to load before, and returns those that
+// still fail to load, if any.
+func (tree *Tree) RetryLoad(node *Node) ([]LoadFailure, error) {
+	var gerr *GrowError
+	if err := tree.Grow(node); errors.As(err, &gerr) {
+		return gerr.Failures, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return nil, nil
 }
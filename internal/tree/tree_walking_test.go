@@ -2,11 +2,13 @@ package tree
 
 import (
 	"errors"
+	"fmt"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/fortytw2/leaktest"
+	"github.com/nicolagi/muscle/internal/linuxerr"
 	"github.com/nicolagi/muscle/internal/storage"
 	"github.com/stretchr/testify/assert"
 )
@@ -56,7 +58,7 @@ func TestWalk(t *testing.T) {
 			t.Errorf("got %v, want %v nodes", got, want)
 		}
 		if !errors.Is(err, growErr) {
-			t.Errorf("got %v, want %w", err, growErr)
+			t.Errorf("got %v, want %v", err, growErr)
 		}
 	})
 	t.Run("interrupting walk at second step", func(t *testing.T) {
@@ -78,7 +80,53 @@ func TestWalk(t *testing.T) {
 			t.Errorf("got %v, want %v nodes", got, want)
 		}
 		if !errors.Is(err, ErrNotExist) {
-			t.Errorf("got %v, want %w", err, ErrNotExist)
+			t.Errorf("got %v, want %v", err, ErrNotExist)
+		}
+	})
+	t.Run("walking into an ancestor", func(t *testing.T) {
+		var a, b Node
+		a.flags = loaded
+		b.flags = loaded
+		b.info.Name = "usr"
+		if err := a.addChild(&b); err != nil {
+			t.Fatalf("%+v", err)
+		}
+		// As if b were a link to a.
+		b.children = append(b.children, &a)
+		a.info.Name = "loop"
+		visited, err := oak.Walk(&a, "usr", "..", "usr", "loop")
+		if got, want := len(visited), 3; got != want {
+			t.Fatalf("got %v, want %v nodes", got, want)
+		}
+		if !errors.Is(err, linuxerr.ELOOP) {
+			t.Errorf("got %v, want %v", err, linuxerr.ELOOP)
+		}
+	})
+	t.Run("walking too deep", func(t *testing.T) {
+		shallow, err := NewTree(newTestStore(t), WithMutable(), WithMaxDepth(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, root := shallow.Root()
+		n := root
+		for _, name := range []string{"a", "b", "c"} {
+			if n, err = shallow.Add(n, name, 0700|DMDIR); err != nil {
+				t.Fatal(err)
+			}
+		}
+		visited, err := shallow.Walk(root, "a", "b", "..", "b")
+		if len(visited) != 4 || err != nil {
+			t.Errorf("got %d nodes and %v, want 4 nodes and no error", len(visited), err)
+		}
+		visited, err = shallow.Walk(root, "a", "b", "c")
+		if got, want := len(visited), 2; got != want {
+			t.Fatalf("got %v, want %v nodes", got, want)
+		}
+		if !errors.Is(err, linuxerr.ELOOP) {
+			t.Errorf("got %v, want %v", err, linuxerr.ELOOP)
+		}
+		if _, err := shallow.Walk(n, ".."); !errors.Is(err, linuxerr.ELOOP) {
+			t.Errorf("got %v, want %v", err, linuxerr.ELOOP)
 		}
 	})
 	t.Run("successfully walking two steps", func(t *testing.T) {
@@ -201,6 +249,43 @@ func TestGrow(t *testing.T) {
 		assert.Equal(t, "usr", thirdName)
 		assert.Equal(t, int32(3), atomic.LoadInt32(&loadCounter))
 	})
+	t.Run("failures are reported per child and retried", func(t *testing.T) {
+		a := new(Node)
+		for i := 0; i < 3; i++ {
+			if err := a.addChildPointer(storage.RandomPointer()); err != nil {
+				t.Fatalf("%+v", err)
+			}
+		}
+		failing := map[*Node]bool{a.children[0]: true, a.children[2]: true}
+		load := func(node *Node) error {
+			if failing[node] {
+				return fmt.Errorf("load: %w", storage.ErrNotFound)
+			}
+			node.flags |= loaded
+			return nil
+		}
+		err := oak.grow(a, load)
+		var gerr *GrowError
+		if !errors.As(err, &gerr) {
+			t.Fatalf("got %v, want a *GrowError", err)
+		}
+		assert.True(t, errors.Is(err, storage.ErrNotFound))
+		if assert.Len(t, gerr.Failures, 2) {
+			assert.Equal(t, a.children[0].pointer, gerr.Failures[0].Key)
+			assert.Equal(t, "repository", gerr.Failures[0].Store)
+			assert.Equal(t, a.children[2].pointer, gerr.Failures[1].Key)
+		}
+		assert.NotZero(t, a.children[0].flags&loadFailed)
+		assert.Zero(t, a.children[1].flags&loadFailed)
+
+		delete(failing, a.children[0])
+		err = oak.grow(a, load)
+		if assert.True(t, errors.As(err, &gerr)) {
+			assert.Len(t, gerr.Failures, 1)
+		}
+		assert.Zero(t, a.children[0].flags&loadFailed)
+		assert.NotZero(t, a.children[2].flags&loadFailed)
+	})
 }
 
 func TestGrowParallelizationLimit(t *testing.T) {
@@ -2,6 +2,8 @@ package tree
 
 import (
 	"fmt"
+	"path"
+	"time"
 
 	"github.com/nicolagi/muscle/internal/storage"
 )
@@ -67,3 +69,106 @@ func WithRootName(name string) TreeOption {
 		return nil
 	}
 }
+
+// WithSmallBlocks makes new files use blocks of the given size, rather
+// than the default one, if they are append-only or their name matches
+// any of the given patterns (see path.Match), e.g., "*.log" or "mbox".
+// Changing a few bytes in a file, or appending to it, re-uploads only
+// the blocks affected, so smaller blocks cut upload volume for files
+// that change often, at the cost of more blocks and larger metadata.
+// A zero size disables the option.
+func WithSmallBlocks(size uint32, patterns []string) TreeOption {
+	const method = "WithSmallBlocks"
+	return func(t *Tree) error {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return errorf(method, "pattern %q: %v", p, err)
+			}
+		}
+		t.smallBlockSize = size
+		t.smallBlockPatterns = patterns
+		return nil
+	}
+}
+
+// Policies for updating access times, see WithAtime.
+const (
+	AtimeOff      = "off"
+	AtimeRelative = "relatime"
+	AtimeOn       = "on"
+)
+
+// WithAtime specifies when Tree.Access updates access times: never
+// (AtimeOff, the default), on every access (AtimeOn), or like Linux's
+// relatime mount option, i.e., only if the access time is older than
+// the modification time or than a day (AtimeRelative). Access times are
+// part of the node metadata, so updating them makes nodes dirty.
+func WithAtime(policy string) TreeOption {
+	const method = "WithAtime"
+	return func(t *Tree) error {
+		switch policy {
+		case "", AtimeOff, AtimeRelative, AtimeOn:
+			t.atime = policy
+			return nil
+		default:
+			return errorf(method, "unknown policy %q", policy)
+		}
+	}
+}
+
+// WithCaseInsensitive makes the tree look up names ignoring case, for
+// clients that expect it, e.g., on macOS and Windows. Names are still
+// stored as given on creation (or rename), and a name that matches
+// exactly takes precedence over one that matches ignoring case.
+func WithCaseInsensitive(value bool) TreeOption {
+	return func(t *Tree) error {
+		t.caseInsensitive = value
+		return nil
+	}
+}
+
+// WithNamePolicy specifies what CheckName does with names of new or
+// renamed nodes that are not valid UTF-8 or have trailing spaces:
+// accept them (NamesAllow, the default), reject them (NamesReject), or
+// fix them (NamesNormalize).
+func WithNamePolicy(policy string) TreeOption {
+	const method = "WithNamePolicy"
+	return func(t *Tree) error {
+		switch policy {
+		case "", NamesAllow, NamesReject, NamesNormalize:
+			t.namePolicy = policy
+			return nil
+		default:
+			return errorf(method, "unknown policy %q", policy)
+		}
+	}
+}
+
+// WithMaxDepth sets the maximum depth of nodes that walks and diffs
+// may reach, the root being at depth zero. Going deeper fails with an
+// error wrapping linuxerr.ELOOP, as does walking into an ancestor, so
+// that loops, e.g., due to links, can't make them run forever. Zero
+// means DefaultMaxDepth.
+func WithMaxDepth(depth int) TreeOption {
+	const method = "WithMaxDepth"
+	return func(t *Tree) error {
+		switch {
+		case depth < 0:
+			return errorf(method, "negative depth %d", depth)
+		case depth == 0:
+			t.maxDepth = DefaultMaxDepth
+		default:
+			t.maxDepth = depth
+		}
+		return nil
+	}
+}
+
+// WithFlushInterval sets the minimum time between flushes made by
+// FlushIfNotDoneRecently and StartFlush, see also SetFlushInterval.
+// Zero means SnapshotFrequency.
+func WithFlushInterval(d time.Duration) TreeOption {
+	return func(t *Tree) error {
+		return t.SetFlushInterval(d)
+	}
+}
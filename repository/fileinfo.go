@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// fileInfo adapts the metadata of a tree node to os.FileInfo.
+type fileInfo struct {
+	info tree.NodeInfo
+}
+
+var _ os.FileInfo = fileInfo{}
+
+func (fi fileInfo) Name() string { return fi.info.Name }
+
+func (fi fileInfo) Size() int64 { return int64(fi.info.Size) }
+
+func (fi fileInfo) Mode() os.FileMode {
+	m := os.FileMode(fi.info.Mode & 0777)
+	if fi.info.Mode&tree.DMDIR != 0 {
+		m |= os.ModeDir
+	}
+	if fi.info.Mode&tree.DMAPPEND != 0 {
+		m |= os.ModeAppend
+	}
+	if fi.info.Mode&tree.DMEXCL != 0 {
+		m |= os.ModeExclusive
+	}
+	return m
+}
+
+func (fi fileInfo) ModTime() time.Time { return time.Unix(int64(fi.info.Modified), 0) }
+
+func (fi fileInfo) IsDir() bool { return fi.info.Mode&tree.DMDIR != 0 }
+
+// Sys returns nil, as the underlying metadata is internal to muscle.
+func (fi fileInfo) Sys() interface{} { return nil }
+
+func sortByName(entries []os.FileInfo) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+}
@@ -0,0 +1,246 @@
+// Package repository provides read-only access to the revisions
+// pushed by musclefs, for programs such as backup verifiers and
+// exporters that need to be written against muscle without linking
+// its internal packages.
+//
+// A repository is opened from a muscle base directory, the same one
+// used by musclefs and muscle (see Open). Revisions are looked up by
+// tag or by key, and their files are read by slash-separated paths
+// relative to the revision's root directory:
+//
+//	repo, err := repository.Open("")
+//	...
+//	rev, err := repo.Tag("base")
+//	...
+//	b, err := rev.ReadFile("notes/todo.txt")
+//
+// Nothing in this package modifies the repository, although reading
+// populates the local cache like musclefs does.
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/internal/config"
+	"github.com/nicolagi/muscle/internal/storage"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+// ErrNoRevision is returned when a tag does not point to any revision.
+var ErrNoRevision = errors.New("no revision")
+
+// Repository gives access to the revisions in a muscle store.
+type Repository struct {
+	store *tree.Store
+}
+
+// Open opens the repository configured in the given muscle base
+// directory. An empty base means the default one, i.e., $MUSCLE_BASE
+// or $HOME/lib/muscle.
+func Open(base string) (*Repository, error) {
+	if base == "" {
+		base = config.DefaultBaseDirectoryPath
+	}
+	cfg, err := config.Load(base)
+	if err != nil {
+		return nil, fmt.Errorf("repository.Open: %w", err)
+	}
+	remote, err := storage.NewStore(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("repository.Open: %w", err)
+	}
+	// An empty log path makes the paired store read-only.
+	paired, err := storage.NewPaired(storage.NewDiskStore(cfg.CacheDirectoryPath()), remote, "")
+	if err != nil {
+		return nil, fmt.Errorf("repository.Open: %w", err)
+	}
+	factory, err := block.NewFactory(storage.NullStore{}, paired, cfg.EncryptionKeyBytes())
+	if err != nil {
+		return nil, fmt.Errorf("repository.Open: %w", err)
+	}
+	store, err := tree.NewStore(factory, remote, base)
+	if err != nil {
+		return nil, fmt.Errorf("repository.Open: %w", err)
+	}
+	return &Repository{store: store}, nil
+}
+
+// Tag returns the revision the named tag points to, e.g., "base"
+// for the latest revision pushed from any host.
+func (r *Repository) Tag(name string) (*Revision, error) {
+	tag, err := r.store.RemoteTag(name)
+	if err != nil {
+		return nil, fmt.Errorf("repository.Repository.Tag %q: %w", name, err)
+	}
+	if tag.Pointer.IsNull() {
+		return nil, fmt.Errorf("repository.Repository.Tag %q: %w", name, ErrNoRevision)
+	}
+	return r.load(tag.Pointer)
+}
+
+// Revision returns the revision with the given key, in hexadecimal,
+// as found in the output of muscle history.
+func (r *Repository) Revision(key string) (*Revision, error) {
+	p, err := storage.NewPointerFromHex(key)
+	if err != nil {
+		return nil, fmt.Errorf("repository.Repository.Revision %q: %w", key, err)
+	}
+	return r.load(p)
+}
+
+func (r *Repository) load(key storage.Pointer) (*Revision, error) {
+	rev, err := r.store.LoadRevisionByKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("repository.Repository.load %v: %w", key, err)
+	}
+	return &Revision{repo: r, rev: rev}, nil
+}
+
+// Revision is a snapshot of the file system. Its methods must not be
+// called concurrently.
+type Revision struct {
+	repo *Repository
+	rev  *tree.Revision
+	tree *tree.Tree // Loaded on first access to files.
+}
+
+// Key returns the revision key in hexadecimal.
+func (rev *Revision) Key() string { return rev.rev.Key().Hex() }
+
+// Host returns the name of the host the revision was pushed from.
+func (rev *Revision) Host() string { return rev.rev.Host() }
+
+// Time returns when the revision was pushed.
+func (rev *Revision) Time() time.Time { return rev.rev.Time() }
+
+// Parent returns the revision the named tag pointed to when this
+// revision was pushed. Following the "base" parent walks the whole
+// history. It returns ErrNoRevision for the first revision.
+func (rev *Revision) Parent(tagName string) (*Revision, error) {
+	tag, ok := rev.rev.Parent(tagName)
+	if !ok || tag.Pointer.IsNull() {
+		return nil, fmt.Errorf("repository.Revision.Parent %q: %w", tagName, ErrNoRevision)
+	}
+	return rev.repo.load(tag.Pointer)
+}
+
+// Stat returns information about the file or directory at the given
+// path. Errors for missing files wrap os.ErrNotExist.
+func (rev *Revision) Stat(name string) (os.FileInfo, error) {
+	node, err := rev.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{node.Info()}, nil
+}
+
+// ReadDir returns information about the entries of the directory at
+// the given path, sorted by name.
+func (rev *Revision) ReadDir(name string) ([]os.FileInfo, error) {
+	node, err := rev.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return rev.readDir(name, node)
+}
+
+// ReadFile returns the contents of the file at the given path.
+func (rev *Revision) ReadFile(name string) ([]byte, error) {
+	node, err := rev.lookup("read", name)
+	if err != nil {
+		return nil, err
+	}
+	if node.IsDir() {
+		return nil, &os.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	b := make([]byte, node.Info().Size)
+	n, err := node.ReadAt(b, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "read", Path: name, Err: err}
+	}
+	return b[:n], nil
+}
+
+// Walk calls fn for every file and directory in the revision, in
+// lexical order, starting with the root directory, whose path is ".".
+// If fn returns filepath.SkipDir for a directory, its contents are
+// skipped. Any other error stops the walk and is returned.
+func (rev *Revision) Walk(fn func(name string, info os.FileInfo) error) error {
+	info, err := rev.Stat(".")
+	if err != nil {
+		return err
+	}
+	return rev.walk(".", info, fn)
+}
+
+func (rev *Revision) walk(name string, info os.FileInfo, fn func(string, os.FileInfo) error) error {
+	if err := fn(name, info); err != nil {
+		if info.IsDir() && errors.Is(err, filepath.SkipDir) {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+	entries, err := rev.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := rev.walk(path.Join(name, entry.Name()), entry, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rev *Revision) lookup(op string, name string) (*tree.Node, error) {
+	if rev.tree == nil {
+		t, err := tree.NewTree(rev.repo.store, tree.WithRevision(rev.rev.Key()))
+		if err != nil {
+			return nil, &os.PathError{Op: op, Path: name, Err: err}
+		}
+		rev.tree = t
+	}
+	root := rev.tree.Attach()
+	var elems []string
+	for _, elem := range strings.Split(path.Clean("/"+name), "/") {
+		if elem != "" {
+			elems = append(elems, elem)
+		}
+	}
+	if len(elems) == 0 {
+		return root, nil
+	}
+	nodes, err := rev.tree.Walk(root, elems...)
+	if errors.Is(err, tree.ErrNotExist) {
+		return nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: name, Err: err}
+	}
+	return nodes[len(nodes)-1], nil
+}
+
+func (rev *Revision) readDir(name string, node *tree.Node) ([]os.FileInfo, error) {
+	if !node.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	if err := rev.tree.Grow(node); err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	var entries []os.FileInfo
+	for _, child := range node.Children() {
+		entries = append(entries, fileInfo{child.Info()})
+	}
+	sortByName(entries)
+	return entries, nil
+}
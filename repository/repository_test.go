@@ -0,0 +1,126 @@
+package repository
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/nicolagi/muscle/internal/block"
+	"github.com/nicolagi/muscle/internal/storage"
+	"github.com/nicolagi/muscle/internal/tree"
+)
+
+func newTestRepository(t *testing.T) *Repository {
+	t.Helper()
+	key := make([]byte, 16)
+	rand.Read(key)
+	factory, err := block.NewFactory(&storage.InMemory{}, &storage.InMemory{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := tree.NewStore(factory, &storage.InMemory{}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Repository{store: store}
+}
+
+// push creates a revision containing the given files and points the
+// base tag to it.
+func push(t *testing.T, r *Repository, files map[string]string) {
+	t.Helper()
+	lt, err := tree.NewTree(r.store, tree.WithMutable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root := lt.Root()
+	for name, content := range files {
+		parent := root
+		dir, base := filepath.Split(name)
+		if dir != "" {
+			if parent, err = lt.Add(root, filepath.Clean(dir), 0700|tree.DMDIR); err != nil {
+				t.Fatal(err)
+			}
+		}
+		node, err := lt.Add(parent, base, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := node.WriteAt([]byte(content), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := lt.Seal(); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := r.store.RemoteTags([]string{"base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, root = lt.Root()
+	revision := tree.NewRevision(root, tags)
+	if err := r.store.StoreRevision(revision); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.store.SetRemoteTags([]string{"base"}, revision.Key()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepository(t *testing.T) {
+	r := newTestRepository(t)
+	if _, err := r.Tag("base"); !errors.Is(err, ErrNoRevision) {
+		t.Fatalf("got %v, want %v", err, ErrNoRevision)
+	}
+	push(t, r, map[string]string{"a": "first"})
+	push(t, r, map[string]string{"b": "second", "dir/c": "third"})
+
+	head, err := r.Tag("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := head.ReadFile("dir/c"); err != nil {
+		t.Error(err)
+	} else if got, want := string(b), "third"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := head.ReadFile("a"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want %v", err, os.ErrNotExist)
+	}
+	var walked []string
+	err = head.Walk(func(name string, info os.FileInfo) error {
+		walked = append(walked, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{".", "b", "dir", "dir/c"}; !reflect.DeepEqual(walked, want) {
+		t.Errorf("got %v, want %v", walked, want)
+	}
+
+	parent, err := head.Parent("base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := parent.ReadFile("/a"); err != nil {
+		t.Error(err)
+	} else if got, want := string(b), "first"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := parent.Parent("base"); !errors.Is(err, ErrNoRevision) {
+		t.Errorf("got %v, want %v", err, ErrNoRevision)
+	}
+	same, err := r.Revision(parent.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := same.Stat("a"); err != nil {
+		t.Error(err)
+	} else if info.Size() != 5 || info.IsDir() || info.Mode() != 0600 {
+		t.Errorf("got size %d, mode %v", info.Size(), info.Mode())
+	}
+}